@@ -0,0 +1,64 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "fmt"
+
+// AddNameValue actions
+const (
+	// AddActionAppend adds a value to the values at name.
+	AddActionAppend = "append"
+	// AddActionOverwrite replaces all values at name.
+	AddActionOverwrite = "overwrite"
+	// AddActionAddIfAbsent sets the value only if the request has no name.
+	AddActionAddIfAbsent = "add_if_absent"
+	// AddActionOverwriteIfPresent replaces the values only if the request has name.
+	AddActionOverwriteIfPresent = "overwrite_if_present"
+)
+
+// Apply returns whether the value is added to a request that has name if
+// present, and if so whether it's appended rather than replacing the values.
+func (a AddNameValue) Apply(present bool) (add, appnd bool) {
+	switch a.Action {
+	case AddActionAppend:
+		return true, true
+	case AddActionOverwrite:
+		return true, false
+	case AddActionAddIfAbsent:
+		return !present, false
+	case AddActionOverwriteIfPresent:
+		return present, false
+	}
+	return true, a.Append
+}
+
+// validateAddActions checks the actions of the header and query adds are known
+func validateAddActions(owner string, t HTTPRequestTransforms) error {
+	check := func(kind string, adds []AddNameValue) error {
+		for _, a := range adds {
+			switch a.Action {
+			case "", AddActionAppend, AddActionOverwrite, AddActionAddIfAbsent, AddActionOverwriteIfPresent:
+			default:
+				return fmt.Errorf("%s %s add %q action must be one of %s, %s, %s or %s, got %q", owner, kind, a.Name,
+					AddActionAppend, AddActionOverwrite, AddActionAddIfAbsent, AddActionOverwriteIfPresent, a.Action)
+			}
+		}
+		return nil
+	}
+	if err := check("headers", t.HeaderTransforms.Add); err != nil {
+		return err
+	}
+	return check("query", t.QueryTransforms.Add)
+}
@@ -0,0 +1,78 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "testing"
+
+func TestAddNameValueApply(t *testing.T) {
+	tests := []struct {
+		a          AddNameValue
+		present    bool
+		wantAdd    bool
+		wantAppend bool
+	}{
+		{AddNameValue{}, false, true, false},
+		{AddNameValue{Append: true}, true, true, true},
+		{AddNameValue{Append: true, Action: AddActionOverwrite}, true, true, false},
+		{AddNameValue{Action: AddActionAppend}, false, true, true},
+		{AddNameValue{Action: AddActionAddIfAbsent}, false, true, false},
+		{AddNameValue{Action: AddActionAddIfAbsent}, true, false, false},
+		{AddNameValue{Action: AddActionOverwriteIfPresent}, true, true, false},
+		{AddNameValue{Action: AddActionOverwriteIfPresent}, false, false, false},
+	}
+	for _, test := range tests {
+		add, appnd := test.a.Apply(test.present)
+		if add != test.wantAdd || appnd != test.wantAppend {
+			t.Errorf("%#v present %t: want %t, %t, got %t, %t", test.a, test.present, test.wantAdd, test.wantAppend, add, appnd)
+		}
+	}
+}
+
+func TestValidateAddActions(t *testing.T) {
+	spec := EnvironmentSpec{
+		ID: "spec",
+		APIs: []APISpec{{
+			ID:       "api",
+			BasePath: "/v1",
+			HTTPRequestTransforms: HTTPRequestTransforms{
+				HeaderTransforms: NameValueTransforms{
+					Add: []AddNameValue{{Name: "x", Value: "x", Action: AddActionAddIfAbsent}},
+				},
+			},
+			Operations: []APIOperation{{
+				Name:        "op",
+				HTTPMatches: []HTTPMatch{{PathTemplate: "/"}},
+				HTTPRequestTransforms: HTTPRequestTransforms{
+					QueryTransforms: NameValueTransforms{
+						Add: []AddNameValue{{Name: "q", Value: "q", Action: AddActionOverwrite}},
+					},
+				},
+			}},
+		}},
+	}
+	if err := ValidateEnvironmentSpecs([]EnvironmentSpec{spec}); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+
+	spec.APIs[0].HTTPRequestTransforms.HeaderTransforms.Add[0].Action = "prepend"
+	if err := ValidateEnvironmentSpecs([]EnvironmentSpec{spec}); err == nil {
+		t.Errorf("want error for unknown API header action")
+	}
+	spec.APIs[0].HTTPRequestTransforms.HeaderTransforms.Add[0].Action = ""
+	spec.APIs[0].Operations[0].HTTPRequestTransforms.QueryTransforms.Add[0].Action = "replace"
+	if err := ValidateEnvironmentSpecs([]EnvironmentSpec{spec}); err == nil {
+		t.Errorf("want error for unknown operation query action")
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/errorset"
+)
+
+// DefaultAnalyticsProxyRevision is the proxy revision of analytics records
+// of proxies without a mapped revision.
+const DefaultAnalyticsProxyRevision = 1
+
+// AnalyticsProxyFields are the values of the proxy fields of the analytics
+// records of an API proxy so drill-downs in the Apigee UI behave like those
+// of native proxies. Unset fields default to DefaultAnalyticsProxyRevision,
+// the base path of the matched API, and the request host.
+type AnalyticsProxyFields struct {
+	Revision    int    `yaml:"revision,omitempty" mapstructure:"revision,omitempty"`
+	BasePath    string `yaml:"base_path,omitempty" mapstructure:"base_path,omitempty"`
+	VirtualHost string `yaml:"virtual_host,omitempty" mapstructure:"virtual_host,omitempty"`
+}
+
+func validateAnalyticsProxyFields(fields map[string]AnalyticsProxyFields) error {
+	var errs error
+	for proxy, f := range fields {
+		if proxy == "" {
+			errs = errorset.Append(errs, fmt.Errorf("analytics.proxy_fields must map non-empty proxy names"))
+		}
+		if f.Revision < 0 {
+			errs = errorset.Append(errs, fmt.Errorf("analytics.proxy_fields %q revision must not be negative", proxy))
+		}
+		if f.BasePath != "" && !strings.HasPrefix(f.BasePath, "/") {
+			errs = errorset.Append(errs, fmt.Errorf("analytics.proxy_fields %q base_path must begin with /", proxy))
+		}
+	}
+	return errs
+}
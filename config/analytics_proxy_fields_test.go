@@ -0,0 +1,47 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "testing"
+
+func TestAnalyticsProxyFieldsValidate(t *testing.T) {
+	tests := []struct {
+		desc    string
+		fields  map[string]AnalyticsProxyFields
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"fields", map[string]AnalyticsProxyFields{
+			"pets":   {Revision: 3, BasePath: "/v1/pets", VirtualHost: "secure"},
+			"orders": {VirtualHost: "default"},
+		}, false},
+		{"empty proxy", map[string]AnalyticsProxyFields{"": {Revision: 1}}, true},
+		{"negative revision", map[string]AnalyticsProxyFields{"pets": {Revision: -1}}, true},
+		{"relative base path", map[string]AnalyticsProxyFields{"pets": {BasePath: "v1/pets"}}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			c := Default()
+			c.Tenant.RemoteServiceAPI = "https://runtime/remote-service"
+			c.Tenant.OrgName = "org"
+			c.Tenant.EnvName = "env"
+			c.Analytics.ProxyFields = test.fields
+			err := c.Validate(false)
+			if (err != nil) != test.wantErr {
+				t.Errorf("want error %t, got %v", test.wantErr, err)
+			}
+		})
+	}
+}
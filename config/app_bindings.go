@@ -0,0 +1,121 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+)
+
+// AppBinding binds a JWT to the Apigee app verified by the consumer
+// credential: the claim value must be the value of the app's custom
+// attribute, eg. the tenant_id claim of the JWT must equal the tenant_id
+// attribute of the app of the API key. Requires an auth.Manager implementing
+// ConsumerKeyResolver, see Auth.ConsumerKeyAPI.
+type AppBinding struct {
+	// Name of the binding.
+	Name string `yaml:"name" mapstructure:"name"`
+
+	// Claim of a JWT requirement.
+	Claim JWTClaim `yaml:"claim" mapstructure:"claim"`
+
+	// AppAttribute is the custom attribute of the app the claim must equal.
+	AppAttribute string `yaml:"app_attribute" mapstructure:"app_attribute"`
+}
+
+// validateAppBindings checks bindings have unique names, app attributes, and
+// claims of existing requirements
+func validateAppBindings(c *ConsumerAuthorization, maps ...map[string]*JWTAuthentication) error {
+	if len(c.AppBindings) > 0 && len(c.In) == 0 && len(c.Alternatives) == 0 {
+		return fmt.Errorf("consumer authorization app_bindings require in or alternatives")
+	}
+	names := make(map[string]bool, len(c.AppBindings))
+	for _, b := range c.AppBindings {
+		if b.Name == "" {
+			return fmt.Errorf("consumer authorization app binding names must be non-empty")
+		}
+		if names[b.Name] {
+			return fmt.Errorf("consumer authorization app binding names must be unique, got multiple %s", b.Name)
+		}
+		names[b.Name] = true
+		if b.AppAttribute == "" {
+			return fmt.Errorf("consumer authorization app binding %q app_attribute must be non-empty", b.Name)
+		}
+		if err := validateAPIOperationParameter(&APIOperationParameter{Match: b.Claim}, maps...); err != nil {
+			return fmt.Errorf("consumer authorization app binding %q: %v", b.Name, err)
+		}
+	}
+	return nil
+}
+
+// VerifyAppBindings checks the claims of the AppBindings of the request
+// identify the app of the consumer key. Returns the first violation.
+func (e *EnvironmentSpecRequest) VerifyAppBindings(consumerKey string) error {
+	bindings := e.GetConsumerAuthorization().AppBindings
+	if len(bindings) == 0 {
+		return nil
+	}
+	resolver, ok := e.authMan.(ConsumerKeyResolver)
+	if !ok {
+		return fmt.Errorf("app bindings unsupported, auth manager cannot resolve consumer keys")
+	}
+	for _, b := range bindings {
+		value := e.getClaimValue(b.Claim)
+		if value == "" {
+			return fmt.Errorf("app binding %q: claim %q of %q missing", b.Name, b.Claim.Name, b.Claim.Requirement)
+		}
+		key, err := resolver.ResolveConsumerKey(b.AppAttribute, value)
+		if err != nil {
+			return fmt.Errorf("app binding %q: %v", b.Name, err)
+		}
+		if key != consumerKey {
+			return fmt.Errorf("app binding %q: claim %q does not match app attribute %q", b.Name, b.Claim.Name, b.AppAttribute)
+		}
+	}
+	return nil
+}
+
+// usesAppAttributes returns true if any consumer authorization of the specs
+// has app bindings or resolves client certificates by app attribute.
+func usesAppAttributes(ess []EnvironmentSpec) bool {
+	uses := func(c *ConsumerAuthorization) bool {
+		if len(c.AppBindings) > 0 {
+			return true
+		}
+		params := c.In
+		for _, alt := range c.Alternatives {
+			params = append(params[:len(params):len(params)], alt.In...)
+		}
+		for _, p := range params {
+			if cc, ok := p.Match.(ClientCertificate); ok && cc.AppAttribute != "" {
+				return true
+			}
+		}
+		return false
+	}
+	for i := range ess {
+		for j := range ess[i].APIs {
+			api := &ess[i].APIs[j]
+			if uses(&api.ConsumerAuthorization) {
+				return true
+			}
+			for k := range api.Operations {
+				if uses(&api.Operations[k].ConsumerAuthorization) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+)
+
+func TestValidateAppBindings(t *testing.T) {
+	jwtAuths := map[string]*JWTAuthentication{"tenant-jwt": {Name: "tenant-jwt"}}
+	in := []APIOperationParameter{{Match: Header("x-api-key")}}
+	claim := JWTClaim{Requirement: "tenant-jwt", Name: "tenant_id"}
+	tests := []struct {
+		desc    string
+		c       ConsumerAuthorization
+		wantErr string
+	}{
+		{"none", ConsumerAuthorization{In: in}, ""},
+		{"good", ConsumerAuthorization{In: in, AppBindings: []AppBinding{{Name: "tenant", Claim: claim, AppAttribute: "tenant_id"}}}, ""},
+		{"no credential", ConsumerAuthorization{AppBindings: []AppBinding{{Name: "tenant", Claim: claim, AppAttribute: "tenant_id"}}},
+			"consumer authorization app_bindings require in or alternatives"},
+		{"no name", ConsumerAuthorization{In: in, AppBindings: []AppBinding{{Claim: claim, AppAttribute: "tenant_id"}}},
+			"consumer authorization app binding names must be non-empty"},
+		{"duplicate names", ConsumerAuthorization{In: in, AppBindings: []AppBinding{
+			{Name: "tenant", Claim: claim, AppAttribute: "tenant_id"},
+			{Name: "tenant", Claim: claim, AppAttribute: "region"},
+		}}, "consumer authorization app binding names must be unique, got multiple tenant"},
+		{"no attribute", ConsumerAuthorization{In: in, AppBindings: []AppBinding{{Name: "tenant", Claim: claim}}},
+			`consumer authorization app binding "tenant" app_attribute must be non-empty`},
+		{"unknown requirement", ConsumerAuthorization{In: in, AppBindings: []AppBinding{
+			{Name: "tenant", Claim: JWTClaim{Requirement: "missing", Name: "tenant_id"}, AppAttribute: "tenant_id"},
+		}}, `consumer authorization app binding "tenant": JWT claim requirement "missing" does not exist`},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			err := validateConsumerAuthorization(&test.c, jwtAuths)
+			if test.wantErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if test.wantErr != "" && (err == nil || err.Error() != test.wantErr) {
+				t.Errorf("want error %q, got: %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestUsesAppAttributes(t *testing.T) {
+	in := []APIOperationParameter{{Match: Header("x-api-key")}}
+	cert := []APIOperationParameter{{Match: ClientCertificate{Field: ClientCertificateSAN, AppAttribute: "spiffe_id"}}}
+	binding := []AppBinding{{Name: "tenant", AppAttribute: "tenant_id"}}
+	tests := []struct {
+		desc string
+		api  APISpec
+		want bool
+	}{
+		{"none", APISpec{ConsumerAuthorization: ConsumerAuthorization{In: in}}, false},
+		{"api binding", APISpec{ConsumerAuthorization: ConsumerAuthorization{In: in, AppBindings: binding}}, true},
+		{"certificate", APISpec{ConsumerAuthorization: ConsumerAuthorization{In: cert}}, true},
+		{"alternative certificate", APISpec{ConsumerAuthorization: ConsumerAuthorization{
+			Alternatives: []ConsumerCredential{{Name: "mtls", In: cert}}}}, true},
+		{"operation binding", APISpec{Operations: []APIOperation{
+			{ConsumerAuthorization: ConsumerAuthorization{In: in, AppBindings: binding}}}}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			if got := usesAppAttributes([]EnvironmentSpec{{APIs: []APISpec{test.api}}}); got != test.want {
+				t.Errorf("want: %t, got: %t", test.want, got)
+			}
+		})
+	}
+}
+
+func TestVerifyAppBindings(t *testing.T) {
+	envSpec := &EnvironmentSpec{
+		ID: "spec",
+		APIs: []APISpec{{
+			ID: "api",
+			Authentication: AuthenticationRequirement{
+				Requirements: JWTAuthentication{Name: "tenant-jwt"},
+			},
+			ConsumerAuthorization: ConsumerAuthorization{
+				In: []APIOperationParameter{{Match: Header("x-api-key")}},
+				AppBindings: []AppBinding{{
+					Name:         "tenant",
+					Claim:        JWTClaim{Requirement: "tenant-jwt", Name: "tenant_id"},
+					AppAttribute: "tenant_id",
+				}},
+			},
+		}},
+	}
+	if err := ValidateEnvironmentSpecs([]EnvironmentSpec{*envSpec}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	specExt, err := NewEnvironmentSpecExt(envSpec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	resolver := &testConsumerKeyAuthMan{keys: map[string]string{"tenant_id=acme": "acme-key"}}
+
+	tests := []struct {
+		desc        string
+		authMan     auth.Manager
+		tenant      string
+		consumerKey string
+		wantErr     bool
+	}{
+		{"bound", resolver, "acme", "acme-key", false},
+		{"other app", resolver, "acme", "other-key", true},
+		{"unknown tenant", resolver, "globex", "acme-key", true},
+		{"missing claim", resolver, "", "acme-key", true},
+		{"unsupported", &testAuthMan{}, "acme", "acme-key", true},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			envoyReq := testutil.NewEnvoyRequest(http.MethodGet, "/", nil, nil)
+			req := NewEnvironmentSpecRequest(test.authMan, specExt, envoyReq)
+			claims := jwtClaims{}
+			if test.tenant != "" {
+				claims["tenant_id"] = test.tenant
+			}
+			req.jwtResults["tenant-jwt"] = &jwtResult{claims: claims}
+			err := req.VerifyAppBindings(test.consumerKey)
+			if test.wantErr != (err != nil) {
+				t.Errorf("want error %t, got: %v", test.wantErr, err)
+			}
+		})
+	}
+
+	var nilReq *EnvironmentSpecRequest
+	if err := nilReq.VerifyAppBindings("key"); err != nil {
+		t.Errorf("nil request should have no bindings, got: %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// validateAuthExclusions checks the methods of the API's auth exclusions and
+// that no exclusion may match a request of an operation that authenticates or
+// authorizes consumers
+func validateAuthExclusions(api *APISpec) error {
+	for _, x := range api.AuthExclusions {
+		if x.Method != anyMethod {
+			if _, ok := allMethods[x.Method]; !ok {
+				return fmt.Errorf("API %q auth exclusion %q uses an invalid HTTP method %q", api.ID, x.PathTemplate, x.Method)
+			}
+		}
+		if !strings.HasPrefix(x.PathTemplate, "/") {
+			return fmt.Errorf("API %q auth exclusion path_template must begin with /, got %q", api.ID, x.PathTemplate)
+		}
+		for _, op := range effectiveOperations(api) {
+			if !isAuthenticating(effectiveAuthentication(api, op)) &&
+				!isAuthorizing(effectiveConsumerAuthorization(api, op)) {
+				continue
+			}
+			if len(op.HTTPMatches) == 0 { // empty is wildcard
+				return fmt.Errorf("API %q auth exclusion %q overlaps protected operation %q", api.ID, x.PathTemplate, op.Name)
+			}
+			for _, m := range op.HTTPMatches {
+				if methodsOverlap(x.Method, m.Method) && templatesOverlap(x.PathTemplate, m.PathTemplate) {
+					return fmt.Errorf("API %q auth exclusion %q overlaps protected operation %q", api.ID, x.PathTemplate, op.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func methodsOverlap(a, b string) bool {
+	return a == anyMethod || b == anyMethod || a == b
+}
+
+// templatesOverlap returns true if a request path may match both templates
+func templatesOverlap(a, b string) bool {
+	return segmentsOverlap(templateSegments(a), templateSegments(b))
+}
+
+// templateSegments returns the non-empty segments of a path template with
+// its variables as wildcards
+func templateSegments(template string) []string {
+	var segments []string
+	for _, s := range strings.Split(template, "/") {
+		if s == "" {
+			continue
+		}
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			if strings.HasSuffix(s, "=**}") {
+				s = doubleWildcard
+			} else {
+				s = wildcard
+			}
+		}
+		segments = append(segments, s)
+	}
+	return segments
+}
+
+func segmentsOverlap(a, b []string) bool {
+	if len(a) > 0 && a[0] == doubleWildcard {
+		return segmentsOverlap(a[1:], b) || (len(b) > 0 && segmentsOverlap(a, b[1:]))
+	}
+	if len(b) > 0 && b[0] == doubleWildcard {
+		return segmentsOverlap(a, b[1:]) || (len(a) > 0 && segmentsOverlap(a[1:], b))
+	}
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	if a[0] != wildcard && b[0] != wildcard && a[0] != b[0] {
+		return false
+	}
+	return segmentsOverlap(a[1:], b[1:])
+}
+
+// IsAuthExcluded returns true if the request matches an auth exclusion of
+// its API, bypassing authentication and consumer authorization.
+func (e *EnvironmentSpecRequest) IsAuthExcluded() bool {
+	return e != nil && e.authExcluded
+}
+
+// matchAuthExclusion returns true if the method and operation path match an
+// auth exclusion of the request's API. An exclusion without a method doesn't
+// match the restricted methods.
+func (e *EnvironmentSpecRequest) matchAuthExclusion(method, opPath string) bool {
+	if len(e.apiSpec.AuthExclusions) == 0 {
+		return false
+	}
+	pathSplits := append([]string{e.apiSpec.ID, method}, strings.Split(opPath, "/")...)
+	result := e.exclusionPathTree.Find(pathSplits, 0)
+	if result == nil {
+		return false
+	}
+	return !restrictedMethods[method] || result.(*HTTPMatch).Method == method
+}
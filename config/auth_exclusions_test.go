@@ -0,0 +1,133 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+)
+
+func TestTemplatesOverlap(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"/healthz", "/healthz", true},
+		{"/healthz", "/petstore", false},
+		{"/healthz", "/{id}", true},
+		{"/healthz", "/{id}/pets", false},
+		{"/internal/metrics", "/{path=**}", true},
+		{"/internal/{name}", "/internal/**", true},
+		{"/internal/**", "/public/**", false},
+		{"/**/metrics", "/pets/{id}", true},
+		{"/**/metrics", "/pets/{id}/reviews", false},
+		{"/**/metrics", "/pets/*/metrics", true},
+		{"/", "/**", true},
+		{"/healthz", "/", false},
+	}
+	for _, test := range tests {
+		if got := templatesOverlap(test.a, test.b); got != test.want {
+			t.Errorf("templatesOverlap(%q, %q) want %t, got %t", test.a, test.b, test.want, got)
+		}
+		if got := templatesOverlap(test.b, test.a); got != test.want {
+			t.Errorf("templatesOverlap(%q, %q) want %t, got %t", test.b, test.a, test.want, got)
+		}
+	}
+}
+
+func TestValidateAuthExclusions(t *testing.T) {
+	tests := []struct {
+		desc       string
+		exclusions []HTTPMatch
+		wantErr    string
+	}{
+		{"unprotected paths", []HTTPMatch{{PathTemplate: "/healthz"}, {PathTemplate: "/metrics/**", Method: "GET"}}, ""},
+		{"other method", []HTTPMatch{{PathTemplate: "/petstore", Method: "POST"}}, ""},
+		{"invalid method", []HTTPMatch{{PathTemplate: "/healthz", Method: "FETCH"}},
+			`API "apispec1" auth exclusion "/healthz" uses an invalid HTTP method "FETCH"`},
+		{"relative path", []HTTPMatch{{PathTemplate: "healthz"}},
+			`API "apispec1" auth exclusion path_template must begin with /, got "healthz"`},
+		{"protected path", []HTTPMatch{{PathTemplate: "/{name}", Method: "GET"}},
+			`API "apispec1" auth exclusion "/{name}" overlaps protected operation "op-1"`},
+		{"protected by authentication", []HTTPMatch{{PathTemplate: "/noauthz"}},
+			`API "apispec1" auth exclusion "/noauthz" overlaps protected operation "op-4"`},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			envSpec := createGoodEnvSpec()
+			envSpec.APIs[0].AuthExclusions = test.exclusions
+			err := ValidateEnvironmentSpecs([]EnvironmentSpec{envSpec})
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("want no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("want error %q, got %v", test.wantErr, err)
+			}
+		})
+	}
+
+	envSpec := createGoodEnvSpec()
+	envSpec.APIs[0].Operations = nil
+	envSpec.APIs[0].AuthExclusions = []HTTPMatch{{PathTemplate: "/healthz"}}
+	err := ValidateEnvironmentSpecs([]EnvironmentSpec{envSpec})
+	if want := `API "apispec1" auth exclusion "/healthz" overlaps protected operation "default"`; err == nil || err.Error() != want {
+		t.Errorf("want error %q, got %v", want, err)
+	}
+}
+
+func TestAuthExcludedRequest(t *testing.T) {
+	envSpec := createGoodEnvSpec()
+	envSpec.APIs[0].AuthExclusions = []HTTPMatch{{PathTemplate: "/healthz"}, {PathTemplate: "/metrics/**", Method: "GET"}}
+	if err := ValidateEnvironmentSpecs([]EnvironmentSpec{envSpec}); err != nil {
+		t.Fatal(err)
+	}
+	specExt, err := NewEnvironmentSpecExt(&envSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, path string
+		want         bool
+	}{
+		{http.MethodGet, "/v1/healthz", true},
+		{http.MethodHead, "/v1/healthz?probe=1", true},
+		{http.MethodTrace, "/v1/healthz", false},
+		{http.MethodGet, "/v1/metrics/jvm/heap", true},
+		{http.MethodPost, "/v1/metrics/jvm", false},
+		{http.MethodGet, "/v1/petstore", false},
+		{http.MethodGet, "/v2/healthz", false},
+	}
+	for _, test := range tests {
+		envoyReq := testutil.NewEnvoyRequest(test.method, test.path, nil, nil)
+		req := NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
+		if got := req.IsAuthExcluded(); got != test.want {
+			t.Errorf("%s %s want excluded %t, got %t", test.method, test.path, test.want, got)
+		}
+		if test.want && req.GetOperation() != nil {
+			t.Errorf("%s %s want no operation, got %q", test.method, test.path, req.GetOperation().Name)
+		}
+	}
+
+	var nilReq *EnvironmentSpecRequest
+	if nilReq.IsAuthExcluded() {
+		t.Errorf("want nil request not excluded")
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/util"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/lestrrat-go/jwx/jwk"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	// DefaultBootstrapPropertySet is the property set of the provisioned
+	// remote-service properties if unset.
+	DefaultBootstrapPropertySet = "remote-service"
+
+	// properties of the bootstrap property set
+	bootstrapPropsJWKSKey = "jwks"
+
+	remoteServiceBasePath = "/remote-service"
+	bootstrapMaxBytes     = 1 << 20
+)
+
+// TenantBootstrap fetches the remote-service settings provisioned in Apigee
+// at startup, for a GCP-managed tenant, instead of assembling them in the
+// config: the remote_service_api from the hostnames of the environment's
+// group, and the key ID and JWKS from the environment's property set. Values
+// set by the config, secrets or environment variables are kept. The private
+// key isn't fetched, it must still be provided as a secret.
+type TenantBootstrap struct {
+	// Enabled fetches the settings for the org_name and env_name of the tenant.
+	Enabled bool `yaml:"enabled,omitempty" mapstructure:"enabled,omitempty"`
+	// ManagementAPI is the Apigee API, defaults to GCPExperienceBase.
+	ManagementAPI string `yaml:"management_api,omitempty" mapstructure:"management_api,omitempty"`
+	// CredentialsFile is a service account JSON key with access to the Apigee
+	// API. Defaults to the analytics credentials or, if none, the application
+	// default credentials.
+	CredentialsFile string `yaml:"credentials_file,omitempty" mapstructure:"credentials_file,omitempty"`
+	// PropertySet holding the provisioned "kid" and "jwks" properties, the
+	// JWKS as single-line JSON. Defaults to DefaultBootstrapPropertySet.
+	PropertySet string `yaml:"property_set,omitempty" mapstructure:"property_set,omitempty"`
+}
+
+// envGroups is the part of the Apigee environment groups list in use
+type envGroups struct {
+	EnvironmentGroups []struct {
+		Name      string   `json:"name"`
+		Hostnames []string `json:"hostnames"`
+	} `json:"environmentGroups"`
+}
+
+// envGroupAttachments is the part of the Apigee environment group attachments list in use
+type envGroupAttachments struct {
+	EnvironmentGroupAttachments []struct {
+		Environment string `json:"environment"`
+	} `json:"environmentGroupAttachments"`
+}
+
+// bootstrap fetches the unset settings of an enabled TenantBootstrap
+func (c *Config) bootstrap() error {
+	b := c.Tenant.Bootstrap
+	if !b.Enabled {
+		return nil
+	}
+	if !c.IsGCPManaged() {
+		return fmt.Errorf("tenant.bootstrap requires a GCP-managed tenant")
+	}
+	if c.Tenant.OrgName == "" || c.Tenant.EnvName == "" || c.Tenant.EnvName == "*" {
+		return fmt.Errorf("tenant.bootstrap requires tenant.org_name and a single tenant.env_name")
+	}
+	client, err := c.bootstrapClient()
+	if err != nil {
+		return err
+	}
+	return c.bootstrapWith(client)
+}
+
+// bootstrapClient returns a client of the Apigee API with the bootstrap
+// credentials
+func (c *Config) bootstrapClient() (*http.Client, error) {
+	ctx := context.Background()
+	var ts oauth2.TokenSource
+	switch {
+	case c.Tenant.Bootstrap.CredentialsFile != "":
+		b, err := os.ReadFile(c.Tenant.Bootstrap.CredentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		creds, err := google.CredentialsFromJSON(ctx, b, ApigeeAPIScope)
+		if err != nil {
+			return nil, err
+		}
+		ts = creds.TokenSource
+	case c.Analytics.Credentials != nil:
+		ts = c.Analytics.Credentials.TokenSource
+	default:
+		var err error
+		if ts, err = google.DefaultTokenSource(ctx, ApigeeAPIScope); err != nil {
+			return nil, err
+		}
+	}
+	return &http.Client{
+		Timeout:   c.Tenant.ClientTimeout,
+		Transport: &oauth2.Transport{Source: ts},
+	}, nil
+}
+
+// bootstrapWith fetches the unset settings with client
+func (c *Config) bootstrapWith(client *http.Client) error {
+	b := c.Tenant.Bootstrap
+	api := b.ManagementAPI
+	if api == "" {
+		api = GCPExperienceBase
+	}
+	org := strings.TrimSuffix(api, "/") + "/v1/organizations/" + url.PathEscape(c.Tenant.OrgName)
+
+	if c.Tenant.RemoteServiceAPI == "" {
+		host, err := bootstrapHostname(client, org, c.Tenant.EnvName)
+		if err != nil {
+			return err
+		}
+		c.Tenant.RemoteServiceAPI = "https://" + host + remoteServiceBasePath
+		log.Infof("bootstrapped tenant.remote_service_api: %s", c.Tenant.RemoteServiceAPI)
+	}
+
+	if c.Tenant.PrivateKeyID != "" && c.Tenant.JWKS != nil {
+		return nil
+	}
+	propertySet := b.PropertySet
+	if propertySet == "" {
+		propertySet = DefaultBootstrapPropertySet
+	}
+	content, err := bootstrapGet(client, fmt.Sprintf("%s/environments/%s/resourcefiles/properties/%s",
+		org, url.PathEscape(c.Tenant.EnvName), url.PathEscape(propertySet)))
+	if err != nil {
+		return fmt.Errorf("property set %s: %v", propertySet, err)
+	}
+	props, err := util.ReadProperties(bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("property set %s: %v", propertySet, err)
+	}
+	if kid := props[SecretPropsKIDKey]; kid != "" && c.Tenant.PrivateKeyID == "" {
+		c.Tenant.PrivateKeyID = kid
+		log.Infof("bootstrapped tenant private key ID: %s", kid)
+	}
+	if value := props[bootstrapPropsJWKSKey]; value != "" && c.Tenant.JWKS == nil {
+		jwks := jwk.NewSet()
+		if err := json.Unmarshal([]byte(value), jwks); err != nil {
+			return fmt.Errorf("property set %s jwks: %v", propertySet, err)
+		}
+		c.Tenant.JWKS = jwks
+		log.Infof("bootstrapped tenant JWKS: %d keys", jwks.Len())
+	}
+	return nil
+}
+
+// bootstrapHostname returns the first hostname of the environment group
+// the environment is attached to
+func bootstrapHostname(client *http.Client, org, env string) (string, error) {
+	body, err := bootstrapGet(client, org+"/envgroups")
+	if err != nil {
+		return "", fmt.Errorf("environment groups: %v", err)
+	}
+	var groups envGroups
+	if err := json.Unmarshal(body, &groups); err != nil {
+		return "", fmt.Errorf("environment groups: %v", err)
+	}
+	for _, g := range groups.EnvironmentGroups {
+		if len(g.Hostnames) == 0 {
+			continue
+		}
+		body, err := bootstrapGet(client, fmt.Sprintf("%s/envgroups/%s/attachments", org, url.PathEscape(g.Name)))
+		if err != nil {
+			return "", fmt.Errorf("environment group %s attachments: %v", g.Name, err)
+		}
+		var attachments envGroupAttachments
+		if err := json.Unmarshal(body, &attachments); err != nil {
+			return "", fmt.Errorf("environment group %s attachments: %v", g.Name, err)
+		}
+		for _, a := range attachments.EnvironmentGroupAttachments {
+			if a.Environment == env {
+				return g.Hostnames[0], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("environment %s is not attached to an environment group with hostnames", env)
+}
+
+func bootstrapGet(client *http.Client, u string) ([]byte, error) {
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, bootstrapMaxBytes))
+}
@@ -0,0 +1,141 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+func TestBootstrap(t *testing.T) {
+	_, jwksBuf, err := testutil.GenerateKeyAndJWKs("kid1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := &bytes.Buffer{} // a property is a single line
+	if err := json.Compact(jwks, jwksBuf); err != nil {
+		t.Fatal(err)
+	}
+	var requests []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		switch r.URL.Path {
+		case "/v1/organizations/org/envgroups":
+			fmt.Fprint(w, `{"environmentGroups": [
+				{"name": "empty", "hostnames": []},
+				{"name": "other", "hostnames": ["other.example.com"]},
+				{"name": "group", "hostnames": ["api.example.com", "www.example.com"]}
+			]}`)
+		case "/v1/organizations/org/envgroups/other/attachments":
+			fmt.Fprint(w, `{"environmentGroupAttachments": [{"environment": "test"}]}`)
+		case "/v1/organizations/org/envgroups/group/attachments":
+			fmt.Fprint(w, `{"environmentGroupAttachments": [{"environment": "test"}, {"environment": "prod"}]}`)
+		case "/v1/organizations/org/environments/prod/resourcefiles/properties/remote-service":
+			fmt.Fprintf(w, "kid=kid1\njwks=%s\n", jwks)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	newConfig := func(env string) *Config {
+		c := Default()
+		c.Tenant.OrgName = "org"
+		c.Tenant.EnvName = env
+		c.Tenant.Bootstrap = TenantBootstrap{Enabled: true, ManagementAPI: ts.URL + "/"}
+		return c
+	}
+
+	// everything fetched
+	c := newConfig("prod")
+	if err := c.bootstrapWith(ts.Client()); err != nil {
+		t.Fatal(err)
+	}
+	if c.Tenant.RemoteServiceAPI != "https://api.example.com/remote-service" {
+		t.Errorf("want remote_service_api of environment group, got %q", c.Tenant.RemoteServiceAPI)
+	}
+	if c.Tenant.PrivateKeyID != "kid1" {
+		t.Errorf("want kid1, got %q", c.Tenant.PrivateKeyID)
+	}
+	if c.Tenant.JWKS == nil || c.Tenant.JWKS.Len() != 1 {
+		t.Errorf("want JWKS of property set, got %v", c.Tenant.JWKS)
+	}
+
+	// configured values kept, nothing fetched
+	c = newConfig("prod")
+	c.Tenant.RemoteServiceAPI = "https://configured/remote-service"
+	c.Tenant.PrivateKeyID = "configured"
+	c.Tenant.JWKS = jwk.NewSet()
+	requests = nil
+	if err := c.bootstrapWith(ts.Client()); err != nil {
+		t.Fatal(err)
+	}
+	if c.Tenant.RemoteServiceAPI != "https://configured/remote-service" || c.Tenant.PrivateKeyID != "configured" {
+		t.Errorf("want configured values kept, got %q, %q", c.Tenant.RemoteServiceAPI, c.Tenant.PrivateKeyID)
+	}
+	if len(requests) != 0 {
+		t.Errorf("want no requests, got %v", requests)
+	}
+
+	// errors
+	c = newConfig("dev")
+	if err := c.bootstrapWith(ts.Client()); err == nil {
+		t.Errorf("want error for environment not attached")
+	}
+	c = newConfig("test")
+	c.Tenant.Bootstrap.PropertySet = "missing"
+	if err := c.bootstrapWith(ts.Client()); err == nil {
+		t.Errorf("want error for missing property set")
+	}
+	if c.Tenant.RemoteServiceAPI != "https://other.example.com/remote-service" {
+		t.Errorf("want remote_service_api of first attached group, got %q", c.Tenant.RemoteServiceAPI)
+	}
+}
+
+func TestBootstrapRequirements(t *testing.T) {
+	tests := []struct {
+		desc   string
+		modify func(c *Config)
+	}{
+		{"not GCP managed", func(c *Config) { c.Tenant.InternalAPI = LegacySaaSInternalBase }},
+		{"no org", func(c *Config) { c.Tenant.OrgName = "" }},
+		{"no env", func(c *Config) { c.Tenant.EnvName = "" }},
+		{"multitenant", func(c *Config) { c.Tenant.EnvName = "*" }},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			c := Default()
+			c.Tenant.OrgName = "org"
+			c.Tenant.EnvName = "env"
+			c.Tenant.Bootstrap.Enabled = true
+			test.modify(c)
+			if err := c.bootstrap(); err == nil {
+				t.Errorf("want error")
+			}
+		})
+	}
+
+	c := Default()
+	if err := c.bootstrap(); err != nil {
+		t.Errorf("want no error if disabled, got %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+)
+
+// BotRule actions
+const (
+	BotActionTag  = "tag"  // allow, recording the rule in analytics and a request header
+	BotActionDeny = "deny" // deny as unauthorized
+)
+
+// BotRule flags requests as suspected bots by request signals. A rule
+// matches if any of its signals match.
+type BotRule struct {
+	// Name of the rule, recorded as the "bot.rule" analytics attribute.
+	Name string `yaml:"name" mapstructure:"name"`
+
+	// UserAgents are regular expressions matched against the user-agent header.
+	UserAgents []string `yaml:"user_agents,omitempty" mapstructure:"user_agents,omitempty"`
+
+	// MissingHeaders match requests lacking any of these headers.
+	MissingHeaders []string `yaml:"missing_headers,omitempty" mapstructure:"missing_headers,omitempty"`
+
+	// IPReputation matches clients in the bot_detection IP reputation list.
+	IPReputation bool `yaml:"ip_reputation,omitempty" mapstructure:"ip_reputation,omitempty"`
+
+	// Action is "tag" (default) or "deny".
+	Action string `yaml:"action,omitempty" mapstructure:"action,omitempty"`
+}
+
+// IPReputation lists suspicious client IPs for BotRules.
+// Set with EnvironmentSpecExt.SetIPReputation.
+type IPReputation interface {
+	IsListed(ip string) bool
+}
+
+// validateBotRules checks rules have unique names, signals, and a known action
+func validateBotRules(rules []BotRule) error {
+	names := make(map[string]bool, len(rules))
+	for _, r := range rules {
+		if r.Name == "" {
+			return fmt.Errorf("bot rule names must be non-empty")
+		}
+		if names[r.Name] {
+			return fmt.Errorf("bot rule names within each API or operation must be unique, got multiple %s", r.Name)
+		}
+		names[r.Name] = true
+		if len(r.UserAgents) == 0 && len(r.MissingHeaders) == 0 && !r.IPReputation {
+			return fmt.Errorf("bot rule %q must have user_agents, missing_headers, or ip_reputation", r.Name)
+		}
+		if r.Action != "" && r.Action != BotActionTag && r.Action != BotActionDeny {
+			return fmt.Errorf("bot rule %q action must be %s or %s", r.Name, BotActionTag, BotActionDeny)
+		}
+	}
+	return nil
+}
+
+// parseBotRules compiles the user agent patterns
+func (e *EnvironmentSpecExt) parseBotRules(rules []BotRule) error {
+	for _, r := range rules {
+		for _, ua := range r.UserAgents {
+			re, err := regexp.Compile(ua)
+			if err != nil {
+				return fmt.Errorf("bot rule %q user agent: %v", r.Name, err)
+			}
+			e.compiledRegExps[ua] = re
+		}
+	}
+	return nil
+}
+
+// GetBotRules returns the BotRules of the Operation or APISpec as appropriate.
+func (e *EnvironmentSpecRequest) GetBotRules() []BotRule {
+	if op := e.GetOperation(); op != nil && len(op.BotRules) > 0 {
+		return op.BotRules
+	}
+	if api := e.GetAPISpec(); api != nil {
+		return api.BotRules
+	}
+	return nil
+}
+
+// MatchBotRule returns the first BotRule matching the request, nil if none.
+// The matched rule name is then available from GetBotRule.
+func (e *EnvironmentSpecRequest) MatchBotRule() *BotRule {
+	if e == nil {
+		return nil
+	}
+	rules := e.GetBotRules()
+	for i := range rules {
+		if e.matchesBotRule(rules[i]) {
+			log.Debugf("bot rule %q matched", rules[i].Name)
+			e.botRule = rules[i].Name
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// GetBotRule returns the name of the BotRule matched by MatchBotRule, "" if none.
+func (e *EnvironmentSpecRequest) GetBotRule() string {
+	if e == nil {
+		return ""
+	}
+	return e.botRule
+}
+
+func (e *EnvironmentSpecRequest) matchesBotRule(r BotRule) bool {
+	headers := e.Request.GetAttributes().GetRequest().GetHttp().GetHeaders()
+	if userAgent, ok := headers["user-agent"]; ok {
+		for _, ua := range r.UserAgents {
+			if re := e.compiledRegExps[ua]; re != nil && re.MatchString(userAgent) {
+				return true
+			}
+		}
+	}
+	for _, h := range r.MissingHeaders {
+		if _, ok := headers[strings.ToLower(h)]; !ok {
+			return true
+		}
+	}
+	if r.IPReputation && e.ipReputation != nil {
+		if ip := e.ClientIP(); ip != "" && e.ipReputation.IsListed(ip) {
+			return true
+		}
+	}
+	return false
+}
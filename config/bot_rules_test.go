@@ -0,0 +1,120 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+)
+
+type testIPReputation map[string]bool
+
+func (r testIPReputation) IsListed(ip string) bool {
+	return r[ip]
+}
+
+func TestMatchBotRule(t *testing.T) {
+	envSpec := &EnvironmentSpec{
+		ID: "good-env-config",
+		APIs: []APISpec{{
+			ID: "apispec1",
+			BotRules: []BotRule{
+				{Name: "crawler", UserAgents: []string{"(?i)bot|crawler"}},
+				{Name: "headless", MissingHeaders: []string{"Accept-Language"}, Action: BotActionDeny},
+				{Name: "reputation", IPReputation: true},
+			},
+			Operations: []APIOperation{
+				{
+					Name:        "strict",
+					HTTPMatches: []HTTPMatch{{PathTemplate: "/strict"}},
+					BotRules:    []BotRule{{Name: "strict", MissingHeaders: []string{"referer"}, Action: BotActionDeny}},
+				},
+				{
+					Name:        "default",
+					HTTPMatches: []HTTPMatch{{PathTemplate: "/**"}},
+				},
+			},
+		}},
+	}
+	specExt, err := NewEnvironmentSpecExt(envSpec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	specExt.SetIPReputation(testIPReputation{"10.0.0.1": true})
+
+	tests := []struct {
+		desc    string
+		path    string
+		headers map[string]string
+		ip      string
+		want    string
+	}{
+		{"no match", "/", map[string]string{"user-agent": "curl/7.0", "accept-language": "en"}, "10.0.0.2", ""},
+		{"user agent", "/", map[string]string{"user-agent": "GoogleBot/2.1", "accept-language": "en"}, "", "crawler"},
+		{"missing header", "/", map[string]string{"user-agent": "curl/7.0"}, "", "headless"},
+		{"ip reputation", "/", map[string]string{"user-agent": "curl/7.0", "accept-language": "en"}, "10.0.0.1", "reputation"},
+		{"first match", "/", map[string]string{"user-agent": "crawler"}, "10.0.0.1", "crawler"},
+		{"operation rules", "/strict", map[string]string{"user-agent": "crawler"}, "10.0.0.1", "strict"},
+		{"operation no match", "/strict", map[string]string{"referer": "x"}, "10.0.0.1", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			envoyReq := testutil.NewEnvoyRequest(http.MethodGet, test.path, test.headers, nil)
+			if test.ip != "" {
+				envoyReq.Attributes.Source = &authv3.AttributeContext_Peer{
+					Address: &corev3.Address{
+						Address: &corev3.Address_SocketAddress{
+							SocketAddress: &corev3.SocketAddress{Address: test.ip},
+						},
+					},
+				}
+			}
+			req := NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
+			rule := req.MatchBotRule()
+			var got string
+			if rule != nil {
+				got = rule.Name
+			}
+			if got != test.want {
+				t.Errorf("want: %q, got: %q", test.want, got)
+			}
+			if req.GetBotRule() != test.want {
+				t.Errorf("want GetBotRule: %q, got: %q", test.want, req.GetBotRule())
+			}
+		})
+	}
+
+	var nilReq *EnvironmentSpecRequest
+	if nilReq.MatchBotRule() != nil || nilReq.GetBotRule() != "" {
+		t.Errorf("nil request should not match")
+	}
+}
+
+func TestBadBotRuleUserAgent(t *testing.T) {
+	envSpec := &EnvironmentSpec{
+		ID: "spec",
+		APIs: []APISpec{{
+			ID:       "api",
+			BotRules: []BotRule{{Name: "bad", UserAgents: []string{"("}}},
+		}},
+	}
+	if _, err := NewEnvironmentSpecExt(envSpec); err == nil {
+		t.Errorf("want error for bad user agent pattern")
+	}
+}
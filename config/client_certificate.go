@@ -0,0 +1,210 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+)
+
+// ForwardedClientCertHeader is the header Envoy uses to forward client
+// certificate details (see forward_client_cert_details).
+const ForwardedClientCertHeader = "x-forwarded-client-cert"
+
+// getClientCertificateValue returns the certificate field, or the consumer key
+// of the app it identifies if AppAttribute is set. Returns "" if unavailable.
+func (e *EnvironmentSpecRequest) getClientCertificateValue(cc ClientCertificate) string {
+	value := e.getClientCertificateField(cc.Field)
+	if value == "" || cc.AppAttribute == "" {
+		return value
+	}
+	resolver, ok := e.authMan.(ConsumerKeyResolver)
+	if !ok {
+		log.Warnf("ClientCertificate app_attribute unsupported, auth manager cannot resolve consumer keys")
+		return ""
+	}
+	key, err := resolver.ResolveConsumerKey(cc.AppAttribute, value)
+	if err != nil {
+		log.Debugf("unable to resolve consumer key by app attribute %q: %v", cc.AppAttribute, err)
+		return ""
+	}
+	return key
+}
+
+// verifyCertificateBinding checks the RFC 8705 "cnf" claim "x5t#S256" thumbprint
+// of a JWT matches the client certificate fingerprint per the binding of its
+// JWTAuthentication.
+func (e *EnvironmentSpecRequest) verifyCertificateBinding(binding string, claims map[string]interface{}) error {
+	if binding == "" {
+		return nil
+	}
+	var thumbprint string
+	if cnf, ok := claims["cnf"].(map[string]interface{}); ok {
+		thumbprint, _ = cnf["x5t#S256"].(string)
+	}
+	if thumbprint == "" {
+		if binding == CertificateBindingRequired {
+			return fmt.Errorf("JWT is not certificate-bound")
+		}
+		return nil
+	}
+
+	fingerprint, err := hex.DecodeString(e.getClientCertificateField(ClientCertificateFingerprint))
+	if err != nil || len(fingerprint) == 0 {
+		return fmt.Errorf("certificate-bound JWT requires a client certificate")
+	}
+	if base64.RawURLEncoding.EncodeToString(fingerprint) != strings.TrimRight(thumbprint, "=") {
+		return fmt.Errorf("JWT is bound to another client certificate")
+	}
+	return nil
+}
+
+// getClientCertificateField returns a field of the ext_authz peer certificate,
+// or of the x-forwarded-client-cert header if the API trusts it. The header is
+// sent by clients unless Envoy sanitizes it, so it isn't read by default.
+func (e *EnvironmentSpecRequest) getClientCertificateField(field string) string {
+	source := e.Request.GetAttributes().GetSource()
+	if field == ClientCertificatePrincipal {
+		return source.GetPrincipal()
+	}
+
+	if e.apiSpec != nil && e.apiSpec.TrustForwardedClientCert {
+		headers := e.Request.GetAttributes().GetRequest().GetHttp().GetHeaders()
+		return forwardedClientCertField(headers[ForwardedClientCertHeader], field)
+	}
+
+	if source.GetCertificate() == "" {
+		return ""
+	}
+	cert, err := parsePeerCertificate(source.GetCertificate())
+	if err != nil {
+		log.Debugf("unable to parse peer certificate: %v", err)
+		return ""
+	}
+	switch field {
+	case ClientCertificateFingerprint:
+		sum := sha256.Sum256(cert.Raw)
+		return hex.EncodeToString(sum[:])
+	case ClientCertificateSAN:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case ClientCertificateSubject:
+		return cert.Subject.String()
+	}
+	return ""
+}
+
+// forwardedClientCertField returns a field of the nearest client certificate
+// of an x-forwarded-client-cert header
+func forwardedClientCertField(header, field string) string {
+	if elements := parseForwardedClientCert(header); len(elements) > 0 {
+		// Envoy appends the element for the nearest client, earlier elements
+		// are from the client or other proxies and are not trusted
+		el := elements[len(elements)-1]
+		switch field {
+		case ClientCertificateFingerprint:
+			return el["hash"]
+		case ClientCertificateSAN:
+			if el["uri"] != "" {
+				return el["uri"]
+			}
+			return el["dns"]
+		case ClientCertificateSubject:
+			return el["subject"]
+		}
+	}
+	return ""
+}
+
+// parsePeerCertificate parses the URL encoded PEM certificate of an ext_authz peer
+func parsePeerCertificate(encoded string) (*x509.Certificate, error) {
+	decoded, err := url.QueryUnescape(encoded)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(decoded))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// parseForwardedClientCert parses an x-forwarded-client-cert header value into
+// elements of lower case keys to values. Only the first of repeated keys is kept.
+// e.g. By=spiffe://a;Hash=abc;Subject="CN=client,O=org";URI=spiffe://b;DNS=c
+func parseForwardedClientCert(header string) []map[string]string {
+	if header == "" {
+		return nil
+	}
+	var elements []map[string]string
+	element := map[string]string{}
+	var key, value strings.Builder
+	inKey, quoted, escaped := true, false, false
+
+	endPair := func() {
+		k := strings.ToLower(strings.TrimSpace(key.String()))
+		if _, ok := element[k]; k != "" && !ok {
+			element[k] = value.String()
+		}
+		key.Reset()
+		value.Reset()
+		inKey = true
+	}
+	endElement := func() {
+		endPair()
+		if len(element) > 0 {
+			elements = append(elements, element)
+		}
+		element = map[string]string{}
+	}
+
+	for _, r := range header {
+		switch {
+		case escaped:
+			value.WriteRune(r)
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case !inKey && r == '"':
+			quoted = !quoted
+		case quoted:
+			value.WriteRune(r)
+		case r == '=' && inKey:
+			inKey = false
+		case r == ';':
+			endPair()
+		case r == ',':
+			endElement()
+		case inKey:
+			key.WriteRune(r)
+		default:
+			value.WriteRune(r)
+		}
+	}
+	endElement()
+	return elements
+}
@@ -0,0 +1,245 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseForwardedClientCert(t *testing.T) {
+	tests := []struct {
+		desc   string
+		header string
+		want   []map[string]string
+	}{
+		{"empty", "", nil},
+		{
+			"single",
+			`By=spiffe://lyft.com/frontend;Hash=468ed33be74eee6556d90c0149c1309e9ba61d6425303443c0748a02dd8de688;URI=spiffe://lyft.com/test`,
+			[]map[string]string{{
+				"by":   "spiffe://lyft.com/frontend",
+				"hash": "468ed33be74eee6556d90c0149c1309e9ba61d6425303443c0748a02dd8de688",
+				"uri":  "spiffe://lyft.com/test",
+			}},
+		},
+		{
+			"quoted subject",
+			`Hash=abc;Subject="CN=client,O=\"Acme, Inc.\"";DNS=a.example.com;DNS=b.example.com`,
+			[]map[string]string{{
+				"hash":    "abc",
+				"subject": `CN=client,O="Acme, Inc."`,
+				"dns":     "a.example.com",
+			}},
+		},
+		{
+			"multiple elements",
+			`Hash=abc;URI=spiffe://a,Hash=def;URI=spiffe://b`,
+			[]map[string]string{
+				{"hash": "abc", "uri": "spiffe://a"},
+				{"hash": "def", "uri": "spiffe://b"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			got := parseForwardedClientCert(test.header)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestGetParamValueClientCertificate(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spiffeID, _ := url.Parse("spiffe://cluster/ns/default/sa/client")
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client", Organization: []string{"org"}},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{spiffeID},
+		DNSNames:     []string{"client.example.com"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerCert := url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	sum := sha256.Sum256(der)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	xfcc := `Hash=untrusted;URI=spiffe://untrusted,Hash=abc;Subject="CN=xfcc";URI=spiffe://xfcc;DNS=xfcc.example.com`
+
+	specExt, trustingSpecExt := newClientCertificateSpecExts(t)
+	resolver := &testConsumerKeyAuthMan{
+		keys: map[string]string{"spiffe_id=spiffe://xfcc": "consumer-key"},
+	}
+
+	tests := []struct {
+		desc      string
+		authMan   auth.Manager
+		param     ClientCertificate
+		xfcc      string
+		principal string
+		peerCert  string
+		trustXFCC bool
+		want      string
+	}{
+		{"principal", &testAuthMan{}, ClientCertificate{Field: ClientCertificatePrincipal}, xfcc, "principal", peerCert, false, "principal"},
+		{"no certificate", &testAuthMan{}, ClientCertificate{Field: ClientCertificateFingerprint}, "", "", "", false, ""},
+		{"xfcc fingerprint", &testAuthMan{}, ClientCertificate{Field: ClientCertificateFingerprint}, xfcc, "", peerCert, true, "abc"},
+		{"xfcc san", &testAuthMan{}, ClientCertificate{Field: ClientCertificateSAN}, xfcc, "", peerCert, true, "spiffe://xfcc"},
+		{"xfcc dns san", &testAuthMan{}, ClientCertificate{Field: ClientCertificateSAN}, "Hash=abc;DNS=xfcc.example.com", "", "", true, "xfcc.example.com"},
+		{"xfcc subject", &testAuthMan{}, ClientCertificate{Field: ClientCertificateSubject}, xfcc, "", peerCert, true, "CN=xfcc"},
+		{"xfcc not trusted", &testAuthMan{}, ClientCertificate{Field: ClientCertificateFingerprint}, xfcc, "", peerCert, false, fingerprint},
+		{"xfcc not trusted without peer", &testAuthMan{}, ClientCertificate{Field: ClientCertificateSAN}, xfcc, "", "", false, ""},
+		{"peer fingerprint", &testAuthMan{}, ClientCertificate{Field: ClientCertificateFingerprint}, "", "", peerCert, false, fingerprint},
+		{"peer san", &testAuthMan{}, ClientCertificate{Field: ClientCertificateSAN}, "", "", peerCert, false, spiffeID.String()},
+		{"peer subject", &testAuthMan{}, ClientCertificate{Field: ClientCertificateSubject}, "", "", peerCert, false, "CN=client,O=org"},
+		{"bad peer certificate", &testAuthMan{}, ClientCertificate{Field: ClientCertificateSubject}, "", "", "bad", false, ""},
+		{"app attribute", resolver, ClientCertificate{Field: ClientCertificateSAN, AppAttribute: "spiffe_id"}, xfcc, "", "", true, "consumer-key"},
+		{"unknown app attribute", resolver, ClientCertificate{Field: ClientCertificateFingerprint, AppAttribute: "spiffe_id"}, xfcc, "", "", true, ""},
+		{"app attribute unsupported", &testAuthMan{}, ClientCertificate{Field: ClientCertificateSAN, AppAttribute: "spiffe_id"}, xfcc, "", "", true, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			headers := map[string]string{}
+			if test.xfcc != "" {
+				headers[ForwardedClientCertHeader] = test.xfcc
+			}
+			envoyReq := testutil.NewEnvoyRequest(http.MethodGet, "/v1/petstore", headers, nil)
+			envoyReq.Attributes.Source = &authv3.AttributeContext_Peer{
+				Principal:   test.principal,
+				Certificate: test.peerCert,
+			}
+			ext := specExt
+			if test.trustXFCC {
+				ext = trustingSpecExt
+			}
+			req := NewEnvironmentSpecRequest(test.authMan, ext, envoyReq)
+			got := req.GetParamValue(APIOperationParameter{Match: test.param})
+			if test.want != got {
+				t.Errorf("want: %q, got: %q", test.want, got)
+			}
+		})
+	}
+}
+
+type testConsumerKeyAuthMan struct {
+	testAuthMan
+	keys map[string]string
+}
+
+func (a *testConsumerKeyAuthMan) ResolveConsumerKey(attribute, value string) (string, error) {
+	if key, ok := a.keys[attribute+"="+value]; ok {
+		return key, nil
+	}
+	return "", fmt.Errorf("unknown consumer")
+}
+
+func TestVerifyCertificateBinding(t *testing.T) {
+	sum := sha256.Sum256([]byte("certificate"))
+	fingerprint := hex.EncodeToString(sum[:])
+	thumbprint := base64.RawURLEncoding.EncodeToString(sum[:])
+	other := sha256.Sum256([]byte("other"))
+	bound := func(x5t string) map[string]interface{} {
+		return map[string]interface{}{"cnf": map[string]interface{}{"x5t#S256": x5t}}
+	}
+
+	specExt, trustingSpecExt := newClientCertificateSpecExts(t)
+
+	tests := []struct {
+		desc    string
+		binding string
+		xfcc    string
+		claims  map[string]interface{}
+		wantErr bool
+	}{
+		{"disabled", "", "", bound(thumbprint), false},
+		{"optional unbound", CertificateBindingOptional, "", map[string]interface{}{}, false},
+		{"required unbound", CertificateBindingRequired, "Hash=" + fingerprint, map[string]interface{}{}, true},
+		{"match", CertificateBindingOptional, "Hash=" + fingerprint, bound(thumbprint), false},
+		{"padded match", CertificateBindingRequired, "Hash=" + fingerprint, bound(base64.URLEncoding.EncodeToString(sum[:])), false},
+		{"mismatch", CertificateBindingOptional, "Hash=" + hex.EncodeToString(other[:]), bound(thumbprint), true},
+		{"no certificate", CertificateBindingRequired, "", bound(thumbprint), true},
+		{"bad fingerprint", CertificateBindingOptional, "Hash=bad", bound(thumbprint), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			headers := map[string]string{}
+			if test.xfcc != "" {
+				headers[ForwardedClientCertHeader] = test.xfcc
+			}
+			envoyReq := testutil.NewEnvoyRequest(http.MethodGet, "/v1/petstore", headers, nil)
+			req := NewEnvironmentSpecRequest(&testAuthMan{}, trustingSpecExt, envoyReq)
+			err := req.verifyCertificateBinding(test.binding, test.claims)
+			if test.wantErr != (err != nil) {
+				t.Errorf("want error: %t, got: %v", test.wantErr, err)
+			}
+		})
+	}
+
+	// a forged header isn't trusted by default
+	envoyReq := testutil.NewEnvoyRequest(http.MethodGet, "/v1/petstore",
+		map[string]string{ForwardedClientCertHeader: "Hash=" + fingerprint}, nil)
+	req := NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
+	if err := req.verifyCertificateBinding(CertificateBindingRequired, bound(thumbprint)); err == nil {
+		t.Errorf("want error for untrusted x-forwarded-client-cert")
+	}
+}
+
+// newClientCertificateSpecExts returns the good env spec, and the good env spec
+// with APIs trusting the x-forwarded-client-cert header
+func newClientCertificateSpecExts(t *testing.T) (*EnvironmentSpecExt, *EnvironmentSpecExt) {
+	envSpec := createGoodEnvSpec()
+	specExt, err := NewEnvironmentSpecExt(&envSpec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	trusting := createGoodEnvSpec()
+	for i := range trusting.APIs {
+		trusting.APIs[i].TrustForwardedClientCert = true
+	}
+	trustingSpecExt, err := NewEnvironmentSpecExt(&trusting)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return specExt, trustingSpecExt
+}
@@ -24,9 +24,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"reflect"
+	"sort"
 	"strings"
 	"time"
 
@@ -66,6 +70,7 @@ const (
 	AnalyticsCredentials = "APIGEE_ANALYTICS_CREDENTIALS_JSON"
 
 	EnvironmentSpecsReferences = "ENVIRONMENT_SPECS.REFERENCES"
+	GlobalStrictConfig         = "GLOBAL.STRICT_CONFIG"
 )
 
 func init() {
@@ -126,19 +131,92 @@ func Default() *Config {
 			ClientTimeout:       30 * time.Second,
 			InternalJWTDuration: 10 * time.Minute,
 			InternalJWTRefresh:  30 * time.Second,
+			Failover: Failover{
+				HealthCheckInterval: 30 * time.Second,
+				RecoveryThreshold:   3,
+			},
+			Retry: OutboundRetry{
+				MaxAttempts:    3,
+				InitialBackoff: 100 * time.Millisecond,
+				MaxBackoff:     5 * time.Second,
+				BudgetRatio:    0.1,
+				BudgetBurst:    10,
+			},
 		},
 		Products: Products{
 			RefreshRate: 2 * time.Minute,
 		},
+		KeyValueMaps: KeyValueMaps{
+			RefreshRate: 2 * time.Minute,
+		},
+		BotDetection: BotDetection{
+			RefreshRate: 10 * time.Minute,
+		},
+		JWTRevocation: JWTRevocation{
+			RefreshRate: time.Minute,
+		},
+		QuotaStore: QuotaStore{
+			Redis: Redis{
+				KeyPrefix: "apigee-quota:",
+				PoolSize:  10,
+				Timeout:   time.Second,
+			},
+		},
+		QuotaCounting: QuotaCounting{
+			Mode: QuotaCountingCheck,
+		},
+		RequestNormalization: RequestNormalization{
+			Mode: RequestNormalizationNormalize,
+		},
+		DenialWebhook: DenialWebhook{
+			BatchSize:     100,
+			FlushInterval: 5 * time.Second,
+			QueueSize:     1000,
+			Timeout:       10 * time.Second,
+		},
+		VerificationStore: VerificationStore{
+			Redis: Redis{
+				KeyPrefix: "apigee-verification:",
+				PoolSize:  10,
+				Timeout:   time.Second,
+			},
+		},
+		ReplayStore: ReplayStore{
+			Redis: Redis{
+				KeyPrefix: "apigee-replay:",
+				PoolSize:  10,
+				Timeout:   time.Second,
+			},
+		},
 		Analytics: Analytics{
-			FileLimit:          1024,
-			SendChannelSize:    10,
-			CollectionInterval: 2 * time.Minute,
+			FileLimit:           1024,
+			SendChannelSize:     10,
+			CollectionInterval:  2 * time.Minute,
+			SpoolDenyStatusCode: http.StatusServiceUnavailable,
+			SpoolCheckInterval:  10 * time.Second,
+			AccessLogQueueSize:  1000,
+			AnomalyDetection: AnomalyDetection{
+				Interval:     time.Minute,
+				Smoothing:    0.1,
+				Factor:       3,
+				MinErrorRate: 0.05,
+				MinRequests:  20,
+			},
 		},
 		Auth: Auth{
-			APIKeyCacheDuration: 30 * time.Minute,
-			APIKeyHeader:        "x-api-key",
-			APIHeader:           ":authority",
+			APIKeyCacheDuration:      30 * time.Minute,
+			AccessTokenCacheDuration: 30 * time.Minute,
+			APIKeyHeader:             "x-api-key",
+			APIHeader:                ":authority",
+			JWTLimits: JWTLimits{
+				MaxBytes:  65536,
+				MaxClaims: 1000,
+				MaxDepth:  32,
+			},
+		},
+		Limits: Limits{
+			TargetCheckLatency: 250 * time.Millisecond,
+			OverloadAction:     OverloadActionDeny,
 		},
 	}
 }
@@ -153,6 +231,32 @@ type Config struct {
 	Auth Auth `yaml:"auth,omitempty" mapstructure:"auth,omitempty"`
 	// Apigee Environment configurations.
 	EnvironmentSpecs EnvironmentSpecs `yaml:"environment_specs,omitempty" mapstructure:"environment_specs,omitempty"`
+	// Limits protect the service from oversized requests.
+	Limits Limits `yaml:"limits,omitempty" mapstructure:"limits,omitempty"`
+	// Apigee environment key value maps available to specs.
+	KeyValueMaps KeyValueMaps `yaml:"key_value_maps,omitempty" mapstructure:"key_value_maps,omitempty"`
+	// Shared signals of environment spec bot_rules.
+	BotDetection BotDetection `yaml:"bot_detection,omitempty" mapstructure:"bot_detection,omitempty"`
+	// Revoked JWTs of environment spec jwt_authentications.
+	JWTRevocation JWTRevocation `yaml:"jwt_revocation,omitempty" mapstructure:"jwt_revocation,omitempty"`
+	// Quota counters shared by the replicas of the service.
+	QuotaStore QuotaStore `yaml:"quota_store,omitempty" mapstructure:"quota_store,omitempty"`
+	// When requests are counted against quotas.
+	QuotaCounting QuotaCounting `yaml:"quota_counting,omitempty" mapstructure:"quota_counting,omitempty"`
+	// API key verifications shared by the replicas of the service.
+	VerificationStore VerificationStore `yaml:"verification_store,omitempty" mapstructure:"verification_store,omitempty"`
+	// Nonces of environment spec replay_protection shared by the replicas of the service.
+	ReplayStore ReplayStore `yaml:"replay_store,omitempty" mapstructure:"replay_store,omitempty"`
+	// Percentage rollouts of new behaviors by flag name.
+	FeatureFlags FeatureFlags `yaml:"feature_flags,omitempty" mapstructure:"feature_flags,omitempty"`
+	// Structured events of request denials sent to a webhook.
+	DenialWebhook DenialWebhook `yaml:"denial_webhook,omitempty" mapstructure:"denial_webhook,omitempty"`
+	// Normalization of request paths and hosts before matching and analytics.
+	RequestNormalization RequestNormalization `yaml:"request_normalization,omitempty" mapstructure:"request_normalization,omitempty"`
+	// Proxies trusted to forward the client addresses of requests.
+	TrustedProxies TrustedProxies `yaml:"trusted_proxies,omitempty" mapstructure:"trusted_proxies,omitempty"`
+	// Upstream health metrics of APIs from the stats streamed by Envoy.
+	EnvoyStats EnvoyStats `yaml:"envoy_stats,omitempty" mapstructure:"envoy_stats,omitempty"`
 }
 
 // Global is configuration for the server including the server's listeners' addresses, keepalive,
@@ -165,6 +269,50 @@ type Global struct {
 	KeepAliveMaxConnectionAge time.Duration   `yaml:"keep_alive_max_connection_age,omitempty" mapstructure:"keep_alive_max_connection_age,omitempty"`
 	TLS                       TLSListenerSpec `yaml:"tls,omitempty" mapstructure:"tls,omitempty"`
 	Namespace                 string          `yaml:"-" mapstructure:"namespace,omitempty"`
+	// ConfigEventWebhook receives a JSON POST of each config load event in
+	// addition to the log.
+	ConfigEventWebhook string `yaml:"config_event_webhook,omitempty" mapstructure:"config_event_webhook,omitempty"`
+	// StrictConfig rejects config and environment spec files with unknown
+	// fields instead of logging a warning for each.
+	StrictConfig bool `yaml:"strict_config,omitempty" mapstructure:"strict_config,omitempty"`
+	// ValidateEndpoints fails startup if the JWKS source of any environment
+	// spec JWTAuthentication is unreachable or serves no valid keys.
+	ValidateEndpoints bool `yaml:"validate_endpoints,omitempty" mapstructure:"validate_endpoints,omitempty"`
+	// AdminAccess restricts the endpoints of the metrics address, such as
+	// /metrics, /healthz, /quotas, /traces, /consumers/blocks,
+	// /caches/invalidate, /authorize and /specs/validate. The endpoints
+	// changing state or returning consumer details are only served if set.
+	AdminAccess AdminAccess `yaml:"admin_access,omitempty" mapstructure:"admin_access,omitempty"`
+	// AuthorizationFacade also serves the authorization gRPC services on the
+	// metrics address to gRPC clients over HTTP/2, including h2c, and to
+	// gRPC-Web clients. Requires admin_access.
+	AuthorizationFacade bool `yaml:"authorization_facade,omitempty" mapstructure:"authorization_facade,omitempty"`
+	// AuthorizeCORS is the CORS policy of the authorization API served by the
+	// metrics address: /authorize and the gRPC-Web authorization service.
+	// Preflights of allowed origins don't need the admin_access bearer token
+	// as browsers send them without credentials, other admin_access
+	// restrictions apply.
+	AuthorizeCORS CorsPolicy `yaml:"authorize_cors,omitempty" mapstructure:"authorize_cors,omitempty"`
+}
+
+// AdminAccess restricts the clients of the metrics address. Requests must
+// satisfy each restriction set.
+type AdminAccess struct {
+	// BearerToken must be sent as "Authorization: Bearer <token>".
+	BearerToken string `yaml:"bearer_token,omitempty" json:"-" mapstructure:"bearer_token,omitempty"`
+	// ClientCAFile is a PEM bundle of the CAs that must have issued the client
+	// certificate. Requires global.tls.
+	ClientCAFile string `yaml:"client_ca_file,omitempty" mapstructure:"client_ca_file,omitempty"`
+	// AllowedCIDRs are the client address ranges allowed, eg. 10.0.0.0/8.
+	AllowedCIDRs []string `yaml:"allowed_cidrs,omitempty" mapstructure:"allowed_cidrs,omitempty"`
+	// UnrestrictedPaths are exempt from the restrictions, eg. /healthz for
+	// kubelet probes.
+	UnrestrictedPaths []string `yaml:"unrestricted_paths,omitempty" mapstructure:"unrestricted_paths,omitempty"`
+}
+
+// Enabled returns true if any restriction is set.
+func (a AdminAccess) Enabled() bool {
+	return a.BearerToken != "" || a.ClientCAFile != "" || len(a.AllowedCIDRs) > 0
 }
 
 // TLSListenerSpec is tls configuration
@@ -198,15 +346,160 @@ type Tenant struct {
 	JWKS                jwk.Set         `yaml:"-" json:"-"`
 	InternalJWTDuration time.Duration   `yaml:"-"`
 	InternalJWTRefresh  time.Duration   `yaml:"-"`
+	// Environments, if present, allows a single adapter to serve several environments.
+	// Each request is assigned an environment by its matched environment spec or by
+	// its host. Implies multitenant, env_name may be omitted or "*".
+	Environments []TenantEnvironment `yaml:"environments,omitempty" mapstructure:"environments,omitempty"`
+	// RemoteServiceAPIFailovers are alternate remote_service_api endpoints, such as
+	// those of other Apigee runtime regions, in order of preference.
+	RemoteServiceAPIFailovers []string `yaml:"remote_service_api_failovers,omitempty" mapstructure:"remote_service_api_failovers,omitempty"`
+	// InternalAPIFailovers are alternate internal_api endpoints in order of preference.
+	InternalAPIFailovers []string `yaml:"internal_api_failovers,omitempty" mapstructure:"internal_api_failovers,omitempty"`
+	// Failover controls the health checks of endpoints with failovers.
+	Failover Failover `yaml:"failover,omitempty" mapstructure:"failover,omitempty"`
+	// Retry controls the retries of outbound calls to Apigee and JWKS endpoints.
+	Retry OutboundRetry `yaml:"retry,omitempty" mapstructure:"retry,omitempty"`
+	// Bootstrap fetches the provisioned remote-service settings from Apigee at startup.
+	Bootstrap TenantBootstrap `yaml:"bootstrap,omitempty" mapstructure:"bootstrap,omitempty"`
+}
+
+// Failover is config for switching between an endpoint and its failovers.
+// Requests move to the next endpoint when the active endpoint is unreachable
+// and stay there until a preferred endpoint passes RecoveryThreshold
+// consecutive health checks.
+type Failover struct {
+	HealthCheckInterval time.Duration `yaml:"health_check_interval,omitempty" mapstructure:"health_check_interval,omitempty"`
+	RecoveryThreshold   int           `yaml:"recovery_threshold,omitempty" mapstructure:"recovery_threshold,omitempty"`
+}
+
+// TenantEnvironment maps requests to an Apigee environment
+type TenantEnvironment struct {
+	// Name of the Apigee environment.
+	Name string `yaml:"name" mapstructure:"name"`
+	// Hosts of requests to route to this environment, such as the hostnames
+	// of its environment group. A leading "*" matches any subdomain.
+	Hosts []string `yaml:"hosts,omitempty" mapstructure:"hosts,omitempty"`
+	// IDs of the environment specs whose requests are routed to this environment.
+	EnvironmentSpecIDs []string `yaml:"environment_spec_ids,omitempty" mapstructure:"environment_spec_ids,omitempty"`
 }
 
 func (t *Tenant) IsMultitenant() bool {
-	return t.EnvName == "*"
+	return t.EnvName == "*" || len(t.Environments) > 0
 }
 
 // Products is products-related config
 type Products struct {
 	RefreshRate time.Duration `yaml:"refresh_rate,omitempty" json:"refresh_rate,omitempty" mapstructure:"refresh_rate,omitempty"`
+	// ResourceMatching "classic" matches product resource paths as Apigee
+	// proxies do. Omit for the adapter's path matching.
+	ResourceMatching string `yaml:"resource_matching,omitempty" json:"resource_matching,omitempty" mapstructure:"resource_matching,omitempty"`
+}
+
+// ResourceMatchingClassic matches product resource paths with Apigee proxy
+// semantics: "/" matches all paths, "*" one segment, "**" one or more
+// segments, a trailing slash of the request path is ignored, and a product
+// without resources matches all paths.
+const ResourceMatchingClassic = "classic"
+
+// KeyValueMaps is config for reading Apigee environment key value maps (KVMs).
+// Entries of the named KVMs are available to templates and conditions as
+// {kvm.map.key}.
+type KeyValueMaps struct {
+	// ProxyAPI must be set to read KVMs, here or by JWTRevocation.KVM. The
+	// standard remote-service proxy has no KVM API: it must be customized to
+	// serve GET {remote_service_api}/keyvaluemaps/{env}/{map} with the
+	// entries of the map of tenant.env_name as
+	// {"keyValueEntries": [{"name": key, "value": value}]}, the form of the
+	// Apigee API. Unsupported by multitenant configs.
+	ProxyAPI    bool          `yaml:"proxy_api,omitempty" mapstructure:"proxy_api,omitempty"`
+	Names       []string      `yaml:"names,omitempty" mapstructure:"names,omitempty"`
+	RefreshRate time.Duration `yaml:"refresh_rate,omitempty" mapstructure:"refresh_rate,omitempty"`
+	// AnalyticsAttributes are "map.key" entries recorded as "kvm.map.key"
+	// analytics attributes.
+	AnalyticsAttributes []string `yaml:"analytics_attributes,omitempty" mapstructure:"analytics_attributes,omitempty"`
+}
+
+// BotDetection is config for the IP reputation list of bot_rules. The list
+// has an IP address or CIDR per line, blank lines and "#" comments are ignored.
+type BotDetection struct {
+	IPReputationFile string        `yaml:"ip_reputation_file,omitempty" mapstructure:"ip_reputation_file,omitempty"`
+	IPReputationURL  string        `yaml:"ip_reputation_url,omitempty" mapstructure:"ip_reputation_url,omitempty"`
+	RefreshRate      time.Duration `yaml:"refresh_rate,omitempty" mapstructure:"refresh_rate,omitempty"`
+}
+
+// JWTRevocation is config for the revocation list of JWTs verified by
+// environment spec jwt_authentications, of OAuth access token claims, and of
+// the JWT claims of the Envoy JWT filter. The list is loaded from a file, URL,
+// or Apigee environment key value map. File and URL lists have an entry per
+// line, blank lines and "#" comments are ignored. KVM entry names are entries,
+// their values are ignored, see KeyValueMaps.ProxyAPI. Entries are "jti:<id>"
+// or "sub:<subject>".
+type JWTRevocation struct {
+	File        string        `yaml:"file,omitempty" mapstructure:"file,omitempty"`
+	URL         string        `yaml:"url,omitempty" mapstructure:"url,omitempty"`
+	KVM         string        `yaml:"kvm,omitempty" mapstructure:"kvm,omitempty"`
+	RefreshRate time.Duration `yaml:"refresh_rate,omitempty" mapstructure:"refresh_rate,omitempty"`
+}
+
+// Configured is true if a revocation list source is set
+func (r JWTRevocation) Configured() bool {
+	return r.File != "" || r.URL != "" || r.KVM != ""
+}
+
+// QuotaStore counts quotas in a store shared by the replicas of the service
+// so they enforce their combined limit. Without a store, each replica counts
+// locally and syncs its counts with Apigee.
+type QuotaStore struct {
+	Redis Redis `yaml:"redis,omitempty" mapstructure:"redis,omitempty"`
+}
+
+// QuotaCounting selects when requests are counted against quotas.
+type QuotaCounting struct {
+	// Mode "check" counts each allowed request when it is checked.
+	// "access_log" checks the quotas are not exhausted and counts the request
+	// from its access log record once it completes, so requests that Envoy
+	// fails before reaching the target, eg. for upstream connection failures,
+	// are not counted. Requests in flight may exceed the quotas.
+	Mode string `yaml:"mode,omitempty" mapstructure:"mode,omitempty"`
+}
+
+// QuotaCounting modes
+const (
+	QuotaCountingCheck     = "check"
+	QuotaCountingAccessLog = "access_log"
+)
+
+// VerificationStore shares the API key verification caches of the replicas
+// of the service so each verification is requested from Apigee once. Without
+// a store, each replica verifies and caches locally.
+type VerificationStore struct {
+	Redis Redis `yaml:"redis,omitempty" mapstructure:"redis,omitempty"`
+	// SigningKey is the secret the replicas sign stored verifications with so
+	// those not stored by a replica are ignored. Required with Redis.
+	SigningKey string `yaml:"signing_key,omitempty" json:"-" mapstructure:"signing_key,omitempty"`
+}
+
+// ReplayStore records the nonces of replay protected requests in a store
+// shared by the replicas of the service so a nonce is accepted once by any
+// replica. Without a store, each replica records nonces locally.
+type ReplayStore struct {
+	Redis Redis `yaml:"redis,omitempty" mapstructure:"redis,omitempty"`
+}
+
+// Redis is a Redis server. Addresses are redis:// or rediss:// (TLS) URLs
+// tried in order, the next address is used when the current one fails. The
+// service falls back to local state while no address is reachable.
+type Redis struct {
+	Addresses []string      `yaml:"addresses,omitempty" mapstructure:"addresses,omitempty"`
+	Username  string        `yaml:"username,omitempty" mapstructure:"username,omitempty"`
+	Password  string        `yaml:"password,omitempty" mapstructure:"password,omitempty" json:"-"`
+	DB        int           `yaml:"db,omitempty" mapstructure:"db,omitempty"`
+	TLS       TLSClientSpec `yaml:"tls,omitempty" mapstructure:"tls,omitempty"`
+	KeyPrefix string        `yaml:"key_prefix,omitempty" mapstructure:"key_prefix,omitempty"`
+	// PoolSize is the maximum number of idle connections kept open.
+	PoolSize int `yaml:"pool_size,omitempty" mapstructure:"pool_size,omitempty"`
+	// Timeout of connecting and of each command.
+	Timeout time.Duration `yaml:"timeout,omitempty" mapstructure:"timeout,omitempty"`
 }
 
 // Analytics is analytics-related config
@@ -217,17 +510,260 @@ type Analytics struct {
 	CollectionInterval time.Duration       `yaml:"collection_interval,omitempty" mapstructure:"collection_interval,omitempty"`
 	CredentialsJSON    []byte              `yaml:"-" json:"-"`
 	Credentials        *google.Credentials `yaml:"-" json:"-"`
+	// SpoolDenyThreshold, if positive, denies new requests while the number of analytics
+	// files staged for upload is at or above this value. Must be less than FileLimit.
+	SpoolDenyThreshold int `yaml:"spool_deny_threshold,omitempty" mapstructure:"spool_deny_threshold,omitempty"`
+	// SpoolDenyStatusCode is the HTTP status sent while denying: 429 or 503 (default).
+	SpoolDenyStatusCode int `yaml:"spool_deny_status_code,omitempty" mapstructure:"spool_deny_status_code,omitempty"`
+	// SpoolCheckInterval is how often the analytics spool is measured, must be
+	// positive if SpoolDenyThreshold is.
+	SpoolCheckInterval time.Duration `yaml:"spool_check_interval,omitempty" mapstructure:"spool_check_interval,omitempty"`
+	// AccessLogWorkers send the analytics records of the access logs so slow
+	// uploads don't block the access log streams. The records of each
+	// environment are sent in order by one worker. Zero, the default, sends
+	// while reading.
+	AccessLogWorkers int `yaml:"access_log_workers,omitempty" mapstructure:"access_log_workers,omitempty"`
+	// AccessLogQueueSize bounds the records queued for each worker, records are
+	// dropped while it's full and counted by analytics_worker_records_count.
+	AccessLogQueueSize int `yaml:"access_log_queue_size,omitempty" mapstructure:"access_log_queue_size,omitempty"`
+	// DeduplicationWindow, if positive, is how long access log entries are
+	// remembered by request ID and start time so entries Envoy resends after
+	// reconnecting aren't recorded twice. Best effort, each replica remembers
+	// its own entries.
+	DeduplicationWindow time.Duration `yaml:"deduplication_window,omitempty" mapstructure:"deduplication_window,omitempty"`
+	// MaxTimeSkew, if positive, corrects record timestamps from Envoy that differ
+	// from the adapter's clock by more than this duration.
+	MaxTimeSkew time.Duration `yaml:"max_time_skew,omitempty" mapstructure:"max_time_skew,omitempty"`
+	// AnomalyDetection tracks error rate and latency spikes of the operations
+	// in the access logs.
+	AnomalyDetection AnomalyDetection `yaml:"anomaly_detection,omitempty" mapstructure:"anomaly_detection,omitempty"`
+	// DatacaptureNamespaces are filter metadata namespaces, in addition to
+	// the Apigee datacapture filter's, harvested as custom attributes.
+	DatacaptureNamespaces []DatacaptureNamespace `yaml:"datacapture_namespaces,omitempty" mapstructure:"datacapture_namespaces,omitempty"`
+	// UploadTraceEndpoint, if set, is the http or https URL of an OTLP gRPC
+	// collector receiving a span for each request of the analytics uploads.
+	UploadTraceEndpoint string `yaml:"upload_trace_endpoint,omitempty" mapstructure:"upload_trace_endpoint,omitempty"`
+	// ProxyFields maps the API proxy names of analytics records, the
+	// analytics_proxy of the operation or else the API ID, to custom values of
+	// their proxy revision, base path, and virtual host fields.
+	ProxyFields map[string]AnalyticsProxyFields `yaml:"proxy_fields,omitempty" mapstructure:"proxy_fields,omitempty"`
+}
+
+// DatacaptureNamespace is a filter metadata namespace whose string, number,
+// and bool fields are recorded as analytics attributes. With OpenTelemetry
+// access logs, the metadata is read from the log attribute of the same name.
+type DatacaptureNamespace struct {
+	Namespace string `yaml:"namespace,omitempty" mapstructure:"namespace,omitempty"`
+	// Prefix is prepended to the attribute names, e.g. "waf."
+	Prefix string `yaml:"prefix,omitempty" mapstructure:"prefix,omitempty"`
+}
+
+// AnomalyDetection compares the error rate and mean latency of each API
+// operation over an interval to their exponentially weighted moving averages.
+// An interval exceeding Factor times its average is an anomaly.
+type AnomalyDetection struct {
+	Enabled bool `yaml:"enabled,omitempty" mapstructure:"enabled,omitempty"`
+	// Interval of the error rate and latency samples.
+	Interval time.Duration `yaml:"interval,omitempty" mapstructure:"interval,omitempty"`
+	// Smoothing is the weight (0 to 1] of each new sample in the moving averages.
+	Smoothing float64 `yaml:"smoothing,omitempty" mapstructure:"smoothing,omitempty"`
+	// Factor of the moving average a sample must exceed to be an anomaly.
+	Factor float64 `yaml:"factor,omitempty" mapstructure:"factor,omitempty"`
+	// MinErrorRate an error rate sample must also exceed to be an anomaly.
+	MinErrorRate float64 `yaml:"min_error_rate,omitempty" mapstructure:"min_error_rate,omitempty"`
+	// MinRequests of an interval to be sampled.
+	MinRequests int `yaml:"min_requests,omitempty" mapstructure:"min_requests,omitempty"`
+	// Webhook receives a JSON POST when an anomaly starts or ends.
+	Webhook string `yaml:"webhook,omitempty" mapstructure:"webhook,omitempty"`
+}
+
+// Consumer fields of auth.consumer_fields.
+const (
+	ConsumerFieldAccessToken    = "access_token"
+	ConsumerFieldAPIProducts    = "api_products"
+	ConsumerFieldApplication    = "application"
+	ConsumerFieldClientID       = "client_id"
+	ConsumerFieldDeveloperEmail = "developer_email"
+	ConsumerFieldScope          = "scope"
+)
+
+// Baggage fields of auth.baggage, besides the consumer fields application,
+// client_id and api_products.
+const (
+	BaggageFieldAPI       = "api"
+	BaggageFieldOperation = "operation"
+)
+
+// ConsumerField is how a verified consumer field is sent upstream.
+type ConsumerField struct {
+	// Header sends the field as a request header.
+	Header bool `yaml:"header,omitempty" mapstructure:"header,omitempty"`
+	// HeaderName overrides the default x-apigee-* header name.
+	HeaderName string `yaml:"header_name,omitempty" mapstructure:"header_name,omitempty"`
+	// OmitMetadata excludes the field from the ext_authz dynamic metadata.
+	// Omitted fields are not recorded in analytics.
+	OmitMetadata bool `yaml:"omit_metadata,omitempty" mapstructure:"omit_metadata,omitempty"`
+}
+
+// Overload actions taken on requests shed while the adapter is saturated.
+const (
+	OverloadActionDeny  = "deny"  // deny with status 503
+	OverloadActionAllow = "allow" // forward unchecked with the x-apigee-overloaded header, fails open
+)
+
+// Limits protect the service. A request exceeding a size limit is denied with
+// status 431. Zero disables a limit.
+type Limits struct {
+	// MaxHeaders is the maximum number of request headers.
+	MaxHeaders int `yaml:"max_headers,omitempty" mapstructure:"max_headers,omitempty"`
+	// MaxHeadersBytes is the maximum total size of request header names and values.
+	MaxHeadersBytes int `yaml:"max_headers_bytes,omitempty" mapstructure:"max_headers_bytes,omitempty"`
+	// MaxConcurrentChecks is the upper bound of the adaptive concurrency limit
+	// of authorization checks. Checks over the limit are shed.
+	MaxConcurrentChecks int `yaml:"max_concurrent_checks,omitempty" mapstructure:"max_concurrent_checks,omitempty"`
+	// TargetCheckLatency is the check latency the concurrency limit adapts to,
+	// the limit shrinks while checks are slower.
+	TargetCheckLatency time.Duration `yaml:"target_check_latency,omitempty" mapstructure:"target_check_latency,omitempty"`
+	// OverloadAction for shed checks: deny (default) or allow. Allow fails
+	// open: shed requests are forwarded without authentication, authorization,
+	// or quotas, and clients able to saturate the adapter can cause it. Only
+	// for upstreams that enforce their own access control, eg. by rejecting
+	// requests with the x-apigee-overloaded header.
+	OverloadAction string `yaml:"overload_action,omitempty" mapstructure:"overload_action,omitempty"`
+}
+
+// Modes of RequestNormalization.
+const (
+	RequestNormalizationNormalize = "normalize"
+	RequestNormalizationStrict    = "strict"
+	RequestNormalizationOff       = "off"
+)
+
+// RequestNormalization applies the RFC 3986 syntax-based normalization to
+// request paths, decoding percent-encoded unreserved characters, uppercasing
+// other percent-encodings, and removing dot segments, and converts hosts to
+// lowercase ASCII, internationalized names to punycode, before operation
+// matching, environment routing, and analytics.
+type RequestNormalization struct {
+	// Mode is normalize (default); strict, which also denies requests with
+	// invalid percent-encodings, encoded slashes, backslashes, or control
+	// characters in their paths, or hosts that aren't valid domain names; or
+	// off.
+	Mode string `yaml:"mode,omitempty" mapstructure:"mode,omitempty"`
 }
 
 // Auth is auth-related config
 type Auth struct {
-	APIKeyClaim           string        `yaml:"api_key_claim,omitempty" mapstructure:"api_key_claim,omitempty"`
-	APIKeyCacheDuration   time.Duration `yaml:"api_key_cache_duration,omitempty" mapstructure:"api_key_cache_duration,omitempty"`
-	APIKeyHeader          string        `yaml:"api_key_header,omitempty" mapstructure:"api_key_header,omitempty"`
-	APIHeader             string        `yaml:"api_header,omitempty" mapstructure:"api_header,omitempty"`
-	AllowUnauthorized     bool          `yaml:"allow_unauthorized,omitempty" mapstructure:"allow_unauthorized,omitempty"`
-	JWTProviderKey        string        `yaml:"jwt_provider_key,omitempty" mapstructure:"jwt_provider_key,omitempty"`
-	AppendMetadataHeaders bool          `yaml:"append_metadata_headers,omitempty" mapstructure:"append_metadata_headers,omitempty"`
+	APIKeyClaim              string        `yaml:"api_key_claim,omitempty" mapstructure:"api_key_claim,omitempty"`
+	APIKeyCacheDuration      time.Duration `yaml:"api_key_cache_duration,omitempty" mapstructure:"api_key_cache_duration,omitempty"`
+	AccessTokenCacheDuration time.Duration `yaml:"access_token_cache_duration,omitempty" mapstructure:"access_token_cache_duration,omitempty"`
+	APIKeyHeader             string        `yaml:"api_key_header,omitempty" mapstructure:"api_key_header,omitempty"`
+	APIHeader                string        `yaml:"api_header,omitempty" mapstructure:"api_header,omitempty"`
+	AllowUnauthorized        bool          `yaml:"allow_unauthorized,omitempty" mapstructure:"allow_unauthorized,omitempty"`
+	JWTProviderKey           string        `yaml:"jwt_provider_key,omitempty" mapstructure:"jwt_provider_key,omitempty"`
+	AppendMetadataHeaders    bool          `yaml:"append_metadata_headers,omitempty" mapstructure:"append_metadata_headers,omitempty"`
+	// CheckStages orders the stages of authorization checks. If empty, the built-in
+	// stages are used: spec_match, authentication, consumer_authorization, quota,
+	// and transforms. Custom stages may be placed between the built-in stages.
+	CheckStages []string `yaml:"check_stages,omitempty" mapstructure:"check_stages,omitempty"`
+	// AppendMatchHeaders sends the matched environment spec ID, API ID, API base
+	// path and operation name upstream as the x-apigee-environment-spec,
+	// x-apigee-api, x-apigee-basepath and x-apigee-operation headers. They are
+	// always in the ext_authz dynamic metadata.
+	AppendMatchHeaders bool `yaml:"append_match_headers,omitempty" mapstructure:"append_match_headers,omitempty"`
+	// MetadataHeaderMaxBytes limits the size of each append_metadata_headers value,
+	// larger values are compressed and split across headers. Zero is unlimited.
+	MetadataHeaderMaxBytes int `yaml:"metadata_header_max_bytes,omitempty" mapstructure:"metadata_header_max_bytes,omitempty"`
+	// ConsumerFields selects the verified consumer fields sent upstream by field
+	// name: access_token, api_products, application, client_id, developer_email
+	// or scope. If set, only the fields with header enabled are sent as headers
+	// and append_metadata_headers just adds the api, environment and organization.
+	ConsumerFields map[string]ConsumerField `yaml:"consumer_fields,omitempty" mapstructure:"consumer_fields,omitempty"`
+	// MetricLabels names the API and operation labels counted in the
+	// auth_labeled_requests_count metric. Keep the set small, each label value
+	// is a metric series.
+	MetricLabels []string `yaml:"metric_labels,omitempty" mapstructure:"metric_labels,omitempty"`
+	// MetricSpecs lists the environment spec IDs recorded as the "spec" label of
+	// auth and traffic metrics, others are recorded as "other". "*" records all
+	// IDs. If empty, the label is left blank.
+	MetricSpecs []string `yaml:"metric_specs,omitempty" mapstructure:"metric_specs,omitempty"`
+	// MetricAPIs lists the API IDs recorded as the "api" label of auth,
+	// traffic and anomaly metrics like MetricSpecs. With "*", API IDs taken from the
+	// api_header are recorded as sent, so prefer listing them.
+	MetricAPIs []string `yaml:"metric_apis,omitempty" mapstructure:"metric_apis,omitempty"`
+	// JWTParallelism limits how many JWT requirements of an "any" authentication
+	// requirement are verified concurrently, the first success wins. Values
+	// below 2 verify sequentially.
+	JWTParallelism int `yaml:"jwt_parallelism,omitempty" mapstructure:"jwt_parallelism,omitempty"`
+	// VerificationTimeout limits API key and JWT verification of APIs without
+	// their own verification_timeouts. Zero is only limited by tenant.client_timeout.
+	VerificationTimeout time.Duration `yaml:"verification_timeout,omitempty" mapstructure:"verification_timeout,omitempty"`
+	// MaxVerificationTimeout caps the verification_timeouts of all APIs. Zero is unlimited.
+	MaxVerificationTimeout time.Duration `yaml:"max_verification_timeout,omitempty" mapstructure:"max_verification_timeout,omitempty"`
+	// APIKeyHash, if set, sends API keys for verification as their hex digest by
+	// "sha256" or "hmac-sha256" instead of in the clear. Only for remote-service
+	// proxies customized to verify keys in the same form.
+	APIKeyHash string `yaml:"api_key_hash,omitempty" mapstructure:"api_key_hash,omitempty"`
+	// APIKeyHashKey is the secret key of the "hmac-sha256" APIKeyHash.
+	APIKeyHashKey string `yaml:"api_key_hash_key,omitempty" json:"-" mapstructure:"api_key_hash_key,omitempty"`
+	// ConsumerKeyAPI enables the app_attribute lookups of ClientCertificate
+	// locations and consumer authorization app bindings. The standard
+	// remote-service proxy has no such API: it must be customized to serve
+	// POST {remote_service_api}/consumerKey with a JSON body of
+	// {"attribute": name, "value": value}, answering 200 with
+	// {"consumerKey": key} of the app having the custom attribute value, or 404
+	// if there is none (eg. with an AccessEntity or KVM lookup).
+	ConsumerKeyAPI bool `yaml:"consumer_key_api,omitempty" mapstructure:"consumer_key_api,omitempty"`
+	// TokenSchemes, such as Bearer and Token, are stripped case-insensitively
+	// from the values of the JWTAuthentication and OAuthAuthentication
+	// locations before their transformations.
+	TokenSchemes []string `yaml:"token_schemes,omitempty" mapstructure:"token_schemes,omitempty"`
+	// JWTLimits rejects oversized or pathological JWTs from clients before
+	// they are parsed.
+	JWTLimits JWTLimits `yaml:"jwt_limits,omitempty" mapstructure:"jwt_limits,omitempty"`
+	// VerifyAPIKeyHeaders lists the request headers, such as x-forwarded-for,
+	// forwarded to the remote-service verifyApiKey call for its verification
+	// policies. Only listed headers are sent and credentials may not be listed.
+	// Verifications are cached by key, so the headers are those of the request
+	// that missed the cache.
+	VerifyAPIKeyHeaders []string `yaml:"verify_api_key_headers,omitempty" mapstructure:"verify_api_key_headers,omitempty"`
+	// Baggage adds the listed fields of allowed requests to the W3C baggage
+	// header sent upstream as apigee.<field> members, so backend traces carry
+	// them: api, operation, application, client_id or api_products. Clients'
+	// apigee.* members are removed.
+	Baggage []string `yaml:"baggage,omitempty" mapstructure:"baggage,omitempty"`
+}
+
+// JWTLimits bound the JWTs of JWTAuthentications and DPoP proofs. Zero is
+// unlimited.
+type JWTLimits struct {
+	// MaxBytes is the longest token.
+	MaxBytes int `yaml:"max_bytes,omitempty" mapstructure:"max_bytes,omitempty"`
+	// MaxClaims is the most top-level claims of the payload.
+	MaxClaims int `yaml:"max_claims,omitempty" mapstructure:"max_claims,omitempty"`
+	// MaxDepth is the deepest nesting of objects and arrays in the payload,
+	// the payload object itself is depth 1.
+	MaxDepth int `yaml:"max_depth,omitempty" mapstructure:"max_depth,omitempty"`
+}
+
+// API key hashes of Auth.APIKeyHash.
+const (
+	APIKeyHashSHA256     = "sha256"
+	APIKeyHashHMACSHA256 = "hmac-sha256"
+)
+
+// verifyAPIKeyHeadersDenied are credentials and headers of the verifyApiKey
+// call itself that may not be forwarded by Auth.VerifyAPIKeyHeaders.
+var verifyAPIKeyHeadersDenied = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"cookie":              true,
+	"set-cookie":          true,
+	"x-api-key":           true,
+	"host":                true,
+	"content-type":        true,
+	"content-length":      true,
+	"accept":              true,
 }
 
 // Load config with the given config file, secret paths and a flag specifying whether analytics credentials must be present.
@@ -281,6 +817,9 @@ func (c *Config) Load(configFile, policySecretPath, analyticsSecretPath string,
 				if err = c.unmarshalWithConfig(configBytes); err != nil {
 					return errors.Wrap(err, "bad config file format")
 				}
+				if err = c.checkUnknownFields(configFile, configBytes, unknownConfigFields); err != nil {
+					return err
+				}
 			}
 		} else if crd.Kind == "Secret" {
 			if strings.Contains(crd.Metadata.Name, "policy") {
@@ -309,6 +848,11 @@ func (c *Config) Load(configFile, policySecretPath, analyticsSecretPath string,
 		if err = c.unmarshalWithConfig(yamlFile); err != nil {
 			return errors.Wrap(err, "bad config file format")
 		}
+		if crd.Kind == "" { // not CRDs
+			if err = c.checkUnknownFields(configFile, yamlFile, unknownConfigFields); err != nil {
+				return err
+			}
+		}
 	}
 
 	// if no Secret, try files in policySecretPath
@@ -371,6 +915,16 @@ func (c *Config) Load(configFile, policySecretPath, analyticsSecretPath string,
 		}
 	}
 
+	if err = c.bootstrap(); err != nil {
+		return errors.Wrap(err, "tenant bootstrap")
+	}
+
+	if c.EnvironmentSpecs.verifier, err = c.EnvironmentSpecs.Signatures.Verifier(); err != nil {
+		return err
+	}
+	if c.EnvironmentSpecs.Signatures.Required && len(c.EnvironmentSpecs.Inline) > 0 {
+		return fmt.Errorf("environment_specs.inline are unsigned, refused by environment_specs.signatures.required")
+	}
 	for _, v := range c.EnvironmentSpecs.References {
 		f := strings.TrimPrefix(v, "file://")
 		info, err := os.Stat(f)
@@ -381,21 +935,22 @@ func (c *Config) Load(configFile, policySecretPath, analyticsSecretPath string,
 			if err := c.loadEnvironmentSpec(f); err != nil {
 				return err
 			}
-		} else {
-			entries, err := os.ReadDir(f)
-			if err != nil {
-				return err
-			}
-			for _, e := range entries {
-				if !e.IsDir() {
-					if err := c.loadEnvironmentSpec(path.Join(f, e.Name())); err != nil {
-						return err
-					}
-				}
-			}
+		} else if err := c.loadEnvironmentSpecDir(f); err != nil {
+			return err
 		}
 	}
 
+	for i := range c.EnvironmentSpecs.Remote {
+		if err := c.loadRemoteEnvironmentSpecs(c.EnvironmentSpecs.Remote[i]); err != nil {
+			return err
+		}
+	}
+
+	// environments are served in multitenant mode
+	if len(c.Tenant.Environments) > 0 && c.Tenant.EnvName == "" {
+		c.Tenant.EnvName = "*"
+	}
+
 	return c.Validate(requireAnalyticsCredentials)
 }
 
@@ -435,24 +990,139 @@ func (c *Config) analyticsCredentialsFromBytes(b []byte) error {
 	return err
 }
 
-// loadEnvironmentSpec unmarshals the given file content into an EnvironmentSpec
-// and appends it to c.EnvironmentSpecs.Inline
+// loadEnvironmentSpecDir loads the YAML files directly in dir in name order,
+// skipping hidden entries such as the ..data links of mounted ConfigMaps
+func (c *Config) loadEnvironmentSpecDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") || !isYAMLFile(e.Name()) {
+			continue
+		}
+		if err := c.loadEnvironmentSpec(path.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadEnvironmentSpec unmarshals each YAML document of the given file into
+// an EnvironmentSpec and appends them to c.EnvironmentSpecs.Inline. The
+// signature of the file is verified if environment_specs.signatures is set.
 func (c *Config) loadEnvironmentSpec(f string) error {
 	log.Debugf("reading environment config from: %s", f)
 	data, err := os.ReadFile(f)
 	if err != nil {
 		return err
 	}
+	if c.EnvironmentSpecs.verifier != nil {
+		result, err := verifyEnvironmentSpecFile(f, data, c.EnvironmentSpecs.Signatures, c.EnvironmentSpecs.verifier)
+		if err != nil {
+			return err
+		}
+		if result == SpecSignatureUnsigned {
+			log.Warnf("environment spec %s is not signed", f)
+		}
+		c.EnvironmentSpecs.signatures = append(c.EnvironmentSpecs.signatures, SpecSignature{Source: f, Result: result})
+	}
+	specs, err := c.DecodeEnvironmentSpecs(f, data)
+	if err != nil {
+		return err
+	}
+	c.EnvironmentSpecs.Inline = append(c.EnvironmentSpecs.Inline, specs...)
+
+	return nil
+}
 
-	ec := EnvironmentSpec{}
-	if err := yaml.Unmarshal(data, &ec); err != nil {
+// loadRemoteEnvironmentSpecs fetches the specs of source and appends them
+// to c.EnvironmentSpecs.Inline
+func (c *Config) loadRemoteEnvironmentSpecs(source RemoteSpecSource) error {
+	log.Debugf("reading environment config from: %s", source.String())
+	fetcher, err := NewSpecSourceFetcher(source, c.EnvironmentSpecs.verifier)
+	if err != nil {
 		return err
 	}
-	c.EnvironmentSpecs.Inline = append(c.EnvironmentSpecs.Inline, ec)
+	data, _, err := fetcher.Fetch()
+	if err != nil {
+		return err
+	}
+	c.EnvironmentSpecs.signatures = append(c.EnvironmentSpecs.signatures,
+		SpecSignature{Source: source.String(), Result: SpecSignatureVerified})
+	specs, err := c.DecodeEnvironmentSpecs(source.String(), data)
+	if err != nil {
+		return err
+	}
+	c.EnvironmentSpecs.Inline = append(c.EnvironmentSpecs.Inline, specs...)
+	c.EnvironmentSpecs.remoteSpecs = append(c.EnvironmentSpecs.remoteSpecs, RemoteSpecs{Fetcher: fetcher, Specs: specs})
 
 	return nil
 }
 
+// DecodeEnvironmentSpecs unmarshals each YAML document of data read from
+// source into an EnvironmentSpec. Unknown fields fail if Global.StrictConfig
+// is set, otherwise are logged.
+func (c *Config) DecodeEnvironmentSpecs(source string, data []byte) ([]EnvironmentSpec, error) {
+	var specs []EnvironmentSpec
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc yaml.Node
+		if err := decoder.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "%s", source)
+		}
+		if isEmptyDocument(&doc) {
+			continue
+		}
+		ec := EnvironmentSpec{}
+		if err := doc.Decode(&ec); err != nil {
+			return nil, errors.Wrapf(err, "%s", source)
+		}
+		if err := c.reportUnknownFields(source, unknownEnvironmentSpecNodeFields(&doc)); err != nil {
+			return nil, err
+		}
+		specs = append(specs, ec)
+	}
+	return specs, nil
+}
+
+// isEmptyDocument is true for documents without content, such as the one
+// between two consecutive "---" separators
+func isEmptyDocument(doc *yaml.Node) bool {
+	return len(doc.Content) == 0 || doc.Content[0].Tag == "!!null"
+}
+
+func isYAMLFile(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// checkUnknownFields fails on fields of file unknown to the unknown func if
+// Global.StrictConfig is set, otherwise logs a warning for each
+func (c *Config) checkUnknownFields(file string, data []byte, unknown func([]byte) ([]error, error)) error {
+	unknownErrs, err := unknown(data)
+	if err != nil {
+		return errors.Wrap(err, "bad config file format")
+	}
+	return c.reportUnknownFields(file, unknownErrs)
+}
+
+// reportUnknownFields returns the unknown field errors of file if
+// Global.StrictConfig is set, otherwise logs a warning for each
+func (c *Config) reportUnknownFields(file string, unknownErrs []error) error {
+	var errs error
+	for _, e := range unknownErrs {
+		if c.Global.StrictConfig {
+			errs = errorset.Append(errs, fmt.Errorf("%s: %v", file, e))
+		} else {
+			log.Warnf("%s: %v, ignored", file, e)
+		}
+	}
+	return errs
+}
+
 // IsGCPManaged is true for Apigee X and Hybrid
 func (c *Config) IsGCPManaged() bool {
 	// Empty InternalAPI will be default to GCP managed.
@@ -492,26 +1162,356 @@ func (c *Config) Validate(requireAnalyticsCredentials bool) error {
 	if c.Tenant.OrgName == "" {
 		errs = errorset.Append(errs, fmt.Errorf("tenant.org_name is required"))
 	}
-	if c.Tenant.EnvName == "" {
+	if len(c.Tenant.Environments) > 0 {
+		if c.Tenant.EnvName != "" && c.Tenant.EnvName != "*" {
+			errs = errorset.Append(errs, fmt.Errorf("tenant.env_name must be \"*\" or omitted if tenant.environments is present"))
+		}
+		envNames := make(map[string]bool, len(c.Tenant.Environments))
+		specEnvs := make(map[string]string)
+		for i, e := range c.Tenant.Environments {
+			if e.Name == "" {
+				errs = errorset.Append(errs, fmt.Errorf("tenant.environments[%d].name is required", i))
+			} else if envNames[e.Name] {
+				errs = errorset.Append(errs, fmt.Errorf("tenant.environments name %q is duplicated", e.Name))
+			}
+			envNames[e.Name] = true
+			for _, id := range e.EnvironmentSpecIDs {
+				if other, ok := specEnvs[id]; ok && other != e.Name {
+					errs = errorset.Append(errs, fmt.Errorf("environment spec %q is assigned to tenant.environments %q and %q", id, other, e.Name))
+				}
+				specEnvs[id] = e.Name
+			}
+		}
+	} else if c.Tenant.EnvName == "" {
 		errs = errorset.Append(errs, fmt.Errorf("tenant.env_name is required"))
 	}
+	for _, f := range c.Tenant.RemoteServiceAPIFailovers {
+		if u, err := url.Parse(f); err != nil || !u.IsAbs() {
+			errs = errorset.Append(errs, fmt.Errorf("tenant.remote_service_api_failovers must be absolute URLs, got %q", f))
+		}
+	}
+	if len(c.Tenant.InternalAPIFailovers) > 0 && c.Tenant.InternalAPI == "" {
+		errs = errorset.Append(errs, fmt.Errorf("tenant.internal_api_failovers requires tenant.internal_api"))
+	}
+	for _, f := range c.Tenant.InternalAPIFailovers {
+		if u, err := url.Parse(f); err != nil || !u.IsAbs() {
+			errs = errorset.Append(errs, fmt.Errorf("tenant.internal_api_failovers must be absolute URLs, got %q", f))
+		}
+	}
+	if len(c.Tenant.RemoteServiceAPIFailovers) > 0 || len(c.Tenant.InternalAPIFailovers) > 0 {
+		if c.Tenant.Failover.HealthCheckInterval <= 0 {
+			errs = errorset.Append(errs, fmt.Errorf("tenant.failover.health_check_interval must be positive"))
+		}
+		if c.Tenant.Failover.RecoveryThreshold <= 0 {
+			errs = errorset.Append(errs, fmt.Errorf("tenant.failover.recovery_threshold must be positive"))
+		}
+	}
+	errs = errorset.Append(errs, c.Tenant.Retry.validate())
 	if c.Tenant.OperationConfigType != "" &&
 		c.Tenant.OperationConfigType != product.ProxyOperationConfigType &&
 		c.Tenant.OperationConfigType != product.RemoteOperationConfigType {
 		errs = errorset.Append(errs, fmt.Errorf("tenant.operationConfigType must be %q or %q",
 			product.ProxyOperationConfigType, product.RemoteOperationConfigType))
 	}
+	if c.Products.ResourceMatching != "" && c.Products.ResourceMatching != ResourceMatchingClassic {
+		errs = errorset.Append(errs, fmt.Errorf("products.resource_matching must be %s or omitted", ResourceMatchingClassic))
+	}
 	if (c.Global.TLS.CertFile != "" || c.Global.TLS.KeyFile != "") &&
 		(c.Global.TLS.CertFile == "" || c.Global.TLS.KeyFile == "") {
 		errs = errorset.Append(errs, fmt.Errorf("global.tls.cert_file and global.tls.key_file are both required if either are present"))
 	}
+	if c.Global.AdminAccess.ClientCAFile != "" && c.Global.TLS.CertFile == "" {
+		errs = errorset.Append(errs, fmt.Errorf("global.admin_access.client_ca_file requires global.tls"))
+	}
+	for _, cidr := range c.Global.AdminAccess.AllowedCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errs = errorset.Append(errs, fmt.Errorf("global.admin_access.allowed_cidrs must be CIDRs, got %q", cidr))
+		}
+	}
+	for _, path := range c.Global.AdminAccess.UnrestrictedPaths {
+		if !strings.HasPrefix(path, "/") {
+			errs = errorset.Append(errs, fmt.Errorf("global.admin_access.unrestricted_paths must start with /, got %q", path))
+		}
+	}
+	if c.Global.ConfigEventWebhook != "" {
+		if u, err := url.Parse(c.Global.ConfigEventWebhook); err != nil || !u.IsAbs() {
+			errs = errorset.Append(errs, fmt.Errorf("global.config_event_webhook must be an absolute URL"))
+		}
+	}
+	if c.Global.AuthorizationFacade && !c.Global.AdminAccess.Enabled() {
+		errs = errorset.Append(errs, fmt.Errorf("global.authorization_facade requires global.admin_access"))
+	}
+	if _, err := c.Global.AuthorizeCORS.Compile(); err != nil {
+		errs = errorset.Append(errs, fmt.Errorf("global.authorize_cors %v", err))
+	}
 	if (c.Tenant.TLS.CAFile != "" || c.Tenant.TLS.CertFile != "" || c.Tenant.TLS.KeyFile != "") &&
 		(c.Tenant.TLS.CAFile == "" || c.Tenant.TLS.CertFile == "" || c.Tenant.TLS.KeyFile == "") {
 		errs = errorset.Append(errs, fmt.Errorf("all tenant.tls options are required if any are present"))
 	}
+	if c.Analytics.SpoolDenyThreshold > 0 {
+		if c.Analytics.SpoolDenyStatusCode != http.StatusTooManyRequests &&
+			c.Analytics.SpoolDenyStatusCode != http.StatusServiceUnavailable {
+			errs = errorset.Append(errs, fmt.Errorf("analytics.spool_deny_status_code must be %d or %d",
+				http.StatusTooManyRequests, http.StatusServiceUnavailable))
+		}
+		if c.Analytics.SpoolDenyThreshold >= c.Analytics.FileLimit {
+			errs = errorset.Append(errs, fmt.Errorf("analytics.spool_deny_threshold must be less than analytics.file_limit"))
+		}
+		if c.Analytics.SpoolCheckInterval <= 0 {
+			errs = errorset.Append(errs, fmt.Errorf("analytics.spool_check_interval must be positive"))
+		}
+	}
+	if c.Analytics.AccessLogWorkers < 0 {
+		errs = errorset.Append(errs, fmt.Errorf("analytics.access_log_workers must not be negative"))
+	} else if c.Analytics.AccessLogWorkers > 0 && c.Analytics.AccessLogQueueSize <= 0 {
+		errs = errorset.Append(errs, fmt.Errorf("analytics.access_log_queue_size must be positive"))
+	}
+	if c.Analytics.DeduplicationWindow < 0 {
+		errs = errorset.Append(errs, fmt.Errorf("analytics.deduplication_window must not be negative"))
+	}
+	if c.Analytics.MaxTimeSkew < 0 {
+		errs = errorset.Append(errs, fmt.Errorf("analytics.max_time_skew must not be negative"))
+	}
+	if ep := c.Analytics.UploadTraceEndpoint; ep != "" {
+		if u, err := url.Parse(ep); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = errorset.Append(errs, fmt.Errorf("analytics.upload_trace_endpoint must be an http or https URL"))
+		}
+	}
+	if ad := c.Analytics.AnomalyDetection; ad.Enabled {
+		if ad.Interval <= 0 {
+			errs = errorset.Append(errs, fmt.Errorf("analytics.anomaly_detection.interval must be positive"))
+		}
+		if ad.Smoothing <= 0 || ad.Smoothing > 1 {
+			errs = errorset.Append(errs, fmt.Errorf("analytics.anomaly_detection.smoothing must be greater than 0 and at most 1"))
+		}
+		if ad.Factor <= 1 {
+			errs = errorset.Append(errs, fmt.Errorf("analytics.anomaly_detection.factor must be greater than 1"))
+		}
+		if ad.MinErrorRate < 0 || ad.MinErrorRate > 1 {
+			errs = errorset.Append(errs, fmt.Errorf("analytics.anomaly_detection.min_error_rate must be between 0 and 1"))
+		}
+		if ad.MinRequests < 1 {
+			errs = errorset.Append(errs, fmt.Errorf("analytics.anomaly_detection.min_requests must be positive"))
+		}
+		if ad.Webhook != "" {
+			if u, err := url.Parse(ad.Webhook); err != nil || !u.IsAbs() {
+				errs = errorset.Append(errs, fmt.Errorf("analytics.anomaly_detection.webhook must be an absolute URL"))
+			}
+		}
+	}
+	namespaces := make(map[string]bool, len(c.Analytics.DatacaptureNamespaces))
+	for i, ns := range c.Analytics.DatacaptureNamespaces {
+		if ns.Namespace == "" {
+			errs = errorset.Append(errs, fmt.Errorf("analytics.datacapture_namespaces[%d].namespace is required", i))
+		} else if namespaces[ns.Namespace] {
+			errs = errorset.Append(errs, fmt.Errorf("analytics.datacapture_namespaces has duplicate namespace %q", ns.Namespace))
+		}
+		namespaces[ns.Namespace] = true
+	}
+	if c.Auth.MetadataHeaderMaxBytes < 0 {
+		errs = errorset.Append(errs, fmt.Errorf("auth.metadata_header_max_bytes must not be negative"))
+	}
+	if c.Auth.JWTParallelism < 0 {
+		errs = errorset.Append(errs, fmt.Errorf("auth.jwt_parallelism must not be negative"))
+	}
+	if l := c.Auth.JWTLimits; l.MaxBytes < 0 || l.MaxClaims < 0 || l.MaxDepth < 0 {
+		errs = errorset.Append(errs, fmt.Errorf("auth.jwt_limits must not be negative"))
+	}
+	if c.Auth.VerificationTimeout < 0 {
+		errs = errorset.Append(errs, fmt.Errorf("auth.verification_timeout must not be negative"))
+	}
+	if c.Auth.MaxVerificationTimeout < 0 {
+		errs = errorset.Append(errs, fmt.Errorf("auth.max_verification_timeout must not be negative"))
+	}
+	if c.Auth.MaxVerificationTimeout > 0 && c.Auth.VerificationTimeout > c.Auth.MaxVerificationTimeout {
+		errs = errorset.Append(errs, fmt.Errorf("auth.verification_timeout must not exceed auth.max_verification_timeout"))
+	}
+	switch c.Auth.APIKeyHash {
+	case "", APIKeyHashSHA256:
+	case APIKeyHashHMACSHA256:
+		if c.Auth.APIKeyHashKey == "" {
+			errs = errorset.Append(errs, fmt.Errorf("auth.api_key_hash_key is required for auth.api_key_hash %s", APIKeyHashHMACSHA256))
+		}
+	default:
+		errs = errorset.Append(errs, fmt.Errorf("auth.api_key_hash must be %s or %s", APIKeyHashSHA256, APIKeyHashHMACSHA256))
+	}
+	for _, name := range c.Auth.VerifyAPIKeyHeaders {
+		lower := strings.ToLower(name)
+		switch {
+		case name == "" || strings.HasPrefix(name, ":"):
+			errs = errorset.Append(errs, fmt.Errorf("auth.verify_api_key_headers must be header names, got %q", name))
+		case verifyAPIKeyHeadersDenied[lower] || strings.EqualFold(name, c.Auth.APIKeyHeader):
+			errs = errorset.Append(errs, fmt.Errorf("auth.verify_api_key_headers must not include %q", name))
+		}
+	}
+	for _, scheme := range c.Auth.TokenSchemes {
+		if scheme == "" || strings.ContainsAny(scheme, " \t") {
+			errs = errorset.Append(errs, fmt.Errorf("auth.token_schemes must be non-empty without spaces, got %q", scheme))
+		}
+	}
+	for _, id := range c.Auth.MetricSpecs {
+		if id == "" {
+			errs = errorset.Append(errs, fmt.Errorf("auth.metric_specs must not contain empty IDs"))
+			break
+		}
+	}
+	for _, id := range c.Auth.MetricAPIs {
+		if id == "" {
+			errs = errorset.Append(errs, fmt.Errorf("auth.metric_apis must not contain empty IDs"))
+			break
+		}
+	}
+	consumerFields := make([]string, 0, len(c.Auth.ConsumerFields))
+	for name := range c.Auth.ConsumerFields {
+		consumerFields = append(consumerFields, name)
+	}
+	sort.Strings(consumerFields)
+	for _, name := range consumerFields {
+		field := c.Auth.ConsumerFields[name]
+		switch name {
+		case ConsumerFieldAccessToken, ConsumerFieldAPIProducts, ConsumerFieldApplication,
+			ConsumerFieldClientID, ConsumerFieldDeveloperEmail, ConsumerFieldScope:
+		default:
+			errs = errorset.Append(errs, fmt.Errorf("auth.consumer_fields has unknown field %q", name))
+			continue
+		}
+		if field.HeaderName != "" && field.HeaderName != strings.ToLower(field.HeaderName) {
+			errs = errorset.Append(errs, fmt.Errorf("auth.consumer_fields.%s.header_name must be lower case", name))
+		}
+	}
+	for _, field := range c.Auth.Baggage {
+		switch field {
+		case BaggageFieldAPI, BaggageFieldOperation, ConsumerFieldApplication, ConsumerFieldClientID, ConsumerFieldAPIProducts:
+		default:
+			errs = errorset.Append(errs, fmt.Errorf("auth.baggage has unknown field %q", field))
+		}
+	}
+	if c.Limits.MaxHeaders < 0 {
+		errs = errorset.Append(errs, fmt.Errorf("limits.max_headers must not be negative"))
+	}
+	if c.Limits.MaxHeadersBytes < 0 {
+		errs = errorset.Append(errs, fmt.Errorf("limits.max_headers_bytes must not be negative"))
+	}
+	if c.Limits.MaxConcurrentChecks < 0 {
+		errs = errorset.Append(errs, fmt.Errorf("limits.max_concurrent_checks must not be negative"))
+	}
+	if c.Limits.MaxConcurrentChecks > 0 {
+		if c.Limits.TargetCheckLatency <= 0 {
+			errs = errorset.Append(errs, fmt.Errorf("limits.target_check_latency must be positive"))
+		}
+		if c.Limits.OverloadAction != OverloadActionDeny && c.Limits.OverloadAction != OverloadActionAllow {
+			errs = errorset.Append(errs, fmt.Errorf("limits.overload_action must be %s or %s", OverloadActionDeny, OverloadActionAllow))
+		}
+	}
+	if len(c.KeyValueMaps.Names) > 0 && c.KeyValueMaps.RefreshRate <= 0 {
+		errs = errorset.Append(errs, fmt.Errorf("key_value_maps.refresh_rate must be positive"))
+	}
+	if len(c.KeyValueMaps.Names) > 0 || c.JWTRevocation.KVM != "" {
+		if !c.KeyValueMaps.ProxyAPI {
+			errs = errorset.Append(errs, fmt.Errorf("key value maps require key_value_maps.proxy_api"))
+		}
+		if c.Tenant.IsMultitenant() {
+			errs = errorset.Append(errs, fmt.Errorf("key value maps are unsupported with multitenant configs"))
+		}
+	}
+	kvmNames := make(map[string]bool, len(c.KeyValueMaps.Names))
+	for _, name := range c.KeyValueMaps.Names {
+		if name == "" {
+			errs = errorset.Append(errs, fmt.Errorf("key_value_maps.names must be non-empty"))
+		}
+		kvmNames[name] = true
+	}
+	for _, attr := range c.KeyValueMaps.AnalyticsAttributes {
+		if splits := strings.SplitN(attr, ".", 2); len(splits) < 2 || !kvmNames[splits[0]] {
+			errs = errorset.Append(errs, fmt.Errorf("key_value_maps.analytics_attributes must be map.key of a named map, got %q", attr))
+		}
+	}
+	if c.BotDetection.IPReputationFile != "" && c.BotDetection.IPReputationURL != "" {
+		errs = errorset.Append(errs, fmt.Errorf("bot_detection.ip_reputation_file and bot_detection.ip_reputation_url are mutually exclusive"))
+	}
+	if (c.BotDetection.IPReputationFile != "" || c.BotDetection.IPReputationURL != "") && c.BotDetection.RefreshRate <= 0 {
+		errs = errorset.Append(errs, fmt.Errorf("bot_detection.refresh_rate must be positive"))
+	}
+	sources := 0
+	for _, source := range []string{c.JWTRevocation.File, c.JWTRevocation.URL, c.JWTRevocation.KVM} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		errs = errorset.Append(errs, fmt.Errorf("jwt_revocation.file, jwt_revocation.url, and jwt_revocation.kvm are mutually exclusive"))
+	}
+	if c.JWTRevocation.URL != "" {
+		if u, err := url.Parse(c.JWTRevocation.URL); err != nil || !u.IsAbs() {
+			errs = errorset.Append(errs, fmt.Errorf("jwt_revocation.url must be an absolute URL"))
+		}
+	}
+	if sources > 0 && c.JWTRevocation.RefreshRate <= 0 {
+		errs = errorset.Append(errs, fmt.Errorf("jwt_revocation.refresh_rate must be positive"))
+	}
+	errs = errorset.Append(errs, c.QuotaStore.Redis.validate("quota_store.redis"))
+	switch c.QuotaCounting.Mode {
+	case "", QuotaCountingCheck, QuotaCountingAccessLog:
+	default:
+		errs = errorset.Append(errs, fmt.Errorf("quota_counting.mode must be %s or %s", QuotaCountingCheck, QuotaCountingAccessLog))
+	}
+	errs = errorset.Append(errs, c.VerificationStore.Redis.validate("verification_store.redis"))
+	if len(c.VerificationStore.Redis.Addresses) > 0 && c.VerificationStore.SigningKey == "" {
+		errs = errorset.Append(errs, fmt.Errorf("verification_store.signing_key is required with verification_store.redis"))
+	}
+	errs = errorset.Append(errs, c.ReplayStore.Redis.validate("replay_store.redis"))
+	errs = errorset.Append(errs, c.FeatureFlags.validate())
+	errs = errorset.Append(errs, c.DenialWebhook.validate())
+	switch c.RequestNormalization.Mode {
+	case "", RequestNormalizationNormalize, RequestNormalizationStrict, RequestNormalizationOff:
+	default:
+		errs = errorset.Append(errs, fmt.Errorf("request_normalization.mode must be %s, %s, or %s",
+			RequestNormalizationNormalize, RequestNormalizationStrict, RequestNormalizationOff))
+	}
+	errs = errorset.Append(errs, c.TrustedProxies.validate())
+	errs = errorset.Append(errs, c.EnvoyStats.validate())
+	errs = errorset.Append(errs, validateAnalyticsProxyFields(c.Analytics.ProxyFields))
+	errs = errorset.Append(errs, c.EnvironmentSpecs.Signatures.validate())
+	if c.EnvironmentSpecs.DriftCheckInterval < 0 {
+		errs = errorset.Append(errs, fmt.Errorf("environment_specs.drift_check_interval must not be negative"))
+	}
+	for i := range c.EnvironmentSpecs.Remote {
+		source := &c.EnvironmentSpecs.Remote[i]
+		field := fmt.Sprintf("environment_specs.remote[%d]", i)
+		errs = errorset.Append(errs, source.validate(field))
+		if source.PublicKeyFile == "" && !c.EnvironmentSpecs.Signatures.configured() {
+			errs = errorset.Append(errs, fmt.Errorf("%s.public_key_file is required without environment_specs.signatures keys", field))
+		}
+	}
+	if !c.Auth.ConsumerKeyAPI && usesAppAttributes(c.EnvironmentSpecs.Inline) {
+		errs = errorset.Append(errs, fmt.Errorf("app_attribute lookups require auth.consumer_key_api"))
+	}
 	return errorset.Append(errs, ValidateEnvironmentSpecs(c.EnvironmentSpecs.Inline))
 }
 
+// validate returns the errors of a configured Redis at field
+func (r Redis) validate(field string) error {
+	if len(r.Addresses) == 0 {
+		return nil
+	}
+	var errs error
+	for _, addr := range r.Addresses {
+		if u, err := url.Parse(addr); err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+			errs = errorset.Append(errs, fmt.Errorf("%s.addresses must be redis:// or rediss:// URLs, got %q", field, addr))
+		}
+	}
+	if r.DB < 0 {
+		errs = errorset.Append(errs, fmt.Errorf("%s.db must not be negative", field))
+	}
+	if r.PoolSize <= 0 {
+		errs = errorset.Append(errs, fmt.Errorf("%s.pool_size must be positive", field))
+	}
+	if r.Timeout <= 0 {
+		errs = errorset.Append(errs, fmt.Errorf("%s.timeout must be positive", field))
+	}
+	return errs
+}
+
 // ConfigMapCRD is a CRD for ConfigMap
 type ConfigMapCRD struct {
 	APIVersion string            `yaml:"apiVersion"`
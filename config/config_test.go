@@ -21,6 +21,7 @@ import (
 	"encoding/pem"
 	"os"
 	"path"
+	"strings"
 	"testing"
 	"time"
 
@@ -865,6 +866,556 @@ func TestValidateTLS(t *testing.T) {
 	}
 }
 
+func TestValidateAdminAccess(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		EnvName:          "env",
+		Key:              "key",
+		Secret:           "secret",
+	}
+
+	config.Global.AdminAccess = AdminAccess{
+		BearerToken:       "token",
+		AllowedCIDRs:      []string{"10.0.0.0/8", "fd00::/8"},
+		UnrestrictedPaths: []string{"/healthz"},
+	}
+	if err := config.Validate(true); err != nil {
+		t.Errorf("should not get error: %v", err)
+	}
+
+	config.Global.AdminAccess = AdminAccess{
+		ClientCAFile:      "ca.pem",
+		AllowedCIDRs:      []string{"10.0.0.1"},
+		UnrestrictedPaths: []string{"healthz"},
+	}
+	err := config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten errors")
+	}
+	wantErrs := []string{
+		"global.admin_access.client_ca_file requires global.tls",
+		`global.admin_access.allowed_cidrs must be CIDRs, got "10.0.0.1"`,
+		`global.admin_access.unrestricted_paths must start with /, got "healthz"`,
+	}
+	merr := err.(*errorset.Error)
+	if merr.Len() != len(wantErrs) {
+		t.Fatalf("got %d errors, want: %d, errors: %s", merr.Len(), len(wantErrs), merr)
+	}
+	for i, e := range merr.Errors {
+		equal(t, e.Error(), wantErrs[i])
+	}
+}
+
+func TestValidateSpoolDeny(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		EnvName:          "env",
+		Key:              "key",
+		Secret:           "secret",
+	}
+
+	config.Analytics.SpoolDenyThreshold = 10
+	if err := config.Validate(true); err != nil {
+		t.Errorf("should not get error: %v", err)
+	}
+
+	config.Analytics.SpoolDenyThreshold = config.Analytics.FileLimit
+	config.Analytics.SpoolDenyStatusCode = 500
+	config.Analytics.SpoolCheckInterval = 0
+	err := config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten errors")
+	}
+	wantErrs := []string{
+		"analytics.spool_deny_status_code must be 429 or 503",
+		"analytics.spool_deny_threshold must be less than analytics.file_limit",
+		"analytics.spool_check_interval must be positive",
+	}
+	merr := err.(*errorset.Error)
+	if merr.Len() != len(wantErrs) {
+		t.Fatalf("got %d errors, want: %d, errors: %s", merr.Len(), len(wantErrs), merr)
+	}
+	for i, e := range merr.Errors {
+		equal(t, e.Error(), wantErrs[i])
+	}
+}
+
+func TestValidateLimits(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		EnvName:          "env",
+		Key:              "key",
+		Secret:           "secret",
+	}
+
+	config.Limits.MaxHeaders = 100
+	config.Limits.MaxHeadersBytes = 8192
+	config.Limits.MaxConcurrentChecks = 100
+	if err := config.Validate(true); err != nil {
+		t.Errorf("should not get error: %v", err)
+	}
+
+	config.Analytics.AccessLogWorkers = 4
+	config.Analytics.AccessLogQueueSize = 0
+	config.Analytics.DeduplicationWindow = -time.Second
+	config.Analytics.MaxTimeSkew = -time.Second
+	config.Analytics.UploadTraceEndpoint = "collector:4317"
+	config.Auth.MetadataHeaderMaxBytes = -1
+	config.Auth.JWTParallelism = -1
+	config.Auth.JWTLimits.MaxDepth = -1
+	config.EnvironmentSpecs.DriftCheckInterval = -time.Minute
+	config.Limits = Limits{MaxHeaders: -1, MaxHeadersBytes: -1, MaxConcurrentChecks: 10, OverloadAction: "drop"}
+	err := config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten errors")
+	}
+	wantErrs := []string{
+		"analytics.access_log_queue_size must be positive",
+		"analytics.deduplication_window must not be negative",
+		"analytics.max_time_skew must not be negative",
+		"analytics.upload_trace_endpoint must be an http or https URL",
+		"auth.metadata_header_max_bytes must not be negative",
+		"auth.jwt_parallelism must not be negative",
+		"auth.jwt_limits must not be negative",
+		"limits.max_headers must not be negative",
+		"limits.max_headers_bytes must not be negative",
+		"limits.target_check_latency must be positive",
+		"limits.overload_action must be deny or allow",
+		"environment_specs.drift_check_interval must not be negative",
+	}
+	merr := err.(*errorset.Error)
+	if merr.Len() != len(wantErrs) {
+		t.Fatalf("got %d errors, want: %d, errors: %s", merr.Len(), len(wantErrs), merr)
+	}
+	for i, e := range merr.Errors {
+		equal(t, e.Error(), wantErrs[i])
+	}
+
+	config.Analytics.AccessLogWorkers = -1
+	config.Analytics.DeduplicationWindow = 0
+	config.Analytics.MaxTimeSkew = 0
+	config.Analytics.UploadTraceEndpoint = ""
+	config.Auth.MetadataHeaderMaxBytes = 0
+	config.Auth.JWTParallelism = 0
+	config.Auth.JWTLimits.MaxDepth = 0
+	config.EnvironmentSpecs.DriftCheckInterval = 0
+	config.Limits = Limits{MaxConcurrentChecks: -1}
+	err = config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten error")
+	}
+	merr = err.(*errorset.Error)
+	if merr.Len() != 2 {
+		t.Fatalf("got %d errors, want: 2, errors: %s", merr.Len(), merr)
+	}
+	equal(t, merr.Errors[0].Error(), "analytics.access_log_workers must not be negative")
+	equal(t, merr.Errors[1].Error(), "limits.max_concurrent_checks must not be negative")
+}
+
+func TestValidateVerificationTimeouts(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		EnvName:          "env",
+		Key:              "key",
+		Secret:           "secret",
+	}
+
+	config.Auth.VerificationTimeout = time.Second
+	config.Auth.MaxVerificationTimeout = 5 * time.Second
+	if err := config.Validate(true); err != nil {
+		t.Errorf("should not get error: %v", err)
+	}
+
+	config.Auth.VerificationTimeout = 10 * time.Second
+	err := config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten error")
+	}
+	equal(t, err.(*errorset.Error).Errors[0].Error(), "auth.verification_timeout must not exceed auth.max_verification_timeout")
+
+	config.Auth.VerificationTimeout = -time.Second
+	config.Auth.MaxVerificationTimeout = -time.Second
+	err = config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten errors")
+	}
+	wantErrs := []string{
+		"auth.verification_timeout must not be negative",
+		"auth.max_verification_timeout must not be negative",
+	}
+	merr := err.(*errorset.Error)
+	if merr.Len() != len(wantErrs) {
+		t.Fatalf("got %d errors, want: %d, errors: %s", merr.Len(), len(wantErrs), merr)
+	}
+	for i, e := range merr.Errors {
+		equal(t, e.Error(), wantErrs[i])
+	}
+}
+
+func TestValidateKeyValueMaps(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		EnvName:          "env",
+		Key:              "key",
+		Secret:           "secret",
+	}
+
+	config.KeyValueMaps.ProxyAPI = true
+	config.KeyValueMaps.Names = []string{"settings"}
+	config.KeyValueMaps.AnalyticsAttributes = []string{"settings.region"}
+	if err := config.Validate(true); err != nil {
+		t.Errorf("should not get error: %v", err)
+	}
+
+	config.Tenant.EnvName = "*"
+	config.KeyValueMaps = KeyValueMaps{
+		Names:               []string{""},
+		AnalyticsAttributes: []string{"settings.region", "region"},
+	}
+	err := config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten errors")
+	}
+	wantErrs := []string{
+		"key_value_maps.refresh_rate must be positive",
+		"key value maps require key_value_maps.proxy_api",
+		"key value maps are unsupported with multitenant configs",
+		"key_value_maps.names must be non-empty",
+		`key_value_maps.analytics_attributes must be map.key of a named map, got "settings.region"`,
+		`key_value_maps.analytics_attributes must be map.key of a named map, got "region"`,
+	}
+	merr := err.(*errorset.Error)
+	if merr.Len() != len(wantErrs) {
+		t.Fatalf("got %d errors, want: %d, errors: %s", merr.Len(), len(wantErrs), merr)
+	}
+	for i, e := range merr.Errors {
+		equal(t, e.Error(), wantErrs[i])
+	}
+}
+
+func TestValidateBotDetection(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		EnvName:          "env",
+		Key:              "key",
+		Secret:           "secret",
+	}
+
+	config.BotDetection.IPReputationFile = "/etc/bots.txt"
+	if err := config.Validate(true); err != nil {
+		t.Errorf("should not get error: %v", err)
+	}
+
+	config.BotDetection = BotDetection{
+		IPReputationFile: "/etc/bots.txt",
+		IPReputationURL:  "https://example.com/bots.txt",
+	}
+	err := config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten errors")
+	}
+	wantErrs := []string{
+		"bot_detection.ip_reputation_file and bot_detection.ip_reputation_url are mutually exclusive",
+		"bot_detection.refresh_rate must be positive",
+	}
+	merr := err.(*errorset.Error)
+	if merr.Len() != len(wantErrs) {
+		t.Fatalf("got %d errors, want: %d, errors: %s", merr.Len(), len(wantErrs), merr)
+	}
+	for i, e := range merr.Errors {
+		equal(t, e.Error(), wantErrs[i])
+	}
+}
+
+func TestValidateAPIKeyHash(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		EnvName:          "env",
+		Key:              "key",
+		Secret:           "secret",
+	}
+
+	for _, hash := range []string{"", APIKeyHashSHA256} {
+		config.Auth.APIKeyHash = hash
+		if err := config.Validate(true); err != nil {
+			t.Errorf("%q should not get error: %v", hash, err)
+		}
+	}
+	config.Auth.APIKeyHash = APIKeyHashHMACSHA256
+	config.Auth.APIKeyHashKey = "hash key"
+	if err := config.Validate(true); err != nil {
+		t.Errorf("should not get error: %v", err)
+	}
+
+	tests := []struct {
+		hash string
+		want string
+	}{
+		{APIKeyHashHMACSHA256, "auth.api_key_hash_key is required for auth.api_key_hash hmac-sha256"},
+		{"md5", "auth.api_key_hash must be sha256 or hmac-sha256"},
+	}
+	for _, test := range tests {
+		config.Auth.APIKeyHash = test.hash
+		config.Auth.APIKeyHashKey = ""
+		err := config.Validate(true)
+		if err == nil {
+			t.Fatalf("%q should have gotten error", test.hash)
+		}
+		merr := err.(*errorset.Error)
+		if merr.Len() != 1 {
+			t.Fatalf("got %d errors, want: 1, errors: %s", merr.Len(), merr)
+		}
+		equal(t, merr.Errors[0].Error(), test.want)
+	}
+}
+
+func TestValidateTokenSchemes(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		EnvName:          "env",
+		Key:              "key",
+		Secret:           "secret",
+	}
+
+	config.Auth.TokenSchemes = []string{"Bearer", "Token"}
+	if err := config.Validate(true); err != nil {
+		t.Errorf("should not get error: %v", err)
+	}
+
+	config.Auth.TokenSchemes = []string{"", "Bearer "}
+	err := config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten errors")
+	}
+	wantErrs := []string{
+		`auth.token_schemes must be non-empty without spaces, got ""`,
+		`auth.token_schemes must be non-empty without spaces, got "Bearer "`,
+	}
+	merr := err.(*errorset.Error)
+	if merr.Len() != len(wantErrs) {
+		t.Fatalf("got %d errors, want: %d, errors: %s", merr.Len(), len(wantErrs), merr)
+	}
+	for i, e := range merr.Errors {
+		equal(t, e.Error(), wantErrs[i])
+	}
+}
+
+func TestValidateVerifyAPIKeyHeaders(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		EnvName:          "env",
+		Key:              "key",
+		Secret:           "secret",
+	}
+
+	config.Auth.VerifyAPIKeyHeaders = []string{"X-Forwarded-For", "x-partner-id"}
+	if err := config.Validate(true); err != nil {
+		t.Errorf("should not get error: %v", err)
+	}
+
+	config.Auth.APIKeyHeader = "x-partner-key"
+	config.Auth.VerifyAPIKeyHeaders = []string{"", ":authority", "Authorization", "X-Partner-Key", "content-type"}
+	err := config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten errors")
+	}
+	wantErrs := []string{
+		`auth.verify_api_key_headers must be header names, got ""`,
+		`auth.verify_api_key_headers must be header names, got ":authority"`,
+		`auth.verify_api_key_headers must not include "Authorization"`,
+		`auth.verify_api_key_headers must not include "X-Partner-Key"`,
+		`auth.verify_api_key_headers must not include "content-type"`,
+	}
+	merr := err.(*errorset.Error)
+	if merr.Len() != len(wantErrs) {
+		t.Fatalf("got %d errors, want: %d, errors: %s", merr.Len(), len(wantErrs), merr)
+	}
+	for i, e := range merr.Errors {
+		equal(t, e.Error(), wantErrs[i])
+	}
+}
+
+func TestValidateMetricScopes(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		EnvName:          "env",
+		Key:              "key",
+		Secret:           "secret",
+	}
+
+	config.Auth.MetricSpecs = []string{"*"}
+	config.Auth.MetricAPIs = []string{"foo", "bar"}
+	if err := config.Validate(true); err != nil {
+		t.Errorf("should not get error: %v", err)
+	}
+
+	config.Auth.MetricSpecs = []string{""}
+	config.Auth.MetricAPIs = []string{"foo", ""}
+	err := config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten errors")
+	}
+	wantErrs := []string{
+		"auth.metric_specs must not contain empty IDs",
+		"auth.metric_apis must not contain empty IDs",
+	}
+	merr := err.(*errorset.Error)
+	if merr.Len() != len(wantErrs) {
+		t.Fatalf("got %d errors, want: %d, errors: %s", merr.Len(), len(wantErrs), merr)
+	}
+	for i, e := range merr.Errors {
+		equal(t, e.Error(), wantErrs[i])
+	}
+}
+
+func TestValidateTenantFailovers(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		RemoteServiceAPI:          "http://localhost/remote-service",
+		RemoteServiceAPIFailovers: []string{"http://other/remote-service"},
+		OrgName:                   "org",
+		EnvName:                   "env",
+		Key:                       "key",
+		Secret:                    "secret",
+		Failover:                  Default().Tenant.Failover,
+	}
+	if err := config.Validate(false); err != nil {
+		t.Errorf("should not get error: %v", err)
+	}
+
+	config.Tenant.RemoteServiceAPIFailovers = []string{"other/remote-service"}
+	config.Tenant.InternalAPIFailovers = []string{"http://other/internal"}
+	config.Tenant.Failover = Failover{}
+	err := config.Validate(false)
+	if err == nil {
+		t.Fatal("should have gotten errors")
+	}
+	wantErrs := []string{
+		`tenant.remote_service_api_failovers must be absolute URLs, got "other/remote-service"`,
+		"tenant.internal_api_failovers requires tenant.internal_api",
+		"tenant.failover.health_check_interval must be positive",
+		"tenant.failover.recovery_threshold must be positive",
+	}
+	merr := err.(*errorset.Error)
+	if merr.Len() != len(wantErrs) {
+		t.Fatalf("got %d errors, want: %d, errors: %s", merr.Len(), len(wantErrs), merr)
+	}
+	for i, e := range merr.Errors {
+		equal(t, e.Error(), wantErrs[i])
+	}
+}
+
+func TestLoadTenantEnvironments(t *testing.T) {
+	const config = `
+tenant:
+  internal_api: https://localhost/internal
+  remote_service_api: https://localhost/remote-service
+  org_name: org
+  environments:
+  - name: test
+    hosts:
+    - test.example.com
+  - name: prod
+    environment_spec_ids:
+    - prod-spec`
+	tf, err := os.CreateTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tf.Name())
+	if _, err := tf.WriteString(config); err != nil {
+		t.Fatal(err)
+	}
+	if err := tf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := Default()
+	if err := c.Load(tf.Name(), "", "", false); err != nil {
+		t.Fatal(err)
+	}
+
+	equal(t, c.Tenant.EnvName, "*")
+	want := []TenantEnvironment{
+		{Name: "test", Hosts: []string{"test.example.com"}},
+		{Name: "prod", EnvironmentSpecIDs: []string{"prod-spec"}},
+	}
+	if diff := cmp.Diff(want, c.Tenant.Environments); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestValidateTenantEnvironments(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		Key:              "key",
+		Secret:           "secret",
+		Environments: []TenantEnvironment{
+			{Name: "test", Hosts: []string{"test.example.com"}},
+			{Name: "prod", EnvironmentSpecIDs: []string{"prod-spec"}},
+		},
+	}
+	if err := config.Validate(true); err != nil {
+		t.Errorf("should not get error: %v", err)
+	}
+
+	config.Tenant.EnvName = "env"
+	config.Tenant.Environments = append(config.Tenant.Environments,
+		TenantEnvironment{Name: "prod", EnvironmentSpecIDs: []string{"prod-spec"}},
+		TenantEnvironment{EnvironmentSpecIDs: []string{"prod-spec"}},
+	)
+	err := config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten errors")
+	}
+	wantErrs := []string{
+		`tenant.env_name must be "*" or omitted if tenant.environments is present`,
+		`tenant.environments name "prod" is duplicated`,
+		`tenant.environments[3].name is required`,
+		`environment spec "prod-spec" is assigned to tenant.environments "prod" and ""`,
+	}
+	merr := err.(*errorset.Error)
+	if merr.Len() != len(wantErrs) {
+		t.Fatalf("got %d errors, want: %d, errors: %s", merr.Len(), len(wantErrs), merr)
+	}
+	for i, e := range merr.Errors {
+		equal(t, e.Error(), wantErrs[i])
+	}
+}
+
 func TestMultitenant(t *testing.T) {
 	tests := []struct {
 		desc string
@@ -885,109 +1436,711 @@ func TestMultitenant(t *testing.T) {
 			},
 			want: false,
 		},
+		{
+			desc: "environments",
+			tc: Tenant{
+				Environments: []TenantEnvironment{{Name: "env"}},
+			},
+			want: true,
+		},
+	}
+
+	for _, test := range tests {
+		if got := test.tc.IsMultitenant(); got != test.want {
+			t.Errorf("tc.IsMultitenant() = %v, want = %v", got, test.want)
+		}
+	}
+}
+
+func makeConfigCRD(config string) *ConfigMapCRD {
+	data := map[string]string{configMapConfigKey: config}
+	return &ConfigMapCRD{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Metadata: Metadata{
+			Name:      "apigee-remote-service-envoy",
+			Namespace: "apigee",
+		},
+		Data: data,
+	}
+}
+
+func makePolicySecretCRD() (*SecretCRD, error) {
+	kid := "my kid"
+	privateKey, jwksBuf, err := testutil.GenerateKeyAndJWKs(kid)
+	if err != nil {
+		return nil, err
+	}
+	pkBytes := pem.EncodeToMemory(&pem.Block{Type: util.PEMKeyType, Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+
+	props := map[string]string{SecretPropsKIDKey: kid}
+	propsBuf := new(bytes.Buffer)
+	if err := util.WriteProperties(propsBuf, props); err != nil {
+		return nil, err
+	}
+
+	data := map[string]string{
+		SecretJWKSKey:    base64.StdEncoding.EncodeToString(jwksBuf),
+		SecretPrivateKey: base64.StdEncoding.EncodeToString(pkBytes),
+		SecretPropsKey:   base64.StdEncoding.EncodeToString(propsBuf.Bytes()),
+	}
+
+	return &SecretCRD{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Type:       "Opaque",
+		Metadata: Metadata{
+			Name:      "org-env-policy-secret",
+			Namespace: "apigee",
+		},
+		Data: data,
+	}, nil
+}
+
+func makeAnalyaticsSecretCRD() (*SecretCRD, error) {
+	data := map[string]string{
+		ServiceAccount: base64.StdEncoding.EncodeToString([]byte(`{"type": "service_account"}`)),
+	}
+
+	return &SecretCRD{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Type:       "Opaque",
+		Metadata: Metadata{
+			Name:      "org-env-analytics-secret",
+			Namespace: "apigee",
+		},
+		Data: data,
+	}, nil
+}
+
+func makeCRDs() (configCRD *ConfigMapCRD, policySecretCRD, analyticsSecretCRD *SecretCRD, err error) {
+	const config = `
+tenant:
+  remote_service_api: https://org-test.apigee.net/remote-service
+  org_name: org
+  env_name: env`
+	configCRD = makeConfigCRD(config)
+	policySecretCRD, err = makePolicySecretCRD()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	analyticsSecretCRD, err = makeAnalyaticsSecretCRD()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return configCRD, policySecretCRD, analyticsSecretCRD, nil
+}
+
+func makeYAML(crds ...interface{}) (string, error) {
+	var yamlBuffer bytes.Buffer
+	yamlEncoder := yaml.NewEncoder(&yamlBuffer)
+	yamlEncoder.SetIndent(2)
+	for _, crd := range crds {
+		if err := yamlEncoder.Encode(crd); err != nil {
+			return "", err
+		}
+	}
+	return yamlBuffer.String(), nil
+}
+
+func equal(t *testing.T, got, want string) {
+	if got != want {
+		t.Errorf("got: '%s', want: '%s'", got, want)
+	}
+}
+
+func TestValidateAnomalyDetection(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		EnvName:          "env",
+		Key:              "key",
+		Secret:           "secret",
+	}
+
+	config.Analytics.AnomalyDetection.Enabled = true
+	config.Analytics.AnomalyDetection.Webhook = "https://alerts.example.com/hook"
+	if err := config.Validate(true); err != nil {
+		t.Errorf("should not get error: %v", err)
+	}
+
+	config.Analytics.AnomalyDetection = AnomalyDetection{
+		Enabled:      true,
+		Smoothing:    2,
+		Factor:       1,
+		MinErrorRate: -1,
+		Webhook:      "alerts",
+	}
+	err := config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten errors")
+	}
+	wantErrs := []string{
+		"analytics.anomaly_detection.interval must be positive",
+		"analytics.anomaly_detection.smoothing must be greater than 0 and at most 1",
+		"analytics.anomaly_detection.factor must be greater than 1",
+		"analytics.anomaly_detection.min_error_rate must be between 0 and 1",
+		"analytics.anomaly_detection.min_requests must be positive",
+		"analytics.anomaly_detection.webhook must be an absolute URL",
+	}
+	merr := err.(*errorset.Error)
+	if merr.Len() != len(wantErrs) {
+		t.Fatalf("got %d errors, want: %d, errors: %s", merr.Len(), len(wantErrs), merr)
+	}
+	for i, e := range merr.Errors {
+		equal(t, e.Error(), wantErrs[i])
+	}
+}
+
+func TestValidateConsumerFields(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		EnvName:          "env",
+		Key:              "key",
+		Secret:           "secret",
+	}
+
+	config.Auth.ConsumerFields = map[string]ConsumerField{
+		ConsumerFieldApplication: {Header: true, HeaderName: "x-app"},
+		ConsumerFieldAccessToken: {OmitMetadata: true},
+	}
+	if err := config.Validate(true); err != nil {
+		t.Errorf("should not get error: %v", err)
+	}
+
+	config.Auth.ConsumerFields = map[string]ConsumerField{
+		"password":               {Header: true},
+		ConsumerFieldClientID:    {Header: true, HeaderName: "X-Client"},
+		ConsumerFieldAPIProducts: {Header: true},
+	}
+	err := config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten errors")
+	}
+	wantErrs := []string{
+		"auth.consumer_fields.client_id.header_name must be lower case",
+		`auth.consumer_fields has unknown field "password"`,
+	}
+	merr := err.(*errorset.Error)
+	if merr.Len() != len(wantErrs) {
+		t.Fatalf("got %d errors, want: %d, errors: %s", merr.Len(), len(wantErrs), merr)
+	}
+	for i, e := range merr.Errors {
+		equal(t, e.Error(), wantErrs[i])
+	}
+}
+
+func TestValidateBaggage(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		EnvName:          "env",
+		Key:              "key",
+		Secret:           "secret",
+	}
+
+	config.Auth.Baggage = []string{BaggageFieldAPI, BaggageFieldOperation, ConsumerFieldApplication}
+	if err := config.Validate(true); err != nil {
+		t.Errorf("should not get error: %v", err)
+	}
+
+	config.Auth.Baggage = []string{ConsumerFieldClientID, ConsumerFieldAccessToken}
+	err := config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten errors")
+	}
+	equal(t, err.(*errorset.Error).Errors[0].Error(), `auth.baggage has unknown field "access_token"`)
+}
+
+func TestValidateJWTRevocation(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		EnvName:          "env",
+		Key:              "key",
+		Secret:           "secret",
+	}
+
+	config.KeyValueMaps.ProxyAPI = true
+	config.JWTRevocation.KVM = "revoked-jwts"
+	if err := config.Validate(true); err != nil {
+		t.Errorf("should not get error: %v", err)
+	}
+
+	config.JWTRevocation = JWTRevocation{
+		File: "/etc/revoked.txt",
+		URL:  "revoked.txt",
+	}
+	err := config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten errors")
+	}
+	wantErrs := []string{
+		"jwt_revocation.file, jwt_revocation.url, and jwt_revocation.kvm are mutually exclusive",
+		"jwt_revocation.url must be an absolute URL",
+		"jwt_revocation.refresh_rate must be positive",
+	}
+	merr := err.(*errorset.Error)
+	if merr.Len() != len(wantErrs) {
+		t.Fatalf("got %d errors, want: %d, errors: %s", merr.Len(), len(wantErrs), merr)
+	}
+	for i, e := range merr.Errors {
+		equal(t, e.Error(), wantErrs[i])
+	}
+}
+
+func TestValidateResourceMatching(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		EnvName:          "env",
+		Key:              "key",
+		Secret:           "secret",
+	}
+
+	config.Products.ResourceMatching = ResourceMatchingClassic
+	if err := config.Validate(true); err != nil {
+		t.Errorf("should not get error: %v", err)
+	}
+
+	config.Products.ResourceMatching = "strict"
+	err := config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten errors")
+	}
+	merr := err.(*errorset.Error)
+	if merr.Len() != 1 {
+		t.Fatalf("got %d errors, want: 1, errors: %s", merr.Len(), merr)
+	}
+	equal(t, merr.Errors[0].Error(), "products.resource_matching must be classic or omitted")
+}
+
+func TestValidateDatacaptureNamespaces(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		EnvName:          "env",
+		Key:              "key",
+		Secret:           "secret",
+	}
+
+	config.Analytics.DatacaptureNamespaces = []DatacaptureNamespace{
+		{Namespace: "envoy.filters.http.wasm.waf", Prefix: "waf."},
+		{Namespace: "envoy.filters.http.wasm.geo"},
+	}
+	if err := config.Validate(true); err != nil {
+		t.Errorf("should not get error: %v", err)
+	}
+
+	config.Analytics.DatacaptureNamespaces = []DatacaptureNamespace{
+		{Namespace: "envoy.filters.http.wasm.waf"},
+		{Prefix: "geo."},
+		{Namespace: "envoy.filters.http.wasm.waf", Prefix: "waf."},
+	}
+	err := config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten errors")
+	}
+	wantErrs := []string{
+		"analytics.datacapture_namespaces[1].namespace is required",
+		`analytics.datacapture_namespaces has duplicate namespace "envoy.filters.http.wasm.waf"`,
+	}
+	merr := err.(*errorset.Error)
+	if merr.Len() != len(wantErrs) {
+		t.Fatalf("got %d errors, want: %d, errors: %s", merr.Len(), len(wantErrs), merr)
 	}
+	for i, e := range merr.Errors {
+		equal(t, e.Error(), wantErrs[i])
+	}
+}
 
-	for _, test := range tests {
-		if got := test.tc.IsMultitenant(); got != test.want {
-			t.Errorf("tc.IsMultitenant() = %v, want = %v", got, test.want)
-		}
+func TestValidateQuotaStore(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		EnvName:          "env",
+		Key:              "key",
+		Secret:           "secret",
+	}
+
+	config.QuotaStore.Redis.Addresses = []string{"redis://redis-0:6379", "rediss://redis-1:6380"}
+	if err := config.Validate(true); err != nil {
+		t.Errorf("should not get error: %v", err)
+	}
+
+	config.QuotaStore.Redis = Redis{
+		Addresses: []string{"redis-0:6379", "http://redis-1"},
+		DB:        -1,
+	}
+	err := config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten errors")
+	}
+	wantErrs := []string{
+		`quota_store.redis.addresses must be redis:// or rediss:// URLs, got "redis-0:6379"`,
+		`quota_store.redis.addresses must be redis:// or rediss:// URLs, got "http://redis-1"`,
+		"quota_store.redis.db must not be negative",
+		"quota_store.redis.pool_size must be positive",
+		"quota_store.redis.timeout must be positive",
+	}
+	merr := err.(*errorset.Error)
+	if merr.Len() != len(wantErrs) {
+		t.Fatalf("got %d errors, want: %d, errors: %s", merr.Len(), len(wantErrs), merr)
+	}
+	for i, e := range merr.Errors {
+		equal(t, e.Error(), wantErrs[i])
 	}
 }
 
-func makeConfigCRD(config string) *ConfigMapCRD {
-	data := map[string]string{configMapConfigKey: config}
-	return &ConfigMapCRD{
-		APIVersion: "v1",
-		Kind:       "ConfigMap",
-		Metadata: Metadata{
-			Name:      "apigee-remote-service-envoy",
-			Namespace: "apigee",
-		},
-		Data: data,
+func TestValidateVerificationStore(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		EnvName:          "env",
+		Key:              "key",
+		Secret:           "secret",
+	}
+
+	config.VerificationStore.Redis.Addresses = []string{"rediss://redis-0:6380"}
+	config.VerificationStore.SigningKey = "signing key"
+	if err := config.Validate(true); err != nil {
+		t.Errorf("should not get error: %v", err)
+	}
+
+	config.VerificationStore.Redis.Addresses = []string{"redis-0"}
+	config.VerificationStore.Redis.Timeout = 0
+	config.VerificationStore.SigningKey = ""
+	err := config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten errors")
+	}
+	wantErrs := []string{
+		`verification_store.redis.addresses must be redis:// or rediss:// URLs, got "redis-0"`,
+		"verification_store.redis.timeout must be positive",
+		"verification_store.signing_key is required with verification_store.redis",
+	}
+	merr := err.(*errorset.Error)
+	if merr.Len() != len(wantErrs) {
+		t.Fatalf("got %d errors, want: %d, errors: %s", merr.Len(), len(wantErrs), merr)
+	}
+	for i, e := range merr.Errors {
+		equal(t, e.Error(), wantErrs[i])
 	}
 }
 
-func makePolicySecretCRD() (*SecretCRD, error) {
-	kid := "my kid"
-	privateKey, jwksBuf, err := testutil.GenerateKeyAndJWKs(kid)
-	if err != nil {
-		return nil, err
+func TestValidateReplayStore(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		EnvName:          "env",
+		Key:              "key",
+		Secret:           "secret",
 	}
-	pkBytes := pem.EncodeToMemory(&pem.Block{Type: util.PEMKeyType, Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
 
-	props := map[string]string{SecretPropsKIDKey: kid}
-	propsBuf := new(bytes.Buffer)
-	if err := util.WriteProperties(propsBuf, props); err != nil {
-		return nil, err
+	config.ReplayStore.Redis.Addresses = []string{"rediss://redis-0:6380"}
+	if err := config.Validate(true); err != nil {
+		t.Errorf("should not get error: %v", err)
 	}
 
-	data := map[string]string{
-		SecretJWKSKey:    base64.StdEncoding.EncodeToString(jwksBuf),
-		SecretPrivateKey: base64.StdEncoding.EncodeToString(pkBytes),
-		SecretPropsKey:   base64.StdEncoding.EncodeToString(propsBuf.Bytes()),
+	config.ReplayStore.Redis.Addresses = []string{"redis-0"}
+	config.ReplayStore.Redis.Timeout = 0
+	err := config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten errors")
+	}
+	wantErrs := []string{
+		`replay_store.redis.addresses must be redis:// or rediss:// URLs, got "redis-0"`,
+		"replay_store.redis.timeout must be positive",
+	}
+	merr := err.(*errorset.Error)
+	if merr.Len() != len(wantErrs) {
+		t.Fatalf("got %d errors, want: %d, errors: %s", merr.Len(), len(wantErrs), merr)
+	}
+	for i, e := range merr.Errors {
+		equal(t, e.Error(), wantErrs[i])
 	}
+}
 
-	return &SecretCRD{
-		APIVersion: "v1",
-		Kind:       "Secret",
-		Type:       "Opaque",
-		Metadata: Metadata{
-			Name:      "org-env-policy-secret",
-			Namespace: "apigee",
-		},
-		Data: data,
-	}, nil
+func TestValidateQuotaCounting(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		EnvName:          "env",
+		Key:              "key",
+		Secret:           "secret",
+	}
+	if config.QuotaCounting.Mode != QuotaCountingCheck {
+		t.Errorf("want default mode %s, got %s", QuotaCountingCheck, config.QuotaCounting.Mode)
+	}
+
+	config.QuotaCounting.Mode = QuotaCountingAccessLog
+	if err := config.Validate(true); err != nil {
+		t.Errorf("should not get error: %v", err)
+	}
+
+	config.QuotaCounting.Mode = "response"
+	err := config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten errors")
+	}
+	merr := err.(*errorset.Error)
+	if merr.Len() != 1 {
+		t.Fatalf("got %d errors, want: 1, errors: %s", merr.Len(), merr)
+	}
+	equal(t, merr.Errors[0].Error(), "quota_counting.mode must be check or access_log")
 }
 
-func makeAnalyaticsSecretCRD() (*SecretCRD, error) {
-	data := map[string]string{
-		ServiceAccount: base64.StdEncoding.EncodeToString([]byte(`{"type": "service_account"}`)),
+func TestValidateRequestNormalization(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		EnvName:          "env",
+		Key:              "key",
+		Secret:           "secret",
+	}
+	if config.RequestNormalization.Mode != RequestNormalizationNormalize {
+		t.Errorf("want default mode %s, got %s", RequestNormalizationNormalize, config.RequestNormalization.Mode)
 	}
 
-	return &SecretCRD{
-		APIVersion: "v1",
-		Kind:       "Secret",
-		Type:       "Opaque",
-		Metadata: Metadata{
-			Name:      "org-env-analytics-secret",
-			Namespace: "apigee",
-		},
-		Data: data,
-	}, nil
+	config.RequestNormalization.Mode = RequestNormalizationStrict
+	if err := config.Validate(true); err != nil {
+		t.Errorf("should not get error: %v", err)
+	}
+
+	config.RequestNormalization.Mode = "lenient"
+	err := config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten errors")
+	}
+	merr := err.(*errorset.Error)
+	if merr.Len() != 1 {
+		t.Fatalf("got %d errors, want: 1, errors: %s", merr.Len(), merr)
+	}
+	equal(t, merr.Errors[0].Error(), "request_normalization.mode must be normalize, strict, or off")
 }
 
-func makeCRDs() (configCRD *ConfigMapCRD, policySecretCRD, analyticsSecretCRD *SecretCRD, err error) {
-	const config = `
+func TestValidateFeatureFlags(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		EnvName:          "env",
+		Key:              "key",
+		Secret:           "secret",
+	}
+	config.FeatureFlags = FeatureFlags{
+		FeatureAnalyticsOperation: {Percentage: 10, APIs: map[string]float64{"orders": 100}},
+	}
+	if err := config.Validate(true); err != nil {
+		t.Errorf("should not get error: %v", err)
+	}
+	flag := config.FeatureFlags[FeatureAnalyticsOperation]
+	if flag.PercentageOf("orders") != 100 || flag.PercentageOf("pets") != 10 {
+		t.Errorf("want API percentage 100 and default 10, got %v and %v", flag.PercentageOf("orders"), flag.PercentageOf("pets"))
+	}
+
+	config.FeatureFlags = FeatureFlags{
+		FeatureAnalyticsOperation: {Percentage: 120, APIs: map[string]float64{"orders": -1}},
+		"new_matching":            {Percentage: 50},
+	}
+	err := config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten errors")
+	}
+	wantErrs := []string{
+		"feature_flags.analytics_operation.percentage must be 0 to 100, got 120",
+		"feature_flags.analytics_operation.apis.orders percentage must be 0 to 100, got -1",
+		`feature_flags has unknown flag "new_matching"`,
+	}
+	merr := err.(*errorset.Error)
+	if merr.Len() != len(wantErrs) {
+		t.Fatalf("got %d errors, want: %d, errors: %s", merr.Len(), len(wantErrs), merr)
+	}
+	for i, e := range merr.Errors {
+		equal(t, e.Error(), wantErrs[i])
+	}
+}
+
+func TestLoadEnvironmentSpecDirectory(t *testing.T) {
+	dir := t.TempDir()
+	specDir := path.Join(dir, "specs")
+	if err := os.Mkdir(specDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"team-a.yaml": `
+id: team-a
+apis:
+- id: api-a
+  base_path: /a
+  consumer_authorization: &authz
+    in:
+    - header: x-api-key
+- id: api-b
+  base_path: /b
+  consumer_authorization: *authz
+`,
+		"team-b.yml": `
+id: team-b-1
+apis:
+- id: api-c
+  base_path: /c
+---
+---
+id: team-b-2
+`,
+		"README.md":    "not a spec",
+		".hidden.yaml": "id: [",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(path.Join(specDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	configFile := path.Join(dir, "config.yaml")
+	configYAML := `
 tenant:
   remote_service_api: https://org-test.apigee.net/remote-service
   org_name: org
-  env_name: env`
-	configCRD = makeConfigCRD(config)
-	policySecretCRD, err = makePolicySecretCRD()
-	if err != nil {
-		return nil, nil, nil, err
+  env_name: env
+  key: mykey
+  secret: mysecret
+environment_specs:
+  references:
+  - ` + specDir
+	if err := os.WriteFile(configFile, []byte(configYAML), 0644); err != nil {
+		t.Fatal(err)
 	}
-	analyticsSecretCRD, err = makeAnalyaticsSecretCRD()
-	if err != nil {
-		return nil, nil, nil, err
+
+	c := Default()
+	if err := c.Load(configFile, "", "", false); err != nil {
+		t.Fatalf("c.Load() returns unexpected: %v", err)
+	}
+	var ids []string
+	for _, es := range c.EnvironmentSpecs.Inline {
+		ids = append(ids, es.ID)
+	}
+	if diff := cmp.Diff([]string{"team-a", "team-b-1", "team-b-2"}, ids); diff != "" {
+		t.Errorf("unexpected environment spec IDs diff (-want +got):\n%s", diff)
+	}
+	api := c.EnvironmentSpecs.Inline[0].APIs[1]
+	if diff := cmp.Diff([]APIOperationParameter{{Match: Header("x-api-key")}}, api.ConsumerAuthorization.In); diff != "" {
+		t.Errorf("anchored consumer authorization diff (-want +got):\n%s", diff)
+	}
+
+	// specs from all files are validated together
+	if err := os.WriteFile(path.Join(specDir, "team-c.yaml"), []byte("id: team-a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c = Default()
+	if err := c.Load(configFile, "", "", false); err == nil || !strings.Contains(err.Error(), "multiple team-a") {
+		t.Errorf("want duplicate ID error, got: %v", err)
+	}
+
+	// decode errors name the file
+	badFile := path.Join(specDir, "team-c.yaml")
+	if err := os.WriteFile(badFile, []byte("id: team-c\n---\napis: foo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c = Default()
+	if err := c.Load(configFile, "", "", false); err == nil || !strings.Contains(err.Error(), badFile) {
+		t.Errorf("want error naming %s, got: %v", badFile, err)
 	}
-	return configCRD, policySecretCRD, analyticsSecretCRD, nil
 }
 
-func makeYAML(crds ...interface{}) (string, error) {
-	var yamlBuffer bytes.Buffer
-	yamlEncoder := yaml.NewEncoder(&yamlBuffer)
-	yamlEncoder.SetIndent(2)
-	for _, crd := range crds {
-		if err := yamlEncoder.Encode(crd); err != nil {
-			return "", err
+func TestValidateDenialWebhook(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		EnvName:          "env",
+		Key:              "key",
+		Secret:           "secret",
+	}
+	config.DenialWebhook.URL = "https://siem.example.com/denials"
+	config.DenialWebhook.Classes = []string{DenialInvalidCredential, DenialQuotaExceeded}
+	if err := config.Validate(true); err != nil {
+		t.Errorf("should not get error: %v", err)
+	}
+	if !config.DenialWebhook.Sends(DenialQuotaExceeded) || config.DenialWebhook.Sends(DenialUnauthenticated) {
+		t.Errorf("want only the configured classes sent")
+	}
+
+	config.DenialWebhook.URL = "siem.example.com"
+	config.DenialWebhook.Classes = []string{"forbidden"}
+	config.DenialWebhook.BatchSize = 0
+	err := config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten errors")
+	}
+	wantErrs := []string{
+		"denial_webhook.url must be an http or https URL",
+		`denial_webhook.classes has unknown class "forbidden"`,
+		"denial_webhook.batch_size must be positive",
+	}
+	merr := err.(*errorset.Error)
+	if merr.Len() != len(wantErrs) {
+		t.Fatalf("got %d errors, want: %d, errors: %s", merr.Len(), len(wantErrs), merr)
+	}
+	for i, e := range merr.Errors {
+		equal(t, e.Error(), wantErrs[i])
+	}
+}
+
+func TestAdminAccessEnabled(t *testing.T) {
+	for _, tc := range []struct {
+		access AdminAccess
+		want   bool
+	}{
+		{AdminAccess{}, false},
+		{AdminAccess{UnrestrictedPaths: []string{"/healthz"}}, false},
+		{AdminAccess{BearerToken: "token"}, true},
+		{AdminAccess{ClientCAFile: "ca.pem"}, true},
+		{AdminAccess{AllowedCIDRs: []string{"10.0.0.0/8"}}, true},
+	} {
+		if got := tc.access.Enabled(); got != tc.want {
+			t.Errorf("%+v: want %t, got %t", tc.access, tc.want, got)
 		}
 	}
-	return yamlBuffer.String(), nil
 }
 
-func equal(t *testing.T, got, want string) {
-	if got != want {
-		t.Errorf("got: '%s', want: '%s'", got, want)
+func TestValidateAuthorizationFacade(t *testing.T) {
+	c := Default()
+	c.Tenant.RemoteServiceAPI = "https://runtime/remote-service"
+	c.Tenant.OrgName = "org"
+	c.Tenant.EnvName = "env"
+	c.Global.AuthorizationFacade = true
+	if err := c.Validate(false); err == nil || !strings.Contains(err.Error(), "global.authorization_facade requires global.admin_access") {
+		t.Errorf("want admin access error, got %v", err)
+	}
+	c.Global.AdminAccess.BearerToken = "token"
+	if err := c.Validate(false); err != nil {
+		t.Errorf("want no error, got %v", err)
 	}
 }
@@ -0,0 +1,99 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ConsumerAccess allows or blocks the consumers of an API by the Apigee app
+// and developer verified by consumer authorization, regardless of their API
+// products. A compromised app can be blocked by a spec update without
+// changing its products.
+type ConsumerAccess struct {
+	// Allow, if not empty, restricts the API to the consumers listed.
+	Allow ConsumerList `yaml:"allow,omitempty" mapstructure:"allow,omitempty"`
+
+	// Block denies the consumers listed, even if allowed.
+	Block ConsumerList `yaml:"block,omitempty" mapstructure:"block,omitempty"`
+}
+
+// ConsumerList matches consumers by app name or developer email. Emails are
+// matched case-insensitively.
+type ConsumerList struct {
+	// Apps are Apigee app names.
+	Apps []string `yaml:"apps,omitempty" mapstructure:"apps,omitempty"`
+
+	// DeveloperEmails are emails of Apigee developers.
+	DeveloperEmails []string `yaml:"developer_emails,omitempty" mapstructure:"developer_emails,omitempty"`
+}
+
+func (l ConsumerList) empty() bool {
+	return len(l.Apps) == 0 && len(l.DeveloperEmails) == 0
+}
+
+// matches returns true if the app or developer email is listed
+func (l ConsumerList) matches(app, developerEmail string) bool {
+	if app != "" {
+		for _, a := range l.Apps {
+			if a == app {
+				return true
+			}
+		}
+	}
+	if developerEmail != "" {
+		for _, e := range l.DeveloperEmails {
+			if strings.EqualFold(e, developerEmail) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateConsumerAccess checks the lists have no empty entries
+func validateConsumerAccess(api string, c ConsumerAccess) error {
+	lists := []struct {
+		name string
+		ConsumerList
+	}{{"allow", c.Allow}, {"block", c.Block}}
+	for _, l := range lists {
+		for _, v := range append(append([]string{}, l.Apps...), l.DeveloperEmails...) {
+			if v == "" {
+				return fmt.Errorf("API %q consumer_access %s entries must be non-empty", api, l.name)
+			}
+		}
+	}
+	return nil
+}
+
+// CheckConsumerAccess returns an error if the consumer of the app and
+// developer email is blocked or not allowed by the ConsumerAccess of the API
+// of the request.
+func (e *EnvironmentSpecRequest) CheckConsumerAccess(app, developerEmail string) error {
+	api := e.GetAPISpec()
+	if api == nil {
+		return nil
+	}
+	access := api.ConsumerAccess
+	if access.Block.matches(app, developerEmail) {
+		return fmt.Errorf("app %q of developer %q is blocked", app, developerEmail)
+	}
+	if !access.Allow.empty() && !access.Allow.matches(app, developerEmail) {
+		return fmt.Errorf("app %q of developer %q is not allowed", app, developerEmail)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+)
+
+func TestCheckConsumerAccess(t *testing.T) {
+	envSpec := &EnvironmentSpec{
+		ID: "good-env-config",
+		APIs: []APISpec{
+			{
+				ID:       "blocking",
+				BasePath: "/blocking",
+				ConsumerAccess: ConsumerAccess{
+					Block: ConsumerList{Apps: []string{"compromised"}, DeveloperEmails: []string{"mallory@example.com"}},
+				},
+			},
+			{
+				ID:       "allowing",
+				BasePath: "/allowing",
+				ConsumerAccess: ConsumerAccess{
+					Allow: ConsumerList{Apps: []string{"partner"}, DeveloperEmails: []string{"alice@example.com"}},
+					Block: ConsumerList{Apps: []string{"compromised"}},
+				},
+			},
+			{
+				ID:       "open",
+				BasePath: "/open",
+			},
+		},
+	}
+	if err := ValidateEnvironmentSpecs([]EnvironmentSpec{*envSpec}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	specExt, err := NewEnvironmentSpecExt(envSpec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	tests := []struct {
+		desc    string
+		path    string
+		app     string
+		email   string
+		wantErr string
+	}{
+		{"blocked app", "/blocking", "compromised", "bob@example.com", `app "compromised" of developer "bob@example.com" is blocked`},
+		{"blocked developer", "/blocking", "other", "Mallory@Example.com", `app "other" of developer "Mallory@Example.com" is blocked`},
+		{"not blocked", "/blocking", "other", "bob@example.com", ""},
+		{"allowed app", "/allowing", "partner", "bob@example.com", ""},
+		{"allowed developer", "/allowing", "other", "alice@example.com", ""},
+		{"not allowed", "/allowing", "other", "bob@example.com", `app "other" of developer "bob@example.com" is not allowed`},
+		{"allowed but blocked", "/allowing", "compromised", "alice@example.com", `app "compromised" of developer "alice@example.com" is blocked`},
+		{"no access lists", "/open", "compromised", "mallory@example.com", ""},
+		{"no api", "/unknown", "compromised", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			envoyReq := testutil.NewEnvoyRequest(http.MethodGet, test.path, nil, nil)
+			req := NewEnvironmentSpecRequest(nil, specExt, envoyReq)
+			err := req.CheckConsumerAccess(test.app, test.email)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("want no error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("want error %q, got: %v", test.wantErr, err)
+			}
+		})
+	}
+}
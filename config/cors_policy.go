@@ -0,0 +1,116 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/cors"
+)
+
+// ScopedCorsPolicy is the CORS policy of paths within an API.
+type ScopedCorsPolicy struct {
+	// PathTemplates within the API base path the policy applies to.
+	PathTemplates []string `yaml:"path_templates" mapstructure:"path_templates"`
+
+	// Policy of the paths. A policy allowing no origins disables CORS on them.
+	Policy CorsPolicy `yaml:"policy" mapstructure:"policy"`
+}
+
+// scopedCorsPolicy is a compiled ScopedCorsPolicy, policy is nil if it
+// allows no origins
+type scopedCorsPolicy struct {
+	policy *cors.Policy
+}
+
+// options returns the cors.Options of the policy
+func (c CorsPolicy) options() cors.Options {
+	return cors.Options{
+		AllowOrigins:        c.AllowOrigins,
+		AllowOriginsRegexes: c.AllowOriginsRegexes,
+		AllowHeaders:        c.AllowHeaders,
+		AllowMethods:        c.AllowMethods,
+		ExposeHeaders:       c.ExposeHeaders,
+		MaxAge:              c.MaxAge,
+		AllowCredentials:    c.AllowCredentials,
+		AllowPrivateNetwork: c.AllowPrivateNetwork,
+	}
+}
+
+// Compile returns the compiled policy, nil if it allows no origins.
+func (c CorsPolicy) Compile() (*cors.Policy, error) {
+	return cors.Compile(c.options())
+}
+
+// compileCorsPolicy returns the compiled policy of the API, nil if empty
+func compileCorsPolicy(apiID string, c CorsPolicy) (*cors.Policy, error) {
+	policy, err := c.Compile()
+	if err != nil {
+		return nil, fmt.Errorf("API %q cors %v", apiID, err)
+	}
+	return policy, nil
+}
+
+// validateCorsPolicy checks the policy compiles
+func validateCorsPolicy(apiID string, c CorsPolicy) error {
+	_, err := compileCorsPolicy(apiID, c)
+	return err
+}
+
+// validateCorsScopes checks the scoped policies have path templates and compile
+func validateCorsScopes(apiID string, scopes []ScopedCorsPolicy) error {
+	for _, scope := range scopes {
+		if len(scope.PathTemplates) == 0 {
+			return fmt.Errorf("API %q cors_scopes path_templates must be non-empty", apiID)
+		}
+		for _, t := range scope.PathTemplates {
+			if !strings.HasPrefix(t, "/") {
+				return fmt.Errorf("API %q cors_scopes path_template must begin with /, got %q", apiID, t)
+			}
+		}
+		if _, err := compileCorsPolicy(apiID, scope.Policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addCorsScopes compiles the scoped policies of the API into the CORS path tree
+func (ec *EnvironmentSpecExt) addCorsScopes(api *APISpec) error {
+	for _, scope := range api.CorsScopes {
+		policy, err := compileCorsPolicy(api.ID, scope.Policy)
+		if err != nil {
+			return err
+		}
+		for _, t := range scope.PathTemplates {
+			split := append([]string{api.ID}, strings.Split(t, "/")...)
+			ec.corsPathTree.AddChild(split, 0, &scopedCorsPolicy{policy})
+		}
+	}
+	return nil
+}
+
+// matchCorsPolicy returns the compiled CORS policy of the operation path
+// of the request's API, nil if none
+func (e *EnvironmentSpecRequest) matchCorsPolicy(opPath string) *cors.Policy {
+	if len(e.apiSpec.CorsScopes) > 0 {
+		split := append([]string{e.apiSpec.ID}, strings.Split(opPath, "/")...)
+		if result := e.corsPathTree.Find(split, 0); result != nil {
+			return result.(*scopedCorsPolicy).policy
+		}
+	}
+	return e.corsPolicies[e.apiSpec.ID]
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+)
+
+func corsScopesSpec() EnvironmentSpec {
+	return EnvironmentSpec{
+		ID: "spec",
+		APIs: []APISpec{{
+			ID:       "pets",
+			BasePath: "/v1",
+			Cors:     CorsPolicy{AllowOrigins: []string{"*"}},
+			CorsScopes: []ScopedCorsPolicy{
+				{
+					PathTemplates: []string{"/admin/**"},
+					Policy:        CorsPolicy{AllowOrigins: []string{"https://admin.example.com"}},
+				},
+				{
+					PathTemplates: []string{"/admin/internal", "/pets/{id}/secrets"},
+				},
+			},
+		}},
+	}
+}
+
+func TestCorsScopes(t *testing.T) {
+	spec := corsScopesSpec()
+	if err := ValidateEnvironmentSpecs([]EnvironmentSpec{spec}); err != nil {
+		t.Fatal(err)
+	}
+	specExt, err := NewEnvironmentSpecExt(&spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc       string
+		path       string
+		origin     string
+		wantCors   bool
+		wantOrigin string
+	}{
+		{"api policy", "/v1/pets", "https://any.example.com", true, "*"},
+		{"scoped policy", "/v1/admin/users", "https://admin.example.com", true, "https://admin.example.com"},
+		{"scoped policy disallowed origin", "/v1/admin/users", "https://any.example.com", true, ""},
+		{"more specific scope", "/v1/admin/internal", "https://admin.example.com", false, ""},
+		{"scope with variable", "/v1/pets/1/secrets", "https://any.example.com", false, ""},
+		{"api policy outside scopes", "/v1/pets/1", "https://any.example.com", true, "*"},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			headers := map[string]string{CORSOriginHeader: test.origin}
+			envoyReq := testutil.NewEnvoyRequest(http.MethodOptions, test.path, headers, nil)
+			req := NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
+			if got := req.IsCORSPreflight(); got != test.wantCors {
+				t.Fatalf("want preflight %t, got %t", test.wantCors, got)
+			}
+			if origin, _ := req.AllowedOrigin(); origin != test.wantOrigin {
+				t.Errorf("want origin %q, got %q", test.wantOrigin, origin)
+			}
+		})
+	}
+}
+
+func TestValidateCorsScopes(t *testing.T) {
+	tests := []struct {
+		desc   string
+		modify func(s *ScopedCorsPolicy)
+	}{
+		{"no path templates", func(s *ScopedCorsPolicy) { s.PathTemplates = nil }},
+		{"relative path template", func(s *ScopedCorsPolicy) { s.PathTemplates = []string{"admin"} }},
+		{"bad policy", func(s *ScopedCorsPolicy) { s.Policy.AllowOriginsRegexes = []string{"("} }},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			spec := corsScopesSpec()
+			test.modify(&spec.APIs[0].CorsScopes[0])
+			if err := ValidateEnvironmentSpecs([]EnvironmentSpec{spec}); err == nil {
+				t.Errorf("want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/errorset"
+)
+
+// Classes of the denials sent to the DenialWebhook.
+const (
+	// DenialUnauthenticated is a request without the credentials or JWTs
+	// required.
+	DenialUnauthenticated = "unauthenticated"
+	// DenialInvalidCredential is an API key or access token that is
+	// invalid, expired or revoked.
+	DenialInvalidCredential = "invalid_credential"
+	// DenialUnauthorized is a consumer without an API product authorizing
+	// the operation.
+	DenialUnauthorized = "unauthorized"
+	// DenialAppBinding is a consumer not bound to the operation by
+	// app_bindings.
+	DenialAppBinding = "app_binding"
+	// DenialConsumerBlocked is a consumer blocked or not allowed by the
+	// consumer_access of the spec or the consumer blocks admin API.
+	DenialConsumerBlocked = "consumer_blocked"
+	// DenialQuotaExceeded is a consumer over its quota.
+	DenialQuotaExceeded = "quota_exceeded"
+)
+
+var denialClasses = map[string]bool{
+	DenialUnauthenticated:   true,
+	DenialInvalidCredential: true,
+	DenialUnauthorized:      true,
+	DenialAppBinding:        true,
+	DenialConsumerBlocked:   true,
+	DenialQuotaExceeded:     true,
+}
+
+// DenialWebhook posts batches of structured denial events as JSON to a URL
+// for SIEM and alerting. Each POST is signed with Secret in the
+// X-Apigee-Signature header as "t=<unix time>,sha256=<hex>", the HMAC-SHA256
+// of the unix time, a ".", and the body. Receivers should refuse stale times.
+// Events that don't fit in the queue while the webhook is slow are dropped.
+type DenialWebhook struct {
+	URL string `yaml:"url,omitempty" mapstructure:"url,omitempty"`
+	// Classes of the denials sent, all if empty.
+	Classes []string `yaml:"classes,omitempty" mapstructure:"classes,omitempty"`
+	// Secret signs the POSTs, unsigned if empty.
+	Secret string `yaml:"secret,omitempty" mapstructure:"secret,omitempty" json:"-"`
+	// BatchSize is the maximum number of events per POST.
+	BatchSize int `yaml:"batch_size,omitempty" mapstructure:"batch_size,omitempty"`
+	// FlushInterval is the longest an event waits for a full batch.
+	FlushInterval time.Duration `yaml:"flush_interval,omitempty" mapstructure:"flush_interval,omitempty"`
+	// QueueSize is the number of events waiting to be sent.
+	QueueSize int `yaml:"queue_size,omitempty" mapstructure:"queue_size,omitempty"`
+	// Timeout of each POST.
+	Timeout time.Duration `yaml:"timeout,omitempty" mapstructure:"timeout,omitempty"`
+}
+
+// Sends returns true if denials of class are sent.
+func (w DenialWebhook) Sends(class string) bool {
+	if w.URL == "" {
+		return false
+	}
+	if len(w.Classes) == 0 {
+		return true
+	}
+	for _, c := range w.Classes {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+func (w DenialWebhook) validate() error {
+	if w.URL == "" {
+		return nil
+	}
+	var errs error
+	if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = errorset.Append(errs, fmt.Errorf("denial_webhook.url must be an http or https URL"))
+	}
+	for _, c := range w.Classes {
+		if !denialClasses[c] {
+			errs = errorset.Append(errs, fmt.Errorf("denial_webhook.classes has unknown class %q", c))
+		}
+	}
+	if w.BatchSize <= 0 {
+		errs = errorset.Append(errs, fmt.Errorf("denial_webhook.batch_size must be positive"))
+	}
+	if w.FlushInterval <= 0 {
+		errs = errorset.Append(errs, fmt.Errorf("denial_webhook.flush_interval must be positive"))
+	}
+	if w.QueueSize <= 0 {
+		errs = errorset.Append(errs, fmt.Errorf("denial_webhook.queue_size must be positive"))
+	}
+	if w.Timeout <= 0 {
+		errs = errorset.Append(errs, fmt.Errorf("denial_webhook.timeout must be positive"))
+	}
+	return errs
+}
@@ -0,0 +1,95 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/transform"
+)
+
+// Template variable namespaces of the deployment of the service, resolved
+// when the environment spec is loaded.
+const (
+	EnvNamespace = "env"
+	PodNamespace = "pod"
+)
+
+// podEnvironmentVariables are the environment variables {pod.name} values
+// are read from, as conventionally populated by the Kubernetes downward API:
+//
+//	env:
+//	- name: POD_NAME
+//	  valueFrom:
+//	    fieldRef:
+//	      fieldPath: metadata.name
+var podEnvironmentVariables = map[string]string{
+	"name":            "POD_NAME",
+	"namespace":       "POD_NAMESPACE",
+	"ip":              "POD_IP",
+	"node":            "NODE_NAME",
+	"service_account": "POD_SERVICE_ACCOUNT",
+}
+
+// EnvironmentSpecOption configures the creation of an EnvironmentSpecExt
+type EnvironmentSpecOption func(*EnvironmentSpecExt)
+
+// WithEnvironmentVariables allows {env.VAR} template variables to read the
+// named environment variables, all others are refused.
+func WithEnvironmentVariables(names []string) EnvironmentSpecOption {
+	return func(e *EnvironmentSpecExt) {
+		for _, name := range names {
+			e.environmentVars[name] = true
+		}
+	}
+}
+
+// resolveDeploymentValues records the {env.VAR} and {pod.name} values of the
+// template, returns an error if any is unavailable
+func (e *EnvironmentSpecExt) resolveDeploymentValues(template *transform.Template) error {
+	for _, part := range template.Parts {
+		if part.Variable == nil {
+			continue
+		}
+		name := part.Variable.Name
+		splits := strings.SplitN(name, VariableNamespaceSeparator, 2)
+		if len(splits) < 2 {
+			continue
+		}
+		var envVar string
+		switch splits[0] {
+		case EnvNamespace:
+			envVar = splits[1]
+			if !e.environmentVars[envVar] {
+				return fmt.Errorf("template variable {%s} not allowed, environment variable %s is not in environment_specs.environment_variables", name, envVar)
+			}
+		case PodNamespace:
+			var ok bool
+			if envVar, ok = podEnvironmentVariables[splits[1]]; !ok {
+				return fmt.Errorf("unknown template variable {%s}", name)
+			}
+		default:
+			continue
+		}
+		value, ok := os.LookupEnv(envVar)
+		if !ok {
+			return fmt.Errorf("template variable {%s} unavailable, environment variable %s is not set", name, envVar)
+		}
+		e.deploymentValues[name] = value
+	}
+	return nil
+}
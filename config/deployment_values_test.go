@@ -0,0 +1,76 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+)
+
+func TestDeploymentValues(t *testing.T) {
+	t.Setenv("APIGEE_TEST_REGION", "us-east1")
+	t.Setenv("POD_NAME", "remote-service-abc")
+	t.Setenv("POD_NAMESPACE", "apigee")
+
+	tests := []struct {
+		desc     string
+		template string
+		want     string
+		wantErr  string
+	}{
+		{"env", "{env.APIGEE_TEST_REGION}", "us-east1", ""},
+		{"pod", "{pod.namespace}/{pod.name}", "apigee/remote-service-abc", ""},
+		{"mixed", "{pod.name}:{headers.x-in}", "remote-service-abc:in", ""},
+		{"missing env", "{env.APIGEE_TEST_MISSING}", "", "template variable {env.APIGEE_TEST_MISSING} unavailable, environment variable APIGEE_TEST_MISSING is not set"},
+		{"missing pod", "{pod.ip}", "", "template variable {pod.ip} unavailable, environment variable POD_IP is not set"},
+		{"unknown pod", "{pod.labels}", "", "unknown template variable {pod.labels}"},
+		{"env not allowed", "{env.POD_NAME}", "", "template variable {env.POD_NAME} not allowed, environment variable POD_NAME is not in environment_specs.environment_variables"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			envSpec := &EnvironmentSpec{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID:       "api",
+					BasePath: "/",
+					HTTPRequestTransforms: HTTPRequestTransforms{
+						HeaderTransforms: NameValueTransforms{
+							Add: []AddNameValue{{Name: "x-deployment", Value: test.template}},
+						},
+					},
+				}},
+			}
+			specExt, err := NewEnvironmentSpecExt(envSpec, WithEnvironmentVariables([]string{"APIGEE_TEST_REGION", "APIGEE_TEST_MISSING"}))
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("want error %q, got %v", test.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+
+			envoyReq := testutil.NewEnvoyRequest(http.MethodGet, "/", map[string]string{"x-in": "in"}, nil)
+			req := NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
+			if got := req.Reify(test.template); got != test.want {
+				t.Errorf("want %q, got %q", test.want, got)
+			}
+		})
+	}
+}
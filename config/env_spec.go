@@ -20,6 +20,8 @@ package config
 // especially those that are not commonly used libraries.
 import (
 	"fmt"
+	"net/url"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -31,6 +33,10 @@ const anyMethod = ""
 var allMethods = map[string]interface{}{"GET": nil, "POST": nil, "PUT": nil,
 	"PATCH": nil, "DELETE": nil, "HEAD": nil, "OPTIONS": nil, "CONNECT": nil, "TRACE": nil}
 
+// restrictedMethods are only matched by HTTPMatches naming them or by
+// Operations allowing them
+var restrictedMethods = map[string]bool{"CONNECT": true, "TRACE": true}
+
 // ValidateEnvironmentSpecs checks if there are
 //   * environment configs with the same ID,
 //   * API configs under the same environment config with the same ID,
@@ -48,6 +54,9 @@ func ValidateEnvironmentSpecs(ess []EnvironmentSpec) error {
 			return fmt.Errorf("environment spec IDs must be unique, got multiple %s", es.ID)
 		}
 		configIDSet[es.ID] = true
+		if err := es.GatewayScope.validate(fmt.Sprintf("environment spec %q", es.ID)); err != nil {
+			return err
+		}
 		basePathsSet := make(map[string]bool)
 		for j := range es.APIs {
 			api := &es.APIs[j]
@@ -62,10 +71,47 @@ func ValidateEnvironmentSpecs(ess []EnvironmentSpec) error {
 			if err := validateJWTAuthenticationName(&api.Authentication, api.jwtAuthentications); err != nil {
 				return err
 			}
-			for _, p := range api.ConsumerAuthorization.In {
-				if err := validateAPIOperationParameter(&p, api.jwtAuthentications); err != nil {
-					return err
-				}
+			if err := validateConsumerAuthorization(&api.ConsumerAuthorization, api.jwtAuthentications); err != nil {
+				return err
+			}
+			if err := validateLabels(api.Labels); err != nil {
+				return err
+			}
+			if err := api.GatewayScope.validate(fmt.Sprintf("API %q", api.ID)); err != nil {
+				return err
+			}
+			if api.VerificationTimeouts.APIKey < 0 || api.VerificationTimeouts.JWKS < 0 {
+				return fmt.Errorf("API %q verification timeouts must not be negative", api.ID)
+			}
+			if err := validateCorsPolicy(api.ID, api.Cors); err != nil {
+				return err
+			}
+			if err := validateCorsScopes(api.ID, api.CorsScopes); err != nil {
+				return err
+			}
+			if err := validateBotRules(api.BotRules); err != nil {
+				return err
+			}
+			if err := validateQuotaExemptions(api.QuotaExemptions, api.jwtAuthentications); err != nil {
+				return err
+			}
+			if err := validateDPoP(api.ID, api.DPoP); err != nil {
+				return err
+			}
+			if err := validateConcurrencyLimit(api.ID, api.Concurrency); err != nil {
+				return err
+			}
+			if err := validateConsumerAccess(api.ID, api.ConsumerAccess); err != nil {
+				return err
+			}
+			if err := validateAuthExclusions(api); err != nil {
+				return err
+			}
+			if err := validateQuotaBuckets(fmt.Sprintf("API %q", api.ID), api.QuotaBuckets); err != nil {
+				return err
+			}
+			if err := validateAddActions(fmt.Sprintf("API %q", api.ID), api.HTTPRequestTransforms); err != nil {
+				return err
 			}
 			opNameSet := make(map[string]bool)
 			for k := range api.Operations {
@@ -81,9 +127,39 @@ func ValidateEnvironmentSpecs(ess []EnvironmentSpec) error {
 				if err := validateJWTAuthenticationName(&op.Authentication, op.jwtAuthentications); err != nil {
 					return err
 				}
-				for _, p := range op.ConsumerAuthorization.In {
-					if err := validateAPIOperationParameter(&p, op.jwtAuthentications, api.jwtAuthentications); err != nil {
-						return err
+				if err := validateConsumerAuthorization(&op.ConsumerAuthorization, op.jwtAuthentications, api.jwtAuthentications); err != nil {
+					return err
+				}
+				if err := validateLabels(op.Labels); err != nil {
+					return err
+				}
+				if err := validateBotRules(op.BotRules); err != nil {
+					return err
+				}
+				if err := validateQuotaExemptions(op.QuotaExemptions, op.jwtAuthentications, api.jwtAuthentications); err != nil {
+					return err
+				}
+				if err := validateQuotaBuckets(fmt.Sprintf("operation %q", op.Name), op.QuotaBuckets); err != nil {
+					return err
+				}
+				if err := validateAddActions(fmt.Sprintf("operation %q", op.Name), op.HTTPRequestTransforms); err != nil {
+					return err
+				}
+				if c := op.HeaderCapture; c != nil && (c.SamplePercent <= 0 || c.SamplePercent > 100) {
+					return fmt.Errorf("operation %q header_capture sample_percent must be greater than 0 and up to 100", op.Name)
+				}
+				if err := validateHeaderLimits(op.Name, op.HeaderLimits); err != nil {
+					return err
+				}
+				if err := validateResponseOutcomes(op.Name, op.ResponseOutcomes); err != nil {
+					return err
+				}
+				if r := op.ReplayProtection; r != nil {
+					if r.NonceHeader == "" {
+						return fmt.Errorf("operation %q replay_protection nonce_header must be non-empty", op.Name)
+					}
+					if r.Window < 0 {
+						return fmt.Errorf("operation %q replay_protection window must not be negative", op.Name)
 					}
 				}
 				for _, p := range op.HTTPMatches {
@@ -93,6 +169,14 @@ func ValidateEnvironmentSpecs(ess []EnvironmentSpec) error {
 						}
 					}
 				}
+				for _, m := range op.AllowRestrictedMethods {
+					if !restrictedMethods[m] {
+						return fmt.Errorf("operation %q allow_restricted_methods must be CONNECT or TRACE, got %q", op.Name, m)
+					}
+				}
+			}
+			if err := validateTransformReferences(api); err != nil {
+				return err
 			}
 		}
 	}
@@ -118,6 +202,15 @@ func validateJWTAuthenticationName(a *AuthenticationRequirement, m map[string]*J
 				return err
 			}
 		}
+	case OAuthAuthentication:
+		if len(v.In) == 0 {
+			return fmt.Errorf("OAuth authentication requirement locations must be non-empty")
+		}
+		for _, p := range v.In {
+			if err := validateAPIOperationParameter(&p); err != nil {
+				return err
+			}
+		}
 	case AnyAuthenticationRequirements:
 		for _, val := range []AuthenticationRequirement(v) {
 			err = validateJWTAuthenticationName(&val, m)
@@ -130,8 +223,95 @@ func validateJWTAuthenticationName(a *AuthenticationRequirement, m map[string]*J
 	return err
 }
 
-// validateAPIOperationParameter checks if all headers and queries are non-empty
-// and JWT claims have non-empty names.
+// validateQuotaBuckets checks the quota bucket keying is known
+func validateQuotaBuckets(owner, buckets string) error {
+	switch buckets {
+	case "", QuotaBucketsMethod, QuotaBucketsOperation:
+		return nil
+	}
+	return fmt.Errorf("%s quota_buckets must be one of %s or %s, got %q", owner, QuotaBucketsMethod, QuotaBucketsOperation, buckets)
+}
+
+// validateDPoP checks the mode is known and the max age is not negative
+func validateDPoP(api string, d DPoP) error {
+	switch d.Mode {
+	case "", DPoPModeOptional, DPoPModeRequired:
+	default:
+		return fmt.Errorf("API %q dpop mode must be one of optional or required, got %q", api, d.Mode)
+	}
+	if d.MaxAge < 0 {
+		return fmt.Errorf("API %q dpop max_age must not be negative", api)
+	}
+	return nil
+}
+
+// validateConcurrencyLimit checks the limit and timeout are not negative and
+// the deny status is 429 or 503
+func validateConcurrencyLimit(api string, c ConcurrencyLimit) error {
+	if c.MaxRequests < 0 {
+		return fmt.Errorf("API %q concurrency max_requests must not be negative", api)
+	}
+	switch c.DenyStatus {
+	case 0, 429, 503:
+	default:
+		return fmt.Errorf("API %q concurrency deny_status must be 429 or 503, got %d", api, c.DenyStatus)
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("API %q concurrency timeout must not be negative", api)
+	}
+	return nil
+}
+
+// validateLabels checks label names are non-empty
+func validateLabels(labels map[string]string) error {
+	for k := range labels {
+		if k == "" {
+			return fmt.Errorf("label names must be non-empty")
+		}
+	}
+	return nil
+}
+
+// validateConsumerAuthorization checks the credential locations and that
+// alternatives have unique names and are not combined with In.
+func validateConsumerAuthorization(c *ConsumerAuthorization, maps ...map[string]*JWTAuthentication) error {
+	if len(c.In) > 0 && len(c.Alternatives) > 0 {
+		return fmt.Errorf("consumer authorization in and alternatives must not both be set")
+	}
+	switch c.QueryDuplicates {
+	case "", QueryDuplicatesFirst, QueryDuplicatesLast, QueryDuplicatesReject:
+	default:
+		return fmt.Errorf("consumer authorization query_duplicates must be %s, %s, or %s, got %q",
+			QueryDuplicatesFirst, QueryDuplicatesLast, QueryDuplicatesReject, c.QueryDuplicates)
+	}
+	for _, p := range c.In {
+		if err := validateAPIOperationParameter(&p, maps...); err != nil {
+			return err
+		}
+	}
+	names := make(map[string]bool)
+	for _, alt := range c.Alternatives {
+		if alt.Name == "" {
+			return fmt.Errorf("consumer authorization alternative names must be non-empty")
+		}
+		if names[alt.Name] {
+			return fmt.Errorf("consumer authorization alternative names must be unique, got multiple %s", alt.Name)
+		}
+		names[alt.Name] = true
+		if len(alt.In) == 0 {
+			return fmt.Errorf("consumer authorization alternative %q locations must be non-empty", alt.Name)
+		}
+		for _, p := range alt.In {
+			if err := validateAPIOperationParameter(&p, maps...); err != nil {
+				return err
+			}
+		}
+	}
+	return validateAppBindings(c, maps...)
+}
+
+// validateAPIOperationParameter checks if all headers, queries, and cookies are non-empty,
+// JWT claims have non-empty names, and client certificate fields are known.
 func validateAPIOperationParameter(p *APIOperationParameter, maps ...map[string]*JWTAuthentication) error {
 	switch v := p.Match.(type) {
 	case Header:
@@ -142,6 +322,10 @@ func validateAPIOperationParameter(p *APIOperationParameter, maps ...map[string]
 		if len(string(v)) == 0 {
 			return fmt.Errorf("query in API operation parameter match must be non-empty")
 		}
+	case Cookie:
+		if v.Name == "" {
+			return fmt.Errorf("cookie name in API operation parameter match must be non-empty")
+		}
 	case JWTClaim:
 		if v.Name == "" {
 			return fmt.Errorf("JWT claim name in API operation parameter match must be non-empty")
@@ -156,6 +340,12 @@ func validateAPIOperationParameter(p *APIOperationParameter, maps ...map[string]
 		if fail {
 			return fmt.Errorf("JWT claim requirement %q does not exist", v.Requirement)
 		}
+	case ClientCertificate:
+		switch v.Field {
+		case ClientCertificatePrincipal, ClientCertificateFingerprint, ClientCertificateSAN, ClientCertificateSubject:
+		default:
+			return fmt.Errorf("client certificate field in API operation parameter match must be one of principal, fingerprint, san or subject, got %q", v.Field)
+		}
 	}
 	return nil
 }
@@ -171,6 +361,52 @@ type EnvironmentSpecs struct {
 	// A list of environment configs. Not supported yet for inline loading.
 	// TODO: Support reading this via viper.Unmarshal()
 	Inline []EnvironmentSpec `yaml:"inline,omitempty"`
+
+	// Remote sources polled for environment configs. Their specs are loaded
+	// after those of References and validated together with them.
+	Remote []RemoteSpecSource `yaml:"remote,omitempty" mapstructure:"remote,omitempty"`
+
+	// EnvironmentVariables are the names of the environment variables of the
+	// service that {env.VAR} template variables of the specs may read. Others
+	// are refused so specs can't copy secrets of the deployment into requests.
+	EnvironmentVariables []string `yaml:"environment_variables,omitempty" mapstructure:"environment_variables,omitempty"`
+
+	// Signatures verifies the files of References and the Remote sources.
+	Signatures SpecSignatures `yaml:"signatures,omitempty" mapstructure:"signatures,omitempty"`
+
+	// DriftCheckInterval is how often the operations of the specs are compared
+	// with those of the API products, zero disables the comparison.
+	DriftCheckInterval time.Duration `yaml:"drift_check_interval,omitempty" mapstructure:"drift_check_interval,omitempty"`
+
+	remoteSpecs []RemoteSpecs // loaded from Remote, trailing Inline
+	verifier    *SpecVerifier
+	signatures  []SpecSignature
+}
+
+// RemoteSpecs are the specs loaded from a RemoteSpecSource by its fetcher.
+type RemoteSpecs struct {
+	Fetcher *SpecSourceFetcher
+	Specs   []EnvironmentSpec
+}
+
+// Local returns the specs of Inline not loaded from Remote.
+func (e EnvironmentSpecs) Local() []EnvironmentSpec {
+	n := len(e.Inline)
+	for _, r := range e.remoteSpecs {
+		n -= len(r.Specs)
+	}
+	return e.Inline[:n]
+}
+
+// RemoteSpecs returns the specs loaded from each of Remote.
+func (e EnvironmentSpecs) RemoteSpecs() []RemoteSpecs {
+	return e.remoteSpecs
+}
+
+// SignatureResults returns the signature verifications of the loaded files
+// and Remote sources.
+func (e EnvironmentSpecs) SignatureResults() []SpecSignature {
+	return e.signatures
 }
 
 // EnvironmentSpec contains a snapshot of the set of API configurations associated with an Apigee Environment.
@@ -180,6 +416,9 @@ type EnvironmentSpec struct {
 
 	// A list of API configs.
 	APIs []APISpec `yaml:"apis" mapstructure:"apis"`
+
+	// The Envoy nodes this spec applies to. Optional.
+	GatewayScope GatewayScope `yaml:"gateway_scope,omitempty" mapstructure:"gateway_scope,omitempty"`
 }
 
 // APISpec contains authentication, authorization, and transformation settings for a group of API Operations.
@@ -190,6 +429,9 @@ type APISpec struct {
 	// Base path for this API.
 	BasePath string `yaml:"base_path,omitempty" mapstructure:"base_path,omitempty"`
 
+	// The Envoy nodes this API applies to, within those of the environment spec. Optional.
+	GatewayScope GatewayScope `yaml:"gateway_scope,omitempty" mapstructure:"gateway_scope,omitempty"`
+
 	// The default authentication requirements for this API.
 	Authentication AuthenticationRequirement `yaml:"authentication,omitempty" mapstructure:"authentication,omitempty"`
 
@@ -202,13 +444,153 @@ type APISpec struct {
 	// A list of API Operations, names of which must be unique within the API.
 	Operations []APIOperation `yaml:"operations" mapstructure:"operations"`
 
+	// Requests bypassing authentication and consumer authorization, such as
+	// health checks and metrics. Matching requests have no operation, the
+	// other checks and transforms of the API still apply. May not overlap
+	// the HTTPMatches of operations that authenticate or authorize consumers.
+	AuthExclusions []HTTPMatch `yaml:"auth_exclusions,omitempty" mapstructure:"auth_exclusions,omitempty"`
+
 	// CORS Policy
 	Cors CorsPolicy `yaml:"cors,omitempty" mapstructure:"cors,omitempty"`
 
+	// CORS policies of paths within the API, overriding Cors on the paths
+	// they match, eg. a stricter policy for /admin/**. The most specific
+	// path template matching a request applies, like for operations.
+	CorsScopes []ScopedCorsPolicy `yaml:"cors_scopes,omitempty" mapstructure:"cors_scopes,omitempty"`
+
+	// Free-form labels for business-level grouping (e.g. tier: gold). Labels are
+	// recorded as "label.name" analytics attributes and may be referenced as
+	// {labels.name} in templates, conditions, and quota keys.
+	Labels map[string]string `yaml:"labels,omitempty" mapstructure:"labels,omitempty"`
+
+	// Optional template partitioning the quota of each API Product operation by
+	// its value, for example "{labels.tier}" or "{jwt.name.sub}". Only path,
+	// labels, jwt claims, kvm, api, operation, env, and pod variables are
+	// allowed, request headers and query parameters are chosen by the client.
+	QuotaKey string `yaml:"quota_key,omitempty" mapstructure:"quota_key,omitempty"`
+
+	// Keying of the quota buckets of the API Product operations matching the
+	// requests of this API. By default each product operation config has a
+	// bucket, shared by its methods and resources. "method" splits the buckets
+	// by request method, "operation" merges the operation config buckets of
+	// each product into one per Operation of this API.
+	QuotaBuckets string `yaml:"quota_buckets,omitempty" mapstructure:"quota_buckets,omitempty"`
+
+	// Timeouts of the outbound calls verifying credentials for this API. Zero
+	// values use the auth.verification_timeout default.
+	VerificationTimeouts VerificationTimeouts `yaml:"verification_timeouts,omitempty" mapstructure:"verification_timeouts,omitempty"`
+
+	// The default bot detection rules for this API, first match wins.
+	BotRules []BotRule `yaml:"bot_rules,omitempty" mapstructure:"bot_rules,omitempty"`
+
+	// Consumers exempt from the quotas of this API, first match wins.
+	QuotaExemptions []QuotaExemption `yaml:"quota_exemptions,omitempty" mapstructure:"quota_exemptions,omitempty"`
+
+	// DPoP proof validation of the sender-constrained access tokens of this API.
+	DPoP DPoP `yaml:"dpop,omitempty" mapstructure:"dpop,omitempty"`
+
+	// Limit of the requests of this API in flight to its target.
+	Concurrency ConcurrencyLimit `yaml:"concurrency,omitempty" mapstructure:"concurrency,omitempty"`
+
+	// Consumers allowed or blocked from this API after consumer authorization.
+	ConsumerAccess ConsumerAccess `yaml:"consumer_access,omitempty" mapstructure:"consumer_access,omitempty"`
+
+	// TrustForwardedClientCert reads the client certificate of ClientCertificate
+	// parameters and JWT certificate bindings from the x-forwarded-client-cert
+	// header instead of the ext_authz peer certificate. Only set if Envoy
+	// sanitizes the header sent by clients (see forward_client_cert_details).
+	TrustForwardedClientCert bool `yaml:"trust_forwarded_client_cert,omitempty" mapstructure:"trust_forwarded_client_cert,omitempty"`
+
 	// JWTAuthentication.Name -> *JWTAuthentication
 	jwtAuthentications map[string]*JWTAuthentication `yaml:"-" mapstructure:"-"`
 }
 
+// QuotaBuckets keying of APISpec and APIOperation.
+const (
+	QuotaBucketsMethod    = "method"
+	QuotaBucketsOperation = "operation"
+)
+
+// VerificationTimeouts limit the outbound calls verifying the credentials of an
+// API so a slow issuer doesn't slow other APIs. The calls are also limited by
+// tenant.client_timeout.
+type VerificationTimeouts struct {
+	// APIKey limits API key verification by Apigee.
+	APIKey time.Duration `yaml:"api_key,omitempty" mapstructure:"api_key,omitempty"`
+
+	// JWKS limits JWT verification, including JWKS fetches.
+	JWKS time.Duration `yaml:"jwks,omitempty" mapstructure:"jwks,omitempty"`
+}
+
+// DPoP configures RFC 9449 DPoP proof validation. A proof is a JWT in the DPoP
+// header signed by the client key the access token is bound to, covering the
+// method and URI of the request. Access tokens bound by a "cnf" claim "jkt"
+// thumbprint are rejected without a matching proof.
+type DPoP struct {
+	// Mode "optional" validates proofs that are present, "required" also rejects
+	// requests without a proof. Not validated if empty.
+	Mode string `yaml:"mode,omitempty" mapstructure:"mode,omitempty"`
+
+	// MaxAge of a proof by its "iat" claim, and the time its "jti" is
+	// remembered to detect replays. Defaults to 5 minutes.
+	MaxAge time.Duration `yaml:"max_age,omitempty" mapstructure:"max_age,omitempty"`
+}
+
+// DPoP modes.
+const (
+	DPoPModeOptional = "optional"
+	DPoPModeRequired = "required"
+
+	DefaultDPoPMaxAge = 5 * time.Minute
+)
+
+// GetMaxAge returns the MaxAge or its default.
+func (d DPoP) GetMaxAge() time.Duration {
+	if d.MaxAge > 0 {
+		return d.MaxAge
+	}
+	return DefaultDPoPMaxAge
+}
+
+// ConcurrencyLimit bulkheads the target of an API by denying its requests
+// while the maximum are in flight. A request is in flight from its allowed
+// authorization check until its access log record is received, or the timeout
+// passes if the record never is, so the access log service must be configured.
+type ConcurrencyLimit struct {
+	// MaxRequests in flight. Unlimited if zero.
+	MaxRequests int `yaml:"max_requests,omitempty" mapstructure:"max_requests,omitempty"`
+
+	// DenyStatus is the HTTP status of denied requests, 429 or 503. Defaults
+	// to 503.
+	DenyStatus int `yaml:"deny_status,omitempty" mapstructure:"deny_status,omitempty"`
+
+	// Timeout after which a request without an access log record is no longer
+	// in flight. Defaults to 1 minute.
+	Timeout time.Duration `yaml:"timeout,omitempty" mapstructure:"timeout,omitempty"`
+}
+
+// ConcurrencyLimit defaults.
+const (
+	DefaultConcurrencyDenyStatus = 503
+	DefaultConcurrencyTimeout    = time.Minute
+)
+
+// GetDenyStatus returns the DenyStatus or its default.
+func (c ConcurrencyLimit) GetDenyStatus() int {
+	if c.DenyStatus != 0 {
+		return c.DenyStatus
+	}
+	return DefaultConcurrencyDenyStatus
+}
+
+// GetTimeout returns the Timeout or its default.
+func (c ConcurrencyLimit) GetTimeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return DefaultConcurrencyTimeout
+}
+
 // An APIOperation associates a set of rules with a set of request matching settings.
 type APIOperation struct {
 	// Name of the API Operation. Unique within a API.
@@ -226,10 +608,88 @@ type APIOperation struct {
 	// Transformation rules applied to HTTP requests for this Operation. Overrides the rules set at the API level.
 	HTTPRequestTransforms HTTPRequestTransforms `yaml:"http_request_transforms,omitempty" mapstructure:"http_request_transforms,omitempty"`
 
+	// Labels of this Operation. Merged with the labels of the API, overriding those of the same name.
+	Labels map[string]string `yaml:"labels,omitempty" mapstructure:"labels,omitempty"`
+
+	// Quota key template of this Operation. Overrides the quota key of the API.
+	QuotaKey string `yaml:"quota_key,omitempty" mapstructure:"quota_key,omitempty"`
+
+	// Quota bucket keying of this Operation. Overrides the quota buckets of the API.
+	QuotaBuckets string `yaml:"quota_buckets,omitempty" mapstructure:"quota_buckets,omitempty"`
+
+	// Bot detection rules for this Operation. If specified, these override the rules of the API.
+	BotRules []BotRule `yaml:"bot_rules,omitempty" mapstructure:"bot_rules,omitempty"`
+
+	// Quota exemptions for this Operation. If specified, these override the exemptions of the API.
+	QuotaExemptions []QuotaExemption `yaml:"quota_exemptions,omitempty" mapstructure:"quota_exemptions,omitempty"`
+
+	// Name of the API proxy reported in the analytics records of this Operation.
+	// Operations of the same name are grouped in analytics. Defaults to the API ID.
+	AnalyticsProxy string `yaml:"analytics_proxy,omitempty" mapstructure:"analytics_proxy,omitempty"`
+
+	// Capture of the request and response headers of a sample of this Operation's traffic. Optional.
+	HeaderCapture *HeaderCapture `yaml:"header_capture,omitempty" mapstructure:"header_capture,omitempty"`
+
+	// Replay protection of this Operation's requests. Optional.
+	ReplayProtection *ReplayProtection `yaml:"replay_protection,omitempty" mapstructure:"replay_protection,omitempty"`
+
+	// Classification of this Operation's responses into analytics outcomes,
+	// first match wins. Unmatched responses are classified by status code.
+	ResponseOutcomes []ResponseOutcome `yaml:"response_outcomes,omitempty" mapstructure:"response_outcomes,omitempty"`
+
+	// Limits of this Operation's request headers, protecting its target. Optional.
+	HeaderLimits *HeaderLimits `yaml:"header_limits,omitempty" mapstructure:"header_limits,omitempty"`
+
+	// Restricted methods, CONNECT or TRACE, matched by this Operation's HTTPMatches of any
+	// method, or by this Operation if it has none. Requests of restricted methods are
+	// otherwise only matched by HTTPMatches naming them, and are not found by default.
+	AllowRestrictedMethods []string `yaml:"allow_restricted_methods,omitempty" mapstructure:"allow_restricted_methods,omitempty"`
+
 	// JWTAuthentication.Name -> *JWTAuthentication
 	jwtAuthentications map[string]*JWTAuthentication `yaml:"-" mapstructure:"-"`
 }
 
+// HeaderCapture records the whole request and response header maps of a
+// sample of requests as analytics attributes for debugging integrations.
+// Credential headers, such as authorization, cookies, API keys, DPoP proofs,
+// forwarded client certificates, and the headers the Operation's JWTs and
+// consumer credentials are read from, are always redacted. Envoy only logs the response headers it is configured to.
+type HeaderCapture struct {
+	// SamplePercent of the requests captured, greater than 0 and up to 100.
+	SamplePercent float64 `yaml:"sample_percent" mapstructure:"sample_percent"`
+
+	// Redact lists the names of additional headers whose values are redacted.
+	Redact []string `yaml:"redact,omitempty" mapstructure:"redact,omitempty"`
+}
+
+// ReplayProtection accepts each nonce of a consumer once within the window,
+// denying replayed requests. Nonces are recorded once the request is
+// authorized, scoped to the client ID of the consumer authorization, if any.
+// Nonces are shared by the replicas of the service if a replay_store is
+// configured.
+type ReplayProtection struct {
+	// NonceHeader is the header of the request's unique nonce. Required.
+	NonceHeader string `yaml:"nonce_header" mapstructure:"nonce_header"`
+
+	// TimestampHeader, if set, is the header of the request's Unix time in
+	// seconds, which must be within the window of the current time.
+	TimestampHeader string `yaml:"timestamp_header,omitempty" mapstructure:"timestamp_header,omitempty"`
+
+	// Window a nonce is remembered for. Defaults to 5 minutes.
+	Window time.Duration `yaml:"window,omitempty" mapstructure:"window,omitempty"`
+}
+
+// DefaultReplayWindow is the default ReplayProtection Window.
+const DefaultReplayWindow = 5 * time.Minute
+
+// GetWindow returns the Window or its default.
+func (r ReplayProtection) GetWindow() time.Duration {
+	if r.Window > 0 {
+		return r.Window
+	}
+	return DefaultReplayWindow
+}
+
 // HTTPRequestTransforms are rules for modifying HTTP requests.
 type HTTPRequestTransforms struct {
 	// Header transformations
@@ -245,6 +705,12 @@ type HTTPRequestTransforms struct {
 	// If a query string is included, it will replace any query parameters on the request.
 	// If a query string is not included, the query parameters on the request are retained.
 	PathTransform string `yaml:"path,omitempty" mapstructure:"path,omitempty"`
+
+	// StableHeaders emits the header transforms for upstreams sensitive to
+	// header casing or order: the values of a header are grouped in the order
+	// the header is first added, under the name as first cased, and the
+	// removed headers and query parameters are sorted.
+	StableHeaders bool `yaml:"stable_headers,omitempty" mapstructure:"stable_headers,omitempty"`
 }
 
 type NameValueTransforms struct {
@@ -259,9 +725,17 @@ type AddNameValue struct {
 	Value string
 	// Append is true to append a value to name, false to replace all values at name
 	Append bool
+	// Action, if present, overrides Append: one of append, overwrite,
+	// add_if_absent or overwrite_if_present.
+	Action string
+	// Condition, if present, is an expression that must be true for the value to be added.
+	// It may reference the headers, query, path, and request variables as well as
+	// api.id, operation.name, and jwt.{requirement name}.{claim name}. For example:
+	// condition: 'headers.x-debug == "true" && jwt.foo.sub != ""'
+	Condition string
 }
 
-// AuthenticationRequirement defines the authentication requirement. It can be jwt, any or all.
+// AuthenticationRequirement defines the authentication requirement. It can be jwt, oauth, any or all.
 type AuthenticationRequirement struct {
 	// If Disabled is true, do not process AuthenticationRequirements.
 	Disabled bool `yaml:"disabled,omitempty" mapstructure:"disabled,omitempty"`
@@ -272,6 +746,7 @@ type AuthenticationRequirement struct {
 type authenticationRequirementWrapper struct {
 	Disabled bool                           `yaml:"disabled,omitempty" mapstructure:"disabled,omitempty"`
 	JWT      *JWTAuthentication             `yaml:"jwt,omitempty" mapstructure:"jwt,omitempty"`
+	OAuth    *OAuthAuthentication           `yaml:"oauth,omitempty" mapstructure:"oauth,omitempty"`
 	Any      *AnyAuthenticationRequirements `yaml:"any,omitempty" mapstructure:"any,omitempty"`
 	All      *AllAuthenticationRequirements `yaml:"all,omitempty" mapstructure:"all,omitempty"`
 }
@@ -289,6 +764,10 @@ func (a *AuthenticationRequirement) UnmarshalYAML(node *yaml.Node) error {
 		a.Requirements = *w.JWT
 		ctr++
 	}
+	if w.OAuth != nil {
+		a.Requirements = *w.OAuth
+		ctr++
+	}
 	if w.Any != nil {
 		a.Requirements = *w.Any
 		ctr++
@@ -298,7 +777,7 @@ func (a *AuthenticationRequirement) UnmarshalYAML(node *yaml.Node) error {
 		ctr++
 	}
 	if !w.Disabled && ctr != 1 {
-		return fmt.Errorf("precisely one of jwt, any or all should be set")
+		return fmt.Errorf("precisely one of jwt, oauth, any or all should be set")
 	}
 
 	return nil
@@ -313,6 +792,8 @@ func (a AuthenticationRequirement) MarshalYAML() (interface{}, error) {
 	switch v := a.Requirements.(type) {
 	case JWTAuthentication:
 		w.JWT = &v
+	case OAuthAuthentication:
+		w.OAuth = &v
 	case AnyAuthenticationRequirements:
 		w.Any = &v
 	case AllAuthenticationRequirements:
@@ -359,17 +840,44 @@ type JWTAuthentication struct {
 
 	// Locations where JWT may be found. First match wins.
 	In []APIOperationParameter `yaml:"in" mapstructure:"in"`
+
+	// CertificateBinding enforces RFC 8705 certificate-bound tokens: the
+	// "x5t#S256" member of the "cnf" claim must match the downstream client
+	// certificate so the JWT can't be replayed by other clients. "optional"
+	// checks JWTs with the claim, "required" also rejects JWTs without it.
+	// Not checked if empty.
+	CertificateBinding string `yaml:"certificate_binding,omitempty" mapstructure:"certificate_binding,omitempty"`
 }
 
+// JWTAuthentication certificate bindings.
+const (
+	CertificateBindingOptional = "optional"
+	CertificateBindingRequired = "required"
+)
+
 func (JWTAuthentication) authenticationRequirements() {}
 
+// OAuthAuthentication defines an Apigee OAuth access token authentication requirement.
+// Access tokens are the JWTs issued by the token API of the Apigee remote-service
+// proxy, verified with the keys of its certs API. Opaque tokens aren't supported.
+type OAuthAuthentication struct {
+	// Locations where the access token may be found. First match wins.
+	// For example, a bearer token in the Authorization header:
+	// `{ header: authorization, transformation: { template: "Bearer {token}", substitution: "{token}" } }`
+	In []APIOperationParameter `yaml:"in" mapstructure:"in"`
+}
+
+func (OAuthAuthentication) authenticationRequirements() {}
+
 type jwtAuthenticationWrapper struct {
 	Name                 string                  `yaml:"name" mapstructure:"name"`
 	Issuer               string                  `yaml:"issuer" mapstructure:"issuer"`
 	RemoteJWKS           *RemoteJWKS             `yaml:"remote_jwks,omitempty" mapstructure:"remote_jwks,omitempty"`
+	OIDCDiscovery        *OIDCDiscovery          `yaml:"oidc_discovery,omitempty" mapstructure:"oidc_discovery,omitempty"`
 	Audiences            []string                `yaml:"audiences,omitempty" mapstructure:"audiences,omitempty"`
 	ForwardPayloadHeader string                  `yaml:"forward_payload_header,omitempty" mapstructure:"forward_payload_header,omitempty"`
 	In                   []APIOperationParameter `yaml:"in" mapstructure:"in"`
+	CertificateBinding   string                  `yaml:"certificate_binding,omitempty" mapstructure:"certificate_binding,omitempty"`
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface
@@ -384,10 +892,30 @@ func (j *JWTAuthentication) UnmarshalYAML(node *yaml.Node) error {
 		return err
 	}
 
-	if w.RemoteJWKS == nil {
+	switch {
+	case w.RemoteJWKS != nil && w.OIDCDiscovery != nil:
+		return fmt.Errorf("precisely one of remote_jwks or oidc_discovery should be set")
+	case w.OIDCDiscovery != nil:
+		if u, err := url.Parse(w.OIDCDiscovery.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("oidc_discovery url must be absolute, got %q", w.OIDCDiscovery.URL)
+		}
+		j.JWKSSource = *w.OIDCDiscovery
+	case w.RemoteJWKS != nil:
+		if w.RemoteJWKS.TLS != nil {
+			if err := w.RemoteJWKS.TLS.validate(); err != nil {
+				return err
+			}
+		}
+		j.JWKSSource = *w.RemoteJWKS
+	default:
 		return fmt.Errorf("remote jwks not found")
 	}
-	j.JWKSSource = *w.RemoteJWKS
+
+	switch j.CertificateBinding {
+	case "", CertificateBindingOptional, CertificateBindingRequired:
+	default:
+		return fmt.Errorf("certificate_binding must be one of optional or required, got %q", j.CertificateBinding)
+	}
 
 	return nil
 }
@@ -400,11 +928,14 @@ func (j JWTAuthentication) MarshalYAML() (interface{}, error) {
 		Audiences:            j.Audiences,
 		ForwardPayloadHeader: j.ForwardPayloadHeader,
 		In:                   j.In,
+		CertificateBinding:   j.CertificateBinding,
 	}
 
 	switch v := j.JWKSSource.(type) {
 	case RemoteJWKS:
 		w.RemoteJWKS = &v
+	case OIDCDiscovery:
+		w.OIDCDiscovery = &v
 	default:
 		return nil, fmt.Errorf("unsupported jwks source")
 	}
@@ -424,10 +955,40 @@ type RemoteJWKS struct {
 
 	// CacheDuration of the JWKS.
 	CacheDuration time.Duration `yaml:"cache_duration,omitempty" mapstructure:"cache_duration,omitempty"`
+
+	// TLS settings of fetching the JWKS. Optional.
+	TLS *JWKSTLS `yaml:"tls,omitempty" mapstructure:"tls,omitempty"`
 }
 
 func (RemoteJWKS) jwksSource() {}
 
+// OIDCConfigurationPath is the path of an OpenID Provider's discovery document
+// relative to its issuer.
+const OIDCConfigurationPath = "/.well-known/openid-configuration"
+
+// OIDCDiscovery locates the JWKS by the jwks_uri of an OpenID Provider's
+// discovery document. The issuer of the document must match the URL and the
+// JWTAuthentication issuer, if set.
+type OIDCDiscovery struct {
+	// URL of the issuer or of its discovery document.
+	URL string `yaml:"url" mapstructure:"url"`
+
+	// CacheDuration of the discovery document and JWKS.
+	CacheDuration time.Duration `yaml:"cache_duration,omitempty" mapstructure:"cache_duration,omitempty"`
+}
+
+func (OIDCDiscovery) jwksSource() {}
+
+// ConfigurationURL returns the URL of the discovery document.
+func (o OIDCDiscovery) ConfigurationURL() string {
+	return o.Issuer() + OIDCConfigurationPath
+}
+
+// Issuer returns the issuer identifier the discovery document must declare.
+func (o OIDCDiscovery) Issuer() string {
+	return strings.TrimSuffix(strings.TrimSuffix(o.URL, OIDCConfigurationPath), "/")
+}
+
 // ConsumerAuthorization is the configuration of API consumer authorization.
 type ConsumerAuthorization struct {
 	// If Disabled is true, do not process ConsumerAuthorization requirements.
@@ -439,6 +1000,43 @@ type ConsumerAuthorization struct {
 
 	// Locations of API consumer credential (API Key). First match wins.
 	In []APIOperationParameter `yaml:"in" mapstructure:"in"`
+
+	// Alternatives group the consumer credential locations by kind (e.g. API Key,
+	// JWT client_id, or mTLS). Alternatives are tried in ascending Priority order,
+	// declaration order for equal priorities, and the first match wins.
+	// Alternatives may not be combined with In.
+	Alternatives []ConsumerCredential `yaml:"alternatives,omitempty" mapstructure:"alternatives,omitempty"`
+
+	// AppBindings are checked after the consumer credential is verified, all
+	// must hold for the request to be authorized.
+	AppBindings []AppBinding `yaml:"app_bindings,omitempty" mapstructure:"app_bindings,omitempty"`
+
+	// QueryDuplicates selects the value of a Query location repeated in the request:
+	// first, last, or reject (default), which treats the location as absent. Names and
+	// values are compared percent-decoded, so differently encoded names are the same
+	// parameter. Values with invalid encodings or that aren't UTF-8 are skipped, or
+	// reject the location.
+	QueryDuplicates string `yaml:"query_duplicates,omitempty" mapstructure:"query_duplicates,omitempty"`
+}
+
+// Policies of ConsumerAuthorization QueryDuplicates.
+const (
+	QueryDuplicatesFirst  = "first"
+	QueryDuplicatesLast   = "last"
+	QueryDuplicatesReject = "reject"
+)
+
+// ConsumerCredential is a named alternative location of the API consumer credential.
+type ConsumerCredential struct {
+	// Name of the alternative, recorded as the "consumer.credential" analytics
+	// attribute of requests authorized by it. Must be unique within the alternatives.
+	Name string `yaml:"name" mapstructure:"name"`
+
+	// Priority of the alternative, lower values are tried first.
+	Priority int `yaml:"priority,omitempty" mapstructure:"priority,omitempty"`
+
+	// Locations of API consumer credential (API Key). First match wins.
+	In []APIOperationParameter `yaml:"in" mapstructure:"in"`
 }
 
 // HTTPMatch is an HTTP request matching rule.
@@ -449,18 +1047,20 @@ type HTTPMatch struct {
 	// is declared as either {name} alone or {name=*}, a double named wildcard is declared
 	// as {name=**}. For example:
 	// `path_template: /v1/{single-segment=*}/{multi-segment=**}`
-	// Once defined, these variables may be used to populate transformations.
+	// Once defined, these variables may be used to populate transformations as
+	// {path.name}. Bound values are also forwarded in the ext_authz dynamic metadata
+	// and recorded as "path.name" analytics attributes.
 	PathTemplate string `yaml:"path_template" mapstructure:"path_template"`
 
 	// HTTP method
 	// Discrete values: "GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS", "CONNECT", "TRACE"
-	// "" matches any request method
+	// "" matches any request method but CONNECT and TRACE, see AllowRestrictedMethods
 	Method string `yaml:"method,omitempty" mapstructure:"method,omitempty"`
 }
 
 // APIOperationParameter describes an input value to an API Operation.
 type APIOperationParameter struct {
-	// One of Query, Header, or JWTClaim.
+	// One of Query, Header, Cookie, JWTClaim, or ClientCertificate.
 	Match ParamMatch `yaml:"-"`
 
 	// Optional transformation of the parameter value (e.g. "Bearer " for Authorization tokens).
@@ -468,10 +1068,12 @@ type APIOperationParameter struct {
 }
 
 type apiOperationParameterWrapper struct {
-	Header         *Header              `yaml:"header,omitempty" mapstructure:"header,omitempty"`
-	Query          *Query               `yaml:"query,omitempty" mapstructure:"query,omitempty"`
-	JWTClaim       *JWTClaim            `yaml:"jwt_claim,omitempty" mapstructure:"jwt_claim,omitempty"`
-	Transformation StringTransformation `yaml:"transformation,omitempty" mapstructure:"transformation,omitempty"`
+	Header            *Header              `yaml:"header,omitempty" mapstructure:"header,omitempty"`
+	Query             *Query               `yaml:"query,omitempty" mapstructure:"query,omitempty"`
+	Cookie            *Cookie              `yaml:"cookie,omitempty" mapstructure:"cookie,omitempty"`
+	JWTClaim          *JWTClaim            `yaml:"jwt_claim,omitempty" mapstructure:"jwt_claim,omitempty"`
+	ClientCertificate *ClientCertificate   `yaml:"client_certificate,omitempty" mapstructure:"client_certificate,omitempty"`
+	Transformation    StringTransformation `yaml:"transformation,omitempty" mapstructure:"transformation,omitempty"`
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface
@@ -494,12 +1096,20 @@ func (p *APIOperationParameter) UnmarshalYAML(node *yaml.Node) error {
 		ctr++
 		p.Match = *w.Query
 	}
+	if w.Cookie != nil {
+		ctr++
+		p.Match = *w.Cookie
+	}
 	if w.JWTClaim != nil {
 		ctr++
 		p.Match = *w.JWTClaim
 	}
+	if w.ClientCertificate != nil {
+		ctr++
+		p.Match = *w.ClientCertificate
+	}
 	if ctr != 1 {
-		return fmt.Errorf("precisely one header, query or jwt_claim should be set, got %d", ctr)
+		return fmt.Errorf("precisely one header, query, cookie, jwt_claim or client_certificate should be set, got %d", ctr)
 	}
 
 	return nil
@@ -514,8 +1124,12 @@ func (p APIOperationParameter) MarshalYAML() (interface{}, error) {
 		w.Header = &v
 	case Query:
 		w.Query = &v
+	case Cookie:
+		w.Cookie = &v
 	case JWTClaim:
 		w.JWTClaim = &v
+	case ClientCertificate:
+		w.ClientCertificate = &v
 	default:
 		return nil, fmt.Errorf("unsupported match type")
 	}
@@ -539,6 +1153,17 @@ type Header string
 
 func (Header) paramMatch() {}
 
+// Cookie is an HTTP cookie, such as one delivering the tokens of browser apps.
+type Cookie struct {
+	// Name of the cookie.
+	Name string `yaml:"name" mapstructure:"name"`
+
+	// Prefix stripped from the value, if present.
+	StripPrefix string `yaml:"strip_prefix,omitempty" mapstructure:"strip_prefix,omitempty"`
+}
+
+func (Cookie) paramMatch() {}
+
 // JWTClaim is reference to a JWT claim.
 type JWTClaim struct {
 	// Name of the JWT requirement.
@@ -550,6 +1175,34 @@ type JWTClaim struct {
 
 func (JWTClaim) paramMatch() {}
 
+// ClientCertificate is a field of the downstream mTLS client certificate. Fields
+// are read from the peer certificate if ext_authz includes it, or from the
+// x-forwarded-client-cert header Envoy adds for the nearest client if the API
+// sets TrustForwardedClientCert.
+type ClientCertificate struct {
+	// Field of the certificate: "principal", "fingerprint", "san", or "subject".
+	Field string `yaml:"field" mapstructure:"field"`
+
+	// If AppAttribute is set, the field value is matched against the Apigee app
+	// custom attribute of this name and the consumer key of the matching app is
+	// used as the parameter value. Requires Auth.ConsumerKeyAPI.
+	AppAttribute string `yaml:"app_attribute,omitempty" mapstructure:"app_attribute,omitempty"`
+}
+
+// Client certificate fields.
+const (
+	// peer principal Envoy takes from the URI SAN, DNS SAN or Subject, in that order
+	ClientCertificatePrincipal = "principal"
+	// hex encoded SHA-256 digest of the DER certificate
+	ClientCertificateFingerprint = "fingerprint"
+	// first URI SAN, or DNS SAN if there is no URI SAN
+	ClientCertificateSAN = "san"
+	// RFC 2253 subject
+	ClientCertificateSubject = "subject"
+)
+
+func (ClientCertificate) paramMatch() {}
+
 // StringTransformation uses simple template syntax.
 // e.g. template: "prefix-{foo}-{bar}-suffix"
 //      substitution: "{foo}_{bar}"
@@ -596,6 +1249,12 @@ type CorsPolicy struct {
 	// `Access-Control-Allow-Credentials` header.
 	// If Access-Control-Allow-Origin header is set to "*", this is forced to false.
 	AllowCredentials bool `yaml:"allow_credentials,omitempty" mapstructure:"allow_credentials,omitempty"`
+
+	// In response to a preflight request with the
+	// `Access-Control-Request-Private-Network: true` header, setting this to
+	// true allows public origins to request the API on a private network.
+	// This translates to the `Access-Control-Allow-Private-Network` header.
+	AllowPrivateNetwork bool `yaml:"allow_private_network,omitempty" mapstructure:"allow_private_network,omitempty"`
 }
 
 // IsEmpty returns true if there is no valid CORS policy to apply.
@@ -0,0 +1,239 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ChangeKind categorizes an EnvironmentSpecChange.
+type ChangeKind string
+
+const (
+	APIAdded                          ChangeKind = "api added"
+	APIRemoved                        ChangeKind = "api removed"
+	BasePathChanged                   ChangeKind = "base path changed"
+	CorsChanged                       ChangeKind = "cors changed"
+	AuthExclusionAdded                ChangeKind = "auth exclusion added"
+	AuthExclusionRemoved              ChangeKind = "auth exclusion removed"
+	OperationAdded                    ChangeKind = "operation added"
+	OperationRemoved                  ChangeKind = "operation removed"
+	HTTPMatchChanged                  ChangeKind = "http match changed"
+	AuthenticationWeakened            ChangeKind = "authentication weakened"
+	AuthenticationStrengthened        ChangeKind = "authentication strengthened"
+	AuthenticationChanged             ChangeKind = "authentication changed"
+	ConsumerAuthorizationWeakened     ChangeKind = "consumer authorization weakened"
+	ConsumerAuthorizationStrengthened ChangeKind = "consumer authorization strengthened"
+	ConsumerAuthorizationChanged      ChangeKind = "consumer authorization changed"
+	TransformsChanged                 ChangeKind = "transforms changed"
+)
+
+// EnvironmentSpecChange is a policy-affecting difference between two EnvironmentSpecs.
+type EnvironmentSpecChange struct {
+	Kind      ChangeKind
+	APIID     string
+	Operation string // empty for API-level changes
+}
+
+// Weakens returns true if the change reduces the protection of an operation.
+func (c EnvironmentSpecChange) Weakens() bool {
+	return c.Kind == AuthenticationWeakened || c.Kind == ConsumerAuthorizationWeakened ||
+		c.Kind == AuthExclusionAdded
+}
+
+func (c EnvironmentSpecChange) String() string {
+	if c.Operation == "" {
+		return fmt.Sprintf("api %q: %s", c.APIID, c.Kind)
+	}
+	return fmt.Sprintf("api %q operation %q: %s", c.APIID, c.Operation, c.Kind)
+}
+
+// ReadEnvironmentSpec reads an EnvironmentSpec from a YAML file.
+func ReadEnvironmentSpec(f string) (EnvironmentSpec, error) {
+	spec := EnvironmentSpec{}
+	data, err := os.ReadFile(f)
+	if err != nil {
+		return spec, err
+	}
+	err = yaml.Unmarshal(data, &spec)
+	return spec, err
+}
+
+// DiffEnvironmentSpecs reports the policy-affecting changes from oldSpec to newSpec.
+// Operations are compared using the effective (operation or inherited API)
+// authentication, consumer authorization, and transforms. Changes are ordered
+// as the APIs and Operations appear in the specs, removals first.
+func DiffEnvironmentSpecs(oldSpec, newSpec EnvironmentSpec) []EnvironmentSpecChange {
+	var changes []EnvironmentSpecChange
+
+	newAPIs := make(map[string]*APISpec, len(newSpec.APIs))
+	for i := range newSpec.APIs {
+		newAPIs[newSpec.APIs[i].ID] = &newSpec.APIs[i]
+	}
+	oldAPIs := make(map[string]*APISpec, len(oldSpec.APIs))
+	for i := range oldSpec.APIs {
+		oldAPI := &oldSpec.APIs[i]
+		oldAPIs[oldAPI.ID] = oldAPI
+		if newAPIs[oldAPI.ID] == nil {
+			changes = append(changes, EnvironmentSpecChange{Kind: APIRemoved, APIID: oldAPI.ID})
+		}
+	}
+
+	for i := range newSpec.APIs {
+		newAPI := &newSpec.APIs[i]
+		oldAPI := oldAPIs[newAPI.ID]
+		if oldAPI == nil {
+			changes = append(changes, EnvironmentSpecChange{Kind: APIAdded, APIID: newAPI.ID})
+			continue
+		}
+		changes = append(changes, diffAPIs(oldAPI, newAPI)...)
+	}
+
+	return changes
+}
+
+func diffAPIs(oldAPI, newAPI *APISpec) []EnvironmentSpecChange {
+	var changes []EnvironmentSpecChange
+	add := func(kind ChangeKind, op string) {
+		changes = append(changes, EnvironmentSpecChange{Kind: kind, APIID: newAPI.ID, Operation: op})
+	}
+
+	if oldAPI.BasePath != newAPI.BasePath {
+		add(BasePathChanged, "")
+	}
+	if !reflect.DeepEqual(oldAPI.Cors, newAPI.Cors) || !reflect.DeepEqual(oldAPI.CorsScopes, newAPI.CorsScopes) {
+		add(CorsChanged, "")
+	}
+	if !reflect.DeepEqual(oldAPI.AuthExclusions, newAPI.AuthExclusions) {
+		oldExclusions := make(map[HTTPMatch]bool, len(oldAPI.AuthExclusions))
+		for _, x := range oldAPI.AuthExclusions {
+			oldExclusions[x] = true
+		}
+		newExclusions := make(map[HTTPMatch]bool, len(newAPI.AuthExclusions))
+		for _, x := range newAPI.AuthExclusions {
+			newExclusions[x] = true
+			if !oldExclusions[x] {
+				add(AuthExclusionAdded, "")
+			}
+		}
+		for _, x := range oldAPI.AuthExclusions {
+			if !newExclusions[x] {
+				add(AuthExclusionRemoved, "")
+			}
+		}
+	}
+
+	newOps := make(map[string]*APIOperation)
+	for _, op := range effectiveOperations(newAPI) {
+		newOps[op.Name] = op
+	}
+	oldOps := make(map[string]*APIOperation)
+	for _, op := range effectiveOperations(oldAPI) {
+		oldOps[op.Name] = op
+		if newOps[op.Name] == nil {
+			add(OperationRemoved, op.Name)
+		}
+	}
+
+	for _, newOp := range effectiveOperations(newAPI) {
+		oldOp := oldOps[newOp.Name]
+		if oldOp == nil {
+			add(OperationAdded, newOp.Name)
+			continue
+		}
+
+		if !reflect.DeepEqual(oldOp.HTTPMatches, newOp.HTTPMatches) {
+			add(HTTPMatchChanged, newOp.Name)
+		}
+
+		oldAuth := effectiveAuthentication(oldAPI, oldOp)
+		newAuth := effectiveAuthentication(newAPI, newOp)
+		switch {
+		case isAuthenticating(oldAuth) && !isAuthenticating(newAuth):
+			add(AuthenticationWeakened, newOp.Name)
+		case !isAuthenticating(oldAuth) && isAuthenticating(newAuth):
+			add(AuthenticationStrengthened, newOp.Name)
+		case !reflect.DeepEqual(oldAuth, newAuth):
+			add(AuthenticationChanged, newOp.Name)
+		}
+
+		oldAuthz := effectiveConsumerAuthorization(oldAPI, oldOp)
+		newAuthz := effectiveConsumerAuthorization(newAPI, newOp)
+		switch {
+		case isAuthorizing(oldAuthz) && !isAuthorizing(newAuthz),
+			isAuthorizing(newAuthz) && !oldAuthz.FailOpen && newAuthz.FailOpen:
+			add(ConsumerAuthorizationWeakened, newOp.Name)
+		case !isAuthorizing(oldAuthz) && isAuthorizing(newAuthz),
+			isAuthorizing(oldAuthz) && oldAuthz.FailOpen && !newAuthz.FailOpen:
+			add(ConsumerAuthorizationStrengthened, newOp.Name)
+		case !reflect.DeepEqual(oldAuthz, newAuthz):
+			add(ConsumerAuthorizationChanged, newOp.Name)
+		}
+
+		if !reflect.DeepEqual(effectiveTransforms(oldAPI, oldOp), effectiveTransforms(newAPI, newOp)) {
+			add(TransformsChanged, newOp.Name)
+		}
+	}
+
+	return changes
+}
+
+// an API without operations behaves as having a single default operation
+func effectiveOperations(api *APISpec) []*APIOperation {
+	if len(api.Operations) == 0 {
+		return []*APIOperation{defaultOperation}
+	}
+	ops := make([]*APIOperation, len(api.Operations))
+	for i := range api.Operations {
+		ops[i] = &api.Operations[i]
+	}
+	return ops
+}
+
+func effectiveAuthentication(api *APISpec, op *APIOperation) AuthenticationRequirement {
+	if !op.Authentication.IsEmpty() {
+		return op.Authentication
+	}
+	return api.Authentication
+}
+
+func effectiveConsumerAuthorization(api *APISpec, op *APIOperation) ConsumerAuthorization {
+	if !op.ConsumerAuthorization.isEmpty() {
+		return op.ConsumerAuthorization
+	}
+	if api.ConsumerAuthorization.Disabled {
+		return ConsumerAuthorization{Disabled: true}
+	}
+	return api.ConsumerAuthorization
+}
+
+func effectiveTransforms(api *APISpec, op *APIOperation) HTTPRequestTransforms {
+	if !op.HTTPRequestTransforms.isEmpty() {
+		return op.HTTPRequestTransforms
+	}
+	return api.HTTPRequestTransforms
+}
+
+func isAuthenticating(auth AuthenticationRequirement) bool {
+	return !auth.Disabled && !isEmpty(auth)
+}
+
+func isAuthorizing(auth ConsumerAuthorization) bool {
+	return !auth.Disabled && !auth.isEmpty()
+}
@@ -0,0 +1,189 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiffEnvironmentSpecs(t *testing.T) {
+	tests := []struct {
+		desc   string
+		modify func(*EnvironmentSpec)
+		want   []EnvironmentSpecChange
+	}{
+		{
+			desc:   "no changes",
+			modify: func(s *EnvironmentSpec) {},
+		},
+		{
+			desc: "api added and removed",
+			modify: func(s *EnvironmentSpec) {
+				s.APIs[1] = APISpec{ID: "new-api"}
+			},
+			want: []EnvironmentSpecChange{
+				{Kind: APIRemoved, APIID: "apispec2"},
+				{Kind: APIAdded, APIID: "new-api"},
+			},
+		},
+		{
+			desc: "base path and cors",
+			modify: func(s *EnvironmentSpec) {
+				s.APIs[0].BasePath = "/v2"
+				s.APIs[0].Cors.AllowOrigins = []string{"https://example.com"}
+			},
+			want: []EnvironmentSpecChange{
+				{Kind: BasePathChanged, APIID: "apispec1"},
+				{Kind: CorsChanged, APIID: "apispec1"},
+			},
+		},
+		{
+			desc: "auth exclusions",
+			modify: func(s *EnvironmentSpec) {
+				s.APIs[0].AuthExclusions = []HTTPMatch{{PathTemplate: "/healthz"}}
+			},
+			want: []EnvironmentSpecChange{
+				{Kind: AuthExclusionAdded, APIID: "apispec1"},
+			},
+		},
+		{
+			desc: "operation added and removed",
+			modify: func(s *EnvironmentSpec) {
+				s.APIs[0].Operations[0].Name = "op-new"
+			},
+			want: []EnvironmentSpecChange{
+				{Kind: OperationRemoved, APIID: "apispec1", Operation: "op-1"},
+				{Kind: OperationAdded, APIID: "apispec1", Operation: "op-new"},
+			},
+		},
+		{
+			desc: "http match",
+			modify: func(s *EnvironmentSpec) {
+				s.APIs[0].Operations[0].HTTPMatches[0].Method = "PUT"
+			},
+			want: []EnvironmentSpecChange{
+				{Kind: HTTPMatchChanged, APIID: "apispec1", Operation: "op-1"},
+			},
+		},
+		{
+			desc: "api authentication disabled",
+			modify: func(s *EnvironmentSpec) {
+				s.APIs[0].Authentication.Disabled = true
+			},
+			want: []EnvironmentSpecChange{
+				{Kind: AuthenticationWeakened, APIID: "apispec1", Operation: "op-1"},
+				{Kind: AuthenticationWeakened, APIID: "apispec1", Operation: "op-2"},
+				{Kind: AuthenticationWeakened, APIID: "apispec1", Operation: "op-4"},
+			},
+		},
+		{
+			desc: "operation authentication changed",
+			modify: func(s *EnvironmentSpec) {
+				auth := s.APIs[0].Authentication
+				any := auth.Requirements.(AnyAuthenticationRequirements)
+				all := any[0].Requirements.(AllAuthenticationRequirements)
+				jwt := all[0].Requirements.(JWTAuthentication)
+				jwt.Issuer = "other"
+				s.APIs[0].Operations[1].Authentication = AuthenticationRequirement{Requirements: jwt}
+			},
+			want: []EnvironmentSpecChange{
+				{Kind: AuthenticationChanged, APIID: "apispec1", Operation: "op-2"},
+			},
+		},
+		{
+			desc: "consumer authorization",
+			modify: func(s *EnvironmentSpec) {
+				s.APIs[0].Operations[0].ConsumerAuthorization.Disabled = true
+				s.APIs[0].Operations[1].ConsumerAuthorization = ConsumerAuthorization{
+					FailOpen: true,
+					In:       s.APIs[0].ConsumerAuthorization.In,
+				}
+				s.APIs[0].Operations[2].ConsumerAuthorization = ConsumerAuthorization{
+					In: []APIOperationParameter{{Match: Header("other")}},
+				}
+			},
+			want: []EnvironmentSpecChange{
+				{Kind: ConsumerAuthorizationWeakened, APIID: "apispec1", Operation: "op-1"},
+				{Kind: ConsumerAuthorizationWeakened, APIID: "apispec1", Operation: "op-2"},
+				{Kind: ConsumerAuthorizationChanged, APIID: "apispec1", Operation: "op-3"},
+			},
+		},
+		{
+			desc: "transforms",
+			modify: func(s *EnvironmentSpec) {
+				s.APIs[0].Operations[0].HTTPRequestTransforms.PathTransform = "/new"
+			},
+			want: []EnvironmentSpecChange{
+				{Kind: TransformsChanged, APIID: "apispec1", Operation: "op-1"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			oldSpec := createGoodEnvSpec()
+			newSpec := createGoodEnvSpec()
+			test.modify(&newSpec)
+
+			got := DiffEnvironmentSpecs(oldSpec, newSpec)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("diff (-want +got):\n%s", diff)
+			}
+
+			// reversing the specs turns each weakening into a strengthening
+			var weakened, strengthened int
+			for _, c := range got {
+				if c.Weakens() {
+					weakened++
+				}
+			}
+			for _, c := range DiffEnvironmentSpecs(newSpec, oldSpec) {
+				if c.Kind == AuthenticationStrengthened || c.Kind == ConsumerAuthorizationStrengthened ||
+					c.Kind == AuthExclusionRemoved {
+					strengthened++
+				}
+			}
+			if weakened != strengthened {
+				t.Errorf("want: %d strengthened, got: %d", weakened, strengthened)
+			}
+		})
+	}
+}
+
+func TestDiffEnvironmentSpecsDefaultOperation(t *testing.T) {
+	oldSpec := EnvironmentSpec{APIs: []APISpec{{ID: "api"}}}
+	newSpec := EnvironmentSpec{APIs: []APISpec{{
+		ID: "api",
+		ConsumerAuthorization: ConsumerAuthorization{
+			In: []APIOperationParameter{{Match: Header("x-api-key")}},
+		},
+	}}}
+
+	want := []EnvironmentSpecChange{
+		{Kind: ConsumerAuthorizationStrengthened, APIID: "api", Operation: "default"},
+	}
+	if diff := cmp.Diff(want, DiffEnvironmentSpecs(oldSpec, newSpec)); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+
+	want = []EnvironmentSpecChange{
+		{Kind: ConsumerAuthorizationWeakened, APIID: "api", Operation: "default"},
+	}
+	if diff := cmp.Diff(want, DiffEnvironmentSpecs(newSpec, oldSpec)); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+}
@@ -17,25 +17,40 @@
 package config
 
 import (
+	"fmt"
+	"net"
 	"regexp"
 	"strings"
+	"time"
 
+	"github.com/apigee/apigee-remote-service-envoy/v2/cors"
 	"github.com/apigee/apigee-remote-service-envoy/v2/transform"
 	"github.com/apigee/apigee-remote-service-golib/v2/path"
 )
 
-const wildcard = "*"
+const (
+	wildcard       = "*"
+	doubleWildcard = "**"
+)
 
 // NewEnvironmentSpecExt creates an EnvironmentSpecExt
-func NewEnvironmentSpecExt(spec *EnvironmentSpec) (*EnvironmentSpecExt, error) {
+func NewEnvironmentSpecExt(spec *EnvironmentSpec, opts ...EnvironmentSpecOption) (*EnvironmentSpecExt, error) {
 	ec := &EnvironmentSpecExt{
 		EnvironmentSpec:    spec,
 		apiPathTree:        path.NewTree(),
 		opPathTree:         path.NewTree(),
+		exclusionPathTree:  path.NewTree(),
+		corsPathTree:       path.NewTree(),
 		compiledTemplates:  make(map[string]*transform.Template),
-		corsVary:           make(map[string]bool, len(spec.APIs)),
-		corsAllowedOrigins: make(map[string]map[string]bool, len(spec.APIs)),
+		corsPolicies:       make(map[string]*cors.Policy, len(spec.APIs)),
 		compiledRegExps:    make(map[string]*regexp.Regexp),
+		compiledIPRanges:   make(map[string]*net.IPNet),
+		compiledConditions: make(map[string]*transform.Condition),
+		deploymentValues:   make(map[string]string),
+		environmentVars:    make(map[string]bool),
+	}
+	for _, opt := range opts {
+		opt(ec)
 	}
 
 	for i := range spec.APIs {
@@ -45,22 +60,15 @@ func NewEnvironmentSpecExt(spec *EnvironmentSpec) (*EnvironmentSpecExt, error) {
 		split = append([]string{"/"}, split...)
 		ec.apiPathTree.AddChild(split, 0, &api)
 
-		var mustVary = false
-		allowedOrigins := make(map[string]bool, len(api.Cors.AllowOrigins))
-		for _, o := range api.Cors.AllowOrigins {
-			allowedOrigins[o] = true
-			if o == wildcard {
-				mustVary = true
-			}
+		policy, err := compileCorsPolicy(api.ID, api.Cors)
+		if err != nil {
+			return nil, err
 		}
-		ec.corsAllowedOrigins[api.ID] = allowedOrigins
-
-		for _, r := range api.Cors.AllowOriginsRegexes {
-			ec.compiledRegExps[r] = regexp.MustCompile(r)
+		ec.corsPolicies[api.ID] = policy
+		if err := ec.addCorsScopes(&api); err != nil {
+			return nil, err
 		}
 
-		ec.corsVary[api.ID] = mustVary || len(api.Cors.AllowOriginsRegexes) > 0 || len(api.Cors.AllowOrigins) > 1
-
 		parseHTTPRequestTransforms := func(t HTTPRequestTransforms) error {
 			_, err := ec.parseTemplate(t.PathTransform)
 			if err != nil {
@@ -72,6 +80,9 @@ func NewEnvironmentSpecExt(spec *EnvironmentSpec) (*EnvironmentSpecExt, error) {
 				if err != nil {
 					return err
 				}
+				if err := ec.parseCondition(a.Condition); err != nil {
+					return err
+				}
 			}
 
 			for _, a := range t.QueryTransforms.Add {
@@ -79,28 +90,57 @@ func NewEnvironmentSpecExt(spec *EnvironmentSpec) (*EnvironmentSpecExt, error) {
 				if err != nil {
 					return err
 				}
+				if err := ec.parseCondition(a.Condition); err != nil {
+					return err
+				}
 			}
 			return nil
 		}
 
-		for _, in := range api.ConsumerAuthorization.In {
-			err := ec.parseAPIOperationParameter(in.Transformation)
-			if err != nil {
-				return nil, err
-			}
+		if err := ec.parseConsumerAuthorization(api.ConsumerAuthorization); err != nil {
+			return nil, err
+		}
+
+		if err := ec.parseQuotaKey(api.QuotaKey); err != nil {
+			return nil, err
+		}
+
+		if err := ec.parseBotRules(api.BotRules); err != nil {
+			return nil, err
 		}
 
-		err := parseHTTPRequestTransforms(api.HTTPRequestTransforms)
+		if err := ec.parseQuotaExemptions(api.QuotaExemptions); err != nil {
+			return nil, err
+		}
+
+		if err := ec.parseOAuthAuthentications(api.Authentication); err != nil {
+			return nil, err
+		}
+
+		err = parseHTTPRequestTransforms(api.HTTPRequestTransforms)
 		if err != nil {
 			return nil, err
 		}
 
+		for j := range api.AuthExclusions {
+			x := api.AuthExclusions[j]
+			if _, err := ec.parseTemplate(x.PathTemplate); err != nil {
+				return nil, err
+			}
+			method := x.Method
+			if method == anyMethod {
+				method = wildcard
+			}
+			split = append([]string{api.ID, method}, strings.Split(x.PathTemplate, "/")...)
+			ec.exclusionPathTree.AddChild(split, 0, &x)
+		}
+
 		for i := range api.Operations {
 			op := api.Operations[i]
 
 			if len(op.HTTPMatches) == 0 { // empty is wildcard
 				split = []string{api.ID, wildcard, wildcard}
-				opMatch := OpTemplateMatch{&op, nil}
+				opMatch := OpTemplateMatch{&op, nil, anyMethod}
 				ec.opPathTree.AddChild(split, 0, &opMatch)
 			} else {
 				for _, m := range op.HTTPMatches {
@@ -117,16 +157,29 @@ func NewEnvironmentSpecExt(spec *EnvironmentSpec) (*EnvironmentSpecExt, error) {
 						return nil, err
 					}
 
-					opMatch := OpTemplateMatch{&op, t}
+					opMatch := OpTemplateMatch{&op, t, m.Method}
 					ec.opPathTree.AddChild(split, 0, &opMatch)
 				}
 			}
 
-			for _, in := range op.ConsumerAuthorization.In {
-				err := ec.parseAPIOperationParameter(in.Transformation)
-				if err != nil {
-					return nil, err
-				}
+			if err := ec.parseConsumerAuthorization(op.ConsumerAuthorization); err != nil {
+				return nil, err
+			}
+
+			if err := ec.parseBotRules(op.BotRules); err != nil {
+				return nil, err
+			}
+
+			if err := ec.parseQuotaExemptions(op.QuotaExemptions); err != nil {
+				return nil, err
+			}
+
+			if err := ec.parseQuotaKey(op.QuotaKey); err != nil {
+				return nil, err
+			}
+
+			if err := ec.parseOAuthAuthentications(op.Authentication); err != nil {
+				return nil, err
 			}
 
 			err := parseHTTPRequestTransforms(op.HTTPRequestTransforms)
@@ -148,21 +201,161 @@ func NewEnvironmentSpecExt(spec *EnvironmentSpec) (*EnvironmentSpecExt, error) {
 	return ec, nil
 }
 
+// parses the parameter transformations of the consumer credential locations
+func (ec *EnvironmentSpecExt) parseConsumerAuthorization(c ConsumerAuthorization) error {
+	for _, in := range c.In {
+		if err := ec.parseAPIOperationParameter(in.Transformation); err != nil {
+			return err
+		}
+	}
+	for _, alt := range c.Alternatives {
+		for _, in := range alt.In {
+			if err := ec.parseAPIOperationParameter(in.Transformation); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parses the parameter transformations of any OAuthAuthentications
+func (ec *EnvironmentSpecExt) parseOAuthAuthentications(auth AuthenticationRequirement) error {
+	switch a := auth.Requirements.(type) {
+	case OAuthAuthentication:
+		for _, in := range a.In {
+			if err := ec.parseAPIOperationParameter(in.Transformation); err != nil {
+				return err
+			}
+		}
+	case AnyAuthenticationRequirements:
+		for _, r := range a {
+			if err := ec.parseOAuthAuthentications(r); err != nil {
+				return err
+			}
+		}
+	case AllAuthenticationRequirements:
+		for _, r := range a {
+			if err := ec.parseOAuthAuthentications(r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 type OpTemplateMatch struct {
 	operation *APIOperation
 	template  *transform.Template
+	method    string // of the HTTPMatch
+}
+
+// matches returns true if the matched operation accepts the request method
+func (m *OpTemplateMatch) matches(method string) bool {
+	if !restrictedMethods[method] || m.method == method {
+		return true
+	}
+	for _, allowed := range m.operation.AllowRestrictedMethods {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
 }
 
 // EnvironmentSpecExt extends an EnvironmentSpec to hold cached values.
 // Create using config.NewEnvironmentSpecExt()
 type EnvironmentSpecExt struct {
 	*EnvironmentSpec
-	apiPathTree        path.Tree                      // base path -> *APISpec
-	opPathTree         path.Tree                      // api.ID -> method -> sub path -> *Operation
-	compiledTemplates  map[string]*transform.Template // string template -> Template
-	corsVary           map[string]bool                // api ID -> true if vary header should be true
-	corsAllowedOrigins map[string]map[string]bool     // api ID -> statically allowed origin -> true
-	compiledRegExps    map[string]*regexp.Regexp      // uncompiled -> compiled
+	apiPathTree        path.Tree                       // base path -> *APISpec
+	opPathTree         path.Tree                       // api.ID -> method -> sub path -> *Operation
+	exclusionPathTree  path.Tree                       // api.ID -> method -> sub path -> *HTTPMatch
+	compiledTemplates  map[string]*transform.Template  // string template -> Template
+	corsPolicies       map[string]*cors.Policy         // api ID -> compiled CORS policy, nil if none
+	corsPathTree       path.Tree                       // api.ID -> sub path -> *scopedCorsPolicy
+	compiledRegExps    map[string]*regexp.Regexp       // uncompiled -> compiled
+	compiledIPRanges   map[string]*net.IPNet           // CIDR -> parsed
+	compiledConditions map[string]*transform.Condition // string condition -> Condition
+	jwtParallelism     int                             // concurrent JWT verifications per any requirement
+	timeouts           verificationTimeouts            // default and maximum of API verification timeouts
+	kvm                KVMLookup                       // {kvm.map.key} template values
+	ipReputation       IPReputation                    // BotRule ip_reputation list
+	proxyChain         *ProxyChain                     // resolves client addresses
+	oidcVerifier       OIDCVerifier                    // JWT verification of OIDCDiscovery sources
+	jwksVerifier       JWKSVerifier                    // JWT verification of RemoteJWKS sources with TLS
+	revocations        RevocationList                  // revoked JWTs of JWTAuthentications
+	jwtLimiter         JWTLimiter                      // rejects JWTs before parsing
+	tokenSchemes       []string                        // stripped from JWT and OAuth token values
+	deploymentValues   map[string]string               // {env.VAR} and {pod.name} template values
+	environmentVars    map[string]bool                 // environment variables {env.VAR} may read
+}
+
+// default and maximum of API VerificationTimeouts, zero is unset
+type verificationTimeouts struct {
+	defaultTimeout time.Duration
+	maxTimeout     time.Duration
+}
+
+// apply returns the effective timeout for an API timeout
+func (v verificationTimeouts) apply(timeout time.Duration) time.Duration {
+	if timeout == 0 {
+		timeout = v.defaultTimeout
+	}
+	if v.maxTimeout > 0 && (timeout == 0 || timeout > v.maxTimeout) {
+		timeout = v.maxTimeout
+	}
+	return timeout
+}
+
+// SetVerificationTimeouts sets the default timeout of APIs without their own
+// VerificationTimeouts and the maximum of any API. Zero is unset.
+func (e *EnvironmentSpecExt) SetVerificationTimeouts(defaultTimeout, maxTimeout time.Duration) {
+	e.timeouts = verificationTimeouts{defaultTimeout, maxTimeout}
+}
+
+// SetKVMLookup sets the source of {kvm.map.key} template and condition values.
+func (e *EnvironmentSpecExt) SetKVMLookup(kvm KVMLookup) {
+	e.kvm = kvm
+}
+
+// SetIPReputation sets the list matched by BotRules with IPReputation.
+func (e *EnvironmentSpecExt) SetIPReputation(list IPReputation) {
+	e.ipReputation = list
+}
+
+// SetOIDCVerifier sets the verifier of JWTAuthentications with OIDCDiscovery.
+func (e *EnvironmentSpecExt) SetOIDCVerifier(verifier OIDCVerifier) {
+	e.oidcVerifier = verifier
+}
+
+// SetJWKSVerifier sets the verifier of JWTAuthentications with RemoteJWKS
+// TLS settings.
+func (e *EnvironmentSpecExt) SetJWKSVerifier(verifier JWKSVerifier) {
+	e.jwksVerifier = verifier
+}
+
+// SetTokenSchemes sets the schemes, such as Bearer, stripped case-insensitively
+// from the values of JWTAuthentication and OAuthAuthentication locations
+// before their transformations.
+func (e *EnvironmentSpecExt) SetTokenSchemes(schemes []string) {
+	e.tokenSchemes = schemes
+}
+
+// SetRevocationList sets the list of JWTs rejected by JWTAuthentications.
+func (e *EnvironmentSpecExt) SetRevocationList(list RevocationList) {
+	e.revocations = list
+}
+
+// SetJWTLimiter sets the limits checked before parsing the JWTs of
+// JWTAuthentications.
+func (e *EnvironmentSpecExt) SetJWTLimiter(limiter JWTLimiter) {
+	e.jwtLimiter = limiter
+}
+
+// SetJWTParallelism sets how many JWTAuthentications of an
+// AnyAuthenticationRequirements may be verified concurrently.
+// Values below 2 verify sequentially.
+func (e *EnvironmentSpecExt) SetJWTParallelism(n int) {
+	e.jwtParallelism = n
 }
 
 // JWTAuthentications returns a list of all JWTAuthentications for the Spec
@@ -192,7 +385,7 @@ func (u NameValueTransforms) isEmpty() bool {
 }
 
 func (c ConsumerAuthorization) isEmpty() bool {
-	return !c.Disabled && len(c.In) == 0
+	return !c.Disabled && len(c.In) == 0 && len(c.Alternatives) == 0
 }
 
 func (a AuthenticationRequirement) IsEmpty() bool {
@@ -201,7 +394,7 @@ func (a AuthenticationRequirement) IsEmpty() bool {
 
 func isEmpty(auth AuthenticationRequirement) bool {
 	switch a := auth.Requirements.(type) {
-	case JWTAuthentication:
+	case JWTAuthentication, OAuthAuthentication:
 		return false
 	case AnyAuthenticationRequirements:
 		for _, r := range []AuthenticationRequirement(a) {
@@ -226,9 +419,59 @@ func (e *EnvironmentSpecExt) parseTemplate(templateString string) (*transform.Te
 	}
 	template, err := transform.Parse(templateString)
 	e.compiledTemplates[templateString] = template
+	if err == nil {
+		err = e.resolveDeploymentValues(template)
+	}
 	return template, err
 }
 
+// quotaKeyNamespaces are the template variable namespaces of quota keys.
+// Request headers, query parameters, and paths are excluded as clients could
+// vary them to spread their requests over any number of quota buckets.
+var quotaKeyNamespaces = map[string]bool{
+	PathNamespace:      true,
+	LabelsNamespace:    true,
+	JWTNamespace:       true,
+	KVMNamespace:       true,
+	APINamespace:       true,
+	OperationNamespace: true,
+	EnvNamespace:       true,
+	PodNamespace:       true,
+}
+
+// parses and caches a quota key template, returns an error if it has
+// variables of namespaces the client controls. Use only during creation.
+func (e *EnvironmentSpecExt) parseQuotaKey(templateString string) error {
+	template, err := e.parseTemplate(templateString)
+	if err != nil || template == nil {
+		return err
+	}
+	for _, part := range template.Parts {
+		if part.Variable == nil {
+			continue
+		}
+		namespace := strings.SplitN(part.Variable.Name, VariableNamespaceSeparator, 2)[0]
+		if !quotaKeyNamespaces[namespace] {
+			return fmt.Errorf("quota key %q: {%s} is not allowed, use path, labels, jwt, kvm, api, operation, env, or pod variables",
+				templateString, part.Variable.Name)
+		}
+	}
+	return nil
+}
+
+// parses and caches, use only during creation
+func (e *EnvironmentSpecExt) parseCondition(conditionString string) error {
+	if conditionString == "" {
+		return nil
+	}
+	condition, err := transform.ParseCondition(conditionString)
+	if err != nil {
+		return fmt.Errorf("invalid condition %q: %v", conditionString, err)
+	}
+	e.compiledConditions[conditionString] = condition
+	return nil
+}
+
 // parses the StringTransformation and adds to cache
 // use only during creation
 func (e *EnvironmentSpecExt) parseAPIOperationParameter(s StringTransformation) error {
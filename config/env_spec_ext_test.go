@@ -133,12 +133,12 @@ func TestHTTPRequestTransformsIsEmpty(t *testing.T) {
 		t.Errorf("expected not empty")
 	}
 	transforms.PathTransform = ""
-	transforms.HeaderTransforms.Add = []AddNameValue{{"x", "x", false}}
+	transforms.HeaderTransforms.Add = []AddNameValue{{"x", "x", false, "", ""}}
 	if transforms.isEmpty() {
 		t.Errorf("expected not empty")
 	}
 	transforms.HeaderTransforms.Add = []AddNameValue{}
-	transforms.QueryTransforms.Add = []AddNameValue{{"x", "x", false}}
+	transforms.QueryTransforms.Add = []AddNameValue{{"x", "x", false, "", ""}}
 	if transforms.isEmpty() {
 		t.Errorf("expected not empty")
 	}
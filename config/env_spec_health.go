@@ -0,0 +1,180 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/errorset"
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+// EndpointCheck is the result of fetching the JWKS of a JWTAuthentication
+// requirement of an API or operation.
+type EndpointCheck struct {
+	SpecID      string
+	APIID       string
+	Operation   string // empty for API requirements
+	Requirement string // JWTAuthentication name
+	URL         string // RemoteJWKS URL or OIDCDiscovery configuration URL
+	Keys        int    // number of keys served
+	Err         error
+}
+
+// OK is true if the JWKS was fetched and has keys.
+func (c EndpointCheck) OK() bool {
+	return c.Err == nil
+}
+
+func (c EndpointCheck) String() string {
+	scope := c.SpecID + "/" + c.APIID
+	if c.Operation != "" {
+		scope += "/" + c.Operation
+	}
+	if c.Err != nil {
+		return fmt.Sprintf("%s jwt %s: %s: %v", scope, c.Requirement, c.URL, c.Err)
+	}
+	return fmt.Sprintf("%s jwt %s: %s: %d keys", scope, c.Requirement, c.URL, c.Keys)
+}
+
+// ValidateEnvironmentSpecsOnline validates the specs as ValidateEnvironmentSpecs
+// does and then checks that the JWKS source of each JWTAuthentication is
+// reachable and serves valid keys. The checks are returned in order of spec,
+// API, operation, and requirement name. The error lists the failed checks.
+func ValidateEnvironmentSpecsOnline(ess []EnvironmentSpec, client *http.Client) ([]EndpointCheck, error) {
+	if err := ValidateEnvironmentSpecs(ess); err != nil {
+		return nil, err
+	}
+	checks := CheckEnvironmentSpecEndpoints(ess, client)
+	var errs error
+	for _, c := range checks {
+		if !c.OK() {
+			errs = errorset.Append(errs, fmt.Errorf("%s", c))
+		}
+	}
+	return checks, errs
+}
+
+// CheckEnvironmentSpecEndpoints fetches the JWKS source of each
+// JWTAuthentication of the validated specs. Each URL is fetched once.
+func CheckEnvironmentSpecEndpoints(ess []EnvironmentSpec, client *http.Client) []EndpointCheck {
+	type result struct {
+		keys int
+		err  error
+	}
+	results := make(map[string]result) // by URL
+	fetch := func(source JWKSSource) (string, result) {
+		var u string
+		switch s := source.(type) {
+		case RemoteJWKS:
+			u = s.URL
+		case OIDCDiscovery:
+			u = s.ConfigurationURL()
+		}
+		if r, ok := results[u]; ok {
+			return u, r
+		}
+		var r result
+		r.keys, r.err = fetchJWKSSource(client, source)
+		results[u] = r
+		return u, r
+	}
+
+	var checks []EndpointCheck
+	add := func(specID, apiID, op string, auths map[string]*JWTAuthentication) {
+		names := make([]string, 0, len(auths))
+		for name := range auths {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			u, r := fetch(auths[name].JWKSSource)
+			checks = append(checks, EndpointCheck{
+				SpecID:      specID,
+				APIID:       apiID,
+				Operation:   op,
+				Requirement: name,
+				URL:         u,
+				Keys:        r.keys,
+				Err:         r.err,
+			})
+		}
+	}
+	for _, es := range ess {
+		for _, api := range es.APIs {
+			add(es.ID, api.ID, "", api.jwtAuthentications)
+			for _, op := range api.Operations {
+				add(es.ID, api.ID, op.Name, op.jwtAuthentications)
+			}
+		}
+	}
+	return checks
+}
+
+// fetchJWKSSource returns the number of keys of the JWKS of source. The
+// issuer of an OIDCDiscovery document must match its URL.
+func fetchJWKSSource(client *http.Client, source JWKSSource) (int, error) {
+	var jwksURL string
+	switch s := source.(type) {
+	case RemoteJWKS:
+		jwksURL = s.URL
+		if s.TLS != nil {
+			var err error
+			if client, err = s.TLS.Client(client); err != nil {
+				return 0, err
+			}
+		}
+	case OIDCDiscovery:
+		resp, err := client.Get(s.ConfigurationURL())
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return 0, fmt.Errorf("discovery document status: %d", resp.StatusCode)
+		}
+		var doc struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+			return 0, fmt.Errorf("invalid discovery document: %v", err)
+		}
+		if strings.TrimSuffix(doc.Issuer, "/") != s.Issuer() {
+			return 0, fmt.Errorf("discovery document issuer %q does not match %q", doc.Issuer, s.Issuer())
+		}
+		jwksURL = doc.JWKSURI
+	default:
+		return 0, fmt.Errorf("unsupported jwks source")
+	}
+	if u, err := url.Parse(jwksURL); err != nil || !u.IsAbs() {
+		return 0, fmt.Errorf("invalid jwks url %q", jwksURL)
+	}
+
+	keys, err := jwk.Fetch(context.Background(), jwksURL, jwk.WithHTTPClient(client))
+	if err != nil {
+		return 0, err
+	}
+	if keys.Len() == 0 {
+		return 0, fmt.Errorf("jwks %s has no keys", jwksURL)
+	}
+	return keys.Len(), nil
+}
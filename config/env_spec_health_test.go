@@ -0,0 +1,128 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	"github.com/apigee/apigee-remote-service-golib/v2/errorset"
+)
+
+func TestValidateEnvironmentSpecsOnline(t *testing.T) {
+	_, jwks, err := testutil.GenerateKeyAndJWKs("kid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetches := map[string]int{}
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches[r.URL.Path]++
+		switch r.URL.Path {
+		case "/jwks":
+			_, _ = w.Write(jwks)
+		case "/empty":
+			_, _ = w.Write([]byte(`{"keys":[]}`))
+		case "/idp" + OIDCConfigurationPath:
+			fmt.Fprintf(w, `{"issuer":"%s/idp","jwks_uri":"%s/jwks"}`, srv.URL, srv.URL)
+		case "/other" + OIDCConfigurationPath:
+			fmt.Fprintf(w, `{"issuer":"%s/idp","jwks_uri":"%s/jwks"}`, srv.URL, srv.URL)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	jwt := func(name string, source JWKSSource) AuthenticationRequirement {
+		return AuthenticationRequirement{Requirements: JWTAuthentication{Name: name, JWKSSource: source}}
+	}
+	specs := []EnvironmentSpec{{
+		ID: "spec",
+		APIs: []APISpec{{
+			ID:             "api",
+			BasePath:       "/v1",
+			Authentication: jwt("good", RemoteJWKS{URL: srv.URL + "/jwks"}),
+			Operations: []APIOperation{{
+				Name: "op",
+				Authentication: AuthenticationRequirement{Requirements: AnyAuthenticationRequirements{
+					jwt("same", RemoteJWKS{URL: srv.URL + "/jwks"}),
+					jwt("empty", RemoteJWKS{URL: srv.URL + "/empty"}),
+					jwt("missing", RemoteJWKS{URL: srv.URL + "/missing"}),
+					jwt("oidc", OIDCDiscovery{URL: srv.URL + "/idp"}),
+					jwt("wrong-issuer", OIDCDiscovery{URL: srv.URL + "/other"}),
+				}},
+			}},
+		}},
+	}}
+
+	checks, err := ValidateEnvironmentSpecsOnline(specs, srv.Client())
+	tests := []struct {
+		requirement string
+		op          string
+		keys        int
+		wantErr     string
+	}{
+		{"good", "", 1, ""},
+		{"empty", "op", 0, "failed to parse"},
+		{"missing", "op", 0, "404"},
+		{"oidc", "op", 1, ""},
+		{"same", "op", 1, ""},
+		{"wrong-issuer", "op", 0, "does not match"},
+	}
+	if len(checks) != len(tests) {
+		t.Fatalf("want %d checks, got: %v", len(tests), checks)
+	}
+	for i, tc := range tests {
+		c := checks[i]
+		if c.Requirement != tc.requirement || c.Operation != tc.op || c.SpecID != "spec" || c.APIID != "api" {
+			t.Errorf("check %d: want %s of %q, got %s of %q", i, tc.requirement, tc.op, c.Requirement, c.Operation)
+			continue
+		}
+		if c.Keys != tc.keys {
+			t.Errorf("%s: want %d keys, got %d", tc.requirement, tc.keys, c.Keys)
+		}
+		if tc.wantErr == "" {
+			if !c.OK() {
+				t.Errorf("%s: unexpected error: %v", tc.requirement, c.Err)
+			}
+		} else if c.OK() || !strings.Contains(c.Err.Error(), tc.wantErr) {
+			t.Errorf("%s: want error containing %q, got: %v", tc.requirement, tc.wantErr, c.Err)
+		}
+	}
+
+	merr, ok := err.(*errorset.Error)
+	if !ok {
+		t.Fatalf("want errorset, got: %v", err)
+	}
+	if len(merr.Errors) != 3 {
+		t.Errorf("want 3 errors, got: %v", merr.Errors)
+	}
+	if fetches["/jwks"] != 2 {
+		t.Errorf("want the jwks fetched once directly and once by discovery, got %d", fetches["/jwks"])
+	}
+	equal(t, checks[0].String(), fmt.Sprintf("spec/api jwt good: %s/jwks: 1 keys", srv.URL))
+}
+
+func TestValidateEnvironmentSpecsOnlineInvalid(t *testing.T) {
+	specs := []EnvironmentSpec{{ID: ""}}
+	checks, err := ValidateEnvironmentSpecsOnline(specs, http.DefaultClient)
+	if err == nil || checks != nil {
+		t.Errorf("want offline validation error and no checks, got: %v, %v", checks, err)
+	}
+}
@@ -20,8 +20,12 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/apigee/apigee-remote-service-envoy/v2/cors"
 	"github.com/apigee/apigee-remote-service-envoy/v2/transform"
 	"github.com/apigee/apigee-remote-service-golib/v2/auth"
 	"github.com/apigee/apigee-remote-service-golib/v2/auth/jwt"
@@ -33,26 +37,33 @@ import (
 const TruncateDebugRequestValuesAt = 5
 
 const (
-	CORSOriginHeader   = "origin"
-	CORSOriginWildcard = "*"
-	CORSRequestMethod  = "access-control-request-method"
-	CORSRequestHeaders = "access-control-request-headers"
-	CORSVary           = "vary"
-	CORSVaryOrigin     = "Origin"
-
-	CORSAllowOrigin           = "access-control-allow-origin"
-	CORSAllowHeaders          = "access-control-allow-headers"
-	CORSAllowMethods          = "access-control-allow-methods"
-	CORSExposeHeaders         = "access-control-expose-headers"
-	CORSMaxAge                = "access-control-max-age"
-	CORSAllowCredentials      = "access-control-allow-credentials"
-	CORSAllowCredentialsValue = "true"
+	CORSOriginHeader          = cors.OriginHeader
+	CORSOriginWildcard        = cors.OriginWildcard
+	CORSRequestMethod         = cors.RequestMethodHeader
+	CORSRequestHeaders        = cors.RequestHeadersHeader
+	CORSRequestPrivateNetwork = cors.RequestPrivateNetworkHeader
+	CORSVary                  = cors.VaryHeader
+	CORSVaryOrigin            = cors.VaryOrigin
+
+	CORSAllowOrigin           = cors.AllowOriginHeader
+	CORSAllowHeaders          = cors.AllowHeadersHeader
+	CORSAllowMethods          = cors.AllowMethodsHeader
+	CORSExposeHeaders         = cors.ExposeHeadersHeader
+	CORSMaxAge                = cors.MaxAgeHeader
+	CORSAllowCredentials      = cors.AllowCredentialsHeader
+	CORSAllowCredentialsValue = cors.TrueValue
+	CORSAllowPrivateNetwork   = cors.AllowPrivateNetworkHeader
 
 	VariableNamespaceSeparator = "."
 	RequestNamespace           = "request"
 	QueryNamespace             = "query"
 	PathNamespace              = "path"
 	HeaderNamespace            = "headers"
+	APINamespace               = "api"
+	OperationNamespace         = "operation"
+	JWTNamespace               = "jwt"
+	LabelsNamespace            = "labels"
+	KVMNamespace               = "kvm"
 	RequestPath                = "path"
 	RequestQuerystring         = "querystring"
 )
@@ -62,6 +73,51 @@ var defaultOperation = &APIOperation{
 	Name: "default",
 }
 
+// AccessTokenVerifier verifies Apigee OAuth access tokens. The auth.Manager
+// passed to NewEnvironmentSpecRequest must implement this to verify
+// OAuthAuthentication requirements.
+type AccessTokenVerifier interface {
+	VerifyAccessToken(token string) (claims map[string]interface{}, err error)
+}
+
+// ConsumerKeyResolver finds the consumer key of the Apigee app having a custom
+// attribute value. The auth.Manager passed to NewEnvironmentSpecRequest must
+// implement this to support ClientCertificate AppAttribute lookups and
+// AppBindings, see Auth.ConsumerKeyAPI.
+type ConsumerKeyResolver interface {
+	ResolveConsumerKey(attribute, value string) (consumerKey string, err error)
+}
+
+// KVMLookup provides the entries of Apigee key value maps (KVMs) to templates
+// and conditions as {kvm.map.key}. Set with EnvironmentSpecExt.SetKVMLookup.
+type KVMLookup interface {
+	LookupKVM(mapName, key string) (value string, ok bool)
+}
+
+// RevocationList lists revoked JWTs of JWTAuthentications by claims.
+// Set with EnvironmentSpecExt.SetRevocationList.
+type RevocationList interface {
+	IsRevoked(claims map[string]interface{}) bool
+}
+
+// JWTLimiter rejects JWTs of JWTAuthentications before they are parsed.
+// Set with EnvironmentSpecExt.SetJWTLimiter.
+type JWTLimiter interface {
+	CheckJWT(jwtString string) error
+}
+
+// OIDCVerifier verifies JWTs with the JWKS of OIDCDiscovery sources.
+// Set with EnvironmentSpecExt.SetOIDCVerifier.
+type OIDCVerifier interface {
+	ParseJWT(jwtString string, source OIDCDiscovery) (claims map[string]interface{}, err error)
+}
+
+// JWKSVerifier verifies JWTs with the JWKS of RemoteJWKS sources with TLS
+// settings. Set with EnvironmentSpecExt.SetJWKSVerifier.
+type JWKSVerifier interface {
+	ParseJWT(jwtString string, source RemoteJWKS) (claims map[string]interface{}, err error)
+}
+
 // NewEnvironmentSpecRequest creates a new EnvironmentSpecRequest
 func NewEnvironmentSpecRequest(authMan auth.Manager, e *EnvironmentSpecExt, req *authv3.CheckRequest) *EnvironmentSpecRequest {
 	esr := &EnvironmentSpecRequest{
@@ -69,6 +125,7 @@ func NewEnvironmentSpecRequest(authMan auth.Manager, e *EnvironmentSpecExt, req
 		authMan:            authMan,
 		Request:            req,
 		jwtResults:         make(map[string]*jwtResult),
+		oauthResults:       make(map[string]*jwtResult),
 	}
 	esr.parseRequest()
 	return esr
@@ -81,9 +138,15 @@ type EnvironmentSpecRequest struct {
 	Request               *authv3.CheckRequest
 	authMan               auth.Manager
 	jwtResults            map[string]*jwtResult // JWTAuthentication.Name ->
+	oauthResults          map[string]*jwtResult // access token ->
+	oauthClaims           jwtClaims             // claims of first verified access token
 	apiSpec               *APISpec
 	operation             *APIOperation
 	consumerAuthorization *ConsumerAuthorization
+	consumerCredential    string            // alternative that supplied the API key
+	authExcluded          bool              // matched an APISpec.AuthExclusions
+	corsPolicy            *cors.Policy      // of the API or its CorsScopes matched, nil if none
+	botRule               string            // name of the BotRule matched
 	variables             *requestVariables // for template reification
 }
 
@@ -116,24 +179,30 @@ func (e *EnvironmentSpecRequest) parseRequest() {
 	if !strings.HasPrefix(opPath, "/") {
 		opPath = "/" + opPath
 	}
+	e.corsPolicy = e.matchCorsPolicy(opPath)
 
 	var pathTemplate *transform.Template
 
-	if len(e.apiSpec.Operations) == 0 { // if no operations, match any for api
-		e.operation = defaultOperation
+	method := e.Request.Attributes.Request.Http.Method
+	if e.IsCORSPreflight() {
+		method = e.Request.Attributes.Request.Http.Headers[CORSRequestMethod]
+	}
+	if e.matchAuthExclusion(method, opPath) {
+		e.authExcluded = true
+	} else if len(e.apiSpec.Operations) == 0 { // if no operations, match any for api
+		if !restrictedMethods[method] {
+			e.operation = defaultOperation
+		}
 	} else {
 		// find operation
 		pathSplits := strings.Split(opPath, "/")
 		// prepend method for search
-		method := e.Request.Attributes.Request.Http.Method
-		if e.IsCORSPreflight() {
-			method = e.Request.Attributes.Request.Http.Headers[CORSRequestMethod]
-		}
 		pathSplits = append([]string{e.apiSpec.ID, method}, pathSplits...)
 		if result := e.opPathTree.Find(pathSplits, 0); result != nil {
-			match := result.(*OpTemplateMatch)
-			e.operation = match.operation
-			pathTemplate = match.template
+			if match := result.(*OpTemplateMatch); match.matches(method) {
+				e.operation = match.operation
+				pathTemplate = match.template
+			}
 		}
 	}
 
@@ -149,11 +218,20 @@ type jwtResult struct {
 
 func (e *EnvironmentSpecRequest) parseRequestVariables(pathTemplate *transform.Template, opPath, queryString string) *requestVariables {
 
+	// template variables may be declared as {name}, {name=*}, or {name=**}
+	pathParams := make(map[string]string)
+	for k, v := range pathTemplate.Extract(opPath) {
+		pathParams[strings.SplitN(k, "=", 2)[0]] = v
+	}
+
 	vars := &requestVariables{
-		path:    pathTemplate.Extract(opPath),
-		headers: e.Request.Attributes.Request.Http.Headers,
-		request: map[string]string{},
-		query:   map[string]string{},
+		path:       pathParams,
+		headers:    e.Request.Attributes.Request.Http.Headers,
+		request:    map[string]string{},
+		query:      map[string]string{},
+		labels:     e.mergeLabels(),
+		kvm:        e.kvm,
+		deployment: e.deploymentValues,
 	}
 
 	vars.request[RequestPath] = opPath
@@ -174,10 +252,13 @@ func (e *EnvironmentSpecRequest) parseRequestVariables(pathTemplate *transform.T
 }
 
 type requestVariables struct {
-	headers map[string]string
-	request map[string]string
-	query   map[string]string
-	path    map[string]string
+	headers    map[string]string
+	request    map[string]string
+	query      map[string]string
+	path       map[string]string
+	labels     map[string]string
+	kvm        KVMLookup
+	deployment map[string]string // {env.VAR} and {pod.name} -> value
 }
 
 func (rv requestVariables) LookupValue(name string) (string, bool) {
@@ -194,6 +275,13 @@ func (rv requestVariables) LookupValue(name string) (string, bool) {
 			mapping = rv.path
 		case HeaderNamespace:
 			mapping = rv.headers
+		case LabelsNamespace:
+			mapping = rv.labels
+		case KVMNamespace:
+			return rv.lookupKVM(splits[1])
+		case EnvNamespace, PodNamespace:
+			val, ok := rv.deployment[name]
+			return val, ok
 		}
 	}
 
@@ -205,6 +293,77 @@ func (rv requestVariables) LookupValue(name string) (string, bool) {
 	return val, ok
 }
 
+// lookupKVM looks up a "map.key" KVM entry
+func (rv requestVariables) lookupKVM(name string) (string, bool) {
+	splits := strings.SplitN(name, VariableNamespaceSeparator, 2)
+	if rv.kvm == nil || len(splits) < 2 {
+		return "", false
+	}
+	return rv.kvm.LookupKVM(splits[0], splits[1])
+}
+
+// conditionVariables extends the requestVariables with values
+// from the matched API, Operation, and JWT claims for Conditions
+type conditionVariables struct {
+	req *EnvironmentSpecRequest
+}
+
+func (cv conditionVariables) LookupValue(name string) (string, bool) {
+	splits := strings.SplitN(name, VariableNamespaceSeparator, 2)
+	if len(splits) > 1 {
+		switch splits[0] {
+		case APINamespace:
+			if api := cv.req.GetAPISpec(); api != nil && splits[1] == "id" {
+				return api.ID, true
+			}
+			return "", false
+		case OperationNamespace:
+			if op := cv.req.GetOperation(); op != nil && splits[1] == "name" {
+				return op.Name, true
+			}
+			return "", false
+		case JWTNamespace:
+			return cv.req.lookupClaim(splits[1])
+		case HeaderNamespace:
+			name = HeaderNamespace + VariableNamespaceSeparator + strings.ToLower(splits[1])
+		}
+	}
+	if cv.req.variables == nil {
+		return "", false
+	}
+	return cv.req.variables.LookupValue(name)
+}
+
+// lookupClaim returns the value of a claim named as {requirement name}.{claim name}
+func (e *EnvironmentSpecRequest) lookupClaim(name string) (string, bool) {
+	splits := strings.SplitN(name, VariableNamespaceSeparator, 2)
+	if len(splits) < 2 {
+		return "", false
+	}
+	e.verifyJWTAuthentication(splits[0])
+	if r := e.jwtResults[splits[0]]; r != nil && r.err == nil && r.claims[splits[1]] != nil {
+		return fmt.Sprint(r.claims[splits[1]]), true
+	}
+	return "", false
+}
+
+// MeetsCondition returns true if the passed condition is empty or evaluates
+// to true for the request. An unknown condition is never met.
+func (e *EnvironmentSpecRequest) MeetsCondition(condition string) bool {
+	if condition == "" {
+		return true
+	}
+	if e == nil {
+		return false
+	}
+	c := e.compiledConditions[condition]
+	if c == nil {
+		log.Warnf("unknown condition: %q", condition)
+		return false
+	}
+	return c.Evaluate(conditionVariables{e})
+}
+
 // GetQueryParams returns a safe copy of the QueryParams map
 func (e *EnvironmentSpecRequest) GetQueryParams() map[string]string {
 	copy := make(map[string]string)
@@ -216,6 +375,103 @@ func (e *EnvironmentSpecRequest) GetQueryParams() map[string]string {
 	return copy
 }
 
+// GetPathParams returns a safe copy of the variables bound by the matched path template
+func (e *EnvironmentSpecRequest) GetPathParams() map[string]string {
+	copy := make(map[string]string)
+	if e != nil && e.variables != nil {
+		for k, v := range e.variables.path {
+			copy[k] = v
+		}
+	}
+	return copy
+}
+
+// GetLabels returns a safe copy of the labels of the matched API and Operation
+func (e *EnvironmentSpecRequest) GetLabels() map[string]string {
+	copy := make(map[string]string)
+	if e != nil && e.variables != nil {
+		for k, v := range e.variables.labels {
+			copy[k] = v
+		}
+	}
+	return copy
+}
+
+// mergeLabels returns the API labels overridden by the Operation labels
+func (e *EnvironmentSpecRequest) mergeLabels() map[string]string {
+	labels := make(map[string]string)
+	if e.apiSpec != nil {
+		for k, v := range e.apiSpec.Labels {
+			labels[k] = v
+		}
+	}
+	if e.operation != nil {
+		for k, v := range e.operation.Labels {
+			labels[k] = v
+		}
+	}
+	return labels
+}
+
+// GetQuotaKey returns the quota key template of the Operation or APISpec as
+// appropriate reified with the variables of conditions, "" if none.
+func (e *EnvironmentSpecRequest) GetQuotaKey() string {
+	if e == nil {
+		return ""
+	}
+	template := ""
+	if op := e.GetOperation(); op != nil && op.QuotaKey != "" {
+		template = op.QuotaKey
+	} else if api := e.GetAPISpec(); api != nil {
+		template = api.QuotaKey
+	}
+	ct := e.compiledTemplates[template]
+	if ct == nil {
+		return ""
+	}
+	return ct.Reify(conditionVariables{e})
+}
+
+// GetQuotaBuckets returns the QuotaBuckets of the Operation or APISpec as
+// appropriate, "" if none.
+func (e *EnvironmentSpecRequest) GetQuotaBuckets() string {
+	if e == nil {
+		return ""
+	}
+	if op := e.GetOperation(); op != nil && op.QuotaBuckets != "" {
+		return op.QuotaBuckets
+	}
+	if api := e.GetAPISpec(); api != nil {
+		return api.QuotaBuckets
+	}
+	return ""
+}
+
+// GetVerificationTimeouts returns the VerificationTimeouts of the APISpec with
+// the default and maximum set by EnvironmentSpecExt.SetVerificationTimeouts
+// applied. Zero is no timeout.
+func (e *EnvironmentSpecRequest) GetVerificationTimeouts() VerificationTimeouts {
+	if e == nil {
+		return VerificationTimeouts{}
+	}
+	var timeouts VerificationTimeouts
+	if api := e.GetAPISpec(); api != nil {
+		timeouts = api.VerificationTimeouts
+	}
+	return VerificationTimeouts{
+		APIKey: e.timeouts.apply(timeouts.APIKey),
+		JWKS:   e.timeouts.apply(timeouts.JWKS),
+	}
+}
+
+// GetDPoP returns the DPoP config of the APISpec.
+func (e *EnvironmentSpecRequest) GetDPoP() DPoP {
+	if api := e.GetAPISpec(); api != nil {
+		return api.DPoP
+	}
+	return DPoP{}
+}
+
 // Reify will return a string with known {variables} replaced.
 // If the template is unknown, the unmodified template will be returned.
 // If a {variable} is unknown, it will be replaced by an empty string.
@@ -247,9 +503,10 @@ func (e *EnvironmentSpecRequest) GetAPISpec() *APISpec {
 	return e.apiSpec
 }
 
-// GetOperationPath returns path of Operation, no basepath or querystring
+// GetOperationPath returns path of Operation, or of the auth exclusion, no
+// basepath or querystring
 func (e *EnvironmentSpecRequest) GetOperationPath() string {
-	if e.GetOperation() == nil {
+	if e.GetOperation() == nil && !e.IsAuthExcluded() {
 		return ""
 	}
 	return e.variables.request[RequestPath]
@@ -284,13 +541,50 @@ func (e *EnvironmentSpecRequest) GetParamValue(param APIOperationParameter) stri
 		key := string(m)
 		value = e.variables.query[key]
 		log.Debugf("param from query %q: %q", key, util.Truncate(value, TruncateDebugRequestValuesAt))
+	case Cookie:
+		value = e.getCookieValue(m)
+		log.Debugf("param from cookie %q: %q", m.Name, util.Truncate(value, TruncateDebugRequestValuesAt))
 	case JWTClaim:
 		value = e.getClaimValue(m)
 		log.Debugf("param from claim %q: %q", m, util.Truncate(value, TruncateDebugRequestValuesAt))
+	case ClientCertificate:
+		value = e.getClientCertificateValue(m)
+		log.Debugf("param from client certificate %q: %q", m.Field, util.Truncate(value, TruncateDebugRequestValuesAt))
 	}
 	return e.Transform(param.Transformation.Template, param.Transformation.Substitution, value)
 }
 
+// getTokenValue returns the value of a token location, stripped of any of the
+// token schemes before its transformation
+func (e *EnvironmentSpecRequest) getTokenValue(param APIOperationParameter) string {
+	if len(e.tokenSchemes) == 0 {
+		return e.GetParamValue(param)
+	}
+	value := e.GetParamValue(APIOperationParameter{Match: param.Match})
+	for _, scheme := range e.tokenSchemes {
+		if len(value) > len(scheme) && value[len(scheme)] == ' ' && strings.EqualFold(value[:len(scheme)], scheme) {
+			value = strings.TrimLeft(value[len(scheme):], " ")
+			break
+		}
+	}
+	return e.Transform(param.Transformation.Template, param.Transformation.Substitution, value)
+}
+
+// getCookieValue returns the value of the cookie without its prefix, "" if
+// the request doesn't have the cookie
+func (e *EnvironmentSpecRequest) getCookieValue(cookie Cookie) string {
+	header := e.Request.Attributes.Request.Http.Headers["cookie"]
+	if header == "" {
+		return ""
+	}
+	req := &http.Request{Header: http.Header{"Cookie": []string{header}}}
+	c, err := req.Cookie(cookie.Name)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(c.Value, cookie.StripPrefix)
+}
+
 func (e *EnvironmentSpecRequest) getClaimValue(claim JWTClaim) string {
 	if e != nil {
 		r, ok := e.jwtResults[claim.Requirement]
@@ -308,8 +602,10 @@ func (e *EnvironmentSpecRequest) getClaimValue(claim JWTClaim) string {
 // JWTAuthentications returns a list of JWTAuthentication specific to the request.
 func (e *EnvironmentSpecRequest) JWTAuthentications() []*JWTAuthentication {
 	var auths []*JWTAuthentication
-	for _, v := range e.GetOperation().jwtAuthentications {
-		auths = append(auths, v)
+	if op := e.GetOperation(); op != nil {
+		for _, v := range op.jwtAuthentications {
+			auths = append(auths, v)
+		}
 	}
 	if len(auths) != 0 {
 		return auths
@@ -327,12 +623,7 @@ func (e *EnvironmentSpecRequest) verifyJWTAuthentication(name string) bool {
 	if e == nil {
 		return false
 	}
-	var jwtReq *JWTAuthentication
-	if len(e.GetOperation().jwtAuthentications) > 0 {
-		jwtReq = e.GetOperation().jwtAuthentications[name]
-	} else {
-		jwtReq = e.GetAPISpec().jwtAuthentications[name]
-	}
+	jwtReq := e.getJWTAuthentication(name)
 	if jwtReq == nil {
 		log.Debugf("JWTAuthentication %q not found", name)
 		return false
@@ -342,27 +633,77 @@ func (e *EnvironmentSpecRequest) verifyJWTAuthentication(name string) bool {
 	}
 
 	// uncached, parse it
-	setResult := func(claims map[string]interface{}, err error) {
-		if err != nil {
-			log.Debugf("JWTAuthentication %q verification error: %s", name, err)
-		} else {
-			log.Debugf("JWTAuthentication %q verified, claims: %v", name, claims)
-		}
-		e.jwtResults[name] = &jwtResult{
-			claims: claims,
-			err:    err,
-		}
+	return e.setJWTResult(name, e.parseJWTAuthentication(jwtReq, e.jwtStrings(jwtReq)))
+}
+
+// getJWTAuthentication returns the named JWTAuthentication of the Operation
+// or APISpec as appropriate, nil if not found
+func (e *EnvironmentSpecRequest) getJWTAuthentication(name string) *JWTAuthentication {
+	if op := e.GetOperation(); op != nil && len(op.jwtAuthentications) > 0 {
+		return op.jwtAuthentications[name]
 	}
+	if api := e.GetAPISpec(); api != nil {
+		return api.jwtAuthentications[name]
+	}
+	return nil
+}
 
+// jwtStrings returns the values of the JWTAuthentication locations
+func (e *EnvironmentSpecRequest) jwtStrings(jwtReq *JWTAuthentication) []string {
+	jwtStrings := make([]string, 0, len(jwtReq.In))
 	for _, p := range jwtReq.In {
-		jwksSource, ok := jwtReq.JWKSSource.(RemoteJWKS) // only RemoteJWKS supported for now
-		if !ok {
-			setResult(nil, fmt.Errorf("JWKSSource must be RemoteJWKS, got: %#v", jwtReq.JWKSSource))
+		jwtStrings = append(jwtStrings, e.getTokenValue(p))
+	}
+	return jwtStrings
+}
+
+// setJWTResult caches the result, returns true if verified
+func (e *EnvironmentSpecRequest) setJWTResult(name string, result *jwtResult) bool {
+	if result.err != nil {
+		log.Debugf("JWTAuthentication %q verification error: %s", name, result.err)
+	} else {
+		log.Debugf("JWTAuthentication %q verified, claims: %v", name, result.claims)
+	}
+	e.jwtResults[name] = result
+	return result.err == nil
+}
+
+// parseJWTAuthentication verifies the jwtStrings found in the JWTAuthentication
+// locations, first match wins. It doesn't touch the request and is safe to run
+// concurrently.
+func (e *EnvironmentSpecRequest) parseJWTAuthentication(jwtReq *JWTAuthentication, jwtStrings []string) *jwtResult {
+	var parser jwtParser = e.authMan
+	var provider jwt.Provider
+	switch source := jwtReq.JWKSSource.(type) {
+	case RemoteJWKS:
+		if source.TLS == nil {
+			provider.JWKSURL = source.URL
+			break
 		}
-		jwtString := e.GetParamValue(p)
-		provider := jwt.Provider{JWKSURL: jwksSource.URL}
+		if e.jwksVerifier == nil {
+			return &jwtResult{err: fmt.Errorf("JWKS of %s unavailable", source.URL)}
+		}
+		parser = jwksJWTParser{e.jwksVerifier, source}
+	case OIDCDiscovery:
+		if e.oidcVerifier == nil {
+			return &jwtResult{err: fmt.Errorf("OIDC discovery of %s unavailable", source.URL)}
+		}
+		parser = oidcJWTParser{e.oidcVerifier, source}
+	default:
+		return &jwtResult{err: fmt.Errorf("JWKSSource must be RemoteJWKS or OIDCDiscovery, got: %#v", jwtReq.JWKSSource)}
+	}
+	timeout := e.GetVerificationTimeouts().JWKS
 
-		claims, err := e.authMan.ParseJWT(jwtString, provider)
+	result := &jwtResult{err: fmt.Errorf("no JWT found")}
+	for _, jwtString := range jwtStrings {
+		var claims map[string]interface{}
+		var err error
+		if e.jwtLimiter != nil && jwtString != "" {
+			err = e.jwtLimiter.CheckJWT(jwtString)
+		}
+		if err == nil {
+			claims, err = parseJWTWithTimeout(parser, jwtString, provider, timeout)
+		}
 		if err == nil {
 			err = mustBeInClaim(jwtReq.Issuer, "iss", claims)
 		}
@@ -380,17 +721,178 @@ func (e *EnvironmentSpecRequest) verifyJWTAuthentication(name string) bool {
 				break
 			}
 		}
+		if err == nil {
+			err = e.verifyCertificateBinding(jwtReq.CertificateBinding, claims)
+		}
+		if err == nil && e.revocations != nil && e.revocations.IsRevoked(claims) {
+			err = fmt.Errorf("JWT revoked")
+		}
 
-		setResult(claims, err)
+		result = &jwtResult{claims: claims, err: err}
 		// First match wins
 		if err == nil {
+			break
+		}
+	}
+	return result
+}
+
+// jwtParser parses and verifies JWTs, as auth.Manager
+type jwtParser interface {
+	ParseJWT(jwtString string, provider jwt.Provider) (claims map[string]interface{}, err error)
+}
+
+// oidcJWTParser is a jwtParser of an OIDCDiscovery source
+type oidcJWTParser struct {
+	verifier OIDCVerifier
+	source   OIDCDiscovery
+}
+
+func (p oidcJWTParser) ParseJWT(jwtString string, provider jwt.Provider) (map[string]interface{}, error) {
+	return p.verifier.ParseJWT(jwtString, p.source)
+}
+
+// jwksJWTParser is a jwtParser of a RemoteJWKS source with TLS settings
+type jwksJWTParser struct {
+	verifier JWKSVerifier
+	source   RemoteJWKS
+}
+
+func (p jwksJWTParser) ParseJWT(jwtString string, provider jwt.Provider) (map[string]interface{}, error) {
+	return p.verifier.ParseJWT(jwtString, p.source)
+}
+
+// parseJWTWithTimeout gives up on parsing after timeout, leaving the parse
+// running in the background. Zero timeout waits for the parse.
+func parseJWTWithTimeout(authMan jwtParser, jwtString string, provider jwt.Provider, timeout time.Duration) (map[string]interface{}, error) {
+	if timeout <= 0 {
+		return authMan.ParseJWT(jwtString, provider)
+	}
+	type parsed struct {
+		claims map[string]interface{}
+		err    error
+	}
+	done := make(chan parsed, 1)
+	go func() {
+		claims, err := authMan.ParseJWT(jwtString, provider)
+		done <- parsed{claims, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case p := <-done:
+		return p.claims, p.err
+	case <-timer.C:
+		return nil, fmt.Errorf("JWT verification timed out after %s", timeout)
+	}
+}
+
+// verifyAnyJWTAuthentications verifies the uncached JWTAuthentications of an
+// AnyAuthenticationRequirements concurrently, at most jwtParallelism at a time.
+// Results are cached as they arrive and the first success returns true without
+// waiting on the rest. Returns false if nothing was verified, including when
+// there are too few JWTAuthentications to be worth running concurrently.
+func (e *EnvironmentSpecRequest) verifyAnyJWTAuthentications(reqs AnyAuthenticationRequirements) bool {
+	if e.jwtParallelism < 2 {
+		return false
+	}
+
+	type candidate struct {
+		name       string
+		jwtReq     *JWTAuthentication
+		jwtStrings []string
+	}
+	var candidates []candidate
+	seen := make(map[string]bool)
+	for _, r := range []AuthenticationRequirement(reqs) {
+		a, ok := r.Requirements.(JWTAuthentication)
+		if !ok || r.Disabled || seen[a.Name] || e.jwtResults[a.Name] != nil {
+			continue
+		}
+		seen[a.Name] = true
+		if jwtReq := e.getJWTAuthentication(a.Name); jwtReq != nil {
+			// request values are read here, only verification is concurrent
+			candidates = append(candidates, candidate{a.Name, jwtReq, e.jwtStrings(jwtReq)})
+		}
+	}
+	if len(candidates) < 2 {
+		return false
+	}
+
+	type namedResult struct {
+		name   string
+		result *jwtResult
+	}
+	results := make(chan namedResult, len(candidates))
+	done := make(chan struct{})
+	defer close(done)
+	sem := make(chan struct{}, e.jwtParallelism)
+	for _, c := range candidates {
+		go func(c candidate) {
+			select {
+			case sem <- struct{}{}:
+			case <-done: // already verified, skip
+				return
+			}
+			defer func() { <-sem }()
+			results <- namedResult{c.name, e.parseJWTAuthentication(c.jwtReq, c.jwtStrings)}
+		}(c)
+	}
+
+	for range candidates {
+		r := <-results
+		if e.setJWTResult(r.name, r.result) {
 			return true
 		}
 	}
+	return false
+}
 
+// verifies the first access token found in the OAuthAuthentication locations
+// returns true if verified
+func (e *EnvironmentSpecRequest) verifyOAuthAuthentication(oauth OAuthAuthentication) bool {
+	verifier, ok := e.authMan.(AccessTokenVerifier)
+	if !ok {
+		log.Warnf("OAuthAuthentication unsupported, auth manager cannot verify access tokens")
+		return false
+	}
+	for _, p := range oauth.In {
+		token := e.getTokenValue(p)
+		if token == "" {
+			continue
+		}
+		result := e.oauthResults[token]
+		if result == nil { // uncached, verify it
+			claims, err := verifier.VerifyAccessToken(token)
+			if err != nil {
+				log.Debugf("OAuthAuthentication verification error: %s", err)
+			} else {
+				log.Debugf("OAuthAuthentication verified, claims: %v", claims)
+			}
+			result = &jwtResult{claims: claims, err: err}
+			e.oauthResults[token] = result
+		}
+		// First match wins
+		if result.err == nil {
+			if e.oauthClaims == nil {
+				e.oauthClaims = result.claims
+			}
+			return true
+		}
+		return false
+	}
 	return false
 }
 
+// GetOAuthClaims returns the claims of the verified OAuthAuthentication access
+// token, nil if none. Call after IsAuthenticated().
+func (e *EnvironmentSpecRequest) GetOAuthClaims() map[string]interface{} {
+	if e == nil {
+		return nil
+	}
+	return e.oauthClaims
+}
+
 // returns error if passed value is not in claim as string or []string
 func mustBeInClaim(value, name string, claims map[string]interface{}) error {
 	if value == "" {
@@ -461,7 +963,12 @@ func (e *EnvironmentSpecRequest) meetsAuthenticatationRequirements(auth Authenti
 	switch a := auth.Requirements.(type) {
 	case JWTAuthentication:
 		return e.verifyJWTAuthentication(a.Name)
+	case OAuthAuthentication:
+		return e.verifyOAuthAuthentication(a)
 	case AnyAuthenticationRequirements:
+		if e.verifyAnyJWTAuthentications(a) {
+			return true
+		}
 		for _, r := range []AuthenticationRequirement(a) {
 			if e.meetsAuthenticatationRequirements(r) {
 				return true
@@ -485,19 +992,99 @@ func (e *EnvironmentSpecRequest) meetsAuthenticatationRequirements(auth Authenti
 // Returns "" if ConsumerAuthorization is disabled.
 func (e *EnvironmentSpecRequest) GetAPIKey() (key string) {
 	if e != nil {
+		e.consumerCredential = ""
 		auth := e.GetConsumerAuthorization()
 		if !auth.Disabled {
 			for _, authorization := range auth.In {
-				if key = e.GetParamValue(authorization); key != "" {
+				if key = e.getCredentialValue(authorization, auth.QueryDuplicates); key != "" {
 					// First match wins.
 					return key
 				}
 			}
+			for _, alt := range sortedConsumerCredentials(auth.Alternatives) {
+				for _, authorization := range alt.In {
+					if key = e.getCredentialValue(authorization, auth.QueryDuplicates); key != "" {
+						log.Debugf("API key from consumer credential %q", alt.Name)
+						e.consumerCredential = alt.Name
+						return key
+					}
+				}
+			}
 		}
 	}
 	return ""
 }
 
+// getCredentialValue returns the value of a consumer credential location,
+// resolving a repeated Query location by the QueryDuplicates policy
+func (e *EnvironmentSpecRequest) getCredentialValue(param APIOperationParameter, duplicates string) string {
+	q, ok := param.Match.(Query)
+	if !ok {
+		return e.GetParamValue(param)
+	}
+	value := queryParamValue(e.variables.request[RequestQuerystring], string(q), duplicates)
+	log.Debugf("credential from query %q: %q", string(q), util.Truncate(value, TruncateDebugRequestValuesAt))
+	return e.Transform(param.Transformation.Template, param.Transformation.Substitution, value)
+}
+
+// queryParamValue returns the percent-decoded value of the name in the query
+// string by the QueryDuplicates policy, "" if none
+func queryParamValue(queryString, name, duplicates string) string {
+	var values []string
+	invalid := false
+	for _, pair := range strings.Split(queryString, "&") {
+		k, v := pair, ""
+		if i := strings.IndexByte(pair, '='); i >= 0 {
+			k, v = pair[:i], pair[i+1:]
+		}
+		if key, err := url.QueryUnescape(k); err != nil || key != name {
+			continue
+		}
+		value, err := url.QueryUnescape(v)
+		if err != nil || !utf8.ValidString(value) {
+			invalid = true
+			continue
+		}
+		values = append(values, value)
+	}
+	switch {
+	case len(values) == 0:
+		return ""
+	case duplicates == QueryDuplicatesFirst:
+		return values[0]
+	case duplicates == QueryDuplicatesLast:
+		return values[len(values)-1]
+	case invalid || len(values) > 1:
+		log.Debugf("query %q rejected, repeated or invalid", name)
+		return ""
+	}
+	return values[0]
+}
+
+// GetConsumerCredential returns the name of the ConsumerAuthorization
+// alternative that supplied the key last returned by GetAPIKey.
+// Returns "" if the key was not from an alternative.
+func (e *EnvironmentSpecRequest) GetConsumerCredential() string {
+	if e == nil {
+		return ""
+	}
+	return e.consumerCredential
+}
+
+// sortedConsumerCredentials returns the alternatives in ascending priority,
+// retaining declaration order for equal priorities
+func sortedConsumerCredentials(alts []ConsumerCredential) []ConsumerCredential {
+	if len(alts) < 2 {
+		return alts
+	}
+	sorted := make([]ConsumerCredential, len(alts))
+	copy(sorted, alts)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+	return sorted
+}
+
 // GetConsumerAuthorization returns the ConsumerAuthorization of Operation or APISpec as appropriate
 func (e *EnvironmentSpecRequest) GetConsumerAuthorization() (auth ConsumerAuthorization) {
 	if e != nil {
@@ -525,11 +1112,7 @@ func (e *EnvironmentSpecRequest) GetConsumerAuthorization() (auth ConsumerAuthor
 
 // IsCORSRequest returns true if request is a CORS request and there is a CORS Policy
 func (e *EnvironmentSpecRequest) IsCORSRequest() bool {
-	if e == nil || e.GetAPISpec() == nil {
-		return false
-	}
-	origin := e.Request.Attributes.Request.Http.Headers[CORSOriginHeader]
-	return origin != "" && !e.GetAPISpec().Cors.IsEmpty()
+	return e.getCORSPolicy() != nil && e.Request.Attributes.Request.Http.Headers[CORSOriginHeader] != ""
 }
 
 // IsCORSPreflight returns true if IsCORSRequest() is true and is OPTIONS methodd
@@ -544,31 +1127,26 @@ func (e *EnvironmentSpecRequest) AllowedOrigin() (origin string, vary bool) {
 	if !e.IsCORSRequest() {
 		return
 	}
-	origin = e.Request.Attributes.Request.Http.Headers[CORSOriginHeader]
-	api := e.GetAPISpec()
-	vary = e.corsVary[api.ID]
-
-	if allowedMap, ok := e.corsAllowedOrigins[api.ID]; ok {
-		if allowed := allowedMap[origin]; allowed {
-			return
-		}
-	}
+	return e.getCORSPolicy().AllowedOrigin(e.Request.Attributes.Request.Http.Headers[CORSOriginHeader])
+}
 
-	for _, regexString := range api.Cors.AllowOriginsRegexes {
-		if compiledRegex, ok := e.compiledRegExps[regexString]; ok {
-			if compiledRegex.MatchString(origin) {
-				return
-			}
-		}
+// CORSResponseHeaders returns the CORS response headers of the request, nil
+// if it is not a CORS request.
+func (e *EnvironmentSpecRequest) CORSResponseHeaders() []cors.Header {
+	if !e.IsCORSRequest() {
+		return nil
 	}
+	headers := e.Request.Attributes.Request.Http.Headers
+	return e.getCORSPolicy().ResponseHeaders(headers[CORSOriginHeader], e.IsCORSPreflight(), headers)
+}
 
-	if ok := e.corsAllowedOrigins[api.ID][wildcard]; ok {
-		origin = wildcard
-		return
+// getCORSPolicy returns the compiled CORS policy of the API or the
+// CorsScopes matching the request path, nil if none
+func (e *EnvironmentSpecRequest) getCORSPolicy() *cors.Policy {
+	if e == nil {
+		return nil
 	}
-
-	origin = ""
-	return
+	return e.corsPolicy
 }
 
 // Transform uses StringTransformation syntax to transform the passed string.
@@ -23,11 +23,13 @@ import (
 	"fmt"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
 	"github.com/apigee/apigee-remote-service-golib/v2/auth"
 	"github.com/apigee/apigee-remote-service-golib/v2/auth/jwt"
 	"github.com/apigee/apigee-remote-service-golib/v2/context"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 )
@@ -36,6 +38,7 @@ func TestNilReceivers(t *testing.T) {
 	// no panics
 	var s *EnvironmentSpecRequest
 	s.GetAPIKey()
+	s.GetConsumerCredential()
 	s.GetAPISpec()
 	s.GetOperation()
 	s.GetParamValue(APIOperationParameter{})
@@ -182,6 +185,66 @@ func TestGetOperation(t *testing.T) {
 	}
 }
 
+func TestGetOperationRestrictedMethods(t *testing.T) {
+	envSpec := EnvironmentSpec{
+		ID: "spec",
+		APIs: []APISpec{
+			{
+				ID:       "ops",
+				BasePath: "/v1",
+				Operations: []APIOperation{
+					{Name: "any", HTTPMatches: []HTTPMatch{{PathTemplate: "/any"}}},
+					{Name: "trace", HTTPMatches: []HTTPMatch{{PathTemplate: "/trace", Method: http.MethodTrace}}},
+					{
+						Name:                   "allowed",
+						HTTPMatches:            []HTTPMatch{{PathTemplate: "/allowed"}},
+						AllowRestrictedMethods: []string{http.MethodConnect},
+					},
+					{Name: "catchall", AllowRestrictedMethods: []string{http.MethodTrace}},
+				},
+			},
+			{
+				ID:       "noops",
+				BasePath: "/v2",
+			},
+		},
+	}
+	specExt, err := NewEnvironmentSpecExt(&envSpec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{http.MethodGet, "/v1/any", "any"},
+		{http.MethodConnect, "/v1/any", ""},
+		{http.MethodTrace, "/v1/trace", "trace"},
+		{http.MethodConnect, "/v1/allowed", "allowed"},
+		{http.MethodTrace, "/v1/allowed", ""},
+		{http.MethodTrace, "/v1/other", "catchall"},
+		{http.MethodConnect, "/v1/other", ""},
+		{http.MethodGet, "/v2/any", defaultOperation.Name},
+		{http.MethodTrace, "/v2/any", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.method+" "+test.path, func(t *testing.T) {
+			envoyReq := testutil.NewEnvoyRequest(test.method, test.path, nil, nil)
+			specReq := NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
+
+			got := ""
+			if op := specReq.GetOperation(); op != nil {
+				got = op.Name
+			}
+			if got != test.want {
+				t.Errorf("want operation %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
 func TestGetParamValueQuery(t *testing.T) {
 	envSpec := createGoodEnvSpec()
 	specExt, err := NewEnvironmentSpecExt(&envSpec)
@@ -260,6 +323,89 @@ func TestGetParamValueHeader(t *testing.T) {
 	}
 }
 
+func TestGetParamValueCookie(t *testing.T) {
+	envSpec := createGoodEnvSpec()
+	specExt, err := NewEnvironmentSpecExt(&envSpec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	tests := []struct {
+		desc   string
+		cookie string
+		match  Cookie
+		want   string
+	}{
+		{"no cookies", "", Cookie{Name: "token"}, ""},
+		{"single cookie", "token=value", Cookie{Name: "token"}, "value"},
+		{"missing cookie", "other=value", Cookie{Name: "token"}, ""},
+		{"multiple cookies", "other=value1; token=value", Cookie{Name: "token"}, "value"},
+		{"quoted", `token="value"`, Cookie{Name: "token"}, "value"},
+		{"strip prefix", "token=Bearer value", Cookie{Name: "token", StripPrefix: "Bearer "}, "value"},
+		{"without prefix", "token=value", Cookie{Name: "token", StripPrefix: "Bearer "}, "value"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			headers := map[string]string{}
+			if test.cookie != "" {
+				headers["cookie"] = test.cookie
+			}
+			envoyReq := testutil.NewEnvoyRequest(http.MethodGet, "/", headers, nil)
+			specReq := NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
+			got := specReq.GetParamValue(APIOperationParameter{Match: test.match})
+
+			if test.want != got {
+				t.Errorf("want: %q, got: %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestGetTokenValue(t *testing.T) {
+	envSpec := createGoodEnvSpec()
+	specExt, err := NewEnvironmentSpecExt(&envSpec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, template := range []string{"prefix-{token}", "{token}"} {
+		if _, err := specExt.parseTemplate(template); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		desc    string
+		schemes []string
+		value   string
+		param   APIOperationParameter
+		want    string
+	}{
+		{"no schemes", nil, "Bearer token", APIOperationParameter{Match: Header("jwt")}, "Bearer token"},
+		{"scheme", []string{"Bearer", "Token"}, "Bearer token", APIOperationParameter{Match: Header("jwt")}, "token"},
+		{"other scheme", []string{"Bearer", "Token"}, "Token token", APIOperationParameter{Match: Header("jwt")}, "token"},
+		{"case insensitive", []string{"Bearer"}, "bEARER  token", APIOperationParameter{Match: Header("jwt")}, "token"},
+		{"no scheme", []string{"Bearer"}, "token", APIOperationParameter{Match: Header("jwt")}, "token"},
+		{"scheme prefix only", []string{"Bearer"}, "Bearertoken", APIOperationParameter{Match: Header("jwt")}, "Bearertoken"},
+		{"unknown scheme", []string{"Bearer"}, "Basic token", APIOperationParameter{Match: Header("jwt")}, "Basic token"},
+		{"before transformation", []string{"Bearer"}, "Bearer prefix-token", APIOperationParameter{
+			Match:          Header("jwt"),
+			Transformation: StringTransformation{Template: "prefix-{token}", Substitution: "{token}"},
+		}, "token"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			specExt.SetTokenSchemes(test.schemes)
+			envoyReq := testutil.NewEnvoyRequest(http.MethodGet, "/", map[string]string{"jwt": test.value}, nil)
+			specReq := NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
+			if got := specReq.getTokenValue(test.param); test.want != got {
+				t.Errorf("want: %q, got: %q", test.want, got)
+			}
+		})
+	}
+}
+
 func TestGetParamValueJWTClaim(t *testing.T) {
 	envSpec := createGoodEnvSpec()
 	specExt, err := NewEnvironmentSpecExt(&envSpec)
@@ -395,6 +541,362 @@ func TestIsAuthenticated(t *testing.T) {
 	}
 }
 
+func TestRevokedJWT(t *testing.T) {
+	envSpec := createGoodEnvSpec()
+	specExt, err := NewEnvironmentSpecExt(&envSpec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	specExt.SetRevocationList(testRevocationList{"revoked": true})
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		jti  string
+		want bool
+	}{
+		{"revoked", false},
+		{"valid", true},
+	} {
+		jwtString, err := testutil.GenerateJWT(privateKey, map[string]interface{}{
+			"iss": "issuer",
+			"aud": []string{"foo", "bar"},
+			"jti": test.jti,
+		})
+		if err != nil {
+			t.Fatalf("generateJWT() failed: %v", err)
+		}
+		envoyReq := testutil.NewEnvoyRequest(http.MethodGet, "/v1/petstore", map[string]string{"jwt": jwtString}, nil)
+		req := NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
+		if got := req.IsAuthenticated(); got != test.want {
+			t.Errorf("jti %q: IsAuthenticated want %t, got %t", test.jti, test.want, got)
+		}
+	}
+}
+
+// testRevocationList revokes JWTs by jti
+type testRevocationList map[string]bool
+
+func (l testRevocationList) IsRevoked(claims map[string]interface{}) bool {
+	jti, _ := claims["jti"].(string)
+	return l[jti]
+}
+
+// testJWKSVerifier accepts JWTs of its URL without verification
+type testJWKSVerifier string
+
+func (v testJWKSVerifier) ParseJWT(jwtString string, source RemoteJWKS) (map[string]interface{}, error) {
+	if source.URL != string(v) || source.TLS == nil {
+		return nil, fmt.Errorf("unexpected source: %v", source)
+	}
+	return map[string]interface{}{"sub": jwtString}, nil
+}
+
+func TestJWTAuthenticationWithJWKSTLS(t *testing.T) {
+	envSpec := EnvironmentSpec{
+		ID: "jwks-tls",
+		APIs: []APISpec{{
+			ID:       "api",
+			BasePath: "/v1",
+			Authentication: AuthenticationRequirement{
+				Requirements: JWTAuthentication{
+					Name:       "jwt",
+					JWKSSource: RemoteJWKS{URL: "https://internal.example.com/jwks", TLS: &JWKSTLS{CAFile: "ca.pem"}},
+					In:         []APIOperationParameter{{Match: Header("jwt")}},
+				},
+			},
+		}},
+	}
+	if err := ValidateEnvironmentSpecs([]EnvironmentSpec{envSpec}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	envoyReq := testutil.NewEnvoyRequest(http.MethodGet, "/v1/petstore", map[string]string{"jwt": "token"}, nil)
+
+	for _, verifier := range []JWKSVerifier{nil, testJWKSVerifier("https://internal.example.com/jwks")} {
+		specExt, err := NewEnvironmentSpecExt(&envSpec)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		specExt.SetJWKSVerifier(verifier)
+		req := NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
+		if got, want := req.IsAuthenticated(), verifier != nil; got != want {
+			t.Errorf("verifier %v: want: %t, got: %t", verifier, want, got)
+		}
+	}
+}
+
+func TestAnyJWTAuthenticationsConcurrently(t *testing.T) {
+	jwtAuth := func(name string) AuthenticationRequirement {
+		return AuthenticationRequirement{
+			Requirements: JWTAuthentication{
+				Name:       name,
+				JWKSSource: RemoteJWKS{URL: "url"},
+				In:         []APIOperationParameter{{Match: Header(name)}},
+			},
+		}
+	}
+	envSpec := EnvironmentSpec{
+		ID: "any-jwt",
+		APIs: []APISpec{{
+			ID:       "api",
+			BasePath: "/v1",
+			Authentication: AuthenticationRequirement{
+				Requirements: AnyAuthenticationRequirements{
+					jwtAuth("jwt1"),
+					jwtAuth("jwt2"),
+					jwtAuth("jwt3"),
+				},
+			},
+		}},
+	}
+	if err := ValidateEnvironmentSpecs([]EnvironmentSpec{envSpec}); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwtString, err := testutil.GenerateJWT(privateKey, map[string]interface{}{"key": "value"})
+	if err != nil {
+		t.Fatalf("generateJWT() failed: %v", err)
+	}
+
+	tests := []struct {
+		desc        string
+		parallelism int
+		headers     map[string]string
+		want        bool
+	}{
+		{"sequential", 0, map[string]string{"jwt3": jwtString}, true},
+		{"sequential, none valid", 1, map[string]string{"jwt1": "bad"}, false},
+		{"concurrent", 3, map[string]string{"jwt3": jwtString}, true},
+		{"concurrent, limited", 2, map[string]string{"jwt3": jwtString}, true},
+		{"concurrent, none valid", 3, map[string]string{"jwt1": "bad", "jwt2": "bad"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			specExt, err := NewEnvironmentSpecExt(&envSpec)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			specExt.SetJWTParallelism(test.parallelism)
+			envoyReq := testutil.NewEnvoyRequest(http.MethodGet, "/v1/petstore", test.headers, nil)
+			req := NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
+
+			if got := req.IsAuthenticated(); got != test.want {
+				t.Errorf("want: %t, got: %t", test.want, got)
+			}
+			if test.want {
+				if got := req.GetParamValue(APIOperationParameter{Match: JWTClaim{Requirement: "jwt3", Name: "key"}}); got != "value" {
+					t.Errorf("want: value, got: %s", got)
+				}
+			} else {
+				for _, name := range []string{"jwt1", "jwt2", "jwt3"} {
+					if r := req.jwtResults[name]; r == nil || r.err == nil {
+						t.Errorf("%s should have cached err", name)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAnyJWTAuthenticationsShortCircuit(t *testing.T) {
+	envSpec := EnvironmentSpec{
+		ID: "any-jwt",
+		APIs: []APISpec{{
+			ID:       "api",
+			BasePath: "/v1",
+			Authentication: AuthenticationRequirement{
+				Requirements: AnyAuthenticationRequirements{
+					{Requirements: JWTAuthentication{Name: "slow", JWKSSource: RemoteJWKS{URL: "url"},
+						In: []APIOperationParameter{{Match: Header("slow")}}}},
+					{Requirements: JWTAuthentication{Name: "fast", JWKSSource: RemoteJWKS{URL: "url"},
+						In: []APIOperationParameter{{Match: Header("fast")}}}},
+				},
+			},
+		}},
+	}
+	if err := ValidateEnvironmentSpecs([]EnvironmentSpec{envSpec}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	specExt, err := NewEnvironmentSpecExt(&envSpec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	specExt.SetJWTParallelism(2)
+
+	authMan := &blockingJWTAuthMan{release: make(chan struct{})}
+	defer close(authMan.release)
+	headers := map[string]string{"slow": "slow", "fast": "fast"}
+	envoyReq := testutil.NewEnvoyRequest(http.MethodGet, "/v1/petstore", headers, nil)
+	req := NewEnvironmentSpecRequest(authMan, specExt, envoyReq)
+
+	// fast succeeds without waiting on slow
+	if !req.IsAuthenticated() {
+		t.Errorf("IsAuthenticated should be true")
+	}
+	if r := req.jwtResults["fast"]; r == nil || r.err != nil {
+		t.Errorf("fast should have cached claims")
+	}
+	if r := req.jwtResults["slow"]; r != nil {
+		t.Errorf("slow should not have a result, got: %v", r)
+	}
+}
+
+// blockingJWTAuthMan accepts the "fast" JWT, other JWTs fail after release
+type blockingJWTAuthMan struct {
+	testAuthMan
+	release chan struct{}
+}
+
+func (a *blockingJWTAuthMan) ParseJWT(jwtString string, provider jwt.Provider) (map[string]interface{}, error) {
+	if jwtString == "fast" {
+		return map[string]interface{}{"key": "value"}, nil
+	}
+	<-a.release
+	return nil, fmt.Errorf("bad jwt")
+}
+
+func TestGetVerificationTimeouts(t *testing.T) {
+	tests := []struct {
+		desc       string
+		api        VerificationTimeouts
+		defaultTO  time.Duration
+		maxTO      time.Duration
+		wantAPIKey time.Duration
+		wantJWKS   time.Duration
+	}{
+		{"unset", VerificationTimeouts{}, 0, 0, 0, 0},
+		{"default", VerificationTimeouts{}, time.Second, 0, time.Second, time.Second},
+		{"api", VerificationTimeouts{JWKS: 2 * time.Second}, time.Second, 0, time.Second, 2 * time.Second},
+		{"max", VerificationTimeouts{JWKS: 5 * time.Second}, time.Second, 3 * time.Second, time.Second, 3 * time.Second},
+		{"max without default", VerificationTimeouts{APIKey: time.Second}, 0, 3 * time.Second, time.Second, 3 * time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			envSpec := EnvironmentSpec{
+				ID: "timeouts",
+				APIs: []APISpec{{
+					ID:                   "api",
+					BasePath:             "/v1",
+					VerificationTimeouts: test.api,
+				}},
+			}
+			specExt, err := NewEnvironmentSpecExt(&envSpec)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			specExt.SetVerificationTimeouts(test.defaultTO, test.maxTO)
+			envoyReq := testutil.NewEnvoyRequest(http.MethodGet, "/v1/petstore", nil, nil)
+			req := NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
+
+			got := req.GetVerificationTimeouts()
+			if got.APIKey != test.wantAPIKey {
+				t.Errorf("want: %s, got: %s", test.wantAPIKey, got.APIKey)
+			}
+			if got.JWKS != test.wantJWKS {
+				t.Errorf("want: %s, got: %s", test.wantJWKS, got.JWKS)
+			}
+		})
+	}
+
+	var nilReq *EnvironmentSpecRequest
+	if got := nilReq.GetVerificationTimeouts(); got != (VerificationTimeouts{}) {
+		t.Errorf("want zero timeouts, got: %v", got)
+	}
+}
+
+func TestParseJWTWithTimeout(t *testing.T) {
+	authMan := &blockingJWTAuthMan{release: make(chan struct{})}
+	defer close(authMan.release)
+
+	claims, err := parseJWTWithTimeout(authMan, "fast", jwt.Provider{}, time.Minute)
+	if err != nil || claims["key"] != "value" {
+		t.Errorf("want claims, got: %v, %v", claims, err)
+	}
+	if _, err := parseJWTWithTimeout(authMan, "slow", jwt.Provider{}, 10*time.Millisecond); err == nil {
+		t.Errorf("want timeout error")
+	}
+}
+
+func TestOAuthAuthentication(t *testing.T) {
+	envSpec := EnvironmentSpec{
+		ID: "oauth",
+		APIs: []APISpec{{
+			ID:       "api",
+			BasePath: "/v1",
+			Authentication: AuthenticationRequirement{
+				Requirements: OAuthAuthentication{
+					In: []APIOperationParameter{{
+						Match: Header("authorization"),
+						Transformation: StringTransformation{
+							Template:     "Bearer {token}",
+							Substitution: "{token}",
+						},
+					}},
+				},
+			},
+		}},
+	}
+	if err := ValidateEnvironmentSpecs([]EnvironmentSpec{envSpec}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	specExt, err := NewEnvironmentSpecExt(&envSpec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	verifier := &testAccessTokenAuthMan{
+		tokens: map[string]map[string]interface{}{
+			"good": {"client_id": "client"},
+		},
+	}
+
+	tests := []struct {
+		desc       string
+		authMan    auth.Manager
+		headers    map[string]string
+		want       bool
+		wantClaims map[string]interface{}
+	}{
+		{"no token", verifier, map[string]string{}, false, nil},
+		{"not bearer", verifier, map[string]string{"authorization": "good"}, false, nil},
+		{"good token", verifier, map[string]string{"authorization": "Bearer good"}, true, map[string]interface{}{"client_id": "client"}},
+		{"bad token", verifier, map[string]string{"authorization": "Bearer bad"}, false, nil},
+		{"unsupported", &testAuthMan{}, map[string]string{"authorization": "Bearer good"}, false, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			envoyReq := testutil.NewEnvoyRequest(http.MethodGet, "/v1/petstore", test.headers, nil)
+			req := NewEnvironmentSpecRequest(test.authMan, specExt, envoyReq)
+
+			if got := req.IsAuthenticated(); got != test.want {
+				t.Errorf("want: %t, got: %t", test.want, got)
+			}
+			if diff := cmp.Diff(test.wantClaims, req.GetOAuthClaims()); diff != "" {
+				t.Errorf("diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	// results are cached within a request
+	verifier.calls = 0
+	envoyReq := testutil.NewEnvoyRequest(http.MethodGet, "/v1/petstore", map[string]string{"authorization": "Bearer good"}, nil)
+	req := NewEnvironmentSpecRequest(verifier, specExt, envoyReq)
+	req.IsAuthenticated()
+	req.IsAuthenticated()
+	if verifier.calls != 1 {
+		t.Errorf("want: 1 verification, got: %d", verifier.calls)
+	}
+}
+
 func TestIsAuthorizationRequired(t *testing.T) {
 	envSpec := createGoodEnvSpec()
 	specExt, err := NewEnvironmentSpecExt(&envSpec)
@@ -535,6 +1037,116 @@ func TestGetAPIKey(t *testing.T) {
 	}
 }
 
+func TestGetAPIKeyQueryDuplicates(t *testing.T) {
+	tests := []struct {
+		desc       string
+		duplicates string
+		query      string
+		want       string
+	}{
+		{"single", "", "x-api-key=key1", "key1"},
+		{"encoded", "", "x-api-key=key%2B1+2", "key+1 2"},
+		{"encoded name", "", "x-api-%6Bey=key1", "key1"},
+		{"repeated rejected", "", "x-api-key=key1&x-api-key=key2", ""},
+		{"mixed encodings rejected", QueryDuplicatesReject, "x-api-key=key1&x%2Dapi-key=key2", ""},
+		{"invalid rejected", QueryDuplicatesReject, "x-api-key=key1&x-api-key=%zz", ""},
+		{"not utf-8 rejected", QueryDuplicatesReject, "x-api-key=%ff", ""},
+		{"first", QueryDuplicatesFirst, "x-api-key=key1&other=x&x-api-key=key2", "key1"},
+		{"last", QueryDuplicatesLast, "x-api-key=key1&other=x&x-api-key=key2", "key2"},
+		{"first valid", QueryDuplicatesFirst, "x-api-key=%zz&x-api-key=key2", "key2"},
+		{"empty value", QueryDuplicatesFirst, "x-api-key=&x-api-key=key2", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			envSpec := createGoodEnvSpec()
+			envSpec.APIs[0].ConsumerAuthorization = ConsumerAuthorization{
+				In:              []APIOperationParameter{{Match: Query("x-api-key")}},
+				QueryDuplicates: test.duplicates,
+			}
+			specExt, err := NewEnvironmentSpecExt(&envSpec)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			envoyReq := testutil.NewEnvoyRequest(http.MethodGet, "/v1/petstore?"+test.query, nil, nil)
+			req := NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
+			if got := req.GetAPIKey(); got != test.want {
+				t.Errorf("want: %q, got: %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestGetAPIKeyAlternatives(t *testing.T) {
+	envSpec := createGoodEnvSpec()
+	envSpec.APIs[0].ConsumerAuthorization = ConsumerAuthorization{
+		Alternatives: []ConsumerCredential{
+			{
+				Name:     "mtls",
+				Priority: 2,
+				In:       []APIOperationParameter{{Match: ClientCertificate{Field: ClientCertificatePrincipal}}},
+			},
+			{
+				Name: "apikey",
+				In: []APIOperationParameter{
+					{Match: Header("x-api-key")},
+					{Match: Query("x-api-key")},
+				},
+			},
+			{
+				Name: "bearer",
+				In: []APIOperationParameter{{
+					Match: Header("authorization"),
+					Transformation: StringTransformation{
+						Template:     "Bearer {value}",
+						Substitution: "{value}",
+					},
+				}},
+			},
+		},
+	}
+	specExt, err := NewEnvironmentSpecExt(&envSpec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	tests := []struct {
+		desc           string
+		path           string
+		headers        map[string]string
+		principal      string
+		wantKey        string
+		wantCredential string
+	}{
+		{"no key", "/v1/petstore", nil, "", "", ""},
+		{"key in header", "/v1/petstore", map[string]string{"x-api-key": "key"}, "", "key", "apikey"},
+		{"key in query", "/v1/petstore?x-api-key=key", map[string]string{}, "", "key", "apikey"},
+		{"key in bearer", "/v1/petstore", map[string]string{"authorization": "Bearer key"}, "", "key", "bearer"},
+		{"declaration order", "/v1/petstore", map[string]string{"authorization": "Bearer key2", "x-api-key": "key"}, "", "key", "apikey"},
+		{"client certificate", "/v1/petstore", nil, "spiffe://cluster/ns/sa", "spiffe://cluster/ns/sa", "mtls"},
+		{"priority", "/v1/petstore", map[string]string{"authorization": "Bearer key"}, "spiffe://cluster/ns/sa", "key", "bearer"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			envoyReq := testutil.NewEnvoyRequest(http.MethodGet, test.path, test.headers, nil)
+			if test.principal != "" {
+				envoyReq.Attributes.Source = &authv3.AttributeContext_Peer{Principal: test.principal}
+			}
+			req := NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
+			if !req.IsAuthorizationRequired() {
+				t.Errorf("IsAuthorizationRequired should be true")
+			}
+			if got := req.GetAPIKey(); test.wantKey != got {
+				t.Errorf("want: %q, got: %q", test.wantKey, got)
+			}
+			if got := req.GetConsumerCredential(); test.wantCredential != got {
+				t.Errorf("want: %q, got: %q", test.wantCredential, got)
+			}
+		})
+	}
+}
+
 func TestEnvSpecRequestJWTAuthentications(t *testing.T) {
 	tests := []struct {
 		desc   string
@@ -565,6 +1177,125 @@ func TestEnvSpecRequestJWTAuthentications(t *testing.T) {
 	}
 }
 
+func TestLabelsAndQuotaKey(t *testing.T) {
+	envSpec := &EnvironmentSpec{
+		ID: "good-env-config",
+		APIs: []APISpec{{
+			ID:           "apispec1",
+			Labels:       map[string]string{"tier": "silver", "team": "pets"},
+			QuotaKey:     "{labels.tier}",
+			QuotaBuckets: QuotaBucketsOperation,
+			Operations: []APIOperation{
+				{
+					Name:        "gold",
+					HTTPMatches: []HTTPMatch{{PathTemplate: "/gold"}},
+					Labels:      map[string]string{"tier": "gold"},
+				},
+				{
+					Name:         "keyed",
+					HTTPMatches:  []HTTPMatch{{PathTemplate: "/keyed/{id}"}},
+					QuotaKey:     "{labels.team}-{path.id}",
+					QuotaBuckets: QuotaBucketsMethod,
+				},
+			},
+		}},
+	}
+	specExt, err := NewEnvironmentSpecExt(envSpec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	tests := []struct {
+		desc             string
+		path             string
+		wantLabels       map[string]string
+		wantQuotaKey     string
+		wantQuotaBuckets string
+	}{
+		{"api labels", "/other", map[string]string{"tier": "silver", "team": "pets"}, "silver", QuotaBucketsOperation},
+		{"operation labels", "/gold", map[string]string{"tier": "gold", "team": "pets"}, "gold", QuotaBucketsOperation},
+		{"operation quota key", "/keyed/1", map[string]string{"tier": "silver", "team": "pets"}, "pets-1", QuotaBucketsMethod},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			envoyReq := testutil.NewEnvoyRequest(http.MethodGet, test.path, nil, nil)
+			req := NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
+			if diff := cmp.Diff(test.wantLabels, req.GetLabels()); diff != "" {
+				t.Errorf("diff (-want +got):\n%s", diff)
+			}
+			if got := req.GetQuotaKey(); test.wantQuotaKey != got {
+				t.Errorf("want: %q, got: %q", test.wantQuotaKey, got)
+			}
+			if got := req.GetQuotaBuckets(); test.wantQuotaBuckets != got {
+				t.Errorf("want quota buckets: %q, got: %q", test.wantQuotaBuckets, got)
+			}
+		})
+	}
+
+	var nilReq *EnvironmentSpecRequest
+	if got := nilReq.GetQuotaKey(); got != "" {
+		t.Errorf("want empty quota key, got: %q", got)
+	}
+	if got := nilReq.GetQuotaBuckets(); got != "" {
+		t.Errorf("want no quota buckets, got: %q", got)
+	}
+	if got := nilReq.GetLabels(); len(got) != 0 {
+		t.Errorf("want no labels, got: %v", got)
+	}
+}
+
+type testKVMLookup map[string]map[string]string
+
+func (l testKVMLookup) LookupKVM(mapName, key string) (string, bool) {
+	v, ok := l[mapName][key]
+	return v, ok
+}
+
+func TestKVMVariables(t *testing.T) {
+	envSpec := &EnvironmentSpec{
+		ID: "good-env-config",
+		APIs: []APISpec{{
+			ID:       "apispec1",
+			QuotaKey: "{kvm.settings.tier}-{kvm.settings.missing}",
+		}},
+	}
+	specExt, err := NewEnvironmentSpecExt(envSpec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	envoyReq := testutil.NewEnvoyRequest(http.MethodGet, "/", nil, nil)
+
+	// no lookup
+	req := NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
+	if got := req.GetQuotaKey(); got != "-" {
+		t.Errorf("want: %q, got: %q", "-", got)
+	}
+
+	specExt.SetKVMLookup(testKVMLookup{"settings": {"tier": "gold"}})
+	req = NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
+	if got := req.GetQuotaKey(); got != "gold-" {
+		t.Errorf("want: %q, got: %q", "gold-", got)
+	}
+
+	tests := []struct {
+		name   string
+		want   string
+		wantOK bool
+	}{
+		{"kvm.settings.tier", "gold", true},
+		{"kvm.settings.missing", "", false},
+		{"kvm.other.tier", "", false},
+		{"kvm.settings", "", false},
+	}
+	for _, test := range tests {
+		got, ok := req.variables.LookupValue(test.name)
+		if got != test.want || ok != test.wantOK {
+			t.Errorf("%s want: %q, %t, got: %q, %t", test.name, test.want, test.wantOK, got, ok)
+		}
+	}
+}
+
 func TestGetHTTPRequestTransforms(t *testing.T) {
 	envSpec := &EnvironmentSpec{
 		ID: "good-env-config",
@@ -620,6 +1351,49 @@ func TestGetHTTPRequestTransforms(t *testing.T) {
 	}
 }
 
+func TestGetPathParams(t *testing.T) {
+	tests := []struct {
+		desc     string
+		template string
+		path     string
+		want     map[string]string
+	}{
+		{"plain variable", "/seg1/{pathsegment}", "/seg1/value", map[string]string{"pathsegment": "value"}},
+		{"single segment", "/seg1/{pathsegment=*}", "/seg1/value", map[string]string{"pathsegment": "value"}},
+		{"multiple segments", "/seg1/{rest=**}", "/seg1/a/b", map[string]string{"rest": "a/b"}},
+		{"no variables", "/seg1", "/seg1", map[string]string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			envSpec := &EnvironmentSpec{
+				ID: "spec",
+				APIs: []APISpec{{
+					BasePath: "/",
+					ID:       "api",
+					Operations: []APIOperation{{
+						Name:        "op",
+						HTTPMatches: []HTTPMatch{{PathTemplate: test.template}},
+					}},
+				}},
+			}
+			specExt, err := NewEnvironmentSpecExt(envSpec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			envoyReq := testutil.NewEnvoyRequest(http.MethodGet, test.path, nil, nil)
+			envRequest := NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
+			if diff := cmp.Diff(test.want, envRequest.GetPathParams()); diff != "" {
+				t.Errorf("diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	var nilRequest *EnvironmentSpecRequest
+	if got := nilRequest.GetPathParams(); len(got) != 0 {
+		t.Errorf("want no params, got: %v", got)
+	}
+}
+
 func TestVariables(t *testing.T) {
 	envSpec := &EnvironmentSpec{
 		ID: "good-env-config",
@@ -635,13 +1409,13 @@ func TestVariables(t *testing.T) {
 			HTTPRequestTransforms: HTTPRequestTransforms{
 				HeaderTransforms: NameValueTransforms{
 					Add: []AddNameValue{
-						{"setheader", "new-{headers.setheader}", false},
+						{"setheader", "new-{headers.setheader}", false, "", ""},
 					},
 					Remove: []string{"removeheader"},
 				},
 				QueryTransforms: NameValueTransforms{
 					Add: []AddNameValue{
-						{"setquery", "new-{query.setquery}", false},
+						{"setquery", "new-{query.setquery}", false, "", ""},
 					},
 					Remove: []string{"removequery"},
 				},
@@ -717,6 +1491,103 @@ func TestVariables(t *testing.T) {
 	}
 }
 
+func TestMeetsCondition(t *testing.T) {
+	conditions := []struct {
+		condition string
+		want      bool
+	}{
+		{"", true},
+		{`headers.x-debug == "true"`, true},
+		{`headers.X-Debug == "true"`, true},
+		{`headers.x-debug == "true" && query.q == "x"`, false},
+		{`api.id == "apispec1" && operation.name == "op-1"`, true},
+		{`operation.name == "op-2"`, false},
+		{`path.missing || request.path == "/petstore"`, true},
+		{`jwt.foo.sub == "me"`, true},
+		{`jwt.foo.count == "3"`, true},
+		{`jwt.foo.missing`, false},
+		{`jwt.bar.sub`, false},
+	}
+
+	envSpec := createGoodEnvSpec()
+	for _, c := range conditions {
+		envSpec.APIs[0].HTTPRequestTransforms.HeaderTransforms.Add = append(
+			envSpec.APIs[0].HTTPRequestTransforms.HeaderTransforms.Add,
+			AddNameValue{Name: "x", Value: "x", Condition: c.condition})
+	}
+	specExt, err := NewEnvironmentSpecExt(&envSpec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwtString, err := testutil.GenerateJWT(privateKey, map[string]interface{}{"iss": "issuer", "sub": "me", "count": 3})
+	if err != nil {
+		t.Fatalf("generateJWT() failed: %v", err)
+	}
+	headers := map[string]string{
+		"jwt":     jwtString,
+		"x-debug": "true",
+	}
+	envoyReq := testutil.NewEnvoyRequest(http.MethodGet, "/v1/petstore", headers, nil)
+	specReq := NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
+
+	for _, test := range conditions {
+		t.Run(test.condition, func(t *testing.T) {
+			if got := specReq.MeetsCondition(test.condition); got != test.want {
+				t.Errorf("want: %t, got: %t", test.want, got)
+			}
+		})
+	}
+
+	if specReq.MeetsCondition(`headers.unknown == "condition"`) {
+		t.Errorf("unknown condition should not be met")
+	}
+
+	envSpec.APIs[0].HTTPRequestTransforms.HeaderTransforms.Add = []AddNameValue{
+		{Name: "x", Value: "x", Condition: `headers.x-debug ==`},
+	}
+	if _, err := NewEnvironmentSpecExt(&envSpec); err == nil {
+		t.Errorf("want error for invalid condition")
+	}
+}
+
+func TestQuotaKeyVariables(t *testing.T) {
+	envSpec := createGoodEnvSpec()
+	envSpec.APIs[0].QuotaKey = "{jwt.foo.sub}-{operation.name}"
+	specExt, err := NewEnvironmentSpecExt(&envSpec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwtString, err := testutil.GenerateJWT(privateKey, map[string]interface{}{"iss": "issuer", "sub": "me"})
+	if err != nil {
+		t.Fatalf("generateJWT() failed: %v", err)
+	}
+	envoyReq := testutil.NewEnvoyRequest(http.MethodGet, "/v1/petstore", map[string]string{"jwt": jwtString}, nil)
+	specReq := NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
+	if got := specReq.GetQuotaKey(); got != "me-op-1" {
+		t.Errorf("want: %q, got: %q", "me-op-1", got)
+	}
+
+	for _, quotaKey := range []string{"{headers.x-tenant}", "{query.tenant}", "{request.path}", "{tenant}"} {
+		t.Run(quotaKey, func(t *testing.T) {
+			envSpec := createGoodEnvSpec()
+			envSpec.APIs[0].Operations[0].QuotaKey = quotaKey
+			if _, err := NewEnvironmentSpecExt(&envSpec); err == nil {
+				t.Errorf("want error for client-controlled quota key")
+			}
+		})
+	}
+}
+
 func TestIsCors(t *testing.T) {
 	tests := []struct {
 		desc         string
@@ -845,3 +1716,17 @@ func (a *testAuthMan) Authenticate(ctx context.Context, apiKey string, claims ma
 func (a *testAuthMan) ParseJWT(jwtString string, provider jwt.Provider) (map[string]interface{}, error) {
 	return testutil.MockJWTVerifier{}.Parse(jwtString, provider)
 }
+
+type testAccessTokenAuthMan struct {
+	testAuthMan
+	tokens map[string]map[string]interface{}
+	calls  int
+}
+
+func (a *testAccessTokenAuthMan) VerifyAccessToken(token string) (map[string]interface{}, error) {
+	a.calls++
+	if claims, ok := a.tokens[token]; ok {
+		return claims, nil
+	}
+	return nil, fmt.Errorf("bad token")
+}
@@ -153,6 +153,34 @@ func TestValidateEnvironmentSpecs(t *testing.T) {
 			hasErr:  true,
 			wantErr: "operation \"op\" uses an invalid HTTP method \"foo\"",
 		},
+		{
+			desc: "bad consumer authorization query duplicates",
+			configs: []EnvironmentSpec{
+				{
+					ID: "spec",
+					APIs: []APISpec{{ID: "api", ConsumerAuthorization: ConsumerAuthorization{
+						In:              []APIOperationParameter{{Match: Query("key")}},
+						QueryDuplicates: "join",
+					}}},
+				},
+			},
+			hasErr:  true,
+			wantErr: "consumer authorization query_duplicates must be first, last, or reject, got \"join\"",
+		},
+		{
+			desc: "bad operation restricted method",
+			configs: []EnvironmentSpec{
+				{
+					ID: "spec",
+					APIs: []APISpec{{ID: "api", Operations: []APIOperation{{
+						Name:                   "op",
+						AllowRestrictedMethods: []string{"GET"},
+					}}}},
+				},
+			},
+			hasErr:  true,
+			wantErr: "operation \"op\" allow_restricted_methods must be CONNECT or TRACE, got \"GET\"",
+		},
 		{
 			desc: "duplicate jwt authentication requirement names",
 			configs: []EnvironmentSpec{
@@ -255,6 +283,23 @@ func TestValidateEnvironmentSpecs(t *testing.T) {
 			hasErr:  true,
 			wantErr: "query in API operation parameter match must be non-empty",
 		},
+		{
+			desc: "empty cookie name",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID: "api",
+					Authentication: AuthenticationRequirement{
+						Requirements: JWTAuthentication{
+							Name: "jwt",
+							In:   []APIOperationParameter{{Match: Cookie{StripPrefix: "Bearer "}}},
+						},
+					},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: "cookie name in API operation parameter match must be non-empty",
+		},
 		{
 			desc: "empty jwt claim name",
 			configs: []EnvironmentSpec{
@@ -312,6 +357,537 @@ func TestValidateEnvironmentSpecs(t *testing.T) {
 			hasErr:  true,
 			wantErr: "JWT claim requirement \"no-such-thing\" does not exist",
 		},
+		{
+			desc: "empty OAuth authentication locations",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID: "api",
+					Authentication: AuthenticationRequirement{
+						Requirements: OAuthAuthentication{},
+					},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: "OAuth authentication requirement locations must be non-empty",
+		},
+		{
+			desc: "empty label name",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID: "api",
+					Operations: []APIOperation{{
+						Name:   "op",
+						Labels: map[string]string{"": "gold"},
+					}},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: "label names must be non-empty",
+		},
+		{
+			desc: "negative verification timeout",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID:                   "api",
+					VerificationTimeouts: VerificationTimeouts{JWKS: -time.Second},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `API "api" verification timeouts must not be negative`,
+		},
+		{
+			desc: "unknown dpop mode",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID:   "api",
+					DPoP: DPoP{Mode: "always"},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `API "api" dpop mode must be one of optional or required, got "always"`,
+		},
+		{
+			desc: "negative dpop max age",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID:   "api",
+					DPoP: DPoP{Mode: DPoPModeRequired, MaxAge: -time.Second},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `API "api" dpop max_age must not be negative`,
+		},
+		{
+			desc: "negative concurrency max requests",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID:          "api",
+					Concurrency: ConcurrencyLimit{MaxRequests: -1},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `API "api" concurrency max_requests must not be negative`,
+		},
+		{
+			desc: "bad concurrency deny status",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID:          "api",
+					Concurrency: ConcurrencyLimit{MaxRequests: 10, DenyStatus: 500},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `API "api" concurrency deny_status must be 429 or 503, got 500`,
+		},
+		{
+			desc: "negative concurrency timeout",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID:          "api",
+					Concurrency: ConcurrencyLimit{MaxRequests: 10, Timeout: -time.Second},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `API "api" concurrency timeout must not be negative`,
+		},
+		{
+			desc: "unknown quota buckets",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID: "api",
+					Operations: []APIOperation{{
+						Name:         "op",
+						QuotaBuckets: "resource",
+					}},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `operation "op" quota_buckets must be one of method or operation, got "resource"`,
+		},
+		{
+			desc: "empty consumer access entry",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID:             "api",
+					ConsumerAccess: ConsumerAccess{Block: ConsumerList{DeveloperEmails: []string{""}}},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `API "api" consumer_access block entries must be non-empty`,
+		},
+		{
+			desc: "zero header capture sample",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID: "api",
+					Operations: []APIOperation{{
+						Name:          "op",
+						HeaderCapture: &HeaderCapture{},
+					}},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `operation "op" header_capture sample_percent must be greater than 0 and up to 100`,
+		},
+		{
+			desc: "replay protection without nonce header",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID: "api",
+					Operations: []APIOperation{{
+						Name:             "op",
+						ReplayProtection: &ReplayProtection{TimestampHeader: "x-timestamp"},
+					}},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `operation "op" replay_protection nonce_header must be non-empty`,
+		},
+		{
+			desc: "replay protection negative window",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID: "api",
+					Operations: []APIOperation{{
+						Name:             "op",
+						ReplayProtection: &ReplayProtection{NonceHeader: "x-nonce", Window: -time.Second},
+					}},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `operation "op" replay_protection window must not be negative`,
+		},
+		{
+			desc: "header capture sample over 100",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID: "api",
+					Operations: []APIOperation{{
+						Name:          "op",
+						HeaderCapture: &HeaderCapture{SamplePercent: 101},
+					}},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `operation "op" header_capture sample_percent must be greater than 0 and up to 100`,
+		},
+		{
+			desc: "bot rule without signals",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID:       "api",
+					BotRules: []BotRule{{Name: "rule"}},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `bot rule "rule" must have user_agents, missing_headers, or ip_reputation`,
+		},
+		{
+			desc: "bad bot rule action",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID: "api",
+					Operations: []APIOperation{{
+						Name:     "op",
+						BotRules: []BotRule{{Name: "rule", IPReputation: true, Action: "block"}},
+					}},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `bot rule "rule" action must be tag or deny`,
+		},
+		{
+			desc: "duplicate bot rule names",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID: "api",
+					BotRules: []BotRule{
+						{Name: "rule", IPReputation: true},
+						{Name: "rule", MissingHeaders: []string{"accept"}},
+					},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: "bot rule names within each API or operation must be unique, got multiple rule",
+		},
+		{
+			desc: "transform unbound path variable",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID: "api",
+					HTTPRequestTransforms: HTTPRequestTransforms{
+						PathTransform: "/v2/{path.id}",
+					},
+					Operations: []APIOperation{
+						{Name: "bound", HTTPMatches: []HTTPMatch{{PathTemplate: "/pets/{id}"}}},
+						{Name: "unbound", HTTPMatches: []HTTPMatch{{PathTemplate: "/pets/{id}"}, {PathTemplate: "/pets"}}},
+					},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `API "api" path transform references {path.id}: not a path template variable of operation "unbound"`,
+		},
+		{
+			desc: "transform bound path variable of operation",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID:     "api",
+					Labels: map[string]string{"tier": "gold"},
+					Operations: []APIOperation{{
+						Name:        "op",
+						HTTPMatches: []HTTPMatch{{PathTemplate: "/pets/{id=*}"}},
+						Labels:      map[string]string{"team": "pets"},
+						HTTPRequestTransforms: HTTPRequestTransforms{
+							PathTransform: "/v2/{path.id}?{request.querystring}",
+							HeaderTransforms: NameValueTransforms{
+								Add: []AddNameValue{{
+									Name:      "x-owner",
+									Value:     "{labels.tier}-{labels.team}-{kvm.owners.pets}",
+									Condition: `operation.name == "op" && headers.x-debug`,
+								}},
+							},
+						},
+					}},
+				}},
+			}},
+			hasErr: false,
+		},
+		{
+			desc: "transform unknown namespace",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID: "api",
+					HTTPRequestTransforms: HTTPRequestTransforms{
+						HeaderTransforms: NameValueTransforms{
+							Add: []AddNameValue{{Name: "x-id", Value: "{header.id}"}},
+						},
+					},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `API "api" header transform "x-id" references {header.id}: unknown namespace "header"`,
+		},
+		{
+			desc: "transform undeclared label",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID: "api",
+					HTTPRequestTransforms: HTTPRequestTransforms{
+						QueryTransforms: NameValueTransforms{
+							Add: []AddNameValue{{Name: "tier", Value: "{labels.tier}"}},
+						},
+					},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `API "api" query transform "tier" references {labels.tier}: not a label of the API or operation "default"`,
+		},
+		{
+			desc: "transform jwt outside condition",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID: "api",
+					HTTPRequestTransforms: HTTPRequestTransforms{
+						HeaderTransforms: NameValueTransforms{
+							Add: []AddNameValue{{Name: "x-sub", Value: "{jwt.foo.sub}"}},
+						},
+					},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `API "api" header transform "x-sub" references {jwt.foo.sub}: jwt variables are only available to conditions`,
+		},
+		{
+			desc: "transform condition undeclared requirement",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID: "api",
+					HTTPRequestTransforms: HTTPRequestTransforms{
+						HeaderTransforms: NameValueTransforms{
+							Add: []AddNameValue{{Name: "x-admin", Value: "true", Condition: `jwt.foo.role == "admin"`}},
+						},
+					},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `API "api" header transform "x-admin" condition references jwt.foo.role: JWT requirement "foo" does not exist for operation "default"`,
+		},
+		{
+			desc: "transform bad request variable",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID: "api",
+					HTTPRequestTransforms: HTTPRequestTransforms{
+						PathTransform: "{request.method}",
+					},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `API "api" path transform references {request.method}: request variables are path and querystring`,
+		},
+		{
+			desc: "bad cors origin regex",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID:   "api",
+					Cors: CorsPolicy{AllowOriginsRegexes: []string{"("}},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: "API \"api\" cors allow_origins_regexes \"(\": error parsing regexp: missing closing ): `(`",
+		},
+		{
+			desc: "negative cors max age",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID:   "api",
+					Cors: CorsPolicy{AllowOrigins: []string{"*"}, MaxAge: -1},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `API "api" cors max_age must not be negative`,
+		},
+		{
+			desc: "empty environment spec gateway scope cluster",
+			configs: []EnvironmentSpec{{
+				ID:           "spec",
+				GatewayScope: GatewayScope{Clusters: []string{""}},
+			}},
+			hasErr:  true,
+			wantErr: `environment spec "spec" gateway_scope node_ids and clusters must be non-empty`,
+		},
+		{
+			desc: "empty API gateway scope node",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID:           "api",
+					GatewayScope: GatewayScope{NodeIDs: []string{"node-1", ""}},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `API "api" gateway_scope node_ids and clusters must be non-empty`,
+		},
+		{
+			desc: "quota exemption without signals",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID:              "api",
+					QuotaExemptions: []QuotaExemption{{Name: "checker"}},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `quota exemption "checker" must have apps, claims, or ip_ranges`,
+		},
+		{
+			desc: "duplicate quota exemption names",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID: "api",
+					QuotaExemptions: []QuotaExemption{
+						{Name: "checker", Apps: []string{"a"}},
+						{Name: "checker", Apps: []string{"b"}},
+					},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: "quota exemption names within each API or operation must be unique, got multiple checker",
+		},
+		{
+			desc: "bad quota exemption ip range",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID: "api",
+					Operations: []APIOperation{{
+						Name:            "op",
+						QuotaExemptions: []QuotaExemption{{Name: "checker", IPRanges: []string{"10.0.0.1"}}},
+					}},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `quota exemption "checker" ip_ranges must be CIDRs, got "10.0.0.1"`,
+		},
+		{
+			desc: "quota exemption claim of unknown requirement",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID: "api",
+					QuotaExemptions: []QuotaExemption{{
+						Name:   "partner",
+						Claims: []ExemptClaim{{Requirement: "missing", Name: "sub", Values: []string{"p"}}},
+					}},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `quota exemption "partner" claim requirement "missing" does not exist`,
+		},
+		{
+			desc: "consumer authorization in and alternatives",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID: "api",
+					ConsumerAuthorization: ConsumerAuthorization{
+						In:           []APIOperationParameter{{Match: Header("x-api-key")}},
+						Alternatives: []ConsumerCredential{{Name: "apikey", In: []APIOperationParameter{{Match: Query("key")}}}},
+					},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: "consumer authorization in and alternatives must not both be set",
+		},
+		{
+			desc: "empty consumer authorization alternative name",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID: "api",
+					ConsumerAuthorization: ConsumerAuthorization{
+						Alternatives: []ConsumerCredential{{In: []APIOperationParameter{{Match: Query("key")}}}},
+					},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: "consumer authorization alternative names must be non-empty",
+		},
+		{
+			desc: "duplicate consumer authorization alternative names",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID: "api",
+					ConsumerAuthorization: ConsumerAuthorization{
+						Alternatives: []ConsumerCredential{
+							{Name: "apikey", In: []APIOperationParameter{{Match: Query("key")}}},
+							{Name: "apikey", In: []APIOperationParameter{{Match: Header("x-api-key")}}},
+						},
+					},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: "consumer authorization alternative names must be unique, got multiple apikey",
+		},
+		{
+			desc: "empty consumer authorization alternative locations",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID: "api",
+					Operations: []APIOperation{{
+						Name: "op",
+						ConsumerAuthorization: ConsumerAuthorization{
+							Alternatives: []ConsumerCredential{{Name: "mtls"}},
+						},
+					}},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `consumer authorization alternative "mtls" locations must be non-empty`,
+		},
+		{
+			desc: "unsupported client certificate field",
+			configs: []EnvironmentSpec{{
+				ID: "spec",
+				APIs: []APISpec{{
+					ID: "api",
+					ConsumerAuthorization: ConsumerAuthorization{
+						Alternatives: []ConsumerCredential{{Name: "mtls", In: []APIOperationParameter{{Match: ClientCertificate{Field: "serial"}}}}},
+					},
+				}},
+			}},
+			hasErr:  true,
+			wantErr: `client certificate field in API operation parameter match must be one of principal, fingerprint, san or subject, got "serial"`,
+		},
 	}
 
 	for _, test := range tests {
@@ -342,6 +918,20 @@ func TestMarshalAndUnmarshalAuthenticationRequirement(t *testing.T) {
 				},
 			},
 		},
+		{
+			desc: "valid oauth",
+			want: &AuthenticationRequirement{
+				Requirements: OAuthAuthentication{
+					In: []APIOperationParameter{{
+						Match: Header("authorization"),
+						Transformation: StringTransformation{
+							Template:     "Bearer {token}",
+							Substitution: "{token}",
+						},
+					}},
+				},
+			},
+		},
 		{
 			desc: "valid any enclosing jwt",
 			want: &AuthenticationRequirement{
@@ -477,7 +1067,7 @@ jwt:
     url: url2
     cache_duration: 1h
 `),
-			wantErr: "precisely one of jwt, any or all should be set",
+			wantErr: "precisely one of jwt, oauth, any or all should be set",
 		},
 		{
 			desc: "all and jwt coexist",
@@ -500,7 +1090,7 @@ jwt:
     url: url2
     cache_duration: 1h
 `),
-			wantErr: "precisely one of jwt, any or all should be set",
+			wantErr: "precisely one of jwt, oauth, any or all should be set",
 		},
 		{
 			desc: "all and any coexist",
@@ -524,7 +1114,7 @@ any:
       url: url1
       cache_duration: 1h
 `),
-			wantErr: "precisely one of jwt, any or all should be set",
+			wantErr: "precisely one of jwt, oauth, any or all should be set",
 		},
 		{
 			desc: "disabled:true should eliminate validation err",
@@ -579,6 +1169,39 @@ func TestMarshalAndUnmarshalJWTAuthentication(t *testing.T) {
 				JWKSSource: RemoteJWKS{URL: "url", CacheDuration: time.Hour},
 			},
 		},
+		{
+			desc: "valid oidc_discovery",
+			want: &JWTAuthentication{
+				Name:       "foo",
+				Issuer:     "https://issuer.example.com",
+				In:         []APIOperationParameter{{Match: Header("header")}},
+				JWKSSource: OIDCDiscovery{URL: "https://issuer.example.com", CacheDuration: time.Hour},
+			},
+		},
+		{
+			desc: "remote_jwks with tls",
+			want: &JWTAuthentication{
+				Name:   "foo",
+				Issuer: "bar",
+				In:     []APIOperationParameter{{Match: Header("header")}},
+				JWKSSource: RemoteJWKS{URL: "url", TLS: &JWKSTLS{
+					CAFile:   "ca.pem",
+					CertFile: "cert.pem",
+					KeyFile:  "key.pem",
+					SPKIPins: []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="},
+				}},
+			},
+		},
+		{
+			desc: "certificate_binding",
+			want: &JWTAuthentication{
+				Name:               "foo",
+				Issuer:             "bar",
+				In:                 []APIOperationParameter{{Match: Header("header")}},
+				JWKSSource:         RemoteJWKS{URL: "url"},
+				CertificateBinding: CertificateBindingRequired,
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -636,6 +1259,55 @@ in:
 - header: header
 `),
 		},
+		{
+			desc: "remote_jwks and oidc_discovery",
+			data: []byte(`
+name: foo
+remote_jwks:
+  url: url
+oidc_discovery:
+  url: https://issuer.example.com
+in:
+- header: header
+`),
+			wantErr: "precisely one of remote_jwks or oidc_discovery should be set",
+		},
+		{
+			desc: "relative oidc_discovery url",
+			data: []byte(`
+name: foo
+oidc_discovery:
+  url: issuer.example.com
+in:
+- header: header
+`),
+			wantErr: `oidc_discovery url must be absolute, got "issuer.example.com"`,
+		},
+		{
+			desc: "remote_jwks tls cert without key",
+			data: []byte(`
+name: foo
+remote_jwks:
+  url: url
+  tls:
+    cert_file: cert.pem
+in:
+- header: header
+`),
+			wantErr: "remote_jwks tls cert_file and key_file must be set together",
+		},
+		{
+			desc: "bad certificate_binding",
+			data: []byte(`
+name: foo
+remote_jwks:
+  url: url
+certificate_binding: always
+in:
+- header: header
+`),
+			wantErr: `certificate_binding must be one of optional or required, got "always"`,
+		},
 	}
 
 	for _, test := range tests {
@@ -684,10 +1356,18 @@ func TestMarshalAndUnmarshalAPIOperationParameter(t *testing.T) {
 			desc: "valid API operation parameter with query",
 			want: &APIOperationParameter{Match: Query("query")},
 		},
+		{
+			desc: "valid API operation parameter with cookie",
+			want: &APIOperationParameter{Match: Cookie{Name: "token", StripPrefix: "Bearer "}},
+		},
 		{
 			desc: "valid API operation parameter with jwt claim",
 			want: &APIOperationParameter{Match: JWTClaim{Requirement: "foo", Name: "bar"}},
 		},
+		{
+			desc: "valid API operation parameter with client certificate",
+			want: &APIOperationParameter{Match: ClientCertificate{Field: ClientCertificateSAN, AppAttribute: "spiffe_id"}},
+		},
 		{
 			desc: "valid API operation parameter with jwt claim and transformation",
 			want: &APIOperationParameter{
@@ -741,7 +1421,7 @@ jwt_claim:
   name: bar
 header: header
 `),
-			wantErr: "precisely one header, query or jwt_claim should be set, got 2",
+			wantErr: "precisely one header, query, cookie, jwt_claim or client_certificate should be set, got 2",
 		},
 		{
 			desc: "jwt claim and query coexist",
@@ -751,7 +1431,7 @@ jwt_claim:
   name: bar
 query: query
 `),
-			wantErr: "precisely one header, query or jwt_claim should be set, got 2",
+			wantErr: "precisely one header, query, cookie, jwt_claim or client_certificate should be set, got 2",
 		},
 		{
 			desc: "header and query coexist",
@@ -759,7 +1439,7 @@ query: query
 header: header
 query: query
 `),
-			wantErr: "precisely one header, query or jwt_claim should be set, got 2",
+			wantErr: "precisely one header, query, cookie, jwt_claim or client_certificate should be set, got 2",
 		},
 	}
 
@@ -797,6 +1477,9 @@ func TestAuthenticationRequirementTypes(t *testing.T) {
 	j := JWTAuthentication{}
 	j.authenticationRequirements()
 
+	o := OAuthAuthentication{}
+	o.authenticationRequirements()
+
 	any := AnyAuthenticationRequirements{}
 	any.authenticationRequirements()
 
@@ -843,6 +1526,12 @@ func TestParamMatchTypes(t *testing.T) {
 
 	j := JWTClaim{}
 	j.paramMatch()
+
+	c := ClientCertificate{}
+	c.paramMatch()
+
+	k := Cookie{}
+	k.paramMatch()
 }
 
 func createGoodEnvSpec() EnvironmentSpec {
@@ -942,7 +1631,7 @@ func createGoodEnvSpec() EnvironmentSpec {
 							{Name: "x-apigee-target", Value: "target"},
 						},
 					},
-					PathTransform: "/target_prefix/{path}",
+					PathTransform: "/target_prefix/{request.path}",
 				},
 				Cors: CorsPolicy{
 					AllowOrigins: []string{"*"},
@@ -1071,3 +1760,15 @@ func createGoodEnvSpec() EnvironmentSpec {
 	_ = ValidateEnvironmentSpecs(envSpecs)
 	return envSpecs[0]
 }
+
+func TestOIDCDiscoveryURLs(t *testing.T) {
+	for _, url := range []string{
+		"https://issuer.example.com",
+		"https://issuer.example.com/",
+		"https://issuer.example.com/.well-known/openid-configuration",
+	} {
+		o := OIDCDiscovery{URL: url}
+		equal(t, o.Issuer(), "https://issuer.example.com")
+		equal(t, o.ConfigurationURL(), "https://issuer.example.com/.well-known/openid-configuration")
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "fmt"
+
+// EnvironmentSpecValidation is the validation result of a candidate
+// EnvironmentSpec.
+type EnvironmentSpecValidation struct {
+	ID    string `json:"id"`
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+}
+
+// ValidateCandidateEnvironmentSpecs validates each of the specs as
+// ValidateEnvironmentSpecs and compiles it as NewEnvironmentSpecExt, without
+// applying it. Results are in the order of the specs.
+func ValidateCandidateEnvironmentSpecs(specs []EnvironmentSpec, opts ...EnvironmentSpecOption) []EnvironmentSpecValidation {
+	results := make([]EnvironmentSpecValidation, len(specs))
+	ids := make(map[string]bool, len(specs))
+	for i := range specs {
+		spec := specs[i]
+		results[i] = EnvironmentSpecValidation{ID: spec.ID}
+		err := ValidateEnvironmentSpecs([]EnvironmentSpec{spec})
+		if err == nil && ids[spec.ID] {
+			err = fmt.Errorf("environment spec IDs must be unique, got multiple %s", spec.ID)
+		}
+		ids[spec.ID] = true
+		if err == nil {
+			_, err = NewEnvironmentSpecExt(&spec, opts...)
+		}
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		results[i].Valid = true
+	}
+	return results
+}
@@ -0,0 +1,60 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestValidateCandidateEnvironmentSpecs(t *testing.T) {
+	good := createGoodEnvSpec()
+
+	badTemplate := createGoodEnvSpec()
+	badTemplate.ID = "bad-template"
+	badTemplate.APIs[0].HTTPRequestTransforms.PathTransform = "{unclosed"
+
+	missingEnv := createGoodEnvSpec()
+	missingEnv.ID = "missing-env"
+	missingEnv.APIs[0].HTTPRequestTransforms.PathTransform = "/{env.APIGEE_TEST_MISSING}"
+
+	specs := []EnvironmentSpec{
+		good,
+		{ID: ""},
+		good,
+		badTemplate,
+		missingEnv,
+	}
+	got := ValidateCandidateEnvironmentSpecs(specs, WithEnvironmentVariables([]string{"APIGEE_TEST_MISSING"}))
+	want := []EnvironmentSpecValidation{
+		{ID: good.ID, Valid: true},
+		{Error: "environment spec IDs must be non-empty"},
+		{ID: good.ID, Error: "environment spec IDs must be unique, got multiple " + good.ID},
+		{ID: "bad-template"},
+		{ID: "missing-env", Error: "template variable {env.APIGEE_TEST_MISSING} unavailable, environment variable APIGEE_TEST_MISSING is not set"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("want %d results, got %d", len(want), len(got))
+	}
+	// the parse error of the template is not ours to assert
+	if got[3].Valid || got[3].Error == "" {
+		t.Errorf("want bad-template invalid, got %#v", got[3])
+	}
+	got[3].Error = ""
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/errorset"
+)
+
+// EnvoyStats aggregates the stats Envoy streams to the service's metrics
+// service as upstream health metrics of APIs, labeled like the authorization
+// metrics. Envoy must have a stats sink to the service with cumulative
+// counters, for example:
+//
+//	stats_sinks:
+//	- name: envoy.stat_sinks.metrics_service
+//	  typed_config:
+//	    "@type": type.googleapis.com/envoy.config.metrics.v3.MetricsServiceConfig
+//	    transport_api_version: V3
+//	    grpc_service:
+//	      envoy_grpc:
+//	        cluster_name: apigee-remote-service-envoy
+type EnvoyStats struct {
+	// Clusters maps the names of the Envoy upstream clusters to the IDs of
+	// the APIs they serve. Stats of other clusters are ignored.
+	Clusters map[string]string `yaml:"clusters,omitempty" mapstructure:"clusters,omitempty"`
+}
+
+func (s EnvoyStats) validate() error {
+	var errs error
+	for cluster, api := range s.Clusters {
+		if cluster == "" || api == "" {
+			errs = errorset.Append(errs, fmt.Errorf("envoy_stats.clusters must map non-empty clusters to non-empty APIs, got %q: %q", cluster, api))
+		}
+	}
+	return errs
+}
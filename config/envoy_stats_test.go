@@ -0,0 +1,43 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "testing"
+
+func TestEnvoyStatsValidate(t *testing.T) {
+	tests := []struct {
+		desc    string
+		stats   EnvoyStats
+		wantErr bool
+	}{
+		{"none", EnvoyStats{}, false},
+		{"clusters", EnvoyStats{Clusters: map[string]string{"petstore": "pets", "orders-v2": "orders"}}, false},
+		{"empty cluster", EnvoyStats{Clusters: map[string]string{"": "pets"}}, true},
+		{"empty api", EnvoyStats{Clusters: map[string]string{"petstore": ""}}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			c := Default()
+			c.Tenant.RemoteServiceAPI = "https://runtime/remote-service"
+			c.Tenant.OrgName = "org"
+			c.Tenant.EnvName = "env"
+			c.EnvoyStats = test.stats
+			err := c.Validate(false)
+			if (err != nil) != test.wantErr {
+				t.Errorf("want error %t, got %v", test.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/errorset"
+)
+
+// Feature flags of the behaviors staged with FeatureFlags. A behavior is
+// disabled unless enabled by its flag.
+const (
+	// FeatureAnalyticsOperation records the matched operation of a request
+	// as the "operation" analytics attribute.
+	FeatureAnalyticsOperation = "analytics_operation"
+)
+
+// knownFeatureFlags are the flags that may be configured
+var knownFeatureFlags = map[string]bool{
+	FeatureAnalyticsOperation: true,
+}
+
+// KnownFeatureFlag returns true if name is a feature flag.
+func KnownFeatureFlag(name string) bool {
+	return knownFeatureFlags[name]
+}
+
+// FeatureFlags enables new behaviors for a percentage of requests, so a
+// change can be staged API by API across a fleet. Flags are by name, the
+// percentages may be overridden at runtime with the admin API.
+type FeatureFlags map[string]FeatureFlag
+
+// FeatureFlag enables a behavior for a percentage of the requests of each
+// API. Requests are selected by a hash of their Envoy request ID, so the
+// decisions for a request agree across its check and access log.
+type FeatureFlag struct {
+	// Percentage of the requests, 0 to 100, of the APIs not in APIs.
+	Percentage float64 `yaml:"percentage,omitempty" mapstructure:"percentage,omitempty"`
+
+	// APIs overrides the Percentage by API name.
+	APIs map[string]float64 `yaml:"apis,omitempty" mapstructure:"apis,omitempty"`
+}
+
+// PercentageOf returns the percentage of the requests of api enabled.
+func (f FeatureFlag) PercentageOf(api string) float64 {
+	if p, ok := f.APIs[api]; ok {
+		return p
+	}
+	return f.Percentage
+}
+
+// ValidFeaturePercentage returns an error if p is not 0 to 100.
+func ValidFeaturePercentage(p float64) error {
+	if p < 0 || p > 100 {
+		return fmt.Errorf("percentage must be 0 to 100, got %v", p)
+	}
+	return nil
+}
+
+func (f FeatureFlags) validate() error {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs error
+	for _, name := range names {
+		if !knownFeatureFlags[name] {
+			errs = errorset.Append(errs, fmt.Errorf("feature_flags has unknown flag %q", name))
+			continue
+		}
+		flag := f[name]
+		if err := ValidFeaturePercentage(flag.Percentage); err != nil {
+			errs = errorset.Append(errs, fmt.Errorf("feature_flags.%s.%v", name, err))
+		}
+		apis := make([]string, 0, len(flag.APIs))
+		for api := range flag.APIs {
+			apis = append(apis, api)
+		}
+		sort.Strings(apis)
+		for _, api := range apis {
+			if err := ValidFeaturePercentage(flag.APIs[api]); err != nil {
+				errs = errorset.Append(errs, fmt.Errorf("feature_flags.%s.apis.%s %v", name, api, err))
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "fmt"
+
+// GatewayScope restricts an EnvironmentSpec or APISpec to the requests of
+// specific Envoy nodes or clusters so an adapter shared by gateway tiers does
+// not apply the policies of one tier to another. Envoy identifies itself by
+// the apigee_envoy_node and apigee_envoy_cluster context extensions of the
+// ext_authz filter, typically set per listener. An empty scope includes all
+// requests, a scope excludes requests that don't identify themselves.
+type GatewayScope struct {
+	// NodeIDs of the Envoy nodes in scope. All nodes if empty.
+	NodeIDs []string `yaml:"node_ids,omitempty" mapstructure:"node_ids,omitempty"`
+
+	// Clusters of the Envoy nodes in scope. All clusters if empty.
+	Clusters []string `yaml:"clusters,omitempty" mapstructure:"clusters,omitempty"`
+}
+
+// Includes returns true if the node of the cluster is in scope.
+func (s GatewayScope) Includes(node, cluster string) bool {
+	return scopeIncludes(s.NodeIDs, node) && scopeIncludes(s.Clusters, cluster)
+}
+
+func scopeIncludes(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the node IDs and clusters are non-empty
+func (s GatewayScope) validate(field string) error {
+	for _, v := range append(append([]string{}, s.NodeIDs...), s.Clusters...) {
+		if v == "" {
+			return fmt.Errorf("%s gateway_scope node_ids and clusters must be non-empty", field)
+		}
+	}
+	return nil
+}
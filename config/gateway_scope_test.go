@@ -0,0 +1,44 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "testing"
+
+func TestGatewayScopeIncludes(t *testing.T) {
+	tests := []struct {
+		desc    string
+		scope   GatewayScope
+		node    string
+		cluster string
+		want    bool
+	}{
+		{"empty scope", GatewayScope{}, "", "", true},
+		{"empty scope any node", GatewayScope{}, "node-1", "edge", true},
+		{"node in scope", GatewayScope{NodeIDs: []string{"node-1", "node-2"}}, "node-2", "edge", true},
+		{"node out of scope", GatewayScope{NodeIDs: []string{"node-1"}}, "node-2", "edge", false},
+		{"cluster in scope", GatewayScope{Clusters: []string{"edge"}}, "node-1", "edge", true},
+		{"cluster out of scope", GatewayScope{Clusters: []string{"edge"}}, "node-1", "internal", false},
+		{"unidentified", GatewayScope{Clusters: []string{"edge"}}, "", "", false},
+		{"node and cluster", GatewayScope{NodeIDs: []string{"node-1"}, Clusters: []string{"edge"}}, "node-1", "edge", true},
+		{"node without cluster", GatewayScope{NodeIDs: []string{"node-1"}, Clusters: []string{"edge"}}, "node-1", "internal", false},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			if got := test.scope.Includes(test.node, test.cluster); got != test.want {
+				t.Errorf("want: %t, got: %t", test.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "fmt"
+
+// HeaderLimits protect the target of an operation that fails on oversized
+// request headers. A request exceeding a limit is denied with status 431
+// before authentication. Pseudo-headers, such as :path, are not limited.
+// Zero disables a limit.
+type HeaderLimits struct {
+	// MaxHeaders is the maximum number of request headers.
+	MaxHeaders int `yaml:"max_headers,omitempty" mapstructure:"max_headers,omitempty"`
+
+	// MaxHeaderBytes is the maximum size of the name and value of any request header.
+	MaxHeaderBytes int `yaml:"max_header_bytes,omitempty" mapstructure:"max_header_bytes,omitempty"`
+
+	// MaxCookieBytes is the maximum size of the cookie header value.
+	MaxCookieBytes int `yaml:"max_cookie_bytes,omitempty" mapstructure:"max_cookie_bytes,omitempty"`
+}
+
+// validateHeaderLimits checks the limits are not negative
+func validateHeaderLimits(op string, l *HeaderLimits) error {
+	if l != nil && (l.MaxHeaders < 0 || l.MaxHeaderBytes < 0 || l.MaxCookieBytes < 0) {
+		return fmt.Errorf("operation %q header_limits must not be negative", op)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "testing"
+
+func TestValidateHeaderLimits(t *testing.T) {
+	spec := EnvironmentSpec{
+		ID: "spec",
+		APIs: []APISpec{{
+			ID:       "api",
+			BasePath: "/v1",
+			Operations: []APIOperation{{
+				Name:         "op",
+				HTTPMatches:  []HTTPMatch{{PathTemplate: "/"}},
+				HeaderLimits: &HeaderLimits{MaxHeaders: 10, MaxHeaderBytes: 1024, MaxCookieBytes: 512},
+			}},
+		}},
+	}
+	if err := ValidateEnvironmentSpecs([]EnvironmentSpec{spec}); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+
+	for _, l := range []HeaderLimits{{MaxHeaders: -1}, {MaxHeaderBytes: -1}, {MaxCookieBytes: -1}} {
+		l := l
+		spec.APIs[0].Operations[0].HeaderLimits = &l
+		if err := ValidateEnvironmentSpecs([]EnvironmentSpec{spec}); err == nil {
+			t.Errorf("want error for %#v", l)
+		}
+	}
+}
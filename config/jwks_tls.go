@@ -0,0 +1,117 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// JWKSTLS contains the TLS settings of fetching a RemoteJWKS, such as from
+// internal issuers not trusted by the system pool or requiring mTLS.
+type JWKSTLS struct {
+	// CAFile is a PEM bundle of the CAs trusted in place of the system pool.
+	CAFile string `yaml:"ca_file,omitempty" mapstructure:"ca_file,omitempty"`
+
+	// CertFile and KeyFile are the PEM client certificate and key for mTLS.
+	CertFile string `yaml:"cert_file,omitempty" mapstructure:"cert_file,omitempty"`
+	KeyFile  string `yaml:"key_file,omitempty" mapstructure:"key_file,omitempty"`
+
+	// SPKIPins are base64 SHA-256 digests of SubjectPublicKeyInfos. If set,
+	// the verified chain of the server must contain one of them.
+	SPKIPins []string `yaml:"spki_pins,omitempty" mapstructure:"spki_pins,omitempty"`
+}
+
+func (t *JWKSTLS) validate() error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("remote_jwks tls cert_file and key_file must be set together")
+	}
+	for _, pin := range t.SPKIPins {
+		if b, err := base64.StdEncoding.DecodeString(pin); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("remote_jwks tls spki_pins must be base64 SHA-256 digests, got %q", pin)
+		}
+	}
+	return nil
+}
+
+// TLSConfig returns the client TLS configuration, loading the CA and client
+// certificate files.
+func (t *JWKSTLS) TLSConfig() (*tls.Config, error) {
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{}
+	if t.CAFile != "" {
+		caCert, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if ok := pool.AppendCertsFromPEM(caCert); !ok {
+			return nil, fmt.Errorf("error appending CA to cert pool")
+		}
+		cfg.RootCAs = pool
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if len(t.SPKIPins) > 0 {
+		pins := make([][]byte, len(t.SPKIPins))
+		for i, pin := range t.SPKIPins {
+			pins[i], _ = base64.StdEncoding.DecodeString(pin)
+		}
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			for _, chain := range verifiedChains {
+				for _, cert := range chain {
+					digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+					for _, pin := range pins {
+						if bytes.Equal(digest[:], pin) {
+							return nil
+						}
+					}
+				}
+			}
+			return fmt.Errorf("no certificate matches the spki_pins")
+		}
+	}
+	return cfg, nil
+}
+
+// Client returns a copy of client, or a new client if nil, fetching with
+// the TLS settings.
+func (t *JWKSTLS) Client(client *http.Client) (*http.Client, error) {
+	tlsConfig, err := t.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tlsConfig
+	c := &http.Client{}
+	if client != nil {
+		*c = *client
+	}
+	c.Transport = tr
+	return c, nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+)
+
+func TestJWKSTLSValidate(t *testing.T) {
+	pin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	tests := []struct {
+		desc    string
+		tls     JWKSTLS
+		wantErr string
+	}{
+		{"empty", JWKSTLS{}, ""},
+		{"all", JWKSTLS{CAFile: "ca", CertFile: "cert", KeyFile: "key", SPKIPins: []string{pin}}, ""},
+		{"cert without key", JWKSTLS{CertFile: "cert"}, "remote_jwks tls cert_file and key_file must be set together"},
+		{"key without cert", JWKSTLS{KeyFile: "key"}, "remote_jwks tls cert_file and key_file must be set together"},
+		{"bad pin", JWKSTLS{SPKIPins: []string{"not base64"}},
+			`remote_jwks tls spki_pins must be base64 SHA-256 digests, got "not base64"`},
+		{"short pin", JWKSTLS{SPKIPins: []string{"c2hvcnQ="}},
+			`remote_jwks tls spki_pins must be base64 SHA-256 digests, got "c2hvcnQ="`},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			err := test.tls.validate()
+			if test.wantErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if test.wantErr != "" && (err == nil || err.Error() != test.wantErr) {
+				t.Errorf("want error %q, got: %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestFetchJWKSSourceTLS(t *testing.T) {
+	_, jwks, err := testutil.GenerateKeyAndJWKs("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(jwks)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	write := func(name string, block *pem.Block) string {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	caFile := write("ca.pem", &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := write("cert.pem", &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyFile := write("key.pem", &pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	digest := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	goodPin := base64.StdEncoding.EncodeToString(digest[:])
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		desc   string
+		tls    *JWKSTLS
+		wantOK bool
+	}{
+		{"system pool", nil, false},
+		{"no client cert", &JWKSTLS{CAFile: caFile}, false},
+		{"ca and client cert", &JWKSTLS{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}, true},
+		{"pinned", &JWKSTLS{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, SPKIPins: []string{otherPin, goodPin}}, true},
+		{"pin mismatch", &JWKSTLS{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, SPKIPins: []string{otherPin}}, false},
+		{"missing ca", &JWKSTLS{CAFile: filepath.Join(dir, "missing.pem")}, false},
+		{"bad ca", &JWKSTLS{CAFile: keyFile}, false},
+		{"bad client cert", &JWKSTLS{CAFile: caFile, CertFile: caFile, KeyFile: keyFile}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			keys, err := fetchJWKSSource(&http.Client{Timeout: time.Second}, RemoteJWKS{URL: srv.URL, TLS: test.tls})
+			if test.wantOK && (err != nil || keys != 1) {
+				t.Errorf("want 1 key, got: %d, %v", keys, err)
+			}
+			if !test.wantOK && err == nil {
+				t.Errorf("want error")
+			}
+		})
+	}
+}
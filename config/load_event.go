@@ -0,0 +1,160 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"gopkg.in/yaml.v3"
+)
+
+// LoadEventKind categorizes a LoadEvent.
+type LoadEventKind string
+
+const (
+	ConfigLoaded   LoadEventKind = "loaded"
+	ConfigReloaded LoadEventKind = "reloaded"
+	ConfigRejected LoadEventKind = "rejected"
+
+	versionLength = 16 // hex characters of the sha256 kept in versions
+)
+
+// loadEventClient posts LoadEvents to the webhook
+var loadEventClient = &http.Client{Timeout: 10 * time.Second}
+
+// LoadEvent records a config load for audit trails and incident timelines.
+type LoadEvent struct {
+	Kind   LoadEventKind `json:"kind"`
+	Time   time.Time     `json:"time"`
+	Source string        `json:"source"`
+	// Version is a hash of the config, secrets excluded.
+	Version          string                   `json:"version,omitempty"`
+	EnvironmentSpecs []EnvironmentSpecVersion `json:"environment_specs,omitempty"`
+	// Changes summarizes the policy-affecting changes from the previous config.
+	Changes []string `json:"changes,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// EnvironmentSpecVersion identifies the content of a loaded EnvironmentSpec.
+type EnvironmentSpecVersion struct {
+	ID      string `json:"id"`
+	Version string `json:"version"`
+}
+
+// NewLoadEvent creates a LoadEvent for a load of current from source.
+// Previous is the config being replaced, nil on first load. A non-nil err
+// creates a ConfigRejected event, current may then be partially loaded or nil.
+func NewLoadEvent(source string, previous, current *Config, err error) LoadEvent {
+	event := LoadEvent{
+		Kind:   ConfigLoaded,
+		Time:   time.Now().UTC(),
+		Source: source,
+	}
+	if current != nil {
+		event.Version = versionOf(current)
+		for _, spec := range current.EnvironmentSpecs.Inline {
+			event.EnvironmentSpecs = append(event.EnvironmentSpecs, EnvironmentSpecVersion{
+				ID:      spec.ID,
+				Version: versionOf(spec),
+			})
+		}
+	}
+	switch {
+	case err != nil:
+		event.Kind = ConfigRejected
+		event.Error = err.Error()
+	case previous != nil:
+		event.Kind = ConfigReloaded
+		event.Changes = diffConfigSpecs(previous, current)
+	}
+	return event
+}
+
+// EmitLoadEvent logs the event and posts it to webhook, if not empty.
+func EmitLoadEvent(event LoadEvent, webhook string) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("unable to marshal config %s event: %v", event.Kind, err)
+		return
+	}
+	if event.Kind == ConfigRejected {
+		log.Warnf("config %s: %s", event.Kind, b)
+	} else {
+		log.Infof("config %s: %s", event.Kind, b)
+	}
+
+	if webhook == "" {
+		return
+	}
+	if err := postLoadEvent(webhook, b); err != nil {
+		log.Warnf("unable to post config %s event to %s: %v", event.Kind, webhook, err)
+	}
+}
+
+func postLoadEvent(webhook string, body []byte) error {
+	resp, err := loadEventClient.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// versionOf hashes the YAML of v, fields excluded from YAML (secrets) are not included
+func versionOf(v interface{}) string {
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])[:versionLength]
+}
+
+// diffConfigSpecs summarizes the EnvironmentSpec changes, matched by ID
+func diffConfigSpecs(previous, current *Config) []string {
+	var changes []string
+	currentSpecs := make(map[string]EnvironmentSpec, len(current.EnvironmentSpecs.Inline))
+	for _, spec := range current.EnvironmentSpecs.Inline {
+		currentSpecs[spec.ID] = spec
+	}
+	previousSpecs := make(map[string]EnvironmentSpec, len(previous.EnvironmentSpecs.Inline))
+	for _, spec := range previous.EnvironmentSpecs.Inline {
+		previousSpecs[spec.ID] = spec
+		if _, ok := currentSpecs[spec.ID]; !ok {
+			changes = append(changes, fmt.Sprintf("environment spec %q: removed", spec.ID))
+		}
+	}
+	for _, spec := range current.EnvironmentSpecs.Inline {
+		previousSpec, ok := previousSpecs[spec.ID]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("environment spec %q: added", spec.ID))
+			continue
+		}
+		for _, c := range DiffEnvironmentSpecs(previousSpec, spec) {
+			changes = append(changes, fmt.Sprintf("environment spec %q: %s", spec.ID, c))
+		}
+	}
+	return changes
+}
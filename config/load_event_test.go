@@ -0,0 +1,159 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/errorset"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNewLoadEvent(t *testing.T) {
+	previous := Default()
+	previous.EnvironmentSpecs.Inline = []EnvironmentSpec{createGoodEnvSpec(), {ID: "removed"}}
+
+	current := Default()
+	spec := createGoodEnvSpec()
+	spec.APIs = spec.APIs[1:]
+	current.EnvironmentSpecs.Inline = []EnvironmentSpec{spec, {ID: "added"}}
+
+	loaded := NewLoadEvent("config.yaml", nil, previous, nil)
+	if loaded.Kind != ConfigLoaded {
+		t.Errorf("want: %s, got: %s", ConfigLoaded, loaded.Kind)
+	}
+	if loaded.Source != "config.yaml" {
+		t.Errorf("want: config.yaml, got: %s", loaded.Source)
+	}
+	if len(loaded.Version) != versionLength {
+		t.Errorf("want version of length %d, got: %q", versionLength, loaded.Version)
+	}
+	if len(loaded.EnvironmentSpecs) != 2 || loaded.EnvironmentSpecs[0].ID != "good-env-config" {
+		t.Errorf("unexpected environment specs: %v", loaded.EnvironmentSpecs)
+	}
+	if loaded.Changes != nil {
+		t.Errorf("want no changes, got: %v", loaded.Changes)
+	}
+
+	reloaded := NewLoadEvent("config.yaml", previous, current, nil)
+	if reloaded.Kind != ConfigReloaded {
+		t.Errorf("want: %s, got: %s", ConfigReloaded, reloaded.Kind)
+	}
+	if reloaded.Version == loaded.Version {
+		t.Errorf("version should change")
+	}
+	if reloaded.EnvironmentSpecs[0].Version == loaded.EnvironmentSpecs[0].Version {
+		t.Errorf("environment spec version should change")
+	}
+	wantChanges := []string{
+		`environment spec "removed": removed`,
+		fmt.Sprintf(`environment spec "good-env-config": api %q: api removed`, createGoodEnvSpec().APIs[0].ID),
+		`environment spec "added": added`,
+	}
+	if diff := cmp.Diff(wantChanges, reloaded.Changes); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+
+	unchanged := NewLoadEvent("config.yaml", previous, previous, nil)
+	if unchanged.Version != loaded.Version || unchanged.Changes != nil {
+		t.Errorf("want version %s and no changes, got: %s, %v", loaded.Version, unchanged.Version, unchanged.Changes)
+	}
+
+	rejected := NewLoadEvent("config.yaml", nil, nil, fmt.Errorf("bad config"))
+	if rejected.Kind != ConfigRejected {
+		t.Errorf("want: %s, got: %s", ConfigRejected, rejected.Kind)
+	}
+	if rejected.Error != "bad config" {
+		t.Errorf("want: bad config, got: %s", rejected.Error)
+	}
+	if rejected.Version != "" {
+		t.Errorf("want no version, got: %s", rejected.Version)
+	}
+}
+
+func TestEmitLoadEvent(t *testing.T) {
+	var got LoadEvent
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("want: POST, got: %s", r.Method)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	cfg := Default()
+	cfg.EnvironmentSpecs.Inline = []EnvironmentSpec{createGoodEnvSpec()}
+	event := NewLoadEvent("config.yaml", nil, cfg, nil)
+	EmitLoadEvent(event, ts.URL)
+	if got.Kind != ConfigLoaded || got.Version != event.Version || len(got.EnvironmentSpecs) != 1 {
+		t.Errorf("want: %v, got: %v", event, got)
+	}
+
+	b, _ := json.Marshal(event)
+	if err := postLoadEvent(ts.URL, b); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	status = http.StatusInternalServerError
+	if err := postLoadEvent(ts.URL, b); err == nil {
+		t.Errorf("want error on bad status")
+	}
+}
+
+func TestValidateConfigEventWebhook(t *testing.T) {
+	tests := []struct {
+		webhook string
+		wantErr bool
+	}{
+		{"", false},
+		{"https://example.com/events", false},
+		{"example.com/events", true},
+		{"%", true},
+	}
+	for _, test := range tests {
+		t.Run(test.webhook, func(t *testing.T) {
+			config := Default()
+			config.Tenant = Tenant{
+				InternalAPI:      "http://localhost/remote-service",
+				RemoteServiceAPI: "http://localhost/remote-service",
+				OrgName:          "org",
+				EnvName:          "env",
+				Key:              "key",
+				Secret:           "secret",
+			}
+			config.Global.ConfigEventWebhook = test.webhook
+			err := config.Validate(true)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("should have gotten error")
+				}
+				merr := err.(*errorset.Error)
+				if merr.Len() != 1 {
+					t.Fatalf("got %d errors, want: 1, errors: %s", merr.Len(), merr)
+				}
+				equal(t, merr.Errors[0].Error(), "global.config_event_webhook must be an absolute URL")
+			} else if err != nil {
+				t.Errorf("should not get error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// OutboundRetry is config for retrying the outbound calls of the adapter,
+// such as product polls, API key verifications, quota syncs, and JWKS
+// fetches, that fail with a connection error or a 429, 502, 503, or 504
+// status. Calls that aren't idempotent, such as POSTs, are only retried if
+// the connection failed before they were sent. Attempts are spaced by
+// exponential backoff with full jitter, or by the Retry-After of the response
+// if it's within MaxBackoff. Each endpoint has a retry budget so an
+// unavailable endpoint isn't sent a multiple of its calls. Retried calls to
+// tenant endpoints with failovers are retried on the active endpoint rather
+// than also being replayed by the failover.
+type OutboundRetry struct {
+	// MaxAttempts of a call, including the first. Calls are not retried if 1 or less.
+	MaxAttempts int `yaml:"max_attempts,omitempty" mapstructure:"max_attempts,omitempty"`
+	// InitialBackoff is the most waited before the first retry, doubled for each later retry.
+	InitialBackoff time.Duration `yaml:"initial_backoff,omitempty" mapstructure:"initial_backoff,omitempty"`
+	// MaxBackoff is the most waited before any retry. A longer Retry-After isn't retried.
+	MaxBackoff time.Duration `yaml:"max_backoff,omitempty" mapstructure:"max_backoff,omitempty"`
+	// BudgetRatio of the calls of an endpoint earned as retries, eg. 0.1 allows
+	// a retry for every 10 calls.
+	BudgetRatio float64 `yaml:"budget_ratio,omitempty" mapstructure:"budget_ratio,omitempty"`
+	// BudgetBurst is the most retries of an endpoint saved up from its calls.
+	BudgetBurst int `yaml:"budget_burst,omitempty" mapstructure:"budget_burst,omitempty"`
+}
+
+func (r OutboundRetry) validate() error {
+	if r.MaxAttempts < 0 {
+		return fmt.Errorf("tenant.retry.max_attempts must not be negative")
+	}
+	if r.InitialBackoff < 0 || r.MaxBackoff < 0 {
+		return fmt.Errorf("tenant.retry backoffs must not be negative")
+	}
+	if r.InitialBackoff > r.MaxBackoff {
+		return fmt.Errorf("tenant.retry.initial_backoff must not exceed max_backoff")
+	}
+	if r.BudgetRatio < 0 || r.BudgetRatio > 1 {
+		return fmt.Errorf("tenant.retry.budget_ratio must be between 0 and 1, got %v", r.BudgetRatio)
+	}
+	if r.BudgetBurst < 0 {
+		return fmt.Errorf("tenant.retry.budget_burst must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateOutboundRetry(t *testing.T) {
+	tests := []struct {
+		desc    string
+		retry   OutboundRetry
+		wantErr string
+	}{
+		{"default", Default().Tenant.Retry, ""},
+		{"disabled", OutboundRetry{}, ""},
+		{"negative attempts", OutboundRetry{MaxAttempts: -1}, "tenant.retry.max_attempts must not be negative"},
+		{"negative backoff", OutboundRetry{InitialBackoff: -time.Second}, "tenant.retry backoffs must not be negative"},
+		{"initial over max", OutboundRetry{InitialBackoff: time.Minute, MaxBackoff: time.Second},
+			"tenant.retry.initial_backoff must not exceed max_backoff"},
+		{"budget ratio", OutboundRetry{BudgetRatio: 2}, "tenant.retry.budget_ratio must be between 0 and 1, got 2"},
+		{"budget burst", OutboundRetry{BudgetBurst: -1}, "tenant.retry.budget_burst must not be negative"},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			err := test.retry.validate()
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("want no error, got %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("want error %q", test.wantErr)
+			}
+			equal(t, err.Error(), test.wantErr)
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+)
+
+// QuotaExemption exempts trusted consumers, such as internal health checkers
+// and partners with SLAs, from quotas. Their requests are still recorded in
+// analytics. An exemption matches if any of its signals match.
+type QuotaExemption struct {
+	// Name of the exemption.
+	Name string `yaml:"name" mapstructure:"name"`
+
+	// Apps are the exempt Apigee app names.
+	Apps []string `yaml:"apps,omitempty" mapstructure:"apps,omitempty"`
+
+	// Claims match JWT claims of exempt consumers.
+	Claims []ExemptClaim `yaml:"claims,omitempty" mapstructure:"claims,omitempty"`
+
+	// IPRanges are the CIDRs of exempt client addresses, eg. 10.0.0.0/8.
+	IPRanges []string `yaml:"ip_ranges,omitempty" mapstructure:"ip_ranges,omitempty"`
+}
+
+// ExemptClaim matches a JWT claim of one of the values.
+type ExemptClaim struct {
+	// Name of the JWT requirement.
+	Requirement string `yaml:"requirement" mapstructure:"requirement"`
+
+	// Name of the claim.
+	Name string `yaml:"name" mapstructure:"name"`
+
+	// Values of the claim exempt.
+	Values []string `yaml:"values" mapstructure:"values"`
+}
+
+// validateQuotaExemptions checks exemptions have unique names, signals,
+// claims of existing requirements, and valid IP ranges
+func validateQuotaExemptions(exemptions []QuotaExemption, maps ...map[string]*JWTAuthentication) error {
+	names := make(map[string]bool, len(exemptions))
+	for _, x := range exemptions {
+		if x.Name == "" {
+			return fmt.Errorf("quota exemption names must be non-empty")
+		}
+		if names[x.Name] {
+			return fmt.Errorf("quota exemption names within each API or operation must be unique, got multiple %s", x.Name)
+		}
+		names[x.Name] = true
+		if len(x.Apps) == 0 && len(x.Claims) == 0 && len(x.IPRanges) == 0 {
+			return fmt.Errorf("quota exemption %q must have apps, claims, or ip_ranges", x.Name)
+		}
+		for _, c := range x.Claims {
+			if c.Name == "" || len(c.Values) == 0 {
+				return fmt.Errorf("quota exemption %q claims must have a name and values", x.Name)
+			}
+			found := false
+			for _, m := range maps {
+				if _, ok := m[c.Requirement]; ok {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("quota exemption %q claim requirement %q does not exist", x.Name, c.Requirement)
+			}
+		}
+		for _, r := range x.IPRanges {
+			if _, _, err := net.ParseCIDR(r); err != nil {
+				return fmt.Errorf("quota exemption %q ip_ranges must be CIDRs, got %q", x.Name, r)
+			}
+		}
+	}
+	return nil
+}
+
+// parseQuotaExemptions parses the IP ranges
+func (e *EnvironmentSpecExt) parseQuotaExemptions(exemptions []QuotaExemption) error {
+	for _, x := range exemptions {
+		for _, r := range x.IPRanges {
+			_, ipNet, err := net.ParseCIDR(r)
+			if err != nil {
+				return fmt.Errorf("quota exemption %q ip range: %v", x.Name, err)
+			}
+			e.compiledIPRanges[r] = ipNet
+		}
+	}
+	return nil
+}
+
+// GetQuotaExemptions returns the QuotaExemptions of the Operation or APISpec
+// as appropriate.
+func (e *EnvironmentSpecRequest) GetQuotaExemptions() []QuotaExemption {
+	if op := e.GetOperation(); op != nil && len(op.QuotaExemptions) > 0 {
+		return op.QuotaExemptions
+	}
+	if api := e.GetAPISpec(); api != nil {
+		return api.QuotaExemptions
+	}
+	return nil
+}
+
+// MatchQuotaExemption returns the first QuotaExemption matching the request
+// of the app, nil if none.
+func (e *EnvironmentSpecRequest) MatchQuotaExemption(app string) *QuotaExemption {
+	if e == nil {
+		return nil
+	}
+	exemptions := e.GetQuotaExemptions()
+	for i := range exemptions {
+		if e.matchesQuotaExemption(exemptions[i], app) {
+			log.Debugf("quota exemption %q matched", exemptions[i].Name)
+			return &exemptions[i]
+		}
+	}
+	return nil
+}
+
+func (e *EnvironmentSpecRequest) matchesQuotaExemption(x QuotaExemption, app string) bool {
+	if app != "" {
+		for _, a := range x.Apps {
+			if a == app {
+				return true
+			}
+		}
+	}
+	for _, c := range x.Claims {
+		value := e.getClaimValue(JWTClaim{Requirement: c.Requirement, Name: c.Name})
+		if value == "" {
+			continue
+		}
+		for _, v := range c.Values {
+			if v == value {
+				return true
+			}
+		}
+	}
+	if len(x.IPRanges) > 0 {
+		ip := net.ParseIP(e.ClientIP())
+		for _, r := range x.IPRanges {
+			if ipNet := e.compiledIPRanges[r]; ip != nil && ipNet != nil && ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
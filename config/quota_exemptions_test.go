@@ -0,0 +1,109 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+)
+
+func TestMatchQuotaExemption(t *testing.T) {
+	envSpec := &EnvironmentSpec{
+		ID: "good-env-config",
+		APIs: []APISpec{{
+			ID: "apispec1",
+			Authentication: AuthenticationRequirement{
+				Requirements: JWTAuthentication{Name: "partner-jwt"},
+			},
+			QuotaExemptions: []QuotaExemption{
+				{Name: "internal", Apps: []string{"health-checker"}},
+				{Name: "partner", Claims: []ExemptClaim{{Requirement: "partner-jwt", Name: "sub", Values: []string{"partner-a"}}}},
+				{Name: "network", IPRanges: []string{"10.0.0.0/8", "2001:db8::/32"}},
+			},
+			Operations: []APIOperation{
+				{
+					Name:            "strict",
+					HTTPMatches:     []HTTPMatch{{PathTemplate: "/strict"}},
+					QuotaExemptions: []QuotaExemption{{Name: "monitor", Apps: []string{"monitor"}}},
+				},
+				{
+					Name:        "default",
+					HTTPMatches: []HTTPMatch{{PathTemplate: "/**"}},
+				},
+			},
+		}},
+	}
+	if err := ValidateEnvironmentSpecs([]EnvironmentSpec{*envSpec}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	specExt, err := NewEnvironmentSpecExt(envSpec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	tests := []struct {
+		desc string
+		path string
+		app  string
+		sub  string
+		ip   string
+		want string
+	}{
+		{"no match", "/", "other", "", "192.168.0.1", ""},
+		{"app", "/", "health-checker", "", "", "internal"},
+		{"claim", "/", "", "partner-a", "", "partner"},
+		{"other claim", "/", "", "partner-b", "", ""},
+		{"ip range", "/", "", "", "10.1.2.3", "network"},
+		{"ipv6 range", "/", "", "", "2001:db8::1", "network"},
+		{"first match", "/", "health-checker", "", "10.1.2.3", "internal"},
+		{"operation exemptions", "/strict", "monitor", "", "", "monitor"},
+		{"operation overrides api", "/strict", "health-checker", "", "10.1.2.3", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			envoyReq := testutil.NewEnvoyRequest(http.MethodGet, test.path, nil, nil)
+			if test.ip != "" {
+				envoyReq.Attributes.Source = &authv3.AttributeContext_Peer{
+					Address: &corev3.Address{
+						Address: &corev3.Address_SocketAddress{
+							SocketAddress: &corev3.SocketAddress{Address: test.ip},
+						},
+					},
+				}
+			}
+			req := NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
+			if test.sub != "" {
+				req.jwtResults["partner-jwt"] = &jwtResult{claims: jwtClaims{"sub": test.sub}}
+			}
+			exemption := req.MatchQuotaExemption(test.app)
+			var got string
+			if exemption != nil {
+				got = exemption.Name
+			}
+			if got != test.want {
+				t.Errorf("want: %q, got: %q", test.want, got)
+			}
+		})
+	}
+
+	var nilReq *EnvironmentSpecRequest
+	if nilReq.MatchQuotaExemption("health-checker") != nil {
+		t.Errorf("nil request should not match")
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Outcomes of ResponseOutcomes.
+const (
+	ResponseOutcomeSuccess      = "success"
+	ResponseOutcomeClientError  = "client_error"
+	ResponseOutcomeBackendError = "backend_error"
+	ResponseOutcomeThrottled    = "throttled"
+)
+
+// ResponseOutcome classifies the upstream responses of an Operation into a
+// logical outcome recorded in analytics, for backends whose status codes
+// don't tell, such as those answering errors with 200.
+type ResponseOutcome struct {
+	// Codes are the response status codes, such as 200, or classes, such as
+	// 2xx, matched. Required.
+	Codes []string `yaml:"codes" mapstructure:"codes"`
+
+	// Header, if set, must be in the response for the rule to match. Envoy
+	// only logs the response headers it is configured to.
+	Header string `yaml:"header,omitempty" mapstructure:"header,omitempty"`
+
+	// Outcome of the matched responses: success, client_error, backend_error,
+	// or throttled.
+	Outcome string `yaml:"outcome" mapstructure:"outcome"`
+}
+
+// validateResponseOutcomes checks the rules have valid codes and outcomes
+func validateResponseOutcomes(op string, outcomes []ResponseOutcome) error {
+	for _, o := range outcomes {
+		switch o.Outcome {
+		case ResponseOutcomeSuccess, ResponseOutcomeClientError, ResponseOutcomeBackendError, ResponseOutcomeThrottled:
+		default:
+			return fmt.Errorf("operation %q response_outcomes outcome must be %s, %s, %s, or %s, got %q", op,
+				ResponseOutcomeSuccess, ResponseOutcomeClientError, ResponseOutcomeBackendError, ResponseOutcomeThrottled, o.Outcome)
+		}
+		if len(o.Codes) == 0 {
+			return fmt.Errorf("operation %q response_outcomes must have codes", op)
+		}
+		for _, c := range o.Codes {
+			if !validResponseCodePattern(c) {
+				return fmt.Errorf("operation %q response_outcomes codes must be status codes or classes like 2xx, got %q", op, c)
+			}
+		}
+	}
+	return nil
+}
+
+func validResponseCodePattern(pattern string) bool {
+	if len(pattern) != 3 || pattern[0] < '1' || pattern[0] > '5' {
+		return false
+	}
+	if strings.ToLower(pattern[1:]) == "xx" {
+		return true
+	}
+	_, err := strconv.Atoi(pattern)
+	return err == nil
+}
+
+// responseCodeMatches returns true if the code matches the status code or
+// class pattern
+func responseCodeMatches(pattern string, code int) bool {
+	if strings.ToLower(pattern[1:]) == "xx" {
+		return int(pattern[0]-'0') == code/100
+	}
+	return pattern == strconv.Itoa(code)
+}
+
+// ResponseOutcome returns the outcome of the first of the Operation's
+// ResponseOutcomes matching the response, else as classified by its code.
+func (op *APIOperation) ResponseOutcome(code int, headers map[string]string) string {
+	for _, o := range op.ResponseOutcomes {
+		if o.Header != "" {
+			if _, ok := headers[strings.ToLower(o.Header)]; !ok {
+				continue
+			}
+		}
+		for _, c := range o.Codes {
+			if responseCodeMatches(c, code) {
+				return o.Outcome
+			}
+		}
+	}
+	return DefaultResponseOutcome(code)
+}
+
+// DefaultResponseOutcome classifies a response by its status code.
+func DefaultResponseOutcome(code int) string {
+	switch {
+	case code == 429:
+		return ResponseOutcomeThrottled
+	case code >= 500 || code == 0:
+		return ResponseOutcomeBackendError
+	case code >= 400:
+		return ResponseOutcomeClientError
+	}
+	return ResponseOutcomeSuccess
+}
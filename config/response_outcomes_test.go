@@ -0,0 +1,67 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "testing"
+
+func TestResponseOutcome(t *testing.T) {
+	op := &APIOperation{
+		ResponseOutcomes: []ResponseOutcome{
+			{Codes: []string{"200"}, Header: "X-Error-Code", Outcome: ResponseOutcomeBackendError},
+			{Codes: []string{"404", "5XX"}, Outcome: ResponseOutcomeClientError},
+		},
+	}
+	tests := []struct {
+		code    int
+		headers map[string]string
+		want    string
+	}{
+		{200, map[string]string{"x-error-code": "E1"}, ResponseOutcomeBackendError},
+		{200, nil, ResponseOutcomeSuccess},
+		{404, nil, ResponseOutcomeClientError},
+		{503, nil, ResponseOutcomeClientError},
+		{429, nil, ResponseOutcomeThrottled},
+		{401, nil, ResponseOutcomeClientError},
+		{0, nil, ResponseOutcomeBackendError},
+		{302, nil, ResponseOutcomeSuccess},
+	}
+	for _, test := range tests {
+		if got := op.ResponseOutcome(test.code, test.headers); got != test.want {
+			t.Errorf("%d %v: want %s, got %s", test.code, test.headers, test.want, got)
+		}
+	}
+}
+
+func TestValidateResponseOutcomes(t *testing.T) {
+	tests := []struct {
+		outcome ResponseOutcome
+		wantErr string
+	}{
+		{ResponseOutcome{Codes: []string{"200", "4xx"}, Outcome: ResponseOutcomeThrottled}, ""},
+		{ResponseOutcome{Codes: []string{"200"}, Outcome: "failure"},
+			`operation "op" response_outcomes outcome must be success, client_error, backend_error, or throttled, got "failure"`},
+		{ResponseOutcome{Outcome: ResponseOutcomeSuccess}, `operation "op" response_outcomes must have codes`},
+		{ResponseOutcome{Codes: []string{"2x0"}, Outcome: ResponseOutcomeSuccess},
+			`operation "op" response_outcomes codes must be status codes or classes like 2xx, got "2x0"`},
+		{ResponseOutcome{Codes: []string{"600"}, Outcome: ResponseOutcomeSuccess},
+			`operation "op" response_outcomes codes must be status codes or classes like 2xx, got "600"`},
+	}
+	for _, test := range tests {
+		err := validateResponseOutcomes("op", []ResponseOutcome{test.outcome})
+		if (err == nil && test.wantErr != "") || (err != nil && err.Error() != test.wantErr) {
+			t.Errorf("want error %q, got %v", test.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	jsonSchemaVersion = "https://json-schema.org/draft/2020-12/schema"
+
+	// config files are decoded by viper, environment specs by yaml
+	configFieldTag   = "mapstructure"
+	envSpecFieldTag  = "yaml"
+	schemaDefsPrefix = "#/$defs/"
+
+	// YAML merge keys (<<) carry this tag
+	mergeTag = "!!merge"
+)
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+
+	// types with custom YAML unmarshalling are described by the types they decode
+	schemaTypes = map[reflect.Type]reflect.Type{
+		reflect.TypeOf(AuthenticationRequirement{}): reflect.TypeOf(authenticationRequirementWrapper{}),
+		reflect.TypeOf(JWTAuthentication{}):         reflect.TypeOf(jwtAuthenticationWrapper{}),
+		reflect.TypeOf(APIOperationParameter{}):     reflect.TypeOf(apiOperationParameterWrapper{}),
+	}
+)
+
+// ConfigJSONSchema returns the JSON Schema of the config file.
+func ConfigJSONSchema() map[string]interface{} {
+	return jsonSchema("apigee-remote-service-envoy config", reflect.TypeOf(Config{}), configFieldTag)
+}
+
+// EnvironmentSpecJSONSchema returns the JSON Schema of an environment spec file.
+func EnvironmentSpecJSONSchema() map[string]interface{} {
+	return jsonSchema("apigee-remote-service-envoy environment spec", reflect.TypeOf(EnvironmentSpec{}), envSpecFieldTag)
+}
+
+func jsonSchema(title string, t reflect.Type, tag string) map[string]interface{} {
+	defs := make(map[string]interface{})
+	schema := schemaOf(t, tag, defs)
+	schema["$schema"] = jsonSchemaVersion
+	schema["title"] = title
+	schema["$defs"] = defs
+	return schema
+}
+
+// schemaOf returns the schema of t, adding the named struct types it
+// references to defs
+func schemaOf(t reflect.Type, tag string, defs map[string]interface{}) map[string]interface{} {
+	if t == durationType {
+		return map[string]interface{}{"type": "string", "format": "duration"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem(), tag, defs)
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), tag, defs)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), tag, defs)}
+	case reflect.Struct:
+		name := t.Name()
+		ref := map[string]interface{}{"$ref": schemaDefsPrefix + name}
+		if _, ok := defs[name]; ok {
+			return ref
+		}
+		defs[name] = nil // placeholder for recursive types
+		properties := make(map[string]interface{})
+		for field, ft := range schemaFields(t, tag) {
+			properties[field] = schemaOf(ft, tag, defs)
+		}
+		defs[name] = map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+		return ref
+	}
+	return map[string]interface{}{}
+}
+
+// schemaFields returns the types of the struct fields by their names in tag
+func schemaFields(t reflect.Type, tag string) map[string]reflect.Type {
+	if st, ok := schemaTypes[t]; ok {
+		t = st
+	}
+	fields := make(map[string]reflect.Type, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+		name, ok := f.Tag.Lookup(tag)
+		name = strings.Split(name, ",")[0]
+		if !ok && f.Tag.Get(envSpecFieldTag) != "-" {
+			name = strings.ToLower(f.Name) // as yaml and mapstructure default
+		}
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// unknownConfigFields returns an error for each field of the config file
+// not in the Config.
+func unknownConfigFields(data []byte) ([]error, error) {
+	return unknownFields(data, reflect.TypeOf(Config{}), configFieldTag)
+}
+
+// unknownEnvironmentSpecFields returns an error for each field of the
+// environment spec file not in the EnvironmentSpec.
+func unknownEnvironmentSpecFields(data []byte) ([]error, error) {
+	return unknownFields(data, reflect.TypeOf(EnvironmentSpec{}), envSpecFieldTag)
+}
+
+func unknownFields(data []byte, t reflect.Type, tag string) ([]error, error) {
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+	if len(node.Content) == 0 { // empty document
+		return nil, nil
+	}
+	return checkFields(node.Content[0], t, tag, ""), nil
+}
+
+// unknownEnvironmentSpecNodeFields returns an error for each field of the
+// decoded environment spec document not in the EnvironmentSpec.
+func unknownEnvironmentSpecNodeFields(doc *yaml.Node) []error {
+	if len(doc.Content) == 0 { // empty document
+		return nil
+	}
+	return checkFields(doc.Content[0], reflect.TypeOf(EnvironmentSpec{}), envSpecFieldTag, "")
+}
+
+// checkFields walks node as type t, returning an error with the path and
+// line of each mapping key that isn't a field
+func checkFields(node *yaml.Node, t reflect.Type, tag, path string) []error {
+	if node.Kind == yaml.AliasNode {
+		return nil // checked at the anchor
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var errs []error
+	switch {
+	case t.Kind() == reflect.Struct && t != durationType && node.Kind == yaml.MappingNode:
+		fields := schemaFields(t, tag)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Tag == mergeTag { // <<: *anchor or <<: [*a, *b] merges into t
+				merged := []*yaml.Node{value}
+				if value.Kind == yaml.SequenceNode {
+					merged = value.Content
+				}
+				for _, m := range merged {
+					errs = append(errs, checkFields(m, t, tag, path)...)
+				}
+				continue
+			}
+			fieldPath := key.Value
+			if path != "" {
+				fieldPath = path + "." + key.Value
+			}
+			ft, ok := fields[key.Value]
+			if !ok && tag == configFieldTag {
+				ft, ok = fields[strings.ToLower(key.Value)] // viper keys are case-insensitive
+			}
+			if !ok {
+				errs = append(errs, fmt.Errorf("line %d: unknown field %s", key.Line, fieldPath))
+				continue
+			}
+			errs = append(errs, checkFields(value, ft, tag, fieldPath)...)
+		}
+	case (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) && node.Kind == yaml.SequenceNode:
+		for i, item := range node.Content {
+			errs = append(errs, checkFields(item, t.Elem(), tag, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			errs = append(errs, checkFields(node.Content[i+1], t.Elem(), tag, path+"."+node.Content[i].Value)...)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,234 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestConfigJSONSchema(t *testing.T) {
+	schema := ConfigJSONSchema()
+	if _, err := json.Marshal(schema); err != nil {
+		t.Fatalf("schema should marshal: %v", err)
+	}
+	equal(t, schema["$ref"].(string), "#/$defs/Config")
+
+	defs := schema["$defs"].(map[string]interface{})
+	global := defs["Global"].(map[string]interface{})["properties"].(map[string]interface{})
+	if _, ok := global["namespace"]; !ok {
+		t.Errorf("config schema should use mapstructure names")
+	}
+	if global["keep_alive_max_connection_age"].(map[string]interface{})["format"] != "duration" {
+		t.Errorf("durations should be strings of format duration")
+	}
+	tenant := defs["Tenant"].(map[string]interface{})["properties"].(map[string]interface{})
+	for _, hidden := range []string{"PrivateKey", "JWKS", "private_key"} {
+		if _, ok := tenant[hidden]; ok {
+			t.Errorf("%s should not be in schema", hidden)
+		}
+	}
+}
+
+func TestEnvironmentSpecJSONSchema(t *testing.T) {
+	schema := EnvironmentSpecJSONSchema()
+	if _, err := json.Marshal(schema); err != nil {
+		t.Fatalf("schema should marshal: %v", err)
+	}
+	equal(t, schema["$ref"].(string), "#/$defs/EnvironmentSpec")
+
+	defs := schema["$defs"].(map[string]interface{})
+	for def, properties := range map[string][]string{
+		"AuthenticationRequirement": {"disabled", "jwt", "oauth", "any", "all"},
+		"JWTAuthentication":         {"name", "issuer", "remote_jwks", "oidc_discovery", "in"},
+		"APIOperationParameter":     {"header", "query", "jwt_claim", "client_certificate", "transformation"},
+	} {
+		props := defs[def].(map[string]interface{})["properties"].(map[string]interface{})
+		for _, p := range properties {
+			if _, ok := props[p]; !ok {
+				t.Errorf("%s should have property %s", def, p)
+			}
+		}
+	}
+	any := defs["AuthenticationRequirement"].(map[string]interface{})["properties"].(map[string]interface{})["any"]
+	items := any.(map[string]interface{})["items"].(map[string]interface{})
+	equal(t, items["$ref"].(string), "#/$defs/AuthenticationRequirement")
+}
+
+func TestUnknownFields(t *testing.T) {
+	tests := []struct {
+		desc    string
+		unknown func([]byte) ([]error, error)
+		yaml    string
+		want    []string
+	}{
+		{"good config", unknownConfigFields, `
+global:
+  api_address: :5000
+  tls:
+    cert_file: cert.pem
+tenant:
+  remote_service_api: https://org-test.apigee.net/remote-service
+  environments:
+  - name: test
+    hosts: [test.example.com]
+`, nil},
+		{"config typos", unknownConfigFields, `
+global:
+  api_adress: :5000
+tenant:
+  remote_service_api: https://org-test.apigee.net/remote-service
+  environments:
+  - name: test
+    host: test.example.com
+foo: bar
+`, []string{
+			"line 3: unknown field global.api_adress",
+			"line 8: unknown field tenant.environments[0].host",
+			"line 9: unknown field foo",
+		}},
+		{"good spec", unknownEnvironmentSpecFields, `
+id: spec
+apis:
+- id: api
+  labels:
+    tier: gold
+  authentication:
+    any:
+    - jwt:
+        name: foo
+        issuer: issuer
+        remote_jwks:
+          url: url
+        in:
+        - header: jwt
+  operations:
+  - name: op
+    consumer_authorization:
+      in:
+      - query: x-api-key
+        transformation:
+          template: "{key}"
+`, nil},
+		{"spec typos", unknownEnvironmentSpecFields, `
+id: spec
+apis:
+- id: api
+  authentication:
+    any:
+    - jwt:
+        name: foo
+        remote_jwk:
+          url: url
+  operations:
+  - name: op
+    consumer_authorization:
+      in:
+      - headr: x-api-key
+`, []string{
+			"line 9: unknown field apis[0].authentication.any[0].jwt.remote_jwk",
+			"line 15: unknown field apis[0].operations[0].consumer_authorization.in[0].headr",
+		}},
+		{"merge keys", unknownEnvironmentSpecFields, `
+id: spec
+apis:
+- id: api-1
+  consumer_authorization: &authz
+    in:
+    - header: x-api-key
+- id: api-2
+  consumer_authorization:
+    <<: *authz
+    fail_open: true
+- id: api-3
+  <<: [{base_path: /v3}, {basepath: /v3}]
+`, []string{
+			"line 13: unknown field apis[2].basepath",
+		}},
+		{"empty", unknownEnvironmentSpecFields, ``, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			errs, err := test.unknown([]byte(test.yaml))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(errs) != len(test.want) {
+				t.Fatalf("want %d unknown fields, got: %v", len(test.want), errs)
+			}
+			for i, e := range errs {
+				equal(t, e.Error(), test.want[i])
+			}
+		})
+	}
+}
+
+func TestUnknownFieldsTestdata(t *testing.T) {
+	for _, f := range []string{"good_env_config.yaml", "envspec/good_env_config.yaml"} {
+		data, err := os.ReadFile(path.Join("testdata", f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		errs, err := unknownEnvironmentSpecFields(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(errs) != 0 {
+			t.Errorf("%s has unknown fields: %v", f, errs)
+		}
+	}
+}
+
+func TestLoadStrictConfig(t *testing.T) {
+	dir := t.TempDir()
+	configFile := path.Join(dir, "config.yaml")
+	configYAML := `
+global:
+  strict_config: true
+  metrics_adress: :5001
+tenant:
+  remote_service_api: https://org-test.apigee.net/remote-service
+  org_name: org
+  env_name: env
+  key: mykey
+  secret: mysecret
+`
+	if err := os.WriteFile(configFile, []byte(configYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := Default()
+	err := c.Load(configFile, "", "", false)
+	if err == nil {
+		t.Fatal("should have gotten error")
+	}
+	want := configFile + ": line 4: unknown field global.metrics_adress"
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("want error containing %q, got: %v", want, err)
+	}
+
+	// not strict, only warned
+	if err := os.WriteFile(configFile, []byte(strings.Replace(configYAML, "true", "false", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c = Default()
+	if err := c.Load(configFile, "", "", false); err != nil {
+		t.Errorf("should not get error: %v", err)
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/oauth2/google"
+)
+
+// Results of verifying the signature of an environment spec source.
+const (
+	SpecSignatureVerified = "verified"
+	SpecSignatureUnsigned = "unsigned" // accepted as signatures aren't required
+	SpecSignatureMissing  = "missing"
+	SpecSignatureInvalid  = "invalid"
+	SpecSignatureReplayed = "replayed" // signed remote content not above the applied version
+)
+
+var (
+	// kmsBaseURL is the Cloud KMS API the public keys of kms_keys are read from
+	kmsBaseURL = "https://cloudkms.googleapis.com/v1/"
+
+	// kmsClient returns the client reading public keys from Cloud KMS
+	kmsClient = func() (*http.Client, error) {
+		return google.DefaultClient(context.Background(), ApigeeAPIScope)
+	}
+)
+
+// SpecSignatures configures verification of the detached signatures of
+// environment spec files and remote sources. A signature is the base64
+// RSA PKCS #1 v1.5 or ECDSA ASN.1 signature of the SHA-256 digest of the
+// content, as made by Cloud KMS or `cosign sign-blob`, or the Ed25519
+// signature of the content, stored next to it with a ".sig" suffix.
+type SpecSignatures struct {
+	// Required refuses spec files without a signature and environment_specs
+	// inline specs, which can't be signed. Invalid signatures are always
+	// refused.
+	Required bool `yaml:"required,omitempty" mapstructure:"required,omitempty"`
+
+	// PublicKeyFiles are PEM public keys, any of which may sign a spec.
+	PublicKeyFiles []string `yaml:"public_key_files,omitempty" mapstructure:"public_key_files,omitempty"`
+
+	// KMSKeys are Cloud KMS asymmetric signing key versions, e.g.
+	// projects/p/locations/l/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1,
+	// whose public keys are read at startup with the default credentials.
+	KMSKeys []string `yaml:"kms_keys,omitempty" mapstructure:"kms_keys,omitempty"`
+}
+
+// configured is true if there are keys to verify with
+func (s SpecSignatures) configured() bool {
+	return len(s.PublicKeyFiles) > 0 || len(s.KMSKeys) > 0
+}
+
+func (s SpecSignatures) validate() error {
+	if s.Required && !s.configured() {
+		return fmt.Errorf("environment_specs.signatures.required needs public_key_files or kms_keys")
+	}
+	for _, k := range s.KMSKeys {
+		if !strings.HasPrefix(k, "projects/") || !strings.Contains(k, "/cryptoKeyVersions/") {
+			return fmt.Errorf("environment_specs.signatures.kms_keys must be key version names, got %q", k)
+		}
+	}
+	return nil
+}
+
+// Verifier loads the keys of s. Returns nil if none are configured.
+func (s SpecSignatures) Verifier() (*SpecVerifier, error) {
+	if !s.configured() {
+		return nil, nil
+	}
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	v := &SpecVerifier{}
+	for _, f := range s.PublicKeyFiles {
+		key, err := readPublicKeyFile(f)
+		if err != nil {
+			return nil, err
+		}
+		v.keys = append(v.keys, key)
+	}
+	if len(s.KMSKeys) > 0 {
+		client, err := kmsClient()
+		if err != nil {
+			return nil, fmt.Errorf("kms_keys credentials: %v", err)
+		}
+		for _, name := range s.KMSKeys {
+			key, err := fetchKMSPublicKey(client, name)
+			if err != nil {
+				return nil, fmt.Errorf("kms key %s: %v", name, err)
+			}
+			v.keys = append(v.keys, key)
+		}
+	}
+	return v, nil
+}
+
+// SpecVerifier verifies spec signatures made by any of its keys.
+type SpecVerifier struct {
+	keys []crypto.PublicKey
+}
+
+// Verify checks the base64 signature of content.
+func (v *SpecVerifier) Verify(content, encoded []byte) error {
+	signature, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(encoded)))
+	if err != nil {
+		return fmt.Errorf("must be base64: %v", err)
+	}
+	for _, key := range v.keys {
+		if verifySignature(key, content, signature) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("verification failed")
+}
+
+// SpecSignatureError refuses specs whose signature is missing or invalid.
+type SpecSignatureError struct {
+	Source string
+	Result string // SpecSignatureMissing, SpecSignatureInvalid, or SpecSignatureReplayed
+	Err    error
+}
+
+func (e *SpecSignatureError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%s: signature %s", e.Source, e.Result)
+	}
+	return fmt.Sprintf("%s: signature %s: %v", e.Source, e.Result, e.Err)
+}
+
+// SpecSignature records the signature verification of a loaded spec source.
+type SpecSignature struct {
+	Source string
+	Result string
+}
+
+// verifyEnvironmentSpecFile checks the signature of the spec file f, read
+// from f with a ".sig" suffix, returning the verification result
+func verifyEnvironmentSpecFile(f string, data []byte, signatures SpecSignatures, verifier *SpecVerifier) (string, error) {
+	encoded, err := os.ReadFile(f + specSourceSignatureSuffix)
+	if os.IsNotExist(err) {
+		if signatures.Required {
+			return SpecSignatureMissing, &SpecSignatureError{Source: f, Result: SpecSignatureMissing}
+		}
+		return SpecSignatureUnsigned, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := verifier.Verify(data, encoded); err != nil {
+		return SpecSignatureInvalid, &SpecSignatureError{Source: f, Result: SpecSignatureInvalid, Err: err}
+	}
+	return SpecSignatureVerified, nil
+}
+
+// fetchKMSPublicKey reads the PEM public key of a Cloud KMS key version
+func fetchKMSPublicKey(client *http.Client, name string) (crypto.PublicKey, error) {
+	resp, err := client.Get(kmsBaseURL + name + "/publicKey")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status: %d", resp.StatusCode)
+	}
+	var publicKey struct {
+		PEM string `json:"pem"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&publicKey); err != nil {
+		return nil, err
+	}
+	return parsePublicKey([]byte(publicKey.PEM))
+}
+
+func readPublicKeyFile(f string) (crypto.PublicKey, error) {
+	pemBytes, err := os.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePublicKey(pemBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", f, err)
+	}
+	return key, nil
+}
+
+// parsePublicKey reads a PEM PKIX public key
+func parsePublicKey(pemBytes []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported public key type %T", key)
+}
+
+func verifySignature(key crypto.PublicKey, content, signature []byte) error {
+	digest := sha256.Sum256(content)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, digest[:], signature) {
+			return fmt.Errorf("verification failed")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, content, signature) {
+			return fmt.Errorf("verification failed")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported public key type %T", key)
+}
@@ -0,0 +1,251 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifySignature(t *testing.T) {
+	content := []byte("id: spec\n")
+	digest := sha256.Sum256(content)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaSig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecSig, err := ecdsa.SignASN1(rand.Reader, ecKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edSig := ed25519.Sign(edKey, content)
+
+	for _, test := range []struct {
+		desc      string
+		key       crypto.PublicKey
+		signature []byte
+	}{
+		{"rsa", &rsaKey.PublicKey, rsaSig},
+		{"ecdsa", &ecKey.PublicKey, ecSig},
+		{"ed25519", edPublic, edSig},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: marshalPublicKey(t, test.key)})
+			key, err := parsePublicKey(pemBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := verifySignature(key, content, test.signature); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if err := verifySignature(key, []byte("id: other\n"), test.signature); err == nil {
+				t.Errorf("want error verifying other content")
+			}
+		})
+	}
+}
+
+func TestSpecVerifierKMS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: marshalPublicKey(t, &key.PublicKey)})
+	name := "projects/p/locations/global/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/"+name+"/publicKey" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"pem": %q, "algorithm": "EC_SIGN_P256_SHA256"}`, pemBytes)
+	}))
+	defer srv.Close()
+	defer func(baseURL string, client func() (*http.Client, error)) {
+		kmsBaseURL, kmsClient = baseURL, client
+	}(kmsBaseURL, kmsClient)
+	kmsBaseURL = srv.URL + "/v1/"
+	kmsClient = func() (*http.Client, error) { return srv.Client(), nil }
+
+	verifier, err := SpecSignatures{KMSKeys: []string{name}}.Verifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("id: spec\n")
+	if err := verifier.Verify(content, signSpec(t, key, content)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := verifier.Verify(content, signSpec(t, other, content)); err == nil {
+		t.Errorf("want error verifying signature of other key")
+	}
+
+	if _, err := (SpecSignatures{KMSKeys: []string{name + "0"}}).Verifier(); err == nil {
+		t.Errorf("want error for unknown key")
+	}
+}
+
+func TestSpecSignaturesValidate(t *testing.T) {
+	tests := []struct {
+		desc       string
+		signatures SpecSignatures
+		want       string
+	}{
+		{"none", SpecSignatures{}, ""},
+		{"required", SpecSignatures{Required: true, PublicKeyFiles: []string{"key.pem"}}, ""},
+		{"required without keys", SpecSignatures{Required: true}, "needs public_key_files or kms_keys"},
+		{"kms key", SpecSignatures{KMSKeys: []string{"projects/p/locations/l/keyRings/r/cryptoKeys/k"}}, "must be key version names"},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			err := test.signatures.validate()
+			if test.want == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("want error containing %q, got: %v", test.want, err)
+			}
+		})
+	}
+}
+
+func TestLoadSignedEnvironmentSpecs(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: marshalPublicKey(t, &key.PublicKey)})
+	if err := os.WriteFile(keyFile, pemBytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+	specFile := filepath.Join(dir, "spec.yaml")
+	spec := []byte("id: signed\n")
+	if err := os.WriteFile(specFile, spec, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	load := func(required bool, inline ...string) (*Config, error) {
+		configFile := filepath.Join(dir, "config.yaml")
+		configYAML := fmt.Sprintf(`
+tenant:
+  remote_service_api: https://org-test.apigee.net/remote-service
+  org_name: org
+  env_name: env
+  key: mykey
+  secret: mysecret
+environment_specs:
+  references:
+  - %s
+  signatures:
+    required: %t
+    public_key_files:
+    - %s
+`, specFile, required, keyFile)
+		if len(inline) > 0 {
+			configYAML += "  inline:\n"
+			for _, id := range inline {
+				configYAML += "  - id: " + id + "\n"
+			}
+		}
+		if err := os.WriteFile(configFile, []byte(configYAML), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c := Default()
+		return c, c.Load(configFile, "", "", false)
+	}
+	checkResult := func(c *Config, want string) {
+		t.Helper()
+		results := c.EnvironmentSpecs.SignatureResults()
+		if len(results) != 1 || results[0].Source != specFile || results[0].Result != want {
+			t.Errorf("want %s signature result, got: %v", want, results)
+		}
+	}
+
+	// unsigned allowed unless required
+	c, err := load(false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	checkResult(c, SpecSignatureUnsigned)
+	_, err = load(true)
+	if sigErr, ok := err.(*SpecSignatureError); !ok || sigErr.Result != SpecSignatureMissing {
+		t.Errorf("want missing signature error, got: %v", err)
+	}
+
+	// verified
+	if err := os.WriteFile(specFile+".sig", signSpec(t, key, spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err = load(true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	checkResult(c, SpecSignatureVerified)
+
+	// inline specs can't be signed
+	if _, err = load(false, "inline"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err = load(true, "inline"); err == nil || !strings.Contains(err.Error(), "environment_specs.inline") {
+		t.Errorf("want inline error, got: %v", err)
+	}
+
+	// invalid is refused even if not required
+	if err := os.WriteFile(specFile, []byte("id: tampered\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = load(false)
+	if sigErr, ok := err.(*SpecSignatureError); !ok || sigErr.Result != SpecSignatureInvalid {
+		t.Errorf("want invalid signature error, got: %v", err)
+	}
+}
+
+func signSpec(t *testing.T, key *ecdsa.PrivateKey, content []byte) []byte {
+	digest := sha256.Sum256(content)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []byte(base64.StdEncoding.EncodeToString(sig))
+}
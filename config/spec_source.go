@@ -0,0 +1,374 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	// DefaultSpecSourcePollInterval is the poll_interval of a RemoteSpecSource if unset.
+	DefaultSpecSourcePollInterval = time.Minute
+
+	specSourceSignatureSuffix = ".sig"
+	specSourceVersionPrefix   = "# version:"
+	specSourceMaxBytes        = 10 << 20
+	gcsReadOnlyScope          = "https://www.googleapis.com/auth/devstorage.read_only"
+	defaultGitRef             = "main"
+)
+
+// specSourceClient fetches RemoteSpecSources
+var specSourceClient = &http.Client{Timeout: 30 * time.Second}
+
+// RemoteSpecSource is a location environment specs are periodically pulled
+// from over HTTPS, allowing spec delivery without redeploying the local files.
+// The content, one or more YAML documents of EnvironmentSpecs, must be signed,
+// see SpecSignatures, and start with a "# version: N" line. N must increase
+// with each change of the content, older or reused versions are refused so a
+// previously signed content can't be replayed.
+type RemoteSpecSource struct {
+	// Git fetches a file at a ref of a Git repository. Exclusive with URL.
+	Git *GitSpecSource `yaml:"git,omitempty" mapstructure:"git,omitempty"`
+
+	// URL of an object: gs://bucket/object, s3://bucket/key, or https://.
+	// Objects in GCS are fetched with the application default credentials,
+	// S3 objects must be readable without signing. Exclusive with Git.
+	URL string `yaml:"url,omitempty" mapstructure:"url,omitempty"`
+
+	// PollInterval between fetches, defaults to DefaultSpecSourcePollInterval.
+	// Unchanged content is detected by ETag.
+	PollInterval time.Duration `yaml:"poll_interval,omitempty" mapstructure:"poll_interval,omitempty"`
+
+	// PublicKeyFile is a PEM public key verifying the signature of the
+	// content, fetched from the content location with a ".sig" suffix.
+	// Defaults to the keys of environment_specs.signatures.
+	PublicKeyFile string `yaml:"public_key_file,omitempty" mapstructure:"public_key_file,omitempty"`
+
+	// TokenFile holds a bearer token sent with each fetch, such as for
+	// private repositories. Not used for gs:// URLs.
+	TokenFile string `yaml:"token_file,omitempty" mapstructure:"token_file,omitempty"`
+
+	// CAFile is a PEM bundle of the CAs trusted in place of the system pool,
+	// such as for internal servers.
+	CAFile string `yaml:"ca_file,omitempty" mapstructure:"ca_file,omitempty"`
+}
+
+// GitSpecSource is a file at a ref of a Git repository, fetched as raw
+// content over HTTPS from GitHub or a GitLab compatible host.
+type GitSpecSource struct {
+	// Repository is the HTTPS URL of the repository, e.g. https://github.com/org/specs.
+	Repository string `yaml:"repository,omitempty" mapstructure:"repository,omitempty"`
+
+	// Ref is a branch, tag or commit, defaults to main.
+	Ref string `yaml:"ref,omitempty" mapstructure:"ref,omitempty"`
+
+	// Path of the file within the repository.
+	Path string `yaml:"path,omitempty" mapstructure:"path,omitempty"`
+}
+
+func (s *RemoteSpecSource) validate(field string) error {
+	if (s.Git == nil) == (s.URL == "") {
+		return fmt.Errorf("%s must have one of git or url", field)
+	}
+	if s.Git != nil && (s.Git.Repository == "" || s.Git.Path == "") {
+		return fmt.Errorf("%s.git must have repository and path", field)
+	}
+	if s.PollInterval < 0 {
+		return fmt.Errorf("%s.poll_interval must not be negative", field)
+	}
+	if _, _, err := s.locations(); err != nil {
+		return fmt.Errorf("%s: %v", field, err)
+	}
+	return nil
+}
+
+// String identifies the source in logs and load events
+func (s *RemoteSpecSource) String() string {
+	if s.Git != nil {
+		ref := s.Git.Ref
+		if ref == "" {
+			ref = defaultGitRef
+		}
+		return fmt.Sprintf("%s@%s:%s", s.Git.Repository, ref, strings.TrimPrefix(s.Git.Path, "/"))
+	}
+	return s.URL
+}
+
+// Interval returns the poll interval, defaulted
+func (s *RemoteSpecSource) Interval() time.Duration {
+	if s.PollInterval <= 0 {
+		return DefaultSpecSourcePollInterval
+	}
+	return s.PollInterval
+}
+
+// locations returns the URLs fetching the content and its signature
+func (s *RemoteSpecSource) locations() (content, signature string, err error) {
+	if s.Git != nil {
+		repo, err := url.Parse(strings.TrimSuffix(strings.TrimSuffix(s.Git.Repository, "/"), ".git"))
+		if err != nil || repo.Scheme != "https" || repo.Host == "" {
+			return "", "", fmt.Errorf("git repository must be an https URL, got %q", s.Git.Repository)
+		}
+		ref := s.Git.Ref
+		if ref == "" {
+			ref = defaultGitRef
+		}
+		file := strings.TrimPrefix(s.Git.Path, "/")
+		if repo.Host == "github.com" {
+			repo.Host = "raw.githubusercontent.com"
+			repo.Path = fmt.Sprintf("%s/%s/%s", repo.Path, ref, file)
+		} else {
+			repo.Path = fmt.Sprintf("%s/-/raw/%s/%s", repo.Path, ref, file)
+		}
+		content = repo.String()
+		repo.Path += specSourceSignatureSuffix
+		return content, repo.String(), nil
+	}
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid url %q: %v", s.URL, err)
+	}
+	object := strings.TrimPrefix(u.Path, "/")
+	switch u.Scheme {
+	case "gs":
+		if u.Host == "" || object == "" {
+			return "", "", fmt.Errorf("url must be gs://bucket/object, got %q", s.URL)
+		}
+		gcs := func(object string) string {
+			return fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s?alt=media",
+				url.PathEscape(u.Host), url.PathEscape(object))
+		}
+		return gcs(object), gcs(object + specSourceSignatureSuffix), nil
+	case "s3":
+		if u.Host == "" || object == "" {
+			return "", "", fmt.Errorf("url must be s3://bucket/key, got %q", s.URL)
+		}
+		content = fmt.Sprintf("https://%s.s3.amazonaws.com/%s", u.Host, object)
+		return content, content + specSourceSignatureSuffix, nil
+	case "https":
+		if u.Host == "" {
+			return "", "", fmt.Errorf("url must be https://host/path, got %q", s.URL)
+		}
+		content = u.String()
+		u.Path += specSourceSignatureSuffix
+		u.RawPath = ""
+		return content, u.String(), nil
+	}
+	return "", "", fmt.Errorf("url scheme must be gs, s3 or https, got %q", s.URL)
+}
+
+// SpecSourceFetcher fetches the verified content of a RemoteSpecSource,
+// skipping content unchanged since the previous fetch.
+type SpecSourceFetcher struct {
+	source    RemoteSpecSource
+	client    *http.Client
+	content   string
+	signature string
+	verifier  *SpecVerifier
+	token     string
+
+	etag    string
+	digest  [sha256.Size]byte
+	version uint64
+}
+
+// NewSpecSourceFetcher creates a SpecSourceFetcher of source, loading its
+// public key and token files. Signatures are verified with the public key
+// of source, if set, otherwise by verifier.
+func NewSpecSourceFetcher(source RemoteSpecSource, verifier *SpecVerifier) (*SpecSourceFetcher, error) {
+	if err := source.validate("environment_specs.remote"); err != nil {
+		return nil, err
+	}
+	f := &SpecSourceFetcher{
+		source:   source,
+		client:   specSourceClient,
+		verifier: verifier,
+	}
+	f.content, f.signature, _ = source.locations()
+
+	if source.PublicKeyFile != "" {
+		key, err := readPublicKeyFile(source.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		f.verifier = &SpecVerifier{keys: []crypto.PublicKey{key}}
+	}
+	if f.verifier == nil {
+		return nil, fmt.Errorf("%s needs a public_key_file or environment_specs.signatures keys", source.String())
+	}
+
+	if source.CAFile != "" {
+		client, err := (&JWKSTLS{CAFile: source.CAFile}).Client(specSourceClient)
+		if err != nil {
+			return nil, fmt.Errorf("%s ca_file: %v", source.String(), err)
+		}
+		f.client = client
+	}
+
+	if source.TokenFile != "" {
+		token, err := os.ReadFile(source.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		f.token = strings.TrimSpace(string(token))
+	}
+
+	if strings.HasPrefix(source.URL, "gs://") {
+		ts, err := google.DefaultTokenSource(context.Background(), gcsReadOnlyScope)
+		if err != nil {
+			return nil, fmt.Errorf("%s credentials: %v", source.String(), err)
+		}
+		f.client = &http.Client{
+			Timeout:   f.client.Timeout,
+			Transport: &oauth2.Transport{Source: ts, Base: f.client.Transport},
+		}
+	}
+	return f, nil
+}
+
+// Source returns the RemoteSpecSource fetched.
+func (f *SpecSourceFetcher) Source() RemoteSpecSource {
+	return f.source
+}
+
+// Fetch returns the content of the source if its signature verifies and its
+// version is above that of the previous content, failing with a
+// SpecSignatureError otherwise. If the content is unchanged since the previous
+// successful fetch, changed is false and content nil.
+func (f *SpecSourceFetcher) Fetch() (content []byte, changed bool, err error) {
+	req, err := f.request(f.content)
+	if err != nil {
+		return nil, false, err
+	}
+	if f.etag != "" {
+		req.Header.Set("If-None-Match", f.etag)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("%s status: %d", f.source.String(), resp.StatusCode)
+	}
+	content, err = readLimited(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	digest := sha256.Sum256(content)
+	if digest == f.digest { // servers without ETags
+		f.etag = resp.Header.Get("ETag")
+		return nil, false, nil
+	}
+
+	if err := f.verify(content); err != nil {
+		return nil, false, err
+	}
+	version, err := specSourceVersion(content)
+	if err != nil {
+		return nil, false, &SpecSignatureError{Source: f.source.String(), Result: SpecSignatureReplayed, Err: err}
+	}
+	if version <= f.version {
+		return nil, false, &SpecSignatureError{Source: f.source.String(), Result: SpecSignatureReplayed,
+			Err: fmt.Errorf("version %d is not above %d", version, f.version)}
+	}
+	f.etag = resp.Header.Get("ETag")
+	f.digest = digest
+	f.version = version
+	return content, true, nil
+}
+
+// specSourceVersion returns the version of the "# version: N" first line of content
+func specSourceVersion(content []byte) (uint64, error) {
+	line := string(content)
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	if !strings.HasPrefix(line, specSourceVersionPrefix) {
+		return 0, fmt.Errorf("content must start with a %q line", specSourceVersionPrefix+" N")
+	}
+	version, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, specSourceVersionPrefix)), 10, 64)
+	if err != nil || version == 0 {
+		return 0, fmt.Errorf("version must be a positive integer, got %q", line)
+	}
+	return version, nil
+}
+
+// verify fetches the signature of content and verifies it
+func (f *SpecSourceFetcher) verify(content []byte) error {
+	req, err := f.request(f.signature)
+	if err != nil {
+		return err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return &SpecSignatureError{Source: f.source.String(), Result: SpecSignatureMissing}
+	default:
+		return fmt.Errorf("%s signature status: %d", f.source.String(), resp.StatusCode)
+	}
+	encoded, err := readLimited(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := f.verifier.Verify(content, encoded); err != nil {
+		return &SpecSignatureError{Source: f.source.String(), Result: SpecSignatureInvalid, Err: err}
+	}
+	return nil
+}
+
+func (f *SpecSourceFetcher) request(u string) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if f.token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.token)
+	}
+	return req, nil
+}
+
+func readLimited(r io.Reader) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, specSourceMaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > specSourceMaxBytes {
+		return nil, fmt.Errorf("content exceeds %d bytes", specSourceMaxBytes)
+	}
+	return b, nil
+}
@@ -0,0 +1,280 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRemoteSpecSourceLocations(t *testing.T) {
+	tests := []struct {
+		desc      string
+		source    RemoteSpecSource
+		content   string
+		signature string
+	}{
+		{"github", RemoteSpecSource{Git: &GitSpecSource{Repository: "https://github.com/org/specs.git", Path: "/envoy/specs.yaml"}},
+			"https://raw.githubusercontent.com/org/specs/main/envoy/specs.yaml",
+			"https://raw.githubusercontent.com/org/specs/main/envoy/specs.yaml.sig"},
+		{"gitlab", RemoteSpecSource{Git: &GitSpecSource{Repository: "https://gitlab.example.com/team/specs", Ref: "v1", Path: "specs.yaml"}},
+			"https://gitlab.example.com/team/specs/-/raw/v1/specs.yaml",
+			"https://gitlab.example.com/team/specs/-/raw/v1/specs.yaml.sig"},
+		{"gcs", RemoteSpecSource{URL: "gs://bucket/dir/specs.yaml"},
+			"https://storage.googleapis.com/storage/v1/b/bucket/o/dir%2Fspecs.yaml?alt=media",
+			"https://storage.googleapis.com/storage/v1/b/bucket/o/dir%2Fspecs.yaml.sig?alt=media"},
+		{"s3", RemoteSpecSource{URL: "s3://bucket/dir/specs.yaml"},
+			"https://bucket.s3.amazonaws.com/dir/specs.yaml",
+			"https://bucket.s3.amazonaws.com/dir/specs.yaml.sig"},
+		{"https", RemoteSpecSource{URL: "https://example.com/specs.yaml?v=1"},
+			"https://example.com/specs.yaml?v=1",
+			"https://example.com/specs.yaml.sig?v=1"},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			content, signature, err := test.source.locations()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			equal(t, content, test.content)
+			equal(t, signature, test.signature)
+		})
+	}
+}
+
+func TestRemoteSpecSourceValidate(t *testing.T) {
+	tests := []struct {
+		desc   string
+		source RemoteSpecSource
+		want   string
+	}{
+		{"good", RemoteSpecSource{URL: "gs://bucket/specs.yaml", PublicKeyFile: "key.pem"}, ""},
+		{"none", RemoteSpecSource{PublicKeyFile: "key.pem"}, "must have one of git or url"},
+		{"both", RemoteSpecSource{URL: "gs://bucket/specs.yaml", Git: &GitSpecSource{}, PublicKeyFile: "key.pem"}, "must have one of git or url"},
+		{"git path", RemoteSpecSource{Git: &GitSpecSource{Repository: "https://github.com/org/specs"}, PublicKeyFile: "key.pem"}, "must have repository and path"},
+		{"git scheme", RemoteSpecSource{Git: &GitSpecSource{Repository: "git@github.com:org/specs", Path: "specs.yaml"}, PublicKeyFile: "key.pem"}, "must be an https URL"},
+		{"scheme", RemoteSpecSource{URL: "ftp://host/specs.yaml", PublicKeyFile: "key.pem"}, "url scheme must be"},
+		{"http", RemoteSpecSource{URL: "http://host/specs.yaml", PublicKeyFile: "key.pem"}, "url scheme must be gs, s3 or https"},
+		{"no object", RemoteSpecSource{URL: "s3://bucket", PublicKeyFile: "key.pem"}, "must be s3://bucket/key"},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			err := test.source.validate("remote")
+			if test.want == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("want error containing %q, got: %v", test.want, err)
+			}
+		})
+	}
+}
+
+func TestSpecSourceFetcher(t *testing.T) {
+	srv, keyFile := newSignedSpecServer(t)
+	srv.set("# version: 1\nid: spec-1\n", true)
+
+	f, err := NewSpecSourceFetcher(RemoteSpecSource{URL: srv.URL + "/specs.yaml", PublicKeyFile: keyFile, CAFile: srv.caFile}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, changed, err := f.Fetch()
+	if err != nil || !changed || string(content) != "# version: 1\nid: spec-1\n" {
+		t.Fatalf("want changed spec-1, got %q, %t, %v", content, changed, err)
+	}
+
+	// unchanged by ETag
+	if content, changed, err = f.Fetch(); err != nil || changed || content != nil {
+		t.Errorf("want unchanged, got %q, %t, %v", content, changed, err)
+	}
+	if got := srv.notModified(); got != 1 {
+		t.Errorf("want 1 not modified response, got %d", got)
+	}
+
+	// bad signature is not applied, retried on next fetch
+	srv.set("# version: 2\nid: spec-2\n", false)
+	if _, _, err = f.Fetch(); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Errorf("want signature error, got: %v", err)
+	}
+	srv.set("# version: 2\nid: spec-2\n", true)
+	if content, changed, err = f.Fetch(); err != nil || !changed || string(content) != "# version: 2\nid: spec-2\n" {
+		t.Errorf("want changed spec-2, got %q, %t, %v", content, changed, err)
+	}
+
+	// replayed or unversioned signed content is refused
+	for _, replay := range []string{"# version: 1\nid: spec-1\n", "# version: 2\nid: spec-3\n", "id: spec-3\n"} {
+		srv.set(replay, true)
+		_, _, err = f.Fetch()
+		var signatureErr *SpecSignatureError
+		if !errors.As(err, &signatureErr) || signatureErr.Result != SpecSignatureReplayed {
+			t.Errorf("%q want replayed error, got: %v", replay, err)
+		}
+	}
+	srv.set("# version: 3\nid: spec-3\n", true)
+	if _, changed, err = f.Fetch(); err != nil || !changed {
+		t.Errorf("want changed spec-3, got %t, %v", changed, err)
+	}
+
+	// https only
+	if _, err := NewSpecSourceFetcher(RemoteSpecSource{URL: "http://example.com/specs.yaml", PublicKeyFile: keyFile}, nil); err == nil {
+		t.Errorf("want error for http url")
+	}
+}
+
+func TestLoadRemoteEnvironmentSpecs(t *testing.T) {
+	srv, keyFile := newSignedSpecServer(t)
+	srv.set("# version: 1\nid: remote-1\n---\nid: remote-2\n", true)
+
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	configYAML := fmt.Sprintf(`
+tenant:
+  remote_service_api: https://org-test.apigee.net/remote-service
+  org_name: org
+  env_name: env
+  key: mykey
+  secret: mysecret
+environment_specs:
+  references:
+  - ./testdata/good_env_config.yaml
+  remote:
+  - url: %s/specs.yaml
+    public_key_file: %s
+    ca_file: %s
+`, srv.URL, keyFile, srv.caFile)
+	if err := os.WriteFile(configFile, []byte(configYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := Default()
+	if err := c.Load(configFile, "", "", false); err != nil {
+		t.Fatalf("c.Load() returns unexpected: %v", err)
+	}
+	if l := len(c.EnvironmentSpecs.Inline); l != 3 {
+		t.Fatalf("want 3 environment specs, got %d", l)
+	}
+	local := c.EnvironmentSpecs.Local()
+	if len(local) != 1 || local[0].ID != "good-env-config" {
+		t.Errorf("unexpected local specs: %v", local)
+	}
+	remote := c.EnvironmentSpecs.RemoteSpecs()
+	if len(remote) != 1 || len(remote[0].Specs) != 2 || remote[0].Specs[1].ID != "remote-2" {
+		t.Errorf("unexpected remote specs: %v", remote)
+	}
+
+	// remote specs are validated with the local ones
+	srv.set("# version: 2\nid: good-env-config\n", true)
+	c = Default()
+	if err := c.Load(configFile, "", "", false); err == nil || !strings.Contains(err.Error(), "multiple good-env-config") {
+		t.Errorf("want duplicate ID error, got: %v", err)
+	}
+}
+
+func marshalPublicKey(t *testing.T, key crypto.PublicKey) []byte {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// signedSpecServer serves /specs.yaml with an ETag and its signature over TLS
+type signedSpecServer struct {
+	*httptest.Server
+	key    *ecdsa.PrivateKey
+	caFile string
+
+	mu        sync.Mutex
+	content   string
+	signature string
+	notMod    int
+}
+
+// newSignedSpecServer starts a signedSpecServer, returning the file of its public key
+func newSignedSpecServer(t *testing.T) (*signedSpecServer, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: marshalPublicKey(t, &key.PublicKey)})
+	if err := os.WriteFile(keyFile, pemBytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &signedSpecServer{key: key}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		etag := fmt.Sprintf(`"%x"`, sha256.Sum256([]byte(s.content)))
+		switch r.URL.Path {
+		case "/specs.yaml":
+			if r.Header.Get("If-None-Match") == etag {
+				s.notMod++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", etag)
+			_, _ = w.Write([]byte(s.content))
+		case "/specs.yaml.sig":
+			_, _ = w.Write([]byte(s.signature))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(s.Close)
+	s.caFile = filepath.Join(t.TempDir(), "ca.pem")
+	caBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+	if err := os.WriteFile(s.caFile, caBytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return s, keyFile
+}
+
+// set serves content, signed with the server key if valid or else another key
+func (s *signedSpecServer) set(content string, valid bool) {
+	key := s.key
+	if !valid {
+		key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	digest := sha256.Sum256([]byte(content))
+	sig, _ := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.content = content
+	s.signature = base64.StdEncoding.EncodeToString(sig)
+}
+
+func (s *signedSpecServer) notModified() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.notMod
+}
@@ -0,0 +1,183 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/transform"
+)
+
+// validateTransformReferences checks the variables referenced by the
+// HTTPRequestTransforms templates and conditions of the API and its
+// operations can be bound for each operation they apply to. Must be called
+// once the JWT authentications of the API and operations are validated.
+func validateTransformReferences(api *APISpec) error {
+	var inheriting []*APIOperation
+	for i := range api.Operations {
+		op := &api.Operations[i]
+		if op.HTTPRequestTransforms.isEmpty() {
+			inheriting = append(inheriting, op)
+			continue
+		}
+		where := fmt.Sprintf("API %q operation %q", api.ID, op.Name)
+		if err := validateTransformsReferences(where, op.HTTPRequestTransforms, api, []*APIOperation{op}); err != nil {
+			return err
+		}
+	}
+	if len(api.Operations) == 0 {
+		inheriting = []*APIOperation{defaultOperation}
+	}
+	return validateTransformsReferences(fmt.Sprintf("API %q", api.ID), api.HTTPRequestTransforms, api, inheriting)
+}
+
+func validateTransformsReferences(where string, t HTTPRequestTransforms, api *APISpec, ops []*APIOperation) error {
+	check := func(field, template, condition string) error {
+		if template != "" {
+			parsed, err := transform.Parse(template)
+			if err != nil {
+				return fmt.Errorf("%s %s %q: %v", where, field, template, err)
+			}
+			for _, part := range parsed.Parts {
+				if part.Variable == nil {
+					continue
+				}
+				if err := checkTransformVariable(part.Variable.Name, false, api, ops); err != nil {
+					return fmt.Errorf("%s %s references {%s}: %v", where, field, part.Variable.Name, err)
+				}
+			}
+		}
+		if condition != "" {
+			parsed, err := transform.ParseCondition(condition)
+			if err != nil {
+				return fmt.Errorf("%s %s invalid condition %q: %v", where, field, condition, err)
+			}
+			for _, name := range parsed.Variables() {
+				if err := checkTransformVariable(name, true, api, ops); err != nil {
+					return fmt.Errorf("%s %s condition references %s: %v", where, field, name, err)
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := check("path transform", t.PathTransform, ""); err != nil {
+		return err
+	}
+	for _, a := range t.HeaderTransforms.Add {
+		if err := check(fmt.Sprintf("header transform %q", a.Name), a.Value, a.Condition); err != nil {
+			return err
+		}
+	}
+	for _, a := range t.QueryTransforms.Add {
+		if err := check(fmt.Sprintf("query transform %q", a.Name), a.Value, a.Condition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTransformVariable returns an error if the variable cannot be bound for
+// each of the operations. The api, operation, and jwt namespaces are only
+// available to conditions.
+func checkTransformVariable(name string, condition bool, api *APISpec, ops []*APIOperation) error {
+	splits := strings.SplitN(name, VariableNamespaceSeparator, 2)
+	if len(splits) < 2 || splits[1] == "" {
+		return fmt.Errorf("variables must be namespaced, eg. headers.name")
+	}
+	namespace, key := splits[0], splits[1]
+	switch namespace {
+	case RequestNamespace:
+		if key != RequestPath && key != RequestQuerystring {
+			return fmt.Errorf("request variables are %s and %s", RequestPath, RequestQuerystring)
+		}
+	case QueryNamespace, HeaderNamespace, EnvNamespace, PodNamespace:
+	case PathNamespace:
+		for _, op := range ops {
+			if !bindsPathVariable(op, key) {
+				return fmt.Errorf("not a path template variable of operation %q", op.Name)
+			}
+		}
+	case LabelsNamespace:
+		for _, op := range ops {
+			if _, ok := api.Labels[key]; ok {
+				continue
+			}
+			if _, ok := op.Labels[key]; !ok {
+				return fmt.Errorf("not a label of the API or operation %q", op.Name)
+			}
+		}
+	case KVMNamespace:
+		if s := strings.SplitN(key, VariableNamespaceSeparator, 2); len(s) < 2 || s[0] == "" || s[1] == "" {
+			return fmt.Errorf("kvm variables must be named kvm.map.key")
+		}
+	case APINamespace, OperationNamespace, JWTNamespace:
+		if !condition {
+			return fmt.Errorf("%s variables are only available to conditions", namespace)
+		}
+		switch namespace {
+		case APINamespace:
+			if key != "id" {
+				return fmt.Errorf("api variable is api.id")
+			}
+		case OperationNamespace:
+			if key != "name" {
+				return fmt.Errorf("operation variable is operation.name")
+			}
+		case JWTNamespace:
+			s := strings.SplitN(key, VariableNamespaceSeparator, 2)
+			if len(s) < 2 || s[1] == "" {
+				return fmt.Errorf("jwt variables must be named jwt.requirement.claim")
+			}
+			for _, op := range ops {
+				if _, ok := api.jwtAuthentications[s[0]]; ok {
+					continue
+				}
+				if _, ok := op.jwtAuthentications[s[0]]; !ok {
+					return fmt.Errorf("JWT requirement %q does not exist for operation %q", s[0], op.Name)
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("unknown namespace %q", namespace)
+	}
+	return nil
+}
+
+// bindsPathVariable returns true if each of the path templates of the
+// operation declares the variable
+func bindsPathVariable(op *APIOperation, name string) bool {
+	if len(op.HTTPMatches) == 0 {
+		return false
+	}
+	for _, m := range op.HTTPMatches {
+		t, err := transform.Parse(m.PathTemplate)
+		if err != nil {
+			return false
+		}
+		found := false
+		for _, part := range t.Parts {
+			if part.Variable != nil && strings.SplitN(part.Variable.Name, "=", 2)[0] == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
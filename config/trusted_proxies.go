@@ -0,0 +1,125 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ForwardedForHeader lists the addresses of a request's proxy chain.
+const ForwardedForHeader = "x-forwarded-for"
+
+// TrustedProxies are the proxies and CDNs in front of Envoy whose
+// x-forwarded-for hops are trusted when resolving the client address of a
+// request for analytics and IP-based policies.
+type TrustedProxies struct {
+	// CIDRs of the trusted proxies, eg. 10.0.0.0/8. The client address is
+	// the rightmost address of the downstream address and x-forwarded-for
+	// hops not in a CIDR. If empty, policies use the downstream address and
+	// analytics the x-forwarded-for header as is.
+	CIDRs []string `yaml:"cidrs,omitempty" mapstructure:"cidrs,omitempty"`
+}
+
+func (t TrustedProxies) validate() error {
+	for _, cidr := range t.CIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("trusted_proxies.cidrs must be CIDRs, got %q", cidr)
+		}
+	}
+	return nil
+}
+
+// ProxyChain resolves the client addresses of requests forwarded by the
+// TrustedProxies. Create using NewProxyChain().
+type ProxyChain struct {
+	trusted []*net.IPNet
+}
+
+// NewProxyChain returns nil if no proxies are trusted.
+func NewProxyChain(t TrustedProxies) (*ProxyChain, error) {
+	if len(t.CIDRs) == 0 {
+		return nil, nil
+	}
+	p := &ProxyChain{}
+	for _, cidr := range t.CIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy: %v", err)
+		}
+		p.trusted = append(p.trusted, ipNet)
+	}
+	return p, nil
+}
+
+// ClientIP returns the rightmost of the forwardedFor hops and the downstream
+// address not of a trusted proxy, the leftmost if all are. A hop that isn't
+// an address ends the chain at the trusted proxy that forwarded it. An empty
+// downstream address is omitted. Returns downstream if p is nil.
+func (p *ProxyChain) ClientIP(downstream, forwardedFor string) string {
+	if p == nil {
+		return downstream
+	}
+	var hops []string
+	if strings.TrimSpace(forwardedFor) != "" {
+		hops = strings.Split(forwardedFor, ",")
+	}
+	if downstream != "" {
+		hops = append(hops, downstream)
+	}
+	client := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHop(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		client = ip.String()
+		if !p.trusts(ip) {
+			break
+		}
+	}
+	return client
+}
+
+func (p *ProxyChain) trusts(ip net.IP) bool {
+	for _, ipNet := range p.trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHop parses an address with an optional port, nil if invalid
+func parseHop(hop string) net.IP {
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]"))
+}
+
+// SetProxyChain sets the chain resolving the client addresses of requests.
+func (e *EnvironmentSpecExt) SetProxyChain(chain *ProxyChain) {
+	e.proxyChain = chain
+}
+
+// ClientIP returns the client address of the request, resolved by the proxy
+// chain if set, else the downstream address.
+func (e *EnvironmentSpecRequest) ClientIP() string {
+	attrs := e.Request.GetAttributes()
+	downstream := attrs.GetSource().GetAddress().GetSocketAddress().GetAddress()
+	return e.proxyChain.ClientIP(downstream, attrs.GetRequest().GetHttp().GetHeaders()[ForwardedForHeader])
+}
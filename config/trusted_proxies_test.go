@@ -0,0 +1,122 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	"github.com/apigee/apigee-remote-service-golib/v2/errorset"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+)
+
+func TestProxyChainClientIP(t *testing.T) {
+	chain, err := NewProxyChain(TrustedProxies{CIDRs: []string{"10.0.0.0/8", "2001:db8::/32"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		desc         string
+		downstream   string
+		forwardedFor string
+		want         string
+	}{
+		{"direct", "192.0.2.1", "", "192.0.2.1"},
+		{"untrusted downstream", "192.0.2.1", "198.51.100.1", "192.0.2.1"},
+		{"one proxy", "10.0.0.1", "198.51.100.1", "198.51.100.1"},
+		{"proxy chain", "10.0.0.1", "203.0.113.9, 198.51.100.1, 10.1.1.1", "198.51.100.1"},
+		{"spoofed leftmost", "10.0.0.1", "1.1.1.1,198.51.100.1", "198.51.100.1"},
+		{"all trusted", "10.0.0.1", "10.2.2.2, 10.1.1.1", "10.2.2.2"},
+		{"ports", "10.0.0.1", "198.51.100.1:5000, [2001:db8::1]:443", "198.51.100.1"},
+		{"ipv6", "2001:db8::2", "2001:db9::1", "2001:db9::1"},
+		{"invalid hop", "10.0.0.1", "198.51.100.1, unknown, 10.1.1.1", "10.1.1.1"},
+		{"no downstream", "", "198.51.100.1, 10.1.1.1", "198.51.100.1"},
+		{"nothing", "", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			if got := chain.ClientIP(test.downstream, test.forwardedFor); got != test.want {
+				t.Errorf("want %q, got %q", test.want, got)
+			}
+		})
+	}
+
+	var untrusted *ProxyChain
+	if got := untrusted.ClientIP("192.0.2.1", "198.51.100.1"); got != "192.0.2.1" {
+		t.Errorf("want downstream without trusted proxies, got %q", got)
+	}
+	if chain, err := NewProxyChain(TrustedProxies{}); chain != nil || err != nil {
+		t.Errorf("want no chain and no error, got %v, %v", chain, err)
+	}
+}
+
+func TestValidateTrustedProxies(t *testing.T) {
+	config := Default()
+	config.Tenant = Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		EnvName:          "env",
+		Key:              "key",
+		Secret:           "secret",
+	}
+	config.TrustedProxies.CIDRs = []string{"10.0.0.0/8", "10.0.0.1"}
+	err := config.Validate(true)
+	if err == nil {
+		t.Fatal("should have gotten errors")
+	}
+	merr := err.(*errorset.Error)
+	if merr.Len() != 1 {
+		t.Fatalf("got %d errors, want: 1, errors: %s", merr.Len(), merr)
+	}
+	equal(t, merr.Errors[0].Error(), `trusted_proxies.cidrs must be CIDRs, got "10.0.0.1"`)
+}
+
+func TestQuotaExemptionBehindTrustedProxy(t *testing.T) {
+	envSpec := createGoodEnvSpec()
+	envSpec.APIs[0].QuotaExemptions = []QuotaExemption{{Name: "office", IPRanges: []string{"198.51.100.0/24"}}}
+	specExt, err := NewEnvironmentSpecExt(&envSpec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	envoyReq := testutil.NewEnvoyRequest(http.MethodGet, "/v1/petstore", map[string]string{
+		ForwardedForHeader: "198.51.100.7",
+	}, nil)
+	envoyReq.Attributes.Source = &authv3.AttributeContext_Peer{
+		Address: &corev3.Address{Address: &corev3.Address_SocketAddress{
+			SocketAddress: &corev3.SocketAddress{Address: "10.0.0.1"},
+		}},
+	}
+
+	req := NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
+	if x := req.MatchQuotaExemption(""); x != nil {
+		t.Errorf("want no exemption of the proxy, got %q", x.Name)
+	}
+
+	chain, err := NewProxyChain(TrustedProxies{CIDRs: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	specExt.SetProxyChain(chain)
+	req = NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
+	if got := req.ClientIP(); got != "198.51.100.7" {
+		t.Errorf("want client IP %q, got %q", "198.51.100.7", got)
+	}
+	if x := req.MatchQuotaExemption(""); x == nil || x.Name != "office" {
+		t.Errorf("want office exemption, got %v", x)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cors evaluates CORS requests against compiled policies.
+package cors
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// CORS request and response headers.
+const (
+	OriginHeader                = "origin"
+	RequestMethodHeader         = "access-control-request-method"
+	RequestHeadersHeader        = "access-control-request-headers"
+	RequestPrivateNetworkHeader = "access-control-request-private-network"
+
+	VaryHeader                = "vary"
+	AllowOriginHeader         = "access-control-allow-origin"
+	AllowHeadersHeader        = "access-control-allow-headers"
+	AllowMethodsHeader        = "access-control-allow-methods"
+	ExposeHeadersHeader       = "access-control-expose-headers"
+	MaxAgeHeader              = "access-control-max-age"
+	AllowCredentialsHeader    = "access-control-allow-credentials"
+	AllowPrivateNetworkHeader = "access-control-allow-private-network"
+
+	OriginWildcard = "*"
+	VaryOrigin     = "Origin"
+	TrueValue      = "true"
+)
+
+// Options are the settings of a Policy.
+type Options struct {
+	// AllowOrigins are allowed if they exactly match the origin. "*" allows
+	// any origin as a last resort.
+	AllowOrigins []string
+	// AllowOriginsRegexes are RE2 patterns of allowed origins.
+	AllowOriginsRegexes []string
+	// AllowHeaders, AllowMethods and ExposeHeaders are sent as their
+	// Access-Control-* headers.
+	AllowHeaders  []string
+	AllowMethods  []string
+	ExposeHeaders []string
+	// MaxAge is the seconds a preflight may be cached, 0 to omit.
+	MaxAge int
+	// AllowCredentials is forced off for the wildcard origin.
+	AllowCredentials bool
+	// AllowPrivateNetwork answers preflights requesting private network
+	// access from public origins.
+	AllowPrivateNetwork bool
+}
+
+// Header is a CORS response header.
+type Header struct {
+	Name  string
+	Value string
+}
+
+// Policy is a compiled CORS policy. Create using Compile().
+type Policy struct {
+	origins             map[string]bool
+	regexes             []*regexp.Regexp
+	vary                bool
+	headers             []Header // static headers following the origin
+	allowCredentials    bool
+	allowPrivateNetwork bool
+}
+
+// Compile returns the Policy of the Options, nil if the Options allow no
+// origins.
+func Compile(o Options) (*Policy, error) {
+	if len(o.AllowOrigins) == 0 && len(o.AllowOriginsRegexes) == 0 {
+		return nil, nil
+	}
+	if o.MaxAge < 0 {
+		return nil, fmt.Errorf("max_age must not be negative")
+	}
+	p := &Policy{
+		origins:             make(map[string]bool, len(o.AllowOrigins)),
+		allowCredentials:    o.AllowCredentials,
+		allowPrivateNetwork: o.AllowPrivateNetwork,
+	}
+	wildcard := false
+	for _, origin := range o.AllowOrigins {
+		p.origins[origin] = true
+		wildcard = wildcard || origin == OriginWildcard
+	}
+	for _, r := range o.AllowOriginsRegexes {
+		re, err := regexp.Compile(r)
+		if err != nil {
+			return nil, fmt.Errorf("allow_origins_regexes %q: %v", r, err)
+		}
+		p.regexes = append(p.regexes, re)
+	}
+	p.vary = wildcard || len(o.AllowOriginsRegexes) > 0 || len(o.AllowOrigins) > 1
+
+	appendIfNotEmpty := func(name string, values []string) {
+		if len(values) == 0 || values[0] == "" {
+			return
+		}
+		p.headers = append(p.headers, Header{name, strings.Join(values, ",")})
+	}
+	appendIfNotEmpty(AllowHeadersHeader, o.AllowHeaders)
+	appendIfNotEmpty(AllowMethodsHeader, o.AllowMethods)
+	appendIfNotEmpty(ExposeHeadersHeader, o.ExposeHeaders)
+	if o.MaxAge > 0 {
+		p.headers = append(p.headers, Header{MaxAgeHeader, strconv.Itoa(o.MaxAge)})
+	}
+	return p, nil
+}
+
+// AllowedOrigin returns the Access-Control-Allow-Origin value for the origin
+// ("" to not set) and whether `Vary: Origin` should be set as the value
+// depends on the origin.
+func (p *Policy) AllowedOrigin(origin string) (allowed string, vary bool) {
+	if p == nil || origin == "" {
+		return "", false
+	}
+	if p.origins[origin] {
+		return origin, p.vary
+	}
+	for _, re := range p.regexes {
+		if re.MatchString(origin) {
+			return origin, p.vary
+		}
+	}
+	if p.origins[OriginWildcard] {
+		return OriginWildcard, p.vary
+	}
+	return "", p.vary
+}
+
+// ResponseHeaders returns the CORS response headers of a request of the origin.
+// Private network access is only allowed for preflights requesting it.
+func (p *Policy) ResponseHeaders(origin string, preflight bool, requestHeaders map[string]string) []Header {
+	if p == nil || origin == "" {
+		return nil
+	}
+	var headers []Header
+	allowed, vary := p.AllowedOrigin(origin)
+	if allowed != "" {
+		headers = append(headers, Header{AllowOriginHeader, allowed})
+	}
+	if vary {
+		headers = append(headers, Header{VaryHeader, VaryOrigin})
+	}
+	headers = append(headers, p.headers...)
+	if p.allowCredentials && allowed != OriginWildcard {
+		headers = append(headers, Header{AllowCredentialsHeader, TrueValue})
+	}
+	if p.allowPrivateNetwork && preflight && allowed != "" && requestHeaders[RequestPrivateNetworkHeader] == TrueValue {
+		headers = append(headers, Header{AllowPrivateNetworkHeader, TrueValue})
+	}
+	return headers
+}
@@ -0,0 +1,192 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cors
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		desc    string
+		options Options
+		wantNil bool
+		wantErr string
+	}{
+		{"empty", Options{AllowHeaders: []string{"x"}}, true, ""},
+		{"origins", Options{AllowOrigins: []string{"https://a"}}, false, ""},
+		{"regexes", Options{AllowOriginsRegexes: []string{"^https://.*"}}, false, ""},
+		{"bad regex", Options{AllowOriginsRegexes: []string{"("}}, true, "allow_origins_regexes \"(\": error parsing regexp: missing closing ): `(`"},
+		{"negative max age", Options{AllowOrigins: []string{"*"}, MaxAge: -1}, true, "max_age must not be negative"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			p, err := Compile(test.options)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Errorf("want error %q, got %v", test.wantErr, err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if test.wantNil != (p == nil) {
+				t.Errorf("want nil %t, got %v", test.wantNil, p)
+			}
+		})
+	}
+}
+
+func TestAllowedOrigin(t *testing.T) {
+	tests := []struct {
+		desc       string
+		options    Options
+		origin     string
+		wantOrigin string
+		wantVary   bool
+	}{
+		{"single", Options{AllowOrigins: []string{"https://a"}}, "https://a", "https://a", false},
+		{"single mismatch", Options{AllowOrigins: []string{"https://a"}}, "https://b", "", false},
+		{"multiple", Options{AllowOrigins: []string{"https://a", "https://b"}}, "https://b", "https://b", true},
+		{"wildcard", Options{AllowOrigins: []string{"*"}}, "https://a", "*", true},
+		{"exact before wildcard", Options{AllowOrigins: []string{"*", "https://a"}}, "https://a", "https://a", true},
+		{"regex", Options{AllowOriginsRegexes: []string{`^https://.*\.example\.com$`}}, "https://a.example.com", "https://a.example.com", true},
+		{"regex mismatch", Options{AllowOriginsRegexes: []string{`^https://.*\.example\.com$`}}, "https://example.org", "", true},
+		{"no origin", Options{AllowOrigins: []string{"*"}}, "", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			p, err := Compile(test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			origin, vary := p.AllowedOrigin(test.origin)
+			if test.wantOrigin != origin {
+				t.Errorf("want origin %q, got %q", test.wantOrigin, origin)
+			}
+			if test.wantVary != vary {
+				t.Errorf("want vary %t, got %t", test.wantVary, vary)
+			}
+		})
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	full := Options{
+		AllowOrigins:        []string{"https://a"},
+		AllowHeaders:        []string{"x-a", "x-b"},
+		AllowMethods:        []string{"GET"},
+		ExposeHeaders:       []string{"x-c"},
+		MaxAge:              60,
+		AllowCredentials:    true,
+		AllowPrivateNetwork: true,
+	}
+	privateNetwork := map[string]string{RequestPrivateNetworkHeader: "true"}
+
+	tests := []struct {
+		desc           string
+		options        Options
+		origin         string
+		preflight      bool
+		requestHeaders map[string]string
+		want           []Header
+	}{
+		{
+			desc:    "full",
+			options: full,
+			origin:  "https://a",
+			want: []Header{
+				{AllowOriginHeader, "https://a"},
+				{AllowHeadersHeader, "x-a,x-b"},
+				{AllowMethodsHeader, "GET"},
+				{ExposeHeadersHeader, "x-c"},
+				{MaxAgeHeader, "60"},
+				{AllowCredentialsHeader, "true"},
+			},
+		},
+		{
+			desc:           "private network preflight",
+			options:        Options{AllowOrigins: []string{"https://a"}, AllowPrivateNetwork: true},
+			origin:         "https://a",
+			preflight:      true,
+			requestHeaders: privateNetwork,
+			want: []Header{
+				{AllowOriginHeader, "https://a"},
+				{AllowPrivateNetworkHeader, "true"},
+			},
+		},
+		{
+			desc:           "private network not preflight",
+			options:        Options{AllowOrigins: []string{"https://a"}, AllowPrivateNetwork: true},
+			origin:         "https://a",
+			requestHeaders: privateNetwork,
+			want:           []Header{{AllowOriginHeader, "https://a"}},
+		},
+		{
+			desc:           "private network not allowed",
+			options:        Options{AllowOrigins: []string{"https://a"}},
+			origin:         "https://a",
+			preflight:      true,
+			requestHeaders: privateNetwork,
+			want:           []Header{{AllowOriginHeader, "https://a"}},
+		},
+		{
+			desc:           "private network origin not allowed",
+			options:        Options{AllowOrigins: []string{"https://a"}, AllowPrivateNetwork: true},
+			origin:         "https://b",
+			preflight:      true,
+			requestHeaders: privateNetwork,
+		},
+		{
+			desc:    "wildcard without credentials",
+			options: Options{AllowOrigins: []string{"*"}, AllowCredentials: true},
+			origin:  "https://a",
+			want: []Header{
+				{AllowOriginHeader, "*"},
+				{VaryHeader, VaryOrigin},
+			},
+		},
+		{
+			desc:    "no origin",
+			options: full,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			p, err := Compile(test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := p.ResponseHeaders(test.origin, test.preflight, test.requestHeaders)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNilPolicy(t *testing.T) {
+	var p *Policy
+	if origin, vary := p.AllowedOrigin("https://a"); origin != "" || vary {
+		t.Errorf("want no origin, got %q %t", origin, vary)
+	}
+	if headers := p.ResponseHeaders("https://a", true, nil); headers != nil {
+		t.Errorf("want no headers, got %v", headers)
+	}
+}
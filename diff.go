@@ -0,0 +1,77 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/spf13/cobra"
+)
+
+// diffCmd compares two environment spec files and prints the changes
+// that affect request policy.
+func diffCmd() *cobra.Command {
+	var failOnWeaken bool
+	cmd := &cobra.Command{
+		Use:   "diff OLD_SPEC NEW_SPEC",
+		Short: "Report policy-affecting changes between two environment spec files",
+		Args:  cobra.ExactArgs(2),
+		// errors are logged by main
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			oldSpec, err := config.ReadEnvironmentSpec(args[0])
+			if err != nil {
+				return fmt.Errorf("unable to read %s: %v", args[0], err)
+			}
+			newSpec, err := config.ReadEnvironmentSpec(args[1])
+			if err != nil {
+				return fmt.Errorf("unable to read %s: %v", args[1], err)
+			}
+			if err := config.ValidateEnvironmentSpecs([]config.EnvironmentSpec{newSpec}); err != nil {
+				return fmt.Errorf("invalid %s: %v", args[1], err)
+			}
+
+			changes := config.DiffEnvironmentSpecs(oldSpec, newSpec)
+			weakened := printSpecChanges(cmd.OutOrStdout(), changes)
+			if failOnWeaken && weakened > 0 {
+				return fmt.Errorf("%d change(s) weaken authentication or authorization", weakened)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&failOnWeaken, "fail-on-weaken", false, "Exit with an error if any operation's authentication or authorization is weakened")
+	return cmd
+}
+
+// printSpecChanges writes one line per change, marking those that weaken
+// protection with "!", and returns the number of weakening changes.
+func printSpecChanges(w io.Writer, changes []config.EnvironmentSpecChange) (weakened int) {
+	if len(changes) == 0 {
+		fmt.Fprintln(w, "no policy-affecting changes")
+		return 0
+	}
+	for _, c := range changes {
+		mark := " "
+		if c.Weakens() {
+			mark = "!"
+			weakened++
+		}
+		fmt.Fprintf(w, "%s %s\n", mark, c)
+	}
+	return weakened
+}
@@ -0,0 +1,115 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/server"
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/encoding/protojson"
+	"gopkg.in/yaml.v3"
+)
+
+// envoyConfigCmd prints the Envoy bootstrap routing the APIs of environment
+// spec files through this adapter, so that the Envoy config doesn't have to
+// be kept in agreement with the specs by hand.
+func envoyConfigCmd() *cobra.Command {
+	opts := server.EnvoyConfigOptions{}
+	var asJSON bool
+	cmd := &cobra.Command{
+		Use:   "envoy-config SPEC...",
+		Short: "Print the Envoy config of the APIs of environment spec files",
+		Args:  cobra.MinimumNArgs(1),
+		// errors are logged by main
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			cfg := config.Default()
+			var specs []config.EnvironmentSpec
+			for _, f := range args {
+				data, err := os.ReadFile(f)
+				if err != nil {
+					return fmt.Errorf("unable to read %s: %v", f, err)
+				}
+				fileSpecs, err := cfg.DecodeEnvironmentSpecs(f, data)
+				if err != nil {
+					return err
+				}
+				specs = append(specs, fileSpecs...)
+			}
+			if err := config.ValidateEnvironmentSpecs(specs); err != nil {
+				return err
+			}
+
+			bootstrap, err := server.GenerateEnvoyConfig(specs, opts)
+			if err != nil {
+				return err
+			}
+			b, err := protojson.MarshalOptions{Multiline: true, Indent: "  "}.Marshal(bootstrap)
+			if err != nil {
+				return err
+			}
+			if asJSON {
+				b = append(b, '\n')
+			} else if b, err = jsonToYAML(b); err != nil {
+				return err
+			}
+			fmt.Fprint(cmd.OutOrStdout(), string(b))
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&opts.ListenerAddress, "listener-address", "0.0.0.0:8080", "Address Envoy listens on")
+	cmd.Flags().StringVar(&opts.AdapterAddress, "adapter-address", "localhost:5000", "gRPC address of this adapter")
+	cmd.Flags().StringVar(&opts.TargetAddress, "target-address", "", "Address the APIs are routed to")
+	cmd.Flags().StringVar(&opts.Environment, "environment", "", "Apigee environment of the routes, for multi-tenant configs")
+	cmd.Flags().StringVar(&opts.NodeID, "node", "", "Envoy node ID, only specs and APIs in its gateway scope are routed")
+	cmd.Flags().StringVar(&opts.Cluster, "cluster", "", "Envoy cluster, only specs and APIs in its gateway scope are routed")
+	cmd.Flags().DurationVar(&opts.CheckTimeout, "check-timeout", time.Second, "Timeout of the ext_authz requests")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print JSON instead of YAML")
+	_ = cmd.MarkFlagRequired("target-address")
+	return cmd
+}
+
+// jsonToYAML converts JSON to block style YAML, keeping the order of keys.
+func jsonToYAML(b []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	var blockStyle func(n *yaml.Node)
+	blockStyle = func(n *yaml.Node) {
+		if n.Kind != yaml.ScalarNode {
+			n.Style = 0
+		} else if n.Style == yaml.DoubleQuotedStyle && n.Tag == "!!str" {
+			n.Style = 0 // requoted by the encoder if needed
+		}
+		for _, c := range n.Content {
+			blockStyle(c)
+		}
+	}
+	blockStyle(&doc)
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), encoder.Close()
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/server"
+	"github.com/spf13/cobra"
+)
+
+// generateCmd groups the generators of deployment manifests.
+func generateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "generate",
+		Short: "Generate deployment manifests wiring proxies to this adapter",
+	}
+	cmd.AddCommand(generateIstioCmd())
+	return cmd
+}
+
+// generateIstioCmd prints the Istio resources wiring sidecars or a Gateway
+// API gateway to this adapter.
+func generateIstioCmd() *cobra.Command {
+	opts := server.IstioOptions{}
+	cmd := &cobra.Command{
+		Use:   "istio",
+		Short: "Print the Istio resources wiring sidecars or a gateway to this adapter",
+		Args:  cobra.NoArgs,
+		// errors are logged by main
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			b, err := server.GenerateIstioManifests(opts)
+			if err != nil {
+				return err
+			}
+			fmt.Fprint(cmd.OutOrStdout(), string(b))
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&opts.Format, "format", server.IstioEnvoyFilter,
+		fmt.Sprintf("Resources to generate: %s, or %s using mesh config extension providers", server.IstioEnvoyFilter, server.IstioAuthorizationPolicy))
+	cmd.Flags().StringVar(&opts.Name, "name", "apigee-remote-service-envoy", "Name of the resources and extension providers")
+	cmd.Flags().StringVarP(&opts.Namespace, "namespace", "n", "default", "Namespace of the resources, the Istio root namespace applies them mesh-wide")
+	cmd.Flags().StringToStringVar(&opts.Selector, "selector", nil, "Labels of the sidecar workloads, all of the namespace if empty")
+	cmd.Flags().StringVar(&opts.Gateway, "gateway", "", "Gateway API Gateway to apply to instead of sidecars")
+	cmd.Flags().StringVar(&opts.AdapterService, "adapter-service", "apigee-remote-service-envoy", "Service name of this adapter")
+	cmd.Flags().StringVar(&opts.AdapterNamespace, "adapter-namespace", "apigee", "Namespace of this adapter")
+	cmd.Flags().IntVar(&opts.AdapterPort, "adapter-port", 5000, "gRPC port of this adapter")
+	cmd.Flags().StringVar(&opts.Environment, "environment", "", "Apigee environment, for multi-tenant configs")
+	cmd.Flags().StringVar(&opts.EnvSpecID, "environment-spec", "", "ID of the environment spec applied to the requests")
+	cmd.Flags().DurationVar(&opts.CheckTimeout, "check-timeout", time.Second, "Timeout of the ext_authz requests")
+	return cmd
+}
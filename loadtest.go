@@ -0,0 +1,543 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/server"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	alf "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
+	als "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/gogo/googleapis/google/rpc"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const (
+	loadCheck = "check"
+	loadALS   = "als"
+
+	extAuthzFilterNamespace = "envoy.filters.http.ext_authz"
+	envSpecContextKey       = "apigee_env_config"
+)
+
+type loadtestOptions struct {
+	target             string
+	tls                bool
+	insecureSkipVerify bool
+
+	configFile          string
+	policySecretPath    string
+	analyticsSecretPath string
+	readyTimeout        time.Duration
+	apigeeManagers      bool
+
+	duration    time.Duration
+	concurrency int
+	rate        int
+	mix         string
+	alsBatch    int
+
+	hosts        []string
+	paths        []string
+	apiKeys      []string
+	apiKeyHeader string
+	envSpec      string
+	logLevel     string
+}
+
+// loadtestCmd sends synthetic CheckRequests and access log messages to a
+// running adapter, or one started in-process, and reports the latencies.
+func loadtestCmd() *cobra.Command {
+	opts := loadtestOptions{}
+	cmd := &cobra.Command{
+		Use:   "loadtest",
+		Short: "Send synthetic CheckRequests and access logs to an adapter and report latency and allocations",
+		Long: `Send synthetic CheckRequests and access logs to an adapter and report latency and allocations.
+
+Targets the adapter at --target, or if not given, starts an adapter in-process
+with --config. Access logs of successful checks carry the check's metadata and
+are recorded as analytics. The in-process adapter discards analytics and counts
+quotas locally unless --apigee-managers is set. Allocation stats are of this
+process, so they include the adapter only when it runs in-process.`,
+		Args: cobra.NoArgs,
+		// errors are logged by main
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			log.Log.SetLevel(log.ParseLevel(opts.logLevel))
+			return runLoadtest(cmd.Context(), cmd.OutOrStdout(), opts)
+		},
+	}
+	cmd.Flags().StringVarP(&opts.target, "target", "t", "", "gRPC address of a running adapter, in-process if empty")
+	cmd.Flags().BoolVar(&opts.tls, "tls", false, "Connect to the target with TLS")
+	cmd.Flags().BoolVar(&opts.insecureSkipVerify, "insecure-skip-verify", false, "Skip verification of the target's TLS certificate")
+	cmd.Flags().StringVarP(&opts.configFile, "config", "c", "config.yaml", "Config file of the in-process adapter")
+	cmd.Flags().StringVarP(&opts.policySecretPath, "policy-secret", "p", "/policy-secret", "Policy secret mount point of the in-process adapter")
+	cmd.Flags().StringVarP(&opts.analyticsSecretPath, "analytics-secret", "a", config.DefaultAnalyticsSecretPath, "Analytics secret mount point of the in-process adapter")
+	cmd.Flags().BoolVar(&opts.apigeeManagers, "apigee-managers", false, "Send the in-process adapter's analytics and quotas to Apigee")
+	cmd.Flags().DurationVar(&opts.readyTimeout, "ready-timeout", 30*time.Second, "Time to wait for the in-process adapter to be ready")
+	cmd.Flags().DurationVarP(&opts.duration, "duration", "d", 30*time.Second, "Duration of the test")
+	cmd.Flags().IntVarP(&opts.concurrency, "concurrency", "n", 10, "Number of concurrent senders")
+	cmd.Flags().IntVarP(&opts.rate, "rate", "r", 0, "Total operations per second, unlimited if 0")
+	cmd.Flags().StringVar(&opts.mix, "mix", "check=9,als=1", "Relative weights of check and als operations")
+	cmd.Flags().IntVar(&opts.alsBatch, "als-batch", 10, "Log entries per access log message")
+	cmd.Flags().StringSliceVar(&opts.hosts, "hosts", []string{"localhost"}, "Request :authority values, chosen at random")
+	cmd.Flags().StringSliceVar(&opts.paths, "paths", []string{"/"}, "Request paths, chosen at random")
+	cmd.Flags().StringSliceVar(&opts.apiKeys, "api-keys", nil, "API keys, chosen at random")
+	cmd.Flags().StringVar(&opts.apiKeyHeader, "api-key-header", "x-api-key", "Header carrying the API key")
+	cmd.Flags().StringVar(&opts.envSpec, "environment-spec", "", "Environment spec ID sent in the request context extensions")
+	cmd.Flags().StringVarP(&opts.logLevel, "log-level", "l", "warn", "Logging level")
+	return cmd
+}
+
+func runLoadtest(ctx context.Context, w io.Writer, opts loadtestOptions) error {
+	mix, err := parseLoadMix(opts.mix)
+	if err != nil {
+		return err
+	}
+	if opts.concurrency < 1 {
+		return fmt.Errorf("concurrency must be positive")
+	}
+	if opts.alsBatch < 1 {
+		return fmt.Errorf("als-batch must be positive")
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	target := opts.target
+	if target == "" {
+		stop, addr, err := startInProcessAdapter(opts)
+		if err != nil {
+			return err
+		}
+		defer stop()
+		target = addr
+	}
+
+	dialOpt := grpc.WithInsecure()
+	if opts.tls {
+		dialOpt = grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+			InsecureSkipVerify: opts.insecureSkipVerify,
+		}))
+	}
+	conn, err := grpc.DialContext(ctx, target, dialOpt)
+	if err != nil {
+		return fmt.Errorf("unable to connect to %s: %v", target, err)
+	}
+	defer conn.Close()
+
+	var tokens <-chan time.Time
+	if opts.rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(opts.rate))
+		defer ticker.Stop()
+		tokens = ticker.C
+	}
+
+	fmt.Fprintf(w, "sending to %s for %s with %d senders\n", target, opts.duration, opts.concurrency)
+	ctx, cancel := context.WithTimeout(ctx, opts.duration)
+	defer cancel()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	results := make([]*loadResults, opts.concurrency)
+	wg := sync.WaitGroup{}
+	for i := range results {
+		results[i] = newLoadResults()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s := &loadSender{
+				opts:    opts,
+				mix:     mix,
+				rand:    rand.New(rand.NewSource(time.Now().UnixNano() + int64(i))),
+				check:   authv3.NewAuthorizationClient(conn),
+				als:     als.NewAccessLogServiceClient(conn),
+				results: results[i],
+			}
+			s.run(ctx, tokens)
+		}(i)
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	total := newLoadResults()
+	for _, r := range results {
+		total.merge(r)
+	}
+	total.print(w, elapsed, before, after)
+	return nil
+}
+
+// startInProcessAdapter serves an adapter for opts.configFile on a local port
+// and waits for it to be ready. Its analytics and quotas stay local unless
+// opts.apigeeManagers.
+func startInProcessAdapter(opts loadtestOptions) (stop func(), addr string, err error) {
+	cfg := config.Default()
+	if err := cfg.Load(opts.configFile, opts.policySecretPath, opts.analyticsSecretPath, true); err != nil {
+		return nil, "", fmt.Errorf("unable to load config %s: %v", opts.configFile, err)
+	}
+	var handlerOpts []server.HandlerOption
+	if !opts.apigeeManagers {
+		handlerOpts = append(handlerOpts, server.WithLocalManagers())
+	}
+	handler, err := server.NewHandler(cfg, handlerOpts...)
+	if err != nil {
+		return nil, "", err
+	}
+	grpcServer := grpc.NewServer()
+	(&server.AuthorizationServer{}).Register(grpcServer, handler)
+	alsContext, alsCancel := context.WithCancel(context.Background())
+	(&server.AccessLogServer{}).Register(grpcServer, handler, cfg.Global.KeepAliveMaxConnectionAge, alsContext)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		alsCancel()
+		handler.Close()
+		return nil, "", err
+	}
+	go func() {
+		if err := grpcServer.Serve(listener); err != nil {
+			log.Infof("%s", err)
+		}
+	}()
+	stop = func() {
+		alsCancel()
+		grpcServer.Stop()
+		handler.Close()
+	}
+
+	deadline := time.Now().Add(opts.readyTimeout)
+	for !handler.Ready() {
+		if time.Now().After(deadline) {
+			stop()
+			return nil, "", fmt.Errorf("in-process adapter not ready after %s", opts.readyTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return stop, listener.Addr().String(), nil
+}
+
+// loadMix is the cumulative weights of operations
+type loadMix struct {
+	ops     []string
+	weights []int
+	total   int
+}
+
+// parseLoadMix parses "op=weight,..." into a loadMix
+func parseLoadMix(s string) (loadMix, error) {
+	mix := loadMix{}
+	for _, entry := range strings.Split(s, ",") {
+		splits := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(splits) != 2 || (splits[0] != loadCheck && splits[0] != loadALS) {
+			return mix, fmt.Errorf("mix must be %s=weight and/or %s=weight, got %q", loadCheck, loadALS, entry)
+		}
+		weight, err := strconv.Atoi(splits[1])
+		if err != nil || weight < 0 {
+			return mix, fmt.Errorf("mix weight must be a non-negative integer, got %q", entry)
+		}
+		mix.total += weight
+		mix.ops = append(mix.ops, splits[0])
+		mix.weights = append(mix.weights, mix.total)
+	}
+	if mix.total == 0 {
+		return mix, fmt.Errorf("mix must have a positive weight")
+	}
+	return mix, nil
+}
+
+func (m loadMix) pick(r *rand.Rand) string {
+	n := r.Intn(m.total)
+	for i, w := range m.weights {
+		if n < w {
+			return m.ops[i]
+		}
+	}
+	return m.ops[len(m.ops)-1]
+}
+
+// loadSender sends operations until its context is done
+type loadSender struct {
+	opts    loadtestOptions
+	mix     loadMix
+	rand    *rand.Rand
+	check   authv3.AuthorizationClient
+	als     als.AccessLogServiceClient
+	stream  als.AccessLogService_StreamAccessLogsClient
+	results *loadResults
+
+	// dynamic metadata of the last allowed check for access logs
+	metadata *structpb.Struct
+}
+
+func (s *loadSender) run(ctx context.Context, tokens <-chan time.Time) {
+	defer s.closeStream()
+	for {
+		if tokens != nil {
+			select {
+			case <-tokens:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		switch s.mix.pick(s.rand) {
+		case loadCheck:
+			s.sendCheck(ctx)
+		case loadALS:
+			s.sendAccessLogs(ctx)
+		}
+	}
+}
+
+func (s *loadSender) sendCheck(ctx context.Context) {
+	host, path := s.choose(s.opts.hosts), s.choose(s.opts.paths)
+	headers := map[string]string{
+		":authority": host,
+		":path":      path,
+		":method":    http.MethodGet,
+		"user-agent": "apigee-remote-service-envoy-loadtest",
+	}
+	if key := s.choose(s.opts.apiKeys); key != "" {
+		headers[s.opts.apiKeyHeader] = key
+	}
+	req := &authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{
+			Request: &authv3.AttributeContext_Request{
+				Time: timestamppb.Now(),
+				Http: &authv3.AttributeContext_HttpRequest{
+					Method:  http.MethodGet,
+					Host:    host,
+					Path:    path,
+					Headers: headers,
+				},
+			},
+		},
+	}
+	if s.opts.envSpec != "" {
+		req.Attributes.ContextExtensions = map[string]string{envSpecContextKey: s.opts.envSpec}
+	}
+
+	start := time.Now()
+	resp, err := s.check.Check(ctx, req)
+	latency := time.Since(start)
+	if err != nil {
+		if ctx.Err() == nil {
+			s.results.record(loadCheck, "error", latency)
+		}
+		return
+	}
+	code := rpc.Code(resp.GetStatus().GetCode())
+	s.results.record(loadCheck, code.String(), latency)
+	if code == rpc.OK && resp.GetDynamicMetadata() != nil {
+		s.metadata = resp.GetDynamicMetadata()
+	}
+}
+
+func (s *loadSender) sendAccessLogs(ctx context.Context) {
+	if s.stream == nil {
+		stream, err := s.als.StreamAccessLogs(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				s.results.record(loadALS, "error", 0)
+			}
+			return
+		}
+		s.stream = stream
+	}
+
+	now := time.Now()
+	entries := make([]*alf.HTTPAccessLogEntry, s.opts.alsBatch)
+	for i := range entries {
+		entries[i] = s.accessLogEntry(now)
+	}
+	msg := &als.StreamAccessLogsMessage{
+		Identifier: &als.StreamAccessLogsMessage_Identifier{
+			Node:    &core.Node{Id: "loadtest"},
+			LogName: "loadtest",
+		},
+		LogEntries: &als.StreamAccessLogsMessage_HttpLogs{
+			HttpLogs: &als.StreamAccessLogsMessage_HTTPAccessLogEntries{
+				LogEntry: entries,
+			},
+		},
+	}
+
+	start := time.Now()
+	err := s.stream.Send(msg)
+	latency := time.Since(start)
+	if err != nil {
+		s.stream = nil // reopen on next send
+		if ctx.Err() == nil {
+			s.results.record(loadALS, "error", latency)
+		}
+		return
+	}
+	s.results.record(loadALS, "sent", latency)
+}
+
+func (s *loadSender) accessLogEntry(now time.Time) *alf.HTTPAccessLogEntry {
+	elapsed := durationpb.New(time.Millisecond)
+	entry := &alf.HTTPAccessLogEntry{
+		CommonProperties: &alf.AccessLogCommon{
+			StartTime:                   timestamppb.New(now),
+			TimeToLastRxByte:            elapsed,
+			TimeToFirstUpstreamTxByte:   elapsed,
+			TimeToLastUpstreamTxByte:    elapsed,
+			TimeToFirstUpstreamRxByte:   elapsed,
+			TimeToLastUpstreamRxByte:    elapsed,
+			TimeToFirstDownstreamTxByte: elapsed,
+			TimeToLastDownstreamTxByte:  elapsed,
+		},
+		Request: &alf.HTTPRequestProperties{
+			Authority:     s.choose(s.opts.hosts),
+			Path:          s.choose(s.opts.paths),
+			RequestMethod: core.RequestMethod_GET,
+			UserAgent:     "apigee-remote-service-envoy-loadtest",
+		},
+		Response: &alf.HTTPResponseProperties{
+			ResponseCode: wrapperspb.UInt32(http.StatusOK),
+		},
+	}
+	if s.metadata != nil {
+		entry.CommonProperties.Metadata = &core.Metadata{
+			FilterMetadata: map[string]*structpb.Struct{
+				extAuthzFilterNamespace: s.metadata,
+			},
+		}
+	}
+	return entry
+}
+
+func (s *loadSender) closeStream() {
+	if s.stream != nil {
+		_, _ = s.stream.CloseAndRecv()
+	}
+}
+
+// choose returns a random value, "" if none
+func (s *loadSender) choose(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[s.rand.Intn(len(values))]
+}
+
+// loadResults collects latencies and result counts by operation
+type loadResults struct {
+	latencies map[string][]time.Duration
+	counts    map[string]map[string]int
+}
+
+func newLoadResults() *loadResults {
+	return &loadResults{
+		latencies: map[string][]time.Duration{},
+		counts:    map[string]map[string]int{},
+	}
+}
+
+func (r *loadResults) record(op, result string, latency time.Duration) {
+	r.latencies[op] = append(r.latencies[op], latency)
+	if r.counts[op] == nil {
+		r.counts[op] = map[string]int{}
+	}
+	r.counts[op][result]++
+}
+
+func (r *loadResults) merge(other *loadResults) {
+	for op, l := range other.latencies {
+		r.latencies[op] = append(r.latencies[op], l...)
+	}
+	for op, counts := range other.counts {
+		for result, n := range counts {
+			if r.counts[op] == nil {
+				r.counts[op] = map[string]int{}
+			}
+			r.counts[op][result] += n
+		}
+	}
+}
+
+func (r *loadResults) print(w io.Writer, elapsed time.Duration, before, after runtime.MemStats) {
+	var ops int
+	for _, op := range []string{loadCheck, loadALS} {
+		latencies := r.latencies[op]
+		if len(latencies) == 0 {
+			continue
+		}
+		ops += len(latencies)
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+		var results []string
+		for result, n := range r.counts[op] {
+			results = append(results, fmt.Sprintf("%s=%d", result, n))
+		}
+		sort.Strings(results)
+
+		fmt.Fprintf(w, "\n%s: %d in %s (%.1f/s)\n", op, len(latencies), elapsed.Round(time.Millisecond),
+			float64(len(latencies))/elapsed.Seconds())
+		fmt.Fprintf(w, "  results: %s\n", strings.Join(results, " "))
+		fmt.Fprintf(w, "  latency: p50=%s p90=%s p99=%s max=%s\n",
+			percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99), latencies[len(latencies)-1])
+	}
+	if ops == 0 {
+		fmt.Fprintln(w, "no operations completed")
+		return
+	}
+
+	allocs := after.Mallocs - before.Mallocs
+	bytes := after.TotalAlloc - before.TotalAlloc
+	fmt.Fprintf(w, "\nallocations: %d (%d/op) bytes: %d (%d/op) gc cycles: %d heap in use: %d\n",
+		allocs, allocs/uint64(ops), bytes, bytes/uint64(ops), after.NumGC-before.NumGC, after.HeapInuse)
+}
+
+// percentile of sorted latencies
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
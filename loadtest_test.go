@@ -0,0 +1,273 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	als "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/gogo/googleapis/google/rpc"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestParseLoadMix(t *testing.T) {
+	mix, err := parseLoadMix("check=3, als=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mix.total != 4 {
+		t.Errorf("want total 4, got %d", mix.total)
+	}
+	if len(mix.ops) != 2 || mix.ops[0] != loadCheck || mix.ops[1] != loadALS {
+		t.Errorf("want ops [check als], got %v", mix.ops)
+	}
+	if len(mix.weights) != 2 || mix.weights[0] != 3 || mix.weights[1] != 4 {
+		t.Errorf("want cumulative weights [3 4], got %v", mix.weights)
+	}
+
+	for _, bad := range []string{
+		"",
+		"check",
+		"check=x",
+		"check=-1",
+		"quota=1",
+		"check=0,als=0",
+	} {
+		if _, err := parseLoadMix(bad); err == nil {
+			t.Errorf("%q: want error", bad)
+		}
+	}
+}
+
+func TestLoadMixPick(t *testing.T) {
+	mix, err := parseLoadMix("check=0,als=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		if op := mix.pick(r); op != loadALS {
+			t.Fatalf("want only %s, got %s", loadALS, op)
+		}
+	}
+
+	mix, err = parseLoadMix("check=1,als=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	picked := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		picked[mix.pick(r)]++
+	}
+	if picked[loadCheck] == 0 || picked[loadALS] == 0 {
+		t.Errorf("want both operations picked, got %v", picked)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+	for p, want := range map[int]time.Duration{
+		0:   time.Millisecond,
+		50:  50 * time.Millisecond,
+		90:  90 * time.Millisecond,
+		99:  99 * time.Millisecond,
+		100: 100 * time.Millisecond,
+	} {
+		if got := percentile(sorted, p); got != want {
+			t.Errorf("p%d: want %s, got %s", p, want, got)
+		}
+	}
+
+	if got := percentile([]time.Duration{time.Second}, 50); got != time.Second {
+		t.Errorf("want %s, got %s", time.Second, got)
+	}
+}
+
+func TestLoadResults(t *testing.T) {
+	a := newLoadResults()
+	a.record(loadCheck, "OK", 2*time.Millisecond)
+	a.record(loadCheck, "PERMISSION_DENIED", time.Millisecond)
+	b := newLoadResults()
+	b.record(loadCheck, "OK", 3*time.Millisecond)
+	b.record(loadALS, "sent", time.Millisecond)
+
+	a.merge(b)
+	if len(a.latencies[loadCheck]) != 3 || len(a.latencies[loadALS]) != 1 {
+		t.Errorf("want 3 check and 1 als latencies, got %v", a.latencies)
+	}
+	if a.counts[loadCheck]["OK"] != 2 || a.counts[loadCheck]["PERMISSION_DENIED"] != 1 || a.counts[loadALS]["sent"] != 1 {
+		t.Errorf("unexpected counts: %v", a.counts)
+	}
+
+	var before, after runtime.MemStats
+	after.Mallocs = 40
+	after.TotalAlloc = 400
+	buf := &bytes.Buffer{}
+	a.print(buf, time.Second, before, after)
+	out := buf.String()
+	for _, want := range []string{
+		"check: 3 in 1s (3.0/s)",
+		"results: OK=2 PERMISSION_DENIED=1",
+		"latency: p50=2ms p90=3ms p99=3ms max=3ms",
+		"als: 1 in 1s (1.0/s)",
+		"results: sent=1",
+		"allocations: 40 (10/op) bytes: 400 (100/op)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("want %q in output:\n%s", want, out)
+		}
+	}
+
+	buf.Reset()
+	newLoadResults().print(buf, time.Second, before, after)
+	if !strings.Contains(buf.String(), "no operations completed") {
+		t.Errorf("want no operations, got %q", buf.String())
+	}
+}
+
+func TestRunLoadtestOptions(t *testing.T) {
+	for _, opts := range []loadtestOptions{
+		{mix: "bad", concurrency: 1, alsBatch: 1},
+		{mix: "check=1", concurrency: 0, alsBatch: 1},
+		{mix: "check=1", concurrency: 1, alsBatch: 0},
+	} {
+		if err := runLoadtest(context.Background(), io.Discard, opts); err == nil {
+			t.Errorf("%#v: want error", opts)
+		}
+	}
+}
+
+func TestRunLoadtest(t *testing.T) {
+	srv := &testLoadtestServer{}
+	grpcServer := grpc.NewServer()
+	authv3.RegisterAuthorizationServer(grpcServer, srv)
+	als.RegisterAccessLogServiceServer(grpcServer, srv)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = grpcServer.Serve(listener)
+	}()
+	defer grpcServer.Stop()
+
+	opts := loadtestOptions{
+		target:       listener.Addr().String(),
+		duration:     200 * time.Millisecond,
+		concurrency:  2,
+		mix:          "check=1,als=1",
+		alsBatch:     3,
+		hosts:        []string{"example.com"},
+		paths:        []string{"/v1/petstore"},
+		apiKeys:      []string{"key"},
+		apiKeyHeader: "x-api-key",
+		envSpec:      "spec",
+	}
+	buf := &bytes.Buffer{}
+	if err := runLoadtest(context.Background(), buf, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.checks == 0 {
+		t.Fatal("want checks")
+	}
+	if srv.entries == 0 || srv.entries%opts.alsBatch != 0 {
+		t.Errorf("want access log entries in batches of %d, got %d", opts.alsBatch, srv.entries)
+	}
+	if srv.withMetadata == 0 {
+		t.Errorf("want access log entries with the check metadata")
+	}
+	req := srv.lastCheck.GetAttributes()
+	if got := req.GetRequest().GetHttp().GetHeaders()["x-api-key"]; got != "key" {
+		t.Errorf("want api key header, got %q", got)
+	}
+	if got := req.GetRequest().GetHttp().GetHost(); got != "example.com" {
+		t.Errorf("want host example.com, got %q", got)
+	}
+	if got := req.GetContextExtensions()[envSpecContextKey]; got != "spec" {
+		t.Errorf("want environment spec extension, got %q", got)
+	}
+
+	out := buf.String()
+	for _, want := range []string{"sending to " + opts.target, "check: ", "results: OK=", "als: "} {
+		if !strings.Contains(out, want) {
+			t.Errorf("want %q in output:\n%s", want, out)
+		}
+	}
+}
+
+// testLoadtestServer allows all checks and counts the access log entries
+type testLoadtestServer struct {
+	authv3.UnimplementedAuthorizationServer
+	als.UnimplementedAccessLogServiceServer
+
+	mu           sync.Mutex
+	checks       int
+	lastCheck    *authv3.CheckRequest
+	entries      int
+	withMetadata int
+}
+
+func (s *testLoadtestServer) Check(ctx context.Context, req *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	s.mu.Lock()
+	s.checks++
+	s.lastCheck = req
+	s.mu.Unlock()
+	metadata, err := structpb.NewStruct(map[string]interface{}{"x-apigee-api": "petstore"})
+	if err != nil {
+		return nil, err
+	}
+	return &authv3.CheckResponse{
+		Status:          &status.Status{Code: int32(rpc.OK)},
+		DynamicMetadata: metadata,
+	}, nil
+}
+
+func (s *testLoadtestServer) StreamAccessLogs(stream als.AccessLogService_StreamAccessLogsServer) error {
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				return stream.SendAndClose(&als.StreamAccessLogsResponse{})
+			}
+			return err
+		}
+		s.mu.Lock()
+		for _, entry := range msg.GetHttpLogs().GetLogEntry() {
+			s.entries++
+			if entry.GetCommonProperties().GetMetadata().GetFilterMetadata()[extAuthzFilterNamespace] != nil {
+				s.withMetadata++
+			}
+		}
+		s.mu.Unlock()
+	}
+}
@@ -35,6 +35,8 @@ import (
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/health"
@@ -89,27 +91,39 @@ func main() {
 			}
 			zapConfig.Level = zap.NewAtomicLevelAt(zapLevel)
 
-			logger, _ := zapConfig.Build(zap.AddCallerSkip(2))
+			// skip the golib log funcs and the redacting and level wrappers
+			logger, _ := zapConfig.Build(zap.AddCallerSkip(3))
 			defer func() {
 				_ = logger.Sync()
 			}()
 			sugaredLogger := logger.Sugar()
-			log.Log = &log.LevelWrapper{
+			levelLogger := &log.LevelWrapper{
 				Logger:   sugaredLogger,
 				LogLevel: logLevel,
 			}
+			log.Log = server.NewRedactingLogger(levelLogger)
 
 			fmt.Printf("apigee-remote-service-envoy version %s %s [%s]\n", version, date, commit)
 
 			cfg := config.Default()
 			if err := cfg.Load(configFile, policySecretPath, analyticsSecretPath, true); err != nil {
 				log.Errorf("Unable to load config: %s:\n%v", configFile, err)
+				config.EmitLoadEvent(config.NewLoadEvent(configFile, nil, cfg, err), cfg.Global.ConfigEventWebhook)
 				os.Exit(1)
 			}
+			config.EmitLoadEvent(config.NewLoadEvent(configFile, nil, cfg, nil), cfg.Global.ConfigEventWebhook)
+			log.Log = server.NewRedactingLogger(levelLogger, cfg.Auth.APIKeyHeader)
 
 			b, _ := json.Marshal(cfg)
 			log.Debugf("Config: \n%v", string(b))
 
+			if cfg.Global.ValidateEndpoints {
+				if err := checkSpecEndpoints(cfg); err != nil {
+					log.Errorf("Unable to validate environment spec endpoints:\n%v", err)
+					os.Exit(1)
+				}
+			}
+
 			serve(cfg)
 			select {} // infinite loop
 		},
@@ -122,12 +136,27 @@ func main() {
 
 	// Take environment spec files from the command line flag and bind it to the
 	// corresponding field in the config.
-	rootCmd.Flags().StringSlice("environment-specs", nil, "A list of environment-spec config files or directories containg the files (no further recursion)")
+	rootCmd.Flags().StringSlice("environment-specs", nil, "A list of environment-spec config files or directories containing .yaml/.yml files (no further recursion), each file may hold multiple YAML documents")
 	if err := viper.BindPFlag(config.EnvironmentSpecsReferences, rootCmd.Flags().Lookup("environment-specs")); err != nil {
 		log.Errorf("%v", err)
 		os.Exit(1)
 	}
 
+	// Strict config may also be set as global.strict_config.
+	rootCmd.Flags().Bool("strict-config", false, "Fail on unknown fields in the config and environment spec files")
+	if err := viper.BindPFlag(config.GlobalStrictConfig, rootCmd.Flags().Lookup("strict-config")); err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+
+	rootCmd.AddCommand(diffCmd())
+	rootCmd.AddCommand(envoyConfigCmd())
+	rootCmd.AddCommand(generateCmd())
+	rootCmd.AddCommand(loadtestCmd())
+	rootCmd.AddCommand(schemaCmd())
+	rootCmd.AddCommand(testCmd())
+	rootCmd.AddCommand(validateCmd())
+
 	rootCmd.SetArgs(os.Args[1:])
 	if err := rootCmd.Execute(); err != nil {
 		log.Errorf("%v", err)
@@ -167,6 +196,10 @@ func serve(cfg *config.Config) {
 	ls := &server.AccessLogServer{}
 	lsContext, logServiceCancel := context.WithCancel(context.Background())
 	ls.Register(grpcServer, rsHandler, cfg.Global.KeepAliveMaxConnectionAge, lsContext)
+	ots := &server.OTelLogsServer{}
+	ots.Register(grpcServer, rsHandler)
+	ms := &server.MetricsServer{}
+	ms.Register(grpcServer, rsHandler)
 
 	// grpc health
 	grpcHealth := health.NewServer()
@@ -195,10 +228,30 @@ func serve(cfg *config.Config) {
 	mux := http.NewServeMux()
 	mux.Handle(prometheusPath, promhttp.Handler())
 	mux.HandleFunc("/healthz", kubeHealth.HandlerFunc())
-
+	mux.HandleFunc("/quotas", rsHandler.QuotaStatusHandlerFunc())
+	mux.HandleFunc("/quotas/simulate", rsHandler.QuotaSimulationHandlerFunc())
+	mux.HandleFunc("/specs/validate", server.SpecValidationHandlerFunc(cfg.EnvironmentSpecs.EnvironmentVariables))
+	mux.HandleFunc("/specs/drift", rsHandler.SpecDriftHandlerFunc())
+	rsHandler.RegisterAdminHandlers(mux, cfg.Global.AdminAccess)
+
+	var handler http.Handler = mux
+	if cfg.Global.AuthorizationFacade {
+		handler = server.NewAuthorizationFacadeHandler(grpcServer, mux)
+	}
+	corsHandler, err := server.NewAuthorizationCORSHandler(cfg.Global.AuthorizeCORS, handler)
+	if err != nil {
+		panic(err)
+	}
+	handler, err = server.NewAdminAccessHandler(cfg.Global.AdminAccess, corsHandler)
+	if err != nil {
+		panic(err)
+	}
+	if cfg.Global.AuthorizationFacade {
+		handler = h2c.NewHandler(handler, &http2.Server{}) // gRPC without TLS
+	}
 	httpServer := &http.Server{
 		Addr:    cfg.Global.MetricsAddress,
-		Handler: mux,
+		Handler: handler,
 	}
 	if cfg.Global.TLS.CertFile != "" {
 		cert, err := tls.LoadX509KeyPair(cfg.Global.TLS.CertFile, cfg.Global.TLS.KeyFile)
@@ -209,6 +262,15 @@ func serve(cfg *config.Config) {
 			Certificates: []tls.Certificate{cert},
 			NextProtos:   []string{"h2"},
 		}
+		clientCAs, err := server.AdminClientCAs(cfg.Global.AdminAccess)
+		if err != nil {
+			panic(err)
+		}
+		if clientCAs != nil {
+			// unrestricted paths may be requested without certificates
+			httpServer.TLSConfig.ClientCAs = clientCAs
+			httpServer.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
 		metricsListener = tls.NewListener(metricsListener, httpServer.TLSConfig)
 	}
 
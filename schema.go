@@ -0,0 +1,49 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/spf13/cobra"
+)
+
+// schemaCmd prints the JSON Schema of the config or environment spec files
+// for use by editors and CI validation.
+func schemaCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:       "schema config|environment-spec",
+		Short:     "Print the JSON Schema of the config or environment spec files",
+		Args:      cobra.ExactValidArgs(1),
+		ValidArgs: []string{"config", "environment-spec"},
+		// errors are logged by main
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			schema := config.ConfigJSONSchema()
+			if args[0] == "environment-spec" {
+				schema = config.EnvironmentSpecJSONSchema()
+			}
+			b, err := json.MarshalIndent(schema, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), string(b))
+			return nil
+		},
+	}
+}
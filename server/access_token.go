@@ -0,0 +1,137 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth/jwt"
+	"github.com/apigee/apigee-remote-service-golib/v2/cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	remoteServiceCertsPath           = "/certs"
+	accessTokenCacheEvictionInterval = 10 * time.Second
+	accessTokenMaxCachedEntries      = 10000
+	accessTokenExpirationClaim       = "exp"
+	remoteCacheResultHit             = "hit"
+	remoteCacheResultMiss            = "miss"
+	remoteCacheResultKnownBadEntry   = "known_bad"
+)
+
+// accessTokenVerifier verifies Apigee OAuth access tokens, the JWTs issued by
+// the token API of the remote-service proxy, with the keys of its certs API.
+// Verified claims are cached until the earlier of the cache duration and the
+// token expiration.
+type accessTokenVerifier struct {
+	verifier    jwt.Verifier // nil without the remote service API
+	provider    jwt.Provider
+	addProvider sync.Once // on first use, so the keys are fetched only if needed
+	cacheTTL    time.Duration
+	cache       cache.ExpiringCache
+	now         func() time.Time
+	org         string
+}
+
+func newAccessTokenVerifier(remoteServiceAPI *url.URL, cacheTTL time.Duration, org string) *accessTokenVerifier {
+	v := &accessTokenVerifier{
+		cacheTTL: cacheTTL,
+		cache:    cache.NewLRU(cacheTTL, accessTokenCacheEvictionInterval, accessTokenMaxCachedEntries),
+		now:      time.Now,
+		org:      org,
+	}
+	if remoteServiceAPI != nil {
+		u := *remoteServiceAPI
+		u.Path = path.Join(u.Path, remoteServiceCertsPath)
+		v.provider = jwt.Provider{JWKSURL: u.String()}
+		v.verifier = jwt.NewVerifier(jwt.VerifierOptions{})
+		v.verifier.Start()
+	}
+	return v
+}
+
+// VerifyAccessToken returns the claims of a valid access token.
+// Claims must not be written to.
+func (v *accessTokenVerifier) VerifyAccessToken(token string) (map[string]interface{}, error) {
+	if cached, ok := v.cache.Get(token); ok {
+		claims := cached.(map[string]interface{})
+		if exp, ok := claims[accessTokenExpirationClaim].(time.Time); !ok || exp.After(v.now()) {
+			prometheusAccessTokenCache.WithLabelValues(v.org, remoteCacheResultHit).Inc()
+			return claims, nil
+		}
+		v.cache.Remove(token)
+	}
+	prometheusAccessTokenCache.WithLabelValues(v.org, remoteCacheResultMiss).Inc()
+
+	if v.verifier == nil {
+		return nil, fmt.Errorf("remote service API required to verify access tokens")
+	}
+	v.addProvider.Do(func() { v.verifier.AddProvider(v.provider) })
+	claims, err := v.verifier.Parse(token, v.provider)
+	if err != nil {
+		return nil, err
+	}
+
+	if ttl := v.claimsTTL(claims); ttl > 0 {
+		v.cache.SetWithExpiration(token, claims, ttl)
+	}
+	return claims, nil
+}
+
+// claimsTTL is how long claims may be cached
+func (v *accessTokenVerifier) claimsTTL(claims map[string]interface{}) time.Duration {
+	ttl := v.cacheTTL
+	if exp, ok := claims[accessTokenExpirationClaim].(time.Time); ok && exp.Sub(v.now()) < ttl {
+		ttl = exp.Sub(v.now())
+	}
+	return ttl
+}
+
+func (v *accessTokenVerifier) close() {
+	if v != nil && v.verifier != nil {
+		v.verifier.Stop()
+	}
+}
+
+// remoteServiceAuthManager adds remote-service lookups to an auth.Manager:
+// access token verification for config.OAuthAuthentication requirements and
+// consumer key resolution for config.ClientCertificate app attributes. API
+// keys may be hashed before verification and verified keys shared through a
+// store.
+type remoteServiceAuthManager struct {
+	auth.Manager
+	*accessTokenVerifier
+	*consumerKeyResolver
+	hashAPIKey     func(string) string // nil sends API keys in the clear
+	store          verificationStore   // nil if not shared
+	invalidated    *invalidatedAPIKeys // nil if keys can't be invalidated
+	apiKeyStoreTTL time.Duration
+	org            string
+}
+
+var (
+	prometheusAccessTokenCache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "access_token_cache_count",
+		Help:      "Number of access token cache lookups by result",
+	}, []string{"org", "result"})
+)
@@ -0,0 +1,121 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+)
+
+func TestVerifyAccessToken(t *testing.T) {
+	privateKey, jwks, err := testutil.GenerateKeyAndJWKs("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, err := testutil.GenerateJWT(privateKey, map[string]interface{}{
+		"client_id": "client",
+		"exp":       time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatalf("generateJWT() failed: %v", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := testutil.GenerateJWT(otherKey, map[string]interface{}{
+		"client_id": "client",
+		"exp":       time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatalf("generateJWT() failed: %v", err)
+	}
+
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/remote-service/certs" {
+			t.Errorf("want: /remote-service/certs, got: %s", r.URL.Path)
+		}
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(jwks)
+	}))
+	defer ts.Close()
+
+	remoteServiceAPI, _ := url.Parse(ts.URL + "/remote-service")
+	v := newAccessTokenVerifier(remoteServiceAPI, time.Minute, "org")
+	defer v.close()
+	if calls != 0 {
+		t.Errorf("want keys fetched on first use, got: %d calls", calls)
+	}
+
+	// verifies and caches good token
+	for i := 0; i < 2; i++ {
+		claims, err := v.VerifyAccessToken(good)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if claims["client_id"] != "client" {
+			t.Errorf("want: client, got: %v", claims["client_id"])
+		}
+	}
+	if calls != 1 {
+		t.Errorf("want: 1 call, got: %d", calls)
+	}
+
+	// not signed by the remote service
+	if _, err := v.VerifyAccessToken(forged); err == nil {
+		t.Errorf("want error for token of another key")
+	}
+	if _, err := v.VerifyAccessToken("opaque"); err == nil {
+		t.Errorf("want error for token not a JWT")
+	}
+
+	// expired token is verified again
+	v.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if _, ok := v.cache.Get(good); !ok {
+		t.Fatalf("want cached claims")
+	}
+	_, _ = v.VerifyAccessToken(good)
+	if _, ok := v.cache.Get(good); ok {
+		t.Errorf("want expired claims removed")
+	}
+	v.now = time.Now
+
+	// requires remote service api
+	v = newAccessTokenVerifier(nil, time.Minute, "org")
+	if _, err := v.VerifyAccessToken(good); err == nil {
+		t.Errorf("want error without remote service API")
+	}
+	v.close()
+}
+
+func TestRemoteServiceAuthManager(t *testing.T) {
+	var authMan interface{} = &remoteServiceAuthManager{Manager: &testAuthMan{}}
+	if _, ok := authMan.(config.AccessTokenVerifier); !ok {
+		t.Errorf("remoteServiceAuthManager must implement config.AccessTokenVerifier")
+	}
+	if _, ok := authMan.(config.ConsumerKeyResolver); !ok {
+		t.Errorf("remoteServiceAuthManager must implement config.ConsumerKeyResolver")
+	}
+}
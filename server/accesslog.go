@@ -20,10 +20,12 @@ import (
 	"strings"
 	"time"
 
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
 	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
 	"github.com/apigee/apigee-remote-service-golib/v2/auth"
 	"github.com/apigee/apigee-remote-service-golib/v2/log"
 	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	v3 "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
 	als "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v3"
 	"github.com/golang/protobuf/ptypes/duration"
 	"github.com/golang/protobuf/ptypes/timestamp"
@@ -71,6 +73,7 @@ func (a *AccessLogServer) StreamAccessLogs(srv als.AccessLogService_StreamAccess
 		}
 	}()
 
+	var source envoySource
 	for {
 		msg, err := srv.Recv()
 		if err == io.EOF {
@@ -79,15 +82,20 @@ func (a *AccessLogServer) StreamAccessLogs(srv als.AccessLogService_StreamAccess
 		if err != nil {
 			return err
 		}
+		if id := msg.GetIdentifier(); id != nil {
+			source = envoySourceFrom(id)
+			log.Debugf("access log stream from node %q of cluster %q", source.node, source.cluster)
+		}
 
 		switch msg := msg.GetLogEntries().(type) {
 
 		case *als.StreamAccessLogsMessage_HttpLogs:
 			status := "ok"
-			if err := a.handleHTTPLogs(msg); err != nil {
+			if err := a.handleHTTPLogs(msg, source); err != nil {
 				status = "error"
 			}
 			prometheusAnalyticsRequests.WithLabelValues(a.handler.orgName, status).Inc()
+			prometheusAnalyticsClusterRequests.WithLabelValues(a.handler.orgName, source.metricCluster(), status).Inc()
 			if err != nil {
 				return err
 			}
@@ -98,112 +106,227 @@ func (a *AccessLogServer) StreamAccessLogs(srv als.AccessLogService_StreamAccess
 	}
 }
 
-func (a *AccessLogServer) handleHTTPLogs(msg *als.StreamAccessLogsMessage_HttpLogs) error {
-
+func (a *AccessLogServer) handleHTTPLogs(msg *als.StreamAccessLogsMessage_HttpLogs, source envoySource) error {
 	for _, v := range msg.HttpLogs.LogEntry {
-		req := v.Request
+		if err := a.handler.handleHTTPLogEntry(v, source, a.gatewaySource); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		getMetadata := func(namespace string) *structpb.Struct {
-			props := v.GetCommonProperties()
-			if props == nil {
-				return nil
-			}
-			log.Debugf("props: %#v", props)
+// handleHTTPLogEntry counts the quotas, releases the concurrency, observes the
+// metrics, and sends the analytics record of an access log entry. Entries of
+// both the access log service and OpenTelemetry access logs are handled here.
+func (h *Handler) handleHTTPLogEntry(v *v3.HTTPAccessLogEntry, source envoySource, gatewaySource string) error {
+	req := v.Request
 
-			metadata := props.GetMetadata()
-			if metadata == nil {
-				return nil
-			}
-			log.Debugf("metadata: %#v", metadata)
+	recordKey := recordKey(req.GetRequestId(), v.GetCommonProperties().GetStartTime())
+	recorded, quotasCounted := h.recordDedup.begin(recordKey)
+	if recorded {
+		log.Debugf("Duplicate entry, skipped accesslog: %#v", v.Request)
+		return nil
+	}
 
-			return metadata.GetFilterMetadata()[namespace]
+	getMetadata := func(namespace string) *structpb.Struct {
+		props := v.GetCommonProperties()
+		if props == nil {
+			return nil
 		}
+		log.Debugf("props: %#v", props)
 
-		var api string
-		var authContext *auth.Context
-
-		extAuthzMetadata := getMetadata(extAuthzFilterNamespace)
-		if extAuthzMetadata != nil {
-			api, authContext = a.handler.decodeExtAuthzMetadata(extAuthzMetadata.GetFields())
-		} else if a.handler.appendMetadataHeaders { // only check headers if knowing it may exist
-			log.Debugf("No dynamic metadata for ext_authz filter, falling back to headers")
-			api, authContext = a.handler.decodeMetadataHeaders(req.GetRequestHeaders())
-		} else {
-			log.Debugf("No dynamic metadata for ext_authz filter, skipped accesslog: %#v", v.Request)
-			continue
+		metadata := props.GetMetadata()
+		if metadata == nil {
+			return nil
 		}
+		log.Debugf("metadata: %#v", metadata)
 
-		if api == "" {
-			log.Debugf("Unknown target, skipped accesslog: %#v", v.Request)
-			continue
-		}
+		return metadata.GetFilterMetadata()[namespace]
+	}
 
-		var attributes []analytics.Attribute
-		attributesMetadata := getMetadata(datacaptureNamespace)
-		if attributesMetadata != nil && len(attributesMetadata.Fields) > 0 {
-			for k, v := range attributesMetadata.Fields {
-				attr := analytics.Attribute{
-					Name: k,
-				}
-				switch v.GetKind().(type) {
-				case *structpb.Value_NumberValue:
-					attr.Value = v.GetNumberValue()
-				case *structpb.Value_StringValue:
-					attr.Value = v.GetStringValue()
-				case *structpb.Value_BoolValue:
-					attr.Value = v.GetBoolValue()
-
-				case
-					*structpb.Value_StructValue,
-					*structpb.Value_ListValue:
-					log.Debugf("attribute %s is unsupported type: %s", k, v.GetKind())
-					continue
-				}
-				attributes = append(attributes, attr)
-			}
-			log.Debugf("custom attributes: %#v", attributes)
-		}
+	var api, apiProxy string
+	var authContext *auth.Context
+	var pathParams, labels map[string]string
+	var credential, botRule, operation, basepath string
+	var corsHeaders map[string]string
 
-		var responseCode int
-		if v.Response.ResponseCode != nil {
-			responseCode = int(v.Response.ResponseCode.Value)
-		}
+	extAuthzMetadata := getMetadata(extAuthzFilterNamespace)
+	if extAuthzMetadata != nil {
+		h.concurrency.release(decodeConcurrencyTokenMetadata(extAuthzMetadata.GetFields()))
+		api, authContext = h.decodeExtAuthzMetadata(extAuthzMetadata.GetFields())
+		pathParams = decodePathParamsMetadata(extAuthzMetadata.GetFields())
+		labels = decodeLabelsMetadata(extAuthzMetadata.GetFields())
+		credential = decodeConsumerCredentialMetadata(extAuthzMetadata.GetFields())
+		botRule = decodeBotRuleMetadata(extAuthzMetadata.GetFields())
+		operation = decodeOperationMetadata(extAuthzMetadata.GetFields())
+		apiProxy = decodeAnalyticsProxyMetadata(extAuthzMetadata.GetFields(), api)
+		basepath = decodeBasepathMetadata(extAuthzMetadata.GetFields())
+		corsHeaders = decodeCORSHeadersMetadata(extAuthzMetadata.GetFields())
+	} else if h.appendMetadataHeaders { // only check headers if knowing it may exist
+		log.Debugf("No dynamic metadata for ext_authz filter, falling back to headers")
+		api, authContext = h.decodeMetadataHeaders(req.GetRequestHeaders())
+		apiProxy = api
+	} else {
+		log.Debugf("No dynamic metadata for ext_authz filter, skipped accesslog: %#v", v.Request)
+		return nil
+	}
 
-		cp := v.CommonProperties
-		requestPath := strings.SplitN(req.Path, "?", 2)[0] // Apigee doesn't want query params in requestPath
-		record := analytics.Record{
-			ClientReceivedStartTimestamp: pbTimestampToApigee(cp.StartTime),
-			ClientReceivedEndTimestamp:   pbTimestampAddDurationApigee(cp.StartTime, cp.TimeToLastRxByte),
-			TargetSentStartTimestamp:     pbTimestampAddDurationApigee(cp.StartTime, cp.TimeToFirstUpstreamTxByte),
-			TargetSentEndTimestamp:       pbTimestampAddDurationApigee(cp.StartTime, cp.TimeToLastUpstreamTxByte),
-			TargetReceivedStartTimestamp: pbTimestampAddDurationApigee(cp.StartTime, cp.TimeToFirstUpstreamRxByte),
-			TargetReceivedEndTimestamp:   pbTimestampAddDurationApigee(cp.StartTime, cp.TimeToLastUpstreamRxByte),
-			ClientSentStartTimestamp:     pbTimestampAddDurationApigee(cp.StartTime, cp.TimeToFirstDownstreamTxByte),
-			ClientSentEndTimestamp:       pbTimestampAddDurationApigee(cp.StartTime, cp.TimeToLastDownstreamTxByte),
-			APIProxy:                     api,
-			RequestURI:                   req.Path,
-			RequestPath:                  requestPath,
-			RequestVerb:                  req.RequestMethod.String(),
-			UserAgent:                    req.UserAgent,
-			ResponseStatusCode:           responseCode,
-			GatewaySource:                a.gatewaySource,
-			ClientIP:                     req.GetForwardedFor(),
-			Attributes:                   attributes,
-		}
+	if api == "" {
+		log.Debugf("Unknown target, skipped accesslog: %#v", v.Request)
+		return nil
+	}
 
-		// this may be more efficient to batch, but changing the golib impl would require
-		// a rewrite as it assumes the same authContext for all records
-		records := []analytics.Record{record}
-		err := a.handler.analyticsMan.SendRecords(authContext, records)
-		if err != nil {
-			log.Warnf("Unable to send ax: %v", err)
-			return err
-		}
+	if !quotasCounted { // by an earlier attempt that failed to send the record
+		h.countAccessLogQuotas(authContext, v, decodePendingQuotasMetadata(extAuthzMetadata.GetFields()))
 	}
 
+	if corsHeaders != nil {
+		recordCORSVerification(authContext.Organization(), authContext.Environment(),
+			h.metricAPIs.value(api), corsHeaders, v.GetResponse().GetResponseHeaders())
+	}
+
+	attributes := analyticsAttributes(getMetadata(datacaptureNamespace), pathParams, labels, credential, botRule)
+	for _, ns := range h.datacaptureNamespaces {
+		attributes = append(attributes, metadataAttributes(getMetadata(ns.Namespace), ns.Prefix)...)
+	}
+	attributes = append(attributes, h.kvms.analyticsAttributes()...)
+	attributes = append(attributes, source.attributes()...)
+	if operation != "" && h.features.enabled(config.FeatureAnalyticsOperation, api, req.GetRequestId()) {
+		attributes = append(attributes, analytics.Attribute{Name: operationAttribute, Value: operation})
+	}
+
+	responseCode := int(v.GetResponse().GetResponseCode().GetValue())
+	grpcAttributes, responseCode := grpcAnalytics(v.GetResponse(), responseCode)
+	attributes = append(attributes, grpcAttributes...)
+	attributes = append(attributes, streamMessageAttributes(v.GetCommonProperties())...)
+	attributes = append(attributes, capturedHeaderAttributes(extAuthzMetadata.GetFields(),
+		v.GetResponse().GetResponseHeaders(), h.apiKeyHeader)...)
+	attributes = append(attributes, h.responseOutcomeAttributes(extAuthzMetadata.GetFields(),
+		api, operation, responseCode, v.GetResponse().GetResponseHeaders())...)
+
+	cp := v.CommonProperties
+	spec, metricAPI := h.metricScopeOf(extAuthzMetadata.GetFields()[metadataEnvironmentSpec].GetStringValue(), api)
+	h.anomalies.observe(authContext.Environment(), metricAPI, operation, responseCode,
+		cp.GetTimeToLastDownstreamTxByte().AsDuration())
+	observeTrafficBytes(authContext.Organization(), authContext.Environment(),
+		spec, metricAPI, operation, req, v.GetResponse())
+	requestURI := h.normalizer.path(req.GetPath())
+	clientIP := h.analyticsClientIP(cp.GetDownstreamRemoteAddress().GetSocketAddress().GetAddress(),
+		req.GetForwardedFor())
+	requestPath := strings.SplitN(requestURI, "?", 2)[0] // Apigee doesn't want query params in requestPath
+	record := analytics.Record{
+		ClientReceivedStartTimestamp: pbTimestampToApigee(cp.StartTime),
+		ClientReceivedEndTimestamp:   pbTimestampAddDurationApigee(cp.StartTime, cp.TimeToLastRxByte),
+		TargetSentStartTimestamp:     pbTimestampAddDurationApigee(cp.StartTime, cp.TimeToFirstUpstreamTxByte),
+		TargetSentEndTimestamp:       pbTimestampAddDurationApigee(cp.StartTime, cp.TimeToLastUpstreamTxByte),
+		TargetReceivedStartTimestamp: pbTimestampAddDurationApigee(cp.StartTime, cp.TimeToFirstUpstreamRxByte),
+		TargetReceivedEndTimestamp:   pbTimestampAddDurationApigee(cp.StartTime, cp.TimeToLastUpstreamRxByte),
+		ClientSentStartTimestamp:     pbTimestampAddDurationApigee(cp.StartTime, cp.TimeToFirstDownstreamTxByte),
+		ClientSentEndTimestamp:       pbTimestampAddDurationApigee(cp.StartTime, cp.TimeToLastDownstreamTxByte),
+		APIProxy:                     apiProxy,
+		RequestURI:                   requestURI,
+		RequestPath:                  requestPath,
+		RequestVerb:                  req.GetRequestMethod().String(),
+		UserAgent:                    req.GetUserAgent(),
+		ResponseStatusCode:           responseCode,
+		GatewaySource:                gatewaySource,
+		ClientIP:                     clientIP,
+		Attributes:                   attributes,
+	}
+
+	h.applyProxyFields(&record, basepath, req.GetAuthority())
+	correctTimeSkew(&record, time.Now(), h.maxTimeSkew, h.orgName)
+	h.enrichRecord(&record, authContext)
+
+	// this may be more efficient to batch, but changing the golib impl would require
+	// a rewrite as it assumes the same authContext for all records
+	// a dropped record isn't remembered so a retried entry is recorded, and
+	// doesn't fail the stream as the workers count the drops
+	if err := h.sendRecord(authContext, record); err == errAnalyticsRecordDropped {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	h.recordDedup.remember(recordKey)
 	return nil
 }
 
+// observeTrafficBytes counts the header and body bytes received from and
+// sent to the client by the access log entry. The spec and api are the
+// labels of metricScope.
+func observeTrafficBytes(org, env, spec, api, operation string, req *v3.HTTPRequestProperties, resp *v3.HTTPResponseProperties) {
+	received := float64(req.GetRequestHeadersBytes() + req.GetRequestBodyBytes())
+	sent := float64(resp.GetResponseHeadersBytes() + resp.GetResponseBodyBytes())
+	prometheusRequestBytes.WithLabelValues(org, env, spec, api, operation).Add(received)
+	prometheusResponseBytes.WithLabelValues(org, env, spec, api, operation).Add(sent)
+	prometheusRequestSize.WithLabelValues(org, env, spec, api).Observe(received)
+	prometheusResponseSize.WithLabelValues(org, env, spec, api).Observe(sent)
+}
+
+// analyticsAttributes returns the custom attributes captured in the datacapture
+// metadata followed by the path template variables and labels of the matched
+// operation, the consumer credential alternative used, and the bot rule matched
+func analyticsAttributes(datacapture *structpb.Struct, pathParams, labels map[string]string,
+	credential, botRule string) []analytics.Attribute {
+	attributes := metadataAttributes(datacapture, "")
+	for k, v := range pathParams {
+		attributes = append(attributes, analytics.Attribute{
+			Name:  pathParamAttributePrefix + k,
+			Value: v,
+		})
+	}
+	for k, v := range labels {
+		attributes = append(attributes, analytics.Attribute{
+			Name:  labelAttributePrefix + k,
+			Value: v,
+		})
+	}
+	if credential != "" {
+		attributes = append(attributes, analytics.Attribute{
+			Name:  consumerCredentialAttribute,
+			Value: credential,
+		})
+	}
+	if botRule != "" {
+		attributes = append(attributes, analytics.Attribute{
+			Name:  botRuleAttribute,
+			Value: botRule,
+		})
+	}
+	return attributes
+}
+
+// metadataAttributes returns the string, number, and bool fields of the
+// metadata as attributes with the prefix prepended to their names
+func metadataAttributes(metadata *structpb.Struct, prefix string) []analytics.Attribute {
+	if metadata == nil || len(metadata.Fields) == 0 {
+		return nil
+	}
+	var attributes []analytics.Attribute
+	for k, v := range metadata.Fields {
+		attr := analytics.Attribute{
+			Name: prefix + k,
+		}
+		switch v.GetKind().(type) {
+		case *structpb.Value_NumberValue:
+			attr.Value = v.GetNumberValue()
+		case *structpb.Value_StringValue:
+			attr.Value = v.GetStringValue()
+		case *structpb.Value_BoolValue:
+			attr.Value = v.GetBoolValue()
+
+		case
+			*structpb.Value_StructValue,
+			*structpb.Value_ListValue:
+			log.Debugf("attribute %s is unsupported type: %s", k, v.GetKind())
+			continue
+		}
+		attributes = append(attributes, attr)
+	}
+	log.Debugf("custom attributes: %#v", attributes)
+	return attributes
+}
+
 // returns ms since epoch
 func pbTimestampToApigee(ts *timestamp.Timestamp) int64 {
 	if err := ts.CheckValid(); err != nil {
@@ -232,6 +355,38 @@ var (
 		Name:      "analytics_requests_count",
 		Help:      "Total number of analytics streaming requests received",
 	}, []string{"org", "status"})
+
+	prometheusAnalyticsClusterRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "analytics",
+		Name:      "cluster_requests_count",
+		Help:      "Total number of analytics streaming requests received by Envoy cluster",
+	}, []string{"org", "envoy_cluster", "status"})
+
+	prometheusRequestBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "traffic",
+		Name:      "request_bytes_total",
+		Help:      "Total number of request header and body bytes received by API and operation",
+	}, []string{"org", "env", "spec", "api", "operation"})
+
+	prometheusResponseBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "traffic",
+		Name:      "response_bytes_total",
+		Help:      "Total number of response header and body bytes sent by API and operation",
+	}, []string{"org", "env", "spec", "api", "operation"})
+
+	prometheusRequestSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Subsystem: "traffic",
+		Name:      "request_size_bytes",
+		Help:      "Request header and body bytes received by API",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 8), // 256B to 4MB
+	}, []string{"org", "env", "spec", "api"})
+
+	prometheusResponseSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Subsystem: "traffic",
+		Name:      "response_size_bytes",
+		Help:      "Response header and body bytes sent by API",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 8), // 256B to 4MB
+	}, []string{"org", "env", "spec", "api"})
 )
 
 // format time as ms since epoch
@@ -23,9 +23,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
 	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
 	"github.com/apigee/apigee-remote-service-golib/v2/auth"
 	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	prometheustest "github.com/prometheus/client_golang/prometheus/testutil"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/test/bufconn"
 	"google.golang.org/protobuf/types/known/durationpb"
@@ -63,6 +65,20 @@ func TestHandleHTTPAccessLogs(t *testing.T) {
 	durProto := durationpb.New(dur)
 
 	extAuthzFields := makeExtAuthFields()
+	extAuthzFields[metadataPathParams] = &structpb.Value{
+		Kind: &structpb.Value_StructValue{
+			StructValue: &structpb.Struct{
+				Fields: map[string]*structpb.Value{"petId": stringValueFrom("42")},
+			},
+		},
+	}
+	extAuthzFields[metadataLabels] = &structpb.Value{
+		Kind: &structpb.Value_StructValue{
+			StructValue: &structpb.Struct{
+				Fields: map[string]*structpb.Value{"tier": stringValueFrom("gold")},
+			},
+		},
+	}
 
 	path := "path"
 	uri := "path?x=foo"
@@ -92,6 +108,16 @@ func TestHandleHTTPAccessLogs(t *testing.T) {
 							"struct": structValueFrom(struct{}{}),
 						},
 					},
+					"envoy.filters.http.wasm.waf": {
+						Fields: map[string]*structpb.Value{
+							"rule": stringValueFrom("sqli"),
+						},
+					},
+					"envoy.filters.http.wasm.ignored": {
+						Fields: map[string]*structpb.Value{
+							"ignored": stringValueFrom("true"),
+						},
+					},
 				},
 			},
 		},
@@ -121,10 +147,13 @@ func TestHandleHTTPAccessLogs(t *testing.T) {
 			orgName:      extAuthzFields[headerOrganization].GetStringValue(),
 			envName:      extAuthzFields[headerEnvironment].GetStringValue(),
 			analyticsMan: testAnalyticsMan,
+			datacaptureNamespaces: []config.DatacaptureNamespace{
+				{Namespace: "envoy.filters.http.wasm.waf", Prefix: "waf."},
+			},
 		},
 		gatewaySource: managedGatewaySource,
 	}
-	if err := server.handleHTTPLogs(msg); err != nil {
+	if err := server.handleHTTPLogs(msg, envoySource{node: "node-1", cluster: "fleet-a"}); err != nil {
 		t.Fatal(err)
 	}
 
@@ -201,10 +230,28 @@ func TestHandleHTTPAccessLogs(t *testing.T) {
 	if _, ok := attrMap["struct"]; ok {
 		t.Errorf("got: %v, want: nil", attrMap["struct"])
 	}
+	if attrMap["path.petId"] != "42" {
+		t.Errorf("got: %v, want: %v", attrMap["path.petId"], "42")
+	}
+	if attrMap["label.tier"] != "gold" {
+		t.Errorf("got: %v, want: %v", attrMap["label.tier"], "gold")
+	}
+	if attrMap[envoyNodeAttribute] != "node-1" {
+		t.Errorf("got: %v, want: %v", attrMap[envoyNodeAttribute], "node-1")
+	}
+	if attrMap[envoyClusterAttribute] != "fleet-a" {
+		t.Errorf("got: %v, want: %v", attrMap[envoyClusterAttribute], "fleet-a")
+	}
+	if attrMap["waf.rule"] != "sqli" {
+		t.Errorf("got: %v, want: %v", attrMap["waf.rule"], "sqli")
+	}
+	if _, ok := attrMap["ignored"]; ok {
+		t.Errorf("got: %v, want: nil", attrMap["ignored"])
+	}
 
 	// missing response code can happen when client kills request
 	msg.HttpLogs.LogEntry[0].Response.ResponseCode = nil
-	if err := server.handleHTTPLogs(msg); err != nil {
+	if err := server.handleHTTPLogs(msg, envoySource{}); err != nil {
 		t.Fatal(err)
 	}
 
@@ -212,6 +259,58 @@ func TestHandleHTTPAccessLogs(t *testing.T) {
 	if rec.ResponseStatusCode != 0 {
 		t.Errorf("got: %d, want: %d", rec.ResponseStatusCode, 0)
 	}
+
+	// operations may override the proxy name
+	extAuthzFields[metadataAnalyticsProxy] = stringValueFrom("grouped")
+	if err := server.handleHTTPLogs(msg, envoySource{}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = testAnalyticsMan.records[len(testAnalyticsMan.records)-1]
+	if rec.APIProxy != "grouped" {
+		t.Errorf("got: %s, want: %s", rec.APIProxy, "grouped")
+	}
+
+	// the operation is recorded if enabled by its feature flag
+	extAuthzFields[metadataOperation] = stringValueFrom("getPet")
+	for _, percentage := range []float64{0, 100} {
+		server.handler.features = newFeatureFlags("org", config.FeatureFlags{
+			config.FeatureAnalyticsOperation: {Percentage: percentage},
+		})
+		if err := server.handleHTTPLogs(msg, envoySource{}); err != nil {
+			t.Fatal(err)
+		}
+		rec = testAnalyticsMan.records[len(testAnalyticsMan.records)-1]
+		var operation interface{}
+		for _, attr := range rec.Attributes {
+			if attr.Name == operationAttribute {
+				operation = attr.Value
+			}
+		}
+		if percentage == 0 && operation != nil {
+			t.Errorf("got: %v, want: nil", operation)
+		}
+		if percentage == 100 && operation != "getPet" {
+			t.Errorf("got: %v, want: %v", operation, "getPet")
+		}
+	}
+}
+
+func TestObserveTrafficBytes(t *testing.T) {
+	req := &v3.HTTPRequestProperties{RequestHeadersBytes: 100, RequestBodyBytes: 20}
+	resp := &v3.HTTPResponseProperties{ResponseHeadersBytes: 200, ResponseBodyBytes: 1000}
+	observeTrafficBytes("traffic-org", "env", "spec", "api", "op", req, resp)
+	observeTrafficBytes("traffic-org", "env", "spec", "api", "op", req, nil)
+
+	if got := prometheustest.ToFloat64(prometheusRequestBytes.WithLabelValues("traffic-org", "env", "spec", "api", "op")); got != 240 {
+		t.Errorf("request bytes got: %v, want: %v", got, 240)
+	}
+	if got := prometheustest.ToFloat64(prometheusResponseBytes.WithLabelValues("traffic-org", "env", "spec", "api", "op")); got != 1200 {
+		t.Errorf("response bytes got: %v, want: %v", got, 1200)
+	}
+	if got := prometheustest.CollectAndCount(prometheusResponseSize); got == 0 {
+		t.Errorf("response sizes should be observed")
+	}
 }
 
 func TestTimeToUnix(t *testing.T) {
@@ -257,7 +356,8 @@ func TestAddDurationApigee(t *testing.T) {
 
 type testAnalyticsMan struct {
 	analytics.Manager
-	records []analytics.Record
+	records   []analytics.Record
+	sendError error
 }
 
 func (a *testAnalyticsMan) Start() {
@@ -265,6 +365,9 @@ func (a *testAnalyticsMan) Start() {
 }
 func (a *testAnalyticsMan) Close() {}
 func (a *testAnalyticsMan) SendRecords(authContext *auth.Context, records []analytics.Record) error {
+	if a.sendError != nil {
+		return a.sendError
+	}
 
 	for _, rec := range records {
 		rec = rec.EnsureFields(authContext)
@@ -306,6 +409,10 @@ func TestStreamAccessLogs(t *testing.T) {
 		makeTCPLog(),
 		{}, // empty one,
 	}
+	logMsgs[0].Identifier = &als.StreamAccessLogsMessage_Identifier{
+		Node:    &core.Node{Id: "node-1", Cluster: "fleet-a"},
+		LogName: "apigee",
+	}
 
 	for _, v := range logMsgs {
 		if err := stream.Send(v); err != nil {
@@ -316,6 +423,9 @@ func TestStreamAccessLogs(t *testing.T) {
 	if _, err := stream.CloseAndRecv(); err != nil && err != io.EOF {
 		t.Error(err)
 	}
+	if got := prometheustest.ToFloat64(prometheusAnalyticsClusterRequests.WithLabelValues("hi", "fleet-a", "ok")); got < 1 {
+		t.Errorf("want requests counted by cluster, got: %v", got)
+	}
 
 	stream, err = client.StreamAccessLogs(ctx)
 	if err != nil {
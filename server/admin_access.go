@@ -0,0 +1,158 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	adminDeniedAddress     = "address"
+	adminDeniedCertificate = "certificate"
+	adminDeniedToken       = "token"
+)
+
+// adminAccess restricts the clients of the metrics address handlers
+type adminAccess struct {
+	next         http.Handler
+	token        []byte
+	certificates bool
+	allowed      []*net.IPNet
+	unrestricted map[string]bool
+	cors         *authorizationCORS // preflights of allowed origins need no token
+}
+
+// NewAdminAccessHandler returns next restricted per access, or next itself
+// if no restrictions are set. Client certificates must be verified by the
+// TLS listener, see AdminClientCAs. If next is the authorization CORS
+// handler, its preflights of allowed origins are let through without the
+// bearer token.
+func NewAdminAccessHandler(access config.AdminAccess, next http.Handler) (http.Handler, error) {
+	if access.BearerToken == "" && access.ClientCAFile == "" && len(access.AllowedCIDRs) == 0 {
+		return next, nil
+	}
+	a := &adminAccess{
+		next:         next,
+		token:        []byte(access.BearerToken),
+		certificates: access.ClientCAFile != "",
+		unrestricted: make(map[string]bool),
+	}
+	for _, cidr := range access.AllowedCIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		a.allowed = append(a.allowed, ipNet)
+	}
+	for _, path := range access.UnrestrictedPaths {
+		a.unrestricted[path] = true
+	}
+	a.cors, _ = next.(*authorizationCORS)
+	return a, nil
+}
+
+// RegisterAdminHandlers adds the handlers of the endpoints changing state or
+// returning consumer details to mux, only if access restricts their clients.
+func (h *Handler) RegisterAdminHandlers(mux *http.ServeMux, access config.AdminAccess) {
+	if !access.Enabled() {
+		log.Infof("admin endpoints not served, set global.admin_access to enable them")
+		return
+	}
+	mux.HandleFunc("/traces", h.TraceHandlerFunc())
+	mux.HandleFunc("/consumers/blocks", h.ConsumerBlocksHandlerFunc())
+	mux.HandleFunc("/caches/invalidate", h.CacheInvalidationHandlerFunc())
+	mux.HandleFunc("/features", h.FeatureFlagsHandlerFunc())
+	mux.HandleFunc(authorizePath, h.AuthorizationHandlerFunc())
+}
+
+// AdminClientCAs returns the CAs of access client certificates, nil if unset.
+func AdminClientCAs(access config.AdminAccess) (*x509.CertPool, error) {
+	if access.ClientCAFile == "" {
+		return nil, nil
+	}
+	caCert, err := os.ReadFile(access.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if ok := pool.AppendCertsFromPEM(caCert); !ok {
+		return nil, fmt.Errorf("error appending admin client CA to cert pool")
+	}
+	return pool, nil
+}
+
+func (a *adminAccess) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.unrestricted[r.URL.Path] {
+		a.next.ServeHTTP(w, r)
+		return
+	}
+	if len(a.allowed) > 0 && !a.allowedAddress(r.RemoteAddr) {
+		a.deny(w, r, adminDeniedAddress, http.StatusForbidden)
+		return
+	}
+	if a.certificates && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		a.deny(w, r, adminDeniedCertificate, http.StatusForbidden)
+		return
+	}
+	if len(a.token) > 0 && (a.cors == nil || !a.cors.allowedPreflight(r)) {
+		header := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(header, "Bearer ")
+		if token == header || subtle.ConstantTimeCompare([]byte(token), a.token) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			a.deny(w, r, adminDeniedToken, http.StatusUnauthorized)
+			return
+		}
+	}
+	a.next.ServeHTTP(w, r)
+}
+
+func (a *adminAccess) allowedAddress(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	for _, ipNet := range a.allowed {
+		if ip != nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *adminAccess) deny(w http.ResponseWriter, r *http.Request, reason string, code int) {
+	log.Debugf("denied %s %s from %s: %s", r.Method, r.URL.Path, r.RemoteAddr, reason)
+	prometheusAdminDenied.WithLabelValues(reason).Inc()
+	http.Error(w, http.StatusText(code), code)
+}
+
+var (
+	prometheusAdminDenied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "admin",
+		Name:      "denied_requests_count",
+		Help:      "Total number of metrics address requests denied by reason",
+	}, []string{"reason"})
+)
@@ -0,0 +1,143 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	prometheustest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAdminAccessHandler(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	if h, err := NewAdminAccessHandler(config.AdminAccess{UnrestrictedPaths: []string{"/healthz"}}, next); err != nil {
+		t.Fatal(err)
+	} else if _, ok := h.(*adminAccess); ok {
+		t.Errorf("want next handler without restrictions")
+	}
+	if _, err := NewAdminAccessHandler(config.AdminAccess{AllowedCIDRs: []string{"bad"}}, next); err == nil {
+		t.Errorf("want error for bad CIDR")
+	}
+
+	access := config.AdminAccess{
+		BearerToken:       "secret",
+		ClientCAFile:      "ca.pem",
+		AllowedCIDRs:      []string{"10.0.0.0/8", "::1/128"},
+		UnrestrictedPaths: []string{"/healthz"},
+	}
+	h, err := NewAdminAccessHandler(access, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+
+	tests := []struct {
+		desc       string
+		path       string
+		remoteAddr string
+		tls        *tls.ConnectionState
+		auth       string
+		wantCode   int
+	}{
+		{"allowed", "/metrics", "10.1.2.3:1234", verified, "Bearer secret", http.StatusOK},
+		{"allowed ipv6", "/metrics", "[::1]:1234", verified, "Bearer secret", http.StatusOK},
+		{"unrestricted path", "/healthz", "192.168.0.1:1234", nil, "", http.StatusOK},
+		{"address not allowed", "/metrics", "192.168.0.1:1234", verified, "Bearer secret", http.StatusForbidden},
+		{"bad address", "/metrics", "bad", verified, "Bearer secret", http.StatusForbidden},
+		{"no tls", "/metrics", "10.1.2.3:1234", nil, "Bearer secret", http.StatusForbidden},
+		{"no certificate", "/metrics", "10.1.2.3:1234", &tls.ConnectionState{}, "Bearer secret", http.StatusForbidden},
+		{"no token", "/traces", "10.1.2.3:1234", verified, "", http.StatusUnauthorized},
+		{"bad token", "/traces", "10.1.2.3:1234", verified, "Bearer other", http.StatusUnauthorized},
+		{"token without scheme", "/traces", "10.1.2.3:1234", verified, "secret", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, test.path, nil)
+			r.RemoteAddr = test.remoteAddr
+			r.TLS = test.tls
+			if test.auth != "" {
+				r.Header.Set("Authorization", test.auth)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != test.wantCode {
+				t.Errorf("want status %d, got: %d", test.wantCode, w.Code)
+			}
+			if test.wantCode == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("want WWW-Authenticate header")
+			}
+		})
+	}
+	if got := prometheustest.ToFloat64(prometheusAdminDenied.WithLabelValues(adminDeniedToken)); got != 3 {
+		t.Errorf("want 3 token denials, got: %v", got)
+	}
+}
+
+func TestAdminClientCAs(t *testing.T) {
+	if pool, err := AdminClientCAs(config.AdminAccess{}); pool != nil || err != nil {
+		t.Errorf("want no pool, got: %v, %v", pool, err)
+	}
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.Close()
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if pool, err := AdminClientCAs(config.AdminAccess{ClientCAFile: caFile}); pool == nil || err != nil {
+		t.Errorf("want pool, got: %v, %v", pool, err)
+	}
+
+	badFile := filepath.Join(dir, "bad.pem")
+	if err := os.WriteFile(badFile, []byte("bad"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{badFile, filepath.Join(dir, "missing.pem")} {
+		if _, err := AdminClientCAs(config.AdminAccess{ClientCAFile: file}); err == nil {
+			t.Errorf("want error for %s", file)
+		}
+	}
+}
+
+func TestRegisterAdminHandlers(t *testing.T) {
+	paths := []string{"/traces", "/consumers/blocks", "/caches/invalidate", "/features", authorizePath}
+	h := &Handler{}
+
+	mux := http.NewServeMux()
+	h.RegisterAdminHandlers(mux, config.AdminAccess{UnrestrictedPaths: []string{"/healthz"}})
+	for _, path := range paths {
+		if _, pattern := mux.Handler(httptest.NewRequest(http.MethodGet, path, nil)); pattern != "" {
+			t.Errorf("want %s not served without admin access", path)
+		}
+	}
+
+	mux = http.NewServeMux()
+	h.RegisterAdminHandlers(mux, config.AdminAccess{BearerToken: "secret"})
+	for _, path := range paths {
+		if _, pattern := mux.Handler(httptest.NewRequest(http.MethodGet, path, nil)); pattern != path {
+			t.Errorf("want %s served with admin access, got %q", path, pattern)
+		}
+	}
+}
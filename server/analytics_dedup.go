@@ -0,0 +1,106 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/cache"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	recordDedupEvictionInterval = 10 * time.Second
+	recordDedupMaxEntries       = 100000
+)
+
+// recordDeduplicator remembers the access log entries recently recorded as
+// analytics so entries Envoy resends after reconnecting aren't counted twice.
+// Entries are identified by a hash of their request ID and start time. An
+// entry whose record failed to send is remembered with its quotas counted so
+// they aren't counted again when it's resent.
+type recordDeduplicator struct {
+	mu       sync.Mutex
+	recorded cache.ExpiringCache // key -> true if recorded, false if quotas counted
+	org      string
+}
+
+// newRecordDeduplicator remembers entries for window. Returns nil if window
+// is not positive.
+func newRecordDeduplicator(window time.Duration, org string) *recordDeduplicator {
+	if window <= 0 {
+		return nil
+	}
+	return &recordDeduplicator{
+		recorded: cache.NewLRU(window, recordDedupEvictionInterval, recordDedupMaxEntries),
+		org:      org,
+	}
+}
+
+// recordKey returns the key of an entry, 0 if it has no request ID
+func recordKey(requestID string, start *timestamp.Timestamp) uint64 {
+	if requestID == "" {
+		return 0
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(requestID))
+	var b [12]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(start.GetSeconds()))
+	binary.BigEndian.PutUint32(b[8:], uint32(start.GetNanos()))
+	_, _ = h.Write(b[:])
+	return h.Sum64()
+}
+
+// begin returns true if the entry was recorded within the window. Otherwise it
+// marks the quotas of the entry counted, and returns whether they already were.
+func (d *recordDeduplicator) begin(key uint64) (recorded, quotasCounted bool) {
+	if d == nil || key == 0 {
+		return false, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if v, ok := d.recorded.Get(key); ok {
+		if v.(bool) {
+			prometheusDuplicateRecords.WithLabelValues(d.org).Inc()
+			return true, true
+		}
+		return false, true
+	}
+	d.recorded.Set(key, false)
+	return false, false
+}
+
+// remember marks the entry recorded
+func (d *recordDeduplicator) remember(key uint64) {
+	if d == nil || key == 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.recorded.Set(key, true)
+}
+
+var (
+	prometheusDuplicateRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "analytics",
+		Name:      "duplicate_records_count",
+		Help:      "Total number of resent access log entries not recorded again",
+	}, []string{"org"})
+)
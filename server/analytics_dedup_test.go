@@ -0,0 +1,211 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	v3 "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
+	als "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v3"
+	"github.com/google/go-cmp/cmp"
+	prometheustest "github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestRecordKey(t *testing.T) {
+	start := timestamppb.New(time.Unix(1600000000, 500))
+	key := recordKey("id", start)
+	if key == 0 {
+		t.Fatalf("want key")
+	}
+	if recordKey("id", timestamppb.New(time.Unix(1600000000, 500))) != key {
+		t.Errorf("want same key for same entry")
+	}
+	if recordKey("other", start) == key {
+		t.Errorf("want different key for different request ID")
+	}
+	if recordKey("id", timestamppb.New(time.Unix(1600000000, 501))) == key {
+		t.Errorf("want different key for different start time")
+	}
+	if recordKey("", start) != 0 {
+		t.Errorf("want no key without request ID")
+	}
+}
+
+func TestRecordDeduplicator(t *testing.T) {
+	if d := newRecordDeduplicator(0, "org"); d != nil {
+		t.Errorf("want nil deduplicator")
+	}
+	var nilDedup *recordDeduplicator
+	nilDedup.remember(1) // no panic
+	if recorded, counted := nilDedup.begin(1); recorded || counted {
+		t.Errorf("nil deduplicator should not find duplicates")
+	}
+
+	d := newRecordDeduplicator(time.Minute, "dedup-org")
+	if recorded, counted := d.begin(1); recorded || counted {
+		t.Errorf("want new entry")
+	}
+	// send failed, resent
+	if recorded, counted := d.begin(1); recorded || !counted {
+		t.Errorf("want entry not recorded with quotas counted, got: %t, %t", recorded, counted)
+	}
+	d.remember(1)
+	d.remember(0)
+	if recorded, _ := d.begin(1); !recorded {
+		t.Errorf("want duplicate entry")
+	}
+	if recorded, counted := d.begin(0); recorded || counted {
+		t.Errorf("want entries without key never duplicate")
+	}
+	if got := prometheustest.ToFloat64(prometheusDuplicateRecords.WithLabelValues("dedup-org")); got != 1 {
+		t.Errorf("want 1 duplicate counted, got: %v", got)
+	}
+}
+
+func TestHandleHTTPLogsDuplicates(t *testing.T) {
+	start := timestamppb.Now()
+	entry := func(requestID string) *v3.HTTPAccessLogEntry {
+		return &v3.HTTPAccessLogEntry{
+			CommonProperties: &v3.AccessLogCommon{
+				StartTime: start,
+				Metadata: &core.Metadata{
+					FilterMetadata: map[string]*structpb.Struct{
+						extAuthzFilterNamespace: {Fields: makeExtAuthFields()},
+					},
+				},
+			},
+			Request: &v3.HTTPRequestProperties{
+				Path:      "/path",
+				RequestId: requestID,
+			},
+			Response: &v3.HTTPResponseProperties{},
+		}
+	}
+	msg := &als.StreamAccessLogsMessage_HttpLogs{
+		HttpLogs: &als.StreamAccessLogsMessage_HTTPAccessLogEntries{
+			LogEntry: []*v3.HTTPAccessLogEntry{entry("a"), entry("b"), entry("")},
+		},
+	}
+
+	testAnalyticsMan := &testAnalyticsMan{}
+	server := AccessLogServer{
+		handler: &Handler{
+			orgName:      "org",
+			envName:      "env",
+			analyticsMan: testAnalyticsMan,
+			recordDedup:  newRecordDeduplicator(time.Minute, "org"),
+		},
+	}
+
+	// resent entries with a request ID are recorded once
+	for i := 0; i < 2; i++ {
+		if err := server.handleHTTPLogs(msg, envoySource{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := len(testAnalyticsMan.records); got != 4 {
+		t.Errorf("want 4 records, got: %d", got)
+	}
+}
+
+func TestResentEntryCountsQuotasOnce(t *testing.T) {
+	fields := makeExtAuthFields()
+	metadata := &structpb.Struct{Fields: fields}
+	encodePendingQuotasMetadata(metadata, []product.AuthorizedOperation{{ID: "product1", QuotaLimit: 10}})
+	entry := &v3.HTTPAccessLogEntry{
+		CommonProperties: &v3.AccessLogCommon{
+			StartTime: timestamppb.Now(),
+			Metadata: &core.Metadata{
+				FilterMetadata: map[string]*structpb.Struct{extAuthzFilterNamespace: metadata},
+			},
+		},
+		Request:  &v3.HTTPRequestProperties{Path: "/path", RequestId: "req"},
+		Response: &v3.HTTPResponseProperties{ResponseCode: wrapperspb.UInt32(200)},
+	}
+
+	testAnalyticsMan := &testAnalyticsMan{sendError: fmt.Errorf("send error")}
+	quotaMan := &testQuotaMan{}
+	h := &Handler{
+		orgName:       "org",
+		envName:       "env",
+		analyticsMan:  testAnalyticsMan,
+		quotaMan:      quotaMan,
+		quotaCounting: config.QuotaCountingAccessLog,
+		recordDedup:   newRecordDeduplicator(time.Minute, "org"),
+	}
+
+	if err := h.handleHTTPLogEntry(entry, envoySource{}, defaultGatewaySource); err == nil {
+		t.Fatal("want send error")
+	}
+	testAnalyticsMan.sendError = nil
+	for i := 0; i < 2; i++ { // resent after the failure, then a duplicate
+		if err := h.handleHTTPLogEntry(entry, envoySource{}, defaultGatewaySource); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := len(testAnalyticsMan.records); got != 1 {
+		t.Errorf("want 1 record, got: %d", got)
+	}
+	if diff := cmp.Diff([]string{"product1"}, quotaMan.applied); diff != "" {
+		t.Errorf("applied diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestDroppedRecordNotRemembered(t *testing.T) {
+	entry := &v3.HTTPAccessLogEntry{
+		CommonProperties: &v3.AccessLogCommon{
+			StartTime: timestamppb.Now(),
+			Metadata: &core.Metadata{
+				FilterMetadata: map[string]*structpb.Struct{
+					extAuthzFilterNamespace: {Fields: makeExtAuthFields()},
+				},
+			},
+		},
+		Request:  &v3.HTTPRequestProperties{Path: "/path", RequestId: "req"},
+		Response: &v3.HTTPResponseProperties{},
+	}
+
+	testAnalyticsMan := &testAnalyticsMan{}
+	h := &Handler{
+		orgName:          "org",
+		envName:          "env",
+		analyticsMan:     testAnalyticsMan,
+		recordDedup:      newRecordDeduplicator(time.Minute, "org"),
+		analyticsWorkers: newAnalyticsWorkers(1, 1, "org", testAnalyticsMan.SendRecords),
+	}
+	h.analyticsWorkers.stop() // drops all records
+
+	if err := h.handleHTTPLogEntry(entry, envoySource{}, defaultGatewaySource); err != nil {
+		t.Fatalf("want dropped record not to fail the stream, got: %v", err)
+	}
+
+	// resent entry is recorded
+	h.analyticsWorkers = nil
+	if err := h.handleHTTPLogEntry(entry, envoySource{}, defaultGatewaySource); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(testAnalyticsMan.records); got != 1 {
+		t.Errorf("want resent record, got: %d", got)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+)
+
+// AnalyticsEnricher modifies analytics records before they are sent to
+// Apigee, such as to add attributes specific to an enterprise.
+type AnalyticsEnricher interface {
+	// Enrich is called for each record before it is sent, possibly
+	// concurrently. The authContext identifies the org, env, and consumer.
+	Enrich(record *analytics.Record, authContext *auth.Context)
+}
+
+// AnalyticsEnricherFunc adapts a function to an AnalyticsEnricher.
+type AnalyticsEnricherFunc func(record *analytics.Record, authContext *auth.Context)
+
+// Enrich calls f(record, authContext).
+func (f AnalyticsEnricherFunc) Enrich(record *analytics.Record, authContext *auth.Context) {
+	f(record, authContext)
+}
+
+var (
+	registeredAnalyticsEnrichersMu sync.Mutex
+	registeredAnalyticsEnrichers   []AnalyticsEnricher
+)
+
+// RegisterAnalyticsEnricher adds an AnalyticsEnricher to the Handlers
+// created after by NewHandler. Enrichers are called in the order registered.
+// It panics if enricher is nil.
+func RegisterAnalyticsEnricher(enricher AnalyticsEnricher) {
+	if enricher == nil {
+		panic("server: RegisterAnalyticsEnricher with nil enricher")
+	}
+	registeredAnalyticsEnrichersMu.Lock()
+	defer registeredAnalyticsEnrichersMu.Unlock()
+	registeredAnalyticsEnrichers = append(registeredAnalyticsEnrichers, enricher)
+}
+
+// analyticsEnrichers returns a copy of the registered enrichers
+func analyticsEnrichers() []AnalyticsEnricher {
+	registeredAnalyticsEnrichersMu.Lock()
+	defer registeredAnalyticsEnrichersMu.Unlock()
+	return append([]AnalyticsEnricher(nil), registeredAnalyticsEnrichers...)
+}
+
+// enrichRecord calls the enrichers of the handler on the record. A panicking
+// enricher is logged and skipped so the record is still sent.
+func (h *Handler) enrichRecord(record *analytics.Record, authContext *auth.Context) {
+	for _, e := range h.analyticsEnrichers {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("analytics enricher %T panic: %v", e, r)
+				}
+			}()
+			e.Enrich(record, authContext)
+		}()
+	}
+}
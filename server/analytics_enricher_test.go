@@ -0,0 +1,108 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
+	"github.com/gogo/googleapis/google/rpc"
+)
+
+func TestRegisterAnalyticsEnricher(t *testing.T) {
+	defer func() {
+		registeredAnalyticsEnrichers = nil
+	}()
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("want panic registering nil enricher")
+			}
+		}()
+		RegisterAnalyticsEnricher(nil)
+	}()
+
+	RegisterAnalyticsEnricher(AnalyticsEnricherFunc(func(record *analytics.Record, authContext *auth.Context) {}))
+	if got := analyticsEnrichers(); len(got) != 1 {
+		t.Errorf("want 1 enricher, got: %d", len(got))
+	}
+}
+
+func TestEnrichRecord(t *testing.T) {
+	var calls []string
+	h := &Handler{
+		analyticsEnrichers: []AnalyticsEnricher{
+			AnalyticsEnricherFunc(func(record *analytics.Record, authContext *auth.Context) {
+				calls = append(calls, "panics")
+				panic("bad enricher")
+			}),
+			AnalyticsEnricherFunc(func(record *analytics.Record, authContext *auth.Context) {
+				calls = append(calls, "enriches")
+				record.Attributes = append(record.Attributes, analytics.Attribute{
+					Name:  "cost_center",
+					Value: authContext.Application,
+				})
+			}),
+		},
+	}
+	record := analytics.Record{}
+	h.enrichRecord(&record, &auth.Context{Application: "app"})
+	if len(calls) != 2 {
+		t.Errorf("want both enrichers called, got: %v", calls)
+	}
+	if len(record.Attributes) != 1 || record.Attributes[0].Value != "app" {
+		t.Errorf("want enriched attribute, got: %v", record.Attributes)
+	}
+}
+
+func TestEnrichDeniedRecord(t *testing.T) {
+	testAnalyticsMan := &testAnalyticsMan{}
+	server := AuthorizationServer{
+		handler: &Handler{
+			apiHeader:    headerAPI,
+			authMan:      &testAuthMan{},
+			productMan:   &testProductMan{},
+			quotaMan:     &testQuotaMan{},
+			analyticsMan: testAnalyticsMan,
+			ready:        util.NewAtomicBool(true),
+			analyticsEnrichers: []AnalyticsEnricher{
+				AnalyticsEnricherFunc(func(record *analytics.Record, authContext *auth.Context) {
+					record.Attributes = append(record.Attributes, analytics.Attribute{Name: "region", Value: "eu"})
+				}),
+			},
+		},
+	}
+	req := testutil.NewEnvoyRequest(http.MethodGet, "/path", map[string]string{}, nil)
+	resp, err := server.Check(context.Background(), req)
+	if err != nil {
+		t.Fatalf("should not get error. got: %s", err)
+	}
+	if resp.Status.Code != int32(rpc.UNAUTHENTICATED) {
+		t.Fatalf("want: %d, got: %d", rpc.UNAUTHENTICATED, resp.Status.Code)
+	}
+	if len(testAnalyticsMan.records) != 1 {
+		t.Fatalf("want 1 record, got: %d", len(testAnalyticsMan.records))
+	}
+	attrs := testAnalyticsMan.records[0].Attributes
+	if len(attrs) != 1 || attrs[0].Name != "region" || attrs[0].Value != "eu" {
+		t.Errorf("want enriched attribute, got: %v", attrs)
+	}
+}
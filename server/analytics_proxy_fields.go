@@ -0,0 +1,69 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
+)
+
+const (
+	// analytics attributes populated with the proxy base path and virtual host,
+	// the records have no fields of their own for them
+	proxyBasepathAttribute    = "proxy.basepath"
+	proxyVirtualHostAttribute = "proxy.virtual_host"
+)
+
+// applyProxyFields sets the proxy revision of the record and adds its proxy
+// base path and virtual host attributes. The values mapped to the record's
+// API proxy by analytics.proxy_fields win over the default revision, the
+// base path of the matched API, and the host of the request.
+func (h *Handler) applyProxyFields(record *analytics.Record, basepath, host string) {
+	fields := h.analyticsProxyFields[record.APIProxy]
+
+	record.APIProxyRevision = config.DefaultAnalyticsProxyRevision
+	if fields.Revision > 0 {
+		record.APIProxyRevision = fields.Revision
+	}
+	if fields.BasePath != "" {
+		basepath = fields.BasePath
+	}
+	if basepath != "" {
+		record.Attributes = append(record.Attributes, analytics.Attribute{
+			Name:  proxyBasepathAttribute,
+			Value: basepath,
+		})
+	}
+	virtualHost := fields.VirtualHost
+	if virtualHost == "" {
+		virtualHost = hostWithoutPort(host)
+	}
+	if virtualHost != "" {
+		record.Attributes = append(record.Attributes, analytics.Attribute{
+			Name:  proxyVirtualHostAttribute,
+			Value: virtualHost,
+		})
+	}
+}
+
+// hostWithoutPort returns the host of a Host header or :authority
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
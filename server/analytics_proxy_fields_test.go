@@ -0,0 +1,72 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestApplyProxyFields(t *testing.T) {
+	h := &Handler{analyticsProxyFields: map[string]config.AnalyticsProxyFields{
+		"mapped":   {Revision: 7, BasePath: "/custom", VirtualHost: "secure"},
+		"revision": {Revision: 3},
+	}}
+	bot := analytics.Attribute{Name: botRuleAttribute, Value: "headless"}
+
+	tests := []struct {
+		desc         string
+		proxy        string
+		basepath     string
+		host         string
+		wantRevision int
+		want         []analytics.Attribute
+	}{
+		{"defaults", "api", "/v1", "api.example.com:8080", config.DefaultAnalyticsProxyRevision, []analytics.Attribute{
+			bot,
+			{Name: proxyBasepathAttribute, Value: "/v1"},
+			{Name: proxyVirtualHostAttribute, Value: "api.example.com"},
+		}},
+		{"mapped", "mapped", "/v1", "api.example.com", 7, []analytics.Attribute{
+			bot,
+			{Name: proxyBasepathAttribute, Value: "/custom"},
+			{Name: proxyVirtualHostAttribute, Value: "secure"},
+		}},
+		{"revision mapped", "revision", "/v1", "[::1]:443", 3, []analytics.Attribute{
+			bot,
+			{Name: proxyBasepathAttribute, Value: "/v1"},
+			{Name: proxyVirtualHostAttribute, Value: "::1"},
+		}},
+		{"unknown", "api", "", "", config.DefaultAnalyticsProxyRevision, []analytics.Attribute{bot}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			record := analytics.Record{
+				APIProxy:   test.proxy,
+				Attributes: []analytics.Attribute{bot},
+			}
+			h.applyProxyFields(&record, test.basepath, test.host)
+			if record.APIProxyRevision != test.wantRevision {
+				t.Errorf("want revision %d, got %d", test.wantRevision, record.APIProxyRevision)
+			}
+			if diff := cmp.Diff(test.want, record.Attributes); diff != "" {
+				t.Errorf("diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
+	"github.com/gogo/googleapis/google/rpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// analyticsStagingDir is where the analytics manager places files awaiting upload
+const analyticsStagingDir = "staging"
+
+// spoolMonitor periodically counts the analytics files awaiting upload and
+// flags backpressure when the count reaches the configured threshold.
+type spoolMonitor struct {
+	dir       string
+	threshold int
+	denyCode  rpc.Code
+	interval  time.Duration
+	active    *util.AtomicBool
+	done      chan struct{}
+}
+
+// newSpoolMonitor creates a spoolMonitor for the analytics buffer dir.
+// Returns nil if threshold is not positive.
+func newSpoolMonitor(analyticsDir string, threshold, denyStatusCode int, interval time.Duration) *spoolMonitor {
+	if threshold <= 0 {
+		return nil
+	}
+	denyCode := rpc.UNAVAILABLE
+	if denyStatusCode == http.StatusTooManyRequests {
+		denyCode = rpc.RESOURCE_EXHAUSTED
+	}
+	return &spoolMonitor{
+		dir:       filepath.Join(analyticsDir, analyticsStagingDir),
+		threshold: threshold,
+		denyCode:  denyCode,
+		interval:  interval,
+		active:    util.NewAtomicBool(false),
+		done:      make(chan struct{}),
+	}
+}
+
+func (s *spoolMonitor) start() {
+	s.check()
+	go func() {
+		t := time.NewTicker(s.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				s.check()
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
+func (s *spoolMonitor) stop() {
+	if s != nil {
+		close(s.done)
+	}
+}
+
+// backpressure returns true if new requests should be denied
+func (s *spoolMonitor) backpressure() bool {
+	return s != nil && s.active.IsTrue()
+}
+
+// check counts the spooled files and updates the backpressure state
+func (s *spoolMonitor) check() {
+	count := 0
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warnf("unable to measure analytics spool %s: %v", s.dir, err)
+		return
+	}
+	prometheusSpoolFiles.Set(float64(count))
+
+	if count >= s.threshold {
+		if !s.active.IsTrue() {
+			log.Warnf("analytics spool has %d files (threshold %d), denying requests", count, s.threshold)
+			s.active.SetTrue()
+			prometheusSpoolBackpressure.Set(1)
+		}
+	} else if s.active.IsTrue() {
+		log.Infof("analytics spool has %d files (threshold %d), resuming requests", count, s.threshold)
+		s.active.SetFalse()
+		prometheusSpoolBackpressure.Set(0)
+	}
+}
+
+var (
+	prometheusSpoolFiles = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "analytics",
+		Name:      "spool_files",
+		Help:      "Number of analytics files awaiting upload",
+	})
+
+	prometheusSpoolBackpressure = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "analytics",
+		Name:      "spool_backpressure_active",
+		Help:      "1 if requests are being denied because the analytics spool is over threshold",
+	})
+
+	prometheusSpoolDenied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "analytics",
+		Name:      "spool_backpressure_denied_count",
+		Help:      "Total number of requests denied because the analytics spool is over threshold",
+	}, []string{"org", "env"})
+)
@@ -0,0 +1,131 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/gogo/googleapis/google/rpc"
+)
+
+func TestSpoolMonitor(t *testing.T) {
+	if s := newSpoolMonitor("dir", 0, http.StatusServiceUnavailable, time.Minute); s != nil {
+		t.Errorf("want nil monitor for zero threshold")
+	}
+	var nilMonitor *spoolMonitor
+	if nilMonitor.backpressure() {
+		t.Errorf("nil monitor should not apply backpressure")
+	}
+	nilMonitor.stop()
+
+	dir := t.TempDir()
+	tenantDir := filepath.Join(dir, analyticsStagingDir, "org~env")
+	if err := os.MkdirAll(tenantDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newSpoolMonitor(dir, 2, http.StatusTooManyRequests, time.Minute)
+	if s.denyCode != rpc.RESOURCE_EXHAUSTED {
+		t.Errorf("want %s, got %s", rpc.RESOURCE_EXHAUSTED, s.denyCode)
+	}
+
+	s.check()
+	if s.backpressure() {
+		t.Errorf("empty spool should not apply backpressure")
+	}
+
+	for _, f := range []string{"1.gz", "2.gz"} {
+		if err := os.WriteFile(filepath.Join(tenantDir, f), []byte{}, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.check()
+	if !s.backpressure() {
+		t.Errorf("full spool should apply backpressure")
+	}
+
+	if err := os.Remove(filepath.Join(tenantDir, "1.gz")); err != nil {
+		t.Fatal(err)
+	}
+	s.check()
+	if s.backpressure() {
+		t.Errorf("drained spool should not apply backpressure")
+	}
+}
+
+func TestCheckSpoolBackpressure(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, analyticsStagingDir), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, analyticsStagingDir, "1.gz"), []byte{}, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc       string
+		statusCode int
+		wantCode   rpc.Code
+		wantStatus typev3.StatusCode
+	}{
+		{"unavailable", http.StatusServiceUnavailable, rpc.UNAVAILABLE, typev3.StatusCode_ServiceUnavailable},
+		{"too many requests", http.StatusTooManyRequests, rpc.RESOURCE_EXHAUSTED, typev3.StatusCode_TooManyRequests},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			spool := newSpoolMonitor(dir, 1, test.statusCode, time.Minute)
+			spool.check()
+			testAnalyticsMan := &testAnalyticsMan{}
+			server := AuthorizationServer{
+				handler: &Handler{
+					orgName:      "org",
+					envName:      "env",
+					analyticsMan: testAnalyticsMan,
+					ready:        util.NewAtomicBool(true),
+					spool:        spool,
+				},
+			}
+
+			req := testutil.NewEnvoyRequest(http.MethodGet, "/", map[string]string{}, nil)
+			resp, err := server.Check(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Status.Code != int32(test.wantCode) {
+				t.Errorf("want: %d, got: %d", test.wantCode, resp.Status.Code)
+			}
+			denied, ok := resp.HttpResponse.(*authv3.CheckResponse_DeniedResponse)
+			if !ok {
+				t.Fatal("must be DeniedResponse")
+			}
+			if denied.DeniedResponse.Status.Code != test.wantStatus {
+				t.Errorf("want: %s, got: %s", test.wantStatus, denied.DeniedResponse.Status.Code)
+			}
+			if len(testAnalyticsMan.records) != 0 {
+				t.Errorf("want no analytics records, got: %d", len(testAnalyticsMan.records))
+			}
+		})
+	}
+}
@@ -0,0 +1,391 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	coltrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonv1 "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcev1 "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const (
+	// steps of an analytics upload
+	analyticsUploadStepSignedURL = "signed_url" // GET of the signed URL from UAP
+	analyticsUploadStepUpload    = "upload"     // PUT of the file to the signed URL
+
+	analyticsUploadTransportError = "error" // code of requests without a response
+
+	uploadSpanResultExported = "exported"
+	uploadSpanResultFailed   = "failed"
+	uploadSpanResultDropped  = "dropped"
+
+	uploadSpanBatchSize     = 100
+	uploadSpanQueueSize     = 1000
+	uploadSpanFlushInterval = 5 * time.Second
+	uploadSpanExportTimeout = 10 * time.Second
+)
+
+// uploadMonitor instruments the uploads of the analytics manager, which
+// otherwise only logs failures at debug level. It measures the files staged
+// for upload per environment, the duration and status of the requests for
+// signed URLs and of the uploads, and the attempts retried after a failure.
+// Each request is exported as an OpenTelemetry span if a tracer is set.
+type uploadMonitor struct {
+	org      string
+	dir      string
+	interval time.Duration
+	tracer   *uploadTracer
+	failed   *util.AtomicBool // the last attempt failed
+	done     chan struct{}
+}
+
+// newUploadMonitor creates an uploadMonitor of the analytics buffer dir
+// counting the staged files every interval and exporting spans to
+// traceEndpoint, none if empty
+func newUploadMonitor(analyticsDir, org string, interval time.Duration, traceEndpoint string) (*uploadMonitor, error) {
+	m := &uploadMonitor{
+		org:      org,
+		dir:      filepath.Join(analyticsDir, analyticsStagingDir),
+		interval: interval,
+		failed:   util.NewAtomicBool(false),
+		done:     make(chan struct{}),
+	}
+	if traceEndpoint != "" {
+		var err error
+		if m.tracer, err = newUploadTracer(traceEndpoint, org); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *uploadMonitor) start() {
+	m.tracer.start()
+	m.countStaged()
+	if m.interval <= 0 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(m.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				m.countStaged()
+			case <-m.done:
+				return
+			}
+		}
+	}()
+}
+
+// stop exports the queued spans, call after the analytics manager is closed
+func (m *uploadMonitor) stop() {
+	if m != nil {
+		close(m.done)
+		m.tracer.stop()
+	}
+}
+
+// countStaged updates the number of files staged by environment. The
+// analytics manager stages files in a directory per "org~env".
+func (m *uploadMonitor) countStaged() {
+	dirs, err := os.ReadDir(m.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("unable to count staged analytics files in %s: %v", m.dir, err)
+		}
+		return
+	}
+	prometheusAnalyticsStagingFiles.Reset()
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(m.dir, d.Name()))
+		if err != nil {
+			log.Warnf("unable to count staged analytics files in %s: %v", d.Name(), err)
+			continue
+		}
+		org, env := d.Name(), ""
+		if i := strings.Index(org, "~"); i >= 0 {
+			org, env = org[:i], org[i+1:]
+		}
+		prometheusAnalyticsStagingFiles.WithLabelValues(org, env).Set(float64(len(files)))
+	}
+}
+
+// roundTripper instruments the requests of the analytics uploads made by rt
+func (m *uploadMonitor) roundTripper(rt http.RoundTripper) http.RoundTripper {
+	return uploadRoundTripper{monitor: m, rt: rt}
+}
+
+type uploadRoundTripper struct {
+	monitor *uploadMonitor
+	rt      http.RoundTripper
+}
+
+// RoundTrip records the request. Each upload attempt starts by requesting
+// a signed URL, so an attempt is retried if the previous attempt failed.
+func (u uploadRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	m := u.monitor
+	step := analyticsUploadStepSignedURL
+	if req.Method == http.MethodPut {
+		step = analyticsUploadStepUpload
+	}
+	retry := step == analyticsUploadStepSignedURL && m.failed.IsTrue()
+	if retry {
+		prometheusAnalyticsUploadRetries.WithLabelValues(m.org).Inc()
+	}
+
+	start := time.Now()
+	resp, err := u.rt.RoundTrip(req)
+	end := time.Now()
+
+	code := analyticsUploadTransportError
+	failed := err != nil || resp.StatusCode != http.StatusOK
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	if failed {
+		m.failed.SetTrue()
+	} else if step == analyticsUploadStepUpload {
+		m.failed.SetFalse()
+	}
+	prometheusAnalyticsUploadDuration.WithLabelValues(m.org, step, code).Observe(end.Sub(start).Seconds())
+	if m.tracer != nil {
+		m.tracer.record(uploadSpan(req, step, retry, start, end, resp, err))
+	}
+	return resp, err
+}
+
+// uploadSpan returns the span of an upload request. The URL is recorded
+// without its query, which holds the signature of a signed URL.
+func uploadSpan(req *http.Request, step string, retry bool, start, end time.Time, resp *http.Response, err error) *tracev1.Span {
+	u := url.URL{Scheme: req.URL.Scheme, Host: req.URL.Host, Path: req.URL.Path}
+	span := &tracev1.Span{
+		TraceId:           randomBytes(16),
+		SpanId:            randomBytes(8),
+		Name:              "analytics " + step,
+		Kind:              tracev1.Span_SPAN_KIND_CLIENT,
+		StartTimeUnixNano: uint64(start.UnixNano()),
+		EndTimeUnixNano:   uint64(end.UnixNano()),
+		Attributes: []*commonv1.KeyValue{
+			stringAttribute("http.method", req.Method),
+			stringAttribute("http.url", u.String()),
+			{Key: "apigee.analytics.retry", Value: &commonv1.AnyValue{Value: &commonv1.AnyValue_BoolValue{BoolValue: retry}}},
+		},
+		Status: &tracev1.Status{Code: tracev1.Status_STATUS_CODE_OK},
+	}
+	if err != nil {
+		span.Status = &tracev1.Status{Code: tracev1.Status_STATUS_CODE_ERROR, Message: err.Error()}
+		return span
+	}
+	span.Attributes = append(span.Attributes, &commonv1.KeyValue{
+		Key:   "http.status_code",
+		Value: &commonv1.AnyValue{Value: &commonv1.AnyValue_IntValue{IntValue: int64(resp.StatusCode)}},
+	})
+	if resp.StatusCode != http.StatusOK {
+		span.Status = &tracev1.Status{Code: tracev1.Status_STATUS_CODE_ERROR, Message: resp.Status}
+	}
+	return span
+}
+
+func stringAttribute(key, value string) *commonv1.KeyValue {
+	return &commonv1.KeyValue{Key: key, Value: &commonv1.AnyValue{Value: &commonv1.AnyValue_StringValue{StringValue: value}}}
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return b
+}
+
+// uploadTracer exports upload spans in batches from a bounded queue over
+// OTLP. Spans are dropped while the queue is full.
+type uploadTracer struct {
+	org      string
+	conn     *grpc.ClientConn
+	client   coltrace.TraceServiceClient
+	resource *resourcev1.Resource
+	queue    chan *tracev1.Span
+	wg       sync.WaitGroup
+
+	mu      sync.RWMutex
+	stopped bool
+}
+
+// newUploadTracer creates an uploadTracer exporting to the OTLP gRPC
+// collector at the http or https endpoint
+func newUploadTracer(endpoint, org string) (*uploadTracer, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	creds := insecure.NewCredentials()
+	if u.Scheme == "https" {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+	conn, err := grpc.Dial(u.Host, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("upload trace endpoint %s: %v", endpoint, err)
+	}
+	return &uploadTracer{
+		org:    org,
+		conn:   conn,
+		client: coltrace.NewTraceServiceClient(conn),
+		resource: &resourcev1.Resource{Attributes: []*commonv1.KeyValue{
+			stringAttribute("service.name", "apigee-remote-service-envoy"),
+			stringAttribute("apigee.organization", org),
+		}},
+		queue: make(chan *tracev1.Span, uploadSpanQueueSize),
+	}, nil
+}
+
+func (t *uploadTracer) start() {
+	if t == nil {
+		return
+	}
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		ticker := time.NewTicker(uploadSpanFlushInterval)
+		defer ticker.Stop()
+		batch := make([]*tracev1.Span, 0, uploadSpanBatchSize)
+		flush := func() {
+			if len(batch) > 0 {
+				t.export(batch)
+				batch = make([]*tracev1.Span, 0, uploadSpanBatchSize)
+			}
+		}
+		for {
+			select {
+			case span, ok := <-t.queue:
+				if !ok {
+					flush()
+					return
+				}
+				batch = append(batch, span)
+				if len(batch) >= uploadSpanBatchSize {
+					flush()
+				}
+			case <-ticker.C:
+				flush()
+			}
+		}
+	}()
+}
+
+// stop exports the queued spans and closes the connection
+func (t *uploadTracer) stop() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if !t.stopped {
+		t.stopped = true
+		close(t.queue)
+	}
+	t.mu.Unlock()
+	t.wg.Wait()
+	if err := t.conn.Close(); err != nil {
+		log.Debugf("closing upload trace connection: %v", err)
+	}
+}
+
+// record queues the span for export
+func (t *uploadTracer) record(span *tracev1.Span) {
+	if t == nil {
+		return
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if !t.stopped {
+		select {
+		case t.queue <- span:
+			return
+		default:
+		}
+	}
+	prometheusAnalyticsUploadSpans.WithLabelValues(t.org, uploadSpanResultDropped).Inc()
+}
+
+func (t *uploadTracer) export(spans []*tracev1.Span) {
+	ctx, cancel := context.WithTimeout(context.Background(), uploadSpanExportTimeout)
+	defer cancel()
+	_, err := t.client.Export(ctx, &coltrace.ExportTraceServiceRequest{
+		ResourceSpans: []*tracev1.ResourceSpans{{
+			Resource: t.resource,
+			InstrumentationLibrarySpans: []*tracev1.InstrumentationLibrarySpans{{
+				InstrumentationLibrary: &commonv1.InstrumentationLibrary{Name: "apigee-remote-service-envoy/analytics"},
+				Spans:                  spans,
+			}},
+		}},
+	})
+	result := uploadSpanResultExported
+	if err != nil {
+		log.Warnf("unable to export %d analytics upload spans: %v", len(spans), err)
+		result = uploadSpanResultFailed
+	}
+	prometheusAnalyticsUploadSpans.WithLabelValues(t.org, result).Add(float64(len(spans)))
+}
+
+var (
+	prometheusAnalyticsStagingFiles = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "analytics",
+		Name:      "staging_files",
+		Help:      "Number of analytics files staged for upload by environment",
+	}, []string{"org", "env"})
+
+	prometheusAnalyticsUploadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Subsystem: "analytics",
+		Name:      "upload_request_duration_seconds",
+		Help:      "Duration of the analytics upload requests by step and HTTP status code",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"org", "step", "code"})
+
+	prometheusAnalyticsUploadRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "analytics",
+		Name:      "upload_retry_count",
+		Help:      "Total number of analytics upload attempts following a failed attempt",
+	}, []string{"org"})
+
+	prometheusAnalyticsUploadSpans = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "analytics",
+		Name:      "upload_span_count",
+		Help:      "Total number of analytics upload spans by result: exported, failed, or dropped",
+	}, []string{"org", "result"})
+)
@@ -0,0 +1,138 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	prometheustest "github.com/prometheus/client_golang/prometheus/testutil"
+	coltrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+)
+
+type testTraceServer struct {
+	coltrace.UnimplementedTraceServiceServer
+	mu    sync.Mutex
+	spans []*tracev1.Span
+}
+
+func (s *testTraceServer) Export(ctx context.Context, req *coltrace.ExportTraceServiceRequest) (*coltrace.ExportTraceServiceResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rs := range req.GetResourceSpans() {
+		for _, ils := range rs.GetInstrumentationLibrarySpans() {
+			s.spans = append(s.spans, ils.GetSpans()...)
+		}
+	}
+	return &coltrace.ExportTraceServiceResponse{}, nil
+}
+
+func TestUploadMonitorRequests(t *testing.T) {
+	failSignedURL := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && failSignedURL {
+			failSignedURL = false
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	traces := &testTraceServer{}
+	srv := grpc.NewServer()
+	coltrace.RegisterTraceServiceServer(srv, traces)
+	go func() { _ = srv.Serve(lis) }()
+	defer srv.Stop()
+
+	m, err := newUploadMonitor(t.TempDir(), "upload-org", time.Minute, "http://"+lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.start()
+	client := &http.Client{Transport: m.roundTripper(http.DefaultTransport)}
+
+	for _, method := range []string{http.MethodGet, http.MethodGet, http.MethodPut} {
+		req, _ := http.NewRequest(method, ts.URL+"/file?signature=secret", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	m.stop()
+
+	if got := prometheustest.ToFloat64(prometheusAnalyticsUploadRetries.WithLabelValues("upload-org")); got != 1 {
+		t.Errorf("want 1 retry, got %v", got)
+	}
+	if got := prometheustest.CollectAndCount(prometheusAnalyticsUploadDuration); got < 3 {
+		t.Errorf("want durations of 3 step and code pairs, got %d", got)
+	}
+	if m.failed.IsTrue() {
+		t.Errorf("want successful upload to clear the failure")
+	}
+
+	traces.mu.Lock()
+	defer traces.mu.Unlock()
+	if len(traces.spans) != 3 {
+		t.Fatalf("want 3 spans, got %d", len(traces.spans))
+	}
+	wantNames := []string{"analytics signed_url", "analytics signed_url", "analytics upload"}
+	for i, span := range traces.spans {
+		if span.Name != wantNames[i] {
+			t.Errorf("want span %q, got %q", wantNames[i], span.Name)
+		}
+		for _, attr := range span.Attributes {
+			if attr.Key == "http.url" && attr.Value.GetStringValue() != ts.URL+"/file" {
+				t.Errorf("want URL without query, got %q", attr.Value.GetStringValue())
+			}
+		}
+	}
+	if code := traces.spans[0].Status.Code; code != tracev1.Status_STATUS_CODE_ERROR {
+		t.Errorf("want failed signed URL span error, got %v", code)
+	}
+}
+
+func TestUploadMonitorCountStaged(t *testing.T) {
+	dir := t.TempDir()
+	staging := filepath.Join(dir, analyticsStagingDir, "org~env")
+	if err := os.MkdirAll(staging, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"1.json.gz", "2.json.gz"} {
+		if err := os.WriteFile(filepath.Join(staging, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := newUploadMonitor(dir, "org", time.Minute, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.countStaged()
+	if got := prometheustest.ToFloat64(prometheusAnalyticsStagingFiles.WithLabelValues("org", "env")); got != 2 {
+		t.Errorf("want 2 staged files, got %v", got)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	analyticsWorkerResultSent    = "sent"
+	analyticsWorkerResultError   = "error"
+	analyticsWorkerResultDropped = "dropped"
+)
+
+// errAnalyticsRecordDropped is returned by sendRecord if the queue of the
+// record's worker is full
+var errAnalyticsRecordDropped = errors.New("analytics record dropped, worker queue full")
+
+// analyticsWorkers sends the analytics records of the access logs from a
+// bounded queue per worker so slow uploads don't block the access log
+// streams. The records of an organization and environment always go to the
+// same worker and are sent in order. Records are dropped while the queue of
+// their worker is full.
+type analyticsWorkers struct {
+	send   func(authContext *auth.Context, records []analytics.Record) error
+	org    string
+	queues []chan queuedRecord
+	wg     sync.WaitGroup
+
+	mu      sync.RWMutex
+	stopped bool
+}
+
+type queuedRecord struct {
+	authContext *auth.Context
+	record      analytics.Record
+}
+
+// newAnalyticsWorkers creates analyticsWorkers sending records with send.
+// Returns nil if workers is not positive.
+func newAnalyticsWorkers(workers, queueSize int, org string,
+	send func(authContext *auth.Context, records []analytics.Record) error) *analyticsWorkers {
+	if workers <= 0 {
+		return nil
+	}
+	w := &analyticsWorkers{
+		send:   send,
+		org:    org,
+		queues: make([]chan queuedRecord, workers),
+	}
+	for i := range w.queues {
+		w.queues[i] = make(chan queuedRecord, queueSize)
+	}
+	return w
+}
+
+func (w *analyticsWorkers) start() {
+	for _, queue := range w.queues {
+		w.wg.Add(1)
+		go func(queue chan queuedRecord) {
+			defer w.wg.Done()
+			for r := range queue {
+				prometheusAnalyticsWorkerQueued.Dec()
+				result := analyticsWorkerResultSent
+				if err := w.send(r.authContext, []analytics.Record{r.record}); err != nil {
+					log.Warnf("Unable to send ax: %v", err)
+					result = analyticsWorkerResultError
+				}
+				prometheusAnalyticsWorkerRecords.WithLabelValues(w.org, result).Inc()
+			}
+		}(queue)
+	}
+}
+
+// stop sends the queued records and waits for the workers to finish.
+// Records submitted after stop are dropped.
+func (w *analyticsWorkers) stop() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	if !w.stopped {
+		w.stopped = true
+		for _, queue := range w.queues {
+			close(queue)
+		}
+	}
+	w.mu.Unlock()
+	w.wg.Wait()
+}
+
+// submit queues the record on the worker of its organization and environment,
+// returns false if the record was dropped
+func (w *analyticsWorkers) submit(authContext *auth.Context, record analytics.Record) bool {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(authContext.Organization()))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(authContext.Environment()))
+	queue := w.queues[h.Sum32()%uint32(len(w.queues))]
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if !w.stopped {
+		select {
+		case queue <- queuedRecord{authContext, record}:
+			prometheusAnalyticsWorkerQueued.Inc()
+			return true
+		default:
+		}
+	}
+	log.Debugf("analytics queue full, dropped record of %s", record.APIProxy)
+	prometheusAnalyticsWorkerRecords.WithLabelValues(w.org, analyticsWorkerResultDropped).Inc()
+	return false
+}
+
+// sendRecord sends an access log analytics record through the workers, or
+// directly if there are none. Returns errAnalyticsRecordDropped if the
+// workers drop the record.
+func (h *Handler) sendRecord(authContext *auth.Context, record analytics.Record) error {
+	if h.analyticsWorkers != nil {
+		if !h.analyticsWorkers.submit(authContext, record) {
+			return errAnalyticsRecordDropped
+		}
+		return nil
+	}
+	if err := h.analyticsMan.SendRecords(authContext, []analytics.Record{record}); err != nil {
+		log.Warnf("Unable to send ax: %v", err)
+		return err
+	}
+	return nil
+}
+
+var (
+	prometheusAnalyticsWorkerQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "analytics",
+		Name:      "worker_queued_records",
+		Help:      "Number of access log analytics records queued for the workers",
+	})
+
+	prometheusAnalyticsWorkerRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "analytics",
+		Name:      "worker_records_count",
+		Help:      "Total number of access log analytics records handled by the workers by result",
+	}, []string{"org", "result"})
+)
@@ -0,0 +1,122 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAnalyticsWorkers(t *testing.T) {
+	if w := newAnalyticsWorkers(0, 10, "org", nil); w != nil {
+		t.Errorf("want nil workers")
+	}
+	var nilWorkers *analyticsWorkers
+	nilWorkers.stop() // no panic
+
+	var mu sync.Mutex
+	sent := map[string][]string{}
+	release := make(chan struct{})
+	w := newAnalyticsWorkers(2, 100, "org", func(authContext *auth.Context, records []analytics.Record) error {
+		<-release
+		mu.Lock()
+		defer mu.Unlock()
+		for _, r := range records {
+			sent[authContext.Environment()] = append(sent[authContext.Environment()], r.APIProxy)
+		}
+		return nil
+	})
+	w.start()
+
+	// submit doesn't wait on sends
+	var want = map[string][]string{}
+	for i := 0; i < 20; i++ {
+		env := fmt.Sprintf("env%d", i%3)
+		authContext := &auth.Context{Context: &multitenantContext{&Handler{orgName: "org"}, env}}
+		api := fmt.Sprintf("api%d", i)
+		if !w.submit(authContext, analytics.Record{APIProxy: api}) {
+			t.Fatalf("record %d dropped", i)
+		}
+		want[env] = append(want[env], api)
+	}
+	close(release)
+	w.stop()
+
+	// in order per environment
+	if diff := cmp.Diff(want, sent); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+
+	// dropped after stop
+	if w.submit(&auth.Context{Context: &Handler{orgName: "org", envName: "env"}}, analytics.Record{}) {
+		t.Errorf("want record dropped after stop")
+	}
+}
+
+func TestAnalyticsWorkersQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	w := newAnalyticsWorkers(1, 1, "org", func(authContext *auth.Context, records []analytics.Record) error {
+		<-release
+		return fmt.Errorf("send failed")
+	})
+	w.start()
+	defer w.stop()
+	defer close(release)
+
+	authContext := &auth.Context{Context: &Handler{orgName: "org", envName: "env"}}
+	dropped := 0
+	for i := 0; i < 3; i++ { // one sending, one queued
+		if !w.submit(authContext, analytics.Record{}) {
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		t.Errorf("want records dropped while the queue is full")
+	}
+}
+
+func TestSendRecord(t *testing.T) {
+	testAnalyticsMan := &testAnalyticsMan{}
+	h := &Handler{orgName: "org", envName: "env", analyticsMan: testAnalyticsMan}
+	authContext := &auth.Context{Context: h}
+
+	// sent directly without workers
+	if err := h.sendRecord(authContext, analytics.Record{APIProxy: "api"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(testAnalyticsMan.records) != 1 {
+		t.Fatalf("want 1 record sent, got: %d", len(testAnalyticsMan.records))
+	}
+
+	h.analyticsWorkers = newAnalyticsWorkers(1, 10, "org", testAnalyticsMan.SendRecords)
+	h.analyticsWorkers.start()
+	if err := h.sendRecord(authContext, analytics.Record{APIProxy: "api"}); err != nil {
+		t.Fatal(err)
+	}
+	h.analyticsWorkers.stop()
+	if len(testAnalyticsMan.records) != 2 {
+		t.Errorf("want 2 records sent, got: %d", len(testAnalyticsMan.records))
+	}
+
+	// dropped by the stopped workers
+	if err := h.sendRecord(authContext, analytics.Record{APIProxy: "api"}); err != errAnalyticsRecordDropped {
+		t.Errorf("want %v, got: %v", errAnalyticsRecordDropped, err)
+	}
+}
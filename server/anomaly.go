@@ -0,0 +1,302 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	anomalyErrorRate = "error_rate"
+	anomalyLatency   = "latency"
+
+	anomalyStarted  = "started"
+	anomalyResolved = "resolved"
+
+	// operations without requests for this many intervals are forgotten
+	anomalyIdleIntervals = 10
+)
+
+// anomalyKey identifies the operation of an access log
+type anomalyKey struct {
+	env, api, operation string
+}
+
+// anomalyOperation is the state of an operation: the counts of the current
+// interval and the moving averages of the previous
+type anomalyOperation struct {
+	requests, errors int
+	latency          time.Duration // total
+
+	baselined        bool
+	errorRateAverage float64
+	latencyAverage   float64 // seconds
+	active           map[string]bool
+	idle             int // intervals without requests
+}
+
+// AnomalyEvent is posted to the anomaly detection webhook when an anomaly
+// starts or is resolved.
+type AnomalyEvent struct {
+	State     string    `json:"state"`
+	Kind      string    `json:"kind"`
+	Time      time.Time `json:"time"`
+	Org       string    `json:"org"`
+	Env       string    `json:"env"`
+	API       string    `json:"api"`
+	Operation string    `json:"operation,omitempty"`
+	Value     float64   `json:"value"`
+	Average   float64   `json:"average"`
+}
+
+// anomalyDetector samples the error rate and mean latency of the operations
+// in the access logs each interval and flags samples exceeding a factor of
+// their moving averages. The api is the metricScope label. Idle operations
+// are forgotten with their metrics.
+type anomalyDetector struct {
+	cfg    config.AnomalyDetection
+	org    string
+	client *http.Client // webhook
+	done   chan struct{}
+
+	mu         sync.Mutex
+	operations map[anomalyKey]*anomalyOperation
+}
+
+// newAnomalyDetector creates an anomalyDetector.
+// Returns nil if anomaly detection is not enabled.
+func newAnomalyDetector(client *http.Client, cfg config.AnomalyDetection, org string) *anomalyDetector {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &anomalyDetector{
+		cfg:        cfg,
+		org:        org,
+		client:     client,
+		done:       make(chan struct{}),
+		operations: make(map[anomalyKey]*anomalyOperation),
+	}
+}
+
+func (d *anomalyDetector) start() {
+	go func() {
+		t := time.NewTicker(d.cfg.Interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				for _, event := range d.sample(time.Now()) {
+					d.notify(event)
+				}
+			case <-d.done:
+				return
+			}
+		}
+	}()
+}
+
+func (d *anomalyDetector) stop() {
+	if d != nil {
+		close(d.done)
+	}
+}
+
+// observe counts an access log of the operation, server errors count as errors
+func (d *anomalyDetector) observe(env, api, operation string, statusCode int, latency time.Duration) {
+	if d == nil {
+		return
+	}
+	key := anomalyKey{env, api, operation}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	op, ok := d.operations[key]
+	if !ok {
+		op = &anomalyOperation{active: make(map[string]bool)}
+		d.operations[key] = op
+	}
+	op.requests++
+	if statusCode >= http.StatusInternalServerError {
+		op.errors++
+	}
+	op.latency += latency
+}
+
+// sample ends the interval, updating the metrics and moving averages of the
+// operations with enough requests, and returns the anomalies started or resolved
+func (d *anomalyDetector) sample(now time.Time) []AnomalyEvent {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var events []AnomalyEvent
+	for key, op := range d.operations {
+		if op.requests == 0 {
+			if op.idle++; !op.baselined || op.idle >= anomalyIdleIntervals {
+				d.forget(key)
+			}
+			continue
+		}
+		op.idle = 0
+		if op.requests < d.cfg.MinRequests {
+			op.requests, op.errors, op.latency = 0, 0, 0
+			continue
+		}
+		errorRate := float64(op.errors) / float64(op.requests)
+		latency := op.latency.Seconds() / float64(op.requests)
+		op.requests, op.errors, op.latency = 0, 0, 0
+
+		labels := []string{d.org, key.env, key.api, key.operation}
+		prometheusAnomalyErrorRate.WithLabelValues(labels...).Set(errorRate)
+		prometheusAnomalyLatency.WithLabelValues(labels...).Set(latency)
+
+		if op.baselined {
+			for _, s := range []struct {
+				kind           string
+				value, average float64
+				anomaly        bool
+			}{
+				{anomalyErrorRate, errorRate, op.errorRateAverage,
+					errorRate > d.cfg.MinErrorRate && errorRate > d.cfg.Factor*op.errorRateAverage},
+				{anomalyLatency, latency, op.latencyAverage, latency > d.cfg.Factor*op.latencyAverage},
+			} {
+				if s.anomaly == op.active[s.kind] {
+					continue
+				}
+				op.active[s.kind] = s.anomaly
+				state := anomalyResolved
+				if s.anomaly {
+					state = anomalyStarted
+					prometheusAnomalies.WithLabelValues(append(labels, s.kind)...).Inc()
+				}
+				prometheusAnomalyActive.WithLabelValues(append(labels, s.kind)...).Set(boolToFloat(s.anomaly))
+				events = append(events, AnomalyEvent{
+					State:     state,
+					Kind:      s.kind,
+					Time:      now.UTC(),
+					Org:       d.org,
+					Env:       key.env,
+					API:       key.api,
+					Operation: key.operation,
+					Value:     s.value,
+					Average:   s.average,
+				})
+			}
+			op.errorRateAverage = ewma(op.errorRateAverage, errorRate, d.cfg.Smoothing)
+			op.latencyAverage = ewma(op.latencyAverage, latency, d.cfg.Smoothing)
+		} else {
+			op.baselined = true
+			op.errorRateAverage = errorRate
+			op.latencyAverage = latency
+		}
+		prometheusAnomalyErrorRateAverage.WithLabelValues(labels...).Set(op.errorRateAverage)
+		prometheusAnomalyLatencyAverage.WithLabelValues(labels...).Set(op.latencyAverage)
+	}
+	return events
+}
+
+// forget removes the operation and its gauges
+func (d *anomalyDetector) forget(key anomalyKey) {
+	delete(d.operations, key)
+	labels := []string{d.org, key.env, key.api, key.operation}
+	prometheusAnomalyErrorRate.DeleteLabelValues(labels...)
+	prometheusAnomalyErrorRateAverage.DeleteLabelValues(labels...)
+	prometheusAnomalyLatency.DeleteLabelValues(labels...)
+	prometheusAnomalyLatencyAverage.DeleteLabelValues(labels...)
+	for _, kind := range []string{anomalyErrorRate, anomalyLatency} {
+		prometheusAnomalyActive.DeleteLabelValues(append(labels, kind)...)
+	}
+}
+
+// notify logs the event and posts it to the webhook, if configured
+func (d *anomalyDetector) notify(event AnomalyEvent) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("unable to marshal anomaly event: %v", err)
+		return
+	}
+	log.Warnf("anomaly %s: %s", event.State, b)
+
+	if d.cfg.Webhook == "" {
+		return
+	}
+	resp, err := d.client.Post(d.cfg.Webhook, "application/json", bytes.NewReader(b))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			err = fmt.Errorf("webhook status: %d", resp.StatusCode)
+		}
+	}
+	if err != nil {
+		log.Warnf("unable to post anomaly event to %s: %v", d.cfg.Webhook, err)
+	}
+}
+
+// ewma returns the moving average updated with value
+func ewma(average, value, smoothing float64) float64 {
+	return smoothing*value + (1-smoothing)*average
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var (
+	prometheusAnomalyErrorRate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "anomaly",
+		Name:      "error_rate",
+		Help:      "Server error rate of the last interval by operation",
+	}, []string{"org", "env", "api", "operation"})
+
+	prometheusAnomalyErrorRateAverage = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "anomaly",
+		Name:      "error_rate_average",
+		Help:      "Moving average of the server error rate by operation",
+	}, []string{"org", "env", "api", "operation"})
+
+	prometheusAnomalyLatency = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "anomaly",
+		Name:      "latency_seconds",
+		Help:      "Mean latency of the last interval by operation",
+	}, []string{"org", "env", "api", "operation"})
+
+	prometheusAnomalyLatencyAverage = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "anomaly",
+		Name:      "latency_average_seconds",
+		Help:      "Moving average of the mean latency by operation",
+	}, []string{"org", "env", "api", "operation"})
+
+	prometheusAnomalyActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "anomaly",
+		Name:      "active",
+		Help:      "1 while an anomaly of the kind is active by operation",
+	}, []string{"org", "env", "api", "operation", "kind"})
+
+	prometheusAnomalies = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "anomaly",
+		Name:      "count",
+		Help:      "Total number of anomalies started by operation and kind",
+	}, []string{"org", "env", "api", "operation", "kind"})
+)
@@ -0,0 +1,198 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	v3 "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestAnomalyDetector(t *testing.T) {
+	if newAnomalyDetector(http.DefaultClient, config.AnomalyDetection{}, "org") != nil {
+		t.Fatalf("should be nil if not enabled")
+	}
+
+	cfg := config.Default().Analytics.AnomalyDetection
+	cfg.Enabled = true
+	cfg.MinRequests = 10
+	d := newAnomalyDetector(http.DefaultClient, cfg, "org")
+
+	observe := func(requests, errors int, latency time.Duration) {
+		for i := 0; i < requests; i++ {
+			status := http.StatusOK
+			if i < errors {
+				status = http.StatusServiceUnavailable
+			}
+			d.observe("env", "api", "op", status, latency)
+		}
+	}
+	now := time.Now()
+
+	// baseline
+	observe(100, 1, 10*time.Millisecond)
+	if events := d.sample(now); len(events) != 0 {
+		t.Errorf("want no events, got: %v", events)
+	}
+	observe(100, 2, 10*time.Millisecond)
+	if events := d.sample(now); len(events) != 0 {
+		t.Errorf("want no events, got: %v", events)
+	}
+
+	// too few requests to sample
+	observe(5, 5, time.Second)
+	if events := d.sample(now); len(events) != 0 {
+		t.Errorf("want no events, got: %v", events)
+	}
+
+	// error spike
+	observe(100, 50, 10*time.Millisecond)
+	events := d.sample(now)
+	if len(events) != 1 {
+		t.Fatalf("want 1 event, got: %v", events)
+	}
+	if e := events[0]; e.State != anomalyStarted || e.Kind != anomalyErrorRate || e.Value != 0.5 || e.Operation != "op" {
+		t.Errorf("unexpected event: %#v", e)
+	}
+
+	// latency spike, errors recover
+	observe(100, 1, time.Second)
+	events = d.sample(now)
+	if len(events) != 2 {
+		t.Fatalf("want 2 events, got: %v", events)
+	}
+	for _, e := range events {
+		switch e.Kind {
+		case anomalyErrorRate:
+			if e.State != anomalyResolved {
+				t.Errorf("error rate anomaly should resolve: %#v", e)
+			}
+		case anomalyLatency:
+			if e.State != anomalyStarted || e.Value != 1 {
+				t.Errorf("unexpected event: %#v", e)
+			}
+		}
+	}
+}
+
+func TestAnomalyDetectorIdle(t *testing.T) {
+	cfg := config.Default().Analytics.AnomalyDetection
+	cfg.Enabled = true
+	cfg.MinRequests = 1
+	d := newAnomalyDetector(http.DefaultClient, cfg, "idle-org")
+	now := time.Now()
+
+	d.observe("env", "api", "op", http.StatusOK, time.Millisecond)
+	d.sample(now)
+	labels := []string{"idle-org", "env", "api", "op"}
+	for i := 1; i < anomalyIdleIntervals; i++ {
+		d.sample(now)
+	}
+	if len(d.operations) != 1 {
+		t.Fatalf("want operation kept while idle less than %d intervals", anomalyIdleIntervals)
+	}
+
+	// requests reset the idle intervals
+	d.observe("env", "api", "op", http.StatusOK, time.Millisecond)
+	d.sample(now)
+	for i := 0; i < anomalyIdleIntervals; i++ {
+		d.sample(now)
+	}
+	if len(d.operations) != 0 {
+		t.Errorf("want idle operation forgotten, got: %v", d.operations)
+	}
+	if prometheusAnomalyErrorRate.DeleteLabelValues(labels...) ||
+		prometheusAnomalyLatencyAverage.DeleteLabelValues(labels...) {
+		t.Errorf("want gauges of the idle operation deleted")
+	}
+
+	// never sampled
+	d.observe("env", "api", "other", http.StatusOK, time.Millisecond)
+	d.operations[anomalyKey{"env", "api", "other"}].requests = 0
+	d.sample(now)
+	if len(d.operations) != 0 {
+		t.Errorf("want operation never sampled forgotten, got: %v", d.operations)
+	}
+}
+
+func TestAnomalyDetectorWebhook(t *testing.T) {
+	received := make(chan AnomalyEvent, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event AnomalyEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error(err)
+		}
+		received <- event
+	}))
+	defer ts.Close()
+
+	cfg := config.Default().Analytics.AnomalyDetection
+	cfg.Enabled = true
+	cfg.Webhook = ts.URL
+	d := newAnomalyDetector(ts.Client(), cfg, "org")
+	d.notify(AnomalyEvent{State: anomalyStarted, Kind: anomalyLatency, API: "api"})
+
+	select {
+	case e := <-received:
+		if e.State != anomalyStarted || e.Kind != anomalyLatency || e.API != "api" {
+			t.Errorf("unexpected event: %#v", e)
+		}
+	default:
+		t.Errorf("webhook should receive event")
+	}
+}
+
+func TestAnomalyMetricScope(t *testing.T) {
+	cfg := config.Default().Analytics.AnomalyDetection
+	cfg.Enabled = true
+	h := &Handler{
+		orgName:      "org",
+		envName:      "env",
+		analyticsMan: &testAnalyticsMan{},
+		metricAPIs:   newMetricAllowlist([]string{"listed"}),
+		anomalies:    newAnomalyDetector(http.DefaultClient, cfg, "org"),
+	}
+	entry := &v3.HTTPAccessLogEntry{
+		CommonProperties: &v3.AccessLogCommon{
+			StartTime: timestamppb.Now(),
+			Metadata: &core.Metadata{
+				FilterMetadata: map[string]*structpb.Struct{
+					extAuthzFilterNamespace: {Fields: makeExtAuthFields()},
+				},
+			},
+		},
+		Request:  &v3.HTTPRequestProperties{Path: "/path"},
+		Response: &v3.HTTPResponseProperties{},
+	}
+	if err := h.handleHTTPLogEntry(entry, envoySource{}, defaultGatewaySource); err != nil {
+		t.Fatal(err)
+	}
+	for key := range h.anomalies.operations {
+		if key.api != metricScopeOther {
+			t.Errorf("want api %q, got: %q", metricScopeOther, key.api)
+		}
+	}
+	if len(h.anomalies.operations) != 1 {
+		t.Errorf("want 1 operation, got: %v", h.anomalies.operations)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/context"
+)
+
+// newAPIKeyHasher returns a func hashing API keys by the config.Auth
+// api_key_hash, nil if keys are sent in the clear
+func newAPIKeyHasher(hash, key string) func(string) string {
+	switch hash {
+	case config.APIKeyHashSHA256:
+		return func(apiKey string) string {
+			sum := sha256.Sum256([]byte(apiKey))
+			return hex.EncodeToString(sum[:])
+		}
+	case config.APIKeyHashHMACSHA256:
+		return func(apiKey string) string {
+			mac := hmac.New(sha256.New, []byte(key))
+			mac.Write([]byte(apiKey))
+			return hex.EncodeToString(mac.Sum(nil))
+		}
+	}
+	return nil
+}
+
+// Authenticate hashes the API key, in the argument or claims, before
+// verification if configured. Verified keys are shared through the store.
+func (m *remoteServiceAuthManager) Authenticate(ctx context.Context, apiKey string,
+	claims map[string]interface{}, apiKeyClaimKey string) (*auth.Context, error) {
+	if m.hashAPIKey != nil {
+		if apiKey != "" {
+			apiKey = m.hashAPIKey(apiKey)
+		}
+		if claimKey, ok := claims[apiKeyClaimKey].(string); ok && claimKey != "" {
+			hashed := make(map[string]interface{}, len(claims))
+			for k, v := range claims {
+				hashed[k] = v
+			}
+			hashed[apiKeyClaimKey] = m.hashAPIKey(claimKey)
+			claims = hashed
+		}
+	}
+	return m.authenticate(ctx, apiKey, claims, apiKeyClaimKey)
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/context"
+)
+
+const (
+	sha256OfKey     = "2c70e12b7a0646f92279f427c7b38e7334d8e5389cff167a1dc30e73f826b683"
+	hmacSHA256OfKey = "96de09a0f8699191b28587118ac57df88bbf6c2d0c131d196dcd90f7efd68c93"
+)
+
+type recordingAuthMan struct {
+	auth.Manager
+	apiKey string
+	claims map[string]interface{}
+}
+
+func (m *recordingAuthMan) Authenticate(ctx context.Context, apiKey string,
+	claims map[string]interface{}, apiKeyClaimKey string) (*auth.Context, error) {
+	m.apiKey = apiKey
+	m.claims = claims
+	return &auth.Context{}, nil
+}
+
+func TestNewAPIKeyHasher(t *testing.T) {
+	if h := newAPIKeyHasher("", ""); h != nil {
+		t.Errorf("want nil hasher")
+	}
+	sha := newAPIKeyHasher(config.APIKeyHashSHA256, "")
+	if got := sha("key"); got != sha256OfKey {
+		t.Errorf("want: %s, got: %s", sha256OfKey, got)
+	}
+	hmac := newAPIKeyHasher(config.APIKeyHashHMACSHA256, "secret")
+	if got := hmac("key"); got != hmacSHA256OfKey {
+		t.Errorf("want: %s, got: %s", hmacSHA256OfKey, got)
+	}
+	if hmac("key") == newAPIKeyHasher(config.APIKeyHashHMACSHA256, "other")("key") {
+		t.Errorf("hmac should depend on the key")
+	}
+}
+
+func TestAuthenticateHashesAPIKey(t *testing.T) {
+	recorder := &recordingAuthMan{}
+	m := &remoteServiceAuthManager{
+		Manager:    recorder,
+		hashAPIKey: newAPIKeyHasher(config.APIKeyHashSHA256, ""),
+	}
+	claims := map[string]interface{}{"api_key": "key", "sub": "me"}
+	if _, err := m.Authenticate(nil, "key", claims, "api_key"); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.apiKey != sha256OfKey {
+		t.Errorf("want: %s, got: %s", sha256OfKey, recorder.apiKey)
+	}
+	if recorder.claims["api_key"] != sha256OfKey || recorder.claims["sub"] != "me" {
+		t.Errorf("want hashed claim, got: %v", recorder.claims)
+	}
+	if claims["api_key"] != "key" {
+		t.Errorf("caller's claims should not be modified")
+	}
+
+	// no hash
+	m.hashAPIKey = nil
+	if _, err := m.Authenticate(nil, "key", nil, "api_key"); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.apiKey != "key" {
+		t.Errorf("want: key, got: %s", recorder.apiKey)
+	}
+}
@@ -16,18 +16,13 @@ package server
 
 import (
 	gocontext "context"
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
-	"net/url"
-	"path"
 	"sort"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/apigee/apigee-remote-service-envoy/v2/config"
-	"github.com/apigee/apigee-remote-service-envoy/v2/util"
+	"github.com/apigee/apigee-remote-service-envoy/v2/specmatch"
 	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
 	"github.com/apigee/apigee-remote-service-golib/v2/auth"
 	"github.com/apigee/apigee-remote-service-golib/v2/context"
@@ -37,6 +32,7 @@ import (
 	"github.com/apigee/apigee-remote-service-golib/v2/quota"
 	golibutil "github.com/apigee/apigee-remote-service-golib/v2/util"
 	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
 	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
 	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 	"github.com/gogo/googleapis/google/rpc"
@@ -48,11 +44,14 @@ import (
 )
 
 const (
-	jwtFilterMetadataKey = "envoy.filters.http.jwt_authn"
-	envContextKey        = "apigee_environment"
-	apiContextKey        = "apigee_api"
-	envSpecContextKey    = "apigee_env_config"
-	envoyPathHeader      = ":path"
+	jwtFilterMetadataKey   = "envoy.filters.http.jwt_authn"
+	envContextKey          = "apigee_environment"
+	apiContextKey          = "apigee_api"
+	envSpecContextKey      = "apigee_env_config"
+	envoyNodeContextKey    = "apigee_envoy_node"
+	envoyClusterContextKey = "apigee_envoy_cluster"
+	envoyPathHeader        = ":path"
+	quotaKeySeparator      = ":"
 )
 
 // AuthorizationServer server
@@ -64,6 +63,7 @@ type AuthorizationServer struct {
 // Register registers
 func (a *AuthorizationServer) Register(s *grpc.Server, handler *Handler) {
 	authv3.RegisterAuthorizationServer(s, a)
+	authv2.RegisterAuthorizationServer(s, &authorizationServerV2{a})
 	a.handler = handler
 	a.gatewaySource = defaultGatewaySource
 	if a.handler.operationConfigType == product.ProxyOperationConfigType {
@@ -76,18 +76,34 @@ func (a *AuthorizationServer) Check(ctx gocontext.Context, req *authv3.CheckRequ
 	if !a.handler.Ready() {
 		return a.unavailable(req), nil
 	}
+	if a.handler.spool.backpressure() {
+		return a.spoolBackpressure(req), nil
+	}
+	release, ok := a.handler.overload.acquire()
+	if !ok {
+		return a.overloaded(req), nil
+	}
+	defer release()
+
+	ambiguity := a.handler.normalizer.normalize(req) // before routing by host
 
 	var rootContext context.Context = a.handler
 	var err error
 	envFromEnvoy, envFromEnvoyExists := req.Attributes.ContextExtensions[envContextKey]
 	if a.handler.isMultitenant {
-		if envFromEnvoyExists && envFromEnvoy != "" {
+		env := envFromEnvoy
+		if env == "" {
+			env = a.handler.envRouter.environment(req)
+		}
+		if env == "" {
+			err = fmt.Errorf("no %s metadata or matching tenant environment for multi-tenant mode", envContextKey)
+		} else if !a.handler.envRouter.allows(env) {
+			err = fmt.Errorf("%s metadata (%s) is not a tenant environment", envContextKey, env)
+		} else {
 			rootContext = &multitenantContext{
 				a.handler,
-				envFromEnvoy,
+				env,
 			}
-		} else {
-			err = fmt.Errorf("no %s metadata for multi-tenant mode", envContextKey)
 		}
 	} else if envFromEnvoyExists && envFromEnvoy != rootContext.Environment() {
 		err = fmt.Errorf("%s metadata (%s) disallowed when not in multi-tenant mode", envContextKey, rootContext.Environment())
@@ -100,166 +116,78 @@ func (a *AuthorizationServer) Check(ctx gocontext.Context, req *authv3.CheckRequ
 		return a.internalError(req, nil, tracker, err), nil
 	}
 
-	var envSpec *config.EnvironmentSpecExt
-	var operation *config.APIOperation
-	if envSpecID, ok := req.Attributes.ContextExtensions[envSpecContextKey]; ok {
-		if spec, ok := a.handler.envSpecsByID[envSpecID]; ok {
-			envSpec = spec
-		}
+	if ambiguity != "" {
+		return a.ambiguousRequest(req, tracker, ambiguity), nil
 	}
 
-	var api, apiKey, path string
-	var claims map[string]interface{}
-
-	// EnvSpec found, takes priority over global settings
-	var envRequest *config.EnvironmentSpecRequest
-	if envSpec != nil {
-		envRequest = config.NewEnvironmentSpecRequest(a.handler.authMan, envSpec, req)
-		log.Debugf("environment spec: %s", envRequest.ID)
-
-		apiSpec := envRequest.GetAPISpec()
-		if apiSpec == nil {
-			log.Debugf("api not found for environment spec %s", envSpec.ID)
-			return a.notFound(req, envRequest, tracker, api), nil
-		}
-		api = apiSpec.ID
-		log.Debugf("api: %s", apiSpec.ID)
-
-		// preflight has no operation or auth check, exit here
-		if envRequest.IsCORSPreflight() {
-			return a.corsPreflightResponse(envRequest, tracker, nil, api), nil
-		}
-
-		operation = envRequest.GetOperation()
-		if operation == nil {
-			log.Debugf("no valid operation found for api %s", apiSpec.ID)
-			return a.notFound(req, envRequest, tracker, api), nil
-		}
-		log.Debugf("operation: %s", operation.Name)
-
-		if !envRequest.IsAuthenticated() {
-			log.Debugf("authentication requirements not met")
-			return a.unauthenticated(req, envRequest, tracker, api), nil
-		}
-
-		if !envRequest.IsAuthorizationRequired() {
-			log.Debugf("no authorization requirements")
-			// Send the root context for limited dynamic metadata.
-			return a.authOK(req, tracker, &auth.Context{Context: rootContext}, api, envRequest), nil
-		}
-
-		path = envRequest.GetOperationPath()
-		apiKey = envRequest.GetAPIKey()
-
-	} else { // global authentication
-
-		var queryString string
-		path, queryString = func(path string) (base, qs string) {
-			pathSplits := strings.SplitN(req.Attributes.Request.Http.Path, "?", 2)
-			base = pathSplits[0]
-			if len(pathSplits) > 1 {
-				qs = pathSplits[1]
-			}
-			return
-		}(req.Attributes.Request.Http.Path)
-
-		if v, ok := req.Attributes.ContextExtensions[apiContextKey]; ok { // api specified in context metadata
-			api = v
-			log.Debugf("api from context: %s", api)
-		} else {
-			api, ok = req.Attributes.Request.Http.Headers[a.handler.apiHeader]
-			if !ok {
-				log.Debugf("missing api header %s", a.handler.apiHeader)
-				return a.unauthenticated(req, envRequest, tracker, api), nil
-			}
-			log.Debugf("api from header: %s", api)
-		}
-
-		// check for JWT from Envoy filter
-		protoBufStruct := req.Attributes.GetMetadataContext().GetFilterMetadata()[jwtFilterMetadataKey]
-		fieldsMap := protoBufStruct.GetFields()
-
-		// use jwtProviderKey check if jwtProviderKey is set in config
-		if a.handler.jwtProviderKey != "" {
-			claimsStruct, ok := fieldsMap[a.handler.jwtProviderKey]
-			if ok {
-				log.Debugf("Using JWT at provider key: %s", a.handler.jwtProviderKey)
-				claims = util.DecodeToMap(claimsStruct.GetStructValue())
-			}
-		} else { // otherwise iterate over apiKeyClaim loop
-			for k, v := range fieldsMap {
-				vFields := v.GetStructValue().GetFields()
-				if vFields[a.handler.apiKeyClaim] != nil || vFields["api_product_list"] != nil {
-					log.Debugf("Using JWT with provider key: %s", k)
-					claims = util.DecodeToMap(v.GetStructValue())
-				}
-			}
-		}
-
-		apiKey = req.Attributes.Request.Http.Headers[a.handler.apiKeyHeader] // grab from header
-
-		if apiKey == "" && queryString != "" { // look in querystring if not in header
-			if qs, err := url.ParseQuery(queryString); err == nil {
-				if keys, ok := qs[a.handler.apiKeyHeader]; ok {
-					apiKey = keys[0]
-				}
-			}
-		}
+	if limit := a.handler.limits.check(req); limit != "" {
+		return a.limitExceeded(req, tracker, limit), nil
 	}
 
-	authContext, err := a.handler.authMan.Authenticate(rootContext, apiKey, claims, a.handler.apiKeyClaim)
-	switch err {
-	case auth.ErrNoAuth:
-		return a.unauthenticated(req, envRequest, tracker, api), nil
-	case auth.ErrBadAuth:
-		return a.denied(req, envRequest, tracker, authContext, api), nil
-	case auth.ErrInternalError:
-		return a.internalError(req, envRequest, tracker, err), nil
-	case auth.ErrNetworkError:
-		if envRequest != nil && envRequest.GetConsumerAuthorization().FailOpen {
-			log.Debugf("FailOpen on operation: %v", envRequest.GetOperation().Name)
-			return a.authOK(req, tracker, authContext, api, envRequest), nil
+	stages := a.handler.checkStages
+	if stages == nil {
+		stages = defaultCheckStages
+	}
+	c := &CheckContext{
+		Request:     req,
+		server:      a,
+		rootContext: rootContext,
+		tracker:     tracker,
+		okResponse:  &authv3.OkHttpResponse{},
+		trace:       a.handler.tracer.match(req),
+	}
+	httpReq := req.GetAttributes().GetRequest().GetHttp()
+	c.trace.tracef("request: %s %s%s, environment %s", httpReq.GetMethod(), httpReq.GetHost(), httpReq.GetPath(),
+		rootContext.Environment())
+	resp := runCheckStages(ctx, stages, c)
+	tracker.spec, tracker.api = a.handler.metricScope(c.EnvRequest, c.API)
+	if resp == nil {
+		resp = a.authOK(req, tracker, c.AuthContext, c.API, c.EnvRequest, c.okResponse)
+		if denied := checkV2HeaderRemovals(ctx, c); denied != nil {
+			resp = denied
+		} else if token, denied := a.acquireConcurrency(c); denied != nil {
+			resp = denied
 		} else {
-			return a.internalError(req, envRequest, tracker, err), nil
+			encodePendingQuotasMetadata(resp.GetDynamicMetadata(), c.pendingQuotas)
+			encodeConcurrencyTokenMetadata(resp.GetDynamicMetadata(), token)
 		}
 	}
+	c.trace.finish(c.API, resp)
+	return resp, nil
+}
 
-	if len(authContext.APIProducts) == 0 {
-		return a.denied(req, envRequest, tracker, authContext, api), nil
-	}
-
-	// authorize against products
-	method := req.Attributes.Request.Http.Method
-	authorizedOps := a.handler.productMan.Authorize(authContext, api, path, method)
-	if len(authorizedOps) == 0 {
-		return a.denied(req, envRequest, tracker, authContext, api), nil
-	}
-
-	// apply quotas to matched operations
-	exceeded, quotaError := a.applyQuotas(authorizedOps, authContext)
-	if quotaError != nil {
-		return a.internalError(req, envRequest, tracker, quotaError), nil
-	}
-	if exceeded {
-		return a.quotaExceeded(req, envRequest, tracker, authContext, api), nil
-	}
-
-	return a.authOK(req, tracker, authContext, api, envRequest), nil
+// exceededQuota is the first quota bucket a request exceeded
+type exceededQuota struct {
+	id     string
+	expiry int64 // of the bucket window in Unix seconds, 0 if unknown
 }
 
-// apply quotas to all matched operations
-// returns an error if any quota failed
-func (a *AuthorizationServer) applyQuotas(ops []product.AuthorizedOperation, authC *auth.Context) (exceeded bool, errors error) {
+// apply quotas to all matched operations, partitioned by quotaKey if not empty
+// returns the first quota exceeded and an error if any quota failed. In the
+// access_log quota counting mode, quotas are checked without counting and
+// returned as pending.
+func (a *AuthorizationServer) applyQuotas(ops []product.AuthorizedOperation, authC *auth.Context, quotaKey string) (exceeded *exceededQuota, pending []product.AuthorizedOperation, errors error) {
+	countLater := a.handler.quotaCounting == config.QuotaCountingAccessLog
 	var quotaArgs = quota.Args{QuotaAmount: 1}
+	if countLater {
+		quotaArgs.QuotaAmount = 0
+	}
 	for _, op := range ops {
 		if op.QuotaLimit > 0 {
+			if quotaKey != "" {
+				op.ID = op.ID + quotaKeySeparator + quotaKey
+			}
 			result, err := a.handler.quotaMan.Apply(authC, op, quotaArgs)
 			if err != nil {
 				log.Errorf("quota check: %v", err)
 				errors = errorset.Append(errors, err)
-			} else if result.Exceeded > 0 {
+			} else if result.Exceeded > 0 || countLater && result.Used >= op.QuotaLimit {
 				log.Debugf("quota exceeded: %v", op.ID)
-				exceeded = true
+				if exceeded == nil {
+					exceeded = &exceededQuota{id: op.ID, expiry: result.ExpiryTime}
+				}
+			} else if countLater {
+				pending = append(pending, op)
 			}
 		}
 	}
@@ -269,30 +197,42 @@ func (a *AuthorizationServer) applyQuotas(ops []product.AuthorizedOperation, aut
 func (a *AuthorizationServer) authOK(
 	req *authv3.CheckRequest, tracker *prometheusRequestMetricTracker,
 	authContext *auth.Context, api string,
-	envRequest *config.EnvironmentSpecRequest) *authv3.CheckResponse {
+	envRequest *config.EnvironmentSpecRequest, okResponse *authv3.OkHttpResponse) *authv3.CheckResponse {
 
-	checkResponse := a.createEnvoyForwarded(req, tracker, authContext, api, envRequest)
+	checkResponse := a.createEnvoyForwarded(req, tracker, authContext, api, envRequest, okResponse)
 	checkResponse.GetOkResponse().Headers = append(checkResponse.GetOkResponse().Headers, createHeaderValueOption(headerAuthorized, "true", false))
 	return checkResponse
 }
 
-// response sends request on to target
+// response sends request on to target, okResponse has the request transforms
 func (a *AuthorizationServer) createEnvoyForwarded(
 	req *authv3.CheckRequest, tracker *prometheusRequestMetricTracker,
-	authContext *auth.Context, api string, envRequest *config.EnvironmentSpecRequest) *authv3.CheckResponse {
-
-	okResponse := &authv3.OkHttpResponse{}
-
-	// user request header transforms
-	addRequestHeaderTransforms(req, envRequest, okResponse)
+	authContext *auth.Context, api string, envRequest *config.EnvironmentSpecRequest,
+	okResponse *authv3.OkHttpResponse) *authv3.CheckResponse {
 
 	// apigee metadata request headers
-	if a.handler.appendMetadataHeaders {
-		okResponse.Headers = append(okResponse.Headers, metadataHeaders(api, authContext)...)
+	var headers []*corev3.HeaderValueOption
+	var remove []string
+	if a.handler.consumerFields != nil {
+		headers, remove = a.handler.consumerFields.metadataHeaders(api, authContext,
+			a.handler.metadataHeaderLimit, a.handler.appendMetadataHeaders)
+	} else if a.handler.appendMetadataHeaders {
+		headers, remove = metadataHeaders(api, authContext, a.handler.metadataHeaderLimit)
+	}
+	okResponse.Headers = append(okResponse.Headers, headers...)
+	okResponse.HeadersToRemove = append(okResponse.HeadersToRemove, remove...)
+	if a.handler.appendMatchHeaders {
+		okResponse.Headers = append(okResponse.Headers, matchHeaders(envRequest)...)
+		if !a.handler.appendMetadataHeaders { // else sent with the metadata headers
+			okResponse.Headers = append(okResponse.Headers, createHeaderValueOption(headerAPI, api, false))
+		}
 	}
+	a.handler.baggage.apply(okResponse, req.GetAttributes().GetRequest().GetHttp().GetHeaders()[headerBaggage],
+		api, envRequest, authContext)
 
 	// cors response headers
-	okResponse.ResponseHeadersToAdd = append(okResponse.ResponseHeadersToAdd, corsResponseHeaders(envRequest)...)
+	corsHeaders := corsResponseHeaders(envRequest)
+	okResponse.ResponseHeadersToAdd = append(okResponse.ResponseHeadersToAdd, corsHeaders...)
 
 	// apigee dynamic data response headers
 	var basepath string
@@ -306,6 +246,25 @@ func (a *AuthorizationServer) createEnvoyForwarded(
 		log.Debugf(printHeaderMods(okResponse))
 	}
 
+	metadata := encodeExtAuthzMetadata(api, authContext, true)
+	if envRequest != nil {
+		encodePathParamsMetadata(metadata, envRequest.GetPathParams())
+		encodeLabelsMetadata(metadata, envRequest.GetLabels())
+		encodeConsumerCredentialMetadata(metadata, envRequest.GetConsumerCredential())
+		encodeBotRuleMetadata(metadata, envRequest.GetBotRule())
+		encodeMatchMetadata(metadata, envRequest)
+		if op := envRequest.GetOperation(); op != nil {
+			encodeOperationMetadata(metadata, op.Name)
+			encodeAnalyticsProxyMetadata(metadata, op.AnalyticsProxy)
+			encodeHeaderCaptureMetadata(metadata, op.HeaderCapture,
+				req.GetAttributes().GetRequest().GetHttp().GetHeaders(), a.handler.apiKeyHeader,
+				credentialHeaderNames(envRequest))
+			encodeResponseOutcomesMetadata(metadata, op)
+		}
+	}
+	encodeCORSHeadersMetadata(metadata, corsHeaders)
+	a.handler.consumerFields.omitMetadata(metadata)
+
 	tracker.statusCode = typev3.StatusCode_OK
 	return &authv3.CheckResponse{
 		Status: &status.Status{
@@ -314,118 +273,33 @@ func (a *AuthorizationServer) createEnvoyForwarded(
 		HttpResponse: &authv3.CheckResponse_OkResponse{
 			OkResponse: okResponse,
 		},
-		DynamicMetadata: encodeExtAuthzMetadata(api, authContext, true),
+		DynamicMetadata: metadata,
 	}
 }
 
 // if CORS request, created appropriate response header options
 func corsResponseHeaders(envRequest *config.EnvironmentSpecRequest) (headers []*corev3.HeaderValueOption) {
-	if envRequest == nil || !envRequest.IsCORSRequest() {
-		return
-	}
-	cors := envRequest.GetAPISpec().Cors
-	appendIfNotEmpty := func(key string, values ...string) {
-		if len(values) == 0 || values[0] == "" {
-			return
-		}
-		headers = append(headers, createHeaderValueOption(key, strings.Join(values, ","), false))
-	}
-	allowedOrigin, vary := envRequest.AllowedOrigin()
-	appendIfNotEmpty(config.CORSAllowOrigin, allowedOrigin)
-	if vary {
-		headers = append(headers, createHeaderValueOption(config.CORSVary, config.CORSVaryOrigin, false))
-	}
-	appendIfNotEmpty(config.CORSAllowHeaders, cors.AllowHeaders...)
-	appendIfNotEmpty(config.CORSAllowMethods, cors.AllowMethods...)
-	appendIfNotEmpty(config.CORSExposeHeaders, cors.ExposeHeaders...)
-	if cors.MaxAge > 0 {
-		headers = append(headers, createHeaderValueOption(config.CORSMaxAge, strconv.Itoa(cors.MaxAge), false))
-	}
-	if cors.AllowCredentials && allowedOrigin != config.CORSOriginWildcard {
-		headers = append(headers, createHeaderValueOption(config.CORSAllowCredentials, config.CORSAllowCredentialsValue, false))
+	for _, h := range envRequest.CORSResponseHeaders() {
+		headers = append(headers, createHeaderValueOption(h.Name, h.Value, false))
 	}
 	return
 }
 
 // includes :path and any JWTAuthentication.ForwardPayloadHeader requests
-func addRequestHeaderTransforms(req *authv3.CheckRequest, envRequest *config.EnvironmentSpecRequest,
+func addRequestHeaderTransforms(envRequest *config.EnvironmentSpecRequest,
 	okResponse *authv3.OkHttpResponse) {
-	if envRequest != nil {
-		if apiOperation := envRequest.GetOperation(); apiOperation != nil {
-
-			// add ForwardPayloadHeaders
-			for _, ja := range envRequest.JWTAuthentications() {
-				claims, _ := envRequest.GetJWTResult(ja.Name)
-				if claims != nil && ja.ForwardPayloadHeader != "" {
-					b, err := json.Marshal(claims)
-					if err != nil {
-						log.Errorf("unable to marshal ForwardPayloadHeader for %s", ja.Name)
-						continue
-					}
-					encodedClaims := base64.URLEncoding.EncodeToString(b)
-					addRequestHeader(okResponse, ja.ForwardPayloadHeader, encodedClaims, true)
-				}
-			}
-
-			transforms := envRequest.GetHTTPRequestTransforms()
-
-			// http path transformation
-			pathTransform := transforms.PathTransform
-			var targetPath = envRequest.GetOperationPath()
-			if pathTransform != "" {
-				targetPath = envRequest.Reify(pathTransform)
-				targetPath = path.Clean(targetPath)
-			}
-
-			queryMap := envRequest.GetQueryParams()
-			for _, t := range transforms.QueryTransforms.Remove {
-				t = strings.ToLower(t)
-				delete(queryMap, t)
-			}
-			queryAppends := make(map[string][]string) // excess adds
-			for k, v := range queryMap {
-				queryAppends[k] = []string{v}
-			}
-			for _, t := range transforms.QueryTransforms.Add {
-				value := envRequest.Reify(t.Value)
-				if t.Append {
-					queryAppends[t.Name] = append(queryAppends[t.Name], value)
-				} else {
-					queryAppends[t.Name] = []string{value}
-				}
-			}
-			if len(queryAppends) > 0 {
-				queryParams := []string{}
-				for name, vals := range queryAppends {
-					for _, val := range vals {
-						queryParams = append(queryParams, fmt.Sprintf("%s=%s", url.QueryEscape(name), url.QueryEscape(val)))
-					}
-				}
-				targetPath = targetPath + "?" + strings.Join(queryParams, "&")
-			}
-
-			addRequestHeader(okResponse, envoyPathHeader, targetPath, false)
-
-			// header transforms
-			for _, t := range transforms.HeaderTransforms.Remove {
-				t = strings.ToLower(t)
-				for hdr := range req.Attributes.Request.Http.Headers {
-					if util.SimpleGlobMatch(t, hdr) {
-						okResponse.HeadersToRemove = append(okResponse.HeadersToRemove, hdr)
-					}
-				}
-			}
-			for _, t := range transforms.HeaderTransforms.Add {
-				value := envRequest.Reify(t.Value)
-				addRequestHeader(okResponse, t.Name, value, t.Append)
-			}
-		}
+	transforms := specmatch.Transforms(envRequest)
+	for _, h := range transforms.Headers {
+		addRequestHeader(okResponse, h.Name, h.Value, h.Append)
 	}
+	okResponse.HeadersToRemove = append(okResponse.HeadersToRemove, transforms.RemoveHeaders...)
 }
 
 func printHeaderMods(okResponse *authv3.OkHttpResponse) string {
 	printHeaderValueOptions := func(indent string, b *strings.Builder, options []*corev3.HeaderValueOption) {
 		if len(options) > 0 {
+			// sort a copy, the order of the mods is kept
+			options = append([]*corev3.HeaderValueOption(nil), options...)
 			sort.Sort(SortHeadersByKey(options))
 			for _, h := range options {
 				addAppend := "="
@@ -442,8 +316,9 @@ func printHeaderMods(okResponse *authv3.OkHttpResponse) string {
 	if len(okResponse.Headers) > 0 || len(okResponse.HeadersToRemove) > 0 {
 		b.WriteString("Request header mods:\n")
 		printHeaderValueOptions("  ", &b, okResponse.Headers)
-		sort.Strings(okResponse.HeadersToRemove)
-		for _, h := range okResponse.HeadersToRemove {
+		removes := append([]string(nil), okResponse.HeadersToRemove...)
+		sort.Strings(removes)
+		for _, h := range removes {
 			b.WriteString(fmt.Sprintf("   - %q\n", h))
 		}
 	}
@@ -493,6 +368,53 @@ func (a *AuthorizationServer) unavailable(req *authv3.CheckRequest) *authv3.Chec
 	return a.createConditionalEnvoyDenied(req, nil, nil, nil, "", rpc.UNAVAILABLE)
 }
 
+// denies without an analytics record as the spool is already over threshold
+func (a *AuthorizationServer) spoolBackpressure(req *authv3.CheckRequest) *authv3.CheckResponse {
+	log.Debugf("sending analytics spool backpressure")
+	prometheusSpoolDenied.WithLabelValues(a.handler.Organization(), a.handler.Environment()).Inc()
+	return a.createConditionalEnvoyDenied(req, nil, nil, nil, "", a.handler.spool.denyCode)
+}
+
+// sheds the check while the adapter is saturated, either denying or
+// forwarding unchecked with the overloaded header
+func (a *AuthorizationServer) overloaded(req *authv3.CheckRequest) *authv3.CheckResponse {
+	if a.handler.overload.allow {
+		log.Debugf("overloaded, sending ok unchecked")
+		prometheusOverloadShed.WithLabelValues(a.handler.Organization(), a.handler.Environment(), config.OverloadActionAllow).Inc()
+		return &authv3.CheckResponse{
+			Status: &status.Status{
+				Code: int32(rpc.OK),
+			},
+			HttpResponse: &authv3.CheckResponse_OkResponse{
+				OkResponse: &authv3.OkHttpResponse{
+					Headers: []*corev3.HeaderValueOption{createHeaderValueOption(headerOverloaded, "true", false)},
+				},
+			},
+		}
+	}
+	log.Debugf("overloaded, sending service unavailable")
+	prometheusOverloadShed.WithLabelValues(a.handler.Organization(), a.handler.Environment(), config.OverloadActionDeny).Inc()
+	return a.createConditionalEnvoyDenied(req, nil, nil, nil, "", rpc.UNAVAILABLE)
+}
+
+func (a *AuthorizationServer) limitExceeded(req *authv3.CheckRequest,
+	tracker *prometheusRequestMetricTracker, limit string) *authv3.CheckResponse {
+	log.Debugf("request exceeds %s limit", limit)
+	prometheusRequestLimitDenied.WithLabelValues(tracker.rootContext.Organization(), tracker.rootContext.Environment(), limit).Inc()
+	resp := a.createEnvoyDenied(req, nil, tracker, nil, "", rpc.INVALID_ARGUMENT, typev3.StatusCode_RequestHeaderFieldsTooLarge)
+	setDenyReason(resp, denyReasonRequestLimit)
+	return resp
+}
+
+func (a *AuthorizationServer) ambiguousRequest(req *authv3.CheckRequest,
+	tracker *prometheusRequestMetricTracker, ambiguity string) *authv3.CheckResponse {
+	log.Debugf("request is ambiguous: %s", ambiguity)
+	prometheusAmbiguousRequestDenied.WithLabelValues(tracker.rootContext.Organization(), tracker.rootContext.Environment(), ambiguity).Inc()
+	resp := a.createEnvoyDenied(req, nil, tracker, nil, "", rpc.INVALID_ARGUMENT, typev3.StatusCode_BadRequest)
+	setDenyReason(resp, denyReasonAmbiguousRequest)
+	return resp
+}
+
 func (a *AuthorizationServer) internalError(req *authv3.CheckRequest, envRequest *config.EnvironmentSpecRequest,
 	tracker *prometheusRequestMetricTracker, err error) *authv3.CheckResponse {
 	log.Errorf("sending internal error: %v", err)
@@ -505,8 +427,19 @@ func (a *AuthorizationServer) denied(req *authv3.CheckRequest, envRequest *confi
 }
 
 func (a *AuthorizationServer) quotaExceeded(req *authv3.CheckRequest, envRequest *config.EnvironmentSpecRequest,
-	tracker *prometheusRequestMetricTracker, authContext *auth.Context, api string) *authv3.CheckResponse {
-	return a.createConditionalEnvoyDenied(req, envRequest, tracker, authContext, api, rpc.RESOURCE_EXHAUSTED)
+	tracker *prometheusRequestMetricTracker, authContext *auth.Context, api string, exceeded *exceededQuota) *authv3.CheckResponse {
+	resp := a.createConditionalEnvoyDenied(req, envRequest, tracker, authContext, api, rpc.RESOURCE_EXHAUSTED)
+	setDenyReason(resp, config.DenialQuotaExceeded)
+	if exceeded != nil {
+		var retryAfter int64
+		if exceeded.expiry > 0 {
+			if retryAfter = exceeded.expiry - time.Now().Unix(); retryAfter < 1 {
+				retryAfter = 1
+			}
+		}
+		encodeDenyQuotaMetadata(resp.GetDynamicMetadata(), exceeded.id, retryAfter)
+	}
+	return resp
 }
 
 // creates a deny (direct) response if authorization has failed unless
@@ -533,7 +466,9 @@ func (a *AuthorizationServer) createConditionalEnvoyDenied(
 
 	if authContext != nil && a.handler.allowUnauthorized {
 		log.Debugf("sending ok (actual: %s)", code.String())
-		return a.createEnvoyForwarded(req, tracker, authContext, api, envRequest)
+		okResponse := &authv3.OkHttpResponse{}
+		addRequestHeaderTransforms(envRequest, okResponse)
+		return a.createEnvoyForwarded(req, tracker, authContext, api, envRequest, okResponse)
 	}
 
 	return a.createEnvoyDenied(req, envRequest, tracker, authContext, api, code, statusCode)
@@ -570,6 +505,7 @@ func (a *AuthorizationServer) createEnvoyDenied(req *authv3.CheckRequest, envReq
 				Headers: append(corsResponseHeaders(envRequest), dynamicDataHeaders...),
 			},
 		},
+		DynamicMetadata: encodeDenyMetadata(strings.ToLower(rpcCode.String())),
 	}
 
 	// Envoy does not send metadata to ALS on a reject, so we create the
@@ -584,6 +520,16 @@ func (a *AuthorizationServer) createEnvoyDenied(req *authv3.CheckRequest, envReq
 		duration := time.Now().Unix() - tracker.startTime.Unix()
 		sent := start + duration                                                   // use Envoy's start time to calculate
 		requestPath := strings.SplitN(req.Attributes.Request.Http.Path, "?", 2)[0] // Apigee doesn't want query params in requestPath
+		apiProxy := api
+		if op := envRequest.GetOperation(); op != nil && op.AnalyticsProxy != "" {
+			apiProxy = op.AnalyticsProxy
+		}
+		forwardedFor := req.Attributes.Request.Http.Headers[config.ForwardedForHeader]
+		if forwardedFor == "" {
+			forwardedFor = req.Attributes.Request.Http.Headers["X-Forwarded-For"]
+		}
+		clientIP := a.handler.analyticsClientIP(req.GetAttributes().GetSource().GetAddress().GetSocketAddress().GetAddress(),
+			forwardedFor)
 		record := analytics.Record{
 			ClientReceivedStartTimestamp: start,
 			ClientReceivedEndTimestamp:   start,
@@ -593,16 +539,21 @@ func (a *AuthorizationServer) createEnvoyDenied(req *authv3.CheckRequest, envReq
 			TargetReceivedEndTimestamp:   0,
 			ClientSentStartTimestamp:     sent,
 			ClientSentEndTimestamp:       sent,
-			APIProxy:                     api,
+			APIProxy:                     apiProxy,
 			RequestURI:                   req.Attributes.Request.Http.Path,
 			RequestPath:                  requestPath,
 			RequestVerb:                  req.Attributes.Request.Http.Method,
 			UserAgent:                    req.Attributes.Request.Http.Headers["User-Agent"],
 			ResponseStatusCode:           int(statusCode),
 			GatewaySource:                a.gatewaySource,
-			ClientIP:                     req.Attributes.Request.Http.Headers["X-Forwarded-For"],
+			ClientIP:                     clientIP,
+			Attributes:                   analyticsAttributes(nil, nil, nil, "", envRequest.GetBotRule()),
 		}
 
+		a.handler.applyProxyFields(&record, basepath, req.GetAttributes().GetRequest().GetHttp().GetHost())
+		correctTimeSkew(&record, time.Now(), a.handler.maxTimeSkew, a.handler.orgName)
+		a.handler.enrichRecord(&record, authContext)
+
 		// this may be more efficient to batch, but changing the golib impl would require
 		// a rewrite as it assumes the same authContext for all records
 		records := []analytics.Record{record}
@@ -622,13 +573,22 @@ var (
 		Name:      "requests_seconds",
 		Help:      "Time taken to process authorization requests by code",
 		Buckets:   prometheus.DefBuckets,
-	}, []string{"org", "env", "code"})
+	}, []string{"org", "env", "spec", "api", "code"})
+
+	prometheusLabeledRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "labeled_requests_count",
+		Help:      "Total number of authorization requests by configured operation label and code",
+	}, []string{"org", "env", "spec", "api", "label", "value", "code"})
 )
 
 type prometheusRequestMetricTracker struct {
 	rootContext context.Context
 	startTime   time.Time
 	statusCode  typev3.StatusCode
+	labels      map[string]string // operation labels emitted as metric labels
+	spec        string            // allowed environment spec ID
+	api         string            // allowed API ID
 }
 
 // set statusCode before calling record()
@@ -644,7 +604,12 @@ func prometheusRequestTracker(rootContext context.Context) *prometheusRequestMet
 func (t *prometheusRequestMetricTracker) record() {
 	codeLabel := fmt.Sprintf("%d", t.statusCode)
 	httpDuration := time.Since(t.startTime)
-	prometheusAuthSeconds.WithLabelValues(t.rootContext.Organization(), t.rootContext.Environment(), codeLabel).Observe(httpDuration.Seconds())
+	prometheusAuthSeconds.WithLabelValues(t.rootContext.Organization(), t.rootContext.Environment(),
+		t.spec, t.api, codeLabel).Observe(httpDuration.Seconds())
+	for k, v := range t.labels {
+		prometheusLabeledRequests.WithLabelValues(t.rootContext.Organization(), t.rootContext.Environment(),
+			t.spec, t.api, k, v, codeLabel).Inc()
+	}
 }
 
 type multitenantContext struct {
@@ -0,0 +1,244 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/cors"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+)
+
+const (
+	authorizePath = "/authorize"
+
+	grpcContentType        = "application/grpc"
+	grpcWebContentType     = "application/grpc-web"
+	grpcWebTextContentType = "application/grpc-web-text"
+	grpcWebTrailerFrame    = 0x80
+)
+
+// authorizationServices are the gRPC services served by the facade
+var authorizationServices = []string{
+	"/envoy.service.auth.v3.Authorization/",
+	"/envoy.service.auth.v2.Authorization/",
+}
+
+// NewAuthorizationFacadeHandler returns next also serving the authorization
+// gRPC services of grpcServer to gRPC clients over HTTP/2, including h2c,
+// and to gRPC-Web clients, so browsers and simple sidecars may call the
+// authorization API on the metrics address. Other gRPC services are not
+// served.
+func NewAuthorizationFacadeHandler(grpcServer *grpc.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType := r.Header.Get("Content-Type")
+		switch {
+		case !isAuthorizationService(r.URL.Path):
+			next.ServeHTTP(w, r)
+		case strings.HasPrefix(contentType, grpcWebContentType):
+			serveGRPCWeb(grpcServer, w, r)
+		case r.ProtoMajor == 2 && strings.HasPrefix(contentType, grpcContentType):
+			grpcServer.ServeHTTP(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// authorizationCORS adds the CORS headers of its policy to the responses of
+// the authorization API
+type authorizationCORS struct {
+	policy *cors.Policy
+	next   http.Handler
+}
+
+// NewAuthorizationCORSHandler returns next with the CORS headers of policy
+// on the responses of the authorization API. Preflights of the authorization
+// API are answered without calling next, so it must be wrapped by the admin
+// access handler, which lets preflights of allowed origins through without
+// the bearer token. Returns next itself if the policy allows no origins.
+func NewAuthorizationCORSHandler(policy config.CorsPolicy, next http.Handler) (http.Handler, error) {
+	p, err := policy.Compile()
+	if err != nil || p == nil {
+		return next, err
+	}
+	return &authorizationCORS{policy: p, next: next}, nil
+}
+
+func (a *authorizationCORS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get(cors.OriginHeader)
+	if origin == "" || !isAuthorizationAPI(r.URL.Path) {
+		a.next.ServeHTTP(w, r)
+		return
+	}
+	preflight := isPreflight(r)
+	requestHeaders := map[string]string{
+		cors.RequestPrivateNetworkHeader: r.Header.Get(cors.RequestPrivateNetworkHeader),
+	}
+	for _, h := range a.policy.ResponseHeaders(origin, preflight, requestHeaders) {
+		w.Header().Add(h.Name, h.Value)
+	}
+	if preflight {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	a.next.ServeHTTP(w, r)
+}
+
+// allowedPreflight returns true if r is a preflight of the authorization API
+// from an origin the policy allows. Browsers send preflights without
+// credentials.
+func (a *authorizationCORS) allowedPreflight(r *http.Request) bool {
+	if !isPreflight(r) || !isAuthorizationAPI(r.URL.Path) {
+		return false
+	}
+	allowed, _ := a.policy.AllowedOrigin(r.Header.Get(cors.OriginHeader))
+	return allowed != ""
+}
+
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get(cors.RequestMethodHeader) != ""
+}
+
+func isAuthorizationAPI(path string) bool {
+	return path == authorizePath || isAuthorizationService(path)
+}
+
+func isAuthorizationService(path string) bool {
+	for _, service := range authorizationServices {
+		if strings.HasPrefix(path, service) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveGRPCWeb serves a gRPC-Web request as a gRPC request of grpcServer.
+// The request is presented as HTTP/2 gRPC and the gRPC trailers are written
+// to the response body as a gRPC-Web trailer frame. Text requests and
+// responses are base64 encoded.
+func serveGRPCWeb(grpcServer *grpc.Server, w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	text := strings.HasPrefix(contentType, grpcWebTextContentType)
+
+	req := r.Clone(r.Context())
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	req.Header.Set("Content-Type", grpcContentType+strings.TrimPrefix(
+		strings.TrimPrefix(contentType, grpcWebTextContentType), grpcWebContentType))
+	req.Header.Del("Content-Length")
+	req.ContentLength = -1
+	if text {
+		req.Body = readCloser{base64.NewDecoder(base64.StdEncoding, r.Body), r.Body}
+	}
+
+	gw := &grpcWebResponseWriter{w: w, header: make(http.Header), contentType: contentType, text: text}
+	grpcServer.ServeHTTP(gw, req)
+	gw.writeTrailers()
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// grpcWebResponseWriter translates the gRPC response of the HTTP/2 handler
+// of a grpc.Server into a gRPC-Web response
+type grpcWebResponseWriter struct {
+	w           http.ResponseWriter
+	header      http.Header // of the gRPC response, including trailers
+	contentType string
+	text        bool
+	code        int // 0 until written
+}
+
+func (g *grpcWebResponseWriter) Header() http.Header {
+	return g.header
+}
+
+func (g *grpcWebResponseWriter) WriteHeader(code int) {
+	if g.code != 0 {
+		return
+	}
+	g.code = code
+	trailers := g.trailerNames()
+	for k, v := range g.header {
+		if k != "Trailer" && !trailers[k] && !strings.HasPrefix(k, http2.TrailerPrefix) {
+			g.w.Header()[k] = v
+		}
+	}
+	if code == http.StatusOK {
+		g.w.Header().Set("Content-Type", g.contentType)
+	}
+	g.w.WriteHeader(code)
+}
+
+func (g *grpcWebResponseWriter) Write(b []byte) (int, error) {
+	g.WriteHeader(http.StatusOK)
+	if !g.text {
+		return g.w.Write(b)
+	}
+	if _, err := io.WriteString(g.w, base64.StdEncoding.EncodeToString(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (g *grpcWebResponseWriter) Flush() {
+	if f, ok := g.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// trailerNames returns the declared trailers
+func (g *grpcWebResponseWriter) trailerNames() map[string]bool {
+	names := make(map[string]bool)
+	for _, v := range g.header.Values("Trailer") {
+		for _, name := range strings.Split(v, ",") {
+			names[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+	return names
+}
+
+// writeTrailers writes the gRPC trailers as a gRPC-Web trailer frame
+// unless the request failed before reaching gRPC
+func (g *grpcWebResponseWriter) writeTrailers() {
+	if g.code != 0 && g.code != http.StatusOK {
+		return
+	}
+	var block strings.Builder
+	trailers := g.trailerNames()
+	for k, vv := range g.header {
+		name := strings.TrimPrefix(k, http2.TrailerPrefix)
+		if !trailers[k] && name == k {
+			continue
+		}
+		for _, v := range vv {
+			block.WriteString(strings.ToLower(name) + ": " + v + "\r\n")
+		}
+	}
+	frame := make([]byte, 5, 5+block.Len())
+	frame[0] = grpcWebTrailerFrame
+	binary.BigEndian.PutUint32(frame[1:], uint32(block.Len()))
+	frame = append(frame, block.String()...)
+	_, _ = g.Write(frame)
+	g.Flush()
+}
@@ -0,0 +1,242 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/proto"
+)
+
+type testFacadeAuthorization struct {
+	authv3.UnimplementedAuthorizationServer
+}
+
+func (a *testFacadeAuthorization) Check(ctx context.Context, req *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	code := codes.PermissionDenied
+	if req.GetAttributes().GetRequest().GetHttp().GetPath() == "/allowed" {
+		code = codes.OK
+	}
+	return &authv3.CheckResponse{Status: &status.Status{Code: int32(code)}}, nil
+}
+
+func newTestFacadeServer(t *testing.T) *httptest.Server {
+	return newRestrictedFacadeServer(t, config.AdminAccess{AllowedCIDRs: []string{"127.0.0.0/8", "::1/128"}})
+}
+
+// newRestrictedFacadeServer serves the facade wrapped like the metrics address
+func newRestrictedFacadeServer(t *testing.T, access config.AdminAccess) *httptest.Server {
+	grpcServer := grpc.NewServer()
+	authv3.RegisterAuthorizationServer(grpcServer, &testFacadeAuthorization{})
+	mux := http.NewServeMux()
+	mux.HandleFunc(authorizePath, func(w http.ResponseWriter, r *http.Request) {})
+	handler, err := NewAuthorizationCORSHandler(config.CorsPolicy{
+		AllowOrigins: []string{"https://tools.example.com"},
+		AllowHeaders: []string{"content-type", "x-grpc-web"},
+	}, NewAuthorizationFacadeHandler(grpcServer, mux))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err = NewAdminAccessHandler(access, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// grpcWebFrames returns the frames of a gRPC-Web response body
+func grpcWebFrames(t *testing.T, body []byte) (messages [][]byte, trailers string) {
+	for len(body) > 0 {
+		if len(body) < 5 {
+			t.Fatalf("truncated frame: %v", body)
+		}
+		n := binary.BigEndian.Uint32(body[1:5])
+		frame := body[5 : 5+n]
+		if body[0]&grpcWebTrailerFrame != 0 {
+			trailers = string(frame)
+		} else {
+			messages = append(messages, frame)
+		}
+		body = body[5+n:]
+	}
+	return messages, trailers
+}
+
+func TestAuthorizationFacadeGRPCWeb(t *testing.T) {
+	srv := newTestFacadeServer(t)
+	msg, err := proto.Marshal(&authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{Request: &authv3.AttributeContext_Request{
+			Http: &authv3.AttributeContext_HttpRequest{Path: "/allowed"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	frame = append(frame, msg...)
+
+	for _, contentType := range []string{grpcWebContentType + "+proto", grpcWebTextContentType} {
+		t.Run(contentType, func(t *testing.T) {
+			text := strings.HasPrefix(contentType, grpcWebTextContentType)
+			body := frame
+			if text {
+				body = []byte(base64.StdEncoding.EncodeToString(frame))
+			}
+			req, _ := http.NewRequest(http.MethodPost, srv.URL+"/envoy.service.auth.v3.Authorization/Check", bytes.NewReader(body))
+			req.Header.Set("Content-Type", contentType)
+			req.Header.Set("Origin", "https://tools.example.com")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != contentType {
+				t.Fatalf("want 200 %s, got %d %s", contentType, resp.StatusCode, resp.Header.Get("Content-Type"))
+			}
+			if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "https://tools.example.com" {
+				t.Errorf("want allowed origin, got %q", got)
+			}
+			respBody, _ := io.ReadAll(resp.Body)
+			if text {
+				// each write is encoded separately, so decode by quantum
+				var decoded []byte
+				for i := 0; i+4 <= len(respBody); i += 4 {
+					b, err := base64.StdEncoding.DecodeString(string(respBody[i : i+4]))
+					if err != nil {
+						t.Fatalf("invalid base64 body: %v", err)
+					}
+					decoded = append(decoded, b...)
+				}
+				respBody = decoded
+			}
+			messages, trailers := grpcWebFrames(t, respBody)
+			if len(messages) != 1 {
+				t.Fatalf("want 1 message, got %d", len(messages))
+			}
+			checkResp := &authv3.CheckResponse{}
+			if err := proto.Unmarshal(messages[0], checkResp); err != nil {
+				t.Fatal(err)
+			}
+			if checkResp.GetStatus().GetCode() != int32(codes.OK) {
+				t.Errorf("want allowed, got %v", checkResp.GetStatus())
+			}
+			if !strings.Contains(trailers, "grpc-status: 0\r\n") {
+				t.Errorf("want grpc-status trailer, got %q", trailers)
+			}
+		})
+	}
+}
+
+func TestAuthorizationFacadeH2C(t *testing.T) {
+	srv := newTestFacadeServer(t)
+	conn, err := grpc.Dial(strings.TrimPrefix(srv.URL, "http://"), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	resp, err := authv3.NewAuthorizationClient(conn).Check(context.Background(), &authv3.CheckRequest{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.GetStatus().GetCode() != int32(codes.PermissionDenied) {
+		t.Errorf("want denied, got %v", resp.GetStatus())
+	}
+}
+
+func TestAuthorizationCORS(t *testing.T) {
+	srv := newTestFacadeServer(t)
+	preflight := func(path, origin string) *http.Response {
+		req, _ := http.NewRequest(http.MethodOptions, srv.URL+path, nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := preflight(authorizePath, "https://tools.example.com")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("want 204, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "https://tools.example.com" {
+		t.Errorf("want allowed origin, got %q", got)
+	}
+	if got := resp.Header.Get("Access-Control-Allow-Headers"); got != "content-type,x-grpc-web" {
+		t.Errorf("want allowed headers, got %q", got)
+	}
+
+	resp = preflight(authorizePath, "https://evil.example.com")
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("want origin not allowed, got %q", got)
+	}
+
+	resp = preflight("/quotas", "https://tools.example.com")
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("want no CORS outside the authorization API, got %q", got)
+	}
+
+	// preflights of allowed origins need no bearer token
+	srv = newRestrictedFacadeServer(t, config.AdminAccess{BearerToken: "secret"})
+	resp = preflight(authorizePath, "https://tools.example.com")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("want 204 without the bearer token, got %d", resp.StatusCode)
+	}
+	resp = preflight(authorizePath, "https://evil.example.com")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("want 401 for other origins, got %d", resp.StatusCode)
+	}
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+authorizePath, nil)
+	req.Header.Set("Origin", "https://tools.example.com")
+	post, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post.Body.Close()
+	if post.StatusCode != http.StatusUnauthorized {
+		t.Errorf("want 401 for requests without the bearer token, got %d", post.StatusCode)
+	}
+
+	// other restrictions apply to preflights
+	srv = newRestrictedFacadeServer(t, config.AdminAccess{BearerToken: "secret", AllowedCIDRs: []string{"10.0.0.0/8"}})
+	resp = preflight(authorizePath, "https://tools.example.com")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("want 403 from a disallowed address, got %d", resp.StatusCode)
+	}
+
+	if h, err := NewAuthorizationCORSHandler(config.CorsPolicy{}, http.NotFoundHandler()); err != nil || h == nil {
+		t.Errorf("want next without a policy, got %v, %v", h, err)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/context"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+)
+
+// AuthorizationQuery asks if the consumer of an API key would be authorized
+// to call an API operation. It is answered from the cached API keys and
+// products like the authorization checks, but without counting quotas or
+// recording analytics. JWT authentication and app bindings are not evaluated.
+type AuthorizationQuery struct {
+	APIKey      string `json:"api_key"`
+	Spec        string `json:"spec,omitempty"`        // environment spec ID, global API if empty
+	API         string `json:"api,omitempty"`         // global API, if no spec
+	Method      string `json:"method,omitempty"`      // default GET
+	Path        string `json:"path"`                  // including any base path
+	Environment string `json:"environment,omitempty"` // multi-tenant only
+}
+
+// AuthorizationDecision answers an AuthorizationQuery. The developer of the
+// app isn't included.
+type AuthorizationDecision struct {
+	Allowed     bool     `json:"allowed"`
+	Reason      string   `json:"reason,omitempty"` // if not allowed
+	API         string   `json:"api,omitempty"`
+	Operation   string   `json:"operation,omitempty"`
+	Application string   `json:"application,omitempty"`
+	Products    []string `json:"products,omitempty"`
+	Operations  []string `json:"authorized_operations,omitempty"` // of the products
+}
+
+// authorize answers the query, returns an error if the query is invalid
+func (h *Handler) authorize(q AuthorizationQuery) (AuthorizationDecision, error) {
+	var d AuthorizationDecision
+	if q.APIKey == "" || q.Path == "" {
+		return d, fmt.Errorf("api_key and path are required")
+	}
+	if q.Method == "" {
+		q.Method = http.MethodGet
+	}
+
+	var rootContext context.Context = h
+	if q.Environment != "" && q.Environment != h.Environment() {
+		if !h.isMultitenant || !h.envRouter.allows(q.Environment) {
+			return d, fmt.Errorf("environment %q is not a tenant environment", q.Environment)
+		}
+		rootContext = &multitenantContext{h, q.Environment}
+	}
+
+	var envRequest *config.EnvironmentSpecRequest
+	path := q.Path
+	if q.Spec != "" {
+		envSpec, ok := h.environmentSpec(q.Spec)
+		if !ok {
+			return d, fmt.Errorf("unknown environment spec %q", q.Spec)
+		}
+		req := &authv3.CheckRequest{
+			Attributes: &authv3.AttributeContext{
+				Request: &authv3.AttributeContext_Request{
+					Http: &authv3.AttributeContext_HttpRequest{
+						Method:  q.Method,
+						Path:    q.Path,
+						Headers: map[string]string{},
+					},
+				},
+				ContextExtensions: map[string]string{envSpecContextKey: q.Spec},
+			},
+		}
+		envRequest = config.NewEnvironmentSpecRequest(h.authMan, envSpec, req)
+		api := envRequest.GetAPISpec()
+		if api == nil {
+			d.Reason = "no API matched"
+			return d, nil
+		}
+		d.API = api.ID
+		op := envRequest.GetOperation()
+		if op == nil {
+			d.Reason = "no operation matched"
+			return d, nil
+		}
+		d.Operation = op.Name
+		if !envRequest.IsAuthorizationRequired() {
+			d.Allowed = true
+			return d, nil
+		}
+		path = envRequest.GetOperationPath()
+	} else {
+		if q.API == "" {
+			return d, fmt.Errorf("one of spec or api is required")
+		}
+		d.API = q.API
+	}
+
+	authContext, err := h.authMan.Authenticate(rootContext, q.APIKey, nil, h.apiKeyClaim)
+	switch err {
+	case nil:
+	case auth.ErrBadAuth:
+		d.Reason = "invalid API key"
+		return d, nil
+	default:
+		d.Reason = fmt.Sprintf("API key verification failed: %v", err)
+		return d, nil
+	}
+	d.Application = authContext.Application
+	d.Products = authContext.APIProducts
+	if len(authContext.APIProducts) == 0 {
+		d.Reason = "no API products"
+		return d, nil
+	}
+
+	if _, err := h.consumerAccess(envRequest, d.API, authContext); err != nil {
+		d.Reason = err.Error()
+		return d, nil
+	}
+
+	for _, op := range h.productMan.Authorize(authContext, d.API, path, q.Method) {
+		d.Operations = append(d.Operations, op.ID)
+	}
+	if len(d.Operations) == 0 {
+		d.Reason = "no API product operation authorized"
+		return d, nil
+	}
+	d.Allowed = true
+	return d, nil
+}
+
+// AuthorizationHandlerFunc returns an http.HandlerFunc answering the JSON
+// AuthorizationQuery POSTed with the JSON AuthorizationDecision, so support
+// tooling can check a consumer's access without generating traffic. Only
+// served with admin access, see RegisterAdminHandlers.
+func (h *Handler) AuthorizationHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respond := func(status int, body interface{}) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			if err := json.NewEncoder(w).Encode(body); err != nil {
+				log.Warnf("authorization query unable to respond: %s", err)
+			}
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var q AuthorizationQuery
+		if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+			respond(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		d, err := h.authorize(q)
+		if err != nil {
+			respond(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		respond(http.StatusOK, d)
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAuthorize(t *testing.T) {
+	envSpec := &config.EnvironmentSpec{
+		ID: "spec",
+		APIs: []config.APISpec{
+			{
+				ID:       "api",
+				BasePath: "/v1",
+				ConsumerAuthorization: config.ConsumerAuthorization{
+					In: []config.APIOperationParameter{{Match: config.Query("x-api-key")}},
+				},
+				ConsumerAccess: config.ConsumerAccess{
+					Block: config.ConsumerList{Apps: []string{"compromised"}},
+				},
+				Operations: []config.APIOperation{{
+					Name:        "pets",
+					HTTPMatches: []config.HTTPMatch{{PathTemplate: "/pets", Method: http.MethodGet}},
+				}},
+			},
+			{
+				ID:         "open",
+				BasePath:   "/open",
+				Operations: []config.APIOperation{{Name: "all"}},
+			},
+		},
+	}
+	specExt, err := config.NewEnvironmentSpecExt(envSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	products := map[string]*product.APIProduct{"product1": {DisplayName: "product1"}}
+
+	tests := []struct {
+		desc     string
+		query    AuthorizationQuery
+		app      string
+		products []string
+		authErr  error
+		want     AuthorizationDecision
+		wantErr  string
+	}{
+		{
+			desc:     "allowed",
+			query:    AuthorizationQuery{APIKey: "key", Spec: "spec", Path: "/v1/pets"},
+			app:      "app",
+			products: []string{"product1"},
+			want: AuthorizationDecision{Allowed: true, API: "api", Operation: "pets", Application: "app",
+				Products: []string{"product1"}, Operations: []string{"product1"}},
+		},
+		{
+			desc:     "global api",
+			query:    AuthorizationQuery{APIKey: "key", API: "api", Path: "/pets"},
+			app:      "app",
+			products: []string{"product1"},
+			want: AuthorizationDecision{Allowed: true, API: "api", Application: "app",
+				Products: []string{"product1"}, Operations: []string{"product1"}},
+		},
+		{
+			desc:  "no operation",
+			query: AuthorizationQuery{APIKey: "key", Spec: "spec", Method: http.MethodPost, Path: "/v1/pets"},
+			want:  AuthorizationDecision{API: "api", Reason: "no operation matched"},
+		},
+		{
+			desc:  "no api",
+			query: AuthorizationQuery{APIKey: "key", Spec: "spec", Path: "/v2/pets"},
+			want:  AuthorizationDecision{Reason: "no API matched"},
+		},
+		{
+			desc:  "no consumer authorization",
+			query: AuthorizationQuery{APIKey: "key", Spec: "spec", Path: "/open/pets"},
+			want:  AuthorizationDecision{Allowed: true, API: "open", Operation: "all"},
+		},
+		{
+			desc:    "invalid key",
+			query:   AuthorizationQuery{APIKey: "key", Spec: "spec", Path: "/v1/pets"},
+			authErr: auth.ErrBadAuth,
+			want:    AuthorizationDecision{API: "api", Operation: "pets", Reason: "invalid API key"},
+		},
+		{
+			desc:  "no products",
+			query: AuthorizationQuery{APIKey: "key", Spec: "spec", Path: "/v1/pets"},
+			app:   "app",
+			want:  AuthorizationDecision{API: "api", Operation: "pets", Application: "app", Reason: "no API products"},
+		},
+		{
+			desc:     "blocked",
+			query:    AuthorizationQuery{APIKey: "key", Spec: "spec", Path: "/v1/pets"},
+			app:      "compromised",
+			products: []string{"product1"},
+			want: AuthorizationDecision{API: "api", Operation: "pets", Application: "compromised",
+				Products: []string{"product1"}, Reason: `app "compromised" of developer "" is blocked`},
+		},
+		{
+			desc:     "not authorized",
+			query:    AuthorizationQuery{APIKey: "key", API: "other", Path: "/pets"},
+			app:      "app",
+			products: []string{"product1"},
+			want: AuthorizationDecision{API: "other", Application: "app", Products: []string{"product1"},
+				Reason: "no API product operation authorized"},
+		},
+		{
+			desc:    "missing key",
+			query:   AuthorizationQuery{Spec: "spec", Path: "/v1/pets"},
+			wantErr: "api_key and path are required",
+		},
+		{
+			desc:    "unknown spec",
+			query:   AuthorizationQuery{APIKey: "key", Spec: "unknown", Path: "/v1/pets"},
+			wantErr: `unknown environment spec "unknown"`,
+		},
+		{
+			desc:    "no spec or api",
+			query:   AuthorizationQuery{APIKey: "key", Path: "/v1/pets"},
+			wantErr: "one of spec or api is required",
+		},
+		{
+			desc:    "other environment",
+			query:   AuthorizationQuery{APIKey: "key", API: "api", Path: "/pets", Environment: "other"},
+			wantErr: `environment "other" is not a tenant environment`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			authMan := &testAuthMan{}
+			authMan.sendAuth(&auth.Context{Application: test.app, APIProducts: test.products}, test.authErr)
+			h := &Handler{
+				orgName:      "org",
+				envName:      "env",
+				authMan:      authMan,
+				productMan:   &testProductMan{api: "api", resolve: true, products: products},
+				envSpecsByID: map[string]*config.EnvironmentSpecExt{"spec": specExt},
+			}
+			got, err := h.authorize(test.query)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Errorf("want error %q, got: %v", test.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAuthorizationHandlerFunc(t *testing.T) {
+	authMan := &testAuthMan{}
+	authMan.sendAuth(&auth.Context{Application: "app", DeveloperEmail: "dev@example.com", APIProducts: []string{"product1"}}, nil)
+	h := &Handler{
+		orgName:    "org",
+		envName:    "env",
+		authMan:    authMan,
+		productMan: &testProductMan{api: "api", resolve: true, products: map[string]*product.APIProduct{"product1": {DisplayName: "product1"}}},
+	}
+	do := func(method, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.AuthorizationHandlerFunc()(rec, httptest.NewRequest(method, "/authorize", strings.NewReader(body)))
+		return rec
+	}
+
+	rec := do(http.MethodPost, `{"api_key": "key", "api": "api", "path": "/pets"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body)
+	}
+	if strings.Contains(rec.Body.String(), "dev@example.com") {
+		t.Errorf("want no developer email, got: %s", rec.Body)
+	}
+	var d AuthorizationDecision
+	if err := json.Unmarshal(rec.Body.Bytes(), &d); err != nil {
+		t.Fatal(err)
+	}
+	if !d.Allowed || d.Application != "app" {
+		t.Errorf("unexpected decision: %#v", d)
+	}
+
+	for _, body := range []string{`{"api": "api"}`, `not json`} {
+		if rec := do(http.MethodPost, body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: want status %d, got %d", body, http.StatusBadRequest, rec.Code)
+		}
+	}
+	if rec := do(http.MethodGet, ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("want status %d, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
@@ -129,7 +129,7 @@ func TestAddHeaderTransforms(t *testing.T) {
 			specReq := config.NewEnvironmentSpecRequest(nil, specExt, envoyReq)
 			okResponse := &authv3.OkHttpResponse{}
 
-			addRequestHeaderTransforms(envoyReq, specReq, okResponse)
+			addRequestHeaderTransforms(specReq, okResponse)
 
 			if test.expectedAdds != len(okResponse.Headers) {
 				t.Errorf("expected %d header adds got: %d", test.expectedAdds, len(okResponse.Headers))
@@ -258,7 +258,7 @@ func TestPathTransforms(t *testing.T) {
 			specReq := config.NewEnvironmentSpecRequest(nil, specExt, envoyReq)
 			okResponse := &authv3.OkHttpResponse{}
 
-			addRequestHeaderTransforms(envoyReq, specReq, okResponse)
+			addRequestHeaderTransforms(specReq, okResponse)
 
 			// path
 			pathSet := getHeaderValueOption(okResponse.Headers, envoyPathHeader)
@@ -286,6 +286,48 @@ func TestPathTransforms(t *testing.T) {
 	}
 }
 
+func TestConditionalTransforms(t *testing.T) {
+	envSpec := createAuthEnvSpec()
+	envSpec.APIs[0].HTTPRequestTransforms = config.HTTPRequestTransforms{
+		HeaderTransforms: config.NameValueTransforms{
+			Add: []config.AddNameValue{
+				{Name: "debug", Value: "on", Condition: `headers.x-debug == "true"`},
+				{Name: "no-debug", Value: "on", Condition: `headers.x-debug != "true"`},
+			},
+		},
+		QueryTransforms: config.NameValueTransforms{
+			Add: []config.AddNameValue{
+				{Name: "json", Value: "1", Condition: `headers.content-type =~ "json$"`},
+				{Name: "xml", Value: "1", Condition: `headers.content-type =~ "xml$"`},
+			},
+		},
+	}
+	specExt, err := config.NewEnvironmentSpecExt(&envSpec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	headers := map[string]string{
+		"x-debug":      "true",
+		"content-type": "application/json",
+	}
+	envoyReq := testutil.NewEnvoyRequest("GET", "/v1/petstore", headers, nil)
+	specReq := config.NewEnvironmentSpecRequest(nil, specExt, envoyReq)
+	okResponse := &authv3.OkHttpResponse{}
+
+	addRequestHeaderTransforms(specReq, okResponse)
+
+	if !hasHeaderAdd(okResponse.Headers, "debug", "on", false) {
+		t.Errorf("expected header mod: %q", "debug")
+	}
+	if getHeaderValueOption(okResponse.Headers, "no-debug") != nil {
+		t.Errorf("did not expect header mod: %q", "no-debug")
+	}
+	want := "/petstore?json=1"
+	if pathSet := getHeaderValueOption(okResponse.Headers, envoyPathHeader); pathSet.Header.Value != want {
+		t.Errorf("want: %q, got: %q", want, pathSet.Header.Value)
+	}
+}
+
 func TestEnvRequestCheck(t *testing.T) {
 	envSpec := createAuthEnvSpec()
 	specExt, err := config.NewEnvironmentSpecExt(&envSpec)
@@ -963,7 +1005,7 @@ func TestImmediateAnalytics(t *testing.T) {
 		RequestVerb:                  http.MethodGet,
 		ClientIP:                     headers["X-Forwarded-For"],
 		UserAgent:                    headers["User-Agent"],
-		APIProxyRevision:             0,
+		APIProxyRevision:             config.DefaultAnalyticsProxyRevision,
 		ResponseStatusCode:           http.StatusForbidden,
 		DeveloperEmail:               ac.DeveloperEmail,
 		DeveloperApp:                 ac.Application,
@@ -996,10 +1038,11 @@ func TestImmediateAnalytics(t *testing.T) {
 
 func TestCORSResponseHeaders(t *testing.T) {
 	tests := []struct {
-		desc          string
-		requestOrigin string
-		setHeaders    map[string]string
-		expectedLog   string
+		desc           string
+		requestOrigin  string
+		requestHeaders map[string]string
+		setHeaders     map[string]string
+		expectedLog    string
 	}{
 		{
 			desc:          "not cors",
@@ -1034,6 +1077,22 @@ func TestCORSResponseHeaders(t *testing.T) {
 			},
 			expectedLog: "Response header mods:\n  = \"access-control-allow-headers\": \"Allow...\"\n  = \"access-control-allow-methods\": \"Allow...\"\n  = \"access-control-allow-origin\": \"*\"\n  = \"access-control-expose-headers\": \"Expos...\"\n  = \"access-control-max-age\": \"42\"\n  = \"vary\": \"Origi...\"\n",
 		},
+		{
+			desc:           "private network",
+			requestOrigin:  "origin",
+			requestHeaders: map[string]string{config.CORSRequestPrivateNetwork: "true"},
+			setHeaders: map[string]string{
+				config.CORSAllowOrigin:         "origin",
+				config.CORSAllowHeaders:        "AllowHeaders",
+				config.CORSExposeHeaders:       "ExposeHeaders",
+				config.CORSAllowMethods:        "AllowMethods",
+				config.CORSMaxAge:              "42",
+				config.CORSAllowCredentials:    "true",
+				config.CORSAllowPrivateNetwork: "true",
+				config.CORSVary:                config.CORSVaryOrigin,
+			},
+			expectedLog: "Response header mods:\n  = \"access-control-allow-credentials\": \"true\"\n  = \"access-control-allow-headers\": \"Allow...\"\n  = \"access-control-allow-methods\": \"Allow...\"\n  = \"access-control-allow-origin\": \"origi...\"\n  = \"access-control-allow-private-network\": \"true\"\n  = \"access-control-expose-headers\": \"Expos...\"\n  = \"access-control-max-age\": \"42\"\n  = \"vary\": \"Origi...\"\n",
+		},
 	}
 
 	for _, test := range tests {
@@ -1046,6 +1105,9 @@ func TestCORSResponseHeaders(t *testing.T) {
 			}
 
 			headers := map[string]string{config.CORSOriginHeader: test.requestOrigin}
+			for k, v := range test.requestHeaders {
+				headers[k] = v
+			}
 			envoyReq := testutil.NewEnvoyRequest(http.MethodOptions, "/v1/petstore", headers, nil)
 			req := config.NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
 
@@ -1061,6 +1123,15 @@ func TestCORSResponseHeaders(t *testing.T) {
 				}
 			}
 
+			metadata := &structpb.Struct{Fields: map[string]*structpb.Value{}}
+			encodeCORSHeadersMetadata(metadata, headerOptions)
+			decoded := decodeCORSHeadersMetadata(metadata.GetFields())
+			if len(test.setHeaders) == 0 && decoded != nil {
+				t.Errorf("want no CORS headers metadata, got: %v", decoded)
+			} else if len(test.setHeaders) > 0 && !reflect.DeepEqual(test.setHeaders, decoded) {
+				t.Errorf("want: %v, got: %v", test.setHeaders, decoded)
+			}
+
 			okResponse := &authv3.OkHttpResponse{ResponseHeadersToAdd: headerOptions}
 			logged := printHeaderMods(okResponse)
 			if test.expectedLog != logged {
@@ -1070,6 +1141,60 @@ func TestCORSResponseHeaders(t *testing.T) {
 	}
 }
 
+func TestApplyQuotasKey(t *testing.T) {
+	ops := []product.AuthorizedOperation{
+		{ID: "product1", QuotaLimit: 10},
+		{ID: "product2"},
+	}
+	tests := []struct {
+		desc     string
+		quotaKey string
+		want     []string
+	}{
+		{"no key", "", []string{"product1"}},
+		{"key", "gold", []string{"product1" + quotaKeySeparator + "gold"}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			quotaMan := &testQuotaMan{}
+			server := AuthorizationServer{handler: &Handler{quotaMan: quotaMan}}
+			exceeded, pending, err := server.applyQuotas(ops, &auth.Context{}, test.quotaKey)
+			if exceeded != nil || err != nil {
+				t.Errorf("want not exceeded and no error, got: %v, %v", exceeded, err)
+			}
+			if pending != nil {
+				t.Errorf("want no pending quotas, got: %v", pending)
+			}
+			if diff := cmp.Diff(test.want, quotaMan.applied); diff != "" {
+				t.Errorf("diff (-want +got):\n%s", diff)
+			}
+			if ops[0].ID != "product1" {
+				t.Errorf("operation ID must not be modified, got: %s", ops[0].ID)
+			}
+		})
+	}
+}
+
+func TestMetricLabels(t *testing.T) {
+	labels := map[string]string{"tier": "gold", "team": "pets"}
+	tests := []struct {
+		desc  string
+		names []string
+		want  map[string]string
+	}{
+		{"none", nil, nil},
+		{"unknown", []string{"region"}, nil},
+		{"selected", []string{"tier", "region"}, map[string]string{"tier": "gold"}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			if diff := cmp.Diff(test.want, metricLabels(labels, test.names)); diff != "" {
+				t.Errorf("diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
 type testAuthMan struct {
 	ctx             apigeeContext.Context
 	apiKey          string
@@ -1136,17 +1261,23 @@ func (p *testProductMan) Authorize(ac *auth.Context, api, path, method string) [
 
 type testQuotaMan struct {
 	exceeded  int64
+	used      int64
 	sendError error
+	applied   []string // operation IDs
+	args      []quota.Args
 }
 
 func (q *testQuotaMan) Start() {}
 func (q *testQuotaMan) Close() {}
 func (q *testQuotaMan) Apply(auth *auth.Context, p product.AuthorizedOperation, args quota.Args) (*quota.Result, error) {
+	q.applied = append(q.applied, p.ID)
+	q.args = append(q.args, args)
 	if q.sendError != nil {
 		return nil, q.sendError
 	}
 	return &quota.Result{
 		Exceeded: q.exceeded,
+		Used:     q.used,
 	}, nil
 }
 
@@ -1213,12 +1344,13 @@ func createAuthEnvSpec() config.EnvironmentSpec {
 					},
 				},
 				Cors: config.CorsPolicy{
-					AllowOrigins:     []string{"origin", "*"},
-					AllowHeaders:     []string{"AllowHeaders"},
-					AllowMethods:     []string{"AllowMethods"},
-					ExposeHeaders:    []string{"ExposeHeaders"},
-					MaxAge:           42,
-					AllowCredentials: true,
+					AllowOrigins:        []string{"origin", "*"},
+					AllowHeaders:        []string{"AllowHeaders"},
+					AllowMethods:        []string{"AllowMethods"},
+					ExposeHeaders:       []string{"ExposeHeaders"},
+					MaxAge:              42,
+					AllowCredentials:    true,
+					AllowPrivateNetwork: true,
 				},
 			},
 			{
@@ -0,0 +1,95 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	gocontext "context"
+	"fmt"
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	authv2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// authorizationServerV2 adapts ext_authz v2 Check requests of older Envoy
+// and Istio control planes to the v3 AuthorizationServer. The v2 and v3
+// messages share field numbers, so they are converted through the wire
+// format. Fields only in v3 responses, such as the dynamic metadata, the
+// headers to remove, and the response headers to add, are dropped; enable
+// auth.append_metadata_headers for the access logs of v2 clients. As v2
+// can't remove headers, requests with headers the response would remove,
+// such as client-sent metadata headers or headers the environment spec
+// transforms remove, are denied.
+type authorizationServerV2 struct {
+	v3 *AuthorizationServer
+}
+
+// extAuthzV2Key marks the context of v2 Check requests
+type extAuthzV2Key struct{}
+
+// Check converts the request to v3, checks it, and converts the response to v2
+func (a *authorizationServerV2) Check(ctx gocontext.Context, req *authv2.CheckRequest) (*authv2.CheckResponse, error) {
+	v3Req := &authv3.CheckRequest{}
+	if err := convertProto(req, v3Req); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "unable to convert v2 check request: %v", err)
+	}
+	v3Resp, err := a.v3.Check(gocontext.WithValue(ctx, extAuthzV2Key{}, true), v3Req)
+	if err != nil {
+		return nil, err
+	}
+	if v3Resp.GetDynamicMetadata() != nil || len(v3Resp.GetOkResponse().GetHeadersToRemove()) > 0 ||
+		len(v3Resp.GetOkResponse().GetResponseHeadersToAdd()) > 0 {
+		log.Debugf("v3 only check response fields dropped for v2 request")
+	}
+	v2Resp := &authv2.CheckResponse{}
+	if err := convertProto(v3Resp, v2Resp); err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to convert v2 check response: %v", err)
+	}
+	return v2Resp, nil
+}
+
+// checkV2HeaderRemovals fails v2 requests with headers the response must
+// remove. Otherwise they would reach the target and the access logs, such as
+// a forged compressed metadata header preferred over the adapter's own.
+func checkV2HeaderRemovals(ctx gocontext.Context, c *CheckContext) *authv3.CheckResponse {
+	if ctx.Value(extAuthzV2Key{}) == nil {
+		return nil
+	}
+	headers := c.Request.GetAttributes().GetRequest().GetHttp().GetHeaders()
+	var present []string
+	for _, name := range c.okResponse.GetHeadersToRemove() {
+		if _, ok := headers[strings.ToLower(name)]; ok {
+			present = append(present, name)
+		}
+	}
+	if len(present) == 0 {
+		return nil
+	}
+	return c.InternalError(fmt.Errorf("ext_authz v2 can't remove headers %v of api %s", present, c.API))
+}
+
+// convertProto copies the fields of from to the fields of the same numbers
+// of to, discarding fields to doesn't have
+func convertProto(from, to proto.Message) error {
+	b, err := proto.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return proto.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(b, to)
+}
@@ -0,0 +1,204 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
+	authv2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	"github.com/gogo/googleapis/google/rpc"
+)
+
+func TestCheckV2(t *testing.T) {
+	headers := map[string]string{headerAPI: "api", "x-api-key": "foo"}
+	v3Req := testutil.NewEnvoyRequest(http.MethodGet, "/path", headers, nil)
+	req := &authv2.CheckRequest{}
+	if err := convertProto(v3Req, req); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.GetAttributes().GetRequest().GetHttp().GetHeaders()[headerAPI]; got != "api" {
+		t.Fatalf("v2 request header %s got: %q, want: %q", headerAPI, got, "api")
+	}
+
+	testAuthMan := &testAuthMan{}
+	testProductMan := &testProductMan{
+		api:     "api",
+		resolve: true,
+		products: product.ProductsNameMap{
+			"product1": &product.APIProduct{DisplayName: "product1"},
+		},
+	}
+	v3 := &AuthorizationServer{
+		handler: &Handler{
+			apiKeyClaim:           headerClientID,
+			apiHeader:             headerAPI,
+			apiKeyHeader:          "x-api-key",
+			authMan:               testAuthMan,
+			productMan:            testProductMan,
+			quotaMan:              &testQuotaMan{},
+			analyticsMan:          &testAnalyticsMan{},
+			appendMetadataHeaders: true,
+			ready:                 util.NewAtomicBool(true),
+		},
+	}
+	server := &authorizationServerV2{v3}
+
+	// denied
+	testAuthMan.sendAuth(nil, auth.ErrNoAuth)
+	resp, err := server.Check(context.Background(), req)
+	if err != nil {
+		t.Fatalf("should not get error. got: %s", err)
+	}
+	if resp.GetStatus().GetCode() != int32(rpc.UNAUTHENTICATED) {
+		t.Errorf("got: %d, want: %d", resp.GetStatus().GetCode(), int32(rpc.UNAUTHENTICATED))
+	}
+	if code := resp.GetDeniedResponse().GetStatus().GetCode(); code != http.StatusUnauthorized {
+		t.Errorf("denied status got: %d, want: %d", code, http.StatusUnauthorized)
+	}
+
+	// allowed
+	testAuthMan.sendAuth(&auth.Context{APIProducts: []string{"product1"}}, nil)
+	if resp, err = server.Check(context.Background(), req); err != nil {
+		t.Fatalf("should not get error. got: %s", err)
+	}
+	if resp.GetStatus().GetCode() != int32(rpc.OK) {
+		t.Errorf("got: %d, want: %d", resp.GetStatus().GetCode(), int32(rpc.OK))
+	}
+	added := map[string]string{}
+	for _, h := range resp.GetOkResponse().GetHeaders() {
+		added[h.GetHeader().GetKey()] = h.GetHeader().GetValue()
+	}
+	if added[headerAPI] != "api" {
+		t.Errorf("ok response should add metadata headers, got: %v", added)
+	}
+}
+
+func TestCheckV2HeaderRemoval(t *testing.T) {
+	envSpec := createAuthEnvSpec()
+	envSpec.APIs[0].AuthExclusions = []config.HTTPMatch{{PathTemplate: "/healthz"}}
+	envSpecs := []config.EnvironmentSpec{envSpec}
+	if err := config.ValidateEnvironmentSpecs(envSpecs); err != nil {
+		t.Fatal(err)
+	}
+	specExt, err := config.NewEnvironmentSpecExt(&envSpecs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	v3 := &AuthorizationServer{
+		handler: &Handler{
+			authMan:      &testAuthMan{},
+			productMan:   &testProductMan{resolve: true},
+			quotaMan:     &testQuotaMan{},
+			analyticsMan: &testAnalyticsMan{},
+			envSpecsByID: map[string]*config.EnvironmentSpecExt{specExt.ID: specExt},
+			ready:        util.NewAtomicBool(true),
+		},
+	}
+	server := &authorizationServerV2{v3}
+
+	v3Req := testutil.NewEnvoyRequest(http.MethodGet, "/v1/healthz", map[string]string{"jwt": "token"}, nil)
+	v3Req.Attributes.ContextExtensions = map[string]string{envSpecContextKey: specExt.ID}
+	v3Resp, err := v3.Check(context.Background(), v3Req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v3Resp.GetOkResponse().GetHeadersToRemove()) == 0 {
+		t.Fatalf("want v3 response to remove headers, got: %v", v3Resp)
+	}
+
+	req := &authv2.CheckRequest{}
+	if err := convertProto(v3Req, req); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := server.Check(context.Background(), req)
+	if err != nil {
+		t.Fatalf("should not get error. got: %s", err)
+	}
+	if resp.GetStatus().GetCode() != int32(rpc.INTERNAL) {
+		t.Errorf("got: %d, want: %d", resp.GetStatus().GetCode(), int32(rpc.INTERNAL))
+	}
+	if code := resp.GetDeniedResponse().GetStatus().GetCode(); code != http.StatusInternalServerError {
+		t.Errorf("denied status got: %d, want: %d", code, http.StatusInternalServerError)
+	}
+}
+
+func TestCheckV2SpoofedMetadataHeader(t *testing.T) {
+	spoofed, err := compressHeaderValue("forged-product")
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := map[string]string{
+		headerAPI:   "api",
+		"x-api-key": "foo",
+		compressedHeaderName(headerAPIProducts, 0): spoofed,
+	}
+	v3Req := testutil.NewEnvoyRequest(http.MethodGet, "/path", headers, nil)
+	req := &authv2.CheckRequest{}
+	if err := convertProto(v3Req, req); err != nil {
+		t.Fatal(err)
+	}
+
+	testAuthMan := &testAuthMan{}
+	v3 := &AuthorizationServer{
+		handler: &Handler{
+			apiKeyClaim:  headerClientID,
+			apiHeader:    headerAPI,
+			apiKeyHeader: "x-api-key",
+			authMan:      testAuthMan,
+			productMan: &testProductMan{
+				api:     "api",
+				resolve: true,
+				products: product.ProductsNameMap{
+					"product1": &product.APIProduct{DisplayName: "product1"},
+				},
+			},
+			quotaMan:              &testQuotaMan{},
+			analyticsMan:          &testAnalyticsMan{},
+			appendMetadataHeaders: true,
+			ready:                 util.NewAtomicBool(true),
+		},
+	}
+	server := &authorizationServerV2{v3}
+
+	// v3 removes the spoofed header
+	testAuthMan.sendAuth(&auth.Context{APIProducts: []string{"product1"}}, nil)
+	v3Resp, err := v3.Check(context.Background(), v3Req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v3Resp.GetStatus().GetCode() != int32(rpc.OK) {
+		t.Fatalf("v3 got: %d, want: %d", v3Resp.GetStatus().GetCode(), int32(rpc.OK))
+	}
+
+	// v2 can't, so fails
+	testAuthMan.sendAuth(&auth.Context{APIProducts: []string{"product1"}}, nil)
+	resp, err := server.Check(context.Background(), req)
+	if err != nil {
+		t.Fatalf("should not get error. got: %s", err)
+	}
+	if resp.GetStatus().GetCode() != int32(rpc.INTERNAL) {
+		t.Errorf("got: %d, want: %d", resp.GetStatus().GetCode(), int32(rpc.INTERNAL))
+	}
+	if len(resp.GetOkResponse().GetHeaders()) > 0 {
+		t.Errorf("want no forwarded headers, got: %v", resp.GetOkResponse().GetHeaders())
+	}
+}
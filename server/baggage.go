@@ -0,0 +1,102 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+)
+
+const (
+	headerBaggage = "baggage"
+
+	// baggageKeyPrefix prefixes the keys of the baggage members added
+	baggageKeyPrefix = "apigee."
+)
+
+// upstreamBaggage is the auth.baggage config, adding the fields of allowed
+// requests to the W3C baggage sent upstream
+type upstreamBaggage struct {
+	fields []string
+}
+
+// newUpstreamBaggage returns nil if no fields are added
+func newUpstreamBaggage(fields []string) *upstreamBaggage {
+	if len(fields) == 0 {
+		return nil
+	}
+	return &upstreamBaggage{fields: fields}
+}
+
+// apply replaces the apigee.* members of the incoming baggage of the
+// request with the fields
+func (b *upstreamBaggage) apply(okResponse *authv3.OkHttpResponse, incoming, api string,
+	envRequest *config.EnvironmentSpecRequest, authContext *auth.Context) {
+	if b == nil {
+		return
+	}
+	var members []string
+	changed := false
+	for _, member := range strings.Split(incoming, ",") {
+		member = strings.TrimSpace(member)
+		if strings.HasPrefix(member, baggageKeyPrefix) {
+			changed = true
+		} else if member != "" {
+			members = append(members, member)
+		}
+	}
+	for _, field := range b.fields {
+		if value := baggageFieldValue(field, api, envRequest, authContext); value != "" {
+			members = append(members, baggageKeyPrefix+field+"="+url.PathEscape(value))
+			changed = true
+		}
+	}
+	switch {
+	case !changed:
+	case len(members) == 0:
+		okResponse.HeadersToRemove = append(okResponse.HeadersToRemove, headerBaggage)
+	default:
+		addRequestHeader(okResponse, headerBaggage, strings.Join(members, ","), false)
+	}
+}
+
+// baggageFieldValue returns the value of the auth.baggage field
+func baggageFieldValue(field, api string, envRequest *config.EnvironmentSpecRequest, authContext *auth.Context) string {
+	switch field {
+	case config.BaggageFieldAPI:
+		return api
+	case config.BaggageFieldOperation:
+		if envRequest != nil && envRequest.GetOperation() != nil {
+			return envRequest.GetOperation().Name
+		}
+		return ""
+	}
+	if authContext == nil {
+		return ""
+	}
+	switch field {
+	case config.ConsumerFieldApplication:
+		return authContext.Application
+	case config.ConsumerFieldClientID:
+		return authContext.ClientID
+	case config.ConsumerFieldAPIProducts:
+		return strings.Join(authContext.APIProducts, ",")
+	}
+	return ""
+}
@@ -0,0 +1,81 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+)
+
+func TestUpstreamBaggage(t *testing.T) {
+	specExt, err := config.NewEnvironmentSpecExt(&config.EnvironmentSpec{
+		ID: "spec",
+		APIs: []config.APISpec{{
+			ID:         "api",
+			BasePath:   "/v1",
+			Operations: []config.APIOperation{{Name: "op", HTTPMatches: []config.HTTPMatch{{PathTemplate: "/pets"}}}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envRequest := config.NewEnvironmentSpecRequest(nil, specExt, &authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{Request: &authv3.AttributeContext_Request{
+			Http: &authv3.AttributeContext_HttpRequest{Method: "GET", Path: "/v1/pets"},
+		}},
+	})
+	authContext := &auth.Context{Application: "my app", APIProducts: []string{"p1", "p2"}}
+	b := newUpstreamBaggage([]string{config.BaggageFieldAPI, config.BaggageFieldOperation,
+		config.ConsumerFieldApplication, config.ConsumerFieldClientID, config.ConsumerFieldAPIProducts})
+
+	tests := []struct {
+		desc        string
+		baggage     *upstreamBaggage
+		incoming    string
+		authContext *auth.Context
+		want        string
+		wantRemove  []string
+	}{
+		{"disabled", nil, "k=v", authContext, "", nil},
+		{"added", b, "", authContext,
+			"apigee.api=api,apigee.operation=op,apigee.application=my%20app,apigee.api_products=p1%2Cp2", nil},
+		{"merged", b, "k=v;p, apigee.api=spoof", nil, "k=v;p,apigee.api=api,apigee.operation=op", nil},
+		{"removed", newUpstreamBaggage([]string{config.ConsumerFieldClientID}), "apigee.client_id=spoof", authContext,
+			"", []string{headerBaggage}},
+		{"unchanged", newUpstreamBaggage([]string{config.ConsumerFieldClientID}), "k=v", authContext, "", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			okResponse := &authv3.OkHttpResponse{}
+			test.baggage.apply(okResponse, test.incoming, "api", envRequest, test.authContext)
+			var got string
+			for _, h := range okResponse.Headers {
+				if h.Header.Key == headerBaggage {
+					got = h.Header.Value
+				}
+			}
+			if got != test.want {
+				t.Errorf("want baggage %q, got %q", test.want, got)
+			}
+			if !reflect.DeepEqual(okResponse.HeadersToRemove, test.wantRemove) {
+				t.Errorf("want removed %v, got %v", test.wantRemove, okResponse.HeadersToRemove)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	headerBotRule = "x-apigee-bot-rule"
+
+	ipReputationResultOK     = "ok"
+	ipReputationResultFailed = "failed"
+)
+
+// ipReputationList periodically loads the bot_detection IP reputation list
+// from a file or URL. A failed refresh keeps the previous list.
+type ipReputationList struct {
+	client   *http.Client
+	file     string
+	url      string
+	interval time.Duration
+	org      string
+	done     chan struct{}
+
+	mu   sync.RWMutex
+	ips  map[string]bool
+	nets []*net.IPNet
+}
+
+// newIPReputationList creates an ipReputationList.
+// Returns nil if no list is configured.
+func newIPReputationList(client *http.Client, cfg config.BotDetection, org string) *ipReputationList {
+	if cfg.IPReputationFile == "" && cfg.IPReputationURL == "" {
+		return nil
+	}
+	return &ipReputationList{
+		client:   client,
+		file:     cfg.IPReputationFile,
+		url:      cfg.IPReputationURL,
+		interval: cfg.RefreshRate,
+		org:      org,
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *ipReputationList) start() {
+	go func() {
+		l.refresh()
+		t := time.NewTicker(l.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				l.refresh()
+			case <-l.done:
+				return
+			}
+		}
+	}()
+}
+
+func (l *ipReputationList) stop() {
+	if l != nil {
+		close(l.done)
+	}
+}
+
+// IsListed implements config.IPReputation
+func (l *ipReputationList) IsListed(ip string) bool {
+	if l == nil {
+		return false
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.ips[parsed.String()] {
+		return true
+	}
+	for _, n := range l.nets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// refresh reloads the list, keeping the previous list on failure
+func (l *ipReputationList) refresh() {
+	ips, nets, err := l.load()
+	if err != nil {
+		log.Warnf("unable to refresh IP reputation list: %v", err)
+		prometheusIPReputationRefreshes.WithLabelValues(l.org, ipReputationResultFailed).Inc()
+		return
+	}
+	l.mu.Lock()
+	l.ips = ips
+	l.nets = nets
+	l.mu.Unlock()
+	prometheusIPReputationRefreshes.WithLabelValues(l.org, ipReputationResultOK).Inc()
+	log.Debugf("refreshed IP reputation list: %d addresses, %d networks", len(ips), len(nets))
+}
+
+func (l *ipReputationList) load() (map[string]bool, []*net.IPNet, error) {
+	if l.file != "" {
+		f, err := os.Open(l.file)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer f.Close()
+		return parseIPReputationList(f)
+	}
+
+	resp, err := l.client.Get(l.url)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("IP reputation list status: %d", resp.StatusCode)
+	}
+	return parseIPReputationList(resp.Body)
+}
+
+// parseIPReputationList reads an IP address or CIDR per line,
+// blank lines and "#" comments are ignored
+func parseIPReputationList(r io.Reader) (map[string]bool, []*net.IPNet, error) {
+	ips := make(map[string]bool)
+	var nets []*net.IPNet
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		entry := scanner.Text()
+		if i := strings.Index(entry, "#"); i >= 0 {
+			entry = entry[:i]
+		}
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			_, n, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, nil, fmt.Errorf("line %d: invalid CIDR %q", line, entry)
+			}
+			nets = append(nets, n)
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, nil, fmt.Errorf("line %d: invalid IP %q", line, entry)
+		}
+		ips[ip.String()] = true
+	}
+	return ips, nets, scanner.Err()
+}
+
+// checkBotRules tags or denies the request if it matches a bot rule of its
+// API or operation. The bot rule header sent by clients is removed otherwise.
+func checkBotRules(c *CheckContext) *authv3.CheckResponse {
+	rule := c.EnvRequest.MatchBotRule()
+	if rule == nil {
+		c.okResponse.HeadersToRemove = append(c.okResponse.HeadersToRemove, headerBotRule)
+		return nil
+	}
+	action := rule.Action
+	if action == "" {
+		action = config.BotActionTag
+	}
+	spec, api := c.server.handler.metricScope(c.EnvRequest, c.API)
+	prometheusBotRuleMatches.WithLabelValues(c.rootContext.Organization(), c.rootContext.Environment(),
+		spec, api, rule.Name, action).Inc()
+	if action == config.BotActionDeny {
+		log.Debugf("bot rule %q denied request", rule.Name)
+		return c.Denied()
+	}
+	c.AddRequestHeader(headerBotRule, rule.Name, false)
+	return nil
+}
+
+var (
+	prometheusIPReputationRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "bot_detection",
+		Name:      "ip_reputation_refresh_count",
+		Help:      "Total number of IP reputation list refreshes by result",
+	}, []string{"org", "result"})
+
+	prometheusBotRuleMatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "bot_rule_match_count",
+		Help:      "Total number of requests matching a bot rule by action",
+	}, []string{"org", "env", "spec", "api", "rule", "action"})
+)
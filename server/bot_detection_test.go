@@ -0,0 +1,211 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
+	"github.com/gogo/googleapis/google/rpc"
+	prometheustest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testIPReputationList = `
+# known bots
+192.0.2.1
+2001:db8::1   # v6
+198.51.100.0/24
+`
+
+func TestParseIPReputationList(t *testing.T) {
+	ips, nets, err := parseIPReputationList(strings.NewReader(testIPReputationList))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips) != 2 || len(nets) != 1 {
+		t.Errorf("want 2 addresses and 1 network, got: %v, %v", ips, nets)
+	}
+
+	for _, bad := range []string{"192.0.2", "198.51.100.0/33"} {
+		if _, _, err := parseIPReputationList(strings.NewReader(bad)); err == nil {
+			t.Errorf("want error for %q", bad)
+		}
+	}
+}
+
+func TestIPReputationList(t *testing.T) {
+	if l := newIPReputationList(http.DefaultClient, config.BotDetection{}, "org"); l != nil {
+		t.Errorf("want nil list if not configured")
+	}
+	var nilList *ipReputationList
+	if nilList.IsListed("192.0.2.1") {
+		t.Errorf("nil list should not list")
+	}
+	nilList.stop()
+
+	fail := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(testIPReputationList))
+	}))
+	defer ts.Close()
+
+	file := filepath.Join(t.TempDir(), "bots.txt")
+	if err := os.WriteFile(file, []byte(testIPReputationList), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cfg := range []config.BotDetection{
+		{IPReputationURL: ts.URL, RefreshRate: time.Minute},
+		{IPReputationFile: file, RefreshRate: time.Minute},
+	} {
+		l := newIPReputationList(ts.Client(), cfg, "org")
+		if l.IsListed("192.0.2.1") {
+			t.Errorf("should not list before refresh")
+		}
+		l.refresh()
+
+		tests := map[string]bool{
+			"192.0.2.1":      true,
+			"2001:db8::1":    true,
+			"198.51.100.200": true,
+			"192.0.2.2":      false,
+			"not an ip":      false,
+		}
+		for ip, want := range tests {
+			if got := l.IsListed(ip); got != want {
+				t.Errorf("%s want: %t, got: %t", ip, want, got)
+			}
+		}
+	}
+
+	// failed refresh keeps previous list
+	l := newIPReputationList(ts.Client(), config.BotDetection{IPReputationURL: ts.URL, RefreshRate: time.Minute}, "org")
+	l.refresh()
+	fail = true
+	l.refresh()
+	if !l.IsListed("192.0.2.1") {
+		t.Errorf("failed refresh should keep previous list")
+	}
+}
+
+func TestCheckBotRules(t *testing.T) {
+	envSpec := config.EnvironmentSpec{
+		ID: "spec",
+		APIs: []config.APISpec{{
+			ID:       "api",
+			BasePath: "/v1",
+			BotRules: []config.BotRule{
+				{Name: "crawler", UserAgents: []string{"bot"}},
+				{Name: "headless", MissingHeaders: []string{"accept-language"}, Action: config.BotActionDeny},
+			},
+		}},
+	}
+	if err := config.ValidateEnvironmentSpecs([]config.EnvironmentSpec{envSpec}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	specExt, err := config.NewEnvironmentSpecExt(&envSpec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	testAnalyticsMan := &testAnalyticsMan{}
+	server := AuthorizationServer{
+		handler: &Handler{
+			authMan:      &testAuthMan{},
+			productMan:   &testProductMan{resolve: true},
+			quotaMan:     &testQuotaMan{},
+			analyticsMan: testAnalyticsMan,
+			envSpecsByID: map[string]*config.EnvironmentSpecExt{specExt.ID: specExt},
+			metricAPIs:   newMetricAllowlist([]string{"other-api"}),
+			ready:        util.NewAtomicBool(true),
+		},
+	}
+	matches := prometheusBotRuleMatches.WithLabelValues("", "", "", metricScopeOther, "crawler", config.BotActionTag)
+	matched := prometheustest.ToFloat64(matches)
+
+	tests := []struct {
+		desc       string
+		headers    map[string]string
+		wantCode   rpc.Code
+		wantHeader string
+	}{
+		{"no match", map[string]string{"user-agent": "curl", "accept-language": "en", headerBotRule: "spoofed"}, rpc.OK, ""},
+		{"tag", map[string]string{"user-agent": "somebot", "accept-language": "en"}, rpc.OK, "crawler"},
+		{"deny", map[string]string{"user-agent": "curl"}, rpc.PERMISSION_DENIED, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			testAnalyticsMan.records = nil
+			req := testutil.NewEnvoyRequest(http.MethodGet, "/v1/petstore", test.headers, nil)
+			req.Attributes.ContextExtensions = map[string]string{envSpecContextKey: specExt.ID}
+			resp, err := server.Check(context.Background(), req)
+			if err != nil {
+				t.Fatalf("should not get error. got: %s", err)
+			}
+			if resp.Status.Code != int32(test.wantCode) {
+				t.Fatalf("want: %d, got: %d", test.wantCode, resp.Status.Code)
+			}
+			if test.wantCode != rpc.OK {
+				if len(testAnalyticsMan.records) != 1 {
+					t.Fatalf("want 1 analytics record, got: %d", len(testAnalyticsMan.records))
+				}
+				attrs := testAnalyticsMan.records[0].Attributes
+				if len(attrs) != 2 || attrs[0].Name != botRuleAttribute || attrs[0].Value != "headless" ||
+					attrs[1].Name != proxyBasepathAttribute {
+					t.Errorf("want bot rule and proxy base path attributes, got: %v", attrs)
+				}
+				return
+			}
+			var got string
+			for _, h := range resp.GetOkResponse().GetHeaders() {
+				if h.Header.Key == headerBotRule {
+					got = h.Header.Value
+				}
+			}
+			if got != test.wantHeader {
+				t.Errorf("want header %q, got: %q", test.wantHeader, got)
+			}
+			removed := false
+			for _, h := range resp.GetOkResponse().GetHeadersToRemove() {
+				removed = removed || h == headerBotRule
+			}
+			if removed != (test.wantHeader == "") {
+				t.Errorf("want header %s removed %t, got: %t", headerBotRule, test.wantHeader == "", removed)
+			}
+			rule := decodeBotRuleMetadata(resp.GetDynamicMetadata().GetFields())
+			if rule != test.wantHeader {
+				t.Errorf("want metadata %q, got: %q", test.wantHeader, rule)
+			}
+		})
+	}
+
+	// the api label is bounded by the metric allowlist
+	if got := prometheustest.ToFloat64(matches) - matched; got != 1 {
+		t.Errorf("want 1 crawler match of api %q, got: %v", metricScopeOther, got)
+	}
+}
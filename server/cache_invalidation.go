@@ -0,0 +1,450 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth/jwt"
+	"github.com/apigee/apigee-remote-service-golib/v2/context"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// kinds of cache entries invalidated, as in the invalidation request
+const (
+	cacheKindAPIKey  = "api_key"
+	cacheKindJWKS    = "jwks"
+	cacheKindProduct = "product"
+)
+
+// CacheInvalidation is the request of the cache invalidation endpoint. Each
+// entry set is invalidated.
+type CacheInvalidation struct {
+	// APIKey is verified again on its next use, in the clear even if keys are
+	// hashed. With a verification store, by each replica sharing the store.
+	APIKey string `json:"api_key,omitempty"`
+	// JWKS is the issuer of JWTAuthentications, or the URL of a JWKS or OIDC
+	// discovery source, whose keys are fetched again.
+	JWKS string `json:"jwks,omitempty"`
+	// Product is fetched again with the other API products, which Apigee
+	// returns together.
+	Product string `json:"product,omitempty"`
+}
+
+// cacheInvalidator invalidates the entries of the verification and product
+// caches on demand so, eg., a key revoked in Apigee is refused immediately
+// instead of after the cache durations.
+type cacheInvalidator struct {
+	authMan       *remoteServiceAuthManager
+	keyManagers   *reloadableAuthManager // verifies the JWTs of Apigee-fetched JWKS
+	products      *reloadableProductManager
+	oidcDiscovery *oidcDiscoveryManager // nil if none
+	remoteJWKS    *remoteJWKSManager    // nil if none
+	jwksURLs      map[string]bool       // fetched by keyManagers
+	jwksIssuers   map[string][]string   // issuer -> JWKS URLs
+	org           string
+}
+
+// invalidateAPIKey has the key verified again on its next use
+func (c *cacheInvalidator) invalidateAPIKey(apiKey string) error {
+	return c.authMan.invalidateAPIKey(apiKey)
+}
+
+// invalidateJWKS fetches the keys of an issuer or source URL again. False
+// if no source matches.
+func (c *cacheInvalidator) invalidateJWKS(issuerOrURL string) (bool, error) {
+	urls := c.jwksIssuers[issuerOrURL]
+	if urls == nil {
+		urls = []string{issuerOrURL}
+	}
+	found, reload := false, false
+	for _, u := range urls {
+		if c.jwksURLs[u] {
+			found, reload = true, true
+			continue
+		}
+		refreshed, err := c.remoteJWKS.refresh(u)
+		if err != nil {
+			return true, err
+		}
+		found = found || refreshed
+	}
+	if c.oidcDiscovery.refreshMatching(issuerOrURL) {
+		found = true
+	}
+	if reload {
+		// the auth.Manager caches JWTs verified with the keys as well
+		if err := c.keyManagers.reload(); err != nil {
+			return true, err
+		}
+	}
+	return found, nil
+}
+
+// invalidateProduct fetches the API products again. False if the product
+// isn't found after.
+func (c *cacheInvalidator) invalidateProduct(name string) (bool, error) {
+	if err := c.products.reload(); err != nil {
+		return false, err
+	}
+	_, ok := c.products.Products()[name]
+	return ok, nil
+}
+
+// CacheInvalidationHandlerFunc invalidates the cache entries of a POSTed
+// CacheInvalidation
+func (h *Handler) CacheInvalidationHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respond := func(status int, body interface{}) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			if err := json.NewEncoder(w).Encode(body); err != nil {
+				log.Warnf("cache invalidation unable to respond: %s", err)
+			}
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		c := h.caches
+		if c == nil {
+			respond(http.StatusNotFound, map[string]string{"error": "cache invalidation not available"})
+			return
+		}
+		var req CacheInvalidation
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respond(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if req.APIKey == "" && req.JWKS == "" && req.Product == "" {
+			respond(http.StatusBadRequest, map[string]string{"error": "api_key, jwks, or product is required"})
+			return
+		}
+
+		invalidated := map[string]bool{}
+		record := func(kind string, found bool, err error) bool {
+			if err != nil {
+				log.Warnf("unable to invalidate %s cache: %v", kind, err)
+				prometheusCacheInvalidations.WithLabelValues(c.org, kind, cacheInvalidationResultFailed).Inc()
+				status := http.StatusBadGateway
+				if err == errTooManyInvalidatedAPIKeys {
+					status = http.StatusTooManyRequests
+				}
+				respond(status, map[string]string{"error": fmt.Sprintf("%s: %v", kind, err)})
+				return false
+			}
+			result := cacheInvalidationResultInvalidated
+			if !found {
+				result = cacheInvalidationResultNotFound
+			}
+			prometheusCacheInvalidations.WithLabelValues(c.org, kind, result).Inc()
+			invalidated[kind] = found
+			return true
+		}
+		if req.APIKey != "" && !record(cacheKindAPIKey, true, c.invalidateAPIKey(req.APIKey)) {
+			return
+		}
+		if req.JWKS != "" {
+			found, err := c.invalidateJWKS(req.JWKS)
+			if !record(cacheKindJWKS, found, err) {
+				return
+			}
+		}
+		if req.Product != "" {
+			found, err := c.invalidateProduct(req.Product)
+			if !record(cacheKindProduct, found, err) {
+				return
+			}
+		}
+		respond(http.StatusOK, map[string]interface{}{"invalidated": invalidated})
+	}
+}
+
+// reloadableAuthManager is an auth.Manager that may be replaced by a new one
+// to drop its caches
+type reloadableAuthManager struct {
+	newManager func() (auth.Manager, error)
+
+	mu      sync.RWMutex
+	current auth.Manager
+}
+
+func newReloadableAuthManager(newManager func() (auth.Manager, error)) (*reloadableAuthManager, error) {
+	m, err := newManager()
+	if err != nil {
+		return nil, err
+	}
+	return &reloadableAuthManager{newManager: newManager, current: m}, nil
+}
+
+func (r *reloadableAuthManager) manager() auth.Manager {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current
+}
+
+// reload replaces the manager, closing the previous one
+func (r *reloadableAuthManager) reload() error {
+	m, err := r.newManager()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	previous := r.current
+	r.current = m
+	r.mu.Unlock()
+	previous.Close()
+	return nil
+}
+
+// Authenticate implements auth.Manager
+func (r *reloadableAuthManager) Authenticate(ctx context.Context, apiKey string,
+	claims map[string]interface{}, apiKeyClaimKey string) (*auth.Context, error) {
+	return r.manager().Authenticate(ctx, apiKey, claims, apiKeyClaimKey)
+}
+
+// ParseJWT implements auth.Manager
+func (r *reloadableAuthManager) ParseJWT(jwtString string, provider jwt.Provider) (map[string]interface{}, error) {
+	return r.manager().ParseJWT(jwtString, provider)
+}
+
+// Close implements auth.Manager
+func (r *reloadableAuthManager) Close() {
+	r.manager().Close()
+}
+
+// reloadableProductManager is a product.Manager that may be replaced by a
+// new one to fetch the products again
+type reloadableProductManager struct {
+	newManager func() (product.Manager, error)
+	timeout    time.Duration // of the first load of a new manager
+
+	mu      sync.RWMutex
+	current product.Manager
+}
+
+func newReloadableProductManager(newManager func() (product.Manager, error), timeout time.Duration) (*reloadableProductManager, error) {
+	m, err := newManager()
+	if err != nil {
+		return nil, err
+	}
+	return &reloadableProductManager{newManager: newManager, timeout: timeout, current: m}, nil
+}
+
+func (r *reloadableProductManager) manager() product.Manager {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current
+}
+
+// reload replaces the manager once the new one has loaded the products,
+// closing the previous one. Keeps the previous one if loading times out.
+func (r *reloadableProductManager) reload() error {
+	m, err := r.newManager()
+	if err != nil {
+		return err
+	}
+	loaded := make(chan struct{})
+	go func() {
+		_ = m.Products() // blocks until loaded
+		close(loaded)
+	}()
+	select {
+	case <-loaded:
+	case <-time.After(r.timeout):
+		go m.Close()
+		return fmt.Errorf("products not loaded within %s", r.timeout)
+	}
+	r.mu.Lock()
+	previous := r.current
+	r.current = m
+	r.mu.Unlock()
+	previous.Close()
+	return nil
+}
+
+// Products implements product.Manager
+func (r *reloadableProductManager) Products() product.ProductsNameMap {
+	return r.manager().Products()
+}
+
+// Authorize implements product.Manager
+func (r *reloadableProductManager) Authorize(authContext *auth.Context, api, path, method string) []product.AuthorizedOperation {
+	return r.manager().Authorize(authContext, api, path, method)
+}
+
+// Close implements product.Manager
+func (r *reloadableProductManager) Close() {
+	r.manager().Close()
+}
+
+// maxInvalidatedAPIKeys limits the API keys invalidated at once, each has an
+// auth.Manager of its own
+const maxInvalidatedAPIKeys = 100
+
+// errTooManyInvalidatedAPIKeys is returned for an invalidation beyond maxInvalidatedAPIKeys
+var errTooManyInvalidatedAPIKeys = fmt.Errorf("too many API keys invalidated, at most %d within the API key cache duration", maxInvalidatedAPIKeys)
+
+// invalidatedAPIKeys verifies each invalidated API key with an auth.Manager
+// of its own, without the entries cached before, until those have expired
+type invalidatedAPIKeys struct {
+	newManager func() (auth.Manager, error)
+	ttl        time.Duration // of the API key cache
+	now        func() time.Time
+
+	mu   sync.Mutex
+	keys map[string]*invalidatedAPIKey
+}
+
+type invalidatedAPIKey struct {
+	manager auth.Manager
+	since   time.Time
+	until   time.Time
+}
+
+func newInvalidatedAPIKeys(newManager func() (auth.Manager, error), ttl time.Duration) *invalidatedAPIKeys {
+	return &invalidatedAPIKeys{
+		newManager: newManager,
+		ttl:        ttl,
+		now:        time.Now,
+		keys:       make(map[string]*invalidatedAPIKey),
+	}
+}
+
+// add invalidates the key as of the time, unless it was invalidated since.
+// Fails if maxInvalidatedAPIKeys other keys are invalidated or k is nil.
+func (k *invalidatedAPIKeys) add(apiKey string, at time.Time) error {
+	if k == nil {
+		return fmt.Errorf("API keys can't be invalidated")
+	}
+	if !at.Add(k.ttl).After(k.now()) {
+		return nil // the entries cached before have expired
+	}
+	k.prune()
+	k.mu.Lock()
+	inv, ok := k.keys[apiKey]
+	k.mu.Unlock()
+	if ok && !inv.since.Before(at) {
+		return nil
+	}
+	m, err := k.newManager()
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	previous, ok := k.keys[apiKey]
+	if !ok && len(k.keys) >= maxInvalidatedAPIKeys {
+		k.mu.Unlock()
+		m.Close()
+		return errTooManyInvalidatedAPIKeys
+	}
+	k.keys[apiKey] = &invalidatedAPIKey{manager: m, since: at, until: at.Add(k.ttl)}
+	k.mu.Unlock()
+	if previous != nil {
+		previous.manager.Close()
+	}
+	return nil
+}
+
+// manager returns the auth.Manager verifying the key, nil if the key isn't
+// invalidated or k is nil
+func (k *invalidatedAPIKeys) manager(apiKey string) auth.Manager {
+	if k == nil {
+		return nil
+	}
+	k.prune()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if inv, ok := k.keys[apiKey]; ok {
+		return inv.manager
+	}
+	return nil
+}
+
+// prune closes the managers of expired invalidations
+func (k *invalidatedAPIKeys) prune() {
+	now := k.now()
+	var expired []auth.Manager
+	k.mu.Lock()
+	for key, inv := range k.keys {
+		if !now.Before(inv.until) {
+			expired = append(expired, inv.manager)
+			delete(k.keys, key)
+		}
+	}
+	k.mu.Unlock()
+	for _, e := range expired {
+		e.Close()
+	}
+}
+
+func (k *invalidatedAPIKeys) close() {
+	if k == nil {
+		return
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for key, inv := range k.keys {
+		inv.manager.Close()
+		delete(k.keys, key)
+	}
+}
+
+// invalidateAPIKey has the key verified again on its next use by any replica
+// sharing the store, replacing its stored verification with the time of the
+// invalidation. Fails if keys can't be invalidated.
+func (m *remoteServiceAuthManager) invalidateAPIKey(apiKey string) error {
+	if m.hashAPIKey != nil {
+		apiKey = m.hashAPIKey(apiKey)
+	}
+	if m.invalidated == nil {
+		return fmt.Errorf("API keys can't be invalidated")
+	}
+	now := m.invalidated.now()
+	if err := m.invalidated.add(apiKey, now); err != nil {
+		return err
+	}
+	if m.store != nil {
+		value, _ := json.Marshal(storedAuthContext{Invalidated: now})
+		if err := m.store.set(verificationStoreKey(verificationKindAPIKey, apiKey), value, m.apiKeyStoreTTL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cache invalidation results of the cache_invalidation_count metric
+const (
+	cacheInvalidationResultInvalidated = "invalidated"
+	cacheInvalidationResultNotFound    = "not_found"
+	cacheInvalidationResultFailed      = "failed"
+)
+
+var (
+	prometheusCacheInvalidations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "cache_invalidation_count",
+		Help:      "Total number of cache invalidations by kind and result",
+	}, []string{"org", "kind", "result"})
+)
@@ -0,0 +1,347 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	"github.com/google/go-cmp/cmp"
+)
+
+// closableAuthMan is a countingAuthMan recording whether it's closed
+type closableAuthMan struct {
+	countingAuthMan
+	closed bool
+}
+
+func (m *closableAuthMan) Close() {
+	m.closed = true
+}
+
+// blockingProductMan loads its products once loaded is closed
+type blockingProductMan struct {
+	testProductMan
+	loaded chan struct{}
+	closed chan struct{}
+}
+
+func (p *blockingProductMan) Products() product.ProductsNameMap {
+	<-p.loaded
+	return p.testProductMan.Products()
+}
+
+func (p *blockingProductMan) Close() {
+	close(p.closed)
+}
+
+func TestReloadableAuthManager(t *testing.T) {
+	var created []*closableAuthMan
+	r, err := newReloadableAuthManager(func() (auth.Manager, error) {
+		m := &closableAuthMan{}
+		created = append(created, m)
+		return m, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Authenticate(nil, "good", nil, "api_key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Authenticate(nil, "good", nil, "api_key"); err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 2 || !created[0].closed || created[1].closed {
+		t.Fatalf("want previous manager closed, got %d managers", len(created))
+	}
+	if created[0].calls != 1 || created[1].calls != 1 {
+		t.Errorf("want a verification by each manager, got %d, %d", created[0].calls, created[1].calls)
+	}
+	r.Close()
+	if !created[1].closed {
+		t.Errorf("want current manager closed")
+	}
+}
+
+func TestReloadableProductManager(t *testing.T) {
+	var created []*blockingProductMan
+	loaded := true
+	r, err := newReloadableProductManager(func() (product.Manager, error) {
+		m := &blockingProductMan{
+			testProductMan: testProductMan{products: product.ProductsNameMap{
+				"product": &product.APIProduct{Name: "product"},
+			}},
+			loaded: make(chan struct{}),
+			closed: make(chan struct{}),
+		}
+		if loaded {
+			close(m.loaded)
+		}
+		created = append(created, m)
+		return m, nil
+	}, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	<-created[0].closed
+	if r.manager() != created[1] {
+		t.Errorf("want new manager after reload")
+	}
+
+	// not loaded in time
+	loaded = false
+	if err := r.reload(); err == nil {
+		t.Errorf("want error if products not loaded")
+	}
+	<-created[2].closed
+	if r.manager() != created[1] {
+		t.Errorf("want previous manager kept")
+	}
+	if _, ok := r.Products()["product"]; !ok {
+		t.Errorf("want products of previous manager")
+	}
+}
+
+func TestInvalidatedAPIKeys(t *testing.T) {
+	var created []*closableAuthMan
+	k := newInvalidatedAPIKeys(func() (auth.Manager, error) {
+		m := &closableAuthMan{}
+		created = append(created, m)
+		return m, nil
+	}, time.Minute)
+	now := time.Unix(1000, 0)
+	k.now = func() time.Time { return now }
+
+	if m := k.manager("key"); m != nil {
+		t.Errorf("want no manager of a key not invalidated")
+	}
+	if err := k.add("key", now); err != nil {
+		t.Fatal(err)
+	}
+	if m := k.manager("key"); m != created[0] {
+		t.Errorf("want manager of invalidated key")
+	}
+
+	// invalidated again by another replica, before and after
+	if err := k.add("key", now.Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 1 {
+		t.Errorf("want earlier invalidation ignored")
+	}
+	now = now.Add(time.Second)
+	if err := k.add("key", now); err != nil {
+		t.Fatal(err)
+	}
+	if !created[0].closed || k.manager("key") != created[1] {
+		t.Errorf("want previous manager replaced")
+	}
+
+	// expired with the cache entries
+	now = now.Add(time.Minute)
+	if m := k.manager("key"); m != nil {
+		t.Errorf("want no manager after the cache duration")
+	}
+	if !created[1].closed {
+		t.Errorf("want expired manager closed")
+	}
+	if err := k.add("key", now.Add(-time.Minute)); err != nil || len(created) != 2 {
+		t.Errorf("want expired invalidation ignored, got: %v", err)
+	}
+
+	// bounded
+	for i := 0; i < maxInvalidatedAPIKeys; i++ {
+		if err := k.add(fmt.Sprintf("key-%d", i), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := k.add("key", now); err != errTooManyInvalidatedAPIKeys {
+		t.Errorf("want: %v, got: %v", errTooManyInvalidatedAPIKeys, err)
+	}
+	if !created[len(created)-1].closed {
+		t.Errorf("want manager beyond the limit closed")
+	}
+	if err := k.add("key-0", now.Add(time.Second)); err != nil {
+		t.Errorf("want invalidated key invalidated again, got: %v", err)
+	}
+	k.close()
+
+	var nilKeys *invalidatedAPIKeys
+	if m := nilKeys.manager("key"); m != nil {
+		t.Errorf("want no manager if nil")
+	}
+	if err := nilKeys.add("key", now); err == nil {
+		t.Errorf("want error if nil")
+	}
+	nilKeys.close()
+}
+
+func TestInvalidateAPIKey(t *testing.T) {
+	srv := newFakeRedis(t, "")
+	defer srv.close()
+	store := newTestVerificationStore(t, srv)
+	defer store.close()
+
+	replica := func() (*remoteServiceAuthManager, *countingAuthMan, *[]*closableAuthMan) {
+		counter := &countingAuthMan{}
+		fresh := &[]*closableAuthMan{}
+		return &remoteServiceAuthManager{
+			Manager: counter,
+			store:   store,
+			invalidated: newInvalidatedAPIKeys(func() (auth.Manager, error) {
+				m := &closableAuthMan{}
+				*fresh = append(*fresh, m)
+				return m, nil
+			}, time.Minute),
+			hashAPIKey:     func(key string) string { return key },
+			apiKeyStoreTTL: time.Minute,
+			org:            "org",
+		}, counter, fresh
+	}
+	m1, c1, fresh1 := replica()
+	m2, c2, fresh2 := replica()
+
+	if _, err := m1.Authenticate(nil, "good", nil, "api_key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m1.invalidateAPIKey("good"); err != nil {
+		t.Fatal(err)
+	}
+	srv.mu.Lock()
+	if len(srv.values) != 1 || srv.ttls["v:org:env:"+verificationStoreKey(verificationKindAPIKey, "good")] != 60000 {
+		t.Errorf("want invalidation stored for the cache duration, got: %v", srv.values)
+	}
+	srv.mu.Unlock()
+
+	// both replicas verify the key with managers of their own
+	for _, m := range []*remoteServiceAuthManager{m1, m2, m1, m2} {
+		if _, err := m.Authenticate(nil, "", map[string]interface{}{"api_key": "good"}, "api_key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c1.calls != 1 || c2.calls != 0 {
+		t.Errorf("want no verification by the previous managers, got: %d, %d", c1.calls, c2.calls)
+	}
+	if len(*fresh1) != 1 || (*fresh1)[0].calls != 2 || len(*fresh2) != 1 || (*fresh2)[0].calls != 2 {
+		t.Errorf("want invalidated key verified by a manager of each replica")
+	}
+	srv.mu.Lock()
+	for _, v := range srv.values {
+		if !strings.Contains(v, `"invalidated"`) || strings.Contains(v, `"client_id":"client"`) {
+			t.Errorf("want invalidation kept, got: %v", v)
+		}
+	}
+	srv.mu.Unlock()
+
+	m1.invalidated.close()
+	m2.invalidated.close()
+	m1.invalidated = nil
+	if err := m1.invalidateAPIKey("good"); err == nil {
+		t.Errorf("want error without invalidations")
+	}
+}
+
+func TestCacheInvalidationHandlerFunc(t *testing.T) {
+	products, err := newReloadableProductManager(func() (product.Manager, error) {
+		return &testProductMan{products: product.ProductsNameMap{
+			"product": &product.APIProduct{Name: "product"},
+		}}, nil
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyManagers, err := newReloadableAuthManager(func() (auth.Manager, error) {
+		return &closableAuthMan{}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{caches: &cacheInvalidator{
+		authMan: &remoteServiceAuthManager{
+			Manager: keyManagers,
+			invalidated: newInvalidatedAPIKeys(func() (auth.Manager, error) {
+				return &closableAuthMan{}, nil
+			}, time.Minute),
+		},
+		keyManagers: keyManagers,
+		products:    products,
+		jwksURLs:    map[string]bool{"https://issuer/jwks": true},
+		jwksIssuers: map[string][]string{"https://issuer": {"https://issuer/jwks"}},
+		org:         "org",
+	}}
+
+	tests := []struct {
+		desc       string
+		method     string
+		body       string
+		wantStatus int
+		want       map[string]bool
+	}{
+		{"method not allowed", http.MethodGet, "", http.StatusMethodNotAllowed, nil},
+		{"bad json", http.MethodPost, "{", http.StatusBadRequest, nil},
+		{"nothing", http.MethodPost, "{}", http.StatusBadRequest, nil},
+		{"api key", http.MethodPost, `{"api_key": "key"}`, http.StatusOK, map[string]bool{cacheKindAPIKey: true}},
+		{"jwks by issuer", http.MethodPost, `{"jwks": "https://issuer"}`, http.StatusOK, map[string]bool{cacheKindJWKS: true}},
+		{"jwks by url", http.MethodPost, `{"jwks": "https://issuer/jwks"}`, http.StatusOK, map[string]bool{cacheKindJWKS: true}},
+		{"unknown jwks", http.MethodPost, `{"jwks": "https://other"}`, http.StatusOK, map[string]bool{cacheKindJWKS: false}},
+		{"product", http.MethodPost, `{"product": "product"}`, http.StatusOK, map[string]bool{cacheKindProduct: true}},
+		{"unknown product", http.MethodPost, `{"product": "other"}`, http.StatusOK, map[string]bool{cacheKindProduct: false}},
+		{"all", http.MethodPost, `{"api_key": "key", "jwks": "https://issuer", "product": "product"}`, http.StatusOK,
+			map[string]bool{cacheKindAPIKey: true, cacheKindJWKS: true, cacheKindProduct: true}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(test.method, "/caches/invalidate", strings.NewReader(test.body))
+			h.CacheInvalidationHandlerFunc()(w, r)
+			if w.Code != test.wantStatus {
+				t.Fatalf("want status %d, got %d: %s", test.wantStatus, w.Code, w.Body.String())
+			}
+			if test.want == nil {
+				return
+			}
+			var got struct {
+				Invalidated map[string]bool `json:"invalidated"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.want, got.Invalidated); diff != "" {
+				t.Errorf("diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	// unavailable
+	w := httptest.NewRecorder()
+	(&Handler{}).CacheInvalidationHandlerFunc()(w, httptest.NewRequest(http.MethodPost, "/caches/invalidate", strings.NewReader(`{"product": "product"}`)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("want not found without caches, got %d", w.Code)
+	}
+}
@@ -0,0 +1,567 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	gocontext "context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/util"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/context"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Built-in CheckStage names. The built-in stages always run in this
+// relative order, custom stages may be placed anywhere between them.
+const (
+	SpecMatchStage             = "spec_match"
+	AuthenticationStage        = "authentication"
+	ConsumerAuthorizationStage = "consumer_authorization"
+	QuotaStage                 = "quota"
+	TransformsStage            = "transforms"
+)
+
+// CheckStage is a step in the authorization decision pipeline of Check.
+type CheckStage interface {
+	// Name identifies the stage in the auth.check_stages config and metrics.
+	Name() string
+	// Check returns a response to end the pipeline or nil to continue to
+	// the next stage. The request is allowed if all stages continue.
+	Check(ctx gocontext.Context, c *CheckContext) *authv3.CheckResponse
+}
+
+// NewCheckStage returns a CheckStage that calls check.
+func NewCheckStage(name string, check func(ctx gocontext.Context, c *CheckContext) *authv3.CheckResponse) CheckStage {
+	return &funcCheckStage{name, check}
+}
+
+type funcCheckStage struct {
+	name  string
+	check func(ctx gocontext.Context, c *CheckContext) *authv3.CheckResponse
+}
+
+func (s *funcCheckStage) Name() string {
+	return s.name
+}
+
+func (s *funcCheckStage) Check(ctx gocontext.Context, c *CheckContext) *authv3.CheckResponse {
+	return s.check(ctx, c)
+}
+
+// CheckContext is the state of a request as it passes through the CheckStages.
+// Fields are populated by the built-in stages as they run.
+type CheckContext struct {
+	// Request is the Envoy request.
+	Request *authv3.CheckRequest
+	// EnvRequest is set by spec_match if an EnvironmentSpec applies to the request.
+	EnvRequest *config.EnvironmentSpecRequest
+	// API is set by spec_match.
+	API string
+	// AuthContext is set by consumer_authorization.
+	AuthContext *auth.Context
+
+	server        *AuthorizationServer
+	rootContext   context.Context
+	tracker       *prometheusRequestMetricTracker
+	claims        map[string]interface{}
+	authorizedOps []product.AuthorizedOperation
+	pendingQuotas []product.AuthorizedOperation // counted from the access log
+	okResponse    *authv3.OkHttpResponse
+	trace         *requestTrace // nil unless a trace session matches
+}
+
+// AddRequestHeader adds a header to the request sent upstream if the request is allowed.
+func (c *CheckContext) AddRequestHeader(key, value string, appnd bool) {
+	addRequestHeader(c.okResponse, key, value, appnd)
+}
+
+// Unauthenticated returns a response denying the request as unauthenticated.
+func (c *CheckContext) Unauthenticated() *authv3.CheckResponse {
+	c.notifyDenial(config.DenialUnauthenticated, "")
+	resp := c.server.unauthenticated(c.Request, c.EnvRequest, c.tracker, c.API)
+	setDenyReason(resp, config.DenialUnauthenticated)
+	return resp
+}
+
+// Denied returns a response denying the request as unauthorized.
+func (c *CheckContext) Denied() *authv3.CheckResponse {
+	return c.deniedFor(config.DenialUnauthorized, "")
+}
+
+// deniedFor returns a response denying the request as unauthorized for the
+// denial class and reason
+func (c *CheckContext) deniedFor(class, reason string) *authv3.CheckResponse {
+	c.notifyDenial(class, reason)
+	resp := c.server.denied(c.Request, c.EnvRequest, c.tracker, c.AuthContext, c.API)
+	setDenyReason(resp, class)
+	return resp
+}
+
+// InternalError returns a response denying the request for an internal error.
+func (c *CheckContext) InternalError(err error) *authv3.CheckResponse {
+	return c.server.internalError(c.Request, c.EnvRequest, c.tracker, err)
+}
+
+var (
+	registeredCheckStagesMu sync.Mutex
+	registeredCheckStages   = map[string]CheckStage{}
+)
+
+// RegisterCheckStage makes a CheckStage available by name to the
+// auth.check_stages config. It must be called before NewHandler and
+// panics if the name is empty or already registered.
+func RegisterCheckStage(stage CheckStage) {
+	registeredCheckStagesMu.Lock()
+	defer registeredCheckStagesMu.Unlock()
+	name := stage.Name()
+	if name == "" {
+		panic("server: RegisterCheckStage with empty name")
+	}
+	if _, ok := registeredCheckStages[name]; ok || builtinCheckStage(name) != nil || checkPhase(name) {
+		panic("server: RegisterCheckStage called twice for " + name)
+	}
+	registeredCheckStages[name] = stage
+}
+
+var defaultCheckStages = []CheckStage{
+	NewCheckStage(SpecMatchStage, specMatch),
+	NewCheckStage(AuthenticationStage, authenticate),
+	NewCheckStage(ConsumerAuthorizationStage, authorizeConsumer),
+	NewCheckStage(QuotaStage, applyQuotas),
+	NewCheckStage(TransformsStage, transformRequest),
+}
+
+func builtinCheckStage(name string) CheckStage {
+	for _, s := range defaultCheckStages {
+		if s.Name() == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// newCheckStages returns the CheckStages in the order named, the default
+// stages if names is empty. All built-in stages must be named in order.
+func newCheckStages(names []string) ([]CheckStage, error) {
+	if len(names) == 0 {
+		return defaultCheckStages, nil
+	}
+	registeredCheckStagesMu.Lock()
+	defer registeredCheckStagesMu.Unlock()
+
+	var stages []CheckStage
+	seen := make(map[string]bool, len(names))
+	nextBuiltin := 0
+	for _, name := range names {
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate check stage %q", name)
+		}
+		seen[name] = true
+		if stage := builtinCheckStage(name); stage != nil {
+			if stage != defaultCheckStages[nextBuiltin] {
+				return nil, fmt.Errorf("check stage %q must follow %q", name, defaultCheckStages[nextBuiltin].Name())
+			}
+			nextBuiltin++
+			stages = append(stages, stage)
+			continue
+		}
+		stage, ok := registeredCheckStages[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown check stage %q", name)
+		}
+		stages = append(stages, stage)
+	}
+	if nextBuiltin < len(defaultCheckStages) {
+		return nil, fmt.Errorf("missing check stage %q", defaultCheckStages[nextBuiltin].Name())
+	}
+	return stages, nil
+}
+
+// runCheckStages runs the stages until one responds, returns nil if all continue
+func runCheckStages(ctx gocontext.Context, stages []CheckStage, c *CheckContext) *authv3.CheckResponse {
+	for _, stage := range stages {
+		start := time.Now()
+		resp := stage.Check(ctx, c)
+		result := "continue"
+		if resp != nil {
+			result = "respond"
+		}
+		spec, api := c.server.handler.metricScope(c.EnvRequest, c.API)
+		prometheusCheckStageSeconds.WithLabelValues(c.rootContext.Organization(), c.rootContext.Environment(),
+			spec, api, stage.Name(), result).Observe(time.Since(start).Seconds())
+		c.trace.tracef("stage %s: %s in %s", stage.Name(), result, time.Since(start))
+		if resp != nil {
+			log.Debugf("check stage %s responded", stage.Name())
+			return resp
+		}
+	}
+	return nil
+}
+
+// Phases of the Check stages timed as stages of the check_stage_seconds
+// histogram with the "phase" result. Unlike the stages, they isolate the
+// verifications from the decisions around them.
+const (
+	jwtVerifyPhase    = "jwt_verify"
+	apiKeyVerifyPhase = "api_key_verify"
+
+	phaseResult = "phase"
+)
+
+// checkPhase returns true if name is of a phase
+func checkPhase(name string) bool {
+	return name == jwtVerifyPhase || name == apiKeyVerifyPhase
+}
+
+// observePhase records the time since start of the phase
+func (c *CheckContext) observePhase(phase string, start time.Time) {
+	spec, api := c.server.handler.metricScope(c.EnvRequest, c.API)
+	prometheusCheckStageSeconds.WithLabelValues(c.rootContext.Organization(), c.rootContext.Environment(),
+		spec, api, phase, phaseResult).Observe(time.Since(start).Seconds())
+}
+
+// resolves the EnvironmentSpec, API, and operation of the request
+func specMatch(ctx gocontext.Context, c *CheckContext) *authv3.CheckResponse {
+	a := c.server
+	req := c.Request
+
+	var envSpec *config.EnvironmentSpecExt
+	if envSpecID, ok := req.Attributes.ContextExtensions[envSpecContextKey]; ok {
+		if spec, ok := a.handler.environmentSpec(envSpecID); ok {
+			envSpec = spec
+		}
+	}
+
+	// EnvSpec found, takes priority over global settings
+	if envSpec != nil {
+		c.EnvRequest = config.NewEnvironmentSpecRequest(a.handler.authMan, envSpec, req)
+		log.Debugf("environment spec: %s", c.EnvRequest.ID)
+		c.trace.tracef("environment spec: %s", c.EnvRequest.ID)
+
+		node, cluster := req.Attributes.ContextExtensions[envoyNodeContextKey], req.Attributes.ContextExtensions[envoyClusterContextKey]
+		if !envSpec.GatewayScope.Includes(node, cluster) {
+			log.Debugf("environment spec %s out of scope of node %q of cluster %q", envSpec.ID, node, cluster)
+			c.trace.tracef("environment spec %s: out of gateway scope", envSpec.ID)
+			return a.notFound(req, c.EnvRequest, c.tracker, c.API)
+		}
+
+		apiSpec := c.EnvRequest.GetAPISpec()
+		if apiSpec == nil {
+			log.Debugf("api not found for environment spec %s", envSpec.ID)
+			c.trace.tracef("no api matched")
+			return a.notFound(req, c.EnvRequest, c.tracker, c.API)
+		}
+		if !apiSpec.GatewayScope.Includes(node, cluster) {
+			log.Debugf("api %s out of scope of node %q of cluster %q", apiSpec.ID, node, cluster)
+			c.trace.tracef("api %s: out of gateway scope", apiSpec.ID)
+			return a.notFound(req, c.EnvRequest, c.tracker, c.API)
+		}
+		c.API = apiSpec.ID
+		log.Debugf("api: %s", apiSpec.ID)
+
+		// preflight has no operation or auth check, exit here
+		if c.EnvRequest.IsCORSPreflight() {
+			return a.corsPreflightResponse(c.EnvRequest, c.tracker, nil, c.API)
+		}
+
+		// auth exclusions have no operation, authentication and consumer
+		// authorization are skipped but the other stages apply
+		if c.EnvRequest.IsAuthExcluded() {
+			log.Debugf("auth excluded for api %s", apiSpec.ID)
+			c.trace.tracef("api %s: auth excluded, path %s", apiSpec.ID, req.Attributes.Request.Http.Path)
+			return checkBotRules(c)
+		}
+
+		operation := c.EnvRequest.GetOperation()
+		if operation == nil {
+			log.Debugf("no valid operation found for api %s", apiSpec.ID)
+			c.trace.tracef("api %s: no operation matched", apiSpec.ID)
+			return a.notFound(req, c.EnvRequest, c.tracker, c.API)
+		}
+		log.Debugf("operation: %s", operation.Name)
+		c.trace.tracef("api %s, operation %s, path %s, labels %v", apiSpec.ID, operation.Name,
+			c.EnvRequest.GetOperationPath(), c.EnvRequest.GetLabels())
+		c.tracker.labels = metricLabels(c.EnvRequest.GetLabels(), a.handler.metricLabels)
+		if resp := checkHeaderLimits(c); resp != nil {
+			return resp
+		}
+		return checkBotRules(c)
+	}
+
+	// global
+	if v, ok := req.Attributes.ContextExtensions[apiContextKey]; ok { // api specified in context metadata
+		c.API = v
+		log.Debugf("api from context: %s", c.API)
+		c.trace.tracef("api from context: %s", c.API)
+	} else {
+		c.API, ok = req.Attributes.Request.Http.Headers[a.handler.apiHeader]
+		if !ok {
+			log.Debugf("missing api header %s", a.handler.apiHeader)
+			return c.Unauthenticated()
+		}
+		log.Debugf("api from header: %s", c.API)
+		c.trace.tracef("api from header: %s", c.API)
+	}
+	return nil
+}
+
+// verifies EnvironmentSpec authentication or collects global JWT claims,
+// OAuth access token claims are collected for consumer authorization. The
+// collected claims must not be revoked.
+func authenticate(ctx gocontext.Context, c *CheckContext) *authv3.CheckResponse {
+	a := c.server
+	if c.EnvRequest.IsAuthExcluded() {
+		return nil
+	}
+	if c.EnvRequest != nil {
+		start := time.Now()
+		authenticated := c.EnvRequest.IsAuthenticated()
+		c.observePhase(jwtVerifyPhase, start)
+		if c.trace != nil {
+			traceJWTResults(c)
+		}
+		if !authenticated {
+			log.Debugf("authentication requirements not met")
+			c.trace.tracef("authentication requirements not met")
+			return c.Unauthenticated()
+		}
+		if resp := checkDPoP(c); resp != nil {
+			return resp
+		}
+		// verified OAuth access token claims may authorize the consumer
+		c.claims = c.EnvRequest.GetOAuthClaims()
+		return checkRevokedClaims(c)
+	}
+
+	// check for JWT from Envoy filter
+	protoBufStruct := c.Request.Attributes.GetMetadataContext().GetFilterMetadata()[jwtFilterMetadataKey]
+	fieldsMap := protoBufStruct.GetFields()
+
+	// use jwtProviderKey check if jwtProviderKey is set in config
+	if a.handler.jwtProviderKey != "" {
+		claimsStruct, ok := fieldsMap[a.handler.jwtProviderKey]
+		if ok {
+			log.Debugf("Using JWT at provider key: %s", a.handler.jwtProviderKey)
+			c.claims = util.DecodeToMap(claimsStruct.GetStructValue())
+		}
+	} else { // otherwise iterate over apiKeyClaim loop
+		for k, v := range fieldsMap {
+			vFields := v.GetStructValue().GetFields()
+			if vFields[a.handler.apiKeyClaim] != nil || vFields["api_product_list"] != nil {
+				log.Debugf("Using JWT with provider key: %s", k)
+				c.claims = util.DecodeToMap(v.GetStructValue())
+			}
+		}
+	}
+	return checkRevokedClaims(c)
+}
+
+// authenticates the consumer and authorizes it against API Products, then
+// records the replay protection nonce of the authorized request
+func authorizeConsumer(ctx gocontext.Context, c *CheckContext) *authv3.CheckResponse {
+	if resp := authorizeConsumerProducts(ctx, c); resp != nil {
+		return resp
+	}
+	return checkReplayProtection(c)
+}
+
+// authenticates the consumer and authorizes it against API Products
+func authorizeConsumerProducts(ctx gocontext.Context, c *CheckContext) *authv3.CheckResponse {
+	a := c.server
+	req := c.Request
+
+	var apiKey, path string
+	if c.EnvRequest != nil {
+		if c.EnvRequest.IsAuthExcluded() || !c.EnvRequest.IsAuthorizationRequired() {
+			log.Debugf("no authorization requirements")
+			// Use the root context for limited dynamic metadata.
+			c.AuthContext = &auth.Context{Context: c.rootContext}
+			return nil
+		}
+		path = c.EnvRequest.GetOperationPath()
+		apiKey = c.EnvRequest.GetAPIKey()
+	} else {
+		var queryString string
+		pathSplits := strings.SplitN(req.Attributes.Request.Http.Path, "?", 2)
+		path = pathSplits[0]
+		if len(pathSplits) > 1 {
+			queryString = pathSplits[1]
+		}
+
+		apiKey = req.Attributes.Request.Http.Headers[a.handler.apiKeyHeader] // grab from header
+
+		if apiKey == "" && queryString != "" { // look in querystring if not in header
+			if qs, err := url.ParseQuery(queryString); err == nil {
+				if keys, ok := qs[a.handler.apiKeyHeader]; ok {
+					apiKey = keys[0]
+				}
+			}
+		}
+	}
+
+	timeout := a.handler.verificationTimeout
+	if c.EnvRequest != nil {
+		timeout = c.EnvRequest.GetVerificationTimeouts().APIKey
+	}
+	spec, metricAPI := a.handler.metricScope(c.EnvRequest, c.API)
+	verifyContext := a.handler.verifyAPIKeyHeaders.context(c.rootContext, req.Attributes.Request.Http.Headers)
+	start := time.Now()
+	authContext, err := a.authenticateWithTimeout(verifyContext, timeout, apiKey, c.claims, spec, metricAPI)
+	c.observePhase(apiKeyVerifyPhase, start)
+	if authContext != nil {
+		authContext.Context = c.rootContext
+	}
+	c.AuthContext = authContext
+	switch err {
+	case auth.ErrNoAuth:
+		return c.Unauthenticated()
+	case auth.ErrBadAuth:
+		return c.deniedFor(config.DenialInvalidCredential, "invalid, expired or revoked API key or access token")
+	case auth.ErrInternalError:
+		return c.InternalError(err)
+	case auth.ErrNetworkError:
+		if c.EnvRequest != nil && c.EnvRequest.GetConsumerAuthorization().FailOpen {
+			log.Debugf("FailOpen on operation: %v", c.EnvRequest.GetOperation().Name)
+			return nil
+		}
+		return c.InternalError(err)
+	}
+
+	if len(authContext.APIProducts) == 0 {
+		return c.deniedFor(config.DenialUnauthorized, "no API products")
+	}
+
+	if err := c.EnvRequest.VerifyAppBindings(authContext.ClientID); err != nil {
+		log.Debugf("consumer: %v", err)
+		c.trace.tracef("consumer: %v", err)
+		return c.deniedFor(config.DenialAppBinding, err.Error())
+	}
+
+	if err := a.handler.checkConsumerAccess(c.EnvRequest, c.API, authContext); err != nil {
+		log.Debugf("consumer: %v", err)
+		c.trace.tracef("consumer: %v", err)
+		return c.deniedFor(config.DenialConsumerBlocked, err.Error())
+	}
+
+	// authorize against products
+	method := req.Attributes.Request.Http.Method
+	c.authorizedOps = a.handler.productMan.Authorize(authContext, c.API, path, method)
+	if c.trace != nil {
+		ids := make([]string, 0, len(c.authorizedOps))
+		for _, op := range c.authorizedOps {
+			ids = append(ids, op.ID)
+		}
+		c.trace.tracef("consumer: application %s, products %v, authorized operations %v",
+			authContext.Application, authContext.APIProducts, ids)
+	}
+	if len(c.authorizedOps) == 0 {
+		return c.deniedFor(config.DenialUnauthorized, "no API product authorizes the operation")
+	}
+	return nil
+}
+
+// applies quotas of the authorized operations
+func applyQuotas(ctx gocontext.Context, c *CheckContext) *authv3.CheckResponse {
+	var app string
+	if c.AuthContext != nil {
+		app = c.AuthContext.Application
+	}
+	if exemption := c.EnvRequest.MatchQuotaExemption(app); exemption != nil {
+		c.trace.tracef("quota: exempt by %s", exemption.Name)
+		_, api := c.server.handler.metricScope(c.EnvRequest, c.API)
+		prometheusQuotaExemptions.WithLabelValues(c.rootContext.Organization(), c.rootContext.Environment(), api, exemption.Name).Inc()
+		return nil
+	}
+	ops := quotaBuckets(c.authorizedOps, c.EnvRequest, c.API)
+	exceeded, pending, quotaError := c.server.applyQuotas(ops, c.AuthContext, c.EnvRequest.GetQuotaKey())
+	c.trace.tracef("quota: exceeded %t, error %v", exceeded != nil, quotaError)
+	c.pendingQuotas = pending
+	if quotaError != nil {
+		return c.InternalError(quotaError)
+	}
+	if exceeded != nil {
+		c.notifyDenial(config.DenialQuotaExceeded, "")
+		return c.server.quotaExceeded(c.Request, c.EnvRequest, c.tracker, c.AuthContext, c.API, exceeded)
+	}
+	return nil
+}
+
+// adds the EnvironmentSpec request transforms
+func transformRequest(ctx gocontext.Context, c *CheckContext) *authv3.CheckResponse {
+	addRequestHeaderTransforms(c.EnvRequest, c.okResponse)
+	if c.trace != nil {
+		for _, h := range c.okResponse.GetHeaders() {
+			c.trace.tracef("transform: set header %s", h.GetHeader().GetKey())
+		}
+		for _, h := range c.okResponse.GetHeadersToRemove() {
+			c.trace.tracef("transform: remove header %s", h)
+		}
+	}
+	return nil
+}
+
+// traceJWTResults traces the verification results of the JWTAuthentications
+func traceJWTResults(c *CheckContext) {
+	for _, jwtAuth := range c.EnvRequest.JWTAuthentications() {
+		claims, err := c.EnvRequest.GetJWTResult(jwtAuth.Name)
+		switch {
+		case err != nil:
+			c.trace.tracef("jwt_authentication %s: %v", jwtAuth.Name, err)
+		case claims != nil:
+			c.trace.tracef("jwt_authentication %s: verified", jwtAuth.Name)
+		default:
+			c.trace.tracef("jwt_authentication %s: not evaluated", jwtAuth.Name)
+		}
+	}
+}
+
+// metricLabels returns the labels named for metrics, nil if none
+func metricLabels(labels map[string]string, names []string) map[string]string {
+	var selected map[string]string
+	for _, name := range names {
+		if v, ok := labels[name]; ok {
+			if selected == nil {
+				selected = make(map[string]string, len(names))
+			}
+			selected[name] = v
+		}
+	}
+	return selected
+}
+
+var (
+	prometheusCheckStageSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Subsystem: "auth",
+		Name:      "check_stage_seconds",
+		Help:      "Time taken by each authorization check stage by result, and by the jwt_verify and api_key_verify phases",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"org", "env", "spec", "api", "stage", "result"})
+
+	prometheusQuotaExemptions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "quota",
+		Name:      "exempt_requests_count",
+		Help:      "Total number of requests exempt from quotas by exemption",
+	}, []string{"org", "env", "api", "exemption"})
+)
@@ -0,0 +1,421 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/specmatch"
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/gogo/googleapis/google/rpc"
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	prometheustest "github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func init() {
+	RegisterCheckStage(NewCheckStage("test_stage", func(ctx context.Context, c *CheckContext) *authv3.CheckResponse {
+		return nil
+	}))
+}
+
+func TestNewCheckStages(t *testing.T) {
+	defaults := []string{SpecMatchStage, AuthenticationStage, ConsumerAuthorizationStage, QuotaStage, TransformsStage}
+
+	tests := []struct {
+		desc    string
+		names   []string
+		want    []string
+		wantErr string
+	}{
+		{"default", nil, defaults, ""},
+		{"explicit default", defaults, defaults, ""},
+		{
+			"custom",
+			[]string{SpecMatchStage, AuthenticationStage, "test_stage", ConsumerAuthorizationStage, QuotaStage, TransformsStage},
+			[]string{SpecMatchStage, AuthenticationStage, "test_stage", ConsumerAuthorizationStage, QuotaStage, TransformsStage},
+			"",
+		},
+		{
+			"unknown",
+			[]string{SpecMatchStage, AuthenticationStage, "unknown", ConsumerAuthorizationStage, QuotaStage, TransformsStage},
+			nil,
+			`unknown check stage "unknown"`,
+		},
+		{
+			"duplicate",
+			[]string{SpecMatchStage, "test_stage", AuthenticationStage, "test_stage", ConsumerAuthorizationStage, QuotaStage, TransformsStage},
+			nil,
+			`duplicate check stage "test_stage"`,
+		},
+		{
+			"out of order",
+			[]string{SpecMatchStage, ConsumerAuthorizationStage, AuthenticationStage, QuotaStage, TransformsStage},
+			nil,
+			`check stage "consumer_authorization" must follow "authentication"`,
+		},
+		{
+			"missing",
+			[]string{SpecMatchStage, AuthenticationStage, ConsumerAuthorizationStage, QuotaStage},
+			nil,
+			`missing check stage "transforms"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			stages, err := newCheckStages(test.names)
+			if err != nil {
+				if test.wantErr == "" {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if err.Error() != test.wantErr {
+					t.Errorf("want: %q, got: %q", test.wantErr, err.Error())
+				}
+				return
+			}
+			if test.wantErr != "" {
+				t.Fatalf("want error: %q", test.wantErr)
+			}
+			var got []string
+			for _, s := range stages {
+				got = append(got, s.Name())
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRegisterCheckStagePanics(t *testing.T) {
+	for _, name := range []string{"", "test_stage", QuotaStage, apiKeyVerifyPhase} {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("want panic registering %q", name)
+				}
+			}()
+			RegisterCheckStage(NewCheckStage(name, nil))
+		})
+	}
+}
+
+func TestCustomCheckStage(t *testing.T) {
+	var stageAuthContext *auth.Context
+	custom := NewCheckStage("custom", func(ctx context.Context, c *CheckContext) *authv3.CheckResponse {
+		stageAuthContext = c.AuthContext
+		if c.Request.Attributes.Request.Http.Headers["x-deny"] != "" {
+			return c.Denied()
+		}
+		c.AddRequestHeader("x-custom", c.API, false)
+		return nil
+	})
+	stages := []CheckStage{defaultCheckStages[0], defaultCheckStages[1], defaultCheckStages[2], custom,
+		defaultCheckStages[3], defaultCheckStages[4]}
+
+	testAuthMan := &testAuthMan{}
+	testAuthMan.sendAuth(&auth.Context{APIProducts: []string{"product1"}}, nil)
+	server := AuthorizationServer{
+		handler: &Handler{
+			apiHeader:    headerAPI,
+			apiKeyHeader: "x-api-key",
+			authMan:      testAuthMan,
+			productMan: &testProductMan{
+				api:      "api",
+				resolve:  true,
+				products: product.ProductsNameMap{"product1": &product.APIProduct{DisplayName: "product1"}},
+			},
+			quotaMan:     &testQuotaMan{},
+			analyticsMan: &testAnalyticsMan{},
+			ready:        util.NewAtomicBool(true),
+			checkStages:  stages,
+		},
+	}
+
+	tests := []struct {
+		desc       string
+		headers    map[string]string
+		statusCode int32
+		wantHeader bool
+	}{
+		{"allowed", map[string]string{headerAPI: "api"}, int32(rpc.OK), true},
+		{"denied", map[string]string{headerAPI: "api", "x-deny": "true"}, int32(rpc.PERMISSION_DENIED), false},
+		{"earlier stage denied", map[string]string{}, int32(rpc.UNAUTHENTICATED), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			stageAuthContext = nil
+			req := testutil.NewEnvoyRequest(http.MethodGet, "/path?x-api-key=foo", test.headers, nil)
+			resp, err := server.Check(context.Background(), req)
+			if err != nil {
+				t.Fatalf("should not get error. got: %s", err)
+			}
+			if resp.Status.Code != test.statusCode {
+				t.Errorf("want: %d, got: %d", test.statusCode, resp.Status.Code)
+			}
+			if test.statusCode != int32(rpc.UNAUTHENTICATED) && stageAuthContext == nil {
+				t.Errorf("custom stage should have auth context")
+			}
+			var gotHeader bool
+			for _, h := range resp.GetOkResponse().GetHeaders() {
+				if h.Header.Key == "x-custom" && h.Header.Value == "api" {
+					gotHeader = true
+				}
+			}
+			if gotHeader != test.wantHeader {
+				t.Errorf("want x-custom header: %t, got: %t", test.wantHeader, gotHeader)
+			}
+		})
+	}
+}
+
+func TestCheckPhaseSeconds(t *testing.T) {
+	testAuthMan := &testAuthMan{}
+	testAuthMan.sendAuth(&auth.Context{APIProducts: []string{"product1"}}, nil)
+	server := AuthorizationServer{
+		handler: &Handler{
+			orgName:      "phase-org",
+			envName:      "phase-env",
+			apiHeader:    headerAPI,
+			apiKeyHeader: "x-api-key",
+			authMan:      testAuthMan,
+			productMan: &testProductMan{
+				api:      "api",
+				resolve:  true,
+				products: product.ProductsNameMap{"product1": &product.APIProduct{DisplayName: "product1"}},
+			},
+			quotaMan:     &testQuotaMan{},
+			analyticsMan: &testAnalyticsMan{},
+			ready:        util.NewAtomicBool(true),
+			checkStages:  defaultCheckStages,
+		},
+	}
+
+	req := testutil.NewEnvoyRequest(http.MethodGet, "/path?x-api-key=foo", map[string]string{headerAPI: "api"}, nil)
+	resp, err := server.Check(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.Code != int32(rpc.OK) {
+		t.Fatalf("want OK, got: %d", resp.Status.Code)
+	}
+
+	// phases are stages of the stage histogram, without an environment
+	// spec, JWTs are verified by Envoy
+	for phase, want := range map[string]uint64{apiKeyVerifyPhase: 1, jwtVerifyPhase: 0} {
+		var m dto.Metric
+		observer := prometheusCheckStageSeconds.WithLabelValues("phase-org", "phase-env", "", "", phase, phaseResult)
+		if err := observer.(prometheus.Histogram).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		if got := m.GetHistogram().GetSampleCount(); got != want {
+			t.Errorf("want %d %s observations, got %d", want, phase, got)
+		}
+	}
+}
+
+func TestQuotaExemptionStage(t *testing.T) {
+	envSpec := &config.EnvironmentSpec{
+		ID: "spec",
+		APIs: []config.APISpec{{
+			ID:              "api",
+			QuotaExemptions: []config.QuotaExemption{{Name: "internal", Apps: []string{"health-checker"}}},
+		}},
+	}
+	specExt, err := config.NewEnvironmentSpecExt(envSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := []product.AuthorizedOperation{{ID: "product1", QuotaLimit: 10}}
+
+	tests := []struct {
+		desc        string
+		app         string
+		wantApplied bool
+	}{
+		{"exempt", "health-checker", false},
+		{"not exempt", "other", true},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			quotaMan := &testQuotaMan{}
+			handler := &Handler{orgName: "exempt-org", envName: "env", quotaMan: quotaMan,
+				metricAPIs: newMetricAllowlist([]string{"listed"})}
+			authContext := &auth.Context{Application: test.app}
+			envoyReq := testutil.NewEnvoyRequest(http.MethodGet, "/", nil, nil)
+			c := &CheckContext{
+				Request:       envoyReq,
+				EnvRequest:    config.NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq),
+				API:           "api",
+				AuthContext:   authContext,
+				server:        &AuthorizationServer{handler: handler},
+				rootContext:   handler,
+				authorizedOps: ops,
+			}
+			if resp := applyQuotas(context.Background(), c); resp != nil {
+				t.Errorf("want request allowed, got: %v", resp)
+			}
+			if applied := len(quotaMan.applied) > 0; applied != test.wantApplied {
+				t.Errorf("want quota applied %t, got: %t", test.wantApplied, applied)
+			}
+		})
+	}
+
+	// the api is the metric scope label
+	if got := prometheustest.ToFloat64(prometheusQuotaExemptions.WithLabelValues("exempt-org", "env", metricScopeOther, "internal")); got != 1 {
+		t.Errorf("want 1 exemption of api %q, got: %v", metricScopeOther, got)
+	}
+}
+
+func TestGatewayScope(t *testing.T) {
+	envSpecs := []config.EnvironmentSpec{
+		{
+			ID:           "edge",
+			GatewayScope: config.GatewayScope{Clusters: []string{"edge"}},
+			APIs: []config.APISpec{
+				{ID: "public", BasePath: "/public"},
+				{ID: "canary", BasePath: "/canary", GatewayScope: config.GatewayScope{NodeIDs: []string{"node-1"}}},
+			},
+		},
+		{
+			ID:   "any",
+			APIs: []config.APISpec{{ID: "api", BasePath: "/v1"}},
+		},
+	}
+	if err := config.ValidateEnvironmentSpecs(envSpecs); err != nil {
+		t.Fatalf("%v", err)
+	}
+	specsByID := map[string]*config.EnvironmentSpecExt{}
+	for i := range envSpecs {
+		specExt, err := config.NewEnvironmentSpecExt(&envSpecs[i])
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		specsByID[specExt.ID] = specExt
+	}
+	server := AuthorizationServer{
+		handler: &Handler{
+			authMan:      &testAuthMan{},
+			productMan:   &testProductMan{resolve: true},
+			quotaMan:     &testQuotaMan{},
+			analyticsMan: &testAnalyticsMan{},
+			envSpecsByID: specsByID,
+			ready:        util.NewAtomicBool(true),
+		},
+	}
+
+	tests := []struct {
+		desc     string
+		spec     string
+		path     string
+		node     string
+		cluster  string
+		wantCode rpc.Code
+	}{
+		{"unscoped spec", "any", "/v1/pets", "", "", rpc.OK},
+		{"spec in scope", "edge", "/public/pets", "node-2", "edge", rpc.OK},
+		{"spec out of scope", "edge", "/public/pets", "node-2", "internal", rpc.NOT_FOUND},
+		{"unidentified node", "edge", "/public/pets", "", "", rpc.NOT_FOUND},
+		{"api in scope", "edge", "/canary/pets", "node-1", "edge", rpc.OK},
+		{"api out of scope", "edge", "/canary/pets", "node-2", "edge", rpc.NOT_FOUND},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			req := testutil.NewEnvoyRequest(http.MethodGet, test.path, nil, nil)
+			req.Attributes.ContextExtensions = map[string]string{envSpecContextKey: test.spec}
+			if test.node != "" {
+				req.Attributes.ContextExtensions[envoyNodeContextKey] = test.node
+			}
+			if test.cluster != "" {
+				req.Attributes.ContextExtensions[envoyClusterContextKey] = test.cluster
+			}
+			resp, err := server.Check(context.Background(), req)
+			if err != nil {
+				t.Fatalf("should not get error. got: %s", err)
+			}
+			if resp.Status.Code != int32(test.wantCode) {
+				t.Errorf("want: %d, got: %d", test.wantCode, resp.Status.Code)
+			}
+		})
+	}
+}
+
+func TestAuthExclusions(t *testing.T) {
+	envSpec := createAuthEnvSpec()
+	envSpec.APIs[0].AuthExclusions = []config.HTTPMatch{{PathTemplate: "/healthz"}}
+	envSpec.APIs[0].QuotaBuckets = config.QuotaBucketsOperation
+	envSpecs := []config.EnvironmentSpec{envSpec}
+	if err := config.ValidateEnvironmentSpecs(envSpecs); err != nil {
+		t.Fatalf("%v", err)
+	}
+	specExt, err := config.NewEnvironmentSpecExt(&envSpecs[0])
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	authMan := &testAuthMan{}
+	server := AuthorizationServer{
+		handler: &Handler{
+			authMan:      authMan,
+			productMan:   &testProductMan{resolve: true},
+			quotaMan:     &testQuotaMan{},
+			analyticsMan: &testAnalyticsMan{},
+			envSpecsByID: map[string]*config.EnvironmentSpecExt{specExt.ID: specExt},
+			ready:        util.NewAtomicBool(true),
+		},
+	}
+
+	tests := []struct {
+		desc     string
+		path     string
+		wantCode rpc.Code
+	}{
+		{"excluded", "/v1/healthz", rpc.OK},
+		{"protected", "/v1/petstore", rpc.UNAUTHENTICATED},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			req := testutil.NewEnvoyRequest(http.MethodGet, test.path, nil, nil)
+			req.Attributes.ContextExtensions = map[string]string{envSpecContextKey: specExt.ID}
+			authMan.sendAuth(nil, auth.ErrBadAuth)
+			resp, err := server.Check(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rpc.Code(resp.Status.Code); got != test.wantCode {
+				t.Errorf("want %s, got %s", test.wantCode, got)
+			}
+			// the request transforms of the API still apply
+			if test.wantCode == rpc.OK {
+				added := map[string]string{}
+				for _, h := range resp.GetOkResponse().GetHeaders() {
+					added[h.GetHeader().GetKey()] = h.GetHeader().GetValue()
+				}
+				if added["target"] == "" || added[specmatch.PathHeader] != "/healthz" {
+					t.Errorf("want transformed headers, got: %v", added)
+				}
+			}
+		})
+	}
+}
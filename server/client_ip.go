@@ -0,0 +1,37 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+)
+
+// clientIP returns the client address of a checked request, resolved by the
+// trusted proxies if configured, else the downstream address
+func (h *Handler) clientIP(req *authv3.CheckRequest) string {
+	attrs := req.GetAttributes()
+	downstream := attrs.GetSource().GetAddress().GetSocketAddress().GetAddress()
+	return h.proxyChain.ClientIP(downstream, attrs.GetRequest().GetHttp().GetHeaders()[config.ForwardedForHeader])
+}
+
+// analyticsClientIP returns the ClientIP of an analytics record, resolved by
+// the trusted proxies if configured, else the x-forwarded-for header as is
+func (h *Handler) analyticsClientIP(downstream, forwardedFor string) string {
+	if h.proxyChain == nil {
+		return forwardedFor
+	}
+	return h.proxyChain.ClientIP(downstream, forwardedFor)
+}
@@ -0,0 +1,63 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+)
+
+func TestClientIP(t *testing.T) {
+	req := testutil.NewEnvoyRequest(http.MethodGet, "/", map[string]string{
+		config.ForwardedForHeader: "198.51.100.7, 10.1.1.1",
+	}, nil)
+	req.Attributes.Source = &authv3.AttributeContext_Peer{
+		Address: &corev3.Address{Address: &corev3.Address_SocketAddress{
+			SocketAddress: &corev3.SocketAddress{Address: "10.0.0.1"},
+		}},
+	}
+
+	h := &Handler{}
+	if got := h.clientIP(req); got != "10.0.0.1" {
+		t.Errorf("want downstream address, got %q", got)
+	}
+	if got := h.analyticsClientIP("10.0.0.1", "198.51.100.7, 10.1.1.1"); got != "198.51.100.7, 10.1.1.1" {
+		t.Errorf("want forwarded for as is, got %q", got)
+	}
+
+	chain, err := config.NewProxyChain(config.TrustedProxies{CIDRs: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = &Handler{proxyChain: chain, tracer: newRequestTracer(chain)}
+	if got := h.clientIP(req); got != "198.51.100.7" {
+		t.Errorf("want client address, got %q", got)
+	}
+	if got := h.analyticsClientIP("10.0.0.1", "198.51.100.7, 10.1.1.1"); got != "198.51.100.7" {
+		t.Errorf("want client address, got %q", got)
+	}
+
+	if _, err := h.tracer.add(TraceSession{ClientIP: "198.51.100.7"}); err != nil {
+		t.Fatal(err)
+	}
+	if h.tracer.match(req) == nil {
+		t.Errorf("want trace of the client behind the proxies")
+	}
+}
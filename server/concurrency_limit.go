@@ -0,0 +1,168 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/gogo/googleapis/google/rpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// concurrencyLimiter tracks the requests of each API in flight to its target,
+// from the allowed check until the access log record, and denies requests over
+// the API concurrency limit. Requests are identified by tokens passed through
+// the dynamic metadata.
+type concurrencyLimiter struct {
+	now func() time.Time
+
+	mu     sync.Mutex
+	next   uint64
+	apis   map[concurrencyKey]map[string]*inFlightRequest // by token
+	tokens map[string]*inFlightRequest
+}
+
+// concurrencyKey identifies an API by the IDs of its spec and itself
+type concurrencyKey struct {
+	spec, api string
+}
+
+type inFlightRequest struct {
+	key                   concurrencyKey
+	expiry                time.Time
+	metricSpec, metricAPI string
+}
+
+func newConcurrencyLimiter() *concurrencyLimiter {
+	return &concurrencyLimiter{
+		now:    time.Now,
+		apis:   make(map[concurrencyKey]map[string]*inFlightRequest),
+		tokens: make(map[string]*inFlightRequest),
+	}
+}
+
+// acquire returns a token for a request of the API if under the limit, false
+// if the limit is reached. Unlimited requests are not tracked and have an
+// empty token. The metric labels scope the in flight gauge.
+func (l *concurrencyLimiter) acquire(key concurrencyKey, limit config.ConcurrencyLimit, metricSpec, metricAPI string) (token string, ok bool) {
+	if l == nil || limit.MaxRequests <= 0 {
+		return "", true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	inFlight := l.apis[key]
+	if inFlight == nil {
+		inFlight = make(map[string]*inFlightRequest)
+		l.apis[key] = inFlight
+	}
+	for t, r := range inFlight {
+		if !now.Before(r.expiry) {
+			l.remove(t)
+			prometheusConcurrencyExpired.WithLabelValues(r.metricSpec, r.metricAPI).Inc()
+		}
+	}
+	if len(inFlight) >= limit.MaxRequests {
+		return "", false
+	}
+	l.next++
+	token = strconv.FormatUint(l.next, 10)
+	r := &inFlightRequest{
+		key:        key,
+		expiry:     now.Add(limit.GetTimeout()),
+		metricSpec: metricSpec,
+		metricAPI:  metricAPI,
+	}
+	inFlight[token] = r
+	l.tokens[token] = r
+	prometheusAPIRequestsInFlight.WithLabelValues(metricSpec, metricAPI).Inc()
+	return token, true
+}
+
+// release ends the request of the token, ignored if unknown or expired
+func (l *concurrencyLimiter) release(token string) {
+	if l == nil || token == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.remove(token)
+}
+
+// inFlight returns the number of requests of the API in flight
+func (l *concurrencyLimiter) inFlight(key concurrencyKey) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.apis[key])
+}
+
+// remove must be called with the lock held
+func (l *concurrencyLimiter) remove(token string) {
+	r, ok := l.tokens[token]
+	if !ok {
+		return
+	}
+	delete(l.apis[r.key], token)
+	delete(l.tokens, token)
+	prometheusAPIRequestsInFlight.WithLabelValues(r.metricSpec, r.metricAPI).Dec()
+}
+
+// acquireConcurrency returns the concurrency token of an allowed request, or a
+// response denying it if its API concurrency limit is reached
+func (a *AuthorizationServer) acquireConcurrency(c *CheckContext) (token string, resp *authv3.CheckResponse) {
+	api := c.EnvRequest.GetAPISpec()
+	if api == nil {
+		return "", nil
+	}
+	spec, apiLabel := a.handler.metricScope(c.EnvRequest, c.API)
+	token, ok := a.handler.concurrency.acquire(concurrencyKey{c.EnvRequest.ID, api.ID}, api.Concurrency, spec, apiLabel)
+	if ok {
+		return token, nil
+	}
+	c.trace.tracef("concurrency: limit of %d reached", api.Concurrency.MaxRequests)
+	prometheusConcurrencyDenied.WithLabelValues(c.rootContext.Organization(), c.rootContext.Environment(), spec, apiLabel).Inc()
+	code, statusCode := rpc.UNAVAILABLE, typev3.StatusCode_ServiceUnavailable
+	if api.Concurrency.GetDenyStatus() == http.StatusTooManyRequests {
+		code, statusCode = rpc.RESOURCE_EXHAUSTED, typev3.StatusCode_TooManyRequests
+	}
+	return "", a.createEnvoyDenied(c.Request, c.EnvRequest, c.tracker, c.AuthContext, c.API, code, statusCode)
+}
+
+var (
+	prometheusAPIRequestsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "auth",
+		Name:      "api_requests_in_flight",
+		Help:      "Number of requests of APIs with a concurrency limit in flight to their targets",
+	}, []string{"spec", "api"})
+
+	prometheusConcurrencyExpired = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "api_requests_in_flight_expired_count",
+		Help:      "Total number of in flight requests expired without an access log record",
+	}, []string{"spec", "api"})
+
+	prometheusConcurrencyDenied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "concurrency_denied_count",
+		Help:      "Total number of requests denied for exceeding the API concurrency limit",
+	}, []string{"org", "env", "spec", "api"})
+)
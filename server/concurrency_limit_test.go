@@ -0,0 +1,134 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newConcurrencyLimiter()
+	l.now = func() time.Time { return now }
+	key := concurrencyKey{"spec", "api"}
+	limit := config.ConcurrencyLimit{MaxRequests: 2, Timeout: time.Minute}
+
+	first, ok := l.acquire(key, limit, "spec", "api")
+	if !ok || first == "" {
+		t.Fatalf("want first acquired with token, got %q, %t", first, ok)
+	}
+	second, ok := l.acquire(key, limit, "spec", "api")
+	if !ok || second == "" || second == first {
+		t.Fatalf("want second acquired with new token, got %q, %t", second, ok)
+	}
+	if _, ok := l.acquire(key, limit, "spec", "api"); ok {
+		t.Errorf("want third denied")
+	}
+	if _, ok := l.acquire(concurrencyKey{"spec", "other"}, limit, "spec", "other"); !ok {
+		t.Errorf("want other API acquired")
+	}
+
+	l.release(first)
+	l.release(first)
+	l.release("unknown")
+	if got := l.inFlight(key); got != 1 {
+		t.Errorf("want 1 in flight, got %d", got)
+	}
+	if _, ok := l.acquire(key, limit, "spec", "api"); !ok {
+		t.Errorf("want acquired after release")
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := l.acquire(key, limit, "spec", "api"); !ok {
+		t.Errorf("want acquired after timeout")
+	}
+	if got := l.inFlight(key); got != 1 {
+		t.Errorf("want expired removed, got %d in flight", got)
+	}
+	l.release(second)
+	if got := l.inFlight(key); got != 1 {
+		t.Errorf("want expired token ignored, got %d in flight", got)
+	}
+
+	if token, ok := l.acquire(key, config.ConcurrencyLimit{}, "spec", "api"); !ok || token != "" {
+		t.Errorf("want unlimited acquired without token, got %q, %t", token, ok)
+	}
+	var nilLimiter *concurrencyLimiter
+	if token, ok := nilLimiter.acquire(key, limit, "spec", "api"); !ok || token != "" {
+		t.Errorf("want nil limiter acquired without token, got %q, %t", token, ok)
+	}
+	nilLimiter.release("1")
+}
+
+func TestAcquireConcurrency(t *testing.T) {
+	tests := []struct {
+		desc       string
+		denyStatus int
+		want       typev3.StatusCode
+	}{
+		{"default", 0, typev3.StatusCode_ServiceUnavailable},
+		{"too many requests", http.StatusTooManyRequests, typev3.StatusCode_TooManyRequests},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			envSpec := &config.EnvironmentSpec{
+				ID: "spec",
+				APIs: []config.APISpec{{
+					ID:          "api",
+					Concurrency: config.ConcurrencyLimit{MaxRequests: 1, DenyStatus: test.denyStatus},
+				}},
+			}
+			specExt, err := config.NewEnvironmentSpecExt(envSpec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler := &Handler{orgName: "org", envName: "env", concurrency: newConcurrencyLimiter()}
+			server := &AuthorizationServer{handler: handler}
+			newContext := func() *CheckContext {
+				envoyReq := testutil.NewEnvoyRequest(http.MethodGet, "/", nil, nil)
+				return &CheckContext{
+					Request:     envoyReq,
+					EnvRequest:  config.NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq),
+					API:         "api",
+					server:      server,
+					rootContext: handler,
+				}
+			}
+
+			token, resp := server.acquireConcurrency(newContext())
+			if resp != nil || token == "" {
+				t.Fatalf("want acquired with token, got %q, %v", token, resp)
+			}
+			_, resp = server.acquireConcurrency(newContext())
+			if got := resp.GetDeniedResponse().GetStatus().GetCode(); got != test.want {
+				t.Errorf("want denied %v, got %v", test.want, got)
+			}
+
+			metadata := &structpb.Struct{Fields: map[string]*structpb.Value{}}
+			encodeConcurrencyTokenMetadata(metadata, token)
+			handler.concurrency.release(decodeConcurrencyTokenMetadata(metadata.Fields))
+			if token, resp := server.acquireConcurrency(newContext()); resp != nil || token == "" {
+				t.Errorf("want acquired after release, got %q, %v", token, resp)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	consumerBlockedBySpec  = "spec"
+	consumerBlockedByAdmin = "admin"
+)
+
+// ConsumerBlock blocks an Apigee app or developer from an API, or all APIs
+// if API is empty. Blocks are created with the consumer blocks admin API and
+// held in memory by each adapter, so a block to keep should also be added to
+// the consumer_access of the spec.
+type ConsumerBlock struct {
+	ID             string    `json:"id"`
+	API            string    `json:"api,omitempty"`
+	App            string    `json:"app,omitempty"`
+	DeveloperEmail string    `json:"developer_email,omitempty"`
+	Created        time.Time `json:"created"`
+}
+
+// matches returns true if the block applies to the consumer of the API
+func (b *ConsumerBlock) matches(api, app, developerEmail string) bool {
+	if b.API != "" && b.API != api {
+		return false
+	}
+	return (b.App != "" && b.App == app) ||
+		(b.DeveloperEmail != "" && strings.EqualFold(b.DeveloperEmail, developerEmail))
+}
+
+// consumerBlocklist holds the ConsumerBlocks created with the admin API
+type consumerBlocklist struct {
+	now func() time.Time
+
+	mu     sync.RWMutex
+	blocks map[string]*ConsumerBlock
+	nextID int
+}
+
+func newConsumerBlocklist() *consumerBlocklist {
+	return &consumerBlocklist{
+		now:    time.Now,
+		blocks: make(map[string]*ConsumerBlock),
+	}
+}
+
+// add creates the block, assigning its ID and creation time
+func (l *consumerBlocklist) add(b ConsumerBlock) (ConsumerBlock, error) {
+	if (b.App == "") == (b.DeveloperEmail == "") {
+		return b, fmt.Errorf("one of app or developer_email is required")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.nextID++
+	b.ID = strconv.Itoa(l.nextID)
+	b.Created = l.now()
+	l.blocks[b.ID] = &b
+	log.Infof("consumer block %s created: %+v", b.ID, b)
+	return b, nil
+}
+
+// remove deletes the block, returns false if it does not exist
+func (l *consumerBlocklist) remove(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.blocks[id]
+	delete(l.blocks, id)
+	if ok {
+		log.Infof("consumer block %s removed", id)
+	}
+	return ok
+}
+
+// list returns the blocks ordered by ID
+func (l *consumerBlocklist) list() []ConsumerBlock {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	blocks := make([]ConsumerBlock, 0, len(l.blocks))
+	for _, b := range l.blocks {
+		blocks = append(blocks, *b)
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		a, _ := strconv.Atoi(blocks[i].ID)
+		b, _ := strconv.Atoi(blocks[j].ID)
+		return a < b
+	})
+	return blocks
+}
+
+// blocked returns the first block of the consumer of the API, nil if none
+func (l *consumerBlocklist) blocked(api, app, developerEmail string) *ConsumerBlock {
+	if l == nil {
+		return nil
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, b := range l.blocks {
+		if b.matches(api, app, developerEmail) {
+			return b
+		}
+	}
+	return nil
+}
+
+// checkConsumerAccess returns an error if the verified consumer of the
+// request is blocked or not allowed, by the spec or the admin API
+func (h *Handler) checkConsumerAccess(envRequest *config.EnvironmentSpecRequest, api string, authContext *auth.Context) error {
+	source, err := h.consumerAccess(envRequest, api, authContext)
+	if err != nil {
+		prometheusConsumersBlocked.WithLabelValues(authContext.Organization(), authContext.Environment(),
+			h.metricAPIs.value(api), source).Inc()
+	}
+	return err
+}
+
+// consumerAccess returns an error and its source if the consumer is blocked
+// or not allowed
+func (h *Handler) consumerAccess(envRequest *config.EnvironmentSpecRequest, api string, authContext *auth.Context) (source string, err error) {
+	if err := envRequest.CheckConsumerAccess(authContext.Application, authContext.DeveloperEmail); err != nil {
+		return consumerBlockedBySpec, err
+	}
+	if b := h.consumerBlocks.blocked(api, authContext.Application, authContext.DeveloperEmail); b != nil {
+		return consumerBlockedByAdmin, fmt.Errorf("app %q of developer %q is blocked by consumer block %s",
+			authContext.Application, authContext.DeveloperEmail, b.ID)
+	}
+	return "", nil
+}
+
+// ConsumerBlocksHandlerFunc returns an http.HandlerFunc managing consumer
+// blocks: GET lists the blocks, POST creates the JSON ConsumerBlock of the
+// body, and DELETE with an "id" query parameter removes a block.
+func (h *Handler) ConsumerBlocksHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respond := func(status int, body interface{}) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			if err := json.NewEncoder(w).Encode(body); err != nil {
+				log.Warnf("consumer blocks unable to respond: %s", err)
+			}
+		}
+		switch r.Method {
+		case http.MethodGet:
+			respond(http.StatusOK, map[string]interface{}{"blocks": h.consumerBlocks.list()})
+		case http.MethodPost:
+			var b ConsumerBlock
+			if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+				respond(http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			b, err := h.consumerBlocks.add(b)
+			if err != nil {
+				respond(http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			respond(http.StatusCreated, b)
+		case http.MethodDelete:
+			if !h.consumerBlocks.remove(r.URL.Query().Get("id")) {
+				respond(http.StatusNotFound, map[string]string{"error": "no such consumer block"})
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+var (
+	prometheusConsumersBlocked = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "consumer_blocked_count",
+		Help:      "Total number of requests denied as their consumer is blocked or not allowed by source: spec or admin",
+	}, []string{"org", "env", "api", "source"})
+)
@@ -0,0 +1,161 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+)
+
+func TestConsumerBlocklist(t *testing.T) {
+	l := newConsumerBlocklist()
+	for _, b := range []ConsumerBlock{{}, {App: "app", DeveloperEmail: "dev@example.com"}} {
+		if _, err := l.add(b); err == nil {
+			t.Errorf("want error adding %#v", b)
+		}
+	}
+	app, err := l.add(ConsumerBlock{API: "api", App: "compromised"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.add(ConsumerBlock{DeveloperEmail: "mallory@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc    string
+		api     string
+		app     string
+		email   string
+		blocked bool
+	}{
+		{"app of api", "api", "compromised", "", true},
+		{"app of other api", "other", "compromised", "", false},
+		{"developer of any api", "other", "app", "Mallory@example.com", true},
+		{"not blocked", "api", "app", "bob@example.com", false},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			if got := l.blocked(test.api, test.app, test.email) != nil; got != test.blocked {
+				t.Errorf("want blocked %t, got %t", test.blocked, got)
+			}
+		})
+	}
+
+	if !l.remove(app.ID) || l.remove(app.ID) {
+		t.Errorf("want block removed once")
+	}
+	if b := l.blocked("api", "compromised", ""); b != nil {
+		t.Errorf("want removed block not to match, got %#v", b)
+	}
+	var nilList *consumerBlocklist
+	if b := nilList.blocked("api", "compromised", ""); b != nil {
+		t.Errorf("want nil list not to match, got %#v", b)
+	}
+}
+
+func TestCheckConsumerAccess(t *testing.T) {
+	envSpec := &config.EnvironmentSpec{
+		ID: "spec",
+		APIs: []config.APISpec{{
+			ID: "api",
+			ConsumerAccess: config.ConsumerAccess{
+				Block: config.ConsumerList{Apps: []string{"blocked-by-spec"}},
+			},
+		}},
+	}
+	specExt, err := config.NewEnvironmentSpecExt(envSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{orgName: "org", envName: "env", consumerBlocks: newConsumerBlocklist()}
+	if _, err := h.consumerBlocks.add(ConsumerBlock{App: "blocked-by-admin"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		app     string
+		wantErr bool
+	}{
+		{"blocked-by-spec", true},
+		{"blocked-by-admin", true},
+		{"app", false},
+	}
+	for _, test := range tests {
+		t.Run(test.app, func(t *testing.T) {
+			envoyReq := testutil.NewEnvoyRequest(http.MethodGet, "/", nil, nil)
+			envRequest := config.NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
+			authContext := &auth.Context{Context: h, Application: test.app}
+			if err := h.checkConsumerAccess(envRequest, "api", authContext); (err != nil) != test.wantErr {
+				t.Errorf("want error %t, got: %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestConsumerBlocksHandlerFunc(t *testing.T) {
+	h := &Handler{consumerBlocks: newConsumerBlocklist()}
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ConsumerBlocksHandlerFunc()(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/consumers/blocks", `{"api": "api", "app": "compromised"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("want status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body)
+	}
+	var created ConsumerBlock
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.ID == "" || created.App != "compromised" || created.Created.IsZero() {
+		t.Errorf("unexpected block: %#v", created)
+	}
+
+	for _, body := range []string{`{"api": "api"}`, `not json`} {
+		if rec := do(http.MethodPost, "/consumers/blocks", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: want status %d, got %d", body, http.StatusBadRequest, rec.Code)
+		}
+	}
+
+	rec = do(http.MethodGet, "/consumers/blocks", "")
+	var list struct {
+		Blocks []ConsumerBlock `json:"blocks"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Blocks) != 1 || list.Blocks[0].ID != created.ID {
+		t.Errorf("unexpected blocks: %#v", list.Blocks)
+	}
+
+	if rec := do(http.MethodDelete, "/consumers/blocks?id="+created.ID, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("want status %d, got %d", http.StatusNoContent, rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/consumers/blocks?id="+created.ID, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("want status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	if rec := do(http.MethodPut, "/consumers/blocks", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("want status %d, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
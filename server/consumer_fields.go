@@ -0,0 +1,120 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// consumerField is a verified consumer field of the auth context
+type consumerField struct {
+	name   string // in auth.consumer_fields
+	header string // default header and metadata field name
+	value  func(ac *auth.Context) string
+}
+
+var consumerFields = []consumerField{
+	{config.ConsumerFieldAccessToken, headerAccessToken, func(ac *auth.Context) string { return ac.AccessToken }},
+	{config.ConsumerFieldAPIProducts, headerAPIProducts, func(ac *auth.Context) string { return strings.Join(ac.APIProducts, ",") }},
+	{config.ConsumerFieldApplication, headerApplication, func(ac *auth.Context) string { return ac.Application }},
+	{config.ConsumerFieldClientID, headerClientID, func(ac *auth.Context) string { return ac.ClientID }},
+	{config.ConsumerFieldDeveloperEmail, headerDeveloperEmail, func(ac *auth.Context) string { return ac.DeveloperEmail }},
+	{config.ConsumerFieldScope, headerScope, func(ac *auth.Context) string { return strings.Join(ac.Scopes, " ") }},
+}
+
+// consumerFieldSelection is the auth.consumer_fields config. A nil selection
+// sends all fields under their default names.
+type consumerFieldSelection struct {
+	headers map[string]string // default header -> header sent, if enabled
+	omitted map[string]bool   // default header names omitted from metadata
+}
+
+// newConsumerFieldSelection returns nil if cfg is empty
+func newConsumerFieldSelection(cfg map[string]config.ConsumerField) *consumerFieldSelection {
+	if len(cfg) == 0 {
+		return nil
+	}
+	s := &consumerFieldSelection{
+		headers: make(map[string]string),
+		omitted: make(map[string]bool),
+	}
+	for _, f := range consumerFields {
+		fc, ok := cfg[f.name]
+		if !ok {
+			continue
+		}
+		if fc.Header {
+			s.headers[f.header] = f.header
+			if fc.HeaderName != "" {
+				s.headers[f.header] = fc.HeaderName
+			}
+		}
+		if fc.OmitMetadata {
+			s.omitted[f.header] = true
+		}
+	}
+	return s
+}
+
+// headerName returns the name the field of the default header is sent as
+func (s *consumerFieldSelection) headerName(header string) string {
+	if s != nil {
+		if name, ok := s.headers[header]; ok {
+			return name
+		}
+	}
+	return header
+}
+
+// metadataHeaders returns the headers of the selected fields, preceded by the
+// api, environment and organization headers if context is true, and the
+// headers to remove as metadataHeaders
+func (s *consumerFieldSelection) metadataHeaders(api string, ac *auth.Context, maxBytes int, context bool) (headers []*corev3.HeaderValueOption, remove []string) {
+	if ac == nil {
+		return
+	}
+	add := func(name, value string) {
+		h, r := metadataHeader(name, value, maxBytes)
+		headers = append(headers, h...)
+		remove = append(remove, r...)
+	}
+	if context {
+		add(headerAPI, api)
+		add(headerEnvironment, ac.Environment())
+		add(headerOrganization, ac.Organization())
+	}
+	for _, f := range consumerFields {
+		if name, ok := s.headers[f.header]; ok {
+			add(name, f.value(ac))
+		}
+	}
+	observeMetadataHeadersSize(headers)
+	return
+}
+
+// omitMetadata removes the omitted fields from the ext_authz metadata
+func (s *consumerFieldSelection) omitMetadata(metadata *structpb.Struct) {
+	if s == nil || metadata == nil {
+		return
+	}
+	for header := range s.omitted {
+		delete(metadata.Fields, header)
+	}
+}
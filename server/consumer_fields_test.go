@@ -0,0 +1,111 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestConsumerFieldSelection(t *testing.T) {
+	if s := newConsumerFieldSelection(nil); s != nil {
+		t.Errorf("want nil selection, got %#v", s)
+	}
+	var nilSelection *consumerFieldSelection
+	if got := nilSelection.headerName(headerClientID); got != headerClientID {
+		t.Errorf("got %q, want %q", got, headerClientID)
+	}
+
+	s := newConsumerFieldSelection(map[string]config.ConsumerField{
+		config.ConsumerFieldApplication: {Header: true, HeaderName: "x-app"},
+		config.ConsumerFieldClientID:    {Header: true},
+		config.ConsumerFieldAccessToken: {OmitMetadata: true},
+	})
+	for _, tc := range []struct {
+		header string
+		want   string
+	}{
+		{headerApplication, "x-app"},
+		{headerClientID, headerClientID},
+		{headerAccessToken, headerAccessToken},
+	} {
+		if got := s.headerName(tc.header); got != tc.want {
+			t.Errorf("headerName(%q) got %q, want %q", tc.header, got, tc.want)
+		}
+	}
+
+	h := &Handler{
+		orgName: "org",
+		envName: "env",
+	}
+	authContext := &auth.Context{
+		Context:        h,
+		ClientID:       "clientid",
+		AccessToken:    "accesstoken",
+		Application:    "application",
+		APIProducts:    []string{"prod1", "prod2"},
+		DeveloperEmail: "dev@google.com",
+		Scopes:         []string{"scope1", "scope2"},
+	}
+
+	for _, tc := range []struct {
+		desc    string
+		context bool
+		want    map[string]string
+	}{
+		{"selected", false, map[string]string{
+			"x-app":        "application",
+			headerClientID: "clientid",
+		}},
+		{"with context", true, map[string]string{
+			headerAPI:          "api",
+			headerEnvironment:  "env",
+			headerOrganization: "org",
+			"x-app":            "application",
+			headerClientID:     "clientid",
+		}},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			got := map[string]string{}
+			mh, _ := s.metadataHeaders("api", authContext, 0, tc.context)
+			for _, o := range mh {
+				got[o.Header.Key] = o.Header.Value
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+	if got, _ := s.metadataHeaders("api", nil, 0, true); len(got) != 0 {
+		t.Errorf("want no headers without auth context, got %v", got)
+	}
+
+	metadata := &structpb.Struct{Fields: map[string]*structpb.Value{
+		headerAccessToken: structpb.NewStringValue("accesstoken"),
+		headerClientID:    structpb.NewStringValue("clientid"),
+	}}
+	s.omitMetadata(metadata)
+	if _, ok := metadata.Fields[headerAccessToken]; ok {
+		t.Errorf("%s should be omitted from metadata", headerAccessToken)
+	}
+	if _, ok := metadata.Fields[headerClientID]; !ok {
+		t.Errorf("%s should not be omitted from metadata", headerClientID)
+	}
+	nilSelection.omitMetadata(metadata)
+}
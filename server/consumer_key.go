@@ -0,0 +1,157 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/cache"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	consumerKeyPath                  = "/consumerKey"
+	consumerKeyCacheEvictionInterval = 10 * time.Second
+	consumerKeyMaxCachedEntries      = 10000
+	consumerKeyUnknownEntryCacheTTL  = 10 * time.Second
+	consumerKeyMaxCachedUnknown      = 100
+)
+
+// errUnknownConsumer is returned if no Apigee app has the attribute value.
+var errUnknownConsumer = errors.New("no app with attribute value")
+
+// errConsumerKeyAPIDisabled is returned by a nil consumerKeyResolver.
+var errConsumerKeyAPIDisabled = errors.New("app attribute lookups require auth.consumer_key_api")
+
+// consumerKeyRequest is the request to the remote-service consumerKey API
+type consumerKeyRequest struct {
+	Attribute string `json:"attribute"`
+	Value     string `json:"value"`
+}
+
+// consumerKeyResponse is the response from the remote-service consumerKey API
+type consumerKeyResponse struct {
+	ConsumerKey string `json:"consumerKey"`
+}
+
+// consumerKeyResolver finds the consumer key of the Apigee app having a custom
+// attribute value with the consumerKey API of a customized remote-service
+// proxy, see config.Auth.ConsumerKeyAPI for its contract. Results are cached
+// for the API key cache duration, unknown values are cached briefly. A nil
+// resolver fails all lookups.
+type consumerKeyResolver struct {
+	client  *http.Client
+	url     string
+	cache   cache.ExpiringCache
+	unknown cache.ExpiringCache
+	org     string
+}
+
+func newConsumerKeyResolver(client *http.Client, remoteServiceAPI *url.URL,
+	cacheTTL time.Duration, org string) *consumerKeyResolver {
+	var apiURL string
+	if remoteServiceAPI != nil {
+		u := *remoteServiceAPI
+		u.Path = path.Join(u.Path, consumerKeyPath)
+		apiURL = u.String()
+	}
+	return &consumerKeyResolver{
+		client:  client,
+		url:     apiURL,
+		cache:   cache.NewLRU(cacheTTL, consumerKeyCacheEvictionInterval, consumerKeyMaxCachedEntries),
+		unknown: cache.NewLRU(consumerKeyUnknownEntryCacheTTL, consumerKeyCacheEvictionInterval, consumerKeyMaxCachedUnknown),
+		org:     org,
+	}
+}
+
+// ResolveConsumerKey returns the consumer key of the app with the attribute value.
+func (r *consumerKeyResolver) ResolveConsumerKey(attribute, value string) (string, error) {
+	if r == nil {
+		return "", errConsumerKeyAPIDisabled
+	}
+	cacheKey := attribute + "\x00" + value
+	if cached, ok := r.cache.Get(cacheKey); ok {
+		prometheusConsumerKeyCache.WithLabelValues(r.org, remoteCacheResultHit).Inc()
+		return cached.(string), nil
+	}
+	if cached, ok := r.unknown.Get(cacheKey); ok {
+		prometheusConsumerKeyCache.WithLabelValues(r.org, remoteCacheResultKnownBadEntry).Inc()
+		return "", cached.(error)
+	}
+	prometheusConsumerKeyCache.WithLabelValues(r.org, remoteCacheResultMiss).Inc()
+
+	key, err := r.fetchConsumerKey(attribute, value)
+	if err != nil {
+		if err == errUnknownConsumer {
+			r.unknown.Set(cacheKey, err)
+		}
+		return "", err
+	}
+	r.cache.Set(cacheKey, key)
+	return key, nil
+}
+
+func (r *consumerKeyResolver) fetchConsumerKey(attribute, value string) (string, error) {
+	if r.url == "" {
+		return "", fmt.Errorf("remote service API required to resolve consumer keys")
+	}
+	log.Debugf("resolving consumer key by app attribute %q", attribute)
+
+	body := new(bytes.Buffer)
+	_ = json.NewEncoder(body).Encode(consumerKeyRequest{Attribute: attribute, Value: value})
+	req, err := http.NewRequest(http.MethodPost, r.url, body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", errUnknownConsumer
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("consumerKey status: %d", resp.StatusCode)
+	}
+
+	keyResp := consumerKeyResponse{}
+	_ = json.NewDecoder(resp.Body).Decode(&keyResp)
+	if keyResp.ConsumerKey == "" {
+		return "", errUnknownConsumer
+	}
+	return keyResp.ConsumerKey, nil
+}
+
+var (
+	prometheusConsumerKeyCache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "consumer_key_cache_count",
+		Help:      "Number of consumer key by app attribute cache lookups by result",
+	}, []string{"org", "result"})
+)
@@ -0,0 +1,99 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestResolveConsumerKey(t *testing.T) {
+	calls := map[string]int{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/remote-service/consumerKey" {
+			t.Errorf("want: /remote-service/consumerKey, got: %s", r.URL.Path)
+		}
+		req := consumerKeyRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+		if req.Attribute != "spiffe_id" {
+			t.Errorf("want: spiffe_id, got: %s", req.Attribute)
+		}
+		calls[req.Value]++
+		switch req.Value {
+		case "known":
+			_ = json.NewEncoder(w).Encode(consumerKeyResponse{ConsumerKey: "key"})
+		case "unknown":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	remoteServiceAPI, _ := url.Parse(ts.URL + "/remote-service")
+	r := newConsumerKeyResolver(ts.Client(), remoteServiceAPI, time.Minute, "org")
+
+	// resolves and caches known value
+	for i := 0; i < 2; i++ {
+		key, err := r.ResolveConsumerKey("spiffe_id", "known")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if key != "key" {
+			t.Errorf("want: key, got: %s", key)
+		}
+	}
+	if calls["known"] != 1 {
+		t.Errorf("want: 1 call, got: %d", calls["known"])
+	}
+
+	// caches unknown value
+	for i := 0; i < 2; i++ {
+		if _, err := r.ResolveConsumerKey("spiffe_id", "unknown"); err != errUnknownConsumer {
+			t.Errorf("want: %v, got: %v", errUnknownConsumer, err)
+		}
+	}
+	if calls["unknown"] != 1 {
+		t.Errorf("want: 1 call, got: %d", calls["unknown"])
+	}
+
+	// does not cache errors
+	for i := 0; i < 2; i++ {
+		if _, err := r.ResolveConsumerKey("spiffe_id", "error"); err == nil || err == errUnknownConsumer {
+			t.Errorf("want internal error, got: %v", err)
+		}
+	}
+	if calls["error"] != 2 {
+		t.Errorf("want: 2 calls, got: %d", calls["error"])
+	}
+
+	// requires remote service api
+	r = newConsumerKeyResolver(ts.Client(), nil, time.Minute, "org")
+	if _, err := r.ResolveConsumerKey("spiffe_id", "known"); err == nil {
+		t.Errorf("want error without remote service API")
+	}
+
+	// disabled without auth.consumer_key_api
+	r = nil
+	if _, err := r.ResolveConsumerKey("spiffe_id", "known"); err != errConsumerKeyAPIDisabled {
+		t.Errorf("want: %v, got: %v", errConsumerKeyAPIDisabled, err)
+	}
+}
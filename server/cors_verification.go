@@ -0,0 +1,70 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	corsHeaderMatch    = "match"
+	corsHeaderMismatch = "mismatch"
+	corsHeaderMissing  = "missing"
+)
+
+// verifyCORSHeaders compares the CORS response headers computed during Check
+// with the response headers Envoy returned and logged, returning the result
+// for each expected header. Envoy must log the CORS headers in the access log
+// (additional_response_headers_to_log), otherwise all are reported missing.
+// Mismatches indicate a misconfigured cors filter or ext_authz response
+// header wiring in Envoy.
+func verifyCORSHeaders(expected, observed map[string]string) map[string]string {
+	if len(expected) == 0 {
+		return nil
+	}
+	results := make(map[string]string, len(expected))
+	for k, want := range expected {
+		got, ok := observed[strings.ToLower(k)]
+		switch {
+		case !ok:
+			results[k] = corsHeaderMissing
+		case got != want:
+			log.Debugf("CORS response header %s mismatch, want: %q, got: %q", k, want, got)
+			results[k] = corsHeaderMismatch
+		default:
+			results[k] = corsHeaderMatch
+		}
+	}
+	return results
+}
+
+// recordCORSVerification verifies and records the CORS response header results
+func recordCORSVerification(org, env, api string, expected, observed map[string]string) {
+	for header, result := range verifyCORSHeaders(expected, observed) {
+		prometheusCORSHeaderVerification.WithLabelValues(org, env, api, header, result).Inc()
+	}
+}
+
+var (
+	prometheusCORSHeaderVerification = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "analytics",
+		Name:      "cors_header_verification_count",
+		Help:      "Number of CORS response headers observed in access logs by result: match, mismatch, or missing (not returned or not logged)",
+	}, []string{"org", "env", "api", "header", "result"})
+)
@@ -0,0 +1,78 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/google/go-cmp/cmp"
+	prometheustest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestVerifyCORSHeaders(t *testing.T) {
+	expected := map[string]string{
+		config.CORSAllowOrigin:  "origin",
+		config.CORSAllowMethods: "GET,POST",
+		config.CORSMaxAge:       "42",
+	}
+
+	tests := []struct {
+		desc     string
+		expected map[string]string
+		observed map[string]string
+		want     map[string]string
+	}{
+		{"no cors", nil, map[string]string{config.CORSAllowOrigin: "*"}, nil},
+		{
+			"all match",
+			expected,
+			map[string]string{config.CORSAllowOrigin: "origin", config.CORSAllowMethods: "GET,POST", config.CORSMaxAge: "42"},
+			map[string]string{config.CORSAllowOrigin: corsHeaderMatch, config.CORSAllowMethods: corsHeaderMatch, config.CORSMaxAge: corsHeaderMatch},
+		},
+		{
+			"overwritten and missing",
+			expected,
+			map[string]string{config.CORSAllowOrigin: "*", config.CORSAllowMethods: "GET,POST"},
+			map[string]string{config.CORSAllowOrigin: corsHeaderMismatch, config.CORSAllowMethods: corsHeaderMatch, config.CORSMaxAge: corsHeaderMissing},
+		},
+		{
+			"not logged",
+			expected,
+			nil,
+			map[string]string{config.CORSAllowOrigin: corsHeaderMissing, config.CORSAllowMethods: corsHeaderMissing, config.CORSMaxAge: corsHeaderMissing},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			got := verifyCORSHeaders(test.expected, test.observed)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRecordCORSVerification(t *testing.T) {
+	counter := prometheusCORSHeaderVerification.WithLabelValues("org", "env", "api", config.CORSAllowOrigin, corsHeaderMismatch)
+	before := prometheustest.ToFloat64(counter)
+	recordCORSVerification("org", "env", "api",
+		map[string]string{config.CORSAllowOrigin: "origin"},
+		map[string]string{config.CORSAllowOrigin: "*"})
+	if got := prometheustest.ToFloat64(counter) - before; got != 1 {
+		t.Errorf("want: 1, got: %v", got)
+	}
+}
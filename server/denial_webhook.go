@@ -0,0 +1,243 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	denialWebhookSignatureHeader = "X-Apigee-Signature"
+
+	denialWebhookResultSent    = "sent"
+	denialWebhookResultFailed  = "failed"
+	denialWebhookResultDropped = "dropped"
+)
+
+// DenialEvent is a request denial sent to the denial webhook. Credentials,
+// including the client IDs that are API keys, and query strings are never
+// included.
+type DenialEvent struct {
+	Time            time.Time `json:"time"`
+	Class           string    `json:"class"`
+	Organization    string    `json:"organization"`
+	Environment     string    `json:"environment"`
+	API             string    `json:"api,omitempty"`
+	EnvironmentSpec string    `json:"environment_spec,omitempty"`
+	Operation       string    `json:"operation,omitempty"`
+	Method          string    `json:"method,omitempty"`
+	Path            string    `json:"path,omitempty"`
+	RequestID       string    `json:"request_id,omitempty"`
+	ClientIP        string    `json:"client_ip,omitempty"`
+	Application     string    `json:"application,omitempty"`
+	DeveloperEmail  string    `json:"developer_email,omitempty"`
+	Reason          string    `json:"reason,omitempty"`
+}
+
+// denialWebhook batches DenialEvents from a bounded queue and posts them to
+// the webhook so a slow webhook doesn't block checks. Events are dropped
+// while the queue is full.
+type denialWebhook struct {
+	cfg    config.DenialWebhook
+	org    string
+	client *http.Client
+	queue  chan DenialEvent
+	wg     sync.WaitGroup
+
+	mu      sync.RWMutex
+	stopped bool
+}
+
+// newDenialWebhook creates a denialWebhook of cfg, nil if no URL is set
+func newDenialWebhook(cfg config.DenialWebhook, org string) *denialWebhook {
+	if cfg.URL == "" {
+		return nil
+	}
+	return &denialWebhook{
+		cfg:    cfg,
+		org:    org,
+		client: &http.Client{Timeout: cfg.Timeout},
+		queue:  make(chan DenialEvent, cfg.QueueSize),
+	}
+}
+
+func (w *denialWebhook) start() {
+	if w == nil {
+		return
+	}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		t := time.NewTicker(w.cfg.FlushInterval)
+		defer t.Stop()
+		batch := make([]DenialEvent, 0, w.cfg.BatchSize)
+		flush := func() {
+			if len(batch) > 0 {
+				w.post(batch)
+				batch = batch[:0]
+			}
+		}
+		for {
+			select {
+			case e, ok := <-w.queue:
+				if !ok {
+					flush()
+					return
+				}
+				batch = append(batch, e)
+				if len(batch) >= w.cfg.BatchSize {
+					flush()
+				}
+			case <-t.C:
+				flush()
+			}
+		}
+	}()
+}
+
+// stop posts the queued events and waits for the last POST. Events
+// submitted after stop are dropped.
+func (w *denialWebhook) stop() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	if !w.stopped {
+		w.stopped = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+	w.wg.Wait()
+}
+
+// submit queues the event if its class is sent, returns false if it was
+// dropped
+func (w *denialWebhook) submit(e DenialEvent) bool {
+	if w == nil || !w.cfg.Sends(e.Class) {
+		return false
+	}
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if !w.stopped {
+		select {
+		case w.queue <- e:
+			return true
+		default:
+		}
+	}
+	log.Warnf("denial webhook queue full, dropped %s event of %s", e.Class, e.API)
+	prometheusDenialWebhookEvents.WithLabelValues(w.org, denialWebhookResultDropped).Add(1)
+	return false
+}
+
+// post sends a batch of events, signed if a secret is set
+func (w *denialWebhook) post(batch []DenialEvent) {
+	result := denialWebhookResultSent
+	if err := w.send(batch); err != nil {
+		log.Warnf("unable to post %d denial events: %v", len(batch), err)
+		result = denialWebhookResultFailed
+	}
+	prometheusDenialWebhookEvents.WithLabelValues(w.org, result).Add(float64(len(batch)))
+}
+
+func (w *denialWebhook) send(batch []DenialEvent) error {
+	body, err := json.Marshal(map[string]interface{}{"events": batch})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.cfg.Secret != "" {
+		req.Header.Set(denialWebhookSignatureHeader, signDenialEvents(w.cfg.Secret, time.Now().Unix(), body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// signDenialEvents returns the signature header value of body sent at
+// timestamp, the HMAC covers both so receivers can refuse replayed POSTs
+func signDenialEvents(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = fmt.Fprintf(mac, "%d.", timestamp)
+	_, _ = mac.Write(body)
+	return fmt.Sprintf("t=%d,sha256=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// notifyDenial submits the denial of the request to the webhook. Denials
+// forwarded by auth.allow_unauthorized are not sent.
+func (c *CheckContext) notifyDenial(class, reason string) {
+	h := c.server.handler
+	if h.denialWebhook == nil || (c.AuthContext != nil && h.allowUnauthorized) {
+		return
+	}
+	e := DenialEvent{
+		Time:         time.Now(),
+		Class:        class,
+		Organization: c.rootContext.Organization(),
+		Environment:  c.rootContext.Environment(),
+		API:          c.API,
+		Reason:       reason,
+	}
+	if c.EnvRequest != nil {
+		e.EnvironmentSpec = c.EnvRequest.ID
+		if op := c.EnvRequest.GetOperation(); op != nil {
+			e.Operation = op.Name
+		}
+	}
+	if attrs := c.Request.GetAttributes(); attrs != nil {
+		httpReq := attrs.GetRequest().GetHttp()
+		e.Method = httpReq.GetMethod()
+		e.Path = strings.SplitN(httpReq.GetPath(), "?", 2)[0]
+		e.RequestID = httpReq.GetId()
+		e.ClientIP = h.clientIP(c.Request)
+	}
+	if c.AuthContext != nil {
+		e.Application = c.AuthContext.Application
+		e.DeveloperEmail = c.AuthContext.DeveloperEmail
+	}
+	h.denialWebhook.submit(e)
+}
+
+var (
+	prometheusDenialWebhookEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "denial_webhook_event_count",
+		Help:      "Total number of denial events by webhook result: sent, failed, or dropped",
+	}, []string{"org", "result"})
+)
@@ -0,0 +1,177 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+)
+
+// testDenialWebhookServer records the events and signatures of each POST
+type testDenialWebhookServer struct {
+	*httptest.Server
+	mu         sync.Mutex
+	batches    [][]DenialEvent
+	signatures []string
+	bodies     [][]byte
+}
+
+func newTestDenialWebhookServer(t *testing.T) *testDenialWebhookServer {
+	s := &testDenialWebhookServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		var payload struct {
+			Events []DenialEvent `json:"events"`
+		}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("invalid body: %v", err)
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.batches = append(s.batches, payload.Events)
+		s.signatures = append(s.signatures, r.Header.Get(denialWebhookSignatureHeader))
+		s.bodies = append(s.bodies, body)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func testDenialWebhookConfig(url string) config.DenialWebhook {
+	cfg := config.Default().DenialWebhook
+	cfg.URL = url
+	return cfg
+}
+
+func TestDenialWebhookBatches(t *testing.T) {
+	srv := newTestDenialWebhookServer(t)
+	cfg := testDenialWebhookConfig(srv.URL)
+	cfg.Classes = []string{config.DenialInvalidCredential, config.DenialQuotaExceeded}
+	cfg.Secret = "secret"
+	cfg.BatchSize = 2
+	cfg.FlushInterval = time.Hour
+	w := newDenialWebhook(cfg, "org")
+	w.start()
+
+	for _, class := range []string{
+		config.DenialInvalidCredential,
+		config.DenialUnauthenticated,
+		config.DenialQuotaExceeded,
+		config.DenialQuotaExceeded,
+	} {
+		w.submit(DenialEvent{Class: class, API: "api"})
+	}
+	w.stop()
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.batches) != 2 || len(srv.batches[0]) != 2 || len(srv.batches[1]) != 1 {
+		t.Fatalf("want batches of 2 and 1 events, got %v", srv.batches)
+	}
+	for _, batch := range srv.batches {
+		for _, e := range batch {
+			if e.Class == config.DenialUnauthenticated {
+				t.Errorf("want %s events filtered", config.DenialUnauthenticated)
+			}
+		}
+	}
+	for i, sig := range srv.signatures {
+		var timestamp int64
+		if _, err := fmt.Sscanf(sig, "t=%d,", &timestamp); err != nil || time.Since(time.Unix(timestamp, 0)) > time.Minute {
+			t.Errorf("want recent timestamp in signature %q", sig)
+		}
+		if want := signDenialEvents("secret", timestamp, srv.bodies[i]); sig != want {
+			t.Errorf("want signature %q, got %q", want, sig)
+		}
+	}
+	if signDenialEvents("secret", 1, srv.bodies[0]) == signDenialEvents("secret", 2, srv.bodies[0]) {
+		t.Errorf("want signature to cover the timestamp")
+	}
+
+	if w.submit(DenialEvent{Class: config.DenialQuotaExceeded}) {
+		t.Errorf("want event dropped after stop")
+	}
+}
+
+func TestDenialWebhookQueueFull(t *testing.T) {
+	cfg := testDenialWebhookConfig("http://localhost/denials")
+	cfg.QueueSize = 1
+	w := newDenialWebhook(cfg, "org")
+	if !w.submit(DenialEvent{Class: config.DenialUnauthorized}) {
+		t.Errorf("want event queued")
+	}
+	if w.submit(DenialEvent{Class: config.DenialUnauthorized}) {
+		t.Errorf("want event dropped")
+	}
+
+	if newDenialWebhook(config.DenialWebhook{}, "org") != nil {
+		t.Errorf("want no webhook without a URL")
+	}
+}
+
+func TestNotifyDenial(t *testing.T) {
+	cfg := testDenialWebhookConfig("http://localhost/denials")
+	handler := &Handler{orgName: "org", envName: "env", denialWebhook: newDenialWebhook(cfg, "org")}
+	envoyReq := testutil.NewEnvoyRequest(http.MethodGet, "/v1/petstore?apikey=secret", map[string]string{}, nil)
+	envoyReq.Attributes.Request.Http.Id = "request-1"
+	c := &CheckContext{
+		Request:     envoyReq,
+		API:         "petstore",
+		AuthContext: &auth.Context{Application: "app", DeveloperEmail: "dev@example.com", ClientID: "key"},
+		server:      &AuthorizationServer{handler: handler},
+		rootContext: handler,
+	}
+	c.notifyDenial(config.DenialQuotaExceeded, "quota exceeded")
+
+	want := DenialEvent{
+		Class:          config.DenialQuotaExceeded,
+		Organization:   "org",
+		Environment:    "env",
+		API:            "petstore",
+		Method:         http.MethodGet,
+		Path:           "/v1/petstore",
+		RequestID:      "request-1",
+		Application:    "app",
+		DeveloperEmail: "dev@example.com",
+		Reason:         "quota exceeded",
+	}
+	select {
+	case got := <-handler.denialWebhook.queue:
+		got.Time = time.Time{}
+		if got != want {
+			t.Errorf("want %#v, got %#v", want, got)
+		}
+	default:
+		t.Fatal("want event queued")
+	}
+
+	handler.allowUnauthorized = true
+	c.notifyDenial(config.DenialQuotaExceeded, "quota exceeded")
+	if l := len(handler.denialWebhook.queue); l != 0 {
+		t.Errorf("want denials of allow_unauthorized not sent, got %d events", l)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	headerDPoP     = "dpop"
+	dpopAuthScheme = "dpop "
+	dpopProofType  = "dpop+jwt"
+
+	// proofs issued this far in the future are accepted for clock skew
+	dpopAcceptableSkew = 10 * time.Second
+
+	dpopResultOK       = "ok"
+	dpopResultMissing  = "missing"
+	dpopResultInvalid  = "invalid"
+	dpopResultReplayed = "replayed"
+)
+
+// dpopProofClaims are the claims of a DPoP proof
+type dpopProofClaims struct {
+	JTI string  `json:"jti"`
+	HTM string  `json:"htm"`
+	HTU string  `json:"htu"`
+	IAT float64 `json:"iat"`
+	ATH string  `json:"ath"`
+}
+
+// checkDPoP validates the DPoP proof of the request if its API has DPoP
+// enabled or its access token is bound to a DPoP key
+func checkDPoP(c *CheckContext) *authv3.CheckResponse {
+	policy := c.EnvRequest.GetDPoP()
+	jkt := dpopBoundThumbprint(c)
+	if policy.Mode == "" && jkt == "" {
+		return nil
+	}
+	org, env := c.rootContext.Organization(), c.rootContext.Environment()
+	spec, api := c.server.handler.metricScope(c.EnvRequest, c.API)
+
+	httpReq := c.Request.GetAttributes().GetRequest().GetHttp()
+	proof := httpReq.GetHeaders()[headerDPoP]
+	if proof == "" {
+		if policy.Mode != config.DPoPModeRequired && jkt == "" {
+			return nil
+		}
+		log.Debugf("DPoP proof required")
+		prometheusDPoPValidations.WithLabelValues(org, env, spec, api, dpopResultMissing).Inc()
+		return c.Unauthenticated()
+	}
+
+	var accessToken string
+	if authz := httpReq.GetHeaders()["authorization"]; strings.HasPrefix(strings.ToLower(authz), dpopAuthScheme) {
+		accessToken = strings.TrimSpace(authz[len(dpopAuthScheme):])
+	}
+	uri := httpReq.GetScheme() + "://" + httpReq.GetHost() + httpReq.GetPath()
+	var claims *dpopProofClaims
+	var thumbprint string
+	err := c.server.handler.jwtLimiter.CheckJWT(proof)
+	if err == nil {
+		claims, thumbprint, err = verifyDPoPProof(proof, httpReq.GetMethod(), uri, accessToken,
+			policy.GetMaxAge(), time.Now())
+	}
+	if err == nil && jkt != "" && jkt != thumbprint {
+		err = fmt.Errorf("access token is bound to another key")
+	}
+	if err != nil {
+		log.Debugf("invalid DPoP proof: %v", err)
+		prometheusDPoPValidations.WithLabelValues(org, env, spec, api, dpopResultInvalid).Inc()
+		return c.Unauthenticated()
+	}
+
+	iat := time.Unix(int64(claims.IAT), 0)
+	if !c.server.handler.dpopReplay.add(claims.JTI, iat.Add(policy.GetMaxAge()+dpopAcceptableSkew), time.Now()) {
+		log.Debugf("DPoP proof %q replayed", claims.JTI)
+		prometheusDPoPValidations.WithLabelValues(org, env, spec, api, dpopResultReplayed).Inc()
+		return c.Unauthenticated()
+	}
+	prometheusDPoPValidations.WithLabelValues(org, env, spec, api, dpopResultOK).Inc()
+	return nil
+}
+
+// dpopBoundThumbprint returns the "cnf" claim "jkt" of the verified access
+// token of the request, if any
+func dpopBoundThumbprint(c *CheckContext) string {
+	claimSets := []map[string]interface{}{c.EnvRequest.GetOAuthClaims()}
+	for _, jwtAuth := range c.EnvRequest.JWTAuthentications() {
+		if claims, err := c.EnvRequest.GetJWTResult(jwtAuth.Name); err == nil {
+			claimSets = append(claimSets, claims)
+		}
+	}
+	for _, claims := range claimSets {
+		if cnf, ok := claims["cnf"].(map[string]interface{}); ok {
+			if jkt, ok := cnf["jkt"].(string); ok && jkt != "" {
+				return jkt
+			}
+		}
+	}
+	return ""
+}
+
+// verifyDPoPProof verifies the signature of the proof by its embedded public
+// key and that it covers the request and access token. Returns the claims and
+// the base64url SHA-256 thumbprint of the key.
+func verifyDPoPProof(proof, method, uri, accessToken string, maxAge time.Duration, now time.Time) (*dpopProofClaims, string, error) {
+	msg, err := jws.Parse([]byte(proof))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(msg.Signatures()) != 1 {
+		return nil, "", fmt.Errorf("proof must have one signature")
+	}
+	headers := msg.Signatures()[0].ProtectedHeaders()
+	if headers.Type() != dpopProofType {
+		return nil, "", fmt.Errorf("proof typ must be %s, got %q", dpopProofType, headers.Type())
+	}
+	alg := headers.Algorithm()
+	switch alg {
+	case jwa.NoSignature, jwa.HS256, jwa.HS384, jwa.HS512, "":
+		return nil, "", fmt.Errorf("proof alg must be asymmetric, got %q", alg)
+	}
+	key := headers.JWK()
+	switch key.(type) {
+	case nil:
+		return nil, "", fmt.Errorf("proof has no jwk")
+	case jwk.RSAPrivateKey, jwk.ECDSAPrivateKey, jwk.OKPPrivateKey, jwk.SymmetricKey:
+		return nil, "", fmt.Errorf("proof jwk must be a public key")
+	}
+	var rawKey interface{}
+	if err := key.Raw(&rawKey); err != nil {
+		return nil, "", err
+	}
+	payload, err := jws.Verify([]byte(proof), alg, rawKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var claims dpopProofClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, "", err
+	}
+	if claims.JTI == "" {
+		return nil, "", fmt.Errorf("proof has no jti")
+	}
+	if claims.HTM != method {
+		return nil, "", fmt.Errorf("proof htm %q does not match %q", claims.HTM, method)
+	}
+	if !dpopURIMatch(claims.HTU, uri) {
+		return nil, "", fmt.Errorf("proof htu %q does not match %q", claims.HTU, uri)
+	}
+	iat := time.Unix(int64(claims.IAT), 0)
+	if iat.After(now.Add(dpopAcceptableSkew)) || now.Sub(iat) > maxAge {
+		return nil, "", fmt.Errorf("proof iat %s outside of max age %s", iat, maxAge)
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		if claims.ATH != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			return nil, "", fmt.Errorf("proof ath does not match the access token")
+		}
+	}
+
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, "", err
+	}
+	return &claims, base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
+
+// dpopURIMatch compares URIs without their query and fragment, ignoring the
+// case of the scheme and host and normalizing the path
+func dpopURIMatch(htu, uri string) bool {
+	normalize := func(u string) string {
+		if i := strings.IndexAny(u, "?#"); i >= 0 {
+			u = u[:i]
+		}
+		if i := strings.Index(u, "://"); i >= 0 {
+			rest := u[i+3:]
+			host, path := rest, ""
+			if j := strings.Index(rest, "/"); j >= 0 {
+				host, path = rest[:j], rest[j:]
+			}
+			path, _ = normalizeRequestPath(path)
+			return strings.ToLower(u[:i+3]+host) + path
+		}
+		return u
+	}
+	return htu != "" && normalize(htu) == normalize(uri)
+}
+
+var (
+	prometheusDPoPValidations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "dpop_validation_count",
+		Help:      "Total number of DPoP proof validations by result",
+	}, []string{"org", "env", "spec", "api", "result"})
+)
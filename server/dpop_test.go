@@ -0,0 +1,215 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
+	"github.com/gogo/googleapis/google/rpc"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
+)
+
+// testDPoPKey signs DPoP proofs
+type testDPoPKey struct {
+	t          *testing.T
+	privateKey *ecdsa.PrivateKey
+	publicKey  jwk.Key
+}
+
+func newTestDPoPKey(t *testing.T) *testDPoPKey {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := jwk.New(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testDPoPKey{t: t, privateKey: privateKey, publicKey: publicKey}
+}
+
+func (k *testDPoPKey) thumbprint() string {
+	tp, err := k.publicKey.Thumbprint(crypto.SHA256)
+	if err != nil {
+		k.t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(tp)
+}
+
+func (k *testDPoPKey) proof(typ string, claims map[string]interface{}) string {
+	headers := jws.NewHeaders()
+	if err := headers.Set(jws.TypeKey, typ); err != nil {
+		k.t.Fatal(err)
+	}
+	if err := headers.Set(jws.JWKKey, k.publicKey); err != nil {
+		k.t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		k.t.Fatal(err)
+	}
+	proof, err := jws.Sign(payload, jwa.ES256, k.privateKey, jws.WithHeaders(headers))
+	if err != nil {
+		k.t.Fatal(err)
+	}
+	return string(proof)
+}
+
+func TestVerifyDPoPProof(t *testing.T) {
+	key := newTestDPoPKey(t)
+	now := time.Now()
+	uri := "https://api.example.com/v1/petstore"
+	sum := sha256.Sum256([]byte("token"))
+	ath := base64.RawURLEncoding.EncodeToString(sum[:])
+	claims := func(modify func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{"jti": "id", "htm": http.MethodGet, "htu": uri, "iat": now.Unix()}
+		if modify != nil {
+			modify(c)
+		}
+		return c
+	}
+	hmacProof, err := jws.Sign([]byte(`{"jti":"id"}`), jwa.HS256, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc        string
+		proof       string
+		accessToken string
+		wantErr     bool
+	}{
+		{"valid", key.proof(dpopProofType, claims(nil)), "", false},
+		{"query and case ignored", key.proof(dpopProofType, claims(func(c map[string]interface{}) {
+			c["htu"] = "HTTPS://API.example.com/v1/petstore?x=1"
+		})), "", false},
+		{"ath", key.proof(dpopProofType, claims(func(c map[string]interface{}) { c["ath"] = ath })), "token", false},
+		{"wrong ath", key.proof(dpopProofType, claims(func(c map[string]interface{}) { c["ath"] = ath })), "other", true},
+		{"missing ath", key.proof(dpopProofType, claims(nil)), "token", true},
+		{"wrong typ", key.proof("JWT", claims(nil)), "", true},
+		{"symmetric", string(hmacProof), "", true},
+		{"not a jws", "bad", "", true},
+		{"wrong htm", key.proof(dpopProofType, claims(func(c map[string]interface{}) { c["htm"] = http.MethodPost })), "", true},
+		{"wrong htu", key.proof(dpopProofType, claims(func(c map[string]interface{}) { c["htu"] = uri + "/other" })), "", true},
+		{"stale", key.proof(dpopProofType, claims(func(c map[string]interface{}) { c["iat"] = now.Add(-time.Hour).Unix() })), "", true},
+		{"future", key.proof(dpopProofType, claims(func(c map[string]interface{}) { c["iat"] = now.Add(time.Hour).Unix() })), "", true},
+		{"no jti", key.proof(dpopProofType, claims(func(c map[string]interface{}) { delete(c, "jti") })), "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			_, thumbprint, err := verifyDPoPProof(test.proof, http.MethodGet, uri, test.accessToken, time.Minute, now)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if thumbprint != key.thumbprint() {
+				t.Errorf("want thumbprint %s, got: %s", key.thumbprint(), thumbprint)
+			}
+		})
+	}
+}
+
+func TestCheckDPoP(t *testing.T) {
+	envSpec := config.EnvironmentSpec{
+		ID: "spec",
+		APIs: []config.APISpec{
+			{ID: "required", BasePath: "/v1", DPoP: config.DPoP{Mode: config.DPoPModeRequired}},
+			{ID: "optional", BasePath: "/v2", DPoP: config.DPoP{Mode: config.DPoPModeOptional}},
+		},
+	}
+	if err := config.ValidateEnvironmentSpecs([]config.EnvironmentSpec{envSpec}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	specExt, err := config.NewEnvironmentSpecExt(&envSpec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	server := AuthorizationServer{
+		handler: &Handler{
+			authMan:      &testAuthMan{},
+			productMan:   &testProductMan{resolve: true},
+			quotaMan:     &testQuotaMan{},
+			analyticsMan: &testAnalyticsMan{},
+			envSpecsByID: map[string]*config.EnvironmentSpecExt{specExt.ID: specExt},
+			ready:        util.NewAtomicBool(true),
+			dpopReplay:   newReplayCache(),
+		},
+	}
+
+	key := newTestDPoPKey(t)
+	proof := func(path, jti string) string {
+		return key.proof(dpopProofType, map[string]interface{}{
+			"jti": jti,
+			"htm": http.MethodGet,
+			"htu": "https://api.example.com" + path,
+			"iat": time.Now().Unix(),
+		})
+	}
+	replayed := proof("/v1/petstore", "replayed")
+
+	tests := []struct {
+		desc     string
+		path     string
+		proof    string
+		wantCode rpc.Code
+	}{
+		{"required", "/v1/petstore", proof("/v1/petstore", "1"), rpc.OK},
+		{"required missing", "/v1/petstore", "", rpc.UNAUTHENTICATED},
+		{"first use", "/v1/petstore", replayed, rpc.OK},
+		{"replayed", "/v1/petstore", replayed, rpc.UNAUTHENTICATED},
+		{"wrong uri", "/v1/petstore", proof("/v1/other", "2"), rpc.UNAUTHENTICATED},
+		{"optional missing", "/v2/petstore", "", rpc.OK},
+		{"optional invalid", "/v2/petstore", "bad", rpc.UNAUTHENTICATED},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			headers := map[string]string{}
+			if test.proof != "" {
+				headers[headerDPoP] = test.proof
+			}
+			req := testutil.NewEnvoyRequest(http.MethodGet, test.path, headers, nil)
+			req.Attributes.Request.Http.Scheme = "https"
+			req.Attributes.Request.Http.Host = "api.example.com"
+			req.Attributes.ContextExtensions = map[string]string{envSpecContextKey: specExt.ID}
+			resp, err := server.Check(context.Background(), req)
+			if err != nil {
+				t.Fatalf("should not get error. got: %s", err)
+			}
+			if resp.Status.Code != int32(test.wantCode) {
+				t.Errorf("want: %d, got: %d", test.wantCode, resp.Status.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/util"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+)
+
+// environmentRouter selects the Apigee environment of a request
+// using the configured tenant environments.
+type environmentRouter struct {
+	names    map[string]bool   // environment name -> true
+	bySpecID map[string]string // environment spec ID -> environment name
+	hosts    []hostEnvironment // first match wins
+}
+
+type hostEnvironment struct {
+	host string
+	env  string
+}
+
+// newEnvironmentRouter returns nil if there are no environments.
+func newEnvironmentRouter(envs []config.TenantEnvironment) *environmentRouter {
+	if len(envs) == 0 {
+		return nil
+	}
+	r := &environmentRouter{
+		names:    make(map[string]bool, len(envs)),
+		bySpecID: make(map[string]string),
+	}
+	for _, e := range envs {
+		r.names[e.Name] = true
+		for _, id := range e.EnvironmentSpecIDs {
+			r.bySpecID[id] = e.Name
+		}
+		for _, h := range e.Hosts {
+			r.hosts = append(r.hosts, hostEnvironment{strings.ToLower(h), e.Name})
+		}
+	}
+	return r
+}
+
+// environment returns the environment for the request by its environment
+// spec, then by its host. Returns "" if none match.
+func (r *environmentRouter) environment(req *authv3.CheckRequest) string {
+	if r == nil {
+		return ""
+	}
+	if env, ok := r.bySpecID[req.Attributes.ContextExtensions[envSpecContextKey]]; ok {
+		return env
+	}
+	host := strings.ToLower(req.GetAttributes().GetRequest().GetHttp().GetHost())
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, h := range r.hosts {
+		if util.SimpleGlobMatch(h.host, host) {
+			return h.env
+		}
+	}
+	return ""
+}
+
+// allows returns true if env is a configured environment or
+// if no environments are configured.
+func (r *environmentRouter) allows(env string) bool {
+	return r == nil || r.names[env]
+}
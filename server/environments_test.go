@@ -0,0 +1,113 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
+	"github.com/gogo/googleapis/google/rpc"
+)
+
+func TestEnvironmentRouter(t *testing.T) {
+	if r := newEnvironmentRouter(nil); r != nil {
+		t.Errorf("want nil router for no environments")
+	}
+	var nilRouter *environmentRouter
+	if !nilRouter.allows("any") {
+		t.Errorf("nil router should allow any environment")
+	}
+
+	r := newEnvironmentRouter([]config.TenantEnvironment{
+		{Name: "test", Hosts: []string{"test.example.com", "*.test.example.com"}},
+		{Name: "prod", Hosts: []string{"*.example.com"}, EnvironmentSpecIDs: []string{"prod-spec"}},
+	})
+
+	tests := []struct {
+		desc   string
+		host   string
+		specID string
+		want   string
+	}{
+		{"exact host", "test.example.com", "", "test"},
+		{"host with port", "test.example.com:8080", "", "test"},
+		{"host case", "Test.Example.com", "", "test"},
+		{"wildcard host", "api.test.example.com", "", "test"},
+		{"first host match wins", "www.example.com", "", "prod"},
+		{"spec before host", "test.example.com", "prod-spec", "prod"},
+		{"unknown spec uses host", "test.example.com", "other-spec", "test"},
+		{"no match", "example.org", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			req := testutil.NewEnvoyRequest(http.MethodGet, "/", nil, nil)
+			req.Attributes.Request.Http.Host = test.host
+			if test.specID != "" {
+				req.Attributes.ContextExtensions = map[string]string{envSpecContextKey: test.specID}
+			}
+			if got := r.environment(req); got != test.want {
+				t.Errorf("want: %q, got: %q", test.want, got)
+			}
+		})
+	}
+
+	if !r.allows("prod") || r.allows("other") {
+		t.Errorf("router should only allow configured environments")
+	}
+}
+
+func TestCheckTenantEnvironments(t *testing.T) {
+	server := AuthorizationServer{
+		handler: &Handler{
+			orgName:       "org",
+			envName:       "*",
+			isMultitenant: true,
+			analyticsMan:  &testAnalyticsMan{},
+			ready:         util.NewAtomicBool(true),
+			envRouter: newEnvironmentRouter([]config.TenantEnvironment{
+				{Name: "test", Hosts: []string{"test.example.com"}},
+			}),
+		},
+	}
+
+	tests := []struct {
+		desc string
+		host string
+		env  string
+	}{
+		{"no matching host", "example.org", ""},
+		{"not a tenant environment", "test.example.com", "prod"},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			req := testutil.NewEnvoyRequest(http.MethodGet, "/", map[string]string{}, nil)
+			req.Attributes.Request.Http.Host = test.host
+			if test.env != "" {
+				req.Attributes.ContextExtensions = map[string]string{envContextKey: test.env}
+			}
+			resp, err := server.Check(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Status.Code != int32(rpc.INTERNAL) {
+				t.Errorf("want: %d, got: %d", rpc.INTERNAL, resp.Status.Code)
+			}
+		})
+	}
+}
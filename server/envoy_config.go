@@ -0,0 +1,383 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	accesslogv3 "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
+	bootstrapv3 "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v3"
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	grpcalv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/grpc/v3"
+	corsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/cors/v3"
+	extauthzv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_authz/v3"
+	grpcstatsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/grpc_stats/v3"
+	routerv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
+	hcmv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	matcherv3 "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const (
+	envoyAdapterCluster = "apigee-remote-service-envoy"
+	envoyTargetCluster  = "target"
+	envoyListenerName   = "apigee-ingress"
+
+	envoyHCMFilter      = "envoy.filters.network.http_connection_manager"
+	envoyCorsFilter     = "envoy.filters.http.cors"
+	envoyExtAuthzFilter = "envoy.filters.http.ext_authz"
+	envoyRouterFilter   = "envoy.filters.http.router"
+	envoyGrpcAccessLog  = "envoy.access_loggers.http_grpc"
+)
+
+// EnvoyConfigOptions are the deployment details of GenerateEnvoyConfig not
+// described by the environment specs.
+type EnvoyConfigOptions struct {
+	// ListenerAddress is the host:port Envoy listens on.
+	ListenerAddress string
+	// AdapterAddress is the host:port of the gRPC API of this adapter.
+	AdapterAddress string
+	// TargetAddress is the host:port requests of the APIs are routed to.
+	TargetAddress string
+	// Environment is sent as apigee_environment in multi-tenant mode.
+	Environment string
+	// NodeID and Cluster identify the Envoy as apigee_envoy_node and
+	// apigee_envoy_cluster, only specs and APIs in their gateway scope are
+	// routed.
+	NodeID  string
+	Cluster string
+	// CheckTimeout of the ext_authz requests.
+	CheckTimeout time.Duration
+}
+
+// GenerateEnvoyConfig derives an Envoy bootstrap routing the APIs of the
+// specs by base path to the target through the ext_authz and CORS filters,
+// with the context extensions selecting the spec and access logs sent to
+// this adapter for analytics. Base paths must be unique across the specs.
+func GenerateEnvoyConfig(specs []config.EnvironmentSpec, opts EnvoyConfigOptions) (*bootstrapv3.Bootstrap, error) {
+	listenerAddress, err := envoySocketAddress("listener", opts.ListenerAddress)
+	if err != nil {
+		return nil, err
+	}
+	adapterAddress, err := envoySocketAddress("adapter", opts.AdapterAddress)
+	if err != nil {
+		return nil, err
+	}
+	targetAddress, err := envoySocketAddress("target", opts.TargetAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	routes, cors, err := envoyRoutes(specs, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var httpFilters []*hcmv3.HttpFilter
+	if cors {
+		httpFilters = append(httpFilters, envoyHTTPFilter(envoyCorsFilter, &corsv3.Cors{}))
+	}
+	httpFilters = append(httpFilters,
+		envoyExtAuthz(envoyAdapterCluster, opts.CheckTimeout),
+		envoyHTTPFilter(envoyGrpcStatsFilter, &grpcstatsv3.FilterConfig{EmitFilterState: true}),
+		envoyHTTPFilter(envoyRouterFilter, &routerv3.Router{}))
+
+	hcm := &hcmv3.HttpConnectionManager{
+		StatPrefix: "ingress_http",
+		RouteSpecifier: &hcmv3.HttpConnectionManager_RouteConfig{
+			RouteConfig: &routev3.RouteConfiguration{
+				Name: envoyListenerName,
+				VirtualHosts: []*routev3.VirtualHost{{
+					Name:    "default",
+					Domains: []string{"*"},
+					Routes:  routes,
+				}},
+			},
+		},
+		HttpFilters: httpFilters,
+		AccessLog:   []*accesslogv3.AccessLog{envoyAccessLog(envoyAdapterCluster, cors)},
+	}
+
+	return &bootstrapv3.Bootstrap{
+		StaticResources: &bootstrapv3.Bootstrap_StaticResources{
+			Listeners: []*listenerv3.Listener{{
+				Name:    envoyListenerName,
+				Address: listenerAddress,
+				FilterChains: []*listenerv3.FilterChain{{
+					Filters: []*listenerv3.Filter{{
+						Name:       envoyHCMFilter,
+						ConfigType: &listenerv3.Filter_TypedConfig{TypedConfig: mustMarshalAny(hcm)},
+					}},
+				}},
+			}},
+			Clusters: []*clusterv3.Cluster{
+				envoyCluster(envoyTargetCluster, targetAddress, false),
+				envoyCluster(envoyAdapterCluster, adapterAddress, true),
+			},
+		},
+	}, nil
+}
+
+// envoyAPIRoute is an API routed by its base path
+type envoyAPIRoute struct {
+	spec *config.EnvironmentSpec
+	api  *config.APISpec
+}
+
+// envoyRoutes returns the routes of the APIs in scope, longest base path
+// first, and whether any has a CORS policy
+func envoyRoutes(specs []config.EnvironmentSpec, opts EnvoyConfigOptions) ([]*routev3.Route, bool, error) {
+	var apis []envoyAPIRoute
+	basePaths := make(map[string]string)
+	for i := range specs {
+		spec := &specs[i]
+		if !spec.GatewayScope.Includes(opts.NodeID, opts.Cluster) {
+			continue
+		}
+		for j := range spec.APIs {
+			api := &spec.APIs[j]
+			if !api.GatewayScope.Includes(opts.NodeID, opts.Cluster) {
+				continue
+			}
+			basePath := envoyBasePath(api.BasePath)
+			if other, ok := basePaths[basePath]; ok {
+				return nil, false, fmt.Errorf("API %q of environment spec %q and %s have the same base path %s",
+					api.ID, spec.ID, other, basePath)
+			}
+			basePaths[basePath] = fmt.Sprintf("API %q of environment spec %q", api.ID, spec.ID)
+			apis = append(apis, envoyAPIRoute{spec: spec, api: api})
+		}
+	}
+	sort.SliceStable(apis, func(i, j int) bool {
+		return len(envoyBasePath(apis[i].api.BasePath)) > len(envoyBasePath(apis[j].api.BasePath))
+	})
+
+	var routes []*routev3.Route
+	cors := false
+	for _, r := range apis {
+		contextExtensions := map[string]string{envSpecContextKey: r.spec.ID}
+		for k, v := range map[string]string{
+			envContextKey:          opts.Environment,
+			envoyNodeContextKey:    opts.NodeID,
+			envoyClusterContextKey: opts.Cluster,
+		} {
+			if v != "" {
+				contextExtensions[k] = v
+			}
+		}
+		action := &routev3.RouteAction{
+			ClusterSpecifier: &routev3.RouteAction_Cluster{Cluster: envoyTargetCluster},
+		}
+		// path scoped policies are applied by the adapter, Envoy's would
+		// answer preflights of the whole API
+		if policy := envoyCorsPolicy(r.api.Cors); policy != nil && len(r.api.CorsScopes) == 0 {
+			action.Cors = policy
+			cors = true
+		}
+		routes = append(routes, &routev3.Route{
+			Name: fmt.Sprintf("%s/%s", r.spec.ID, r.api.ID),
+			Match: &routev3.RouteMatch{
+				PathSpecifier: &routev3.RouteMatch_Prefix{Prefix: envoyBasePath(r.api.BasePath)},
+			},
+			Action: &routev3.Route_Route{Route: action},
+			TypedPerFilterConfig: map[string]*anypb.Any{
+				envoyExtAuthzFilter: mustMarshalAny(&extauthzv3.ExtAuthzPerRoute{
+					Override: &extauthzv3.ExtAuthzPerRoute_CheckSettings{
+						CheckSettings: &extauthzv3.CheckSettings{ContextExtensions: contextExtensions},
+					},
+				}),
+			},
+		})
+	}
+	return routes, cors, nil
+}
+
+// envoyCorsPolicy returns the route CORS policy of the API, nil if no
+// origins are allowed
+func envoyCorsPolicy(c config.CorsPolicy) *routev3.CorsPolicy {
+	if len(c.AllowOrigins) == 0 && len(c.AllowOriginsRegexes) == 0 {
+		return nil
+	}
+	policy := &routev3.CorsPolicy{
+		AllowMethods:  strings.Join(c.AllowMethods, ","),
+		AllowHeaders:  strings.Join(c.AllowHeaders, ","),
+		ExposeHeaders: strings.Join(c.ExposeHeaders, ","),
+	}
+	wildcard := false
+	for _, origin := range c.AllowOrigins {
+		if origin == "*" {
+			wildcard = true
+			continue
+		}
+		policy.AllowOriginStringMatch = append(policy.AllowOriginStringMatch, &matcherv3.StringMatcher{
+			MatchPattern: &matcherv3.StringMatcher_Exact{Exact: origin},
+		})
+	}
+	regexes := c.AllowOriginsRegexes
+	if wildcard { // as a last resort, after the exact origins
+		regexes = append(append([]string{}, regexes...), ".*")
+	}
+	for _, regex := range regexes {
+		policy.AllowOriginStringMatch = append(policy.AllowOriginStringMatch, &matcherv3.StringMatcher{
+			MatchPattern: &matcherv3.StringMatcher_SafeRegex{SafeRegex: &matcherv3.RegexMatcher{
+				EngineType: &matcherv3.RegexMatcher_GoogleRe2{GoogleRe2: &matcherv3.RegexMatcher_GoogleRE2{}},
+				Regex:      regex,
+			}},
+		})
+	}
+	if c.MaxAge > 0 {
+		policy.MaxAge = strconv.Itoa(c.MaxAge)
+	}
+	if c.AllowCredentials && !wildcard {
+		policy.AllowCredentials = wrapperspb.Bool(true)
+	}
+	return policy
+}
+
+// envoyBasePath returns the route prefix of a base path
+func envoyBasePath(basePath string) string {
+	if !strings.HasPrefix(basePath, "/") {
+		basePath = "/" + basePath
+	}
+	return basePath
+}
+
+// envoyExtAuthz is the ext_authz filter checking requests with the adapter
+// of cluster, within timeout or 1s
+func envoyExtAuthz(cluster string, timeout time.Duration) *hcmv3.HttpFilter {
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	return envoyHTTPFilter(envoyExtAuthzFilter, &extauthzv3.ExtAuthz{
+		TransportApiVersion: core.ApiVersion_V3,
+		Services: &extauthzv3.ExtAuthz_GrpcService{
+			GrpcService: envoyAdapterService(cluster, timeout),
+		},
+		ClearRouteCache: true,
+	})
+}
+
+// envoyAccessLog sends access logs to the adapter of cluster for analytics,
+// with the CORS headers verified against those computed by the adapter if
+// cors
+func envoyAccessLog(cluster string, cors bool) *accesslogv3.AccessLog {
+	accessLog := &grpcalv3.HttpGrpcAccessLogConfig{
+		CommonConfig: &grpcalv3.CommonGrpcAccessLogConfig{
+			LogName:             envoyAdapterCluster,
+			TransportApiVersion: core.ApiVersion_V3,
+			GrpcService:         envoyAdapterService(cluster, 0),
+			// message counts of gRPC streams for analytics
+			FilterStateObjectsToLog: []string{envoyGrpcStatsFilter},
+		},
+		AdditionalRequestHeadersToLog:   []string{":authority"},
+		AdditionalResponseHeadersToLog:  []string{"grpc-status", "grpc-message"},
+		AdditionalResponseTrailersToLog: []string{"grpc-status", "grpc-message"},
+	}
+	if cors {
+		accessLog.AdditionalResponseHeadersToLog = append(accessLog.AdditionalResponseHeadersToLog,
+			"access-control-allow-origin", "access-control-allow-credentials", "access-control-expose-headers")
+	}
+	return &accesslogv3.AccessLog{
+		Name:       envoyGrpcAccessLog,
+		ConfigType: &accesslogv3.AccessLog_TypedConfig{TypedConfig: mustMarshalAny(accessLog)},
+	}
+}
+
+// envoyAdapterService is the gRPC service of the adapter of cluster
+func envoyAdapterService(cluster string, timeout time.Duration) *core.GrpcService {
+	service := &core.GrpcService{
+		TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+			EnvoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: cluster},
+		},
+	}
+	if timeout > 0 {
+		service.Timeout = durationpb.New(timeout)
+	}
+	return service
+}
+
+func envoyHTTPFilter(name string, config proto.Message) *hcmv3.HttpFilter {
+	return &hcmv3.HttpFilter{
+		Name:       name,
+		ConfigType: &hcmv3.HttpFilter_TypedConfig{TypedConfig: mustMarshalAny(config)},
+	}
+}
+
+// envoyCluster is a DNS cluster of the address, using HTTP/2 if grpc
+func envoyCluster(name string, address *core.Address, grpc bool) *clusterv3.Cluster {
+	cluster := &clusterv3.Cluster{
+		Name:                 name,
+		ClusterDiscoveryType: &clusterv3.Cluster_Type{Type: clusterv3.Cluster_LOGICAL_DNS},
+		DnsLookupFamily:      clusterv3.Cluster_V4_ONLY,
+		ConnectTimeout:       durationpb.New(2 * time.Second),
+		LoadAssignment: &endpointv3.ClusterLoadAssignment{
+			ClusterName: name,
+			Endpoints: []*endpointv3.LocalityLbEndpoints{{
+				LbEndpoints: []*endpointv3.LbEndpoint{{
+					HostIdentifier: &endpointv3.LbEndpoint_Endpoint{
+						Endpoint: &endpointv3.Endpoint{Address: address},
+					},
+				}},
+			}},
+		},
+	}
+	if grpc {
+		cluster.Http2ProtocolOptions = &core.Http2ProtocolOptions{}
+	}
+	return cluster
+}
+
+// envoySocketAddress parses the host:port of the named address
+func envoySocketAddress(name, hostPort string) (*core.Address, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, fmt.Errorf("%s address must be host:port, got %q", name, hostPort)
+	}
+	portValue, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%s address port must be a number, got %q", name, port)
+	}
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	return &core.Address{
+		Address: &core.Address_SocketAddress{SocketAddress: &core.SocketAddress{
+			Address:       host,
+			PortSpecifier: &core.SocketAddress_PortValue{PortValue: uint32(portValue)},
+		}},
+	}, nil
+}
+
+// mustMarshalAny wraps m, which can't fail for the generated messages
+func mustMarshalAny(m proto.Message) *anypb.Any {
+	a, err := anypb.New(m)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
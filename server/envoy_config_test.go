@@ -0,0 +1,178 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	extauthzv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_authz/v3"
+	hcmv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestGenerateEnvoyConfig(t *testing.T) {
+	specs := []config.EnvironmentSpec{
+		{
+			ID: "spec-1",
+			APIs: []config.APISpec{
+				{ID: "root", BasePath: "/v1"},
+				{ID: "orders", BasePath: "/v1/orders", Cors: config.CorsPolicy{
+					AllowOrigins:     []string{"https://a.example.com"},
+					AllowMethods:     []string{"GET", "POST"},
+					MaxAge:           600,
+					AllowCredentials: true,
+				}},
+				{ID: "other-node", BasePath: "/other", GatewayScope: config.GatewayScope{NodeIDs: []string{"other"}}},
+			},
+		},
+		{
+			ID:   "spec-2",
+			APIs: []config.APISpec{{ID: "pets", BasePath: "pets"}},
+		},
+	}
+	opts := EnvoyConfigOptions{
+		ListenerAddress: ":8080",
+		AdapterAddress:  "localhost:5000",
+		TargetAddress:   "httpbin.org:80",
+		Environment:     "test",
+		NodeID:          "node-1",
+	}
+	bootstrap, err := GenerateEnvoyConfig(specs, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	resources := bootstrap.GetStaticResources()
+	if got := len(resources.GetClusters()); got != 2 {
+		t.Errorf("want 2 clusters, got %d", got)
+	}
+	hcm := &hcmv3.HttpConnectionManager{}
+	if err := resources.GetListeners()[0].GetFilterChains()[0].GetFilters()[0].GetTypedConfig().UnmarshalTo(hcm); err != nil {
+		t.Fatal(err)
+	}
+	var filters []string
+	for _, f := range hcm.GetHttpFilters() {
+		filters = append(filters, f.GetName())
+	}
+	if diff := cmp.Diff([]string{envoyCorsFilter, envoyExtAuthzFilter, envoyGrpcStatsFilter, envoyRouterFilter}, filters); diff != "" {
+		t.Errorf("filters diff (-want +got):\n%s", diff)
+	}
+
+	routes := hcm.GetRouteConfig().GetVirtualHosts()[0].GetRoutes()
+	var prefixes []string
+	for _, r := range routes {
+		prefixes = append(prefixes, r.GetMatch().GetPrefix())
+	}
+	if diff := cmp.Diff([]string{"/v1/orders", "/pets", "/v1"}, prefixes); diff != "" {
+		t.Errorf("route prefixes diff (-want +got):\n%s", diff)
+	}
+
+	perRoute := &extauthzv3.ExtAuthzPerRoute{}
+	if err := routes[1].GetTypedPerFilterConfig()[envoyExtAuthzFilter].UnmarshalTo(perRoute); err != nil {
+		t.Fatal(err)
+	}
+	wantExtensions := map[string]string{
+		envSpecContextKey:   "spec-2",
+		envContextKey:       "test",
+		envoyNodeContextKey: "node-1",
+	}
+	if diff := cmp.Diff(wantExtensions, perRoute.GetCheckSettings().GetContextExtensions()); diff != "" {
+		t.Errorf("context extensions diff (-want +got):\n%s", diff)
+	}
+
+	cors := routes[0].GetRoute().GetCors()
+	if cors == nil {
+		t.Fatal("want CORS policy")
+	}
+	if got := cors.GetAllowOriginStringMatch()[0].GetExact(); got != "https://a.example.com" {
+		t.Errorf("want exact origin, got %q", got)
+	}
+	if cors.GetAllowMethods() != "GET,POST" || cors.GetMaxAge() != "600" || !cors.GetAllowCredentials().GetValue() {
+		t.Errorf("unexpected CORS policy: %v", cors)
+	}
+	if routes[2].GetRoute().GetCors() != nil {
+		t.Errorf("want no CORS policy, got %v", routes[2].GetRoute().GetCors())
+	}
+}
+
+func TestGenerateEnvoyConfigErrors(t *testing.T) {
+	good := EnvoyConfigOptions{ListenerAddress: ":8080", AdapterAddress: "localhost:5000", TargetAddress: "target:80"}
+	tests := []struct {
+		desc  string
+		specs []config.EnvironmentSpec
+		opts  func(o *EnvoyConfigOptions)
+		want  string
+	}{
+		{"duplicate base path", []config.EnvironmentSpec{
+			{ID: "spec-1", APIs: []config.APISpec{{ID: "a", BasePath: "/v1"}}},
+			{ID: "spec-2", APIs: []config.APISpec{{ID: "b", BasePath: "/v1"}}},
+		}, nil, "same base path /v1"},
+		{"target address", nil, func(o *EnvoyConfigOptions) { o.TargetAddress = "" }, "target address must be host:port"},
+		{"adapter port", nil, func(o *EnvoyConfigOptions) { o.AdapterAddress = "localhost:grpc" }, "adapter address port must be a number"},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			opts := good
+			if test.opts != nil {
+				test.opts(&opts)
+			}
+			_, err := GenerateEnvoyConfig(test.specs, opts)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("want error containing %q, got: %v", test.want, err)
+			}
+		})
+	}
+}
+
+func TestEnvoyCorsPolicyWildcard(t *testing.T) {
+	policy := envoyCorsPolicy(config.CorsPolicy{
+		AllowOrigins:     []string{"*", "https://a.example.com"},
+		AllowCredentials: true,
+	})
+	matchers := policy.GetAllowOriginStringMatch()
+	if len(matchers) != 2 || matchers[0].GetExact() != "https://a.example.com" || matchers[1].GetSafeRegex().GetRegex() != ".*" {
+		t.Errorf("want exact origin then wildcard, got %v", matchers)
+	}
+	if policy.GetAllowCredentials() != nil {
+		t.Errorf("want no credentials with wildcard origin")
+	}
+	if envoyCorsPolicy(config.CorsPolicy{AllowMethods: []string{"GET"}}) != nil {
+		t.Errorf("want no policy without origins")
+	}
+}
+
+func TestEnvoyRoutesCorsScopes(t *testing.T) {
+	policy := config.CorsPolicy{AllowOrigins: []string{"https://a.example.com"}}
+	specs := []config.EnvironmentSpec{{
+		ID: "spec",
+		APIs: []config.APISpec{{
+			ID:       "pets",
+			BasePath: "/pets",
+			Cors:     policy,
+			CorsScopes: []config.ScopedCorsPolicy{{
+				PathTemplates: []string{"/admin/**"},
+			}},
+		}},
+	}}
+	routes, cors, err := envoyRoutes(specs, EnvoyConfigOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cors || routes[0].GetRoute().GetCors() != nil {
+		t.Errorf("want CORS of API with scoped policies left to the adapter")
+	}
+}
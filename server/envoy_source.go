@@ -0,0 +1,69 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	als "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v3"
+)
+
+const (
+	// analytics attributes identifying the Envoy of an access log stream
+	envoyNodeAttribute    = "envoy.node"
+	envoyClusterAttribute = "envoy.cluster"
+
+	// metric label value of streams not identifying their cluster
+	unknownEnvoyCluster = "unknown"
+)
+
+// envoySource is the Envoy node of an access log or metrics stream. Envoy
+// identifies itself in the first message of each stream only.
+type envoySource struct {
+	node    string
+	cluster string
+}
+
+func envoySourceFrom(id *als.StreamAccessLogsMessage_Identifier) envoySource {
+	return envoyNodeSource(id.GetNode())
+}
+
+func envoyNodeSource(node *core.Node) envoySource {
+	return envoySource{
+		node:    node.GetId(),
+		cluster: node.GetCluster(),
+	}
+}
+
+// attributes returns the known node ID and cluster as analytics attributes
+func (s envoySource) attributes() []analytics.Attribute {
+	var attributes []analytics.Attribute
+	if s.node != "" {
+		attributes = append(attributes, analytics.Attribute{Name: envoyNodeAttribute, Value: s.node})
+	}
+	if s.cluster != "" {
+		attributes = append(attributes, analytics.Attribute{Name: envoyClusterAttribute, Value: s.cluster})
+	}
+	return attributes
+}
+
+// metricCluster returns the cluster as a metric label value. Node IDs are
+// not used as labels as each Envoy replica has its own.
+func (s envoySource) metricCluster() string {
+	if s.cluster == "" {
+		return unknownEnvoyCluster
+	}
+	return s.cluster
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	als "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v3"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEnvoySource(t *testing.T) {
+	tests := []struct {
+		desc        string
+		id          *als.StreamAccessLogsMessage_Identifier
+		wantAttrs   []analytics.Attribute
+		wantCluster string
+	}{
+		{"nil", nil, nil, unknownEnvoyCluster},
+		{"no node", &als.StreamAccessLogsMessage_Identifier{LogName: "log"}, nil, unknownEnvoyCluster},
+		{"node only", &als.StreamAccessLogsMessage_Identifier{Node: &core.Node{Id: "node-1"}},
+			[]analytics.Attribute{{Name: envoyNodeAttribute, Value: "node-1"}}, unknownEnvoyCluster},
+		{"node and cluster", &als.StreamAccessLogsMessage_Identifier{Node: &core.Node{Id: "node-1", Cluster: "fleet-a"}},
+			[]analytics.Attribute{
+				{Name: envoyNodeAttribute, Value: "node-1"},
+				{Name: envoyClusterAttribute, Value: "fleet-a"},
+			}, "fleet-a"},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			source := envoySourceFrom(test.id)
+			if diff := cmp.Diff(test.wantAttrs, source.attributes()); diff != "" {
+				t.Errorf("diff (-want +got):\n%s", diff)
+			}
+			if got := source.metricCluster(); got != test.wantCluster {
+				t.Errorf("want cluster %q, got: %q", test.wantCluster, got)
+			}
+		})
+	}
+}
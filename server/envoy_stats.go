@@ -0,0 +1,184 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io"
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	metricsv3 "github.com/envoyproxy/go-control-plane/envoy/service/metrics/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+)
+
+// prefix of the stats of Envoy upstream clusters, cluster.<name>.<stat>
+const envoyClusterStatPrefix = "cluster."
+
+// envoyClusterStat is an Envoy upstream cluster stat aggregated by API
+type envoyClusterStat struct {
+	name    string
+	counter *prometheus.CounterVec // set for counters
+	gauge   *prometheus.GaugeVec   // set for gauges
+	class   string                 // response class label of counter, if any
+}
+
+// envoyClusterStats are the stats of the upstream clusters aggregated
+var envoyClusterStats = []envoyClusterStat{
+	{name: "upstream_rq_1xx", counter: prometheusUpstreamRequests, class: "1xx"},
+	{name: "upstream_rq_2xx", counter: prometheusUpstreamRequests, class: "2xx"},
+	{name: "upstream_rq_3xx", counter: prometheusUpstreamRequests, class: "3xx"},
+	{name: "upstream_rq_4xx", counter: prometheusUpstreamRequests, class: "4xx"},
+	{name: "upstream_rq_5xx", counter: prometheusUpstreamRequests, class: "5xx"},
+	{name: "upstream_rq_timeout", counter: prometheusUpstreamTimeouts},
+	{name: "upstream_cx_connect_fail", counter: prometheusUpstreamConnectFailures},
+	{name: "membership_healthy", gauge: prometheusUpstreamHealthyHosts},
+	{name: "membership_total", gauge: prometheusUpstreamHosts},
+}
+
+// parseEnvoyClusterStat returns the upstream cluster and aggregated stat of
+// an Envoy stat name, false if not aggregated. Cluster names may have dots.
+func parseEnvoyClusterStat(name string) (string, *envoyClusterStat, bool) {
+	if !strings.HasPrefix(name, envoyClusterStatPrefix) {
+		return "", nil, false
+	}
+	name = strings.TrimPrefix(name, envoyClusterStatPrefix)
+	for i := range envoyClusterStats {
+		stat := &envoyClusterStats[i]
+		if cluster := strings.TrimSuffix(name, "."+stat.name); cluster != name && cluster != "" {
+			return cluster, stat, true
+		}
+	}
+	return "", nil, false
+}
+
+// MetricsServer receives the stats Envoy streams to its metrics service and
+// aggregates those of the upstream clusters of APIs, see config.EnvoyStats.
+type MetricsServer struct {
+	handler *Handler
+}
+
+// Register registers
+func (m *MetricsServer) Register(s *grpc.Server, handler *Handler) {
+	metricsv3.RegisterMetricsServiceServer(s, m)
+	m.handler = handler
+}
+
+// StreamMetrics receives the stats of an Envoy until it closes the stream.
+// Envoy identifies itself in the first message of each stream only.
+func (m *MetricsServer) StreamMetrics(srv metricsv3.MetricsService_StreamMetricsServer) error {
+	var source envoySource
+	counters := make(map[string]float64) // last cumulative values of the stream
+	for {
+		msg, err := srv.Recv()
+		if err == io.EOF {
+			return srv.SendAndClose(&metricsv3.StreamMetricsResponse{})
+		}
+		if err != nil {
+			return err
+		}
+		if id := msg.GetIdentifier(); id != nil {
+			source = envoyNodeSource(id.GetNode())
+			log.Debugf("metrics stream from node %q of cluster %q", source.node, source.cluster)
+		}
+		m.handleMetrics(msg.GetEnvoyMetrics(), source, counters)
+		prometheusEnvoyStatsMessages.WithLabelValues(m.handler.orgName, source.metricCluster()).Inc()
+	}
+}
+
+// handleMetrics records the stats of the upstream clusters of APIs. Envoy
+// reports cumulative counters, the increase since the last report of the
+// stream is counted, none on the first.
+func (m *MetricsServer) handleMetrics(families []*dto.MetricFamily, source envoySource, counters map[string]float64) {
+	for _, mf := range families {
+		cluster, stat, ok := parseEnvoyClusterStat(mf.GetName())
+		if !ok {
+			continue
+		}
+		api, ok := m.handler.envoyStatsClusters[cluster]
+		if !ok {
+			continue
+		}
+		labels := []string{m.handler.orgName, m.handler.envName, api, cluster, source.metricCluster()}
+
+		var value float64
+		for _, metric := range mf.GetMetric() {
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				value += metric.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				value += metric.GetGauge().GetValue()
+			}
+		}
+
+		if stat.gauge != nil {
+			stat.gauge.WithLabelValues(labels...).Set(value)
+			continue
+		}
+		last, seen := counters[mf.GetName()]
+		counters[mf.GetName()] = value
+		if !seen {
+			continue
+		}
+		delta := value - last
+		if delta < 0 { // reset
+			delta = value
+		}
+		if stat.class != "" {
+			labels = append(labels, stat.class)
+		}
+		stat.counter.WithLabelValues(labels...).Add(delta)
+	}
+}
+
+var (
+	prometheusEnvoyStatsMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "envoy_stats",
+		Name:      "messages_count",
+		Help:      "Total number of stats messages received by Envoy cluster",
+	}, []string{"org", "envoy_cluster"})
+
+	prometheusUpstreamRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "upstream",
+		Name:      "request_count",
+		Help:      "Total number of upstream requests of APIs by response class, reported by Envoy",
+	}, []string{"org", "env", "api", "upstream_cluster", "envoy_cluster", "class"})
+
+	prometheusUpstreamTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "upstream",
+		Name:      "request_timeout_count",
+		Help:      "Total number of upstream requests of APIs timed out, reported by Envoy",
+	}, []string{"org", "env", "api", "upstream_cluster", "envoy_cluster"})
+
+	prometheusUpstreamConnectFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "upstream",
+		Name:      "connect_failure_count",
+		Help:      "Total number of failed upstream connections of APIs, reported by Envoy",
+	}, []string{"org", "env", "api", "upstream_cluster", "envoy_cluster"})
+
+	prometheusUpstreamHealthyHosts = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "upstream",
+		Name:      "healthy_hosts",
+		Help:      "Number of healthy upstream hosts of APIs, reported by Envoy",
+	}, []string{"org", "env", "api", "upstream_cluster", "envoy_cluster"})
+
+	prometheusUpstreamHosts = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "upstream",
+		Name:      "hosts",
+		Help:      "Number of upstream hosts of APIs, reported by Envoy",
+	}, []string{"org", "env", "api", "upstream_cluster", "envoy_cluster"})
+)
@@ -0,0 +1,163 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	metricsv3 "github.com/envoyproxy/go-control-plane/envoy/service/metrics/v3"
+	prometheustest "github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestParseEnvoyClusterStat(t *testing.T) {
+	tests := []struct {
+		name        string
+		wantCluster string
+		wantStat    string
+	}{
+		{"cluster.petstore.upstream_rq_2xx", "petstore", "upstream_rq_2xx"},
+		{"cluster.outbound|80||pets.default.svc.cluster.local.upstream_rq_timeout", "outbound|80||pets.default.svc.cluster.local", "upstream_rq_timeout"},
+		{"cluster.petstore.membership_healthy", "petstore", "membership_healthy"},
+		{"cluster.petstore.upstream_rq_total", "", ""},
+		{"cluster.upstream_rq_2xx", "", ""},
+		{"http.ingress.downstream_rq_2xx", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cluster, stat, ok := parseEnvoyClusterStat(test.name)
+			if ok != (test.wantStat != "") {
+				t.Fatalf("want parsed %t, got %t", test.wantStat != "", ok)
+			}
+			if !ok {
+				return
+			}
+			if cluster != test.wantCluster || stat.name != test.wantStat {
+				t.Errorf("want %q %q, got %q %q", test.wantCluster, test.wantStat, cluster, stat.name)
+			}
+		})
+	}
+}
+
+func envoyCounter(name string, value float64) *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name:   proto.String(name),
+		Type:   dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(value)}}},
+	}
+}
+
+func envoyGauge(name string, value float64) *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name:   proto.String(name),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(value)}}},
+	}
+}
+
+func TestStreamMetrics(t *testing.T) {
+	listener := bufconn.Listen(1024 * 1024)
+	srv := grpc.NewServer()
+	ms := &MetricsServer{}
+	ms.Register(srv, &Handler{
+		orgName:            "stats-org",
+		envName:            "env",
+		envoyStatsClusters: map[string]string{"petstore": "pets"},
+	})
+	go func() {
+		if err := srv.Serve(listener); err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	}()
+	defer srv.GracefulStop()
+
+	ctx := context.Background()
+	conn, err := grpc.DialContext(ctx, "", grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return listener.Dial()
+	}), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	stream, err := metricsv3.NewMetricsServiceClient(conn).StreamMetrics(ctx)
+	if err != nil {
+		t.Fatalf("failed to open client stream: %v", err)
+	}
+	msgs := []*metricsv3.StreamMetricsMessage{
+		{
+			Identifier: &metricsv3.StreamMetricsMessage_Identifier{
+				Node: &core.Node{Id: "node-1", Cluster: "fleet-a"},
+			},
+			EnvoyMetrics: []*dto.MetricFamily{
+				envoyCounter("cluster.petstore.upstream_rq_2xx", 100),
+				envoyCounter("cluster.petstore.upstream_rq_5xx", 10),
+				envoyCounter("cluster.other.upstream_rq_2xx", 50),
+				envoyGauge("cluster.petstore.membership_healthy", 2),
+				envoyGauge("cluster.petstore.membership_total", 3),
+			},
+		},
+		{
+			EnvoyMetrics: []*dto.MetricFamily{
+				envoyCounter("cluster.petstore.upstream_rq_2xx", 130),
+				envoyCounter("cluster.petstore.upstream_rq_5xx", 4), // reset
+				envoyCounter("cluster.petstore.upstream_cx_connect_fail", 1),
+				envoyGauge("cluster.petstore.membership_healthy", 3),
+			},
+		},
+		{
+			EnvoyMetrics: []*dto.MetricFamily{
+				envoyCounter("cluster.petstore.upstream_cx_connect_fail", 3),
+			},
+		},
+	}
+	for _, msg := range msgs {
+		if err := stream.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := stream.CloseAndRecv(); err != nil {
+		t.Fatal(err)
+	}
+
+	labels := []string{"stats-org", "env", "pets", "petstore", "fleet-a"}
+	if got := prometheustest.ToFloat64(prometheusUpstreamRequests.WithLabelValues(append(labels, "2xx")...)); got != 30 {
+		t.Errorf("want 30 2xx requests since the first report, got %v", got)
+	}
+	if got := prometheustest.ToFloat64(prometheusUpstreamRequests.WithLabelValues(append(labels, "5xx")...)); got != 4 {
+		t.Errorf("want 4 5xx requests after reset, got %v", got)
+	}
+	if got := prometheustest.ToFloat64(prometheusUpstreamConnectFailures.WithLabelValues(labels...)); got != 2 {
+		t.Errorf("want 2 connect failures, got %v", got)
+	}
+	if got := prometheustest.ToFloat64(prometheusUpstreamHealthyHosts.WithLabelValues(labels...)); got != 3 {
+		t.Errorf("want 3 healthy hosts, got %v", got)
+	}
+	if got := prometheustest.ToFloat64(prometheusUpstreamHosts.WithLabelValues(labels...)); got != 3 {
+		t.Errorf("want 3 hosts, got %v", got)
+	}
+	if got := prometheustest.ToFloat64(prometheusEnvoyStatsMessages.WithLabelValues("stats-org", "fleet-a")); got != 3 {
+		t.Errorf("want 3 messages, got %v", got)
+	}
+	if got := prometheustest.CollectAndCount(prometheusUpstreamRequests); got != 2 {
+		t.Errorf("want requests of mapped clusters only, got %d series", got)
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	failoverRemoteService = "remote_service"
+	failoverInternal      = "internal"
+)
+
+// failoverManager sends requests for the tenant endpoints to the active
+// endpoint of their failover group and health checks the preferred
+// endpoints of groups that have failed over.
+type failoverManager struct {
+	client   *http.Client // health checks
+	groups   []*failoverGroup
+	interval time.Duration
+	org      string
+	done     chan struct{}
+}
+
+// failoverGroup is an endpoint followed by its failovers in order of preference.
+type failoverGroup struct {
+	name      string
+	endpoints []*url.URL
+	threshold int
+
+	mu     sync.Mutex
+	active int
+	passes []int // consecutive passed health checks by endpoint
+}
+
+// newFailoverManager creates a failoverManager.
+// Returns nil if no failovers are configured.
+func newFailoverManager(client *http.Client, tenant config.Tenant, internalAPI, remoteServiceAPI *url.URL) (*failoverManager, error) {
+	f := &failoverManager{
+		client:   client,
+		interval: tenant.Failover.HealthCheckInterval,
+		org:      tenant.OrgName,
+		done:     make(chan struct{}),
+	}
+	for _, g := range []struct {
+		name      string
+		primary   *url.URL
+		failovers []string
+	}{
+		{failoverRemoteService, remoteServiceAPI, tenant.RemoteServiceAPIFailovers},
+		{failoverInternal, internalAPI, tenant.InternalAPIFailovers},
+	} {
+		if g.primary == nil || len(g.failovers) == 0 {
+			continue
+		}
+		group := &failoverGroup{
+			name:      g.name,
+			endpoints: []*url.URL{g.primary},
+			threshold: tenant.Failover.RecoveryThreshold,
+			passes:    make([]int, len(g.failovers)+1),
+		}
+		for _, s := range g.failovers {
+			u, err := url.Parse(s)
+			if err != nil {
+				return nil, err
+			}
+			if u.Scheme == "" {
+				return nil, fmt.Errorf("invalid URL: %s", s)
+			}
+			group.endpoints = append(group.endpoints, u)
+		}
+		f.groups = append(f.groups, group)
+	}
+	if len(f.groups) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+func (f *failoverManager) start() {
+	go func() {
+		t := time.NewTicker(f.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				for _, g := range f.groups {
+					f.healthCheck(g)
+				}
+			case <-f.done:
+				return
+			}
+		}
+	}()
+}
+
+func (f *failoverManager) stop() {
+	if f != nil {
+		close(f.done)
+	}
+}
+
+// roundTripper returns rt sending requests to the active endpoints,
+// rt itself if f is nil
+func (f *failoverManager) roundTripper(rt http.RoundTripper) http.RoundTripper {
+	if f == nil {
+		return rt
+	}
+	return &failoverRoundTripper{manager: f, base: rt}
+}
+
+// healthCheck probes the endpoints preferred over the active endpoint
+// and recovers to the most preferred to pass threshold consecutive checks
+func (f *failoverManager) healthCheck(g *failoverGroup) {
+	g.mu.Lock()
+	active := g.active
+	g.mu.Unlock()
+
+	for i := 0; i < active; i++ {
+		healthy := f.probe(g.endpoints[i])
+		g.mu.Lock()
+		if healthy {
+			g.passes[i]++
+		} else {
+			g.passes[i] = 0
+		}
+		if g.passes[i] >= g.threshold && i < g.active {
+			log.Infof("%s endpoint %s recovered, switching from %s", g.name, g.endpoints[i], g.endpoints[g.active])
+			prometheusFailovers.WithLabelValues(f.org, g.name, g.endpoints[i].Host).Inc()
+			g.active = i
+		}
+		g.mu.Unlock()
+		if healthy && g.passes[i] >= g.threshold {
+			return
+		}
+	}
+}
+
+// probe is healthy if the endpoint responds without a server error
+func (f *failoverManager) probe(endpoint *url.URL) bool {
+	resp, err := f.client.Get(endpoint.String())
+	if err != nil {
+		log.Debugf("health check of %s failed: %v", endpoint, err)
+		return false
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode < http.StatusInternalServerError
+}
+
+// match returns the group of the request URL and the path relative to its endpoint
+func (f *failoverManager) match(u *url.URL) (*failoverGroup, string) {
+	for _, g := range f.groups {
+		primary := g.endpoints[0]
+		basePath := strings.TrimSuffix(primary.Path, "/")
+		if u.Scheme != primary.Scheme || u.Host != primary.Host || !strings.HasPrefix(u.Path, basePath) {
+			continue
+		}
+		relPath := strings.TrimPrefix(u.Path, basePath)
+		if relPath == "" || strings.HasPrefix(relPath, "/") {
+			return g, relPath
+		}
+	}
+	return nil, ""
+}
+
+// current returns the index and URL of the active endpoint
+func (g *failoverGroup) current() (int, *url.URL) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.active, g.endpoints[g.active]
+}
+
+// fail switches away from endpoint i if it is still active
+func (g *failoverGroup) fail(i int, org string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.active != i {
+		return
+	}
+	g.passes[i] = 0
+	g.active = (i + 1) % len(g.endpoints)
+	log.Warnf("%s endpoint %s unavailable, failing over to %s", g.name, g.endpoints[i], g.endpoints[g.active])
+	prometheusFailovers.WithLabelValues(org, g.name, g.endpoints[g.active].Host).Inc()
+}
+
+// failoverRoundTripper rewrites requests for the tenant endpoints to the active
+// endpoint, failing over and replaying if the endpoint is unavailable. Requests
+// that aren't idempotent are only replayed if they weren't sent, and requests
+// of a retryRoundTripper are left for it to retry.
+type failoverRoundTripper struct {
+	manager *failoverManager
+	base    http.RoundTripper
+}
+
+func (rt *failoverRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	g, relPath := rt.manager.match(req.URL)
+	if g == nil {
+		return rt.base.RoundTrip(req)
+	}
+
+	replay := req.Context().Value(outboundRetryKey{}) == nil
+	var resp *http.Response
+	var err error
+	for attempt := 0; attempt < len(g.endpoints); attempt++ {
+		if attempt > 0 {
+			if req.Body != nil && req.GetBody == nil {
+				break // body can't be replayed
+			}
+			if resp != nil {
+				resp.Body.Close()
+			}
+		}
+		i, endpoint := g.current()
+		r := req.Clone(req.Context())
+		r.URL.Scheme = endpoint.Scheme
+		r.URL.Host = endpoint.Host
+		r.URL.Path = strings.TrimSuffix(endpoint.Path, "/") + relPath
+		r.URL.RawPath = ""
+		r.Host = ""
+		if attempt > 0 && req.GetBody != nil {
+			if r.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err = rt.base.RoundTrip(r)
+		if err == nil && !unavailable(resp.StatusCode) {
+			return resp, nil
+		}
+		g.fail(i, rt.manager.org)
+		if !replay || (!idempotent(req.Method) && !dialError(err)) {
+			break
+		}
+	}
+	return resp, err
+}
+
+// unavailable is true for statuses of an unreachable or overloaded backend
+func unavailable(statusCode int) bool {
+	return statusCode == http.StatusBadGateway ||
+		statusCode == http.StatusServiceUnavailable ||
+		statusCode == http.StatusGatewayTimeout
+}
+
+var (
+	prometheusFailovers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "tenant",
+		Name:      "failover_count",
+		Help:      "Total number of switches of the active tenant endpoint",
+	}, []string{"org", "endpoint", "host"})
+)
@@ -0,0 +1,158 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+)
+
+func TestNewFailoverManager(t *testing.T) {
+	remoteServiceAPI, _ := url.Parse("https://primary/remote-service")
+	f, err := newFailoverManager(http.DefaultClient, config.Tenant{}, nil, remoteServiceAPI)
+	if err != nil || f != nil {
+		t.Errorf("want nil manager without failovers, got: %v, %v", f, err)
+	}
+	if rt := f.roundTripper(http.DefaultTransport); rt != http.DefaultTransport {
+		t.Errorf("nil manager should not wrap round tripper")
+	}
+	f.stop()
+
+	tenant := config.Tenant{RemoteServiceAPIFailovers: []string{"secondary"}}
+	if _, err := newFailoverManager(http.DefaultClient, tenant, nil, remoteServiceAPI); err == nil {
+		t.Errorf("want error for relative failover URL")
+	}
+}
+
+func TestFailoverRoundTripper(t *testing.T) {
+	primaryDown := false
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if primaryDown {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("primary " + r.URL.Path))
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write([]byte("secondary " + r.URL.Path + string(body)))
+	}))
+	defer secondary.Close()
+
+	remoteServiceAPI, _ := url.Parse(primary.URL + "/remote-service")
+	tenant := config.Tenant{
+		OrgName:                   "org",
+		RemoteServiceAPIFailovers: []string{secondary.URL + "/eu/remote-service/"},
+		Failover: config.Failover{
+			HealthCheckInterval: time.Minute,
+			RecoveryThreshold:   2,
+		},
+	}
+	f, err := newFailoverManager(http.DefaultClient, tenant, nil, remoteServiceAPI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: f.roundTripper(http.DefaultTransport)}
+
+	get := func(path string) string {
+		resp, err := client.Get(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+	equal := func(want, got string) {
+		t.Helper()
+		if want != got {
+			t.Errorf("want: %q, got: %q", want, got)
+		}
+	}
+
+	equal("primary /remote-service/products", get(primary.URL+"/remote-service/products"))
+
+	// other endpoints are not rewritten
+	primaryDown = true
+	resp, err := client.Get(primary.URL + "/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("want: %d, got: %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	if g, _ := f.match(&url.URL{Scheme: "http", Host: remoteServiceAPI.Host, Path: "/remote-service-admin/products"}); g != nil {
+		t.Errorf("want paths matched on segment boundaries")
+	}
+
+	// fails over and retries
+	equal("secondary /eu/remote-service/products", get(primary.URL+"/remote-service/products"))
+	resp, err = client.Post(primary.URL+"/remote-service/quotas", "text/plain", strings.NewReader(" body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	equal("secondary /eu/remote-service/quotas body", string(b))
+
+	// sticks to the failover until primary passes the recovery threshold
+	g := f.groups[0]
+	f.healthCheck(g)
+	primaryDown = false
+	f.healthCheck(g)
+	equal("secondary /eu/remote-service/products", get(primary.URL+"/remote-service/products"))
+	f.healthCheck(g)
+	equal("primary /remote-service/products", get(primary.URL+"/remote-service/products"))
+
+	// requests of outbound retries fail over without a replay
+	primaryDown = true
+	ctx := context.WithValue(context.Background(), outboundRetryKey{}, true)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, primary.URL+"/remote-service/products", nil)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("want: %d, got: %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	equal("secondary /eu/remote-service/products", get(primary.URL+"/remote-service/products"))
+
+	// requests that aren't idempotent fail over without a replay once sent
+	f.healthCheck(g)
+	primaryDown = false
+	f.healthCheck(g)
+	f.healthCheck(g)
+	primaryDown = true
+	resp, err = client.Post(primary.URL+"/remote-service/quotas", "text/plain", strings.NewReader(" body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("want: %d, got: %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	equal("secondary /eu/remote-service/products", get(primary.URL+"/remote-service/products"))
+}
@@ -0,0 +1,221 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// FeatureFlagOverride replaces the configured percentage of a feature flag
+// for an API, or all APIs without their own override if API is empty.
+// Overrides are created with the feature flags admin API and held in memory
+// by each adapter, so a rollout to keep should also be configured.
+type FeatureFlagOverride struct {
+	Flag       string    `json:"flag"`
+	API        string    `json:"api,omitempty"`
+	Percentage float64   `json:"percentage"`
+	Created    time.Time `json:"created"`
+}
+
+// FeatureFlagStatus is the configured rollout and the overrides of a flag.
+type FeatureFlagStatus struct {
+	Flag       string                `json:"flag"`
+	Percentage float64               `json:"percentage"`
+	APIs       map[string]float64    `json:"apis,omitempty"`
+	Overrides  []FeatureFlagOverride `json:"overrides,omitempty"`
+}
+
+// featureFlagKey identifies an override
+type featureFlagKey struct {
+	flag string
+	api  string
+}
+
+// featureFlags decides if the flags are enabled for requests by the
+// configured rollouts and the overrides of the admin API
+type featureFlags struct {
+	org        string
+	configured config.FeatureFlags
+	now        func() time.Time
+
+	mu        sync.RWMutex
+	overrides map[featureFlagKey]FeatureFlagOverride
+}
+
+func newFeatureFlags(org string, configured config.FeatureFlags) *featureFlags {
+	return &featureFlags{
+		org:        org,
+		configured: configured,
+		now:        time.Now,
+		overrides:  make(map[featureFlagKey]FeatureFlagOverride),
+	}
+}
+
+// percentage returns the percentage of the requests of api enabled
+func (f *featureFlags) percentage(flag, api string) float64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if o, ok := f.overrides[featureFlagKey{flag, api}]; ok {
+		return o.Percentage
+	}
+	if o, ok := f.overrides[featureFlagKey{flag, ""}]; ok {
+		return o.Percentage
+	}
+	return f.configured[flag].PercentageOf(api)
+}
+
+// enabled returns true if flag is enabled for the request of api with the
+// Envoy request ID. Requests without an ID are enabled only at 100%.
+func (f *featureFlags) enabled(flag, api, requestID string) bool {
+	if f == nil {
+		return false
+	}
+	p := f.percentage(flag, api)
+	enabled := p >= 100
+	if !enabled && p > 0 && requestID != "" {
+		enabled = featureBucket(flag, api, requestID) < p
+	}
+	if enabled {
+		prometheusFeatureFlagsEnabled.WithLabelValues(f.org, flag).Inc()
+	}
+	return enabled
+}
+
+// featureBucket hashes the request into [0, 100) in steps of 0.01
+func featureBucket(flag, api, requestID string) float64 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(flag + "\x00" + api + "\x00" + requestID))
+	return float64(h.Sum32()%10000) / 100
+}
+
+// override creates or replaces the override of its flag and API
+func (f *featureFlags) override(o FeatureFlagOverride) (FeatureFlagOverride, error) {
+	if !config.KnownFeatureFlag(o.Flag) {
+		return o, fmt.Errorf("unknown feature flag %q", o.Flag)
+	}
+	if err := config.ValidFeaturePercentage(o.Percentage); err != nil {
+		return o, err
+	}
+	o.Created = f.now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.overrides[featureFlagKey{o.Flag, o.API}] = o
+	log.Infof("feature flag %s overridden for api %q: %v%%", o.Flag, o.API, o.Percentage)
+	return o, nil
+}
+
+// remove deletes an override, returns false if it does not exist
+func (f *featureFlags) remove(flag, api string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := featureFlagKey{flag, api}
+	_, ok := f.overrides[key]
+	delete(f.overrides, key)
+	if ok {
+		log.Infof("feature flag %s override for api %q removed", flag, api)
+	}
+	return ok
+}
+
+// status returns the configured or overridden flags ordered by name
+func (f *featureFlags) status() []FeatureFlagStatus {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	byFlag := make(map[string]*FeatureFlagStatus)
+	get := func(flag string) *FeatureFlagStatus {
+		s, ok := byFlag[flag]
+		if !ok {
+			s = &FeatureFlagStatus{Flag: flag}
+			byFlag[flag] = s
+		}
+		return s
+	}
+	for flag, c := range f.configured {
+		s := get(flag)
+		s.Percentage = c.Percentage
+		s.APIs = c.APIs
+	}
+	for _, o := range f.overrides {
+		s := get(o.Flag)
+		s.Overrides = append(s.Overrides, o)
+	}
+	statuses := make([]FeatureFlagStatus, 0, len(byFlag))
+	for _, s := range byFlag {
+		sort.Slice(s.Overrides, func(i, j int) bool { return s.Overrides[i].API < s.Overrides[j].API })
+		statuses = append(statuses, *s)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Flag < statuses[j].Flag })
+	return statuses
+}
+
+// FeatureFlagsHandlerFunc returns an http.HandlerFunc managing feature flag
+// overrides: GET lists the flags, POST creates or replaces the JSON
+// FeatureFlagOverride of the body, and DELETE with "flag" and optional "api"
+// query parameters removes an override.
+func (h *Handler) FeatureFlagsHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respond := func(status int, body interface{}) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			if err := json.NewEncoder(w).Encode(body); err != nil {
+				log.Warnf("feature flags unable to respond: %s", err)
+			}
+		}
+		switch r.Method {
+		case http.MethodGet:
+			respond(http.StatusOK, map[string]interface{}{"flags": h.features.status()})
+		case http.MethodPost:
+			var o FeatureFlagOverride
+			if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+				respond(http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			o, err := h.features.override(o)
+			if err != nil {
+				respond(http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			respond(http.StatusCreated, o)
+		case http.MethodDelete:
+			if !h.features.remove(r.URL.Query().Get("flag"), r.URL.Query().Get("api")) {
+				respond(http.StatusNotFound, map[string]string{"error": "no such feature flag override"})
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+var (
+	prometheusFeatureFlagsEnabled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "server",
+		Name:      "feature_flag_enabled_count",
+		Help:      "Total number of requests a feature flag was enabled for",
+	}, []string{"org", "flag"})
+)
@@ -0,0 +1,141 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+)
+
+func TestFeatureFlagsEnabled(t *testing.T) {
+	flag := config.FeatureAnalyticsOperation
+	f := newFeatureFlags("org", config.FeatureFlags{
+		flag: {Percentage: 25, APIs: map[string]float64{"all": 100, "none": 0}},
+	})
+	count := func(api string) int {
+		n := 0
+		for i := 0; i < 1000; i++ {
+			if f.enabled(flag, api, fmt.Sprintf("request-%d", i)) {
+				n++
+			}
+		}
+		return n
+	}
+
+	if n := count("all"); n != 1000 {
+		t.Errorf("want all requests enabled, got %d", n)
+	}
+	if n := count("none"); n != 0 {
+		t.Errorf("want no requests enabled, got %d", n)
+	}
+	if n := count("other"); n < 200 || n > 300 {
+		t.Errorf("want about 250 requests enabled, got %d", n)
+	}
+
+	// decisions are stable for a request
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("request-%d", i)
+		if f.enabled(flag, "other", id) != f.enabled(flag, "other", id) {
+			t.Errorf("unstable decision of %s", id)
+		}
+	}
+	if f.enabled(flag, "other", "") {
+		t.Errorf("want requests without ID disabled below 100%%")
+	}
+
+	// overrides by API, then for all APIs, replace the configured percentages
+	if _, err := f.override(FeatureFlagOverride{Flag: flag, Percentage: 0}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.override(FeatureFlagOverride{Flag: flag, API: "none", Percentage: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if n := count("all"); n != 0 {
+		t.Errorf("want no requests enabled by override, got %d", n)
+	}
+	if n := count("none"); n != 1000 {
+		t.Errorf("want all requests enabled by API override, got %d", n)
+	}
+	if !f.remove(flag, "") || f.remove(flag, "") {
+		t.Errorf("want override removed once")
+	}
+	if n := count("all"); n != 1000 {
+		t.Errorf("want configured percentage after removal, got %d", n)
+	}
+
+	var nilFlags *featureFlags
+	if nilFlags.enabled(flag, "all", "request") {
+		t.Errorf("want nil feature flags disabled")
+	}
+}
+
+func TestFeatureFlagsHandlerFunc(t *testing.T) {
+	flag := config.FeatureAnalyticsOperation
+	h := &Handler{features: newFeatureFlags("org", config.FeatureFlags{flag: {Percentage: 5}})}
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.FeatureFlagsHandlerFunc()(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/features", `{"flag": "analytics_operation", "api": "orders", "percentage": 50}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("want status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body)
+	}
+	var created FeatureFlagOverride
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.API != "orders" || created.Percentage != 50 || created.Created.IsZero() {
+		t.Errorf("unexpected override: %#v", created)
+	}
+
+	for _, body := range []string{
+		`{"flag": "unknown", "percentage": 50}`,
+		`{"flag": "analytics_operation", "percentage": 101}`,
+		`not json`,
+	} {
+		if rec := do(http.MethodPost, "/features", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: want status %d, got %d", body, http.StatusBadRequest, rec.Code)
+		}
+	}
+
+	rec = do(http.MethodGet, "/features", "")
+	var list struct {
+		Flags []FeatureFlagStatus `json:"flags"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Flags) != 1 || list.Flags[0].Percentage != 5 || len(list.Flags[0].Overrides) != 1 {
+		t.Errorf("unexpected flags: %#v", list.Flags)
+	}
+
+	if rec := do(http.MethodDelete, "/features?flag=analytics_operation&api=orders", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("want status %d, got %d", http.StatusNoContent, rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/features?flag=analytics_operation&api=orders", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("want status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	if rec := do(http.MethodPut, "/features", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("want status %d, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
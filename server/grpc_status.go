@@ -0,0 +1,112 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
+	v3 "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	headerGRPCStatus  = "grpc-status"
+	headerGRPCMessage = "grpc-message"
+
+	// analytics attributes populated from the gRPC status of a response
+	grpcStatusAttribute  = "grpc.status"
+	grpcMessageAttribute = "grpc.message"
+)
+
+// grpcStatus returns the gRPC status of the response from its trailers, or
+// its headers for a trailers-only response. Returns false if not gRPC.
+func grpcStatus(resp *v3.HTTPResponseProperties) (codes.Code, string, bool) {
+	status, ok := resp.GetResponseTrailers()[headerGRPCStatus]
+	message := resp.GetResponseTrailers()[headerGRPCMessage]
+	if !ok {
+		status, ok = resp.GetResponseHeaders()[headerGRPCStatus]
+		message = resp.GetResponseHeaders()[headerGRPCMessage]
+	}
+	if !ok {
+		return codes.OK, "", false
+	}
+	code, err := strconv.ParseUint(status, 10, 32)
+	if err != nil {
+		return codes.Unknown, message, true
+	}
+	// grpc-message is percent-encoded
+	if unescaped, err := url.PathUnescape(message); err == nil {
+		message = unescaped
+	}
+	return codes.Code(code), message, true
+}
+
+// grpcAnalytics returns the analytics attributes of a gRPC response and
+// the HTTP equivalent of its status to record in place of the HTTP 200
+// used by gRPC for all statuses
+func grpcAnalytics(resp *v3.HTTPResponseProperties, responseCode int) ([]analytics.Attribute, int) {
+	code, message, ok := grpcStatus(resp)
+	if !ok {
+		return nil, responseCode
+	}
+	attributes := []analytics.Attribute{{
+		Name:  grpcStatusAttribute,
+		Value: code.String(),
+	}}
+	if message != "" {
+		attributes = append(attributes, analytics.Attribute{
+			Name:  grpcMessageAttribute,
+			Value: message,
+		})
+	}
+	if responseCode == http.StatusOK {
+		responseCode = httpStatusFromGRPC(code)
+	}
+	return attributes, responseCode
+}
+
+// httpStatusFromGRPC maps a gRPC status code to the equivalent HTTP status
+// as in https://github.com/googleapis/googleapis/blob/master/google/rpc/code.proto
+func httpStatusFromGRPC(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499 // client closed request
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default: // Unknown, Internal, DataLoss
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
+	v3 "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestGRPCAnalytics(t *testing.T) {
+	tests := []struct {
+		desc       string
+		resp       *v3.HTTPResponseProperties
+		code       int
+		wantAttrs  []analytics.Attribute
+		wantStatus int
+	}{
+		{
+			desc:       "not grpc",
+			resp:       &v3.HTTPResponseProperties{},
+			code:       200,
+			wantStatus: 200,
+		},
+		{
+			desc:       "nil response",
+			code:       200,
+			wantStatus: 200,
+		},
+		{
+			desc: "ok trailer",
+			resp: &v3.HTTPResponseProperties{
+				ResponseTrailers: map[string]string{"grpc-status": "0"},
+			},
+			code:       200,
+			wantAttrs:  []analytics.Attribute{{Name: grpcStatusAttribute, Value: "OK"}},
+			wantStatus: 200,
+		},
+		{
+			desc: "error trailer",
+			resp: &v3.HTTPResponseProperties{
+				ResponseTrailers: map[string]string{"grpc-status": "5", "grpc-message": "pet%20not%20found"},
+			},
+			code: 200,
+			wantAttrs: []analytics.Attribute{
+				{Name: grpcStatusAttribute, Value: "NotFound"},
+				{Name: grpcMessageAttribute, Value: "pet not found"},
+			},
+			wantStatus: 404,
+		},
+		{
+			desc: "trailers-only response",
+			resp: &v3.HTTPResponseProperties{
+				ResponseHeaders: map[string]string{"grpc-status": "16"},
+			},
+			code:       200,
+			wantAttrs:  []analytics.Attribute{{Name: grpcStatusAttribute, Value: "Unauthenticated"}},
+			wantStatus: 401,
+		},
+		{
+			desc: "http error kept",
+			resp: &v3.HTTPResponseProperties{
+				ResponseHeaders: map[string]string{"grpc-status": "14"},
+			},
+			code:       502,
+			wantAttrs:  []analytics.Attribute{{Name: grpcStatusAttribute, Value: "Unavailable"}},
+			wantStatus: 502,
+		},
+		{
+			desc: "bad status",
+			resp: &v3.HTTPResponseProperties{
+				ResponseTrailers: map[string]string{"grpc-status": "bad"},
+			},
+			code:       200,
+			wantAttrs:  []analytics.Attribute{{Name: grpcStatusAttribute, Value: "Unknown"}},
+			wantStatus: 500,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			attrs, status := grpcAnalytics(test.resp, test.code)
+			if diff := cmp.Diff(test.wantAttrs, attrs); diff != "" {
+				t.Errorf("diff (-want +got):\n%s", diff)
+			}
+			if status != test.wantStatus {
+				t.Errorf("want: %d, got: %d", test.wantStatus, status)
+			}
+		})
+	}
+}
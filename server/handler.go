@@ -24,6 +24,7 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/apigee/apigee-remote-service-envoy/v2/config"
 	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
@@ -51,20 +52,68 @@ type Handler struct {
 	apiHeader             string
 	allowUnauthorized     bool
 	appendMetadataHeaders bool
+	appendMatchHeaders    bool
 	jwtProviderKey        string
 	isMultitenant         bool
+	envRouter             *environmentRouter
+	envSpecsMu            sync.RWMutex
 	envSpecsByID          map[string]*config.EnvironmentSpecExt
+	specSetup             *environmentSpecSetup
+	specSources           *specSourcePoller
+	specDrift             *specDriftMonitor
 	operationConfigType   string
 	ready                 *util.AtomicBool
+	spool                 *spoolMonitor
+	uploads               *uploadMonitor
+	analyticsWorkers      *analyticsWorkers
+	recordDedup           *recordDeduplicator
+	overload              *overloadManager
+	concurrency           *concurrencyLimiter
+	consumerBlocks        *consumerBlocklist
+	features              *featureFlags
+	denialWebhook         *denialWebhook
+	kvms                  *kvmManager
+	ipReputation          *ipReputationList
+	proxyChain            *config.ProxyChain
+	oidcDiscovery         *oidcDiscoveryManager
+	remoteJWKS            *remoteJWKSManager
+	caches                *cacheInvalidator
+	revocations           *revocationList
+	dpopReplay            *replayCache
+	jwtLimiter            *jwtLimiter
+	replays               *replayProtector
+	tracer                *requestTracer
+	anomalies             *anomalyDetector
+	failover              *failoverManager
+	quotaReconciler       *quotaReconciler
+	analyticsEnrichers    []AnalyticsEnricher
+	metricLabels          []string
+	metricSpecs           *metricAllowlist
+	metricAPIs            *metricAllowlist
+	limits                requestLimits
+	normalizer            *requestNormalizer
+	checkStages           []CheckStage
+	maxTimeSkew           time.Duration
+	metadataHeaderLimit   int
+	consumerFields        *consumerFieldSelection
+	baggage               *upstreamBaggage
+	datacaptureNamespaces []config.DatacaptureNamespace
+	envoyStatsClusters    map[string]string
+	analyticsProxyFields  map[string]config.AnalyticsProxyFields
+	verificationTimeout   time.Duration // API key verification without an EnvironmentSpec
+	verifyAPIKeyHeaders   *verifyAPIKeyHeaders
 
 	productMan   product.Manager
 	authMan      auth.Manager
 	analyticsMan analytics.Manager
 	quotaMan     quota.Manager
+
+	quotaCounting string // config.QuotaCountingCheck or config.QuotaCountingAccessLog
 }
 
 // Close waits for all managers to close
 func (h *Handler) Close() {
+	h.analyticsWorkers.stop() // before closing the analytics manager
 	wg := sync.WaitGroup{}
 	wg.Add(4)
 	type Closable interface {
@@ -79,6 +128,19 @@ func (h *Handler) Close() {
 	go close(h.analyticsMan)
 	go close(h.quotaMan)
 	wg.Wait()
+	h.uploads.stop() // after the final uploads
+	h.spool.stop()
+	h.kvms.stop()
+	h.ipReputation.stop()
+	h.oidcDiscovery.stop()
+	h.remoteJWKS.stop()
+	h.revocations.stop()
+	h.anomalies.stop()
+	h.failover.stop()
+	h.replays.close()
+	h.specSources.stop()
+	h.specDrift.stop()
+	h.denialWebhook.stop()
 }
 
 // InternalAPI is the internal api base (legacy)
@@ -107,7 +169,11 @@ func (h *Handler) Ready() bool {
 }
 
 // NewHandler creates a handler
-func NewHandler(cfg *config.Config) (*Handler, error) {
+func NewHandler(cfg *config.Config, opts ...HandlerOption) (*Handler, error) {
+	options := handlerOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
 
 	var internalAPI, remoteServiceAPI *url.URL
 	var err error
@@ -130,74 +196,212 @@ func NewHandler(cfg *config.Config) (*Handler, error) {
 		}
 	}
 
+	checkStages, err := newCheckStages(cfg.Auth.CheckStages)
+	if err != nil {
+		return nil, err
+	}
+
 	// get a roundtripper with client TLS config
 	tr, err := roundTripperWithTLS(cfg.Tenant.TLS)
 	if err != nil {
 		return nil, err
 	}
 
+	// send requests for the tenant endpoints to their active failover
+	failover, err := newFailoverManager(&http.Client{Timeout: cfg.Tenant.ClientTimeout, Transport: tr},
+		cfg.Tenant, internalAPI, remoteServiceAPI)
+	if err != nil {
+		return nil, err
+	}
+	tr = failover.roundTripper(tr)
+
 	// add authorization to transport
 	tr, err = AuthorizationRoundTripper(cfg, tr)
 	if err != nil {
 		return nil, err
 	}
 
+	// retry transient failures of outbound calls
+	retries := newOutboundRetries(cfg.Tenant.Retry, cfg.Tenant.OrgName)
+
 	var opConfigTypes []string
 	if cfg.Tenant.OperationConfigType != "" {
 		opConfigTypes = append(opConfigTypes, cfg.Tenant.OperationConfigType)
 	}
-	productMan, err := product.NewManager(product.Options{
-		Client:               instrumentedClientFor(cfg, "products", tr),
+	productOptions := product.Options{
+		Client:               retries.client("products", instrumentedClientFor(cfg, "products", tr)),
 		BaseURL:              remoteServiceAPI,
 		RefreshRate:          cfg.Products.RefreshRate,
 		Org:                  cfg.Tenant.OrgName,
 		Env:                  cfg.Tenant.EnvName,
 		OperationConfigTypes: opConfigTypes,
-	})
+	}
+	products, err := newReloadableProductManager(func() (product.Manager, error) {
+		return product.NewManager(productOptions)
+	}, cfg.Tenant.ClientTimeout)
 	if err != nil {
 		return nil, err
 	}
+	var productMan product.Manager = products
+	if cfg.Products.ResourceMatching == config.ResourceMatchingClassic {
+		productMan = &classicProductManager{productMan}
+	}
 
+	kvms := newKVMManager(retries.client("kvm", instrumentedClientFor(cfg, "kvm", tr)), remoteServiceAPI, cfg.KeyValueMaps, cfg.Tenant.OrgName, cfg.Tenant.EnvName)
+	ipReputation := newIPReputationList(&http.Client{Timeout: cfg.Tenant.ClientTimeout}, cfg.BotDetection, cfg.Tenant.OrgName)
+	proxyChain, err := config.NewProxyChain(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	oidcDiscovery := newOIDCDiscoveryManager(retries.client(retryEndpointJWKS, &http.Client{Timeout: cfg.Tenant.ClientTimeout}),
+		cfg.Tenant.OrgName)
+	remoteJWKS := newRemoteJWKSManager(&http.Client{Timeout: cfg.Tenant.ClientTimeout})
+	remoteJWKS.retries = retries
+	revocationClient := &http.Client{Timeout: cfg.Tenant.ClientTimeout}
+	if cfg.JWTRevocation.KVM != "" {
+		revocationClient = instrumentedClientFor(cfg, "kvm", tr)
+	}
+	revocations := newRevocationList(revocationClient, remoteServiceAPI, cfg.JWTRevocation, cfg.Tenant.OrgName, cfg.Tenant.EnvName)
+	jwtLimiter := newJWTLimiter(cfg.Auth.JWTLimits, cfg.Tenant.OrgName)
+
+	for _, signature := range cfg.EnvironmentSpecs.SignatureResults() {
+		recordSpecSignature(cfg.Tenant.OrgName, signature.Result)
+	}
+	specSetup := &environmentSpecSetup{
+		auth:          cfg.Auth,
+		kvms:          kvms,
+		ipReputation:  ipReputation,
+		proxyChain:    proxyChain,
+		oidcDiscovery: oidcDiscovery,
+		remoteJWKS:    remoteJWKS,
+		revocations:   revocations,
+		jwtLimiter:    jwtLimiter,
+		jwksURLs:      make(map[string]bool),
+		envVars:       cfg.EnvironmentSpecs.EnvironmentVariables,
+	}
 	environmentSpecsByID := make(map[string]*config.EnvironmentSpecExt, len(cfg.EnvironmentSpecs.Inline))
 	var jwtProviders []jwt.Provider
+	jwksIssuers := make(map[string][]string)
 	for i := range cfg.EnvironmentSpecs.Inline {
 		// make EnvironmentSpecExt lookup table
 		spec := cfg.EnvironmentSpecs.Inline[i]
-		envSpec, err := config.NewEnvironmentSpecExt(&spec)
+		envSpec, err := config.NewEnvironmentSpecExt(&spec, config.WithEnvironmentVariables(specSetup.envVars))
 		if err != nil {
 			return nil, err
 		}
+		specSetup.configure(envSpec)
 		environmentSpecsByID[spec.ID] = envSpec
 
-		// make providers array
+		// make providers array, OIDC discovery sources and remote JWKS with
+		// TLS settings are verified separately
 		for _, jwtAuth := range envSpec.JWTAuthentications() {
-			source := jwtAuth.JWKSSource.(config.RemoteJWKS)
-			provider := jwt.Provider{
-				JWKSURL: source.URL,
-				Refresh: source.CacheDuration,
+			switch source := jwtAuth.JWKSSource.(type) {
+			case config.RemoteJWKS:
+				if jwtAuth.Issuer != "" {
+					jwksIssuers[jwtAuth.Issuer] = append(jwksIssuers[jwtAuth.Issuer], source.URL)
+				}
+				if source.TLS != nil {
+					if err := remoteJWKS.add(source); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				provider := jwt.Provider{
+					JWKSURL: source.URL,
+					Refresh: source.CacheDuration,
+				}
+				jwtProviders = append(jwtProviders, provider)
+				specSetup.jwksURLs[source.URL] = true
+			case config.OIDCDiscovery:
+				oidcDiscovery.add(source, jwtAuth.Issuer)
 			}
-			jwtProviders = append(jwtProviders, provider)
 		}
 	}
-
-	authMan, err := auth.NewManager(auth.Options{
-		Client:              instrumentedClientFor(cfg, "auth", tr),
+	if oidcDiscovery.empty() {
+		oidcDiscovery = nil
+	}
+	if remoteJWKS.empty() {
+		remoteJWKS = nil
+	}
+	specSetup.oidcDiscovery = oidcDiscovery
+	specSetup.remoteJWKS = remoteJWKS
+
+	verifyAPIKeyHeaders := newVerifyAPIKeyHeaders(cfg.Auth.VerifyAPIKeyHeaders)
+	authClient := retries.client("auth", instrumentedClientFor(cfg, "auth", tr))
+	authClient.Transport = verifyAPIKeyHeaders.roundTripper(authClient.Transport)
+	authOptions := auth.Options{
+		Client:              authClient,
 		APIKeyCacheDuration: cfg.Auth.APIKeyCacheDuration,
 		Org:                 cfg.Tenant.OrgName,
 		JWTProviders:        jwtProviders,
+	}
+	keyManagers, err := newReloadableAuthManager(func() (auth.Manager, error) {
+		return auth.NewManager(authOptions)
 	})
 	if err != nil {
 		return nil, err
 	}
+	// invalidated API keys are verified without the JWKS providers
+	keyOptions := authOptions
+	keyOptions.JWTProviders = nil
+	invalidatedKeys := newInvalidatedAPIKeys(func() (auth.Manager, error) {
+		return auth.NewManager(keyOptions)
+	}, cfg.Auth.APIKeyCacheDuration)
+	verificationClient, err := newRedisClient(cfg.VerificationStore.Redis)
+	if err != nil {
+		return nil, err
+	}
+	verifications := newRedisVerificationStore(verificationClient, cfg.VerificationStore.Redis.KeyPrefix,
+		cfg.Tenant.OrgName, cfg.Tenant.EnvName, []byte(cfg.VerificationStore.SigningKey))
+	authMan := &remoteServiceAuthManager{
+		Manager:             keyManagers,
+		accessTokenVerifier: newAccessTokenVerifier(remoteServiceAPI, cfg.Auth.AccessTokenCacheDuration, cfg.Tenant.OrgName),
+		hashAPIKey:          newAPIKeyHasher(cfg.Auth.APIKeyHash, cfg.Auth.APIKeyHashKey),
+		store:               verifications,
+		invalidated:         invalidatedKeys,
+		apiKeyStoreTTL:      cfg.Auth.APIKeyCacheDuration,
+		org:                 cfg.Tenant.OrgName,
+	}
+	if cfg.Auth.ConsumerKeyAPI {
+		authMan.consumerKeyResolver = newConsumerKeyResolver(retries.client("auth", instrumentedClientFor(cfg, "auth", tr)), remoteServiceAPI,
+			cfg.Auth.APIKeyCacheDuration, cfg.Tenant.OrgName)
+	}
+	caches := &cacheInvalidator{
+		authMan:       authMan,
+		keyManagers:   keyManagers,
+		products:      products,
+		oidcDiscovery: oidcDiscovery,
+		remoteJWKS:    remoteJWKS,
+		jwksURLs:      specSetup.jwksURLs,
+		jwksIssuers:   jwksIssuers,
+		org:           cfg.Tenant.OrgName,
+	}
 
-	quotaMan, err := quota.NewManager(quota.Options{
-		BaseURL: remoteServiceAPI,
-		Client:  instrumentedClientFor(cfg, "quotas", tr),
-		Org:     cfg.Tenant.OrgName,
-	})
+	quotaReconciler := newQuotaReconciler()
+	quotaClient := retries.client("quotas", instrumentedClientFor(cfg, "quotas", tr))
+	quotaClient.Transport = quotaReconciler.roundTripper(quotaClient.Transport)
+	var quotaMan quota.Manager = newLocalQuotaManager()
+	if !options.localManagers {
+		quotaMan, err = quota.NewManager(quota.Options{
+			BaseURL: remoteServiceAPI,
+			Client:  quotaClient,
+			Org:     cfg.Tenant.OrgName,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	quotaMan = quotaReconciler.manager(quotaMan)
+	redisClient, err := newRedisClient(cfg.QuotaStore.Redis)
 	if err != nil {
 		return nil, err
 	}
+	quotaMan = newRedisQuotaManager(redisClient, cfg.QuotaStore.Redis.KeyPrefix, quotaMan)
+	replayClient, err := newRedisClient(cfg.ReplayStore.Redis)
+	if err != nil {
+		return nil, err
+	}
+	replays := newReplayProtector(replayClient, cfg.ReplayStore.Redis.KeyPrefix)
 
 	tempDirMode := os.FileMode(0700)
 	tempDir := cfg.Global.TempDir
@@ -210,6 +414,7 @@ func NewHandler(cfg *config.Config) (*Handler, error) {
 	if cfg.Analytics.Credentials != nil {
 		// Attempts to get an authorized http client with given analytics credentials
 		analyticsClient = clientAuthorizedByCredentials(cfg, "analytics", cfg.Analytics.Credentials)
+		analyticsClient.Transport = failover.roundTripper(analyticsClient.Transport)
 		// overwrite the internalAPI to the GCP managed host if not initialized yet
 		if internalAPI == nil {
 			internalAPI, _ = url.Parse(config.GCPExperienceBase)
@@ -226,23 +431,36 @@ func NewHandler(cfg *config.Config) (*Handler, error) {
 		if err != nil {
 			return nil, err
 		}
+		tr = failover.roundTripper(tr)
 		// the same method is called previously with same inputs, no need to check error again
 		tr, _ = AuthorizationRoundTripper(cfg, tr)
 		analyticsClient = instrumentedClientFor(cfg, "analytics", tr)
 	}
-
-	analyticsMan, err := analytics.NewManager(analytics.Options{
-		LegacyEndpoint:     cfg.Analytics.LegacyEndpoint,
-		BufferPath:         analyticsDir,
-		StagingFileLimit:   cfg.Analytics.FileLimit,
-		BaseURL:            internalAPI,
-		Client:             analyticsClient,
-		SendChannelSize:    cfg.Analytics.SendChannelSize,
-		CollectionInterval: cfg.Analytics.CollectionInterval,
-	})
+	uploads, err := newUploadMonitor(analyticsDir, cfg.Tenant.OrgName, cfg.Analytics.SpoolCheckInterval,
+		cfg.Analytics.UploadTraceEndpoint)
 	if err != nil {
 		return nil, err
 	}
+	analyticsClient.Transport = uploads.roundTripper(analyticsClient.Transport)
+
+	var analyticsMan analytics.Manager = discardAnalyticsManager{}
+	if !options.localManagers {
+		analyticsMan, err = analytics.NewManager(analytics.Options{
+			LegacyEndpoint:     cfg.Analytics.LegacyEndpoint,
+			BufferPath:         analyticsDir,
+			StagingFileLimit:   cfg.Analytics.FileLimit,
+			BaseURL:            internalAPI,
+			Client:             analyticsClient,
+			SendChannelSize:    cfg.Analytics.SendChannelSize,
+			CollectionInterval: cfg.Analytics.CollectionInterval,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	anomalies := newAnomalyDetector(&http.Client{Timeout: cfg.Tenant.ClientTimeout},
+		cfg.Analytics.AnomalyDetection, cfg.Tenant.OrgName)
 
 	h := &Handler{
 		remoteServiceAPI:      remoteServiceAPI,
@@ -253,23 +471,110 @@ func NewHandler(cfg *config.Config) (*Handler, error) {
 		authMan:               authMan,
 		analyticsMan:          analyticsMan,
 		quotaMan:              quotaMan,
+		quotaReconciler:       quotaReconciler,
+		quotaCounting:         cfg.QuotaCounting.Mode,
 		apiKeyClaim:           cfg.Auth.APIKeyClaim,
 		apiKeyHeader:          cfg.Auth.APIKeyHeader,
 		apiHeader:             cfg.Auth.APIHeader,
 		allowUnauthorized:     cfg.Auth.AllowUnauthorized,
 		jwtProviderKey:        cfg.Auth.JWTProviderKey,
 		appendMetadataHeaders: cfg.Auth.AppendMetadataHeaders,
+		appendMatchHeaders:    cfg.Auth.AppendMatchHeaders,
+		metadataHeaderLimit:   cfg.Auth.MetadataHeaderMaxBytes,
+		consumerFields:        newConsumerFieldSelection(cfg.Auth.ConsumerFields),
+		baggage:               newUpstreamBaggage(cfg.Auth.Baggage),
+		datacaptureNamespaces: cfg.Analytics.DatacaptureNamespaces,
+		analyticsProxyFields:  cfg.Analytics.ProxyFields,
+		verificationTimeout:   cfg.Auth.VerificationTimeout,
+		verifyAPIKeyHeaders:   verifyAPIKeyHeaders,
 		isMultitenant:         cfg.Tenant.IsMultitenant(),
+		envRouter:             newEnvironmentRouter(cfg.Tenant.Environments),
 		envSpecsByID:          environmentSpecsByID,
+		specSetup:             specSetup,
 		operationConfigType:   cfg.Tenant.OperationConfigType,
 		ready:                 util.NewAtomicBool(false),
+		checkStages:           checkStages,
+		maxTimeSkew:           cfg.Analytics.MaxTimeSkew,
+		recordDedup:           newRecordDeduplicator(cfg.Analytics.DeduplicationWindow, cfg.Tenant.OrgName),
+		limits: requestLimits{
+			maxHeaders:      cfg.Limits.MaxHeaders,
+			maxHeadersBytes: cfg.Limits.MaxHeadersBytes,
+		},
+		normalizer: newRequestNormalizer(cfg.RequestNormalization.Mode),
+		spool: newSpoolMonitor(analyticsDir, cfg.Analytics.SpoolDenyThreshold,
+			cfg.Analytics.SpoolDenyStatusCode, cfg.Analytics.SpoolCheckInterval),
+		uploads:            uploads,
+		metricLabels:       cfg.Auth.MetricLabels,
+		metricSpecs:        newMetricAllowlist(cfg.Auth.MetricSpecs),
+		metricAPIs:         newMetricAllowlist(cfg.Auth.MetricAPIs),
+		kvms:               kvms,
+		ipReputation:       ipReputation,
+		proxyChain:         proxyChain,
+		oidcDiscovery:      oidcDiscovery,
+		remoteJWKS:         remoteJWKS,
+		caches:             caches,
+		revocations:        revocations,
+		dpopReplay:         newReplayCache(),
+		jwtLimiter:         jwtLimiter,
+		replays:            replays,
+		tracer:             newRequestTracer(proxyChain),
+		anomalies:          anomalies,
+		failover:           failover,
+		concurrency:        newConcurrencyLimiter(),
+		consumerBlocks:     newConsumerBlocklist(),
+		features:           newFeatureFlags(cfg.Tenant.OrgName, cfg.FeatureFlags),
+		denialWebhook:      newDenialWebhook(cfg.DenialWebhook, cfg.Tenant.OrgName),
+		envoyStatsClusters: cfg.EnvoyStats.Clusters,
+		analyticsEnrichers: analyticsEnrichers(),
+		overload: newOverloadManager(cfg.Limits.MaxConcurrentChecks, cfg.Limits.TargetCheckLatency,
+			cfg.Limits.OverloadAction),
+	}
+	h.analyticsWorkers = newAnalyticsWorkers(cfg.Analytics.AccessLogWorkers, cfg.Analytics.AccessLogQueueSize,
+		cfg.Tenant.OrgName, h.analyticsMan.SendRecords)
+	if h.analyticsWorkers != nil {
+		h.analyticsWorkers.start()
+	}
+	h.denialWebhook.start()
+	h.uploads.start()
+	quotaReconciler.start()
+	if h.spool != nil {
+		h.spool.start()
+	}
+	if h.kvms != nil {
+		h.kvms.start()
+	}
+	if h.ipReputation != nil {
+		h.ipReputation.start()
+	}
+	if h.oidcDiscovery != nil {
+		h.oidcDiscovery.start()
+	}
+	if h.remoteJWKS != nil {
+		h.remoteJWKS.start()
+	}
+	if h.revocations != nil {
+		h.revocations.start()
+	}
+	if h.failover != nil {
+		h.failover.start()
+	}
+	if h.anomalies != nil {
+		h.anomalies.start()
+	}
+	h.specSources = newSpecSourcePoller(h, cfg)
+	if h.specSources != nil {
+		h.specSources.start()
+	}
+	h.specDrift = newSpecDriftMonitor(h, cfg.EnvironmentSpecs.DriftCheckInterval)
+	if h.specDrift != nil {
+		h.specDrift.start()
 	}
 	h.setReadyWhenReady()
 
 	return h, nil
 }
 
-func (h Handler) setReadyWhenReady() {
+func (h *Handler) setReadyWhenReady() {
 	go func() {
 		_ = h.productMan.Products() // blocks until loaded
 		h.ready.SetTrue()
@@ -0,0 +1,137 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"math/rand"
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	// metadata only, the redacted request headers of a request sampled by
+	// the header capture of its operation
+	metadataCapturedHeaders = "x-apigee-captured-headers"
+
+	// metadata only, the additional header names the header capture redacts,
+	// those configured and the credential headers of the operation, comma
+	// separated. Present on sampled requests only.
+	metadataCaptureRedact = "x-apigee-capture-redact"
+
+	// prefixes for analytics attributes populated from captured headers
+	capturedRequestHeaderAttributePrefix  = "request.header."
+	capturedResponseHeaderAttributePrefix = "response.header."
+)
+
+// credentialHeaders are always redacted by header captures, as are apiKeyNames
+var credentialHeaders = []string{"authorization", "proxy-authorization", "cookie", "set-cookie",
+	"dpop", "x-forwarded-client-cert"}
+
+// headerCaptureSampled returns true for percent of calls
+func headerCaptureSampled(percent float64) bool {
+	return rand.Float64()*100 < percent
+}
+
+// encodeHeaderCaptureMetadata adds the redacted request headers to the
+// metadata if the request is sampled by the capture, its response headers
+// are captured from the access log. The credentials are the headers the
+// operation reads its credentials from, as credentialHeaderNames.
+func encodeHeaderCaptureMetadata(metadata *structpb.Struct, capture *config.HeaderCapture,
+	headers map[string]string, apiKeyHeader string, credentials []string) {
+	if metadata == nil || capture == nil || !headerCaptureSampled(capture.SamplePercent) {
+		return
+	}
+	redact := append(append([]string{}, capture.Redact...), credentials...)
+	encodeStringMapMetadata(metadata, metadataCapturedHeaders,
+		redactHeaders(headers, redact, apiKeyHeader))
+	metadata.Fields[metadataCaptureRedact] = stringValueFrom(strings.Join(redact, ","))
+}
+
+// credentialHeaderNames returns the headers the JWTs and consumer credentials
+// of the request's operation are read from
+func credentialHeaderNames(envRequest *config.EnvironmentSpecRequest) []string {
+	var names []string
+	addHeaders := func(params []config.APIOperationParameter) {
+		for _, p := range params {
+			if h, ok := p.Match.(config.Header); ok {
+				names = append(names, string(h))
+			}
+		}
+	}
+	for _, jwtAuth := range envRequest.JWTAuthentications() {
+		addHeaders(jwtAuth.In)
+	}
+	consumerAuth := envRequest.GetConsumerAuthorization()
+	addHeaders(consumerAuth.In)
+	for _, alt := range consumerAuth.Alternatives {
+		addHeaders(alt.In)
+	}
+	return names
+}
+
+// capturedHeaderAttributes returns the captured request headers and the
+// redacted response headers of a sampled request as attributes
+func capturedHeaderAttributes(fields map[string]*structpb.Value, responseHeaders map[string]string,
+	apiKeyHeader string) []analytics.Attribute {
+	redactValue, ok := fields[metadataCaptureRedact]
+	if !ok {
+		return nil
+	}
+	var redact []string
+	if v := redactValue.GetStringValue(); v != "" {
+		redact = strings.Split(v, ",")
+	}
+
+	var attributes []analytics.Attribute
+	for k, v := range decodeStringMapMetadata(fields, metadataCapturedHeaders) {
+		attributes = append(attributes, analytics.Attribute{
+			Name:  capturedRequestHeaderAttributePrefix + k,
+			Value: v,
+		})
+	}
+	for k, v := range redactHeaders(responseHeaders, redact, apiKeyHeader) {
+		attributes = append(attributes, analytics.Attribute{
+			Name:  capturedResponseHeaderAttributePrefix + k,
+			Value: v,
+		})
+	}
+	return attributes
+}
+
+// redactHeaders returns the headers, except pseudo-headers, with the values
+// of credentials and of the redact names masked. Names are lowercased.
+func redactHeaders(headers map[string]string, redact []string, apiKeyHeader string) map[string]string {
+	masked := make(map[string]bool)
+	for _, names := range [][]string{credentialHeaders, apiKeyNames, redact, {apiKeyHeader}} {
+		for _, n := range names {
+			masked[strings.ToLower(n)] = true
+		}
+	}
+	redacted := make(map[string]string, len(headers))
+	for k, v := range headers {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, ":") {
+			continue
+		}
+		if masked[k] {
+			v = redactedValue
+		}
+		redacted[k] = v
+	}
+	return redacted
+}
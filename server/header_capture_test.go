@@ -0,0 +1,145 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestRedactHeaders(t *testing.T) {
+	headers := map[string]string{
+		":path":         "/path",
+		"Authorization": "Bearer token",
+		"cookie":        "session=1",
+		"x-api-key":     "key",
+		"x-custom-key":  "custom",
+		"x-secret":      "secret",
+		"dpop":          "proof",
+		"accept":        "*/*",
+	}
+	want := map[string]string{
+		"authorization": redactedValue,
+		"cookie":        redactedValue,
+		"x-api-key":     redactedValue,
+		"x-custom-key":  redactedValue,
+		"x-secret":      redactedValue,
+		"dpop":          redactedValue,
+		"accept":        "*/*",
+	}
+	if diff := cmp.Diff(want, redactHeaders(headers, []string{"X-Secret"}, "x-custom-key")); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestHeaderCaptureSampled(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if !headerCaptureSampled(100) {
+			t.Fatalf("want all sampled at 100 percent")
+		}
+		if headerCaptureSampled(0) {
+			t.Fatalf("want none sampled at 0 percent")
+		}
+	}
+}
+
+func TestHeaderCapture(t *testing.T) {
+	requestHeaders := map[string]string{
+		":method":       "GET",
+		"authorization": "Bearer token",
+		"x-jwt":         "jwt",
+		"x-request":     "request",
+	}
+	responseHeaders := map[string]string{
+		"set-cookie": "session=1",
+		"x-secret":   "secret",
+		"x-response": "response",
+	}
+
+	// not captured without capture or metadata
+	metadata := &structpb.Struct{Fields: map[string]*structpb.Value{}}
+	encodeHeaderCaptureMetadata(metadata, nil, requestHeaders, "", nil)
+	encodeHeaderCaptureMetadata(nil, &config.HeaderCapture{SamplePercent: 100}, requestHeaders, "", nil)
+	if len(metadata.Fields) != 0 {
+		t.Errorf("want no metadata, got: %v", metadata.Fields)
+	}
+	if got := capturedHeaderAttributes(metadata.Fields, responseHeaders, ""); got != nil {
+		t.Errorf("want no attributes, got: %v", got)
+	}
+
+	capture := &config.HeaderCapture{SamplePercent: 100, Redact: []string{"x-secret", "x-other"}}
+	encodeHeaderCaptureMetadata(metadata, capture, requestHeaders, "", []string{"x-jwt"})
+	want := []analytics.Attribute{
+		{Name: "request.header.authorization", Value: redactedValue},
+		{Name: "request.header.x-jwt", Value: redactedValue},
+		{Name: "request.header.x-request", Value: "request"},
+		{Name: "response.header.set-cookie", Value: redactedValue},
+		{Name: "response.header.x-response", Value: "response"},
+		{Name: "response.header.x-secret", Value: redactedValue},
+	}
+	got := capturedHeaderAttributes(metadata.Fields, responseHeaders, "")
+	sort.Slice(got, func(i, j int) bool { return got[i].Name < got[j].Name })
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestCredentialHeaderNames(t *testing.T) {
+	specs := []config.EnvironmentSpec{{
+		ID: "spec",
+		APIs: []config.APISpec{{
+			ID:       "api",
+			BasePath: "/v1",
+			Authentication: config.AuthenticationRequirement{
+				Requirements: config.JWTAuthentication{
+					Name:       "jwt",
+					Issuer:     "issuer",
+					JWKSSource: config.RemoteJWKS{URL: "url", CacheDuration: time.Hour},
+					In:         []config.APIOperationParameter{{Match: config.Header("x-jwt")}},
+				},
+			},
+			ConsumerAuthorization: config.ConsumerAuthorization{
+				In: []config.APIOperationParameter{
+					{Match: config.Query("key")},
+					{Match: config.Header("x-client-key")},
+				},
+			},
+			Operations: []config.APIOperation{{Name: "op", HTTPMatches: []config.HTTPMatch{{PathTemplate: "/pets"}}}},
+		}},
+	}}
+	if err := config.ValidateEnvironmentSpecs(specs); err != nil {
+		t.Fatal(err)
+	}
+	specExt, err := config.NewEnvironmentSpecExt(&specs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	envRequest := config.NewEnvironmentSpecRequest(nil, specExt, &authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{Request: &authv3.AttributeContext_Request{
+			Http: &authv3.AttributeContext_HttpRequest{Method: "GET", Path: "/v1/pets"},
+		}},
+	})
+	want := []string{"x-jwt", "x-client-key"}
+	if diff := cmp.Diff(want, credentialHeaderNames(envRequest)); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+}
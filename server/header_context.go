@@ -15,14 +15,22 @@
 package server
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
 	"os"
 	"strings"
 
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
 	"github.com/apigee/apigee-remote-service-golib/v2/auth"
 	"github.com/apigee/apigee-remote-service-golib/v2/context"
 	"github.com/apigee/apigee-remote-service-golib/v2/log"
 	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 const (
@@ -37,25 +45,154 @@ const (
 	headerFaultFlag     = "x-apigee-fault-flag"
 	headerFaultSource   = "x-apigee-fault-source"
 	headerFaultRevision = "x-apigee-fault-revision"
+
+	// suffix of a header holding an oversized value, gzipped and base64 encoded
+	compressedHeaderSuffix = "-gz"
+	// maximum number of headers an oversized value may be split into
+	maxMetadataHeaderChunks = 16
 )
 
-func metadataHeaders(api string, ac *auth.Context) (headers []*corev3.HeaderValueOption) {
+// metadataHeaders returns the auth context headers and the headers to remove
+// so client-sent headers of the same names don't reach upstream. A value
+// longer than maxBytes (if positive) is compressed into a header named with a
+// "-gz" suffix, split into "-gz", "-gz-1", "-gz-2"... headers if still too
+// long. A value that would need more than maxMetadataHeaderChunks is dropped.
+func metadataHeaders(api string, ac *auth.Context, maxBytes int) (headers []*corev3.HeaderValueOption, remove []string) {
 	if ac == nil {
 		return
 	}
 
-	headers = append(headers, createHeaderValueOption(headerAccessToken, ac.AccessToken, false))
-	headers = append(headers, createHeaderValueOption(headerAPI, api, false))
-	headers = append(headers, createHeaderValueOption(headerAPIProducts, strings.Join(ac.APIProducts, ","), false))
-	headers = append(headers, createHeaderValueOption(headerApplication, ac.Application, false))
-	headers = append(headers, createHeaderValueOption(headerClientID, ac.ClientID, false))
-	headers = append(headers, createHeaderValueOption(headerDeveloperEmail, ac.DeveloperEmail, false))
-	headers = append(headers, createHeaderValueOption(headerEnvironment, ac.Environment(), false))
-	headers = append(headers, createHeaderValueOption(headerOrganization, ac.Organization(), false))
-	headers = append(headers, createHeaderValueOption(headerScope, strings.Join(ac.Scopes, " "), false))
+	add := func(name, value string) {
+		h, r := metadataHeader(name, value, maxBytes)
+		headers = append(headers, h...)
+		remove = append(remove, r...)
+	}
+	add(headerAccessToken, ac.AccessToken)
+	add(headerAPI, api)
+	add(headerAPIProducts, strings.Join(ac.APIProducts, ","))
+	add(headerApplication, ac.Application)
+	add(headerClientID, ac.ClientID)
+	add(headerDeveloperEmail, ac.DeveloperEmail)
+	add(headerEnvironment, ac.Environment())
+	add(headerOrganization, ac.Organization())
+	add(headerScope, strings.Join(ac.Scopes, " "))
+
+	observeMetadataHeadersSize(headers)
 	return
 }
 
+func observeMetadataHeadersSize(headers []*corev3.HeaderValueOption) {
+	size := 0
+	for _, h := range headers {
+		size += len(h.Header.Key) + len(h.Header.Value)
+	}
+	prometheusMetadataHeadersBytes.Observe(float64(size))
+}
+
+// metadataHeader returns the headers of a metadata value and the names of the
+// plain or compressed headers not sent for it, to be removed from the request.
+// Removing the first chunk not sent is enough as chunks are reassembled in
+// sequence.
+func metadataHeader(name, value string, maxBytes int) ([]*corev3.HeaderValueOption, []string) {
+	if maxBytes <= 0 || len(value) <= maxBytes {
+		return []*corev3.HeaderValueOption{createHeaderValueOption(name, value, false)},
+			[]string{compressedHeaderName(name, 0)}
+	}
+
+	dropped := []string{name, compressedHeaderName(name, 0)}
+	encoded, err := compressHeaderValue(value)
+	if err != nil {
+		log.Warnf("dropped metadata header %s, unable to compress: %v", name, err)
+		prometheusMetadataHeadersOversized.WithLabelValues(name, "dropped").Inc()
+		return nil, dropped
+	}
+	chunks := (len(encoded) + maxBytes - 1) / maxBytes
+	if chunks > maxMetadataHeaderChunks {
+		log.Warnf("dropped metadata header %s, value of %d bytes exceeds limit", name, len(value))
+		prometheusMetadataHeadersOversized.WithLabelValues(name, "dropped").Inc()
+		return nil, dropped
+	}
+
+	action := "compressed"
+	if chunks > 1 {
+		action = "chunked"
+	}
+	log.Debugf("metadata header %s of %d bytes %s into %d headers", name, len(value), action, chunks)
+	prometheusMetadataHeadersOversized.WithLabelValues(name, action).Inc()
+
+	headers := make([]*corev3.HeaderValueOption, 0, chunks)
+	for i := 0; i < chunks; i++ {
+		end := (i + 1) * maxBytes
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		headers = append(headers, createHeaderValueOption(compressedHeaderName(name, i), encoded[i*maxBytes:end], false))
+	}
+	remove := []string{name}
+	if chunks < maxMetadataHeaderChunks {
+		remove = append(remove, compressedHeaderName(name, chunks))
+	}
+	return headers, remove
+}
+
+// metadataHeaderValue returns the value of a metadata header, reassembling
+// and decompressing it if it was oversized. The compressed value wins as the
+// plain header is removed when compressed.
+func metadataHeaderValue(headers map[string]string, name string) string {
+	encoded, ok := headers[compressedHeaderName(name, 0)]
+	if !ok {
+		return headers[name]
+	}
+	for i := 1; i < maxMetadataHeaderChunks; i++ {
+		chunk, ok := headers[compressedHeaderName(name, i)]
+		if !ok {
+			break
+		}
+		encoded += chunk
+	}
+	value, err := decompressHeaderValue(encoded)
+	if err != nil {
+		log.Warnf("unable to decompress metadata header %s: %v", name, err)
+		return ""
+	}
+	return value
+}
+
+func compressedHeaderName(name string, chunk int) string {
+	if chunk == 0 {
+		return name + compressedHeaderSuffix
+	}
+	return fmt.Sprintf("%s%s-%d", name, compressedHeaderSuffix, chunk)
+}
+
+func compressHeaderValue(value string) (string, error) {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	if _, err := zw.Write([]byte(value)); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b.Bytes()), nil
+}
+
+func decompressHeaderValue(encoded string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	value, err := io.ReadAll(zr)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
 func (h *Handler) decodeMetadataHeaders(headers map[string]string) (string, *auth.Context) {
 
 	api, ok := headers[headerAPI]
@@ -78,12 +215,29 @@ func (h *Handler) decodeMetadataHeaders(headers map[string]string) (string, *aut
 
 	return api, &auth.Context{
 		Context:        rootContext,
-		AccessToken:    headers[headerAccessToken],
-		APIProducts:    strings.Split(headers[headerAPIProducts], ","),
-		Application:    headers[headerApplication],
-		ClientID:       headers[headerClientID],
-		DeveloperEmail: headers[headerDeveloperEmail],
-		Scopes:         strings.Split(headers[headerScope], " "),
+		AccessToken:    metadataHeaderValue(headers, h.consumerFields.headerName(headerAccessToken)),
+		APIProducts:    strings.Split(metadataHeaderValue(headers, h.consumerFields.headerName(headerAPIProducts)), ","),
+		Application:    metadataHeaderValue(headers, h.consumerFields.headerName(headerApplication)),
+		ClientID:       metadataHeaderValue(headers, h.consumerFields.headerName(headerClientID)),
+		DeveloperEmail: metadataHeaderValue(headers, h.consumerFields.headerName(headerDeveloperEmail)),
+		Scopes:         strings.Split(metadataHeaderValue(headers, h.consumerFields.headerName(headerScope)), " "),
+	}
+}
+
+// matchHeaders returns the headers of the matched environment spec, API base
+// path and operation. Empty values are sent to replace any sent by the client.
+func matchHeaders(envRequest *config.EnvironmentSpecRequest) []*corev3.HeaderValueOption {
+	var spec, basepath, operation string
+	if apiSpec := envRequest.GetAPISpec(); apiSpec != nil {
+		spec, basepath = envRequest.ID, apiSpec.BasePath
+	}
+	if op := envRequest.GetOperation(); op != nil {
+		operation = op.Name
+	}
+	return []*corev3.HeaderValueOption{
+		createHeaderValueOption(metadataEnvironmentSpec, spec, false),
+		createHeaderValueOption(metadataBasepath, basepath, false),
+		createHeaderValueOption(metadataOperation, operation, false),
 	}
 }
 
@@ -111,3 +265,18 @@ func apigeeDynamicDataHeaders(org, env, api, basepath string, fault bool) (heade
 
 	return
 }
+
+var (
+	prometheusMetadataHeadersBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Subsystem: "auth",
+		Name:      "metadata_headers_bytes",
+		Help:      "Total size of auth context metadata headers added to requests",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 8),
+	})
+
+	prometheusMetadataHeadersOversized = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "metadata_headers_oversized_count",
+		Help:      "Total number of oversized metadata headers by action taken",
+	}, []string{"header", "action"})
+)
@@ -15,11 +15,17 @@
 package server
 
 import (
+	"fmt"
+	"math/rand"
 	"reflect"
 	"strings"
 	"testing"
 
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
 	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
 )
 
 func TestMetadataHeaders(t *testing.T) {
@@ -41,7 +47,7 @@ func TestMetadataHeaders(t *testing.T) {
 		Scopes:         []string{"scope1", "scope2"},
 	}
 	api := "api"
-	mh := metadataHeaders(api, authContext)
+	mh, _ := metadataHeaders(api, authContext, 0)
 	headers := map[string]string{}
 	for _, o := range mh {
 		headers[o.Header.Key] = o.Header.Value
@@ -73,9 +79,149 @@ func TestMetadataHeaders(t *testing.T) {
 	}
 }
 
+func TestMatchHeaders(t *testing.T) {
+	envSpec := createAuthEnvSpec()
+	specExt, err := config.NewEnvironmentSpecExt(&envSpec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	headersOf := func(options []*corev3.HeaderValueOption) map[string]string {
+		headers := map[string]string{}
+		for _, o := range options {
+			headers[o.Header.Key] = o.Header.Value
+		}
+		return headers
+	}
+
+	// unmatched values replace any sent by the client
+	want := map[string]string{
+		metadataEnvironmentSpec: "",
+		metadataBasepath:        "",
+		metadataOperation:       "",
+	}
+	if got := headersOf(matchHeaders(nil)); !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+
+	envoyReq := testutil.NewEnvoyRequest("GET", "/v1/petstore", nil, nil)
+	envRequest := config.NewEnvironmentSpecRequest(nil, specExt, envoyReq)
+	want = map[string]string{
+		metadataEnvironmentSpec: "good-env-config",
+		metadataBasepath:        "/v1",
+		metadataOperation:       "op",
+	}
+	if got := headersOf(matchHeaders(envRequest)); !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+
+	// sent with the API ID if enabled
+	server := &AuthorizationServer{handler: &Handler{orgName: "org", envName: "env"}}
+	authContext := &auth.Context{Context: server.handler}
+	resp := server.createEnvoyForwarded(envoyReq, &prometheusRequestMetricTracker{}, authContext, "api",
+		envRequest, &authv3.OkHttpResponse{})
+	if got := headersOf(resp.GetOkResponse().GetHeaders()); got[metadataOperation] != "" || got[headerAPI] != "" {
+		t.Errorf("want no match headers unless enabled, got: %v", got)
+	}
+	fields := resp.GetDynamicMetadata().GetFields()
+	if fields[metadataEnvironmentSpec].GetStringValue() != "good-env-config" || fields[metadataBasepath].GetStringValue() != "/v1" ||
+		fields[metadataOperation].GetStringValue() != "op" || fields[headerAPI].GetStringValue() != "api" {
+		t.Errorf("want match metadata, got: %v", fields)
+	}
+
+	server.handler.appendMatchHeaders = true
+	resp = server.createEnvoyForwarded(envoyReq, &prometheusRequestMetricTracker{}, authContext, "api",
+		envRequest, &authv3.OkHttpResponse{})
+	want[headerAPI] = "api"
+	got := headersOf(resp.GetOkResponse().GetHeaders())
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("header %s want: %q, got: %q", k, v, got[k])
+		}
+	}
+}
+
+func TestOversizedMetadataHeaders(t *testing.T) {
+	h := &Handler{
+		orgName: "org",
+		envName: "env",
+	}
+	products := make([]string, 1000)
+	for i := range products {
+		products[i] = fmt.Sprintf("product-%d", i)
+	}
+	random := make([]byte, 4096) // incompressible
+	rand.New(rand.NewSource(0)).Read(random)
+	authContext := &auth.Context{
+		Context:     h,
+		ClientID:    "clientid",
+		AccessToken: fmt.Sprintf("%x", random),
+		APIProducts: products,
+		Scopes:      []string{"scope1", "scope2"},
+	}
+
+	tests := []struct {
+		desc             string
+		maxBytes         int
+		wantCompressed   []string
+		wantAccessToken  string
+		wantProductCount int
+	}{
+		{"unlimited", 0, nil, authContext.AccessToken, len(products)},
+		{"compressed", 8192, []string{headerAPIProducts}, authContext.AccessToken, len(products)},
+		{"chunked", 1024, []string{headerAccessToken, headerAPIProducts}, authContext.AccessToken, len(products)},
+		{"dropped", 256, []string{headerAPIProducts}, "", len(products)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			// client-sent headers of the same names
+			headers := map[string]string{
+				headerAPIProducts:                          "spoofed",
+				headerAccessToken:                          "spoofed",
+				compressedHeaderName(headerClientID, 0):    "spoofed",
+				compressedHeaderName(headerAccessToken, 2): "spoofed",
+			}
+			var gotCompressed []string
+			mh, remove := metadataHeaders("api", authContext, test.maxBytes)
+			for _, o := range mh {
+				if test.maxBytes > 0 && len(o.Header.Value) > test.maxBytes {
+					t.Errorf("header %s length %d exceeds %d", o.Header.Key, len(o.Header.Value), test.maxBytes)
+				}
+				if strings.HasSuffix(o.Header.Key, compressedHeaderSuffix) {
+					gotCompressed = append(gotCompressed, strings.TrimSuffix(o.Header.Key, compressedHeaderSuffix))
+				}
+				headers[o.Header.Key] = o.Header.Value
+			}
+			for _, name := range remove {
+				delete(headers, name)
+			}
+			if !reflect.DeepEqual(test.wantCompressed, gotCompressed) {
+				t.Errorf("want: %v, got: %v", test.wantCompressed, gotCompressed)
+			}
+
+			_, ac := h.decodeMetadataHeaders(headers)
+			if ac.AccessToken != test.wantAccessToken {
+				t.Errorf("want access token length: %d, got: %d", len(test.wantAccessToken), len(ac.AccessToken))
+			}
+			if len(ac.APIProducts) != test.wantProductCount {
+				t.Errorf("want: %d products, got: %d", test.wantProductCount, len(ac.APIProducts))
+			}
+			if ac.ClientID != authContext.ClientID {
+				t.Errorf("want: %s, got: %s", authContext.ClientID, ac.ClientID)
+			}
+		})
+	}
+
+	// corrupt value
+	value := metadataHeaderValue(map[string]string{headerClientID + "-gz": "not-gzip"}, headerClientID)
+	if value != "" {
+		t.Errorf("want empty value, got: %s", value)
+	}
+}
+
 func TestMetadataHeadersExceptions(t *testing.T) {
-	mh := metadataHeaders("api", nil)
-	if len(mh) != 0 {
+	mh, remove := metadataHeaders("api", nil, 0)
+	if len(mh) != 0 || len(remove) != 0 {
 		t.Errorf("should return nil if no context")
 	}
 
@@ -0,0 +1,324 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	extauthzv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_authz/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// Formats of GenerateIstioManifests.
+const (
+	// IstioEnvoyFilter patches the ext_authz filter, access log and context
+	// extensions into the Envoy config of the workloads.
+	IstioEnvoyFilter = "envoy-filter"
+	// IstioAuthorizationPolicy delegates to the adapter with a CUSTOM
+	// AuthorizationPolicy and sends access logs with a Telemetry, using
+	// extension providers of the mesh config.
+	IstioAuthorizationPolicy = "authorization-policy"
+)
+
+const (
+	istioGatewayNameLabel  = "gateway.networking.k8s.io/gateway-name"
+	istioALSProviderSuffix = "-als"
+)
+
+// dns1123Label is a Kubernetes name or namespace
+var dns1123Label = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// IstioOptions parameterize GenerateIstioManifests.
+type IstioOptions struct {
+	// Format is IstioEnvoyFilter or IstioAuthorizationPolicy.
+	Format string
+	// Name of the generated resources and the extension providers.
+	Name string
+	// Namespace of the generated resources, the root namespace applies
+	// them to the whole mesh.
+	Namespace string
+	// Selector labels the sidecar workloads the resources apply to, all of
+	// the namespace if empty.
+	Selector map[string]string
+	// Gateway is the name of a Gateway API Gateway the resources apply to
+	// instead of sidecars.
+	Gateway string
+	// AdapterService, AdapterNamespace and AdapterPort locate this adapter.
+	AdapterService   string
+	AdapterNamespace string
+	AdapterPort      int
+	// Environment and EnvSpecID are sent as apigee_environment and
+	// apigee_env_config, only by IstioEnvoyFilter.
+	Environment string
+	EnvSpecID   string
+	// CheckTimeout of the ext_authz requests.
+	CheckTimeout time.Duration
+}
+
+func (o IstioOptions) validate() error {
+	if o.Format != IstioEnvoyFilter && o.Format != IstioAuthorizationPolicy {
+		return fmt.Errorf("format must be %s or %s, got %q", IstioEnvoyFilter, IstioAuthorizationPolicy, o.Format)
+	}
+	for field, v := range map[string]string{
+		"name":              o.Name,
+		"namespace":         o.Namespace,
+		"adapter service":   o.AdapterService,
+		"adapter namespace": o.AdapterNamespace,
+	} {
+		if !dns1123Label.MatchString(v) {
+			return fmt.Errorf("%s must be a DNS-1123 label, got %q", field, v)
+		}
+	}
+	if o.Gateway != "" && len(o.Selector) > 0 {
+		return fmt.Errorf("gateway and selector are exclusive")
+	}
+	if o.AdapterPort <= 0 || o.AdapterPort > 65535 {
+		return fmt.Errorf("adapter port must be 1-65535, got %d", o.AdapterPort)
+	}
+	if o.Format == IstioAuthorizationPolicy && (o.Environment != "" || o.EnvSpecID != "") {
+		return fmt.Errorf("environment and environment spec are only sent by format %s", IstioEnvoyFilter)
+	}
+	return nil
+}
+
+// adapterHost is the cluster-local host of the adapter service
+func (o IstioOptions) adapterHost() string {
+	return fmt.Sprintf("%s.%s.svc.cluster.local", o.AdapterService, o.AdapterNamespace)
+}
+
+// istioResource is a Kubernetes resource of an Istio or Gateway API kind
+type istioResource struct {
+	APIVersion string                 `yaml:"apiVersion"`
+	Kind       string                 `yaml:"kind"`
+	Metadata   istioMetadata          `yaml:"metadata"`
+	Spec       map[string]interface{} `yaml:"spec"`
+}
+
+type istioMetadata struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace"`
+}
+
+// GenerateIstioManifests returns the YAML resources wiring the Istio
+// sidecars or gateway selected by opts to this adapter for authorization
+// and analytics.
+func GenerateIstioManifests(opts IstioOptions) ([]byte, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	metadata := istioMetadata{Name: opts.Name, Namespace: opts.Namespace}
+
+	var header string
+	var resources []istioResource
+	if opts.Format == IstioEnvoyFilter {
+		spec, err := istioEnvoyFilterSpec(opts)
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, istioResource{
+			APIVersion: "networking.istio.io/v1alpha3",
+			Kind:       "EnvoyFilter",
+			Metadata:   metadata,
+			Spec:       spec,
+		})
+	} else {
+		header = istioMeshConfigComment(opts)
+		authz := map[string]interface{}{
+			"action":   "CUSTOM",
+			"provider": map[string]interface{}{"name": opts.Name},
+			"rules":    []interface{}{map[string]interface{}{}},
+		}
+		telemetry := map[string]interface{}{
+			"accessLogging": []interface{}{map[string]interface{}{
+				"providers": []interface{}{map[string]interface{}{"name": opts.Name + istioALSProviderSuffix}},
+			}},
+		}
+		istioSelectWorkloads(opts, authz)
+		istioSelectWorkloads(opts, telemetry)
+		resources = append(resources,
+			istioResource{APIVersion: "security.istio.io/v1", Kind: "AuthorizationPolicy", Metadata: metadata, Spec: authz},
+			istioResource{APIVersion: "telemetry.istio.io/v1", Kind: "Telemetry", Metadata: metadata, Spec: telemetry})
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(header)
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	for _, r := range resources {
+		if err := encoder.Encode(r); err != nil {
+			return nil, err
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// istioSelectWorkloads sets the Gateway targetRefs or the selector of a
+// policy spec
+func istioSelectWorkloads(opts IstioOptions, spec map[string]interface{}) {
+	if opts.Gateway != "" {
+		spec["targetRefs"] = []interface{}{map[string]interface{}{
+			"group": "gateway.networking.k8s.io",
+			"kind":  "Gateway",
+			"name":  opts.Gateway,
+		}}
+	} else if len(opts.Selector) > 0 {
+		spec["selector"] = map[string]interface{}{"matchLabels": opts.Selector}
+	}
+}
+
+// istioEnvoyFilterSpec patches the ext_authz filter before the router, the
+// access log into the HTTP connection manager and, if any, the context
+// extensions into the virtual hosts
+func istioEnvoyFilterSpec(opts IstioOptions) (map[string]interface{}, error) {
+	context := "SIDECAR_INBOUND"
+	selector := opts.Selector
+	if opts.Gateway != "" {
+		context = "GATEWAY"
+		selector = map[string]string{istioGatewayNameLabel: opts.Gateway}
+	}
+	cluster := fmt.Sprintf("outbound|%d||%s", opts.AdapterPort, opts.adapterHost())
+
+	extAuthz, err := istioPatchValue(envoyExtAuthz(cluster, opts.CheckTimeout))
+	if err != nil {
+		return nil, err
+	}
+	accessLog, err := istioPatchValue(envoyAccessLog(cluster, true))
+	if err != nil {
+		return nil, err
+	}
+	hcmMatch := map[string]interface{}{
+		"context": context,
+		"listener": map[string]interface{}{
+			"filterChain": map[string]interface{}{
+				"filter": map[string]interface{}{"name": envoyHCMFilter},
+			},
+		},
+	}
+	routerMatch := map[string]interface{}{
+		"context": context,
+		"listener": map[string]interface{}{
+			"filterChain": map[string]interface{}{
+				"filter": map[string]interface{}{
+					"name":      envoyHCMFilter,
+					"subFilter": map[string]interface{}{"name": envoyRouterFilter},
+				},
+			},
+		},
+	}
+	patches := []interface{}{
+		map[string]interface{}{
+			"applyTo": "HTTP_FILTER",
+			"match":   routerMatch,
+			"patch":   map[string]interface{}{"operation": "INSERT_BEFORE", "value": extAuthz},
+		},
+		map[string]interface{}{
+			"applyTo": "NETWORK_FILTER",
+			"match":   hcmMatch,
+			"patch": map[string]interface{}{
+				"operation": "MERGE",
+				"value": map[string]interface{}{
+					"typed_config": map[string]interface{}{
+						"@type":      "type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager",
+						"access_log": []interface{}{accessLog},
+					},
+				},
+			},
+		},
+	}
+
+	contextExtensions := make(map[string]string)
+	if opts.EnvSpecID != "" {
+		contextExtensions[envSpecContextKey] = opts.EnvSpecID
+	}
+	if opts.Environment != "" {
+		contextExtensions[envContextKey] = opts.Environment
+	}
+	if len(contextExtensions) > 0 {
+		perRoute, err := istioPatchValue(&extauthzv3.ExtAuthzPerRoute{
+			Override: &extauthzv3.ExtAuthzPerRoute_CheckSettings{
+				CheckSettings: &extauthzv3.CheckSettings{ContextExtensions: contextExtensions},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		perRoute["@type"] = "type.googleapis.com/envoy.extensions.filters.http.ext_authz.v3.ExtAuthzPerRoute"
+		patches = append(patches, map[string]interface{}{
+			"applyTo": "VIRTUAL_HOST",
+			"match":   map[string]interface{}{"context": context},
+			"patch": map[string]interface{}{
+				"operation": "MERGE",
+				"value": map[string]interface{}{
+					"typed_per_filter_config": map[string]interface{}{envoyExtAuthzFilter: perRoute},
+				},
+			},
+		})
+	}
+
+	spec := map[string]interface{}{"configPatches": patches}
+	if len(selector) > 0 {
+		spec["workloadSelector"] = map[string]interface{}{"labels": selector}
+	}
+	return spec, nil
+}
+
+// istioPatchValue converts an Envoy message to the generic value of an
+// EnvoyFilter patch
+func istioPatchValue(m proto.Message) (map[string]interface{}, error) {
+	b, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var value map[string]interface{}
+	err = json.Unmarshal(b, &value)
+	return value, err
+}
+
+// istioMeshConfigComment documents the extension providers the
+// IstioAuthorizationPolicy resources refer to
+func istioMeshConfigComment(opts IstioOptions) string {
+	timeout := opts.CheckTimeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	lines := []string{
+		"Requires the extension providers in the Istio mesh config:",
+		"meshConfig:",
+		"  extensionProviders:",
+		"  - name: " + opts.Name,
+		"    envoyExtAuthzGrpc:",
+		"      service: " + opts.adapterHost(),
+		fmt.Sprintf("      port: %d", opts.AdapterPort),
+		"      timeout: " + timeout.String(),
+		"  - name: " + opts.Name + istioALSProviderSuffix,
+		"    envoyHttpAls:",
+		"      service: " + opts.adapterHost(),
+		fmt.Sprintf("      port: %d", opts.AdapterPort),
+		"      logName: " + envoyAdapterCluster,
+		"      additionalRequestHeadersToLog: [\":authority\"]",
+		"      additionalResponseHeadersToLog: [\"grpc-status\", \"grpc-message\"]",
+	}
+	return "# " + strings.Join(lines, "\n# ") + "\n"
+}
@@ -0,0 +1,163 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"gopkg.in/yaml.v3"
+)
+
+func testIstioOptions() IstioOptions {
+	return IstioOptions{
+		Format:           IstioEnvoyFilter,
+		Name:             "apigee",
+		Namespace:        "default",
+		AdapterService:   "apigee-remote-service-envoy",
+		AdapterNamespace: "apigee",
+		AdapterPort:      5000,
+	}
+}
+
+// decodeIstioManifests returns the resources of the YAML documents of b
+func decodeIstioManifests(t *testing.T, b []byte) []map[string]interface{} {
+	var resources []map[string]interface{}
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	for {
+		var r map[string]interface{}
+		if err := decoder.Decode(&r); err == io.EOF {
+			return resources
+		} else if err != nil {
+			t.Fatalf("invalid YAML: %v", err)
+		}
+		resources = append(resources, r)
+	}
+}
+
+func TestGenerateIstioEnvoyFilter(t *testing.T) {
+	opts := testIstioOptions()
+	opts.Gateway = "ingress"
+	opts.EnvSpecID = "spec-1"
+	b, err := GenerateIstioManifests(opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resources := decodeIstioManifests(t, b)
+	if len(resources) != 1 || resources[0]["kind"] != "EnvoyFilter" {
+		t.Fatalf("want an EnvoyFilter, got %v", resources)
+	}
+	spec := resources[0]["spec"].(map[string]interface{})
+	wantSelector := map[string]interface{}{"labels": map[string]interface{}{istioGatewayNameLabel: "ingress"}}
+	if diff := cmp.Diff(wantSelector, spec["workloadSelector"]); diff != "" {
+		t.Errorf("workloadSelector diff (-want +got):\n%s", diff)
+	}
+
+	var applyTo []string
+	for _, p := range spec["configPatches"].([]interface{}) {
+		patch := p.(map[string]interface{})
+		applyTo = append(applyTo, patch["applyTo"].(string))
+		if context := patch["match"].(map[string]interface{})["context"]; context != "GATEWAY" {
+			t.Errorf("want GATEWAY context, got %v", context)
+		}
+	}
+	if diff := cmp.Diff([]string{"HTTP_FILTER", "NETWORK_FILTER", "VIRTUAL_HOST"}, applyTo); diff != "" {
+		t.Errorf("patches diff (-want +got):\n%s", diff)
+	}
+	for _, want := range []string{
+		"cluster_name: outbound|5000||apigee-remote-service-envoy.apigee.svc.cluster.local",
+		envSpecContextKey + ": spec-1",
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("want %q in:\n%s", want, b)
+		}
+	}
+
+	// sidecars without context extensions
+	opts = testIstioOptions()
+	opts.Selector = map[string]string{"app": "httpbin"}
+	if b, err = GenerateIstioManifests(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	spec = decodeIstioManifests(t, b)[0]["spec"].(map[string]interface{})
+	if l := len(spec["configPatches"].([]interface{})); l != 2 {
+		t.Errorf("want 2 patches, got %d", l)
+	}
+	if !strings.Contains(string(b), "context: SIDECAR_INBOUND") {
+		t.Errorf("want SIDECAR_INBOUND context in:\n%s", b)
+	}
+}
+
+func TestGenerateIstioAuthorizationPolicy(t *testing.T) {
+	opts := testIstioOptions()
+	opts.Format = IstioAuthorizationPolicy
+	opts.Gateway = "ingress"
+	b, err := GenerateIstioManifests(opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(string(b), "# Requires the extension providers") {
+		t.Errorf("want mesh config comment, got:\n%s", b)
+	}
+	resources := decodeIstioManifests(t, b)
+	var kinds []string
+	for _, r := range resources {
+		kinds = append(kinds, r["kind"].(string))
+		targetRefs := r["spec"].(map[string]interface{})["targetRefs"]
+		wantRefs := []interface{}{map[string]interface{}{
+			"group": "gateway.networking.k8s.io",
+			"kind":  "Gateway",
+			"name":  "ingress",
+		}}
+		if diff := cmp.Diff(wantRefs, targetRefs); diff != "" {
+			t.Errorf("%s targetRefs diff (-want +got):\n%s", r["kind"], diff)
+		}
+	}
+	if diff := cmp.Diff([]string{"AuthorizationPolicy", "Telemetry"}, kinds); diff != "" {
+		t.Errorf("kinds diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestGenerateIstioManifestsErrors(t *testing.T) {
+	tests := []struct {
+		desc string
+		opts func(o *IstioOptions)
+		want string
+	}{
+		{"format", func(o *IstioOptions) { o.Format = "helm" }, "format must be"},
+		{"namespace", func(o *IstioOptions) { o.Namespace = "Bad_NS" }, "namespace must be a DNS-1123 label"},
+		{"gateway and selector", func(o *IstioOptions) {
+			o.Gateway = "ingress"
+			o.Selector = map[string]string{"app": "httpbin"}
+		}, "exclusive"},
+		{"port", func(o *IstioOptions) { o.AdapterPort = 0 }, "adapter port"},
+		{"context extensions", func(o *IstioOptions) {
+			o.Format = IstioAuthorizationPolicy
+			o.Environment = "test"
+		}, "only sent by format envoy-filter"},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			opts := testIstioOptions()
+			test.opts(&opts)
+			if _, err := GenerateIstioManifests(opts); err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("want error containing %q, got: %v", test.want, err)
+			}
+		})
+	}
+}
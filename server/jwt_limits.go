@@ -0,0 +1,133 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	jwtLimitBytes  = "bytes"
+	jwtLimitClaims = "claims"
+	jwtLimitDepth  = "depth"
+)
+
+// jwtLimiter rejects JWTs over the configured limits before they are parsed.
+// The payload is scanned by token without decoding it into values, so the
+// cost of a rejection is bounded by max_bytes.
+type jwtLimiter struct {
+	limits config.JWTLimits
+	org    string
+}
+
+// newJWTLimiter returns a jwtLimiter, nil if there are no limits
+func newJWTLimiter(limits config.JWTLimits, org string) *jwtLimiter {
+	if limits == (config.JWTLimits{}) {
+		return nil
+	}
+	return &jwtLimiter{limits: limits, org: org}
+}
+
+// CheckJWT implements config.JWTLimiter. Malformed tokens are left to the
+// parser to reject.
+func (l *jwtLimiter) CheckJWT(jwtString string) error {
+	if l == nil {
+		return nil
+	}
+	limit, err := l.check(jwtString)
+	if err != nil {
+		prometheusJWTLimitRejections.WithLabelValues(l.org, limit).Inc()
+	}
+	return err
+}
+
+// check returns the limit exceeded and its error
+func (l *jwtLimiter) check(jwtString string) (string, error) {
+	if l.limits.MaxBytes > 0 && len(jwtString) > l.limits.MaxBytes {
+		return jwtLimitBytes, fmt.Errorf("JWT exceeds %d bytes", l.limits.MaxBytes)
+	}
+	if l.limits.MaxClaims <= 0 && l.limits.MaxDepth <= 0 {
+		return "", nil
+	}
+	parts := strings.Split(jwtString, ".")
+	if len(parts) != 3 {
+		return "", nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", nil
+	}
+
+	var containers []jsonContainer
+	claims := 0
+	// value marks a value of the current container read
+	value := func() {
+		if n := len(containers); n > 0 && containers[n-1].object {
+			containers[n-1].key = true
+		}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	for {
+		token, err := decoder.Token()
+		if err != nil { // done or malformed
+			return "", nil
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			containers = append(containers, jsonContainer{object: token == json.Delim('{'), key: true})
+			if l.limits.MaxDepth > 0 && len(containers) > l.limits.MaxDepth {
+				return jwtLimitDepth, fmt.Errorf("JWT claims exceed depth %d", l.limits.MaxDepth)
+			}
+		case json.Delim('}'), json.Delim(']'):
+			containers = containers[:len(containers)-1]
+			value()
+		default:
+			n := len(containers)
+			if n == 0 || !containers[n-1].object || !containers[n-1].key {
+				value()
+				continue
+			}
+			containers[n-1].key = false
+			if n == 1 {
+				claims++
+				if l.limits.MaxClaims > 0 && claims > l.limits.MaxClaims {
+					return jwtLimitClaims, fmt.Errorf("JWT exceeds %d claims", l.limits.MaxClaims)
+				}
+			}
+		}
+	}
+}
+
+// jsonContainer is an object or array being scanned
+type jsonContainer struct {
+	object bool
+	key    bool // an object expects a key next
+}
+
+var (
+	prometheusJWTLimitRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "jwt_limit_rejected_count",
+		Help:      "Total number of JWTs rejected before parsing by limit: bytes, claims, or depth",
+	}, []string{"org", "limit"})
+)
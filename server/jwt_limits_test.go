@@ -0,0 +1,70 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	prometheustest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testJWT returns an unsigned JWT of the payload
+func testJWT(payload string) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256"}`))
+	return header + "." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2ln"
+}
+
+func TestJWTLimiter(t *testing.T) {
+	if newJWTLimiter(config.JWTLimits{}, "org") != nil {
+		t.Errorf("want no limiter without limits")
+	}
+	var nilLimiter *jwtLimiter
+	if err := nilLimiter.CheckJWT("x"); err != nil {
+		t.Errorf("want nil limiter to allow, got %v", err)
+	}
+
+	l := newJWTLimiter(config.JWTLimits{MaxBytes: 200, MaxClaims: 3, MaxDepth: 3}, "limits-org")
+	tests := []struct {
+		desc      string
+		jwt       string
+		wantLimit string
+	}{
+		{"allowed", testJWT(`{"iss":"a","aud":["b","c"],"cnf":{"jkt":"d"}}`), ""},
+		{"nested keys not claims", testJWT(`{"a":{"b":1,"c":2,"d":3,"e":4}}`), ""},
+		{"arrays of objects", testJWT(`{"a":[{"x":1},{"y":2}],"b":[1,[2]],"c":3}`), ""},
+		{"malformed left to parser", "not.a-jwt", ""},
+		{"bytes", strings.Repeat("a", 201), jwtLimitBytes},
+		{"claims", testJWT(`{"a":1,"b":{"x":1},"c":[],"d":null}`), jwtLimitClaims},
+		{"depth", testJWT(`{"a":[[{"b":1}]]}`), jwtLimitDepth},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			limit, err := l.check(test.jwt)
+			if limit != test.wantLimit || (err != nil) != (test.wantLimit != "") {
+				t.Errorf("want limit %q, got %q: %v", test.wantLimit, limit, err)
+			}
+		})
+	}
+
+	if err := l.CheckJWT(testJWT(`{"a":[[[1]]]}`)); err == nil {
+		t.Errorf("want depth rejected")
+	}
+	if got := prometheustest.ToFloat64(prometheusJWTLimitRejections.WithLabelValues("limits-org", jwtLimitDepth)); got != 1 {
+		t.Errorf("want 1 rejection, got %v", got)
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	revocationClaimJTI = "jti"
+	revocationClaimSub = "sub"
+
+	revocationResultOK     = "ok"
+	revocationResultFailed = "failed"
+)
+
+// revocations are the revoked values by claim
+type revocations map[string]map[string]bool
+
+// revocationList periodically loads the jwt_revocation list from a file,
+// URL, or key value map. A failed refresh keeps the previous list.
+type revocationList struct {
+	client   *http.Client
+	file     string
+	url      string
+	kvmURL   string
+	kvm      string
+	interval time.Duration
+	org      string
+	done     chan struct{}
+
+	mu      sync.RWMutex
+	revoked revocations
+}
+
+// newRevocationList creates a revocationList.
+// Returns nil if no list is configured.
+func newRevocationList(client *http.Client, remoteServiceAPI *url.URL, cfg config.JWTRevocation, org, env string) *revocationList {
+	if !cfg.Configured() {
+		return nil
+	}
+	return &revocationList{
+		client:   client,
+		file:     cfg.File,
+		url:      cfg.URL,
+		kvmURL:   kvmURL(remoteServiceAPI, env),
+		kvm:      cfg.KVM,
+		interval: cfg.RefreshRate,
+		org:      org,
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *revocationList) start() {
+	go func() {
+		l.refresh()
+		t := time.NewTicker(l.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				l.refresh()
+			case <-l.done:
+				return
+			}
+		}
+	}()
+}
+
+func (l *revocationList) stop() {
+	if l != nil {
+		close(l.done)
+	}
+}
+
+// IsRevoked implements config.RevocationList
+func (l *revocationList) IsRevoked(claims map[string]interface{}) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, claim := range []string{revocationClaimJTI, revocationClaimSub} {
+		if value, ok := claims[claim].(string); ok && l.revoked[claim][value] {
+			prometheusJWTRevocations.WithLabelValues(l.org, claim).Inc()
+			return true
+		}
+	}
+	return false
+}
+
+// checkRevokedClaims denies the request as unauthenticated if the claims
+// collected for consumer authorization are revoked
+func checkRevokedClaims(c *CheckContext) *authv3.CheckResponse {
+	if !c.server.handler.revocations.IsRevoked(c.claims) {
+		return nil
+	}
+	log.Debugf("JWT claims revoked")
+	c.trace.tracef("authentication: JWT claims revoked")
+	return c.Unauthenticated()
+}
+
+// refresh reloads the list, keeping the previous list on failure
+func (l *revocationList) refresh() {
+	revoked, err := l.load()
+	if err != nil {
+		log.Warnf("unable to refresh JWT revocation list: %v", err)
+		prometheusRevocationRefreshes.WithLabelValues(l.org, revocationResultFailed).Inc()
+		return
+	}
+	l.mu.Lock()
+	l.revoked = revoked
+	l.mu.Unlock()
+	prometheusRevocationRefreshes.WithLabelValues(l.org, revocationResultOK).Inc()
+	log.Debugf("refreshed JWT revocation list: %d jti, %d sub",
+		len(revoked[revocationClaimJTI]), len(revoked[revocationClaimSub]))
+}
+
+func (l *revocationList) load() (revocations, error) {
+	if l.file != "" {
+		f, err := os.Open(l.file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return parseRevocationList(f)
+	}
+
+	if l.kvm != "" {
+		entries, err := fetchKVM(l.client, l.kvmURL, l.kvm)
+		if err != nil {
+			return nil, err
+		}
+		revoked := make(revocations)
+		for name := range entries {
+			if err := revoked.add(name); err != nil {
+				return nil, fmt.Errorf("key value map %q: %v", l.kvm, err)
+			}
+		}
+		return revoked, nil
+	}
+
+	resp, err := l.client.Get(l.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWT revocation list status: %d", resp.StatusCode)
+	}
+	return parseRevocationList(resp.Body)
+}
+
+// parseRevocationList reads a "jti:<id>" or "sub:<subject>" entry per line,
+// blank lines and "#" comments are ignored
+func parseRevocationList(r io.Reader) (revocations, error) {
+	revoked := make(revocations)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		entry := scanner.Text()
+		if i := strings.Index(entry, "#"); i >= 0 {
+			entry = entry[:i]
+		}
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if err := revoked.add(entry); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+	return revoked, scanner.Err()
+}
+
+// add records a "jti:<id>" or "sub:<subject>" entry
+func (r revocations) add(entry string) error {
+	splits := strings.SplitN(entry, ":", 2)
+	if len(splits) < 2 || splits[1] == "" ||
+		(splits[0] != revocationClaimJTI && splits[0] != revocationClaimSub) {
+		return fmt.Errorf("invalid entry %q, must be jti:<id> or sub:<subject>", entry)
+	}
+	if r[splits[0]] == nil {
+		r[splits[0]] = make(map[string]bool)
+	}
+	r[splits[0]][splits[1]] = true
+	return nil
+}
+
+var (
+	prometheusRevocationRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "jwt_revocation_refresh_count",
+		Help:      "Total number of JWT revocation list refreshes by result",
+	}, []string{"org", "result"})
+
+	prometheusJWTRevocations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "jwt_revoked_count",
+		Help:      "Total number of revoked JWTs rejected by matching claim",
+	}, []string{"org", "claim"})
+)
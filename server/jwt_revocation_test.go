@@ -0,0 +1,182 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
+	"github.com/gogo/googleapis/google/rpc"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const testRevocationList = `
+# compromised
+jti:token-1
+sub:user-1   # offboarded
+`
+
+func TestParseRevocationList(t *testing.T) {
+	revoked, err := parseRevocationList(strings.NewReader(testRevocationList))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !revoked[revocationClaimJTI]["token-1"] || !revoked[revocationClaimSub]["user-1"] {
+		t.Errorf("want jti token-1 and sub user-1, got: %v", revoked)
+	}
+
+	for _, bad := range []string{"token-1", "iss:issuer", "jti:"} {
+		if _, err := parseRevocationList(strings.NewReader(bad)); err == nil {
+			t.Errorf("want error for %q", bad)
+		}
+	}
+}
+
+func TestRevocationList(t *testing.T) {
+	if l := newRevocationList(http.DefaultClient, nil, config.JWTRevocation{}, "org", "test"); l != nil {
+		t.Errorf("want nil list if not configured")
+	}
+	var nilList *revocationList
+	if nilList.IsRevoked(map[string]interface{}{"jti": "token-1"}) {
+		t.Errorf("nil list should not revoke")
+	}
+	nilList.stop()
+
+	fail := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		switch r.URL.Path {
+		case "/revoked.txt":
+			_, _ = w.Write([]byte(testRevocationList))
+		case "/remote-service/keyvaluemaps/test/revoked":
+			_ = json.NewEncoder(w).Encode(kvmResponse{Entries: []kvmEntry{
+				{Name: "jti:token-1", Value: "compromised"},
+				{Name: "sub:user-1", Value: "offboarded"},
+			}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	remoteServiceAPI, _ := url.Parse(ts.URL + "/remote-service")
+
+	file := filepath.Join(t.TempDir(), "revoked.txt")
+	if err := os.WriteFile(file, []byte(testRevocationList), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cfg := range []config.JWTRevocation{
+		{URL: ts.URL + "/revoked.txt", RefreshRate: time.Minute},
+		{File: file, RefreshRate: time.Minute},
+		{KVM: "revoked", RefreshRate: time.Minute},
+	} {
+		l := newRevocationList(ts.Client(), remoteServiceAPI, cfg, "org", "test")
+		if l.IsRevoked(map[string]interface{}{"jti": "token-1"}) {
+			t.Errorf("should not revoke before refresh")
+		}
+		l.refresh()
+
+		tests := []struct {
+			claims map[string]interface{}
+			want   bool
+		}{
+			{map[string]interface{}{"jti": "token-1", "sub": "user-2"}, true},
+			{map[string]interface{}{"jti": "token-2", "sub": "user-1"}, true},
+			{map[string]interface{}{"jti": "token-2", "sub": "user-2"}, false},
+			{map[string]interface{}{"jti": 1}, false},
+			{map[string]interface{}{}, false},
+		}
+		for _, test := range tests {
+			if got := l.IsRevoked(test.claims); got != test.want {
+				t.Errorf("%v want: %t, got: %t", test.claims, test.want, got)
+			}
+		}
+	}
+
+	// failed refresh keeps previous list
+	l := newRevocationList(ts.Client(), remoteServiceAPI, config.JWTRevocation{KVM: "revoked", RefreshRate: time.Minute}, "org", "test")
+	l.refresh()
+	fail = true
+	l.refresh()
+	if !l.IsRevoked(map[string]interface{}{"jti": "token-1"}) {
+		t.Errorf("failed refresh should keep previous list")
+	}
+}
+
+func TestCheckRevokedClaims(t *testing.T) {
+	claims := func(jti string) map[string]*structpb.Struct {
+		return map[string]*structpb.Struct{
+			jwtFilterMetadataKey: {Fields: map[string]*structpb.Value{
+				"apigee": structpb.NewStructValue(&structpb.Struct{Fields: map[string]*structpb.Value{
+					"api_product_list": structpb.NewStringValue("product1"),
+					revocationClaimJTI: structpb.NewStringValue(jti),
+				}}),
+			}},
+		}
+	}
+	testAuthMan := &testAuthMan{}
+	server := AuthorizationServer{
+		handler: &Handler{
+			apiKeyClaim:    headerClientID,
+			apiHeader:      headerAPI,
+			apiKeyHeader:   "x-api-key",
+			authMan:        testAuthMan,
+			productMan:     &testProductMan{api: "api", resolve: true, products: product.ProductsNameMap{"product1": &product.APIProduct{DisplayName: "product1"}}},
+			quotaMan:       &testQuotaMan{},
+			analyticsMan:   &testAnalyticsMan{},
+			jwtProviderKey: "apigee",
+			revocations:    &revocationList{revoked: revocations{revocationClaimJTI: {"token-1": true}}},
+			ready:          util.NewAtomicBool(true),
+		},
+	}
+
+	tests := []struct {
+		desc     string
+		jti      string
+		wantCode rpc.Code
+	}{
+		{"valid", "token-2", rpc.OK},
+		{"revoked", "token-1", rpc.UNAUTHENTICATED},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			testAuthMan.sendAuth(&auth.Context{APIProducts: []string{"product1"}}, nil)
+			req := testutil.NewEnvoyRequest(http.MethodGet, "/path", map[string]string{headerAPI: "api"}, claims(test.jti))
+			resp, err := server.Check(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rpc.Code(resp.Status.Code); got != test.wantCode {
+				t.Errorf("want %s, got %s", test.wantCode, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	kvmPath                = "/keyvaluemaps"
+	kvmAttributePrefix     = config.KVMNamespace + "."
+	kvmRefreshResultOK     = "ok"
+	kvmRefreshResultFailed = "failed"
+)
+
+// kvmEntry is an entry of the remote-service key value map response
+type kvmEntry struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// kvmResponse is the response from the remote-service key value map API
+type kvmResponse struct {
+	Entries []kvmEntry `json:"keyValueEntries"`
+}
+
+// kvmManager periodically loads the configured Apigee environment key value
+// maps with the KVM API of a customized remote-service proxy, see
+// config.KeyValueMaps.ProxyAPI. A map that fails to refresh keeps its
+// previous entries.
+type kvmManager struct {
+	client     *http.Client
+	url        string
+	names      []string
+	attributes []string // "map.key" entries recorded in analytics
+	interval   time.Duration
+	org        string
+	done       chan struct{}
+
+	mu   sync.RWMutex
+	maps map[string]map[string]string // map name -> key -> value
+}
+
+// newKVMManager creates a kvmManager.
+// Returns nil if no maps are configured.
+func newKVMManager(client *http.Client, remoteServiceAPI *url.URL, cfg config.KeyValueMaps, org, env string) *kvmManager {
+	if len(cfg.Names) == 0 {
+		return nil
+	}
+	return &kvmManager{
+		client:     client,
+		url:        kvmURL(remoteServiceAPI, env),
+		names:      cfg.Names,
+		attributes: cfg.AnalyticsAttributes,
+		interval:   cfg.RefreshRate,
+		org:        org,
+		done:       make(chan struct{}),
+		maps:       make(map[string]map[string]string, len(cfg.Names)),
+	}
+}
+
+func (k *kvmManager) start() {
+	go func() {
+		k.refresh()
+		t := time.NewTicker(k.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				k.refresh()
+			case <-k.done:
+				return
+			}
+		}
+	}()
+}
+
+func (k *kvmManager) stop() {
+	if k != nil {
+		close(k.done)
+	}
+}
+
+// LookupKVM implements config.KVMLookup
+func (k *kvmManager) LookupKVM(mapName, key string) (string, bool) {
+	if k == nil {
+		return "", false
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	value, ok := k.maps[mapName][key]
+	return value, ok
+}
+
+// analyticsAttributes returns the configured entries as "kvm.map.key"
+// attributes, entries not loaded are omitted
+func (k *kvmManager) analyticsAttributes() []analytics.Attribute {
+	if k == nil {
+		return nil
+	}
+	var attributes []analytics.Attribute
+	for _, attr := range k.attributes {
+		splits := strings.SplitN(attr, ".", 2)
+		if value, ok := k.LookupKVM(splits[0], splits[1]); ok {
+			attributes = append(attributes, analytics.Attribute{
+				Name:  kvmAttributePrefix + attr,
+				Value: value,
+			})
+		}
+	}
+	return attributes
+}
+
+// refresh loads all maps, keeping the previous entries of those that fail
+func (k *kvmManager) refresh() {
+	for _, name := range k.names {
+		entries, err := k.fetch(name)
+		if err != nil {
+			log.Warnf("unable to refresh key value map %q: %v", name, err)
+			prometheusKVMRefreshes.WithLabelValues(k.org, name, kvmRefreshResultFailed).Inc()
+			continue
+		}
+		k.mu.Lock()
+		k.maps[name] = entries
+		k.mu.Unlock()
+		prometheusKVMRefreshes.WithLabelValues(k.org, name, kvmRefreshResultOK).Inc()
+		log.Debugf("refreshed key value map %q: %d entries", name, len(entries))
+	}
+}
+
+func (k *kvmManager) fetch(name string) (map[string]string, error) {
+	return fetchKVM(k.client, k.url, name)
+}
+
+// kvmURL returns the key value map API of the env on the remote-service API, if any
+func kvmURL(remoteServiceAPI *url.URL, env string) string {
+	if remoteServiceAPI == nil {
+		return ""
+	}
+	u := *remoteServiceAPI
+	u.Path = path.Join(u.Path, kvmPath, env)
+	return u.String()
+}
+
+// fetchKVM loads the entries of the named map from the key value map API
+func fetchKVM(client *http.Client, apiURL, name string) (map[string]string, error) {
+	if apiURL == "" {
+		return nil, fmt.Errorf("remote service API required to load key value maps")
+	}
+	req, err := http.NewRequest(http.MethodGet, apiURL+"/"+url.PathEscape(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("keyvaluemaps status: %d", resp.StatusCode)
+	}
+
+	kvmResp := kvmResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&kvmResp); err != nil {
+		return nil, err
+	}
+	entries := make(map[string]string, len(kvmResp.Entries))
+	for _, e := range kvmResp.Entries {
+		entries[e.Name] = e.Value
+	}
+	return entries, nil
+}
+
+var (
+	prometheusKVMRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "kvm",
+		Name:      "refresh_count",
+		Help:      "Total number of key value map refreshes by result",
+	}, []string{"org", "map", "result"})
+)
@@ -0,0 +1,99 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestKVMManager(t *testing.T) {
+	fail := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		switch r.URL.Path {
+		case "/remote-service/keyvaluemaps/test/settings":
+			_ = json.NewEncoder(w).Encode(kvmResponse{Entries: []kvmEntry{
+				{Name: "region", Value: "us-east1"},
+				{Name: "tier", Value: "gold"},
+			}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	remoteServiceAPI, _ := url.Parse(ts.URL + "/remote-service")
+	k := newKVMManager(ts.Client(), remoteServiceAPI, config.KeyValueMaps{
+		Names:               []string{"settings", "missing"},
+		RefreshRate:         time.Minute,
+		AnalyticsAttributes: []string{"settings.region", "settings.unknown", "missing.key"},
+	}, "org", "test")
+
+	if _, ok := k.LookupKVM("settings", "region"); ok {
+		t.Errorf("should not find entry before refresh")
+	}
+
+	k.refresh()
+	if v, ok := k.LookupKVM("settings", "region"); !ok || v != "us-east1" {
+		t.Errorf("want: us-east1, got: %q, %t", v, ok)
+	}
+	if _, ok := k.LookupKVM("missing", "key"); ok {
+		t.Errorf("should not find entry of missing map")
+	}
+
+	want := []analytics.Attribute{{Name: "kvm.settings.region", Value: "us-east1"}}
+	if diff := cmp.Diff(want, k.analyticsAttributes()); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+
+	// failed refresh keeps entries
+	fail = true
+	k.refresh()
+	if v, ok := k.LookupKVM("settings", "tier"); !ok || v != "gold" {
+		t.Errorf("want: gold, got: %q, %t", v, ok)
+	}
+
+	// requires remote service api
+	k = newKVMManager(ts.Client(), nil, config.KeyValueMaps{Names: []string{"settings"}}, "org", "test")
+	if _, err := k.fetch("settings"); err == nil {
+		t.Errorf("want error without remote service API")
+	}
+}
+
+func TestKVMManagerDisabled(t *testing.T) {
+	k := newKVMManager(http.DefaultClient, nil, config.KeyValueMaps{RefreshRate: time.Minute}, "org", "test")
+	if k != nil {
+		t.Fatalf("want nil kvmManager")
+	}
+	if _, ok := k.LookupKVM("settings", "region"); ok {
+		t.Errorf("nil kvmManager should not find entries")
+	}
+	if attrs := k.analyticsAttributes(); attrs != nil {
+		t.Errorf("want no attributes, got: %v", attrs)
+	}
+	k.stop()
+}
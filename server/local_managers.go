@@ -0,0 +1,122 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	"github.com/apigee/apigee-remote-service-golib/v2/quota"
+)
+
+// HandlerOption configures the creation of a Handler
+type HandlerOption func(*handlerOptions)
+
+type handlerOptions struct {
+	localManagers bool
+}
+
+// WithLocalManagers replaces the Apigee analytics and quota managers with
+// local ones: analytics records are discarded and quotas are counted in
+// memory, never synced. For load tests that must not send traffic to Apigee.
+func WithLocalManagers() HandlerOption {
+	return func(o *handlerOptions) {
+		o.localManagers = true
+	}
+}
+
+// discardAnalyticsManager is an analytics.Manager that drops all records
+type discardAnalyticsManager struct{}
+
+var _ analytics.Manager = discardAnalyticsManager{}
+
+func (discardAnalyticsManager) Start() {}
+func (discardAnalyticsManager) Close() {}
+
+// SendRecords implements analytics.Manager
+func (discardAnalyticsManager) SendRecords(*auth.Context, []analytics.Record) error {
+	return nil
+}
+
+// localQuotaManager is a quota.Manager that counts each quota in memory for
+// its interval from the first request, never syncing with Apigee
+type localQuotaManager struct {
+	now     func() time.Time
+	lock    sync.Mutex
+	buckets map[string]*localQuotaBucket
+}
+
+type localQuotaBucket struct {
+	used   int64
+	expiry time.Time
+}
+
+var _ quota.Manager = &localQuotaManager{}
+
+func newLocalQuotaManager() *localQuotaManager {
+	return &localQuotaManager{
+		now:     time.Now,
+		buckets: map[string]*localQuotaBucket{},
+	}
+}
+
+func (q *localQuotaManager) Start() {}
+func (q *localQuotaManager) Close() {}
+
+// Apply implements quota.Manager
+func (q *localQuotaManager) Apply(authContext *auth.Context, op product.AuthorizedOperation, args quota.Args) (*quota.Result, error) {
+	if op.QuotaLimit == 0 {
+		return nil, nil
+	}
+	now := q.now()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	b := q.buckets[op.ID]
+	if b == nil || !now.Before(b.expiry) {
+		b = &localQuotaBucket{expiry: now.Add(localQuotaWindow(op))}
+		q.buckets[op.ID] = b
+	}
+	b.used += args.QuotaAmount
+
+	res := &quota.Result{
+		Allowed:    op.QuotaLimit,
+		Used:       b.used,
+		ExpiryTime: b.expiry.Unix(),
+		Timestamp:  now.Unix(),
+	}
+	if res.Used > res.Allowed {
+		res.Exceeded = res.Used - res.Allowed
+		res.Used = res.Allowed
+	}
+	return res, nil
+}
+
+// localQuotaWindow is the length of the quota interval, a minute if the
+// time unit is unknown
+func localQuotaWindow(op product.AuthorizedOperation) time.Duration {
+	seconds, ok := quotaUnitSeconds[op.QuotaTimeUnit]
+	if !ok {
+		seconds = quotaUnitSeconds["minute"]
+	}
+	interval := op.QuotaInterval
+	if interval < 1 {
+		interval = 1
+	}
+	return time.Duration(float64(interval) * seconds * float64(time.Second))
+}
@@ -0,0 +1,138 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	"github.com/apigee/apigee-remote-service-golib/v2/quota"
+)
+
+func TestLocalQuotaManager(t *testing.T) {
+	now := time.Unix(1000, 0)
+	q := newLocalQuotaManager()
+	q.now = func() time.Time { return now }
+	authContext := &auth.Context{}
+
+	op := product.AuthorizedOperation{
+		ID:            "op",
+		QuotaLimit:    2,
+		QuotaInterval: 1,
+		QuotaTimeUnit: "minute",
+	}
+	args := quota.Args{QuotaAmount: 1}
+
+	for i, want := range []quota.Result{
+		{Allowed: 2, Used: 1},
+		{Allowed: 2, Used: 2},
+		{Allowed: 2, Used: 2, Exceeded: 1},
+	} {
+		res, err := q.Apply(authContext, op, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Allowed != want.Allowed || res.Used != want.Used || res.Exceeded != want.Exceeded {
+			t.Errorf("%d: want %#v, got %#v", i, want, *res)
+		}
+		if res.ExpiryTime != now.Add(time.Minute).Unix() {
+			t.Errorf("%d: want expiry %d, got %d", i, now.Add(time.Minute).Unix(), res.ExpiryTime)
+		}
+	}
+
+	// new window
+	now = now.Add(time.Minute)
+	res, err := q.Apply(authContext, op, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Used != 1 || res.Exceeded != 0 {
+		t.Errorf("want used 1 after expiry, got %#v", *res)
+	}
+
+	// no quota
+	res, err = q.Apply(authContext, product.AuthorizedOperation{ID: "none"}, args)
+	if err != nil || res != nil {
+		t.Errorf("want no result without a quota limit, got %v, %v", res, err)
+	}
+}
+
+func TestLocalQuotaWindow(t *testing.T) {
+	for _, test := range []struct {
+		interval int64
+		unit     string
+		want     time.Duration
+	}{
+		{1, "second", time.Second},
+		{5, "minute", 5 * time.Minute},
+		{2, "day", 48 * time.Hour},
+		{0, "hour", time.Hour},
+		{1, "fortnight", time.Minute},
+	} {
+		op := product.AuthorizedOperation{QuotaInterval: test.interval, QuotaTimeUnit: test.unit}
+		if got := localQuotaWindow(op); got != test.want {
+			t.Errorf("%d %s: want %s, got %s", test.interval, test.unit, test.want, got)
+		}
+	}
+}
+
+func TestNewHandlerWithLocalManagers(t *testing.T) {
+	kid := "kid"
+	privateKey, _, err := testutil.GenerateKeyAndJWKs(kid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default()
+	cfg.Global.TempDir = t.TempDir()
+	cfg.Tenant = config.Tenant{
+		InternalAPI:      "http://localhost/remote-service",
+		RemoteServiceAPI: "http://localhost/remote-service",
+		OrgName:          "org",
+		EnvName:          "*",
+		PrivateKeyID:     kid,
+		PrivateKey:       privateKey,
+	}
+
+	h, err := NewHandler(cfg, WithLocalManagers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	if _, ok := h.analyticsMan.(discardAnalyticsManager); !ok {
+		t.Errorf("want discarding analytics manager, got %T", h.analyticsMan)
+	}
+	if err := h.analyticsMan.SendRecords(&auth.Context{Context: h}, []analytics.Record{{}}); err != nil {
+		t.Errorf("want records discarded, got %v", err)
+	}
+	res, err := h.quotaMan.Apply(&auth.Context{Context: h}, product.AuthorizedOperation{
+		ID:            "op",
+		QuotaLimit:    1,
+		QuotaInterval: 1,
+		QuotaTimeUnit: "minute",
+	}, quota.Args{QuotaAmount: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Used != 1 {
+		t.Errorf("want quota counted locally, got %#v", *res)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+)
+
+const redactedValue = "***"
+
+// apiKeyNames are always redacted, headers, query parameters, and fields alike
+var apiKeyNames = []string{"x-api-key", "api-key", "api_key", "apikey"}
+
+// NewRedactingLogger returns a logger masking API key values in all messages,
+// those of the given names (such as auth.api_key_header) and the defaults, before
+// passing them to logger. Errors logged are masked alike.
+func NewRedactingLogger(logger log.LoggerWithLevel, names ...string) log.LoggerWithLevel {
+	var quoted []string
+	for _, n := range append(append([]string{}, apiKeyNames...), names...) {
+		if n != "" {
+			quoted = append(quoted, regexp.QuoteMeta(n))
+		}
+	}
+	// name, optionally quoted, then : or = and the value up to a delimiter
+	pattern := `(?i)((?:` + strings.Join(quoted, "|") + `)["']?\s*[:=]\s*["']?)([^\s"'&,;}\]]+)` +
+		// the key prefix logged by golib's auth.Manager.Authenticate
+		`|(Authenticate: key: )([^\s,]+)`
+	return &redactingLogger{
+		LoggerWithLevel: logger,
+		pattern:         regexp.MustCompile(pattern),
+	}
+}
+
+// redactingLogger masks API keys in the messages of a log.LoggerWithLevel
+type redactingLogger struct {
+	log.LoggerWithLevel
+	pattern *regexp.Regexp
+}
+
+func (r *redactingLogger) Debugf(format string, args ...interface{}) {
+	if r.DebugEnabled() {
+		r.LoggerWithLevel.Debugf("%s", r.redact(format, args))
+	}
+}
+
+func (r *redactingLogger) Infof(format string, args ...interface{}) {
+	if r.InfoEnabled() {
+		r.LoggerWithLevel.Infof("%s", r.redact(format, args))
+	}
+}
+
+func (r *redactingLogger) Warnf(format string, args ...interface{}) {
+	if r.WarnEnabled() {
+		r.LoggerWithLevel.Warnf("%s", r.redact(format, args))
+	}
+}
+
+func (r *redactingLogger) Errorf(format string, args ...interface{}) {
+	if r.ErrorEnabled() {
+		r.LoggerWithLevel.Errorf("%s", r.redact(format, args))
+	}
+}
+
+// redact formats the message and masks the API key values
+func (r *redactingLogger) redact(format string, args []interface{}) string {
+	return r.pattern.ReplaceAllString(fmt.Sprintf(format, args...), "${1}${3}"+redactedValue)
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+)
+
+type capturingLogger struct {
+	messages []string
+}
+
+func (c *capturingLogger) Debugf(format string, args ...interface{}) {
+	c.messages = append(c.messages, fmt.Sprintf(format, args...))
+}
+func (c *capturingLogger) Infof(format string, args ...interface{}) {
+	c.messages = append(c.messages, fmt.Sprintf(format, args...))
+}
+func (c *capturingLogger) Warnf(format string, args ...interface{}) {
+	c.messages = append(c.messages, fmt.Sprintf(format, args...))
+}
+func (c *capturingLogger) Errorf(format string, args ...interface{}) {
+	c.messages = append(c.messages, fmt.Sprintf(format, args...))
+}
+
+func TestRedactingLogger(t *testing.T) {
+	capture := &capturingLogger{}
+	logger := NewRedactingLogger(&log.LevelWrapper{Logger: capture, LogLevel: log.Debug}, "x-custom-key")
+
+	tests := []struct {
+		format string
+		args   []interface{}
+		want   string
+	}{
+		{"headers: %v", []interface{}{map[string]string{"x-api-key": "secret123"}},
+			"headers: map[x-api-key:***]"},
+		{"headers: %#v", []interface{}{map[string]string{"X-Api-Key": "secret123"}},
+			`headers: map[string]string{"X-Api-Key":"***"}`},
+		{"path: %s", []interface{}{"/pets?apikey=secret123&limit=2"},
+			"path: /pets?apikey=***&limit=2"},
+		{"body: %s", []interface{}{`{"api_key": "secret123", "other": "ok"}`},
+			`body: {"api_key": "***", "other": "ok"}`},
+		{"custom header %s", []interface{}{"x-custom-key: secret123"},
+			"custom header x-custom-key: ***"},
+		{"Authenticate: key: %v, claims: %v", []interface{}{"secre...", "map[]"},
+			"Authenticate: key: ***, claims: map[]"},
+		{"error: %v", []interface{}{fmt.Errorf("bad api-key=secret123")},
+			"error: bad api-key=***"},
+		{"nothing to redact: %s", []interface{}{"key: value"},
+			"nothing to redact: key: value"},
+	}
+	for _, test := range tests {
+		capture.messages = nil
+		logger.Errorf(test.format, test.args...)
+		if len(capture.messages) != 1 || capture.messages[0] != test.want {
+			t.Errorf("want: %q, got: %q", test.want, capture.messages)
+		}
+	}
+
+	// levels are respected
+	logger.SetLevel(log.Info)
+	capture.messages = nil
+	logger.Debugf("x-api-key: secret123")
+	logger.Infof("x-api-key: secret123")
+	logger.Warnf("x-api-key: secret123")
+	if len(capture.messages) != 2 || capture.messages[0] != "x-api-key: ***" {
+		t.Errorf("unexpected messages: %q", capture.messages)
+	}
+}
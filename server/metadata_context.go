@@ -15,11 +15,16 @@
 package server
 
 import (
+	"encoding/json"
 	"strings"
 
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
 	"github.com/apigee/apigee-remote-service-golib/v2/auth"
 	"github.com/apigee/apigee-remote-service-golib/v2/context"
 	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
 	"google.golang.org/protobuf/types/known/structpb"
 )
 
@@ -36,6 +41,73 @@ const (
 	headerEnvironment    = "x-apigee-environment"
 	headerOrganization   = "x-apigee-organization"
 	headerScope          = "x-apigee-scope"
+
+	// metadata only, not sent as a header
+	metadataPathParams = "x-apigee-path-params"
+
+	// prefix for analytics attributes populated from path params
+	pathParamAttributePrefix = "path."
+
+	// metadata only, not sent as a header
+	metadataLabels = "x-apigee-labels"
+
+	// prefix for analytics attributes populated from labels
+	labelAttributePrefix = "label."
+
+	// metadata only, not sent as a header
+	metadataConsumerCredential = "x-apigee-consumer-credential"
+
+	// analytics attribute populated from the consumer credential alternative
+	consumerCredentialAttribute = "consumer.credential"
+
+	// metadata only, not sent as a header
+	metadataBotRule = "x-apigee-bot-rule"
+
+	// analytics attribute populated from the matched bot rule
+	botRuleAttribute = "bot.rule"
+
+	// the name of the matched operation, a header only if auth.append_match_headers
+	metadataOperation = "x-apigee-operation"
+
+	// analytics attribute populated from the matched operation, if enabled by
+	// the analytics_operation feature flag
+	operationAttribute = "operation"
+
+	// the ID of the matched environment spec, a header only if auth.append_match_headers
+	metadataEnvironmentSpec = "x-apigee-environment-spec"
+
+	// the base path of the matched API, a header only if auth.append_match_headers
+	metadataBasepath = "x-apigee-basepath"
+
+	// metadata only, the API proxy name of the analytics records of the matched operation
+	metadataAnalyticsProxy = "x-apigee-analytics-proxy"
+
+	// metadata only, the CORS response headers Envoy was asked to add
+	metadataCORSHeaders = "x-apigee-cors-headers"
+
+	// metadata only, the quotas of an allowed request to count from its
+	// access log record in the access_log quota counting mode
+	metadataPendingQuotas = "x-apigee-pending-quotas"
+
+	// metadata only, the token of a request counted by its API concurrency limit
+	metadataConcurrencyToken = "x-apigee-concurrency-token"
+
+	// metadata only, the reason a request was denied for filters shaping the
+	// response or falling back to local rate limits: a config.Denial* class,
+	// a denyReason*, or else the lowercase gRPC status code
+	metadataDenyReason = "x-apigee-deny-reason"
+
+	// metadata only, the seconds until the quota denying a request resets
+	metadataDenyRetryAfter = "x-apigee-deny-retry-after"
+
+	// metadata only, the quota bucket denying a request
+	metadataDenyQuota = "x-apigee-deny-quota"
+)
+
+// Reasons of denied requests without a denial class.
+const (
+	denyReasonRequestLimit     = "request_limit"
+	denyReasonAmbiguousRequest = "ambiguous_request"
 )
 
 // encodeExtAuthzMetadata encodes given api and auth context into
@@ -66,6 +138,216 @@ func encodeExtAuthzMetadata(api string, ac *auth.Context, authorized bool) *stru
 
 }
 
+// encodePathParamsMetadata adds the path template variables to the metadata
+func encodePathParamsMetadata(metadata *structpb.Struct, params map[string]string) {
+	encodeStringMapMetadata(metadata, metadataPathParams, params)
+}
+
+// decodePathParamsMetadata returns the path template variables from the metadata
+func decodePathParamsMetadata(fields map[string]*structpb.Value) map[string]string {
+	return decodeStringMapMetadata(fields, metadataPathParams)
+}
+
+// encodeLabelsMetadata adds the API and Operation labels to the metadata
+func encodeLabelsMetadata(metadata *structpb.Struct, labels map[string]string) {
+	encodeStringMapMetadata(metadata, metadataLabels, labels)
+}
+
+// decodeLabelsMetadata returns the API and Operation labels from the metadata
+func decodeLabelsMetadata(fields map[string]*structpb.Value) map[string]string {
+	return decodeStringMapMetadata(fields, metadataLabels)
+}
+
+// encodeStringMapMetadata adds a non-empty map as a struct field of the metadata
+func encodeStringMapMetadata(metadata *structpb.Struct, field string, values map[string]string) {
+	if metadata == nil || len(values) == 0 {
+		return
+	}
+	fields := make(map[string]*structpb.Value, len(values))
+	for k, v := range values {
+		fields[k] = stringValueFrom(v)
+	}
+	metadata.Fields[field] = &structpb.Value{
+		Kind: &structpb.Value_StructValue{
+			StructValue: &structpb.Struct{Fields: fields},
+		},
+	}
+}
+
+// decodeStringMapMetadata returns a struct field of the metadata as a map,
+// nil if missing or empty
+func decodeStringMapMetadata(fields map[string]*structpb.Value, field string) map[string]string {
+	mapFields := fields[field].GetStructValue().GetFields()
+	if len(mapFields) == 0 {
+		return nil
+	}
+	values := make(map[string]string, len(mapFields))
+	for k, v := range mapFields {
+		values[k] = v.GetStringValue()
+	}
+	return values
+}
+
+// encodeConsumerCredentialMetadata adds the name of the consumer credential
+// alternative to the metadata
+func encodeConsumerCredentialMetadata(metadata *structpb.Struct, credential string) {
+	if metadata == nil || credential == "" {
+		return
+	}
+	metadata.Fields[metadataConsumerCredential] = stringValueFrom(credential)
+}
+
+// decodeConsumerCredentialMetadata returns the name of the consumer credential
+// alternative from the metadata
+func decodeConsumerCredentialMetadata(fields map[string]*structpb.Value) string {
+	return fields[metadataConsumerCredential].GetStringValue()
+}
+
+// encodeBotRuleMetadata adds the name of the matched bot rule to the metadata
+func encodeBotRuleMetadata(metadata *structpb.Struct, rule string) {
+	if metadata == nil || rule == "" {
+		return
+	}
+	metadata.Fields[metadataBotRule] = stringValueFrom(rule)
+}
+
+// decodeBotRuleMetadata returns the name of the matched bot rule from the metadata
+func decodeBotRuleMetadata(fields map[string]*structpb.Value) string {
+	return fields[metadataBotRule].GetStringValue()
+}
+
+// encodeOperationMetadata adds the name of the matched operation to the metadata
+func encodeOperationMetadata(metadata *structpb.Struct, operation string) {
+	if metadata == nil || operation == "" {
+		return
+	}
+	metadata.Fields[metadataOperation] = stringValueFrom(operation)
+}
+
+// decodeOperationMetadata returns the name of the matched operation from the metadata
+func decodeOperationMetadata(fields map[string]*structpb.Value) string {
+	return fields[metadataOperation].GetStringValue()
+}
+
+// encodeMatchMetadata adds the ID of the matched environment spec and the
+// base path of the matched API to the metadata. The API ID is the
+// x-apigee-api and the operation is added separately.
+func encodeMatchMetadata(metadata *structpb.Struct, envRequest *config.EnvironmentSpecRequest) {
+	apiSpec := envRequest.GetAPISpec()
+	if metadata == nil || apiSpec == nil {
+		return
+	}
+	metadata.Fields[metadataEnvironmentSpec] = stringValueFrom(envRequest.ID)
+	metadata.Fields[metadataBasepath] = stringValueFrom(apiSpec.BasePath)
+}
+
+// decodeBasepathMetadata returns the base path of the matched API from the metadata
+func decodeBasepathMetadata(fields map[string]*structpb.Value) string {
+	return fields[metadataBasepath].GetStringValue()
+}
+
+// encodeAnalyticsProxyMetadata adds the analytics proxy name of the matched
+// operation to the metadata
+func encodeAnalyticsProxyMetadata(metadata *structpb.Struct, proxy string) {
+	if metadata == nil || proxy == "" {
+		return
+	}
+	metadata.Fields[metadataAnalyticsProxy] = stringValueFrom(proxy)
+}
+
+// decodeAnalyticsProxyMetadata returns the analytics proxy name from the
+// metadata, api if none
+func decodeAnalyticsProxyMetadata(fields map[string]*structpb.Value, api string) string {
+	if proxy := fields[metadataAnalyticsProxy].GetStringValue(); proxy != "" {
+		return proxy
+	}
+	return api
+}
+
+// encodeCORSHeadersMetadata adds the CORS response headers to the metadata
+func encodeCORSHeadersMetadata(metadata *structpb.Struct, headers []*corev3.HeaderValueOption) {
+	values := make(map[string]string, len(headers))
+	for _, h := range headers {
+		values[h.GetHeader().GetKey()] = h.GetHeader().GetValue()
+	}
+	encodeStringMapMetadata(metadata, metadataCORSHeaders, values)
+}
+
+// decodeCORSHeadersMetadata returns the CORS response headers from the metadata
+func decodeCORSHeadersMetadata(fields map[string]*structpb.Value) map[string]string {
+	return decodeStringMapMetadata(fields, metadataCORSHeaders)
+}
+
+// encodePendingQuotasMetadata adds the quota operations to count from the
+// access log to the metadata
+func encodePendingQuotasMetadata(metadata *structpb.Struct, ops []product.AuthorizedOperation) {
+	if metadata == nil || len(ops) == 0 {
+		return
+	}
+	data, err := json.Marshal(ops)
+	if err != nil {
+		log.Errorf("unable to encode pending quotas: %v", err)
+		return
+	}
+	metadata.Fields[metadataPendingQuotas] = stringValueFrom(string(data))
+}
+
+// decodePendingQuotasMetadata returns the quota operations to count from the
+// access log from the metadata
+func decodePendingQuotasMetadata(fields map[string]*structpb.Value) []product.AuthorizedOperation {
+	data := fields[metadataPendingQuotas].GetStringValue()
+	if data == "" {
+		return nil
+	}
+	var ops []product.AuthorizedOperation
+	if err := json.Unmarshal([]byte(data), &ops); err != nil {
+		log.Errorf("unable to decode pending quotas: %v", err)
+		return nil
+	}
+	return ops
+}
+
+// encodeConcurrencyTokenMetadata adds the concurrency token to the metadata
+func encodeConcurrencyTokenMetadata(metadata *structpb.Struct, token string) {
+	if metadata == nil || token == "" {
+		return
+	}
+	metadata.Fields[metadataConcurrencyToken] = stringValueFrom(token)
+}
+
+// decodeConcurrencyTokenMetadata returns the concurrency token from the metadata
+func decodeConcurrencyTokenMetadata(fields map[string]*structpb.Value) string {
+	return fields[metadataConcurrencyToken].GetStringValue()
+}
+
+// encodeDenyMetadata returns the metadata of a denied response
+func encodeDenyMetadata(reason string) *structpb.Struct {
+	return &structpb.Struct{
+		Fields: map[string]*structpb.Value{metadataDenyReason: stringValueFrom(reason)},
+	}
+}
+
+// setDenyReason replaces the reason of a denied response, a response
+// forwarding the request is left as is
+func setDenyReason(resp *authv3.CheckResponse, reason string) {
+	if resp.GetDeniedResponse() == nil || resp.GetDynamicMetadata() == nil {
+		return
+	}
+	resp.DynamicMetadata.Fields[metadataDenyReason] = stringValueFrom(reason)
+}
+
+// encodeDenyQuotaMetadata adds the exceeded quota bucket and, if known, the
+// seconds until it resets to the metadata of a denied response
+func encodeDenyQuotaMetadata(metadata *structpb.Struct, quota string, retryAfter int64) {
+	if metadata == nil || metadata.Fields[metadataDenyReason] == nil {
+		return
+	}
+	metadata.Fields[metadataDenyQuota] = stringValueFrom(quota)
+	if retryAfter > 0 {
+		metadata.Fields[metadataDenyRetryAfter] = numberValueFrom(float64(retryAfter))
+	}
+}
+
 // stringValueFrom returns a *structpb.Value with a StringValue Kind
 func stringValueFrom(v string) *structpb.Value {
 	return &structpb.Value{
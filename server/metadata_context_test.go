@@ -18,7 +18,10 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
 	"github.com/apigee/apigee-remote-service-golib/v2/auth"
 	"google.golang.org/protobuf/types/known/structpb"
 )
@@ -80,6 +83,119 @@ func TestEncodeMetadataNilCheck(t *testing.T) {
 	}
 }
 
+func TestEncodePathParamsMetadata(t *testing.T) {
+	h := &Handler{
+		orgName: "org",
+		envName: "env",
+	}
+	authContext := &auth.Context{Context: h}
+
+	metadata := encodeExtAuthzMetadata("api", authContext, true)
+	encodePathParamsMetadata(metadata, nil)
+	if _, ok := metadata.GetFields()[metadataPathParams]; ok {
+		t.Errorf("should not have %q field in metadata", metadataPathParams)
+	}
+	if got := decodePathParamsMetadata(metadata.GetFields()); got != nil {
+		t.Errorf("want nil, got: %v", got)
+	}
+
+	encodePathParamsMetadata(nil, map[string]string{"petId": "1"}) // no panic
+
+	want := map[string]string{"petId": "1", "toyId": "2"}
+	encodePathParamsMetadata(metadata, want)
+	got := decodePathParamsMetadata(metadata.GetFields())
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+}
+
+func TestEncodeLabelsMetadata(t *testing.T) {
+	metadata := &structpb.Struct{Fields: map[string]*structpb.Value{}}
+	encodeLabelsMetadata(metadata, map[string]string{})
+	if got := decodeLabelsMetadata(metadata.GetFields()); got != nil {
+		t.Errorf("want nil, got: %v", got)
+	}
+
+	want := map[string]string{"tier": "gold"}
+	encodeLabelsMetadata(metadata, want)
+	got := decodeLabelsMetadata(metadata.GetFields())
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+}
+
+func TestEncodeConsumerCredentialMetadata(t *testing.T) {
+	h := &Handler{
+		orgName: "org",
+		envName: "env",
+	}
+	authContext := &auth.Context{Context: h}
+
+	metadata := encodeExtAuthzMetadata("api", authContext, true)
+	encodeConsumerCredentialMetadata(metadata, "")
+	if _, ok := metadata.GetFields()[metadataConsumerCredential]; ok {
+		t.Errorf("should not have %q field in metadata", metadataConsumerCredential)
+	}
+
+	encodeConsumerCredentialMetadata(nil, "apikey") // no panic
+
+	encodeConsumerCredentialMetadata(metadata, "apikey")
+	if got := decodeConsumerCredentialMetadata(metadata.GetFields()); got != "apikey" {
+		t.Errorf("want: %q, got: %q", "apikey", got)
+	}
+}
+
+func TestEncodeAnalyticsProxyMetadata(t *testing.T) {
+	h := &Handler{
+		orgName: "org",
+		envName: "env",
+	}
+	authContext := &auth.Context{Context: h}
+
+	metadata := encodeExtAuthzMetadata("api", authContext, true)
+	encodeAnalyticsProxyMetadata(metadata, "")
+	if got := decodeAnalyticsProxyMetadata(metadata.GetFields(), "api"); got != "api" {
+		t.Errorf("want: %q, got: %q", "api", got)
+	}
+
+	encodeAnalyticsProxyMetadata(nil, "proxy") // no panic
+
+	encodeAnalyticsProxyMetadata(metadata, "proxy")
+	if got := decodeAnalyticsProxyMetadata(metadata.GetFields(), "api"); got != "proxy" {
+		t.Errorf("want: %q, got: %q", "proxy", got)
+	}
+}
+
+func TestEncodeMatchMetadata(t *testing.T) {
+	envSpec := createAuthEnvSpec()
+	specExt, err := config.NewEnvironmentSpecExt(&envSpec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	metadata := &structpb.Struct{Fields: map[string]*structpb.Value{}}
+	unmatched := config.NewEnvironmentSpecRequest(nil, specExt, testutil.NewEnvoyRequest("GET", "/unknown", nil, nil))
+	encodeMatchMetadata(metadata, unmatched)
+	if len(metadata.GetFields()) != 0 {
+		t.Errorf("want no fields without a matched API, got: %v", metadata.GetFields())
+	}
+
+	matched := config.NewEnvironmentSpecRequest(nil, specExt, testutil.NewEnvoyRequest("GET", "/v1/petstore", nil, nil))
+	encodeMatchMetadata(nil, matched) // no panic
+	encodeMatchMetadata(metadata, matched)
+	want := map[string]string{
+		metadataEnvironmentSpec: "good-env-config",
+		metadataBasepath:        "/v1",
+	}
+	got := map[string]string{}
+	for k, v := range metadata.GetFields() {
+		got[k] = v.GetStringValue()
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+}
+
 func TestEncodeMetadataAuthorizedField(t *testing.T) {
 	h := &Handler{
 		orgName: "org",
@@ -155,3 +271,42 @@ func TestEncodeMetadataHeadersExceptions(t *testing.T) {
 		t.Errorf("got: %s, want: %s", ac.Environment(), "test")
 	}
 }
+
+func TestDenyMetadata(t *testing.T) {
+	server := &AuthorizationServer{handler: &Handler{orgName: "org", envName: "env"}}
+	req := testutil.NewEnvoyRequest("GET", "/", nil, nil)
+
+	resp := server.notFound(req, nil, nil, "")
+	if got := resp.GetDynamicMetadata().GetFields()[metadataDenyReason].GetStringValue(); got != "not_found" {
+		t.Errorf("want reason %q, got %q", "not_found", got)
+	}
+
+	expiry := time.Now().Add(30 * time.Second).Unix()
+	resp = server.quotaExceeded(req, nil, nil, nil, "api", &exceededQuota{id: "product1", expiry: expiry})
+	fields := resp.GetDynamicMetadata().GetFields()
+	if got := fields[metadataDenyReason].GetStringValue(); got != config.DenialQuotaExceeded {
+		t.Errorf("want reason %q, got %q", config.DenialQuotaExceeded, got)
+	}
+	if got := fields[metadataDenyQuota].GetStringValue(); got != "product1" {
+		t.Errorf("want quota %q, got %q", "product1", got)
+	}
+	if got := fields[metadataDenyRetryAfter].GetNumberValue(); got < 29 || got > 30 {
+		t.Errorf("want retry after about 30, got %v", got)
+	}
+
+	resp = server.quotaExceeded(req, nil, nil, nil, "api", &exceededQuota{id: "product1"})
+	if _, ok := resp.GetDynamicMetadata().GetFields()[metadataDenyRetryAfter]; ok {
+		t.Errorf("want no retry after without expiry")
+	}
+
+	server.handler.allowUnauthorized = true
+	authContext := &auth.Context{Context: server.handler}
+	resp = server.quotaExceeded(req, nil, &prometheusRequestMetricTracker{}, authContext, "api",
+		&exceededQuota{id: "product1", expiry: expiry})
+	if resp.GetOkResponse() == nil {
+		t.Fatalf("want forwarded, got %v", resp)
+	}
+	if _, ok := resp.GetDynamicMetadata().GetFields()[metadataDenyReason]; ok {
+		t.Errorf("want no deny reason when forwarded")
+	}
+}
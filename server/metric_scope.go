@@ -0,0 +1,69 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "github.com/apigee/apigee-remote-service-envoy/v2/config"
+
+const (
+	metricScopeAll   = "*"
+	metricScopeOther = "other"
+)
+
+// metricAllowlist bounds the values of a metric label to those configured
+type metricAllowlist struct {
+	all bool
+	ids map[string]bool
+}
+
+// newMetricAllowlist returns nil if ids is empty
+func newMetricAllowlist(ids []string) *metricAllowlist {
+	if len(ids) == 0 {
+		return nil
+	}
+	l := &metricAllowlist{ids: make(map[string]bool, len(ids))}
+	for _, id := range ids {
+		if id == metricScopeAll {
+			l.all = true
+		}
+		l.ids[id] = true
+	}
+	return l
+}
+
+// value returns id if allowed, "other" if not, "" if id is "" or l is nil
+func (l *metricAllowlist) value(id string) string {
+	if l == nil || id == "" {
+		return ""
+	}
+	if l.all || l.ids[id] {
+		return id
+	}
+	return metricScopeOther
+}
+
+// metricScope returns the "spec" and "api" metric label values of a request
+func (h *Handler) metricScope(envRequest *config.EnvironmentSpecRequest, api string) (spec, apiLabel string) {
+	var specID string
+	if envRequest != nil && envRequest.EnvironmentSpecExt != nil {
+		specID = envRequest.ID
+	}
+	return h.metricScopeOf(specID, api)
+}
+
+// metricScopeOf returns the "spec" and "api" metric label values of the
+// environment spec ID, "" if none, and api, as for requests in access logs
+func (h *Handler) metricScopeOf(specID, api string) (spec, apiLabel string) {
+	return h.metricSpecs.value(specID), h.metricAPIs.value(api)
+}
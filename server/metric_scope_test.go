@@ -0,0 +1,92 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+)
+
+func TestMetricAllowlist(t *testing.T) {
+	tests := []struct {
+		desc string
+		ids  []string
+		id   string
+		want string
+	}{
+		{"disabled", nil, "foo", ""},
+		{"listed", []string{"foo", "bar"}, "bar", "bar"},
+		{"unlisted", []string{"foo", "bar"}, "baz", metricScopeOther},
+		{"all", []string{"*"}, "baz", "baz"},
+		{"blank", []string{"*"}, "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			if got := newMetricAllowlist(test.ids).value(test.id); got != test.want {
+				t.Errorf("want: %q, got: %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestMetricScope(t *testing.T) {
+	envRequest := &config.EnvironmentSpecRequest{
+		EnvironmentSpecExt: &config.EnvironmentSpecExt{
+			EnvironmentSpec: &config.EnvironmentSpec{ID: "spec"},
+		},
+	}
+
+	h := &Handler{
+		metricSpecs: newMetricAllowlist([]string{"spec"}),
+		metricAPIs:  newMetricAllowlist([]string{"apispec1"}),
+	}
+	tests := []struct {
+		desc       string
+		envRequest *config.EnvironmentSpecRequest
+		api        string
+		wantSpec   string
+		wantAPI    string
+	}{
+		{"spec", envRequest, "apispec1", "spec", "apispec1"},
+		{"unlisted api", envRequest, "apispec2", "spec", metricScopeOther},
+		{"global", nil, "apispec1", "", "apispec1"},
+		{"no api", nil, "", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			spec, api := h.metricScope(test.envRequest, test.api)
+			if spec != test.wantSpec {
+				t.Errorf("want spec: %q, got: %q", test.wantSpec, spec)
+			}
+			if api != test.wantAPI {
+				t.Errorf("want api: %q, got: %q", test.wantAPI, api)
+			}
+		})
+	}
+}
+
+func TestMetricScopeOf(t *testing.T) {
+	h := &Handler{
+		metricSpecs: newMetricAllowlist([]string{"spec"}),
+		metricAPIs:  newMetricAllowlist([]string{"apispec1"}),
+	}
+	if spec, api := h.metricScopeOf("spec", "apispec2"); spec != "spec" || api != metricScopeOther {
+		t.Errorf("want spec: %q, api: %q, got: %q, %q", "spec", metricScopeOther, spec, api)
+	}
+	if spec, api := h.metricScopeOf("", "apispec1"); spec != "" || api != "apispec1" {
+		t.Errorf("want spec: %q, api: %q, got: %q, %q", "", "apispec1", spec, api)
+	}
+}
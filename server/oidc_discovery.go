@@ -0,0 +1,276 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	oidcDefaultCacheDuration = 10 * time.Minute
+	oidcCheckInterval        = time.Minute // also the minimum interval of refreshes on failed verification
+	oidcAcceptableSkew       = 10 * time.Second
+
+	oidcRefreshResultOK     = "ok"
+	oidcRefreshResultFailed = "failed"
+)
+
+// oidcConfiguration is the part of an OpenID Provider's discovery document in use
+type oidcConfiguration struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+// oidcDiscoveryManager periodically loads the discovery documents and JWKS of
+// the OIDCDiscovery JWKS sources. A source that fails to refresh keeps its
+// previous keys. Sources are also refreshed, at most once per check interval,
+// when a JWT fails verification so rotated keys are picked up early.
+type oidcDiscoveryManager struct {
+	client    *http.Client
+	org       string
+	now       func() time.Time
+	done      chan struct{}
+	providers map[string]*oidcProvider // by configuration URL, fixed after creation
+}
+
+// oidcProvider is the discovered state of an OIDCDiscovery source
+type oidcProvider struct {
+	source  config.OIDCDiscovery
+	issuers []string // JWTAuthentication issuers the document must declare
+
+	mu          sync.RWMutex
+	issuer      string
+	keys        jwk.Set
+	lastAttempt time.Time
+	lastLoaded  time.Time
+}
+
+// newOIDCDiscoveryManager creates an oidcDiscoveryManager without sources.
+func newOIDCDiscoveryManager(client *http.Client, org string) *oidcDiscoveryManager {
+	return &oidcDiscoveryManager{
+		client:    client,
+		org:       org,
+		now:       time.Now,
+		done:      make(chan struct{}),
+		providers: make(map[string]*oidcProvider),
+	}
+}
+
+// add registers the source of a JWTAuthentication. Must not be called after start.
+func (o *oidcDiscoveryManager) add(source config.OIDCDiscovery, issuer string) {
+	key := source.ConfigurationURL()
+	p, ok := o.providers[key]
+	if !ok {
+		p = &oidcProvider{source: source}
+		o.providers[key] = p
+	}
+	if source.CacheDuration != 0 && (p.source.CacheDuration == 0 || source.CacheDuration < p.source.CacheDuration) {
+		p.source.CacheDuration = source.CacheDuration
+	}
+	if issuer != "" {
+		p.issuers = append(p.issuers, issuer)
+	}
+}
+
+// empty is true if no sources are registered
+func (o *oidcDiscoveryManager) empty() bool {
+	return o == nil || len(o.providers) == 0
+}
+
+func (o *oidcDiscoveryManager) start() {
+	go func() {
+		o.refreshDue()
+		t := time.NewTicker(oidcCheckInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				o.refreshDue()
+			case <-o.done:
+				return
+			}
+		}
+	}()
+}
+
+func (o *oidcDiscoveryManager) stop() {
+	if o != nil {
+		close(o.done)
+	}
+}
+
+// refreshDue refreshes the providers whose cache duration has passed
+func (o *oidcDiscoveryManager) refreshDue() {
+	now := o.now()
+	for _, p := range o.providers {
+		p.mu.RLock()
+		due := p.lastLoaded.IsZero() || now.Sub(p.lastLoaded) >= p.cacheDuration()
+		p.mu.RUnlock()
+		if due {
+			o.refresh(p)
+		}
+	}
+}
+
+// refreshMatching refreshes the providers of an issuer or source URL. False
+// if o is nil or none match.
+func (o *oidcDiscoveryManager) refreshMatching(issuerOrURL string) bool {
+	if o == nil {
+		return false
+	}
+	found := false
+	for key, p := range o.providers {
+		match := key == issuerOrURL || p.source.URL == issuerOrURL || p.source.Issuer() == issuerOrURL
+		for _, issuer := range p.issuers {
+			match = match || issuer == issuerOrURL
+		}
+		if match {
+			o.refresh(p)
+			found = true
+		}
+	}
+	return found
+}
+
+// ParseJWT implements config.OIDCVerifier
+func (o *oidcDiscoveryManager) ParseJWT(jwtString string, source config.OIDCDiscovery) (map[string]interface{}, error) {
+	p, ok := o.providers[source.ConfigurationURL()]
+	if !ok {
+		return nil, fmt.Errorf("unknown OIDC discovery %s", source.URL)
+	}
+	claims, err := p.parse(jwtString)
+	if err != nil && o.claimRefresh(p) {
+		o.refresh(p)
+		claims, err = p.parse(jwtString)
+	}
+	return claims, err
+}
+
+// claimRefresh is true if p has not been refreshed within the check
+// interval, in which case it is marked as attempted for other callers
+func (o *oidcDiscoveryManager) claimRefresh(p *oidcProvider) bool {
+	now := o.now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now.Sub(p.lastAttempt) < oidcCheckInterval {
+		return false
+	}
+	p.lastAttempt = now
+	return true
+}
+
+// refresh reloads the discovery document and JWKS of p, keeping the
+// previous keys on failure
+func (o *oidcDiscoveryManager) refresh(p *oidcProvider) {
+	p.mu.Lock()
+	p.lastAttempt = o.now()
+	p.mu.Unlock()
+
+	issuer, keys, err := o.load(p)
+	if err != nil {
+		log.Warnf("unable to refresh OIDC discovery %s: %v", p.source.URL, err)
+		prometheusOIDCRefreshes.WithLabelValues(o.org, p.source.Issuer(), oidcRefreshResultFailed).Inc()
+		return
+	}
+	p.mu.Lock()
+	p.issuer = issuer
+	p.keys = keys
+	p.lastLoaded = o.now()
+	p.mu.Unlock()
+	prometheusOIDCRefreshes.WithLabelValues(o.org, p.source.Issuer(), oidcRefreshResultOK).Inc()
+	log.Debugf("refreshed OIDC discovery %s: %d keys", p.source.URL, keys.Len())
+}
+
+func (o *oidcDiscoveryManager) load(p *oidcProvider) (string, jwk.Set, error) {
+	resp, err := o.client.Get(p.source.ConfigurationURL())
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("discovery document status: %d", resp.StatusCode)
+	}
+	var doc oidcConfiguration
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return "", nil, fmt.Errorf("invalid discovery document: %v", err)
+	}
+
+	if strings.TrimSuffix(doc.Issuer, "/") != p.source.Issuer() {
+		return "", nil, fmt.Errorf("discovery document issuer %q does not match %q", doc.Issuer, p.source.Issuer())
+	}
+	for _, iss := range p.issuers {
+		if iss != doc.Issuer {
+			return "", nil, fmt.Errorf("discovery document issuer %q does not match JWT issuer %q", doc.Issuer, iss)
+		}
+	}
+	if u, err := url.Parse(doc.JWKSURI); err != nil || !u.IsAbs() {
+		return "", nil, fmt.Errorf("invalid jwks_uri %q", doc.JWKSURI)
+	}
+
+	keys, err := jwk.Fetch(context.Background(), doc.JWKSURI, jwk.WithHTTPClient(o.client))
+	if err != nil {
+		return "", nil, err
+	}
+	return doc.Issuer, keys, nil
+}
+
+// parse verifies the JWT with the keys of p and returns its claims
+func (p *oidcProvider) parse(jwtString string) (map[string]interface{}, error) {
+	p.mu.RLock()
+	issuer, keys := p.issuer, p.keys
+	p.mu.RUnlock()
+	if keys == nil {
+		return nil, fmt.Errorf("OIDC discovery %s not loaded", p.source.URL)
+	}
+
+	token, err := jwt.Parse([]byte(jwtString),
+		jwt.WithKeySet(keys),
+		jwt.WithValidate(true),
+		jwt.WithAcceptableSkew(oidcAcceptableSkew),
+		jwt.WithIssuer(issuer))
+	if err != nil {
+		return nil, err
+	}
+	return token.AsMap(context.Background())
+}
+
+func (p *oidcProvider) cacheDuration() time.Duration {
+	if p.source.CacheDuration > 0 {
+		return p.source.CacheDuration
+	}
+	return oidcDefaultCacheDuration
+}
+
+var (
+	prometheusOIDCRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "oidc_discovery_refresh_count",
+		Help:      "Total number of OIDC discovery document and JWKS refreshes by result",
+	}, []string{"org", "issuer", "result"})
+)
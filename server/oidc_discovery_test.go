@@ -0,0 +1,145 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+)
+
+func TestOIDCDiscoveryManager(t *testing.T) {
+	var mu sync.Mutex
+	var jwks []byte
+	var issuer string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case config.OIDCConfigurationPath:
+			_ = json.NewEncoder(w).Encode(oidcConfiguration{Issuer: issuer, JWKSURI: "http://" + r.Host + "/certs"})
+		case "/certs":
+			_, _ = w.Write(jwks)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	issuer = ts.URL
+
+	rotate := func() *rsa.PrivateKey {
+		privateKey, buf, err := testutil.GenerateKeyAndJWKs("1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		jwks = buf
+		mu.Unlock()
+		return privateKey
+	}
+	sign := func(privateKey *rsa.PrivateKey, iss string) string {
+		jwt, err := testutil.GenerateJWT(privateKey, map[string]interface{}{
+			"iss": iss,
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jwt
+	}
+
+	now := time.Now()
+	source := config.OIDCDiscovery{URL: ts.URL + "/"}
+	o := newOIDCDiscoveryManager(ts.Client(), "org")
+	o.now = func() time.Time { return now }
+	if !o.empty() {
+		t.Errorf("should be empty")
+	}
+	o.add(source, ts.URL)
+	if o.empty() {
+		t.Errorf("should not be empty")
+	}
+
+	key := rotate()
+	o.refreshDue()
+	claims, err := o.ParseJWT(sign(key, ts.URL), source)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if claims["iss"] != ts.URL {
+		t.Errorf("want iss %s, got %v", ts.URL, claims["iss"])
+	}
+
+	if _, err := o.ParseJWT(sign(key, "https://other.example.com"), source); err == nil {
+		t.Errorf("should reject JWT of another issuer")
+	}
+
+	if _, err := o.ParseJWT(sign(key, ts.URL), config.OIDCDiscovery{URL: "https://unknown.example.com"}); err == nil {
+		t.Errorf("should reject unknown source")
+	}
+
+	// rotated keys are refreshed on failed verification
+	now = now.Add(oidcCheckInterval)
+	key = rotate()
+	if _, err := o.ParseJWT(sign(key, ts.URL), source); err != nil {
+		t.Errorf("should verify with rotated key: %v", err)
+	}
+
+	// at most once per check interval
+	key = rotate()
+	if _, err := o.ParseJWT(sign(key, ts.URL), source); err == nil {
+		t.Errorf("should not refresh again within check interval")
+	}
+
+	// refreshed after cache duration
+	now = now.Add(oidcDefaultCacheDuration)
+	o.refreshDue()
+	if _, err := o.ParseJWT(sign(key, ts.URL), source); err != nil {
+		t.Errorf("should verify after refresh: %v", err)
+	}
+
+	// failed refresh keeps keys
+	mu.Lock()
+	issuer = "https://other.example.com"
+	mu.Unlock()
+	now = now.Add(oidcDefaultCacheDuration)
+	o.refreshDue()
+	if _, err := o.ParseJWT(sign(key, ts.URL), source); err != nil {
+		t.Errorf("should verify with previous keys: %v", err)
+	}
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(oidcConfiguration{Issuer: "http://" + r.Host, JWKSURI: "http://" + r.Host + "/certs"})
+	}))
+	defer ts.Close()
+
+	source := config.OIDCDiscovery{URL: ts.URL}
+	o := newOIDCDiscoveryManager(ts.Client(), "org")
+	o.add(source, "https://issuer.example.com")
+	o.refreshDue()
+
+	if _, err := o.ParseJWT("jwt", source); err == nil {
+		t.Errorf("should not load discovery document of another issuer")
+	}
+}
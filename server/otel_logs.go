@@ -0,0 +1,341 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	v3 "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
+	collogs "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonv1 "go.opentelemetry.io/proto/otlp/common/v1"
+	logsv1 "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcev1 "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// LogRecord attributes read from Envoy's OpenTelemetry access logger. For example:
+//
+//	attributes:
+//	  values:
+//	  - key: apigee.ext_authz
+//	    value: { string_value: "%DYNAMIC_METADATA(envoy.filters.http.ext_authz)%" }
+//	  - key: apigee.datacapture
+//	    value: { string_value: "%DYNAMIC_METADATA(envoy.filters.http.apigee.datacapture)%" }
+//	  - key: request.path
+//	    value: { string_value: "%REQ(:PATH)%" }
+//	  - key: request.method
+//	    value: { string_value: "%REQ(:METHOD)%" }
+//	  - key: request.user_agent
+//	    value: { string_value: "%REQ(USER-AGENT)%" }
+//	  - key: request.authority
+//	    value: { string_value: "%REQ(:AUTHORITY)%" }
+//	  - key: request.forwarded_for
+//	    value: { string_value: "%REQ(X-FORWARDED-FOR)%" }
+//	  - key: request.duration
+//	    value: { string_value: "%REQUEST_DURATION%" }
+//	  - key: request.id
+//	    value: { string_value: "%REQ(X-REQUEST-ID)%" }
+//	  - key: request.bytes
+//	    value: { string_value: "%BYTES_RECEIVED%" }
+//	  - key: response.code
+//	    value: { string_value: "%RESPONSE_CODE%" }
+//	  - key: response.flags
+//	    value: { string_value: "%RESPONSE_FLAGS%" }
+//	  - key: response.bytes
+//	    value: { string_value: "%BYTES_SENT%" }
+//	  - key: response.duration
+//	    value: { string_value: "%RESPONSE_DURATION%" }
+//	  - key: duration
+//	    value: { string_value: "%DURATION%" }
+//
+// The LogRecord time is the request start time. Durations are in milliseconds.
+// Metadata of analytics.datacapture_namespaces and of the stream messages
+// filter is read from the attributes named by namespace. Response headers,
+// such as grpc-status, are read from attributes prefixed "response.header.".
+// Records are deduplicated by request ID like those of the access log service.
+const (
+	otelExtAuthzAttribute         = "apigee.ext_authz"
+	otelDatacaptureAttribute      = "apigee.datacapture"
+	otelPathAttribute             = "request.path"
+	otelMethodAttribute           = "request.method"
+	otelUserAgentAttribute        = "request.user_agent"
+	otelAuthorityAttribute        = "request.authority"
+	otelForwardedForAttribute     = "request.forwarded_for"
+	otelRequestDurationAttribute  = "request.duration"
+	otelRequestIDAttribute        = "request.id"
+	otelRequestBytesAttribute     = "request.bytes"
+	otelResponseCodeAttribute     = "response.code"
+	otelResponseFlagsAttribute    = "response.flags"
+	otelResponseBytesAttribute    = "response.bytes"
+	otelResponseDurationAttribute = "response.duration"
+	otelDurationAttribute         = "duration"
+	otelMissingValue              = "-" // Envoy's value for an unavailable command operator
+
+	otelResponseHeaderAttributePrefix = "response.header."
+
+	// Resource attributes of Envoy's OpenTelemetry access logger
+	otelNodeNameResourceAttribute    = "node_name"
+	otelClusterNameResourceAttribute = "cluster_name"
+)
+
+// OTelLogsServer receives Envoy access logs exported over the
+// OpenTelemetry logs protocol (OTLP) and records them as analytics.
+type OTelLogsServer struct {
+	collogs.UnimplementedLogsServiceServer
+	handler       *Handler
+	gatewaySource string
+}
+
+// Register registers
+func (o *OTelLogsServer) Register(s *grpc.Server, handler *Handler) {
+	collogs.RegisterLogsServiceServer(s, o)
+	o.handler = handler
+	o.gatewaySource = defaultGatewaySource
+	if o.handler.operationConfigType == product.ProxyOperationConfigType {
+		o.gatewaySource = managedGatewaySource
+	}
+}
+
+// Export receives a batch of LogRecords
+func (o *OTelLogsServer) Export(ctx context.Context, req *collogs.ExportLogsServiceRequest) (*collogs.ExportLogsServiceResponse, error) {
+	status := "ok"
+	err := o.handleLogs(req.GetResourceLogs())
+	if err != nil {
+		status = "error"
+	}
+	// Envoy exports the logs of its own node only
+	var source envoySource
+	if len(req.GetResourceLogs()) > 0 {
+		source = otelEnvoySource(req.GetResourceLogs()[0].GetResource())
+	}
+	prometheusAnalyticsRequests.WithLabelValues(o.handler.orgName, status).Inc()
+	prometheusAnalyticsClusterRequests.WithLabelValues(o.handler.orgName, source.metricCluster(), status).Inc()
+	if err != nil {
+		return nil, err
+	}
+	return &collogs.ExportLogsServiceResponse{}, nil
+}
+
+func (o *OTelLogsServer) handleLogs(resourceLogs []*logsv1.ResourceLogs) error {
+	for _, rl := range resourceLogs {
+		source := otelEnvoySource(rl.GetResource())
+		for _, ill := range rl.GetInstrumentationLibraryLogs() {
+			for _, lr := range ill.GetLogs() {
+				if err := o.handleLogRecord(lr, source); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (o *OTelLogsServer) handleLogRecord(lr *logsv1.LogRecord, source envoySource) error {
+	return o.handler.handleHTTPLogEntry(o.handler.otelHTTPLogEntry(lr), source, o.gatewaySource)
+}
+
+// otelHTTPLogEntry returns the LogRecord as an access log entry of the access
+// log service so both are recorded the same. OTel access logs have fewer
+// timings than ALS, upstream timings are approximated.
+func (h *Handler) otelHTTPLogEntry(lr *logsv1.LogRecord) *v3.HTTPAccessLogEntry {
+	attrs := make(map[string]*commonv1.AnyValue, len(lr.GetAttributes()))
+	for _, kv := range lr.GetAttributes() {
+		attrs[kv.GetKey()] = kv.GetValue()
+	}
+
+	metadata := map[string]*structpb.Struct{}
+	addMetadata := func(namespace, attr string) {
+		if s := otelStructValue(attrs[attr]); s != nil {
+			metadata[namespace] = s
+		}
+	}
+	addMetadata(extAuthzFilterNamespace, otelExtAuthzAttribute)
+	addMetadata(datacaptureNamespace, otelDatacaptureAttribute)
+	addMetadata(streamMessagesNamespace, streamMessagesNamespace)
+	for _, ns := range h.datacaptureNamespaces {
+		addMetadata(ns.Namespace, ns.Namespace)
+	}
+
+	number := func(attr string) uint64 {
+		n, _ := strconv.ParseUint(otelStringValue(attrs[attr]), 10, 64)
+		return n
+	}
+	millis := func(attr string) *durationpb.Duration {
+		return durationpb.New(time.Duration(number(attr)) * time.Millisecond)
+	}
+	requestDuration := millis(otelRequestDurationAttribute)
+	responseDuration := millis(otelResponseDurationAttribute)
+	duration := millis(otelDurationAttribute)
+
+	var responseHeaders map[string]string
+	for k, v := range attrs {
+		if name := strings.TrimPrefix(k, otelResponseHeaderAttributePrefix); name != k {
+			if value := otelStringValue(v); value != "" {
+				if responseHeaders == nil {
+					responseHeaders = map[string]string{}
+				}
+				responseHeaders[name] = value
+			}
+		}
+	}
+
+	return &v3.HTTPAccessLogEntry{
+		CommonProperties: &v3.AccessLogCommon{
+			StartTime:                   timestamppb.New(time.Unix(0, int64(lr.GetTimeUnixNano()))),
+			TimeToLastRxByte:            requestDuration,
+			TimeToFirstUpstreamTxByte:   requestDuration,
+			TimeToLastUpstreamTxByte:    requestDuration,
+			TimeToFirstUpstreamRxByte:   responseDuration,
+			TimeToLastUpstreamRxByte:    duration,
+			TimeToFirstDownstreamTxByte: responseDuration,
+			TimeToLastDownstreamTxByte:  duration,
+			ResponseFlags:               otelResponseFlags(otelStringValue(attrs[otelResponseFlagsAttribute])),
+			Metadata:                    &core.Metadata{FilterMetadata: metadata},
+		},
+		Request: &v3.HTTPRequestProperties{
+			RequestMethod:    core.RequestMethod(core.RequestMethod_value[otelStringValue(attrs[otelMethodAttribute])]),
+			Authority:        otelStringValue(attrs[otelAuthorityAttribute]),
+			Path:             otelStringValue(attrs[otelPathAttribute]),
+			UserAgent:        otelStringValue(attrs[otelUserAgentAttribute]),
+			ForwardedFor:     otelStringValue(attrs[otelForwardedForAttribute]),
+			RequestId:        otelStringValue(attrs[otelRequestIDAttribute]),
+			RequestBodyBytes: number(otelRequestBytesAttribute),
+		},
+		Response: &v3.HTTPResponseProperties{
+			ResponseCode:      wrapperspb.UInt32(uint32(number(otelResponseCodeAttribute))),
+			ResponseHeaders:   responseHeaders,
+			ResponseBodyBytes: number(otelResponseBytesAttribute),
+		},
+	}
+}
+
+// otelResponseFlags returns the %RESPONSE_FLAGS% short names that decide
+// whether quotas are counted, nil if none
+func otelResponseFlags(value string) *v3.ResponseFlags {
+	if value == "" {
+		return nil
+	}
+	flags := &v3.ResponseFlags{}
+	for _, f := range strings.Split(value, ",") {
+		switch f {
+		case "LH":
+			flags.FailedLocalHealthcheck = true
+		case "UH":
+			flags.NoHealthyUpstream = true
+		case "UT":
+			flags.UpstreamRequestTimeout = true
+		case "UF":
+			flags.UpstreamConnectionFailure = true
+		case "UO":
+			flags.UpstreamOverflow = true
+		case "NR":
+			flags.NoRouteFound = true
+		case "RL":
+			flags.RateLimited = true
+		case "RLSE":
+			flags.RateLimitServiceError = true
+		case "IH":
+			flags.InvalidEnvoyRequestHeaders = true
+		case "DPE":
+			flags.DownstreamProtocolError = true
+		case "NFCF":
+			flags.NoFilterConfigFound = true
+		}
+	}
+	return flags
+}
+
+// otelEnvoySource returns the Envoy node of the resource attributes
+func otelEnvoySource(resource *resourcev1.Resource) envoySource {
+	var source envoySource
+	for _, kv := range resource.GetAttributes() {
+		switch kv.GetKey() {
+		case otelNodeNameResourceAttribute:
+			source.node = otelStringValue(kv.GetValue())
+		case otelClusterNameResourceAttribute:
+			source.cluster = otelStringValue(kv.GetValue())
+		}
+	}
+	return source
+}
+
+// otelStringValue returns a scalar AnyValue as a string, "" if missing
+func otelStringValue(v *commonv1.AnyValue) string {
+	switch v.GetValue().(type) {
+	case *commonv1.AnyValue_StringValue:
+		if s := v.GetStringValue(); s != otelMissingValue {
+			return s
+		}
+	case *commonv1.AnyValue_IntValue:
+		return strconv.FormatInt(v.GetIntValue(), 10)
+	case *commonv1.AnyValue_DoubleValue:
+		return strconv.FormatFloat(v.GetDoubleValue(), 'f', -1, 64)
+	case *commonv1.AnyValue_BoolValue:
+		return strconv.FormatBool(v.GetBoolValue())
+	}
+	return ""
+}
+
+// otelStructValue returns a JSON string or key-value list AnyValue as a Struct,
+// nil if missing or invalid
+func otelStructValue(v *commonv1.AnyValue) *structpb.Struct {
+	switch v.GetValue().(type) {
+	case *commonv1.AnyValue_StringValue:
+		s := &structpb.Struct{}
+		if err := protojson.Unmarshal([]byte(v.GetStringValue()), s); err != nil {
+			return nil
+		}
+		return s
+	case *commonv1.AnyValue_KvlistValue:
+		s := &structpb.Struct{Fields: map[string]*structpb.Value{}}
+		for _, kv := range v.GetKvlistValue().GetValues() {
+			s.Fields[kv.GetKey()] = otelValue(kv.GetValue())
+		}
+		return s
+	}
+	return nil
+}
+
+func otelValue(v *commonv1.AnyValue) *structpb.Value {
+	switch v.GetValue().(type) {
+	case *commonv1.AnyValue_StringValue:
+		return structpb.NewStringValue(v.GetStringValue())
+	case *commonv1.AnyValue_IntValue:
+		return structpb.NewNumberValue(float64(v.GetIntValue()))
+	case *commonv1.AnyValue_DoubleValue:
+		return structpb.NewNumberValue(v.GetDoubleValue())
+	case *commonv1.AnyValue_BoolValue:
+		return structpb.NewBoolValue(v.GetBoolValue())
+	case *commonv1.AnyValue_KvlistValue:
+		return structpb.NewStructValue(otelStructValue(v))
+	case *commonv1.AnyValue_ArrayValue:
+		list := &structpb.ListValue{}
+		for _, e := range v.GetArrayValue().GetValues() {
+			list.Values = append(list.Values, otelValue(e))
+		}
+		return structpb.NewListValue(list)
+	}
+	return structpb.NewNullValue()
+}
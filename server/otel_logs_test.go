@@ -0,0 +1,229 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	"github.com/google/go-cmp/cmp"
+	collogs "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonv1 "go.opentelemetry.io/proto/otlp/common/v1"
+	logsv1 "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcev1 "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func otelString(key, value string) *commonv1.KeyValue {
+	return &commonv1.KeyValue{
+		Key:   key,
+		Value: &commonv1.AnyValue{Value: &commonv1.AnyValue_StringValue{StringValue: value}},
+	}
+}
+
+func TestOTelLogsExport(t *testing.T) {
+	now := time.Now()
+	nowUnix := now.UnixNano() / 1000000
+
+	extAuthzFields := makeExtAuthFields()
+	extAuthzFields[metadataPathParams] = structpb.NewStructValue(&structpb.Struct{
+		Fields: map[string]*structpb.Value{"petId": stringValueFrom("42")},
+	})
+	extAuthzJSON, err := protojson.Marshal(&structpb.Struct{Fields: extAuthzFields})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	datacapture := &commonv1.KeyValue{
+		Key: otelDatacaptureAttribute,
+		Value: &commonv1.AnyValue{Value: &commonv1.AnyValue_KvlistValue{KvlistValue: &commonv1.KeyValueList{
+			Values: []*commonv1.KeyValue{
+				otelString("string", "yellow"),
+				{Key: "number", Value: &commonv1.AnyValue{Value: &commonv1.AnyValue_DoubleValue{DoubleValue: 3.14}}},
+			},
+		}}},
+	}
+
+	record := &logsv1.LogRecord{
+		TimeUnixNano: uint64(now.UnixNano()),
+		Attributes: []*commonv1.KeyValue{
+			otelString(otelExtAuthzAttribute, string(extAuthzJSON)),
+			datacapture,
+			otelString(otelPathAttribute, "path?x=foo"),
+			otelString(otelMethodAttribute, "GET"),
+			otelString(otelUserAgentAttribute, "some agent"),
+			otelString(otelForwardedForAttribute, otelMissingValue),
+			otelString(otelRequestDurationAttribute, "3"),
+			otelString(otelResponseDurationAttribute, "5"),
+			{Key: otelDurationAttribute, Value: &commonv1.AnyValue{Value: &commonv1.AnyValue_IntValue{IntValue: 7}}},
+			otelString(otelResponseCodeAttribute, "200"),
+		},
+	}
+	unknown := &logsv1.LogRecord{
+		TimeUnixNano: uint64(now.UnixNano()),
+		Attributes:   []*commonv1.KeyValue{otelString(otelExtAuthzAttribute, otelMissingValue)},
+	}
+	req := &collogs.ExportLogsServiceRequest{
+		ResourceLogs: []*logsv1.ResourceLogs{{
+			Resource: &resourcev1.Resource{Attributes: []*commonv1.KeyValue{
+				otelString(otelNodeNameResourceAttribute, "node-1"),
+				otelString(otelClusterNameResourceAttribute, "fleet-a"),
+			}},
+			InstrumentationLibraryLogs: []*logsv1.InstrumentationLibraryLogs{{
+				Logs: []*logsv1.LogRecord{record, unknown},
+			}},
+		}},
+	}
+
+	testAnalyticsMan := &testAnalyticsMan{}
+	server := OTelLogsServer{
+		handler: &Handler{
+			orgName:      "org",
+			envName:      "env",
+			analyticsMan: testAnalyticsMan,
+		},
+		gatewaySource: defaultGatewaySource,
+	}
+	if _, err := server.Export(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	recs := testAnalyticsMan.records
+	if len(recs) != 1 {
+		t.Fatalf("got: %d, want: %d", len(recs), 1)
+	}
+	rec := recs[0]
+
+	for _, test := range []struct {
+		desc      string
+		got, want interface{}
+	}{
+		{"api", rec.APIProxy, "api"},
+		{"request uri", rec.RequestURI, "path?x=foo"},
+		{"request path", rec.RequestPath, "path"},
+		{"verb", rec.RequestVerb, "GET"},
+		{"user agent", rec.UserAgent, "some agent"},
+		{"client ip", rec.ClientIP, ""},
+		{"response code", rec.ResponseStatusCode, 200},
+		{"gateway source", rec.GatewaySource, defaultGatewaySource},
+		{"client received start", rec.ClientReceivedStartTimestamp, nowUnix},
+		{"client received end", rec.ClientReceivedEndTimestamp, nowUnix + 3},
+		{"target sent start", rec.TargetSentStartTimestamp, nowUnix + 3},
+		{"target received start", rec.TargetReceivedStartTimestamp, nowUnix + 5},
+		{"client sent end", rec.ClientSentEndTimestamp, nowUnix + 7},
+	} {
+		if test.got != test.want {
+			t.Errorf("%s got: %v, want: %v", test.desc, test.got, test.want)
+		}
+	}
+
+	attrMap := make(map[string]interface{})
+	for _, attr := range rec.Attributes {
+		attrMap[attr.Name] = attr.Value
+	}
+	if attrMap["string"] != "yellow" {
+		t.Errorf("got: %v, want: %v", attrMap["string"], "yellow")
+	}
+	if attrMap["number"] != float64(3.14) {
+		t.Errorf("got: %v, want: %v", attrMap["number"], float64(3.14))
+	}
+	if attrMap["path.petId"] != "42" {
+		t.Errorf("got: %v, want: %v", attrMap["path.petId"], "42")
+	}
+	if attrMap[envoyNodeAttribute] != "node-1" {
+		t.Errorf("got: %v, want: %v", attrMap[envoyNodeAttribute], "node-1")
+	}
+	if attrMap[envoyClusterAttribute] != "fleet-a" {
+		t.Errorf("got: %v, want: %v", attrMap[envoyClusterAttribute], "fleet-a")
+	}
+}
+
+func TestOTelLogsCountQuotas(t *testing.T) {
+	metadata := &structpb.Struct{Fields: makeExtAuthFields()}
+	encodePendingQuotasMetadata(metadata, []product.AuthorizedOperation{{ID: "product1", QuotaLimit: 10}})
+	extAuthzJSON, err := protojson.Marshal(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := func(requestID, flags string) *logsv1.LogRecord {
+		return &logsv1.LogRecord{
+			TimeUnixNano: uint64(time.Now().UnixNano()),
+			Attributes: []*commonv1.KeyValue{
+				otelString(otelExtAuthzAttribute, string(extAuthzJSON)),
+				otelString(otelPathAttribute, "/path"),
+				otelString(otelRequestIDAttribute, requestID),
+				otelString(otelResponseCodeAttribute, "503"),
+				otelString(otelResponseFlagsAttribute, flags),
+				otelString(otelResponseHeaderAttributePrefix+headerGRPCStatus, "14"),
+			},
+		}
+	}
+	counted := record("counted", otelMissingValue)
+	req := &collogs.ExportLogsServiceRequest{
+		ResourceLogs: []*logsv1.ResourceLogs{{
+			InstrumentationLibraryLogs: []*logsv1.InstrumentationLibraryLogs{{
+				Logs: []*logsv1.LogRecord{counted, counted, record("failed", "UF,URX")},
+			}},
+		}},
+	}
+
+	testAnalyticsMan := &testAnalyticsMan{}
+	quotaMan := &testQuotaMan{}
+	server := OTelLogsServer{
+		handler: &Handler{
+			orgName:       "org",
+			envName:       "env",
+			analyticsMan:  testAnalyticsMan,
+			quotaMan:      quotaMan,
+			quotaCounting: config.QuotaCountingAccessLog,
+			recordDedup:   newRecordDeduplicator(time.Minute, "org"),
+		},
+		gatewaySource: defaultGatewaySource,
+	}
+	if _, err := server.Export(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	// the resent record is a duplicate, the failed connection isn't counted
+	if got := len(testAnalyticsMan.records); got != 2 {
+		t.Errorf("want 2 records, got: %d", got)
+	}
+	if diff := cmp.Diff([]string{"product1"}, quotaMan.applied); diff != "" {
+		t.Errorf("applied diff (-want +got):\n%s", diff)
+	}
+	var grpcStatus interface{}
+	for _, attr := range testAnalyticsMan.records[0].Attributes {
+		if attr.Name == grpcStatusAttribute {
+			grpcStatus = attr.Value
+		}
+	}
+	if grpcStatus != "Unavailable" {
+		t.Errorf("got grpc status: %v, want: %v", grpcStatus, "Unavailable")
+	}
+}
+
+func TestOTelResponseFlags(t *testing.T) {
+	if f := otelResponseFlags(""); f != nil {
+		t.Errorf("want no flags, got: %v", f)
+	}
+	f := otelResponseFlags("UH,NR")
+	if !f.GetNoHealthyUpstream() || !f.GetNoRouteFound() || f.GetUpstreamOverflow() {
+		t.Errorf("got: %v", f)
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// retryEndpointJWKS is the retry endpoint of JWKS and OIDC discovery fetches
+const retryEndpointJWKS = "jwks"
+
+// retry results of the retry_count metric
+const (
+	retryResultRetried            = "retried"
+	retryResultBudgetExhausted    = "budget_exhausted"
+	retryResultRetryAfterExceeded = "retry_after_exceeded"
+)
+
+// outboundRetryKey marks the context of requests retried by a retryRoundTripper
+type outboundRetryKey struct{}
+
+// outboundRetries retries the outbound calls of endpoints within their budgets
+type outboundRetries struct {
+	cfg    config.OutboundRetry
+	org    string
+	now    func() time.Time
+	jitter func() float64 // in [0, 1)
+	sleep  func(ctx context.Context, d time.Duration) error
+
+	mu      sync.Mutex
+	budgets map[string]float64 // endpoint -> retries available
+}
+
+// newOutboundRetries returns nil if calls are not retried
+func newOutboundRetries(cfg config.OutboundRetry, org string) *outboundRetries {
+	if cfg.MaxAttempts <= 1 {
+		return nil
+	}
+	return &outboundRetries{
+		cfg:     cfg,
+		org:     org,
+		now:     time.Now,
+		jitter:  rand.Float64,
+		sleep:   sleepContext,
+		budgets: make(map[string]float64),
+	}
+}
+
+// client returns c retrying the calls of the endpoint, c if o is nil
+func (o *outboundRetries) client(endpoint string, c *http.Client) *http.Client {
+	if o == nil {
+		return c
+	}
+	o.mu.Lock()
+	if _, ok := o.budgets[endpoint]; !ok {
+		o.budgets[endpoint] = float64(o.cfg.BudgetBurst)
+	}
+	o.mu.Unlock()
+	base := c.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	c.Transport = &retryRoundTripper{retries: o, endpoint: endpoint, base: base}
+	return c
+}
+
+// earn adds the budget of a call to the endpoint
+func (o *outboundRetries) earn(endpoint string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	budget := o.budgets[endpoint] + o.cfg.BudgetRatio
+	if budget > float64(o.cfg.BudgetBurst) {
+		budget = float64(o.cfg.BudgetBurst)
+	}
+	o.budgets[endpoint] = budget
+}
+
+// spend takes a retry from the budget of the endpoint, false if none left
+func (o *outboundRetries) spend(endpoint string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.budgets[endpoint] < 1 {
+		return false
+	}
+	o.budgets[endpoint]--
+	return true
+}
+
+// backoff returns the wait before the retry following attempt, the
+// Retry-After of resp if any. False if the Retry-After exceeds MaxBackoff.
+func (o *outboundRetries) backoff(attempt int, resp *http.Response) (time.Duration, bool) {
+	if resp != nil {
+		if wait, ok := retryAfter(resp.Header.Get("Retry-After"), o.now()); ok {
+			return wait, wait <= o.cfg.MaxBackoff
+		}
+	}
+	ceiling := o.cfg.InitialBackoff << uint(attempt-1)
+	if ceiling > o.cfg.MaxBackoff || ceiling <= 0 {
+		ceiling = o.cfg.MaxBackoff
+	}
+	return time.Duration(o.jitter() * float64(ceiling)), true
+}
+
+// retryAfter parses a Retry-After header of seconds or an HTTP date
+func retryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := date.Sub(now); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// retryable is true for the results of a transient failure of req. Requests
+// that aren't idempotent are only retried if they weren't sent.
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	if !idempotent(req.Method) {
+		return dialError(err)
+	}
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || unavailable(resp.StatusCode)
+}
+
+// idempotent is true for the methods whose requests may be sent again
+func idempotent(method string) bool {
+	switch method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// dialError is true if err failed the connection, before the request was sent
+func dialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryRoundTripper retries the transient failures of an endpoint's calls
+type retryRoundTripper struct {
+	retries  *outboundRetries
+	endpoint string
+	base     http.RoundTripper
+}
+
+func (rt *retryRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	o := rt.retries
+	o.earn(rt.endpoint)
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	ctx := context.WithValue(req.Context(), outboundRetryKey{}, true)
+	r := req.WithContext(ctx)
+	for attempt := 1; ; attempt++ {
+		resp, err := rt.base.RoundTrip(r)
+		if !retryable(req, resp, err) || attempt >= o.cfg.MaxAttempts || !replayable || ctx.Err() != nil {
+			return resp, err
+		}
+		wait, ok := o.backoff(attempt, resp)
+		if !ok {
+			prometheusOutboundRetries.WithLabelValues(o.org, rt.endpoint, retryResultRetryAfterExceeded).Inc()
+			return resp, err
+		}
+		if !o.spend(rt.endpoint) {
+			prometheusOutboundRetries.WithLabelValues(o.org, rt.endpoint, retryResultBudgetExhausted).Inc()
+			return resp, err
+		}
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		prometheusOutboundRetries.WithLabelValues(o.org, rt.endpoint, retryResultRetried).Inc()
+		log.Debugf("retrying %s %s in %s, attempt %d failed", req.Method, req.URL.Redacted(), wait, attempt)
+		if err := o.sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+
+		r = req.Clone(ctx)
+		if req.GetBody != nil {
+			if r.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+var (
+	prometheusOutboundRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "apigee",
+		Name:      "retry_count",
+		Help:      "Total number of outbound request retries by endpoint and result",
+	}, []string{"org", "api", "result"})
+)
@@ -0,0 +1,217 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+)
+
+func TestOutboundRetries(t *testing.T) {
+	var statuses []int // of the responses, then 200
+	var retryAfterHeader string
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		if len(statuses) == 0 {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if retryAfterHeader != "" {
+			w.Header().Set("Retry-After", retryAfterHeader)
+		}
+		w.WriteHeader(statuses[0])
+		statuses = statuses[1:]
+	}))
+	defer ts.Close()
+
+	cfg := config.OutboundRetry{
+		MaxAttempts:    3,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     5 * time.Second,
+		BudgetRatio:    0,
+		BudgetBurst:    4,
+	}
+	retries := newOutboundRetries(cfg, "org")
+	var waits []time.Duration
+	retries.jitter = func() float64 { return 0.5 }
+	retries.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+	client := retries.client("products", &http.Client{})
+
+	tests := []struct {
+		desc         string
+		statuses     []int
+		retryAfter   string
+		wantStatus   int
+		wantAttempts int
+		wantWaits    []time.Duration
+	}{
+		{"no failure", nil, "", http.StatusOK, 1, nil},
+		{"jittered backoff", []int{http.StatusServiceUnavailable, http.StatusBadGateway}, "", http.StatusOK, 3,
+			[]time.Duration{50 * time.Millisecond, 100 * time.Millisecond}},
+		{"attempts exhausted", []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable}, "",
+			http.StatusServiceUnavailable, 3, nil}, // spends the rest of the budget of 4
+		{"not retryable", []int{http.StatusInternalServerError}, "", http.StatusInternalServerError, 1, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			statuses, retryAfterHeader, waits, bodies = test.statuses, test.retryAfter, nil, nil
+			req, _ := http.NewRequest(http.MethodPut, ts.URL, strings.NewReader("body"))
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.wantStatus {
+				t.Errorf("want status %d, got %d", test.wantStatus, resp.StatusCode)
+			}
+			if len(bodies) != test.wantAttempts {
+				t.Errorf("want %d attempts, got %d", test.wantAttempts, len(bodies))
+			}
+			if test.wantWaits != nil && len(waits) != len(test.wantWaits) {
+				t.Fatalf("want waits %v, got %v", test.wantWaits, waits)
+			}
+			for i, w := range test.wantWaits {
+				if waits[i] != w {
+					t.Errorf("want wait %s, got %s", w, waits[i])
+				}
+			}
+			for _, b := range bodies {
+				if b != "body" {
+					t.Errorf("want body replayed, got %q", b)
+				}
+			}
+		})
+	}
+	// not idempotent
+	statuses, waits, bodies = []int{http.StatusServiceUnavailable}, nil, nil
+	resp, err := client.Post(ts.URL, "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || len(bodies) != 1 {
+		t.Errorf("want POST not retried, got status %d after %d attempts", resp.StatusCode, len(bodies))
+	}
+
+	// budget exhausted
+	statuses, waits, bodies = []int{http.StatusServiceUnavailable}, nil, nil
+	resp, err = client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || len(bodies) != 1 {
+		t.Errorf("want no retry without budget, got status %d after %d attempts", resp.StatusCode, len(bodies))
+	}
+
+	// Retry-After honored within max backoff
+	retries = newOutboundRetries(cfg, "org")
+	retries.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+	client = retries.client("auth", &http.Client{})
+	statuses, retryAfterHeader, waits, bodies = []int{http.StatusTooManyRequests}, "2", nil, nil
+	resp, err = client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(waits) != 1 || waits[0] != 2*time.Second {
+		t.Errorf("want retry after 2s, got status %d after waits %v", resp.StatusCode, waits)
+	}
+	statuses, retryAfterHeader, waits, bodies = []int{http.StatusTooManyRequests}, "60", nil, nil
+	resp, err = client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || len(bodies) != 1 {
+		t.Errorf("want no retry after max backoff, got status %d after %d attempts", resp.StatusCode, len(bodies))
+	}
+
+	// disabled
+	if retries := newOutboundRetries(config.OutboundRetry{MaxAttempts: 1}, "org"); retries != nil {
+		t.Errorf("want no retries of a single attempt")
+	}
+	var disabled *outboundRetries
+	c := &http.Client{}
+	if disabled.client("products", c) != c || c.Transport != nil {
+		t.Errorf("want client unchanged without retries")
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	dial := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	read := &net.OpError{Op: "read", Err: errors.New("connection reset")}
+	unavailableResp := &http.Response{StatusCode: http.StatusServiceUnavailable}
+	tests := []struct {
+		method string
+		resp   *http.Response
+		err    error
+		want   bool
+	}{
+		{http.MethodGet, unavailableResp, nil, true},
+		{http.MethodGet, nil, read, true},
+		{http.MethodGet, &http.Response{StatusCode: http.StatusOK}, nil, false},
+		{http.MethodPost, nil, dial, true},
+		{http.MethodPost, nil, &url.Error{Op: "Post", Err: dial}, true},
+		{http.MethodPost, nil, read, false},
+		{http.MethodPost, unavailableResp, nil, false},
+		{http.MethodPatch, &http.Response{StatusCode: http.StatusTooManyRequests}, nil, false},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, "https://example.com", nil)
+		if got := retryable(req, test.resp, test.err); got != test.want {
+			t.Errorf("%s %v %v want: %t, got: %t", test.method, test.resp, test.err, test.want, got)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"", 0, false},
+		{"3", 3 * time.Second, true},
+		{"Fri, 01 Oct 2021 12:00:30 GMT", 30 * time.Second, true},
+		{"Fri, 01 Oct 2021 11:00:00 GMT", 0, true},
+		{"soon", 0, false},
+	}
+	for _, test := range tests {
+		got, ok := retryAfter(test.value, now)
+		if got != test.want || ok != test.wantOK {
+			t.Errorf("retryAfter(%q) want %s, %t, got %s, %t", test.value, test.want, test.wantOK, got, ok)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// header added to requests forwarded unchecked while overloaded
+	headerOverloaded = "x-apigee-overloaded"
+
+	minConcurrentChecks    = 4   // lower bound of the adaptive limit
+	overloadLatencyWeight  = 0.2 // weight of each check in the smoothed latency
+	overloadLimitDecrease  = 0.9 // limit multiplier when over target latency
+	overloadLimitIncrement = 1.0 // limit increase per limit checks under target latency
+)
+
+// overloadManager sheds authorization checks when the adapter is saturated so
+// a slow dependency doesn't cause unbounded goroutine growth. The concurrency
+// limit adapts to check latency: it shrinks multiplicatively while the smoothed
+// latency exceeds the target, at most once per smoothed latency so the checks
+// admitted under the previous limit don't compound the decrease, and grows
+// additively otherwise, bounded by minConcurrentChecks and the configured
+// maximum.
+type overloadManager struct {
+	maxLimit      float64
+	minLimit      float64
+	targetLatency time.Duration
+	allow         bool
+	now           func() time.Time
+
+	mu           sync.Mutex
+	limit        float64
+	inFlight     int
+	latency      time.Duration // smoothed
+	lastDecrease time.Time
+}
+
+// newOverloadManager creates an overloadManager.
+// Returns nil if maxConcurrent is not positive.
+func newOverloadManager(maxConcurrent int, targetLatency time.Duration, action string) *overloadManager {
+	if maxConcurrent <= 0 {
+		return nil
+	}
+	minLimit := float64(minConcurrentChecks)
+	if minLimit > float64(maxConcurrent) {
+		minLimit = float64(maxConcurrent)
+	}
+	prometheusCheckConcurrencyLimit.Set(float64(maxConcurrent))
+	if action == config.OverloadActionAllow {
+		log.Warnf("limits.overload_action %s forwards shed requests unauthenticated", action)
+	}
+	return &overloadManager{
+		maxLimit:      float64(maxConcurrent),
+		minLimit:      minLimit,
+		targetLatency: targetLatency,
+		allow:         action == config.OverloadActionAllow,
+		now:           time.Now,
+		limit:         float64(maxConcurrent),
+	}
+}
+
+// acquire returns false if the check should be shed. Otherwise, the returned
+// release func must be called when the check completes.
+func (o *overloadManager) acquire() (release func(), ok bool) {
+	if o == nil {
+		return func() {}, true
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if float64(o.inFlight) >= o.limit {
+		return nil, false
+	}
+	o.inFlight++
+	prometheusChecksInFlight.Set(float64(o.inFlight))
+
+	start := o.now()
+	return func() { o.release(o.now().Sub(start)) }, true
+}
+
+// release records the latency of a completed check and adapts the limit
+func (o *overloadManager) release(latency time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.inFlight--
+	prometheusChecksInFlight.Set(float64(o.inFlight))
+
+	if o.latency == 0 {
+		o.latency = latency
+	} else {
+		o.latency += time.Duration(overloadLatencyWeight * float64(latency-o.latency))
+	}
+
+	limit := o.limit
+	if o.latency > o.targetLatency {
+		if now := o.now(); now.Sub(o.lastDecrease) >= o.latency {
+			o.lastDecrease = now
+			limit *= overloadLimitDecrease
+			if limit < o.minLimit {
+				limit = o.minLimit
+			}
+		}
+	} else {
+		limit += overloadLimitIncrement / limit
+		if limit > o.maxLimit {
+			limit = o.maxLimit
+		}
+	}
+	if int(limit) != int(o.limit) {
+		log.Debugf("check concurrency limit: %d, smoothed latency: %s", int(limit), o.latency)
+		prometheusCheckConcurrencyLimit.Set(float64(int(limit)))
+	}
+	o.limit = limit
+}
+
+var (
+	prometheusChecksInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "auth",
+		Name:      "checks_in_flight",
+		Help:      "Number of authorization checks in progress",
+	})
+
+	prometheusCheckConcurrencyLimit = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "auth",
+		Name:      "check_concurrency_limit",
+		Help:      "Adaptive limit of concurrent authorization checks",
+	})
+
+	prometheusOverloadShed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "overload_shed_count",
+		Help:      "Total number of authorization checks shed while overloaded by action",
+	}, []string{"org", "env", "action"})
+)
@@ -0,0 +1,175 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/gogo/googleapis/google/rpc"
+)
+
+func TestOverloadManagerDisabled(t *testing.T) {
+	o := newOverloadManager(0, time.Second, config.OverloadActionDeny)
+	if o != nil {
+		t.Fatalf("want nil overloadManager")
+	}
+	release, ok := o.acquire()
+	if !ok {
+		t.Errorf("nil overloadManager should not shed")
+	}
+	release()
+}
+
+func TestOverloadManagerLimit(t *testing.T) {
+	o := newOverloadManager(2, time.Second, config.OverloadActionDeny)
+	r1, ok := o.acquire()
+	if !ok {
+		t.Fatal("first check should not be shed")
+	}
+	r2, ok := o.acquire()
+	if !ok {
+		t.Fatal("second check should not be shed")
+	}
+	if _, ok := o.acquire(); ok {
+		t.Errorf("third check should be shed")
+	}
+	r1()
+	r3, ok := o.acquire()
+	if !ok {
+		t.Errorf("check after release should not be shed")
+	}
+	r2()
+	r3()
+	if o.inFlight != 0 {
+		t.Errorf("want: 0, got: %d", o.inFlight)
+	}
+}
+
+func TestOverloadManagerAdapts(t *testing.T) {
+	clock := time.Now()
+	check := func(o *overloadManager, latency time.Duration) {
+		release, ok := o.acquire()
+		if !ok {
+			t.Fatal("check should not be shed")
+		}
+		clock = clock.Add(latency)
+		release()
+	}
+
+	o := newOverloadManager(100, 100*time.Millisecond, config.OverloadActionDeny)
+	o.now = func() time.Time { return clock }
+
+	// slow checks shrink the limit to the minimum
+	for i := 0; i < 100; i++ {
+		check(o, time.Second)
+	}
+	if o.limit != minConcurrentChecks {
+		t.Errorf("want: %d, got: %f", minConcurrentChecks, o.limit)
+	}
+
+	// fast checks grow the limit back to the maximum
+	for i := 0; i < 10000; i++ {
+		check(o, time.Millisecond)
+	}
+	if o.limit != 100 {
+		t.Errorf("want: 100, got: %f", o.limit)
+	}
+
+	// concurrent slow checks decrease the limit once per smoothed latency
+	o = newOverloadManager(100, 100*time.Millisecond, config.OverloadActionDeny)
+	o.now = func() time.Time { return clock }
+	var releases []func()
+	for i := 0; i < 10; i++ {
+		release, ok := o.acquire()
+		if !ok {
+			t.Fatal("check should not be shed")
+		}
+		releases = append(releases, release)
+	}
+	clock = clock.Add(time.Second)
+	for _, release := range releases {
+		release()
+	}
+	if o.limit != 100*overloadLimitDecrease {
+		t.Errorf("want: %f, got: %f", 100*overloadLimitDecrease, o.limit)
+	}
+
+	// limit is never below a small maximum
+	o = newOverloadManager(2, time.Millisecond, config.OverloadActionDeny)
+	o.now = func() time.Time { return clock }
+	for i := 0; i < 10; i++ {
+		check(o, time.Second)
+	}
+	if o.limit != 2 {
+		t.Errorf("want: 2, got: %f", o.limit)
+	}
+}
+
+func TestCheckOverloaded(t *testing.T) {
+	tests := []struct {
+		desc       string
+		action     string
+		wantCode   rpc.Code
+		wantHeader bool
+	}{
+		{"deny", config.OverloadActionDeny, rpc.UNAVAILABLE, false},
+		{"allow", config.OverloadActionAllow, rpc.OK, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			overload := newOverloadManager(1, time.Second, test.action)
+			if _, ok := overload.acquire(); !ok {
+				t.Fatal("should acquire")
+			}
+			server := AuthorizationServer{
+				handler: &Handler{
+					orgName:      "org",
+					envName:      "env",
+					analyticsMan: &testAnalyticsMan{},
+					ready:        util.NewAtomicBool(true),
+					overload:     overload,
+				},
+			}
+
+			req := testutil.NewEnvoyRequest(http.MethodGet, "/", map[string]string{}, nil)
+			resp, err := server.Check(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Status.Code != int32(test.wantCode) {
+				t.Errorf("want: %d, got: %d", test.wantCode, resp.Status.Code)
+			}
+			var gotHeader bool
+			if ok, isOK := resp.HttpResponse.(*authv3.CheckResponse_OkResponse); isOK {
+				for _, h := range ok.OkResponse.GetHeaders() {
+					if h.Header.Key == headerOverloaded && h.Header.Value == "true" {
+						gotHeader = true
+					}
+				}
+			}
+			if gotHeader != test.wantHeader {
+				t.Errorf("want %s header: %t, got: %t", headerOverloaded, test.wantHeader, gotHeader)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+)
+
+// classicProductManager authorizes requests against API products with their
+// resource paths matched as Apigee proxies do, see config.ResourceMatchingClassic.
+// Authorized operations have the same IDs and quotas as the product.Manager.
+type classicProductManager struct {
+	product.Manager
+}
+
+// Authorize implements product.Manager
+func (m *classicProductManager) Authorize(authContext *auth.Context, api, path, method string) []product.AuthorizedOperation {
+	products := m.Products()
+	var authorizedOps []product.AuthorizedOperation
+	for _, name := range authContext.APIProducts {
+		p, ok := products[name]
+		if !ok {
+			log.Debugf("product %s not found", name)
+			continue
+		}
+		authorizedOps = append(authorizedOps, classicAuthorize(p, authContext, api, path, method)...)
+	}
+	return authorizedOps
+}
+
+// classicAuthorize returns the operations of p authorizing the request
+func classicAuthorize(p *product.APIProduct, authContext *auth.Context, api, path, method string) []product.AuthorizedOperation {
+	env := authContext.Environment()
+	if !p.EnvironmentMap[env] || !validProductScopes(p, authContext) {
+		return nil
+	}
+
+	// if OperationGroup is present, OperationConfigs override APIProduct api
+	if p.OperationGroup != nil {
+		var authorizedOps []product.AuthorizedOperation
+		for _, oc := range p.OperationGroup.OperationConfigs {
+			if oc.APISource != api || !classicOperationMatch(oc.Operations, path, method) {
+				continue
+			}
+			ao := product.AuthorizedOperation{
+				ID:            fmt.Sprintf("%s-%s-%s-%s", p.Name, env, authContext.Application, oc.ID),
+				QuotaLimit:    p.QuotaLimitInt,
+				QuotaInterval: p.QuotaIntervalInt,
+				QuotaTimeUnit: p.QuotaTimeUnit,
+			}
+			// OperationConfig quota is an override
+			if oc.Quota != nil && oc.Quota.LimitInt > 0 {
+				ao.QuotaLimit = oc.Quota.LimitInt
+				ao.QuotaInterval = oc.Quota.IntervalInt
+				ao.QuotaTimeUnit = oc.Quota.TimeUnit
+			}
+			authorizedOps = append(authorizedOps, ao)
+		}
+		return authorizedOps
+	}
+
+	if !p.APIs[api] {
+		return nil
+	}
+	matched := len(p.Resources) == 0 // no resources allows all paths
+	for _, resource := range p.Resources {
+		if classicResourceMatch(resource, path) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return nil
+	}
+	return []product.AuthorizedOperation{{
+		ID:            fmt.Sprintf("%s-%s-%s", p.Name, env, authContext.Application),
+		QuotaLimit:    p.QuotaLimitInt,
+		QuotaInterval: p.QuotaIntervalInt,
+		QuotaTimeUnit: p.QuotaTimeUnit,
+	}}
+}
+
+// validProductScopes is true if any scope intersects or the product has no
+// scopes, scopes are ignored when APIKey is present
+func validProductScopes(p *product.APIProduct, ac *auth.Context) bool {
+	if ac.APIKey != "" || len(p.Scopes) == 0 {
+		return true
+	}
+	for _, ds := range p.Scopes {
+		for _, s := range ac.Scopes {
+			if ds == s {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// classicOperationMatch is true if an operation matches the path and method,
+// an operation without methods allows all methods
+func classicOperationMatch(operations []product.Operation, path, method string) bool {
+	for _, op := range operations {
+		if !classicResourceMatch(op.Resource, path) {
+			continue
+		}
+		if len(op.Methods) == 0 {
+			return true
+		}
+		for _, m := range op.Methods {
+			if strings.EqualFold(m, method) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// classicResourceMatch matches a resource path as Apigee proxies do: "/"
+// matches all paths, "*" matches one segment, "**" matches one or more
+// segments, and a trailing slash is ignored
+func classicResourceMatch(resource, path string) bool {
+	if resource == "/" {
+		return true
+	}
+	return matchResourceSegments(resourceSegments(resource), resourceSegments(path))
+}
+
+// resourceSegments splits a path, ignoring the leading and a trailing slash
+func resourceSegments(path string) []string {
+	path = strings.TrimPrefix(path, "/")
+	path = strings.TrimSuffix(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func matchResourceSegments(resource, path []string) bool {
+	if len(resource) == 0 {
+		return len(path) == 0
+	}
+	switch resource[0] {
+	case "**":
+		for i := 1; i <= len(path); i++ {
+			if matchResourceSegments(resource[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(path) > 0 && matchResourceSegments(resource[1:], path[1:])
+	}
+	return len(path) > 0 && resource[0] == path[0] && matchResourceSegments(resource[1:], path[1:])
+}
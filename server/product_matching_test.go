@@ -0,0 +1,144 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestClassicResourceMatch(t *testing.T) {
+	tests := []struct {
+		resource string
+		path     string
+		want     bool
+	}{
+		{"/", "/", true},
+		{"/", "/a/b", true},
+		{"/**", "/", false},
+		{"/**", "/a", true},
+		{"/**", "/a/b/c", true},
+		{"/*", "/a", true},
+		{"/*", "/a/", true},
+		{"/*", "/a/b", false},
+		{"/a", "/a", true},
+		{"/a", "/a/", true},
+		{"/a/", "/a", true},
+		{"/a", "/a/b", false},
+		{"/a/**", "/a", false},
+		{"/a/**", "/a/b", true},
+		{"/a/**", "/a/b/c/", true},
+		{"/a/*", "/a/b", true},
+		{"/a/*", "/a/b/c", false},
+		{"/a/*/c", "/a/b/c", true},
+		{"/a/*/c", "/a/b/d", false},
+		{"/a/**/d", "/a/b/c/d", true},
+		{"/a/**/d", "/a/d", false},
+		{"/A", "/a", false},
+	}
+	for _, test := range tests {
+		if got := classicResourceMatch(test.resource, test.path); got != test.want {
+			t.Errorf("%s matching %s want: %t, got: %t", test.resource, test.path, test.want, got)
+		}
+	}
+}
+
+func TestClassicProductManager(t *testing.T) {
+	products := map[string]*product.APIProduct{
+		"wildcard": {
+			Name:           "wildcard",
+			Resources:      []string{"/pets/*"},
+			APIs:           map[string]bool{"api": true},
+			EnvironmentMap: map[string]bool{"env": true},
+			QuotaLimitInt:  10,
+		},
+		"all": {
+			Name:           "all",
+			APIs:           map[string]bool{"api": true},
+			EnvironmentMap: map[string]bool{"env": true},
+		},
+		"scoped": {
+			Name:           "scoped",
+			Resources:      []string{"/"},
+			Scopes:         []string{"admin"},
+			APIs:           map[string]bool{"api": true},
+			EnvironmentMap: map[string]bool{"env": true},
+		},
+		"operations": {
+			Name:           "operations",
+			EnvironmentMap: map[string]bool{"env": true},
+			OperationGroup: &product.OperationGroup{
+				OperationConfigs: []product.OperationConfig{{
+					ID:         "oc",
+					APISource:  "api",
+					Operations: []product.Operation{{Resource: "/pets/**", Methods: []string{"GET"}}},
+					Quota:      &product.Quota{LimitInt: 5, IntervalInt: 1, TimeUnit: "minute"},
+				}},
+			},
+		},
+		"other-env": {
+			Name:           "other-env",
+			APIs:           map[string]bool{"api": true},
+			EnvironmentMap: map[string]bool{"prod": true},
+		},
+	}
+	m := &classicProductManager{&testProductMan{products: products}}
+	h := &Handler{orgName: "org", envName: "env"}
+
+	tests := []struct {
+		desc     string
+		products []string
+		scopes   []string
+		path     string
+		method   string
+		want     []string
+	}{
+		{"wildcard", []string{"wildcard"}, nil, "/pets/1/", "GET", []string{"wildcard-env-app"}},
+		{"wildcard too deep", []string{"wildcard"}, nil, "/pets/1/toys", "GET", nil},
+		{"no resources", []string{"all"}, nil, "/anything", "GET", []string{"all-env-app"}},
+		{"missing scope", []string{"scoped"}, []string{"read"}, "/pets", "GET", nil},
+		{"scope", []string{"scoped"}, []string{"admin"}, "/pets", "GET", []string{"scoped-env-app"}},
+		{"operation", []string{"operations"}, nil, "/pets/1", "GET", []string{"operations-env-app-oc"}},
+		{"operation method", []string{"operations"}, nil, "/pets/1", "POST", nil},
+		{"other environment", []string{"other-env"}, nil, "/pets", "GET", nil},
+		{"unknown product", []string{"unknown"}, nil, "/pets", "GET", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			ac := &auth.Context{
+				Context:     h,
+				Application: "app",
+				APIProducts: test.products,
+				Scopes:      test.scopes,
+			}
+			var got []string
+			for _, op := range m.Authorize(ac, "api", test.path, test.method) {
+				got = append(got, op.ID)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	ac := &auth.Context{Context: h, Application: "app", APIProducts: []string{"operations"}}
+	ops := m.Authorize(ac, "api", "/pets/1", "GET")
+	if len(ops) != 1 || ops[0].QuotaLimit != 5 || ops[0].QuotaTimeUnit != "minute" {
+		t.Errorf("want operation config quota, got: %#v", ops)
+	}
+}
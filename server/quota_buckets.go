@@ -0,0 +1,61 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+)
+
+// the ID of an operation authorized by an API Product OperationConfig ends
+// with its API source and the hash of its methods and resources
+var operationConfigHash = regexp.MustCompile(`-[0-9a-f]{32}$`)
+
+// quotaBuckets returns the authorized operations keyed by the QuotaBuckets of
+// the request. By default, each OperationConfig of a product is a bucket.
+// Operations merged into the same bucket are applied once.
+func quotaBuckets(ops []product.AuthorizedOperation, envRequest *config.EnvironmentSpecRequest, api string) []product.AuthorizedOperation {
+	if len(ops) == 0 { // none are authorized for auth exclusions
+		return ops
+	}
+	switch envRequest.GetQuotaBuckets() {
+	case config.QuotaBucketsMethod:
+		method := envRequest.Request.GetAttributes().GetRequest().GetHttp().GetMethod()
+		keyed := make([]product.AuthorizedOperation, len(ops))
+		for i, op := range ops {
+			op.ID = op.ID + quotaKeySeparator + method
+			keyed[i] = op
+		}
+		return keyed
+	case config.QuotaBucketsOperation:
+		operation := envRequest.GetOperation().Name
+		keyed := make([]product.AuthorizedOperation, 0, len(ops))
+		seen := make(map[string]bool, len(ops))
+		for _, op := range ops {
+			if loc := operationConfigHash.FindStringIndex(op.ID); loc != nil && strings.HasSuffix(op.ID[:loc[0]], "-"+api) {
+				op.ID = op.ID[:loc[0]] + quotaKeySeparator + operation
+			}
+			if !seen[op.ID] {
+				seen[op.ID] = true
+				keyed = append(keyed, op)
+			}
+		}
+		return keyed
+	}
+	return ops
+}
@@ -0,0 +1,92 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestQuotaBuckets(t *testing.T) {
+	// mixed-method operation configs as returned by Apigee
+	var readWrite, remove product.OperationConfig
+	if err := json.Unmarshal([]byte(`{"apiSource": "api", "operations": [{"resource": "/pets", "methods": ["GET", "POST"]}]}`), &readWrite); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(`{"apiSource": "api", "operations": [{"resource": "/pets", "methods": ["DELETE"]}]}`), &remove); err != nil {
+		t.Fatal(err)
+	}
+	readWriteID := "product1-env-app-" + readWrite.ID
+	removeID := "product1-env-app-" + remove.ID
+	ops := []product.AuthorizedOperation{
+		{ID: readWriteID, QuotaLimit: 10},
+		{ID: removeID, QuotaLimit: 5},
+		{ID: "product2-env-app", QuotaLimit: 20},
+	}
+
+	tests := []struct {
+		desc    string
+		buckets string
+		method  string
+		want    []string
+	}{
+		{"product operations", "", http.MethodGet, []string{readWriteID, removeID, "product2-env-app"}},
+		{"split by method", config.QuotaBucketsMethod, http.MethodGet,
+			[]string{readWriteID + ":GET", removeID + ":GET", "product2-env-app:GET"}},
+		{"split by other method", config.QuotaBucketsMethod, http.MethodPost,
+			[]string{readWriteID + ":POST", removeID + ":POST", "product2-env-app:POST"}},
+		{"merged by operation", config.QuotaBucketsOperation, http.MethodGet,
+			[]string{"product1-env-app-api:pets", "product2-env-app"}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			envSpec := &config.EnvironmentSpec{
+				ID: "spec",
+				APIs: []config.APISpec{{
+					ID: "api",
+					Operations: []config.APIOperation{{
+						Name:         "pets",
+						HTTPMatches:  []config.HTTPMatch{{PathTemplate: "/pets"}},
+						QuotaBuckets: test.buckets,
+					}},
+				}},
+			}
+			specExt, err := config.NewEnvironmentSpecExt(envSpec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			envoyReq := testutil.NewEnvoyRequest(test.method, "/pets", nil, nil)
+			envRequest := config.NewEnvironmentSpecRequest(&testAuthMan{}, specExt, envoyReq)
+
+			var got []string
+			for _, op := range quotaBuckets(ops, envRequest, "api") {
+				got = append(got, op.ID)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	if got := quotaBuckets(ops, nil, "api"); len(got) != len(ops) || got[0].ID != readWriteID {
+		t.Errorf("want operations as is without an environment spec, got %v", got)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	"github.com/apigee/apigee-remote-service-golib/v2/quota"
+	datav3 "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	quotaCountCounted = "counted"
+	quotaCountSkipped = "skipped"
+	quotaCountError   = "error"
+)
+
+// quotaCountable returns true if the request of the access log entry reached
+// the target, false if Envoy failed it before, such as for no healthy or
+// unreachable upstreams, or the response is unknown.
+func quotaCountable(entry *datav3.HTTPAccessLogEntry) bool {
+	if entry.GetResponse().GetResponseCode().GetValue() == 0 {
+		return false
+	}
+	f := entry.GetCommonProperties().GetResponseFlags()
+	return !(f.GetFailedLocalHealthcheck() ||
+		f.GetNoHealthyUpstream() ||
+		f.GetUpstreamConnectionFailure() ||
+		f.GetUpstreamOverflow() ||
+		f.GetNoRouteFound() ||
+		f.GetRateLimited() ||
+		f.GetRateLimitServiceError() ||
+		f.GetInvalidEnvoyRequestHeaders() ||
+		f.GetDownstreamProtocolError() ||
+		f.GetNoFilterConfigFound())
+}
+
+// countAccessLogQuotas counts the pending quotas of the request of the access
+// log entry if it reached the target. Quotas are counted once per request ID
+// by the quota managers that deduplicate.
+func (h *Handler) countAccessLogQuotas(authContext *auth.Context, entry *datav3.HTTPAccessLogEntry, pending []product.AuthorizedOperation) {
+	if len(pending) == 0 {
+		return
+	}
+	org, env := authContext.Organization(), authContext.Environment()
+	if !quotaCountable(entry) {
+		log.Debugf("request %s failed before the target, quotas not counted", entry.GetRequest().GetRequestId())
+		prometheusAccessLogQuotaCounts.WithLabelValues(org, env, quotaCountSkipped).Add(float64(len(pending)))
+		return
+	}
+	requestID := entry.GetRequest().GetRequestId()
+	for _, op := range pending {
+		args := quota.Args{QuotaAmount: 1}
+		if requestID != "" {
+			args.DeduplicationID = requestID + quotaKeySeparator + op.ID
+		}
+		if _, err := h.quotaMan.Apply(authContext, op, args); err != nil {
+			log.Errorf("quota count: %v", err)
+			prometheusAccessLogQuotaCounts.WithLabelValues(org, env, quotaCountError).Inc()
+			continue
+		}
+		prometheusAccessLogQuotaCounts.WithLabelValues(org, env, quotaCountCounted).Inc()
+	}
+}
+
+var (
+	prometheusAccessLogQuotaCounts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "quota",
+		Name:      "access_log_counts_count",
+		Help:      "Number of quotas counted from access log records in the access_log quota counting mode by result: counted, skipped (failed before the target), or error",
+	}, []string{"org", "env", "result"})
+)
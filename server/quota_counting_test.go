@@ -0,0 +1,188 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	"github.com/apigee/apigee-remote-service-golib/v2/quota"
+	datav3 "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestApplyQuotasAccessLogCounting(t *testing.T) {
+	ops := []product.AuthorizedOperation{
+		{ID: "product1", QuotaLimit: 10},
+		{ID: "product2"},
+	}
+	tests := []struct {
+		desc         string
+		used         int64
+		wantExceeded bool
+		wantPending  []product.AuthorizedOperation
+	}{
+		{"under limit", 9, false, ops[:1]},
+		{"at limit", 10, true, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			quotaMan := &testQuotaMan{used: test.used}
+			server := AuthorizationServer{handler: &Handler{
+				quotaMan:      quotaMan,
+				quotaCounting: config.QuotaCountingAccessLog,
+			}}
+			exceeded, pending, err := server.applyQuotas(ops, &auth.Context{}, "")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if (exceeded != nil) != test.wantExceeded {
+				t.Errorf("want exceeded %t, got %v", test.wantExceeded, exceeded)
+			}
+			if diff := cmp.Diff(test.wantPending, pending); diff != "" {
+				t.Errorf("pending diff (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff([]quota.Args{{QuotaAmount: 0}}, quotaMan.args); diff != "" {
+				t.Errorf("args diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPendingQuotasMetadata(t *testing.T) {
+	ops := []product.AuthorizedOperation{
+		{ID: "product1", QuotaLimit: 10, QuotaInterval: 1, QuotaTimeUnit: "minute"},
+	}
+	metadata := &structpb.Struct{Fields: map[string]*structpb.Value{}}
+	encodePendingQuotasMetadata(metadata, nil)
+	if _, ok := metadata.Fields[metadataPendingQuotas]; ok {
+		t.Errorf("no pending quotas must not be encoded")
+	}
+	encodePendingQuotasMetadata(metadata, ops)
+	if diff := cmp.Diff(ops, decodePendingQuotasMetadata(metadata.Fields)); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+
+	metadata.Fields[metadataPendingQuotas] = stringValueFrom("bad")
+	if got := decodePendingQuotasMetadata(metadata.Fields); got != nil {
+		t.Errorf("want nil for bad metadata, got: %v", got)
+	}
+}
+
+func TestQuotaCountable(t *testing.T) {
+	tests := []struct {
+		desc  string
+		code  uint32
+		flags *datav3.ResponseFlags
+		want  bool
+	}{
+		{"ok", 200, nil, true},
+		{"target error", 500, nil, true},
+		{"no response", 0, nil, false},
+		{"no healthy upstream", 503, &datav3.ResponseFlags{NoHealthyUpstream: true}, false},
+		{"connection failure", 503, &datav3.ResponseFlags{UpstreamConnectionFailure: true}, false},
+		{"overflow", 503, &datav3.ResponseFlags{UpstreamOverflow: true}, false},
+		{"no route", 404, &datav3.ResponseFlags{NoRouteFound: true}, false},
+		{"upstream timeout", 504, &datav3.ResponseFlags{UpstreamRequestTimeout: true}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			entry := &datav3.HTTPAccessLogEntry{
+				CommonProperties: &datav3.AccessLogCommon{ResponseFlags: test.flags},
+				Response: &datav3.HTTPResponseProperties{
+					ResponseCode: &wrappers.UInt32Value{Value: test.code},
+				},
+			}
+			if got := quotaCountable(entry); got != test.want {
+				t.Errorf("want %t, got %t", test.want, got)
+			}
+		})
+	}
+}
+
+func TestCountAccessLogQuotas(t *testing.T) {
+	pending := []product.AuthorizedOperation{
+		{ID: "product1", QuotaLimit: 10},
+		{ID: "product2", QuotaLimit: 20},
+	}
+	tests := []struct {
+		desc        string
+		code        uint32
+		requestID   string
+		sendError   error
+		pending     []product.AuthorizedOperation
+		wantApplied []string
+		wantArgs    []quota.Args
+	}{
+		{
+			desc:        "counted",
+			code:        200,
+			requestID:   "req",
+			pending:     pending,
+			wantApplied: []string{"product1", "product2"},
+			wantArgs: []quota.Args{
+				{QuotaAmount: 1, DeduplicationID: "req:product1"},
+				{QuotaAmount: 1, DeduplicationID: "req:product2"},
+			},
+		},
+		{
+			desc:        "no request id",
+			code:        200,
+			pending:     pending[:1],
+			wantApplied: []string{"product1"},
+			wantArgs:    []quota.Args{{QuotaAmount: 1}},
+		},
+		{
+			desc:    "not countable",
+			pending: pending,
+		},
+		{
+			desc: "no pending",
+			code: 200,
+		},
+		{
+			desc:        "error",
+			code:        200,
+			sendError:   fmt.Errorf("quota error"),
+			pending:     pending[:1],
+			wantApplied: []string{"product1"},
+			wantArgs:    []quota.Args{{QuotaAmount: 1}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			quotaMan := &testQuotaMan{sendError: test.sendError}
+			h := &Handler{orgName: "org", envName: "env", quotaMan: quotaMan, quotaCounting: config.QuotaCountingAccessLog}
+			entry := &datav3.HTTPAccessLogEntry{
+				Request: &datav3.HTTPRequestProperties{RequestId: test.requestID},
+				Response: &datav3.HTTPResponseProperties{
+					ResponseCode: &wrappers.UInt32Value{Value: test.code},
+				},
+			}
+			h.countAccessLogQuotas(&auth.Context{Context: h}, entry, test.pending)
+			if diff := cmp.Diff(test.wantApplied, quotaMan.applied); diff != "" {
+				t.Errorf("applied diff (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(test.wantArgs, quotaMan.args); diff != "" {
+				t.Errorf("args diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	"github.com/apigee/apigee-remote-service-golib/v2/quota"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	quotaSyncPath = "/quotas"
+
+	quotaSyncResultOK     = "ok"
+	quotaSyncResultFailed = "failed"
+
+	// as the quota manager, buckets idle this long are forgotten
+	quotaBucketIdleExpiry    = 10 * time.Minute
+	quotaBucketPruneInterval = time.Minute
+)
+
+// QuotaBucketStatus is the sync state of a quota bucket. Used and
+// SyncedUsed include any amount exceeding Allowed.
+type QuotaBucketStatus struct {
+	ID            string    `json:"id"`
+	Org           string    `json:"org"`
+	Env           string    `json:"env"`
+	Allowed       int64     `json:"allowed"`
+	Used          int64     `json:"used"`        // local count, last synced count plus Pending
+	SyncedUsed    int64     `json:"synced_used"` // count of the last sync
+	Pending       int64     `json:"pending"`     // applied locally, not yet synced
+	WindowExpiry  time.Time `json:"window_expiry,omitempty"`
+	LastApplied   time.Time `json:"last_applied,omitempty"`
+	LastSynced    time.Time `json:"last_synced,omitempty"`
+	FailedSyncs   int       `json:"failed_syncs"` // consecutive
+	LastSyncError string    `json:"last_sync_error,omitempty"`
+}
+
+// quotaReconciler tracks the local and last synced counts of the quota
+// buckets by wrapping the quota.Manager and observing its sync requests.
+// Idle buckets are forgotten periodically once started.
+type quotaReconciler struct {
+	quota.Manager
+	now  func() time.Time
+	done chan struct{}
+
+	mu      sync.Mutex
+	buckets map[string]*QuotaBucketStatus
+}
+
+func newQuotaReconciler() *quotaReconciler {
+	return &quotaReconciler{
+		now:     time.Now,
+		done:    make(chan struct{}),
+		buckets: make(map[string]*QuotaBucketStatus),
+	}
+}
+
+func (q *quotaReconciler) start() {
+	go func() {
+		t := time.NewTicker(quotaBucketPruneInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				q.prune()
+			case <-q.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close implements quota.Manager
+func (q *quotaReconciler) Close() {
+	close(q.done)
+	q.Manager.Close()
+}
+
+// manager returns m recording the results of Apply
+func (q *quotaReconciler) manager(m quota.Manager) quota.Manager {
+	q.Manager = m
+	return q
+}
+
+// roundTripper returns rt recording the quota sync requests and responses
+func (q *quotaReconciler) roundTripper(rt http.RoundTripper) http.RoundTripper {
+	return &quotaSyncRoundTripper{reconciler: q, base: rt}
+}
+
+// Apply implements quota.Manager
+func (q *quotaReconciler) Apply(authContext *auth.Context, op product.AuthorizedOperation, args quota.Args) (*quota.Result, error) {
+	result, err := q.Manager.Apply(authContext, op, args)
+	if err != nil || result == nil {
+		return result, err
+	}
+
+	now := q.now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	b := q.bucket(op.ID)
+	b.Org = authContext.Organization()
+	b.Env = authContext.Environment()
+	b.Allowed = result.Allowed
+	b.Used = result.Used + result.Exceeded
+	b.LastApplied = now
+	pending := b.Pending
+	if !b.WindowExpiry.IsZero() && now.After(b.WindowExpiry) { // new window
+		pending = 0
+		b.SyncedUsed = 0
+		b.WindowExpiry = time.Time{}
+	}
+	b.setPending(pending + args.QuotaAmount)
+	return result, nil
+}
+
+// setPending sets the pending count, adding the change to the pending metric
+func (b *QuotaBucketStatus) setPending(pending int64) {
+	if pending < 0 {
+		pending = 0
+	}
+	prometheusQuotaPending.WithLabelValues(b.Org, b.Env).Add(float64(pending - b.Pending))
+	b.Pending = pending
+}
+
+// bucket returns the status of id, creating it if needed. Lock q.mu before calling.
+func (q *quotaReconciler) bucket(id string) *QuotaBucketStatus {
+	b, ok := q.buckets[id]
+	if !ok {
+		b = &QuotaBucketStatus{ID: id}
+		q.buckets[id] = b
+	}
+	return b
+}
+
+// synced records the result of a sync of weight to the bucket id
+func (q *quotaReconciler) synced(id string, weight int64, result *quota.Result, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	b := q.bucket(id)
+	if err != nil {
+		b.FailedSyncs++
+		b.LastSyncError = err.Error()
+		prometheusQuotaSyncs.WithLabelValues(b.Org, quotaSyncResultFailed).Inc()
+		return
+	}
+	b.FailedSyncs = 0
+	b.LastSyncError = ""
+	b.LastSynced = q.now()
+	b.SyncedUsed = result.Used + result.Exceeded
+	b.WindowExpiry = time.Unix(result.ExpiryTime, 0)
+	b.setPending(b.Pending - weight)
+	prometheusQuotaSyncs.WithLabelValues(b.Org, quotaSyncResultOK).Inc()
+}
+
+// prune forgets the buckets synced and idle
+func (q *quotaReconciler) prune() {
+	now := q.now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for id, b := range q.buckets {
+		if b.Pending == 0 && now.Sub(b.LastApplied) > quotaBucketIdleExpiry {
+			delete(q.buckets, id)
+		}
+	}
+}
+
+// status returns the buckets ordered by ID, forgetting those idle
+func (q *quotaReconciler) status() []QuotaBucketStatus {
+	q.prune()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	statuses := make([]QuotaBucketStatus, 0, len(q.buckets))
+	for _, b := range q.buckets {
+		statuses = append(statuses, *b)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+// QuotaStatusHandlerFunc returns an http.HandlerFunc responding with the
+// JSON sync state of the quota buckets. Buckets with pending counts or
+// sync failures are out of sync with Apigee.
+func (h *Handler) QuotaStatusHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var buckets []QuotaBucketStatus
+		if h.quotaReconciler != nil {
+			buckets = h.quotaReconciler.status()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"buckets": buckets}); err != nil {
+			log.Warnf("quota status unable to respond: %s", err)
+		}
+	}
+}
+
+// quotaSyncRoundTripper observes the quota sync requests of the quota.Manager
+type quotaSyncRoundTripper struct {
+	reconciler *quotaReconciler
+	base       http.RoundTripper
+}
+
+func (rt *quotaSyncRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPost || !strings.HasSuffix(req.URL.Path, quotaSyncPath) || req.Body == nil {
+		return rt.base.RoundTrip(req)
+	}
+
+	reqBody, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(reqBody))
+	var syncReq quota.Request
+	if err := json.Unmarshal(reqBody, &syncReq); err != nil || syncReq.Identifier == "" {
+		return rt.base.RoundTrip(req)
+	}
+
+	resp, err := rt.base.RoundTrip(req)
+	if err != nil {
+		rt.reconciler.synced(syncReq.Identifier, syncReq.Weight, nil, err)
+		return resp, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		rt.reconciler.synced(syncReq.Identifier, syncReq.Weight, nil, fmt.Errorf("quota sync status: %d", resp.StatusCode))
+		return resp, nil
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		rt.reconciler.synced(syncReq.Identifier, syncReq.Weight, nil, err)
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	var result quota.Result
+	if err := result.Unmarshal(respBody); err != nil {
+		rt.reconciler.synced(syncReq.Identifier, syncReq.Weight, nil, err)
+		return resp, nil
+	}
+	rt.reconciler.synced(syncReq.Identifier, syncReq.Weight, &result, nil)
+	return resp, nil
+}
+
+var (
+	prometheusQuotaPending = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "quota",
+		Name:      "pending",
+		Help:      "Quota applied locally and not yet synced with Apigee",
+	}, []string{"org", "env"})
+
+	prometheusQuotaSyncs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "quota",
+		Name:      "sync_count",
+		Help:      "Total number of quota bucket syncs by result",
+	}, []string{"org", "result"})
+)
@@ -0,0 +1,158 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	"github.com/apigee/apigee-remote-service-golib/v2/quota"
+	prometheustest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestQuotaReconciler(t *testing.T) {
+	now := time.Unix(1000, 0)
+	expiry := now.Add(time.Minute)
+	fail := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var req quota.Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+		// other adapters used 10
+		fmt.Fprintf(w, `{"allowed": %d, "used": %d, "expiryTime": %d}`, req.Allow, 10+req.Weight, expiry.Unix()*1000)
+	}))
+	defer srv.Close()
+
+	q := newQuotaReconciler()
+	q.now = func() time.Time { return now }
+	quotaMan := q.manager(&testQuotaMan{})
+	client := &http.Client{Transport: q.roundTripper(http.DefaultTransport)}
+	h := &Handler{orgName: "org", envName: "env", quotaReconciler: q}
+	authContext := &auth.Context{Context: h}
+	op := product.AuthorizedOperation{ID: "bucket", QuotaLimit: 100}
+
+	sync := func(weight int64) {
+		body, _ := json.Marshal(quota.Request{Identifier: "bucket", Weight: weight, Allow: 100})
+		resp, err := client.Post(srv.URL+"/remote-service/quotas", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if _, err := io.ReadAll(resp.Body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	status := func() QuotaBucketStatus {
+		rec := httptest.NewRecorder()
+		h.QuotaStatusHandlerFunc()(rec, httptest.NewRequest(http.MethodGet, "/quotas", nil))
+		var resp struct {
+			Buckets []QuotaBucketStatus `json:"buckets"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Buckets) != 1 {
+			t.Fatalf("want 1 bucket, got: %v", resp.Buckets)
+		}
+		return resp.Buckets[0]
+	}
+
+	pendingMetric := prometheusQuotaPending.WithLabelValues("org", "env")
+	basePending := prometheustest.ToFloat64(pendingMetric)
+	wantPendingMetric := func(want float64) {
+		t.Helper()
+		if got := prometheustest.ToFloat64(pendingMetric) - basePending; got != want {
+			t.Errorf("want pending metric: %v, got: %v", want, got)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := quotaMan.Apply(authContext, op, quota.Args{QuotaAmount: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantPendingMetric(3)
+	if got := status(); got.Pending != 3 || got.Org != "org" || got.Env != "env" || !got.LastSynced.IsZero() {
+		t.Errorf("unexpected status before sync: %#v", got)
+	}
+
+	sync(2) // 1 more applied during the sync
+	got := status()
+	if got.Pending != 1 || got.SyncedUsed != 12 || !got.WindowExpiry.Equal(expiry) || !got.LastSynced.Equal(now) {
+		t.Errorf("unexpected status after sync: %#v", got)
+	}
+	wantPendingMetric(1)
+
+	fail = true
+	sync(1)
+	sync(1)
+	got = status()
+	if got.Pending != 1 || got.FailedSyncs != 2 || got.LastSyncError != "quota sync status: 503" {
+		t.Errorf("unexpected status after failed syncs: %#v", got)
+	}
+
+	fail = false
+	sync(1)
+	got = status()
+	if got.Pending != 0 || got.FailedSyncs != 0 || got.LastSyncError != "" || got.SyncedUsed != 11 {
+		t.Errorf("unexpected status after recovery: %#v", got)
+	}
+	wantPendingMetric(0)
+
+	// new window
+	now = expiry.Add(time.Second)
+	if _, err := quotaMan.Apply(authContext, op, quota.Args{QuotaAmount: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if got := status(); got.Pending != 1 || got.SyncedUsed != 0 || !got.WindowExpiry.IsZero() {
+		t.Errorf("unexpected status in new window: %#v", got)
+	}
+
+	// forgotten when idle and synced, without status requests
+	sync(1)
+	now = now.Add(quotaBucketIdleExpiry + time.Second)
+	q.prune()
+	q.mu.Lock()
+	if len(q.buckets) != 0 {
+		t.Errorf("idle bucket should be forgotten, got: %v", q.buckets)
+	}
+	q.mu.Unlock()
+	wantPendingMetric(0)
+
+	q.start()
+	q.Close()
+}
+
+func TestQuotaStatusWithoutReconciler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	(&Handler{}).QuotaStatusHandlerFunc()(rec, httptest.NewRequest(http.MethodGet, "/quotas", nil))
+	if got := rec.Body.String(); got != "{\"buckets\":null}\n" {
+		t.Errorf("unexpected response: %q", got)
+	}
+}
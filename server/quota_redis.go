@@ -0,0 +1,155 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	"github.com/apigee/apigee-remote-service-golib/v2/quota"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// counters are kept this long past the end of their window
+	redisQuotaKeyGrace = time.Minute
+
+	redisQuotaResultOK       = "ok"
+	redisQuotaResultFallback = "fallback"
+)
+
+// redisQuotaManager counts quotas in Redis so the replicas of the service
+// enforce their combined limit. Each window of a quota has its own counter
+// that expires after the window. The wrapped quota.Manager counts locally
+// while Redis can't be reached.
+type redisQuotaManager struct {
+	quota.Manager
+	client *redisClient
+	prefix string
+	now    func() time.Time
+}
+
+// newRedisQuotaManager wraps fallback. Returns fallback if client is nil.
+func newRedisQuotaManager(client *redisClient, prefix string, fallback quota.Manager) quota.Manager {
+	if client == nil {
+		return fallback
+	}
+	return &redisQuotaManager{
+		Manager: fallback,
+		client:  client,
+		prefix:  prefix,
+		now:     time.Now,
+	}
+}
+
+// Apply implements quota.Manager
+func (m *redisQuotaManager) Apply(authContext *auth.Context, op product.AuthorizedOperation, args quota.Args) (*quota.Result, error) {
+	if op.QuotaLimit == 0 {
+		return nil, nil
+	}
+	now := m.now()
+	expiry := quotaWindowExpiry(now, op.QuotaInterval, strings.ToLower(op.QuotaTimeUnit))
+	if expiry.IsZero() {
+		return m.Manager.Apply(authContext, op, args)
+	}
+
+	org, env := authContext.Organization(), authContext.Environment()
+	key := fmt.Sprintf("%s%s:%s:%s:%d", m.prefix, org, env, op.ID, expiry.Unix())
+	expireAt := expiry.Add(redisQuotaKeyGrace).UnixNano() / int64(time.Millisecond)
+	replies, err := m.client.do(
+		[]string{"INCRBY", key, strconv.FormatInt(args.QuotaAmount, 10)},
+		[]string{"PEXPIREAT", key, strconv.FormatInt(expireAt, 10)},
+	)
+	var used int64
+	if err == nil {
+		switch reply := replies[0].(type) {
+		case int64:
+			used = reply
+		case redisError:
+			err = reply
+		default:
+			err = fmt.Errorf("unexpected INCRBY reply: %v", reply)
+		}
+	}
+	if err != nil {
+		log.Warnf("unable to apply quota %s in redis, counting locally: %v", op.ID, err)
+		prometheusRedisQuotaApplies.WithLabelValues(org, redisQuotaResultFallback).Inc()
+		return m.Manager.Apply(authContext, op, args)
+	}
+	prometheusRedisQuotaApplies.WithLabelValues(org, redisQuotaResultOK).Inc()
+
+	result := &quota.Result{
+		Allowed:    op.QuotaLimit,
+		Used:       used,
+		ExpiryTime: expiry.Unix(),
+		Timestamp:  now.Unix(),
+	}
+	if result.Used > result.Allowed {
+		result.Exceeded = result.Used - result.Allowed
+		result.Used = result.Allowed
+	}
+	return result, nil
+}
+
+// Close implements quota.Manager
+func (m *redisQuotaManager) Close() {
+	m.Manager.Close()
+	m.client.close()
+}
+
+// quotaWindowExpiry returns the last second of the window of the quota
+// interval and time unit containing now. Unlike the windows of the
+// quota.Manager, which start at the first request, the windows are aligned
+// to multiples of the interval in UTC so all replicas share them.
+// Returns the zero time if the time unit is unknown.
+func quotaWindowExpiry(now time.Time, interval int64, timeUnit string) time.Time {
+	if interval <= 0 {
+		interval = 1
+	}
+	now = now.UTC()
+	var end time.Time
+	switch timeUnit {
+	case "second":
+		end = now.Truncate(time.Duration(interval) * time.Second).Add(time.Duration(interval) * time.Second)
+	case "minute":
+		end = now.Truncate(time.Duration(interval) * time.Minute).Add(time.Duration(interval) * time.Minute)
+	case "hour":
+		end = now.Truncate(time.Duration(interval) * time.Hour).Add(time.Duration(interval) * time.Hour)
+	case "day":
+		days := now.Unix() / (24 * 60 * 60)
+		end = time.Unix((days-days%interval+interval)*24*60*60, 0).UTC()
+	case "month":
+		months := int64(now.Year())*12 + int64(now.Month()) - 1
+		start := months - months%interval
+		end = time.Date(int(start/12), time.Month(start%12)+1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, int(interval), 0)
+	default:
+		return time.Time{}
+	}
+	return end.Add(-time.Second)
+}
+
+var (
+	prometheusRedisQuotaApplies = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "quota",
+		Name:      "redis_apply_count",
+		Help:      "Total number of quotas applied in redis by result",
+	}, []string{"org", "result"})
+)
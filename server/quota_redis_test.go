@@ -0,0 +1,154 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	"github.com/apigee/apigee-remote-service-golib/v2/quota"
+)
+
+func TestQuotaWindowExpiry(t *testing.T) {
+	now := time.Date(2021, time.May, 17, 13, 47, 31, 500, time.UTC)
+	tests := []struct {
+		interval int64
+		timeUnit string
+		want     time.Time
+	}{
+		{1, "second", time.Date(2021, time.May, 17, 13, 47, 31, 0, time.UTC)},
+		{1, "minute", time.Date(2021, time.May, 17, 13, 47, 59, 0, time.UTC)},
+		{5, "minute", time.Date(2021, time.May, 17, 13, 49, 59, 0, time.UTC)},
+		{2, "hour", time.Date(2021, time.May, 17, 13, 59, 59, 0, time.UTC)},
+		{1, "day", time.Date(2021, time.May, 17, 23, 59, 59, 0, time.UTC)},
+		{1, "month", time.Date(2021, time.May, 31, 23, 59, 59, 0, time.UTC)},
+		{3, "month", time.Date(2021, time.June, 30, 23, 59, 59, 0, time.UTC)},
+		{0, "minute", time.Date(2021, time.May, 17, 13, 47, 59, 0, time.UTC)},
+		{1, "fortnight", time.Time{}},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%d %s", tc.interval, tc.timeUnit), func(t *testing.T) {
+			if got := quotaWindowExpiry(now, tc.interval, tc.timeUnit); !got.Equal(tc.want) {
+				t.Errorf("want: %s, got: %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRedisQuotaManager(t *testing.T) {
+	if m := newRedisQuotaManager(nil, "", &testQuotaMan{}); m == nil {
+		t.Fatalf("want fallback without client")
+	} else if _, ok := m.(*testQuotaMan); !ok {
+		t.Errorf("want fallback without client, got: %T", m)
+	}
+
+	srv := newFakeRedis(t, "")
+	defer srv.close()
+
+	now := time.Date(2021, time.May, 17, 13, 47, 31, 0, time.UTC)
+	replica := func() *redisQuotaManager {
+		c, err := newRedisClient(testRedisConfig(srv.address()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := newRedisQuotaManager(c, "q:", &testQuotaMan{}).(*redisQuotaManager)
+		m.now = func() time.Time { return now }
+		return m
+	}
+	replicas := []*redisQuotaManager{replica(), replica()}
+	defer replicas[0].Close()
+	defer replicas[1].Close()
+
+	authContext := &auth.Context{Context: &Handler{orgName: "org", envName: "env"}}
+	op := product.AuthorizedOperation{
+		ID:            "product",
+		QuotaLimit:    3,
+		QuotaInterval: 1,
+		QuotaTimeUnit: "Minute",
+	}
+	args := quota.Args{QuotaAmount: 1}
+
+	// the replicas share the limit
+	for i, want := range []int64{0, 0, 0, 1} {
+		result, err := replicas[i%2].Apply(authContext, op, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Exceeded != want {
+			t.Errorf("apply %d: want exceeded %d, got: %d", i, want, result.Exceeded)
+		}
+		if result.Allowed != 3 || result.Used > 3 {
+			t.Errorf("apply %d: want used within allowed 3, got: %+v", i, result)
+		}
+	}
+	key := fmt.Sprintf("q:org:env:product:%d", time.Date(2021, time.May, 17, 13, 47, 59, 0, time.UTC).Unix())
+	srv.mu.Lock()
+	if srv.counters[key] != 4 {
+		t.Errorf("want counter %s of 4, got: %v", key, srv.counters)
+	}
+	wantExpireAt := time.Date(2021, time.May, 17, 13, 48, 59, 0, time.UTC).UnixNano() / int64(time.Millisecond)
+	if srv.expiries[key] != wantExpireAt {
+		t.Errorf("want expiry %d, got: %d", wantExpireAt, srv.expiries[key])
+	}
+	srv.mu.Unlock()
+
+	// the next window has a new counter
+	now = now.Add(time.Minute)
+	result, err := replicas[0].Apply(authContext, op, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Used != 1 || result.Exceeded != 0 {
+		t.Errorf("want new window, got: %+v", result)
+	}
+
+	// counted once in redis if the reply is lost, then locally
+	srv.mu.Lock()
+	srv.cuts = 1
+	srv.mu.Unlock()
+	if _, err := replicas[0].Apply(authContext, op, args); err != nil {
+		t.Fatal(err)
+	}
+	nextKey := fmt.Sprintf("q:org:env:product:%d", time.Date(2021, time.May, 17, 13, 48, 59, 0, time.UTC).Unix())
+	srv.mu.Lock()
+	if srv.counters[nextKey] != 2 {
+		t.Errorf("want counter %s of 2, got: %v", nextKey, srv.counters)
+	}
+	srv.mu.Unlock()
+	if applied := replicas[0].Manager.(*testQuotaMan).applied; len(applied) != 1 {
+		t.Errorf("want 1 local apply, got: %v", applied)
+	}
+
+	// no quota
+	if result, err := replicas[0].Apply(authContext, product.AuthorizedOperation{ID: "none"}, args); result != nil || err != nil {
+		t.Errorf("want no result without quota limit, got: %v, %v", result, err)
+	}
+
+	// counted locally while redis is down
+	srv.close()
+	replicas[0].client.close()
+	fallback := replicas[0].Manager.(*testQuotaMan)
+	fallback.exceeded = 1
+	result, err = replicas[0].Apply(authContext, op, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Exceeded != 1 {
+		t.Errorf("want fallback result, got: %+v", result)
+	}
+}
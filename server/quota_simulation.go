@@ -0,0 +1,250 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/context"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+)
+
+// quotaUnitSeconds are the lengths of the quota time units, months
+// approximated as 30 days
+var quotaUnitSeconds = map[string]float64{
+	"second": 1,
+	"minute": 60,
+	"hour":   60 * 60,
+	"day":    24 * 60 * 60,
+	"month":  30 * 24 * 60 * 60,
+}
+
+// QuotaSimulation is a hypothetical traffic profile of a consumer of API
+// products. It is projected against the quotas of the products as currently
+// configured, assuming steady traffic, without counting quotas or recording
+// analytics.
+type QuotaSimulation struct {
+	Products    []string                 `json:"products"`              // of the consumer
+	Scopes      []string                 `json:"scopes,omitempty"`      // of the consumer's access token
+	Environment string                   `json:"environment,omitempty"` // multi-tenant only
+	Traffic     []QuotaSimulationTraffic `json:"traffic"`
+}
+
+// QuotaSimulationTraffic is a steady rate of requests to an API operation.
+type QuotaSimulationTraffic struct {
+	Spec   string  `json:"spec,omitempty"`   // environment spec ID, global API if empty
+	API    string  `json:"api,omitempty"`    // global API, if no spec
+	Method string  `json:"method,omitempty"` // default GET
+	Path   string  `json:"path"`             // including any base path
+	Rate   float64 `json:"rate"`             // requests per second
+}
+
+// QuotaSimulationResult is the projected throttling of a QuotaSimulation.
+type QuotaSimulationResult struct {
+	Traffic []TrafficProjection `json:"traffic"`
+	Quotas  []QuotaProjection   `json:"quotas"`
+	// AnalyticsRecordsPerDay of the traffic, allowed or not.
+	AnalyticsRecordsPerDay float64 `json:"analytics_records_per_day"`
+}
+
+// TrafficProjection is the projected throttling of a QuotaSimulationTraffic.
+// A request is throttled if any of its quotas is exhausted.
+type TrafficProjection struct {
+	API           string   `json:"api,omitempty"`
+	Operation     string   `json:"operation,omitempty"`
+	Reason        string   `json:"reason,omitempty"` // if not authorized
+	Quotas        []string `json:"quotas,omitempty"`
+	Rate          float64  `json:"rate"`
+	ThrottledRate float64  `json:"throttled_rate"` // average requests per second
+}
+
+// QuotaProjection is the projected use of a quota in each of its intervals.
+type QuotaProjection struct {
+	ID             string  `json:"id"`
+	Limit          int64   `json:"limit"`
+	Interval       int64   `json:"interval"`
+	TimeUnit       string  `json:"time_unit"`
+	Requests       float64 `json:"requests"`
+	Throttled      float64 `json:"throttled"`
+	Utilization    float64 `json:"utilization"`               // requests over limit
+	ExhaustedAfter string  `json:"exhausted_after,omitempty"` // into each interval
+}
+
+// simulateQuotas projects the simulation, returns an error if it is invalid
+func (h *Handler) simulateQuotas(s QuotaSimulation) (QuotaSimulationResult, error) {
+	result := QuotaSimulationResult{Traffic: []TrafficProjection{}, Quotas: []QuotaProjection{}}
+	if len(s.Products) == 0 || len(s.Traffic) == 0 {
+		return result, fmt.Errorf("products and traffic are required")
+	}
+	for i, t := range s.Traffic {
+		if t.Path == "" || t.Rate <= 0 {
+			return result, fmt.Errorf("traffic[%d] needs a path and a positive rate", i)
+		}
+		if t.Spec == "" && t.API == "" {
+			return result, fmt.Errorf("traffic[%d] needs one of spec or api", i)
+		}
+		if t.Spec != "" {
+			if _, ok := h.environmentSpec(t.Spec); !ok {
+				return result, fmt.Errorf("unknown environment spec %q", t.Spec)
+			}
+		}
+	}
+
+	var rootContext context.Context = h
+	if s.Environment != "" && s.Environment != h.Environment() {
+		if !h.isMultitenant || !h.envRouter.allows(s.Environment) {
+			return result, fmt.Errorf("environment %q is not a tenant environment", s.Environment)
+		}
+		rootContext = &multitenantContext{h, s.Environment}
+	}
+	authContext := &auth.Context{Context: rootContext, APIProducts: s.Products, Scopes: s.Scopes}
+
+	quotas := make(map[string]*QuotaProjection)
+	rates := make(map[string]float64) // quota ID -> requests per second
+	for _, t := range s.Traffic {
+		result.AnalyticsRecordsPerDay += t.Rate * quotaUnitSeconds["day"]
+		if t.Method == "" {
+			t.Method = http.MethodGet
+		}
+		p, path := h.simulatedOperation(t)
+		if p.Reason == "" {
+			ops := h.productMan.Authorize(authContext, p.API, path, t.Method)
+			if len(ops) == 0 {
+				p.Reason = "no API product operation authorized"
+			}
+			for _, op := range ops {
+				if op.QuotaLimit <= 0 {
+					continue
+				}
+				if quotas[op.ID] == nil {
+					quotas[op.ID] = &QuotaProjection{
+						ID:       op.ID,
+						Limit:    op.QuotaLimit,
+						Interval: op.QuotaInterval,
+						TimeUnit: op.QuotaTimeUnit,
+					}
+				}
+				rates[op.ID] += t.Rate
+				p.Quotas = append(p.Quotas, op.ID)
+			}
+		}
+		result.Traffic = append(result.Traffic, p)
+	}
+
+	throttledShare := make(map[string]float64)
+	for id, q := range quotas {
+		seconds := quotaUnitSeconds[q.TimeUnit] * float64(q.Interval)
+		if seconds <= 0 { // unknown unit, not projected
+			continue
+		}
+		q.Requests = rates[id] * seconds
+		q.Utilization = q.Requests / float64(q.Limit)
+		if q.Requests > float64(q.Limit) {
+			q.Throttled = q.Requests - float64(q.Limit)
+			throttledShare[id] = q.Throttled / q.Requests
+			exhausted := time.Duration(float64(q.Limit) / rates[id] * float64(time.Second))
+			q.ExhaustedAfter = exhausted.Round(time.Second).String()
+		}
+		result.Quotas = append(result.Quotas, *q)
+	}
+	sort.Slice(result.Quotas, func(i, j int) bool { return result.Quotas[i].ID < result.Quotas[j].ID })
+
+	for i := range result.Traffic {
+		p := &result.Traffic[i]
+		share := 0.0
+		for _, id := range p.Quotas {
+			if throttledShare[id] > share {
+				share = throttledShare[id]
+			}
+		}
+		p.ThrottledRate = p.Rate * share
+	}
+	return result, nil
+}
+
+// simulatedOperation returns the projection of the traffic with the API and
+// operation of its spec, or the reason it isn't matched, and the path to
+// authorize
+func (h *Handler) simulatedOperation(t QuotaSimulationTraffic) (TrafficProjection, string) {
+	p := TrafficProjection{API: t.API, Rate: t.Rate}
+	if t.Spec == "" {
+		return p, t.Path
+	}
+	envSpec, _ := h.environmentSpec(t.Spec)
+	req := &authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{
+			Request: &authv3.AttributeContext_Request{
+				Http: &authv3.AttributeContext_HttpRequest{
+					Method:  t.Method,
+					Path:    t.Path,
+					Headers: map[string]string{},
+				},
+			},
+			ContextExtensions: map[string]string{envSpecContextKey: t.Spec},
+		},
+	}
+	envRequest := config.NewEnvironmentSpecRequest(h.authMan, envSpec, req)
+	api := envRequest.GetAPISpec()
+	if api == nil {
+		p.Reason = "no API matched"
+		return p, ""
+	}
+	p.API = api.ID
+	op := envRequest.GetOperation()
+	if op == nil {
+		p.Reason = "no operation matched"
+		return p, ""
+	}
+	p.Operation = op.Name
+	return p, envRequest.GetOperationPath()
+}
+
+// QuotaSimulationHandlerFunc returns an http.HandlerFunc answering the JSON
+// QuotaSimulation POSTed with the JSON QuotaSimulationResult, so rate plans
+// can be sized against expected traffic before it is sent.
+func (h *Handler) QuotaSimulationHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respond := func(status int, body interface{}) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			if err := json.NewEncoder(w).Encode(body); err != nil {
+				log.Warnf("quota simulation unable to respond: %s", err)
+			}
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var s QuotaSimulation
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			respond(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		result, err := h.simulateQuotas(s)
+		if err != nil {
+			respond(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		respond(http.StatusOK, result)
+	}
+}
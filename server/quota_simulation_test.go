@@ -0,0 +1,159 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+)
+
+// quotaProductMan authorizes the operations of an API by path
+type quotaProductMan struct {
+	testProductMan
+	ops map[string][]product.AuthorizedOperation // api path -> ops
+}
+
+func (p *quotaProductMan) Authorize(ac *auth.Context, api, path, method string) []product.AuthorizedOperation {
+	return p.ops[api+" "+path]
+}
+
+func TestSimulateQuotas(t *testing.T) {
+	specExt, err := config.NewEnvironmentSpecExt(&config.EnvironmentSpec{
+		ID: "spec",
+		APIs: []config.APISpec{{
+			ID:       "pets",
+			BasePath: "/v1",
+			Operations: []config.APIOperation{
+				{Name: "list", HTTPMatches: []config.HTTPMatch{{PathTemplate: "/pets", Method: "GET"}}},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	perMinute := product.AuthorizedOperation{ID: "minute", QuotaLimit: 600, QuotaInterval: 1, QuotaTimeUnit: "minute"}
+	perDay := product.AuthorizedOperation{ID: "day", QuotaLimit: 540000, QuotaInterval: 1, QuotaTimeUnit: "day"}
+	h := &Handler{
+		envName:      "env",
+		envSpecsByID: map[string]*config.EnvironmentSpecExt{"spec": specExt},
+		productMan: &quotaProductMan{ops: map[string][]product.AuthorizedOperation{
+			"pets /pets":  {perMinute, perDay},
+			"global /any": {perDay, {ID: "unlimited"}},
+		}},
+	}
+
+	got, err := h.simulateQuotas(QuotaSimulation{
+		Products: []string{"p"},
+		Traffic: []QuotaSimulationTraffic{
+			{Spec: "spec", Path: "/v1/pets", Rate: 20},
+			{API: "global", Path: "/any", Rate: 5},
+			{Spec: "spec", Path: "/v1/stores", Rate: 1},
+			{API: "unknown", Path: "/any", Rate: 1},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := QuotaSimulationResult{
+		Traffic: []TrafficProjection{
+			{API: "pets", Operation: "list", Quotas: []string{"minute", "day"}, Rate: 20, ThrottledRate: 15},
+			{API: "global", Quotas: []string{"day"}, Rate: 5, ThrottledRate: 3.75},
+			{API: "pets", Reason: "no operation matched", Rate: 1},
+			{API: "unknown", Reason: "no API product operation authorized", Rate: 1},
+		},
+		Quotas: []QuotaProjection{
+			{ID: "day", Limit: 540000, Interval: 1, TimeUnit: "day", Requests: 25 * 86400, Throttled: 1620000,
+				Utilization: 4, ExhaustedAfter: "6h0m0s"},
+			{ID: "minute", Limit: 600, Interval: 1, TimeUnit: "minute", Requests: 1200, Throttled: 600,
+				Utilization: 2, ExhaustedAfter: "30s"},
+		},
+		AnalyticsRecordsPerDay: 27 * 86400,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %#v,\ngot %#v", want, got)
+	}
+
+	errs := []struct {
+		desc       string
+		simulation QuotaSimulation
+		wantErr    string
+	}{
+		{"no products", QuotaSimulation{Traffic: []QuotaSimulationTraffic{{API: "a", Path: "/", Rate: 1}}},
+			"products and traffic are required"},
+		{"no rate", QuotaSimulation{Products: []string{"p"}, Traffic: []QuotaSimulationTraffic{{API: "a", Path: "/"}}},
+			"traffic[0] needs a path and a positive rate"},
+		{"no api", QuotaSimulation{Products: []string{"p"}, Traffic: []QuotaSimulationTraffic{{Path: "/", Rate: 1}}},
+			"traffic[0] needs one of spec or api"},
+		{"unknown spec", QuotaSimulation{Products: []string{"p"}, Traffic: []QuotaSimulationTraffic{{Spec: "x", Path: "/", Rate: 1}}},
+			`unknown environment spec "x"`},
+		{"not multitenant", QuotaSimulation{Products: []string{"p"}, Environment: "other",
+			Traffic: []QuotaSimulationTraffic{{API: "a", Path: "/", Rate: 1}}},
+			`environment "other" is not a tenant environment`},
+	}
+	for _, test := range errs {
+		t.Run(test.desc, func(t *testing.T) {
+			if _, err := h.simulateQuotas(test.simulation); err == nil || err.Error() != test.wantErr {
+				t.Errorf("want error %q, got %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestQuotaSimulationHandlerFunc(t *testing.T) {
+	h := &Handler{
+		envName: "env",
+		productMan: &quotaProductMan{ops: map[string][]product.AuthorizedOperation{
+			"api /": {{ID: "q", QuotaLimit: 10, QuotaInterval: 1, QuotaTimeUnit: "second"}},
+		}},
+	}
+	handler := h.QuotaSimulationHandlerFunc()
+
+	resp := httptest.NewRecorder()
+	handler(resp, httptest.NewRequest(http.MethodGet, "/quotas/simulate", nil))
+	if resp.Code != http.StatusMethodNotAllowed {
+		t.Errorf("want %d, got %d", http.StatusMethodNotAllowed, resp.Code)
+	}
+
+	resp = httptest.NewRecorder()
+	handler(resp, httptest.NewRequest(http.MethodPost, "/quotas/simulate", strings.NewReader("{")))
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("want %d, got %d", http.StatusBadRequest, resp.Code)
+	}
+
+	body := `{"products": ["p"], "traffic": [{"api": "api", "path": "/", "rate": 20}]}`
+	resp = httptest.NewRecorder()
+	handler(resp, httptest.NewRequest(http.MethodPost, "/quotas/simulate", strings.NewReader(body)))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("want %d, got %d: %s", http.StatusOK, resp.Code, resp.Body)
+	}
+	var result QuotaSimulationResult
+	if err := json.Unmarshal(resp.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if got := result.Traffic[0].ThrottledRate; got != 10 {
+		t.Errorf("want throttled rate 10, got %v", got)
+	}
+	if got := result.Quotas[0].Throttled; got != 10 {
+		t.Errorf("want 10 throttled, got %v", got)
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+)
+
+// redisError is an error reply of the Redis server
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// redisAddress is a parsed quota_store.redis.addresses URL
+type redisAddress struct {
+	host string
+	tls  bool
+}
+
+// redisClient is a minimal Redis client sending pipelined commands over a
+// pool of connections. Connections are made to the current address and fail
+// over to the next address in order when it can't be reached.
+type redisClient struct {
+	cfg       config.Redis
+	addresses []redisAddress
+	tlsConfig *tls.Config
+	idle      chan *redisConn
+
+	mu      sync.Mutex
+	current int // index of the address in use
+}
+
+type redisConn struct {
+	net.Conn
+	r       *bufio.Reader
+	address int
+}
+
+// newRedisClient creates a redisClient. Returns nil if no addresses are configured.
+func newRedisClient(cfg config.Redis) (*redisClient, error) {
+	if len(cfg.Addresses) == 0 {
+		return nil, nil
+	}
+	c := &redisClient{
+		cfg:  cfg,
+		idle: make(chan *redisConn, cfg.PoolSize),
+	}
+	for _, addr := range cfg.Addresses {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		c.addresses = append(c.addresses, redisAddress{host: u.Host, tls: u.Scheme == "rediss"})
+		if u.Scheme == "rediss" && c.tlsConfig == nil {
+			tr, err := roundTripperWithTLS(cfg.TLS)
+			if err != nil {
+				return nil, err
+			}
+			c.tlsConfig = tr.(*http.Transport).TLSClientConfig
+		}
+	}
+	return c, nil
+}
+
+// do sends the commands in a pipeline and returns their replies. Replies are
+// int64, string, nil, redisError, or []interface{} of replies. The commands
+// are retried once on another connection if the connection fails before they
+// are written. Once written, they may have been executed, so a failure to read
+// the replies isn't retried: a retried INCRBY would count twice and a retried
+// SET NX would find its own key.
+func (c *redisClient) do(cmds ...[]string) ([]interface{}, error) {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var conn *redisConn
+		if conn, err = c.get(); err != nil {
+			return nil, err
+		}
+		var replies []interface{}
+		var sent bool
+		if replies, sent, err = conn.do(c.cfg.Timeout, cmds...); err == nil {
+			c.put(conn)
+			return replies, nil
+		}
+		conn.Close()
+		c.failed(conn.address)
+		if sent {
+			break
+		}
+	}
+	return nil, err
+}
+
+// get returns an idle connection or connects to the current address,
+// failing over to the following addresses
+func (c *redisClient) get() (*redisConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+	c.mu.Lock()
+	start := c.current
+	c.mu.Unlock()
+	var err error
+	for i := 0; i < len(c.addresses); i++ {
+		index := (start + i) % len(c.addresses)
+		var conn *redisConn
+		if conn, err = c.dial(index); err == nil {
+			if index != start {
+				c.mu.Lock()
+				c.current = index
+				c.mu.Unlock()
+				log.Warnf("redis failed over to %s", c.addresses[index].host)
+			}
+			return conn, nil
+		}
+		log.Debugf("unable to connect to redis %s: %v", c.addresses[index].host, err)
+	}
+	return nil, err
+}
+
+// put returns conn to the pool, closing it if the pool is full or it isn't
+// connected to the current address
+func (c *redisClient) put(conn *redisConn) {
+	c.mu.Lock()
+	current := c.current
+	c.mu.Unlock()
+	if conn.address == current {
+		select {
+		case c.idle <- conn:
+			return
+		default:
+		}
+	}
+	conn.Close()
+}
+
+// failed moves the current address past the failed one
+func (c *redisClient) failed(address int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current == address {
+		c.current = (address + 1) % len(c.addresses)
+	}
+}
+
+// dial connects to the address, authenticates, and selects the database
+func (c *redisClient) dial(index int) (*redisConn, error) {
+	addr := c.addresses[index]
+	dialer := &net.Dialer{Timeout: c.cfg.Timeout}
+	var netConn net.Conn
+	var err error
+	if addr.tls {
+		netConn, err = tls.DialWithDialer(dialer, "tcp", addr.host, c.tlsConfig)
+	} else {
+		netConn, err = dialer.Dial("tcp", addr.host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: netConn, r: bufio.NewReader(netConn), address: index}
+
+	var cmds [][]string
+	if c.cfg.Password != "" {
+		if c.cfg.Username != "" {
+			cmds = append(cmds, []string{"AUTH", c.cfg.Username, c.cfg.Password})
+		} else {
+			cmds = append(cmds, []string{"AUTH", c.cfg.Password})
+		}
+	}
+	if c.cfg.DB != 0 {
+		cmds = append(cmds, []string{"SELECT", strconv.Itoa(c.cfg.DB)})
+	}
+	if len(cmds) > 0 {
+		replies, _, err := conn.do(c.cfg.Timeout, cmds...)
+		if err == nil {
+			for _, reply := range replies {
+				if rerr, ok := reply.(redisError); ok {
+					err = rerr
+					break
+				}
+			}
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// close closes the idle connections
+func (c *redisClient) close() {
+	if c == nil {
+		return
+	}
+	for {
+		select {
+		case conn := <-c.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// do writes the commands and reads a reply for each. sent is false if the
+// commands failed before any of them reached the connection.
+func (conn *redisConn) do(timeout time.Duration, cmds ...[]string) (replies []interface{}, sent bool, err error) {
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, false, err
+	}
+	var b strings.Builder
+	for _, cmd := range cmds {
+		fmt.Fprintf(&b, "*%d\r\n", len(cmd))
+		for _, arg := range cmd {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if n, err := io.WriteString(conn, b.String()); err != nil {
+		return nil, n > 0, err
+	}
+	replies = make([]interface{}, len(cmds))
+	for i := range cmds {
+		reply, err := readRedisReply(conn.r)
+		if err != nil {
+			return nil, true, err
+		}
+		replies[i] = reply
+	}
+	return replies, true, nil
+}
+
+// readRedisReply reads a RESP reply
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("invalid redis reply: %q", line)
+	}
+	kind, value := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return redisError(value), nil
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err // nil bulk string if n < 0
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err // nil array if n < 0
+		}
+		array := make([]interface{}, n)
+		for i := range array {
+			if array[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	}
+	return nil, fmt.Errorf("invalid redis reply: %q", line)
+}
@@ -0,0 +1,322 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeRedis serves the commands used by redisClient from memory
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mu       sync.Mutex
+	counters map[string]int64
+	expiries map[string]int64
+	values   map[string]string
+	ttls     map[string]int64
+	conns    int
+	// cuts is the number of commands to execute without replying, closing
+	// the connection instead
+	cuts int
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{
+		listener: l,
+		password: password,
+		counters: make(map[string]int64),
+		expiries: make(map[string]int64),
+		values:   make(map[string]string),
+		ttls:     make(map[string]int64),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			r.conns++
+			r.mu.Unlock()
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) address() string {
+	return "redis://" + r.listener.Addr().String()
+}
+
+func (r *fakeRedis) close() {
+	r.listener.Close()
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := r.password == ""
+	for {
+		reply, err := readRedisReply(reader)
+		if err != nil {
+			return
+		}
+		var cmd []string
+		for _, arg := range reply.([]interface{}) {
+			cmd = append(cmd, arg.(string))
+		}
+		var resp string
+		r.mu.Lock()
+		switch {
+		case cmd[0] == "AUTH":
+			if cmd[len(cmd)-1] == r.password {
+				authenticated = true
+				resp = "+OK\r\n"
+			} else {
+				resp = "-WRONGPASS invalid password\r\n"
+			}
+		case !authenticated:
+			resp = "-NOAUTH Authentication required.\r\n"
+		case cmd[0] == "SELECT":
+			resp = "+OK\r\n"
+		case cmd[0] == "INCRBY":
+			n, _ := strconv.ParseInt(cmd[2], 10, 64)
+			r.counters[cmd[1]] += n
+			resp = fmt.Sprintf(":%d\r\n", r.counters[cmd[1]])
+		case cmd[0] == "PEXPIREAT":
+			r.expiries[cmd[1]], _ = strconv.ParseInt(cmd[2], 10, 64)
+			resp = ":1\r\n"
+		case cmd[0] == "GET":
+			if v, ok := r.values[cmd[1]]; ok {
+				resp = fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+			} else {
+				resp = "$-1\r\n"
+			}
+		case cmd[0] == "SET" && len(cmd) == 6 && cmd[3] == "NX" && cmd[4] == "PX":
+			if _, ok := r.values[cmd[1]]; ok {
+				resp = "$-1\r\n"
+				break
+			}
+			r.values[cmd[1]] = cmd[2]
+			r.ttls[cmd[1]], _ = strconv.ParseInt(cmd[5], 10, 64)
+			resp = "+OK\r\n"
+		case cmd[0] == "SET" && len(cmd) == 5 && cmd[3] == "PX":
+			r.values[cmd[1]] = cmd[2]
+			r.ttls[cmd[1]], _ = strconv.ParseInt(cmd[4], 10, 64)
+			resp = "+OK\r\n"
+		case cmd[0] == "DEL":
+			if _, ok := r.values[cmd[1]]; ok {
+				delete(r.values, cmd[1])
+				resp = ":1\r\n"
+			} else {
+				resp = ":0\r\n"
+			}
+		default:
+			resp = "-ERR unknown command\r\n"
+		}
+		cut := r.cuts > 0
+		if cut {
+			r.cuts--
+		}
+		r.mu.Unlock()
+		if cut {
+			return
+		}
+		if _, err := conn.Write([]byte(resp)); err != nil {
+			return
+		}
+	}
+}
+
+// unusedRedisAddress returns the address of a closed listener
+func unusedRedisAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return "redis://" + addr
+}
+
+func testRedisConfig(addresses ...string) config.Redis {
+	cfg := config.Default().QuotaStore.Redis
+	cfg.Addresses = addresses
+	return cfg
+}
+
+func TestReadRedisReply(t *testing.T) {
+	tests := []struct {
+		desc    string
+		reply   string
+		want    interface{}
+		wantErr bool
+	}{
+		{"simple string", "+OK\r\n", "OK", false},
+		{"error", "-ERR bad\r\n", redisError("ERR bad"), false},
+		{"integer", ":42\r\n", int64(42), false},
+		{"bulk string", "$5\r\nhello\r\n", "hello", false},
+		{"nil bulk string", "$-1\r\n", nil, false},
+		{"array", "*2\r\n:1\r\n$1\r\na\r\n", []interface{}{int64(1), "a"}, false},
+		{"bad integer", ":x\r\n", nil, true},
+		{"bad kind", "?x\r\n", nil, true},
+		{"short", "+\n", nil, true},
+		{"truncated", "$5\r\nhel", nil, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := readRedisReply(bufio.NewReader(strings.NewReader(tc.reply)))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("want error %t, got: %v", tc.wantErr, err)
+			}
+			if !tc.wantErr {
+				if diff := cmp.Diff(tc.want, got); diff != "" {
+					t.Errorf("diff (-want +got):\n%s", diff)
+				}
+			}
+		})
+	}
+}
+
+func TestRedisClient(t *testing.T) {
+	c, err := newRedisClient(testRedisConfig())
+	if c != nil || err != nil {
+		t.Errorf("want nil client without addresses, got: %v, %v", c, err)
+	}
+
+	srv := newFakeRedis(t, "secret")
+	defer srv.close()
+
+	cfg := testRedisConfig(srv.address())
+	cfg.Password = "secret"
+	cfg.DB = 1
+	if c, err = newRedisClient(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	for i := 1; i <= 3; i++ {
+		replies, err := c.do([]string{"INCRBY", "k", "2"}, []string{"PEXPIREAT", "k", "1000"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff([]interface{}{int64(2 * i), int64(1)}, replies); diff != "" {
+			t.Errorf("diff (-want +got):\n%s", diff)
+		}
+	}
+	srv.mu.Lock()
+	if srv.conns != 1 {
+		t.Errorf("want pooled connection reused, got %d connections", srv.conns)
+	}
+	srv.mu.Unlock()
+
+	// bad password
+	cfg.Password = "wrong"
+	bad, err := newRedisClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bad.do([]string{"INCRBY", "k", "1"}); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("want WRONGPASS error, got: %v", err)
+	}
+}
+
+func TestRedisClientConnectionLostAfterWrite(t *testing.T) {
+	srv := newFakeRedis(t, "")
+	defer srv.close()
+	c, err := newRedisClient(testRedisConfig(srv.address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+
+	srv.mu.Lock()
+	srv.cuts = 1
+	srv.mu.Unlock()
+	if _, err := c.do([]string{"INCRBY", "k", "1"}); err == nil {
+		t.Errorf("want error when the reply is lost")
+	}
+	srv.mu.Lock()
+	if srv.counters["k"] != 1 || srv.conns != 1 {
+		t.Errorf("want INCRBY executed once on 1 connection, got %d on %d", srv.counters["k"], srv.conns)
+	}
+	srv.mu.Unlock()
+
+	// a new connection afterwards
+	replies, err := c.do([]string{"INCRBY", "k", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replies[0] != int64(2) {
+		t.Errorf("want 2, got: %v", replies[0])
+	}
+
+	// a SET NX isn't retried to find the key it set
+	srv.mu.Lock()
+	srv.cuts = 1
+	srv.mu.Unlock()
+	if _, err := c.do([]string{"SET", "n", "1", "NX", "PX", "1000"}); err == nil {
+		t.Errorf("want error when the reply is lost")
+	}
+	srv.mu.Lock()
+	if srv.values["n"] != "1" || srv.conns != 2 {
+		t.Errorf("want SET executed once, got %v on %d connections", srv.values, srv.conns)
+	}
+	srv.mu.Unlock()
+}
+
+func TestRedisClientFailover(t *testing.T) {
+	srv := newFakeRedis(t, "")
+	defer srv.close()
+
+	cfg := testRedisConfig(unusedRedisAddress(t), srv.address())
+	c, err := newRedisClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+
+	replies, err := c.do([]string{"INCRBY", "k", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replies[0] != int64(1) {
+		t.Errorf("want 1, got: %v", replies[0])
+	}
+	if c.current != 1 {
+		t.Errorf("want failover to address 1, got: %d", c.current)
+	}
+
+	// server down
+	srv.close()
+	c.close()
+	if _, err := c.do([]string{"INCRBY", "k", "1"}); err == nil {
+		t.Errorf("want error with no reachable address")
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+)
+
+// remoteJWKSManager fetches the JWKS of the RemoteJWKS sources with TLS
+// settings, which the auth.Manager can't, each with a client of its own.
+// The keys are refreshed in the background per the cache duration of the
+// source or, if unset, the caching headers of the response.
+type remoteJWKSManager struct {
+	client  *http.Client
+	retries *outboundRetries       // of the source clients, nil if none
+	sources map[string]*remoteJWKS // by URL, fixed after creation
+	ctx     context.Context
+	cancel  context.CancelFunc
+	jwks    *jwk.AutoRefresh
+}
+
+// remoteJWKS is a RemoteJWKS source with its client
+type remoteJWKS struct {
+	source config.RemoteJWKS
+	client *http.Client
+}
+
+// newRemoteJWKSManager creates a remoteJWKSManager without sources. The
+// clients of the sources are copies of client.
+func newRemoteJWKSManager(client *http.Client) *remoteJWKSManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &remoteJWKSManager{
+		client:  client,
+		sources: make(map[string]*remoteJWKS),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// add registers the source of a JWTAuthentication, the first TLS settings
+// of a URL win. Fails if the TLS files can't be loaded. Must not be called
+// after start.
+func (m *remoteJWKSManager) add(source config.RemoteJWKS) error {
+	if _, ok := m.sources[source.URL]; ok {
+		return nil
+	}
+	client, err := source.TLS.Client(m.client)
+	if err != nil {
+		return fmt.Errorf("remote_jwks %s tls: %v", source.URL, err)
+	}
+	m.sources[source.URL] = &remoteJWKS{source: source, client: m.retries.client(retryEndpointJWKS, client)}
+	return nil
+}
+
+// empty is true if no sources are registered
+func (m *remoteJWKSManager) empty() bool {
+	return m == nil || len(m.sources) == 0
+}
+
+func (m *remoteJWKSManager) start() {
+	m.jwks = jwk.NewAutoRefresh(m.ctx)
+	for u, s := range m.sources {
+		options := []jwk.AutoRefreshOption{jwk.WithHTTPClient(s.client)}
+		if s.source.CacheDuration > 0 {
+			options = append(options, jwk.WithRefreshInterval(s.source.CacheDuration))
+		}
+		m.jwks.Configure(u, options...)
+	}
+}
+
+func (m *remoteJWKSManager) stop() {
+	if m != nil {
+		m.cancel()
+	}
+}
+
+// refresh fetches the keys of the source with URL u again. False if m is
+// nil or has no such source.
+func (m *remoteJWKSManager) refresh(u string) (bool, error) {
+	if m == nil {
+		return false, nil
+	}
+	if _, ok := m.sources[u]; !ok {
+		return false, nil
+	}
+	_, err := m.jwks.Refresh(m.ctx, u)
+	return true, err
+}
+
+// ParseJWT implements config.JWKSVerifier
+func (m *remoteJWKSManager) ParseJWT(jwtString string, source config.RemoteJWKS) (map[string]interface{}, error) {
+	if _, ok := m.sources[source.URL]; !ok {
+		return nil, fmt.Errorf("unknown remote JWKS %s", source.URL)
+	}
+	keys, err := m.jwks.Fetch(m.ctx, source.URL)
+	if err != nil {
+		return nil, err
+	}
+	token, err := jwt.Parse([]byte(jwtString),
+		jwt.WithKeySet(keys),
+		jwt.WithValidate(true),
+		jwt.WithAcceptableSkew(oidcAcceptableSkew))
+	if err != nil {
+		return nil, err
+	}
+	return token.AsMap(context.Background())
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+)
+
+func TestRemoteJWKSManager(t *testing.T) {
+	privateKey, jwks, err := testutil.GenerateKeyAndJWKs("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(jwks)
+	}))
+	defer ts.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var nilManager *remoteJWKSManager
+	nilManager.stop() // no panic
+	if !nilManager.empty() {
+		t.Errorf("nil manager should be empty")
+	}
+
+	m := newRemoteJWKSManager(&http.Client{Timeout: time.Second})
+	if !m.empty() {
+		t.Errorf("should be empty")
+	}
+	if err := m.add(config.RemoteJWKS{URL: ts.URL, TLS: &config.JWKSTLS{CAFile: filepath.Join(filepath.Dir(caFile), "missing.pem")}}); err == nil {
+		t.Errorf("want error for missing CA file")
+	}
+	source := config.RemoteJWKS{URL: ts.URL, CacheDuration: time.Hour, TLS: &config.JWKSTLS{CAFile: caFile}}
+	if err := m.add(source); err != nil {
+		t.Fatal(err)
+	}
+	if m.empty() {
+		t.Errorf("should not be empty")
+	}
+	m.start()
+	defer m.stop()
+
+	jwtString, err := testutil.GenerateJWT(privateKey, map[string]interface{}{
+		"iss": "issuer",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := m.ParseJWT(jwtString, source)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if claims["iss"] != "issuer" {
+		t.Errorf("want iss issuer, got %v", claims["iss"])
+	}
+
+	if _, err := m.ParseJWT("bad", source); err == nil {
+		t.Errorf("should reject bad JWT")
+	}
+	if _, err := m.ParseJWT(jwtString, config.RemoteJWKS{URL: "https://unknown.example.com"}); err == nil {
+		t.Errorf("should reject unknown source")
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// interval of removing expired IDs from a replay cache
+	replaySweepInterval = time.Minute
+
+	replayResultOK       = "ok"
+	replayResultMissing  = "missing"
+	replayResultStale    = "stale"
+	replayResultReplayed = "replayed"
+)
+
+// replayCache remembers the IDs of accepted requests until they expire
+type replayCache struct {
+	mu        sync.Mutex
+	expiries  map[string]time.Time // id -> expiry
+	nextSweep time.Time
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{expiries: make(map[string]time.Time)}
+}
+
+// add records id until expiry, returns false if it is already recorded
+func (c *replayCache) add(id string, expiry, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.After(c.nextSweep) {
+		for id, exp := range c.expiries {
+			if now.After(exp) {
+				delete(c.expiries, id)
+			}
+		}
+		c.nextSweep = now.Add(replaySweepInterval)
+	}
+	if exp, ok := c.expiries[id]; ok && !now.After(exp) {
+		return false
+	}
+	c.expiries[id] = expiry
+	return true
+}
+
+// replayProtector records the nonces of replay protected operations in Redis
+// so any replica accepts a nonce once. Nonces are recorded locally if there
+// is no Redis client or while Redis can't be reached.
+type replayProtector struct {
+	local  *replayCache
+	client *redisClient
+	prefix string
+}
+
+func newReplayProtector(client *redisClient, prefix string) *replayProtector {
+	return &replayProtector{
+		local:  newReplayCache(),
+		client: client,
+		prefix: prefix,
+	}
+}
+
+// add records the nonce until expiry, returns false if it is already recorded
+func (p *replayProtector) add(nonce string, expiry, now time.Time) bool {
+	if p.client == nil {
+		return p.local.add(nonce, expiry, now)
+	}
+	millis := int64(expiry.Sub(now) / time.Millisecond)
+	if millis <= 0 {
+		millis = 1
+	}
+	replies, err := p.client.do([]string{"SET", p.prefix + nonce, "1", "NX", "PX", strconv.FormatInt(millis, 10)})
+	if err == nil {
+		switch reply := replies[0].(type) {
+		case string:
+			return true
+		case nil:
+			return false
+		case redisError:
+			err = reply
+		default:
+			err = fmt.Errorf("unexpected SET reply: %v", reply)
+		}
+	}
+	log.Warnf("unable to record nonce in redis, recording locally: %v", err)
+	return p.local.add(nonce, expiry, now)
+}
+
+// close is nil-safe
+func (p *replayProtector) close() {
+	if p != nil && p.client != nil {
+		p.client.close()
+	}
+}
+
+// checkReplayProtection denies requests of replay protected operations
+// without a nonce, with a timestamp outside of the window, or with a nonce
+// accepted before from the same consumer. Called once the request is
+// authorized so denied requests don't use up nonces.
+func checkReplayProtection(c *CheckContext) *authv3.CheckResponse {
+	op := c.EnvRequest.GetOperation()
+	if op == nil || op.ReplayProtection == nil {
+		return nil
+	}
+	policy := op.ReplayProtection
+	org, env := c.rootContext.Organization(), c.rootContext.Environment()
+	spec, api := c.server.handler.metricScope(c.EnvRequest, c.API)
+	headers := c.Request.GetAttributes().GetRequest().GetHttp().GetHeaders()
+
+	nonce := headers[strings.ToLower(policy.NonceHeader)]
+	if nonce == "" {
+		log.Debugf("replay protection nonce required")
+		c.trace.tracef("replay protection: missing nonce")
+		prometheusReplayChecks.WithLabelValues(org, env, spec, api, replayResultMissing).Inc()
+		return c.Denied()
+	}
+
+	now := time.Now()
+	window := policy.GetWindow()
+	expiry := now.Add(window)
+	if policy.TimestampHeader != "" {
+		seconds, err := strconv.ParseInt(headers[strings.ToLower(policy.TimestampHeader)], 10, 64)
+		timestamp := time.Unix(seconds, 0)
+		if err != nil || timestamp.Before(now.Add(-window)) || timestamp.After(now.Add(window)) {
+			log.Debugf("replay protection timestamp outside of window %s", window)
+			c.trace.tracef("replay protection: timestamp outside of window %s", window)
+			prometheusReplayChecks.WithLabelValues(org, env, spec, api, replayResultStale).Inc()
+			return c.Denied()
+		}
+		// the timestamp is rejected once the nonce expires
+		expiry = timestamp.Add(window)
+	}
+
+	var consumer string
+	if c.AuthContext != nil {
+		consumer = c.AuthContext.ClientID
+	}
+	if !c.server.handler.replays.add(replayNonceKey(c.EnvRequest.GetAPISpec().ID, op.Name, consumer, nonce), expiry, now) {
+		log.Debugf("replay protection nonce replayed")
+		c.trace.tracef("replay protection: nonce replayed")
+		prometheusReplayChecks.WithLabelValues(org, env, spec, api, replayResultReplayed).Inc()
+		return c.Denied()
+	}
+	prometheusReplayChecks.WithLabelValues(org, env, spec, api, replayResultOK).Inc()
+	return nil
+}
+
+// replayNonceKey scopes the nonce to its operation and consumer by a digest
+// so nonces of any length are recorded in bounded space
+func replayNonceKey(api, operation, consumer, nonce string) string {
+	sum := sha256.Sum256([]byte(api + "\x00" + operation + "\x00" + consumer + "\x00" + nonce))
+	return hex.EncodeToString(sum[:])
+}
+
+var (
+	prometheusReplayChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "replay_protection_count",
+		Help:      "Total number of replay protection checks by result",
+	}, []string{"org", "env", "spec", "api", "result"})
+)
@@ -0,0 +1,224 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	apigeeContext "github.com/apigee/apigee-remote-service-golib/v2/context"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
+	"github.com/gogo/googleapis/google/rpc"
+)
+
+func TestReplayCache(t *testing.T) {
+	c := newReplayCache()
+	now := time.Now()
+	if !c.add("a", now.Add(time.Minute), now) {
+		t.Errorf("should add new id")
+	}
+	if c.add("a", now.Add(time.Minute), now) {
+		t.Errorf("should not add replayed id")
+	}
+	if !c.add("a", now.Add(3*time.Minute), now.Add(2*time.Minute)) {
+		t.Errorf("should add expired id")
+	}
+	c.add("b", now.Add(time.Minute), now.Add(2*time.Minute))
+	c.add("c", now.Add(10*time.Minute), now.Add(5*time.Minute))
+	if _, ok := c.expiries["b"]; ok {
+		t.Errorf("expired ids should be swept")
+	}
+}
+
+func TestReplayProtectorRedis(t *testing.T) {
+	srv := newFakeRedis(t, "")
+	defer srv.close()
+	client, err := newRedisClient(testRedisConfig(srv.address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newReplayProtector(client, "r:")
+	defer p.close()
+
+	now := time.Now()
+	if !p.add("nonce", now.Add(1500*time.Millisecond), now) {
+		t.Errorf("should add new nonce")
+	}
+	if p.add("nonce", now.Add(1500*time.Millisecond), now) {
+		t.Errorf("should not add replayed nonce")
+	}
+	srv.mu.Lock()
+	if srv.ttls["r:nonce"] != 1500 {
+		t.Errorf("want ttl 1500 ms, got: %v", srv.ttls)
+	}
+	srv.mu.Unlock()
+	if len(p.local.expiries) != 0 {
+		t.Errorf("nonces should not be recorded locally, got: %v", p.local.expiries)
+	}
+
+	// connection lost after the SET is written, not retried to find its own key
+	srv.mu.Lock()
+	srv.cuts = 1
+	srv.mu.Unlock()
+	if !p.add("cut", now.Add(time.Minute), now) {
+		t.Errorf("should add new nonce when the reply is lost")
+	}
+	srv.mu.Lock()
+	if srv.values["r:cut"] != "1" || srv.cuts != 0 {
+		t.Errorf("want nonce set once in redis, got: %v", srv.values)
+	}
+	srv.mu.Unlock()
+
+	// unreachable store records locally
+	srv.close()
+	client.close()
+	if !p.add("other", now.Add(time.Minute), now) {
+		t.Errorf("should add new nonce locally")
+	}
+	if p.add("other", now.Add(time.Minute), now) {
+		t.Errorf("should not add replayed nonce locally")
+	}
+
+	var nilProtector *replayProtector
+	nilProtector.close() // no panic
+}
+
+func TestCheckReplayProtection(t *testing.T) {
+	envSpec := config.EnvironmentSpec{
+		ID: "spec",
+		APIs: []config.APISpec{{
+			ID:       "api",
+			BasePath: "/v1",
+			Operations: []config.APIOperation{
+				{
+					Name:        "nonce",
+					HTTPMatches: []config.HTTPMatch{{PathTemplate: "/nonce"}},
+					ReplayProtection: &config.ReplayProtection{
+						NonceHeader: "X-Nonce",
+					},
+				},
+				{
+					Name:        "timestamp",
+					HTTPMatches: []config.HTTPMatch{{PathTemplate: "/timestamp"}},
+					ReplayProtection: &config.ReplayProtection{
+						NonceHeader:     "X-Nonce",
+						TimestampHeader: "X-Timestamp",
+						Window:          time.Minute,
+					},
+				},
+				{
+					Name:        "unprotected",
+					HTTPMatches: []config.HTTPMatch{{PathTemplate: "/unprotected"}},
+				},
+				{
+					Name:        "consumer",
+					HTTPMatches: []config.HTTPMatch{{PathTemplate: "/consumer"}},
+					ConsumerAuthorization: config.ConsumerAuthorization{
+						In: []config.APIOperationParameter{{Match: config.Header("x-api-key")}},
+					},
+					ReplayProtection: &config.ReplayProtection{
+						NonceHeader: "X-Nonce",
+					},
+				},
+			},
+		}},
+	}
+	if err := config.ValidateEnvironmentSpecs([]config.EnvironmentSpec{envSpec}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	specExt, err := config.NewEnvironmentSpecExt(&envSpec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	authMan := &testAuthMan{}
+	authMan.makeContextFunc = func(ctx apigeeContext.Context) (*auth.Context, error) {
+		if authMan.apiKey == "bad" {
+			return nil, auth.ErrBadAuth
+		}
+		return &auth.Context{Context: ctx, ClientID: authMan.apiKey, APIProducts: []string{"product"}}, nil
+	}
+	server := AuthorizationServer{
+		handler: &Handler{
+			authMan: authMan,
+			productMan: &testProductMan{resolve: true, api: "api", products: map[string]*product.APIProduct{
+				"product": {DisplayName: "product"},
+			}},
+			quotaMan:     &testQuotaMan{},
+			analyticsMan: &testAnalyticsMan{},
+			envSpecsByID: map[string]*config.EnvironmentSpecExt{specExt.ID: specExt},
+			ready:        util.NewAtomicBool(true),
+			replays:      newReplayProtector(nil, ""),
+		},
+	}
+
+	now := time.Now().Unix()
+	timestamp := func(seconds int64) string {
+		return strconv.FormatInt(seconds, 10)
+	}
+	tests := []struct {
+		desc      string
+		path      string
+		nonce     string
+		timestamp string
+		apiKey    string
+		wantCode  rpc.Code
+	}{
+		{"unprotected", "/v1/unprotected", "", "", "", rpc.OK},
+		{"missing nonce", "/v1/nonce", "", "", "", rpc.PERMISSION_DENIED},
+		{"first use", "/v1/nonce", "1", "", "", rpc.OK},
+		{"replayed", "/v1/nonce", "1", "", "", rpc.PERMISSION_DENIED},
+		{"same nonce other operation", "/v1/timestamp", "1", timestamp(now), "", rpc.OK},
+		{"missing timestamp", "/v1/timestamp", "2", "", "", rpc.PERMISSION_DENIED},
+		{"bad timestamp", "/v1/timestamp", "3", "yesterday", "", rpc.PERMISSION_DENIED},
+		{"stale timestamp", "/v1/timestamp", "4", timestamp(now - 120), "", rpc.PERMISSION_DENIED},
+		{"future timestamp", "/v1/timestamp", "5", timestamp(now + 120), "", rpc.PERMISSION_DENIED},
+		{"timestamp in window", "/v1/timestamp", "6", timestamp(now - 30), "", rpc.OK},
+		{"timestamp replayed", "/v1/timestamp", "6", timestamp(now - 30), "", rpc.PERMISSION_DENIED},
+		{"unauthorized consumer", "/v1/consumer", "7", "", "bad", rpc.PERMISSION_DENIED},
+		{"nonce of unauthorized request unused", "/v1/consumer", "7", "", "client-1", rpc.OK},
+		{"same nonce other consumer", "/v1/consumer", "7", "", "client-2", rpc.OK},
+		{"consumer replayed", "/v1/consumer", "7", "", "client-1", rpc.PERMISSION_DENIED},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			headers := map[string]string{}
+			if test.nonce != "" {
+				headers["x-nonce"] = test.nonce
+			}
+			if test.timestamp != "" {
+				headers["x-timestamp"] = test.timestamp
+			}
+			if test.apiKey != "" {
+				headers["x-api-key"] = test.apiKey
+			}
+			req := testutil.NewEnvoyRequest(http.MethodGet, test.path, headers, nil)
+			req.Attributes.ContextExtensions = map[string]string{envSpecContextKey: specExt.ID}
+			resp, err := server.Check(context.Background(), req)
+			if err != nil {
+				t.Fatalf("should not get error. got: %s", err)
+			}
+			if resp.Status.Code != int32(test.wantCode) {
+				t.Errorf("want: %d, got: %d", test.wantCode, resp.Status.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/gogo/googleapis/google/rpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	maxHeadersLimit      = "max_headers"
+	maxHeadersBytesLimit = "max_headers_bytes"
+
+	// limits of the operation header_limits
+	opMaxHeadersLimit     = "operation_max_headers"
+	opMaxHeaderBytesLimit = "operation_max_header_bytes"
+	opMaxCookieBytesLimit = "operation_max_cookie_bytes"
+
+	cookieHeader = "cookie"
+)
+
+// requestLimits are protective limits on the size of requests, zero is unlimited
+type requestLimits struct {
+	maxHeaders      int
+	maxHeadersBytes int
+}
+
+// check records the size of the request and returns the
+// name of the first limit exceeded, "" if none
+func (l requestLimits) check(req *authv3.CheckRequest) string {
+	headers := req.GetAttributes().GetRequest().GetHttp().GetHeaders()
+	headersBytes := 0
+	for k, v := range headers {
+		headersBytes += len(k) + len(v)
+	}
+	prometheusRequestHeaders.Observe(float64(len(headers)))
+	prometheusRequestHeadersBytes.Observe(float64(headersBytes))
+	prometheusCheckRequestBytes.Observe(float64(proto.Size(req)))
+
+	if l.maxHeaders > 0 && len(headers) > l.maxHeaders {
+		return maxHeadersLimit
+	}
+	if l.maxHeadersBytes > 0 && headersBytes > l.maxHeadersBytes {
+		return maxHeadersBytesLimit
+	}
+	return ""
+}
+
+// exceededHeaderLimit returns the name of the first header limit of the
+// operation exceeded and the largest header exceeding it, "" if none
+func exceededHeaderLimit(l *config.HeaderLimits, headers map[string]string) (limit, header string) {
+	if l == nil {
+		return "", ""
+	}
+	count, largest := 0, 0
+	for k, v := range headers {
+		if strings.HasPrefix(k, ":") {
+			continue
+		}
+		count++
+		if size := len(k) + len(v); size > largest {
+			header, largest = k, size
+		}
+	}
+	if l.MaxHeaderBytes > 0 && largest > l.MaxHeaderBytes {
+		return opMaxHeaderBytesLimit, header
+	}
+	if l.MaxHeaders > 0 && count > l.MaxHeaders {
+		return opMaxHeadersLimit, ""
+	}
+	if l.MaxCookieBytes > 0 && len(headers[cookieHeader]) > l.MaxCookieBytes {
+		return opMaxCookieBytesLimit, cookieHeader
+	}
+	return "", ""
+}
+
+// checkHeaderLimits denies requests exceeding the header limits of the
+// operation with status 431
+func checkHeaderLimits(c *CheckContext) *authv3.CheckResponse {
+	op := c.EnvRequest.GetOperation()
+	if op == nil {
+		return nil
+	}
+	limit, header := exceededHeaderLimit(op.HeaderLimits, c.Request.GetAttributes().GetRequest().GetHttp().GetHeaders())
+	if limit == "" {
+		return nil
+	}
+	log.Debugf("request exceeds %s limit of operation %s: %q", limit, op.Name, header)
+	c.trace.tracef("operation %s: %s limit exceeded %s", op.Name, limit, header)
+	prometheusRequestLimitDenied.WithLabelValues(c.rootContext.Organization(), c.rootContext.Environment(), limit).Inc()
+	resp := c.server.createEnvoyDenied(c.Request, c.EnvRequest, c.tracker, nil, c.API,
+		rpc.INVALID_ARGUMENT, typev3.StatusCode_RequestHeaderFieldsTooLarge)
+	setDenyReason(resp, denyReasonRequestLimit)
+	return resp
+}
+
+var (
+	prometheusRequestHeaders = promauto.NewHistogram(prometheus.HistogramOpts{
+		Subsystem: "auth",
+		Name:      "request_headers",
+		Help:      "Number of headers in authorization requests",
+		Buckets:   prometheus.ExponentialBuckets(8, 2, 8),
+	})
+
+	prometheusRequestHeadersBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Subsystem: "auth",
+		Name:      "request_headers_bytes",
+		Help:      "Total size of header names and values in authorization requests",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 8),
+	})
+
+	prometheusCheckRequestBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Subsystem: "auth",
+		Name:      "check_request_bytes",
+		Help:      "Size of authorization request messages",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 8),
+	})
+
+	prometheusRequestLimitDenied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "request_limit_denied_count",
+		Help:      "Total number of requests denied for exceeding a request limit",
+	}, []string{"org", "env", "limit"})
+)
@@ -0,0 +1,176 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/gogo/googleapis/google/rpc"
+)
+
+func TestRequestLimitsCheck(t *testing.T) {
+	headers := map[string]string{
+		"a": "12345",
+		"b": "12345",
+		"c": "12345",
+	}
+	req := testutil.NewEnvoyRequest(http.MethodGet, "/path", headers, nil) // adds :path
+
+	tests := []struct {
+		desc   string
+		limits requestLimits
+		want   string
+	}{
+		{"unlimited", requestLimits{}, ""},
+		{"within limits", requestLimits{maxHeaders: 4, maxHeadersBytes: 28}, ""},
+		{"too many headers", requestLimits{maxHeaders: 3}, maxHeadersLimit},
+		{"headers too large", requestLimits{maxHeadersBytes: 27}, maxHeadersBytesLimit},
+		{"both exceeded", requestLimits{maxHeaders: 1, maxHeadersBytes: 1}, maxHeadersLimit},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			if got := test.limits.check(req); got != test.want {
+				t.Errorf("want: %q, got: %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestCheckRequestLimits(t *testing.T) {
+	headers := map[string]string{
+		headerAPI: "api",
+		"x-bomb":  "0123456789",
+	}
+	req := testutil.NewEnvoyRequest(http.MethodGet, "/path", headers, nil)
+
+	server := AuthorizationServer{
+		handler: &Handler{
+			apiHeader:    headerAPI,
+			analyticsMan: &testAnalyticsMan{},
+			ready:        util.NewAtomicBool(true),
+			limits:       requestLimits{maxHeadersBytes: 16},
+		},
+	}
+
+	resp, err := server.Check(context.Background(), req)
+	if err != nil {
+		t.Fatalf("should not get error. got: %s", err)
+	}
+	if resp.Status.Code != int32(rpc.INVALID_ARGUMENT) {
+		t.Errorf("want: %d, got: %d", int32(rpc.INVALID_ARGUMENT), resp.Status.Code)
+	}
+	code := resp.GetDeniedResponse().GetStatus().GetCode()
+	if code != typev3.StatusCode_RequestHeaderFieldsTooLarge {
+		t.Errorf("want: %v, got: %v", typev3.StatusCode_RequestHeaderFieldsTooLarge, code)
+	}
+}
+
+func TestExceededHeaderLimit(t *testing.T) {
+	headers := map[string]string{
+		":path":  "/a-long-path-not-limited",
+		"a":      "12345",
+		"b":      "1234567890",
+		"cookie": "c=1",
+	}
+
+	tests := []struct {
+		desc       string
+		limits     *config.HeaderLimits
+		wantLimit  string
+		wantHeader string
+	}{
+		{"none", nil, "", ""},
+		{"unlimited", &config.HeaderLimits{}, "", ""},
+		{"within limits", &config.HeaderLimits{MaxHeaders: 3, MaxHeaderBytes: 11, MaxCookieBytes: 3}, "", ""},
+		{"too many headers", &config.HeaderLimits{MaxHeaders: 2}, opMaxHeadersLimit, ""},
+		{"header too large", &config.HeaderLimits{MaxHeaderBytes: 10}, opMaxHeaderBytesLimit, "b"},
+		{"cookie too large", &config.HeaderLimits{MaxCookieBytes: 2}, opMaxCookieBytesLimit, cookieHeader},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			limit, header := exceededHeaderLimit(test.limits, headers)
+			if limit != test.wantLimit || header != test.wantHeader {
+				t.Errorf("want: %q %q, got: %q %q", test.wantLimit, test.wantHeader, limit, header)
+			}
+		})
+	}
+}
+
+func TestCheckHeaderLimits(t *testing.T) {
+	envSpec := config.EnvironmentSpec{
+		ID: "spec",
+		APIs: []config.APISpec{{
+			ID:       "api",
+			BasePath: "/v1",
+			Operations: []config.APIOperation{{
+				Name:         "op",
+				HTTPMatches:  []config.HTTPMatch{{PathTemplate: "/**"}},
+				HeaderLimits: &config.HeaderLimits{MaxCookieBytes: 8},
+			}},
+		}},
+	}
+	if err := config.ValidateEnvironmentSpecs([]config.EnvironmentSpec{envSpec}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	specExt, err := config.NewEnvironmentSpecExt(&envSpec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	server := AuthorizationServer{
+		handler: &Handler{
+			authMan:      &testAuthMan{},
+			productMan:   &testProductMan{resolve: true},
+			quotaMan:     &testQuotaMan{},
+			analyticsMan: &testAnalyticsMan{},
+			envSpecsByID: map[string]*config.EnvironmentSpecExt{specExt.ID: specExt},
+			ready:        util.NewAtomicBool(true),
+		},
+	}
+
+	tests := []struct {
+		desc     string
+		cookie   string
+		wantCode rpc.Code
+	}{
+		{"within limit", "c=123456", rpc.OK},
+		{"cookie too large", "c=1234567", rpc.INVALID_ARGUMENT},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			req := testutil.NewEnvoyRequest(http.MethodGet, "/v1/petstore", map[string]string{cookieHeader: test.cookie}, nil)
+			req.Attributes.ContextExtensions = map[string]string{envSpecContextKey: specExt.ID}
+			resp, err := server.Check(context.Background(), req)
+			if err != nil {
+				t.Fatalf("should not get error. got: %s", err)
+			}
+			if resp.Status.Code != int32(test.wantCode) {
+				t.Fatalf("want: %d, got: %d", test.wantCode, resp.Status.Code)
+			}
+			if test.wantCode == rpc.OK {
+				return
+			}
+			if code := resp.GetDeniedResponse().GetStatus().GetCode(); code != typev3.StatusCode_RequestHeaderFieldsTooLarge {
+				t.Errorf("want: %v, got: %v", typev3.StatusCode_RequestHeaderFieldsTooLarge, code)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/net/idna"
+)
+
+// Ambiguities of requests denied by the strict request normalization.
+const (
+	ambiguousPercentEncoding = "percent_encoding"
+	ambiguousEncodedSlash    = "encoded_slash"
+	ambiguousBackslash       = "backslash"
+	ambiguousControlChar     = "control_character"
+	ambiguousHost            = "host"
+)
+
+const upperHex = "0123456789ABCDEF"
+
+// hostProfile converts hosts to ASCII, allowing the underscores of
+// service names
+var hostProfile = idna.New(idna.MapForLookup(), idna.StrictDomainName(false), idna.BidiRule())
+
+// requestNormalizer is the request_normalization config, normalizing the
+// paths and hosts of requests in place before they are matched
+type requestNormalizer struct {
+	strict bool
+}
+
+// newRequestNormalizer returns nil if normalization is off
+func newRequestNormalizer(mode string) *requestNormalizer {
+	if mode == config.RequestNormalizationOff {
+		return nil
+	}
+	return &requestNormalizer{strict: mode == config.RequestNormalizationStrict}
+}
+
+// normalize replaces the path and host of req with their normalized forms.
+// In strict mode, returns the ambiguity of a request to deny, else "".
+func (n *requestNormalizer) normalize(req *authv3.CheckRequest) string {
+	httpReq := req.GetAttributes().GetRequest().GetHttp()
+	if n == nil || httpReq == nil {
+		return ""
+	}
+	path, pathAmbiguity := normalizeRequestPath(httpReq.Path)
+	host, hostValid := normalizeRequestHost(httpReq.Host)
+	httpReq.Path, httpReq.Host = path, host
+	if !n.strict {
+		return ""
+	}
+	if pathAmbiguity != "" {
+		return pathAmbiguity
+	}
+	if !hostValid {
+		return ambiguousHost
+	}
+	return ""
+}
+
+// path returns the normalized form of a logged request path
+func (n *requestNormalizer) path(p string) string {
+	if n == nil {
+		return p
+	}
+	p, _ = normalizeRequestPath(p)
+	return p
+}
+
+// normalizeRequestPath applies the RFC 3986 syntax-based normalization to the
+// path of a request URI, leaving its query as is. Returns the first ambiguity
+// found in the path, if any, which is otherwise kept as is.
+func normalizeRequestPath(uri string) (string, string) {
+	path, query := uri, ""
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		path, query = uri[:i], uri[i:]
+	}
+	ambiguity := ""
+	ambiguous := func(a string) {
+		if ambiguity == "" {
+			ambiguity = a
+		}
+	}
+
+	var b strings.Builder
+	b.Grow(len(path))
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case c == '%':
+			if i+2 >= len(path) || !isHex(path[i+1]) || !isHex(path[i+2]) {
+				ambiguous(ambiguousPercentEncoding)
+				b.WriteByte(c)
+				continue
+			}
+			decoded := unhex(path[i+1])<<4 | unhex(path[i+2])
+			i += 2
+			if isUnreserved(decoded) {
+				b.WriteByte(decoded)
+				continue
+			}
+			if decoded == '/' || decoded == '\\' {
+				ambiguous(ambiguousEncodedSlash)
+			}
+			b.WriteByte('%')
+			b.WriteByte(upperHex[decoded>>4])
+			b.WriteByte(upperHex[decoded&0xf])
+		case c == '\\':
+			ambiguous(ambiguousBackslash)
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			ambiguous(ambiguousControlChar)
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	path = b.String()
+	if strings.HasPrefix(path, "/") {
+		path = removeDotSegments(path)
+	}
+	return path + query, ambiguity
+}
+
+// removeDotSegments is the algorithm of RFC 3986 section 5.2.4
+func removeDotSegments(in string) string {
+	var out []string
+	for in != "" {
+		switch {
+		case strings.HasPrefix(in, "../"):
+			in = in[3:]
+		case strings.HasPrefix(in, "./"):
+			in = in[2:]
+		case strings.HasPrefix(in, "/./"):
+			in = in[2:]
+		case in == "/.":
+			in = "/"
+		case strings.HasPrefix(in, "/../"):
+			in = in[3:]
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+		case in == "/..":
+			in = "/"
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+		case in == "." || in == "..":
+			in = ""
+		default:
+			// move the first segment, with its leading slash, to the output
+			end := strings.IndexByte(in[1:], '/') + 1
+			if end == 0 {
+				end = len(in)
+			}
+			out = append(out, in[:end])
+			in = in[end:]
+		}
+	}
+	return strings.Join(out, "")
+}
+
+// normalizeRequestHost lowercases the host and converts an internationalized
+// name to punycode, keeping the port. Returns false if the name isn't valid.
+func normalizeRequestHost(host string) (string, bool) {
+	if host == "" {
+		return host, true
+	}
+	name, port := host, ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		name, port = h, p
+	}
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	valid := true
+	if net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(name, "["), "]")) == nil {
+		ascii, err := hostProfile.ToASCII(name)
+		switch {
+		case err != nil || !isHostName(ascii):
+			valid = false
+		case isASCII(name) && ascii != name: // a punycode label not round-tripping
+			valid = false
+		default:
+			name = ascii
+		}
+	}
+	if port != "" {
+		return net.JoinHostPort(name, port), valid
+	}
+	return name, valid
+}
+
+// isHostName returns true if the ASCII name has only letters, digits,
+// hyphens, underscores, and dots
+func isHostName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; !isUnreserved(c) || c == '~' {
+			return false
+		}
+	}
+	return name != ""
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// isUnreserved returns true for the unreserved characters of RFC 3986
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
+
+var (
+	prometheusAmbiguousRequestDenied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "ambiguous_request_denied_count",
+		Help:      "Total number of requests denied by strict request normalization by ambiguity",
+	}, []string{"org", "env", "ambiguity"})
+)
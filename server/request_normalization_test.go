@@ -0,0 +1,168 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/gogo/googleapis/google/rpc"
+	prometheustest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNormalizeRequestPath(t *testing.T) {
+	tests := []struct {
+		path          string
+		want          string
+		wantAmbiguity string
+	}{
+		{"/v1/pets", "/v1/pets", ""},
+		{"/v1/%7Euser/%61pi", "/v1/~user/api", ""},
+		{"/v1/a%2fb", "/v1/a%2Fb", ambiguousEncodedSlash},
+		{"/v1/a%5Cb", "/v1/a%5Cb", ambiguousEncodedSlash},
+		{"/v1/caf%c3%a9", "/v1/caf%C3%A9", ""},
+		{"/v1/./admin/../pets", "/v1/pets", ""},
+		{"/v1/%2e%2E/admin", "/admin", ""},
+		{"/../../etc", "/etc", ""},
+		{"/v1/pets/..", "/v1/", ""},
+		{"/v1/pets/.", "/v1/pets/", ""},
+		{"/v1/pets?next=/../x&q=%2e", "/v1/pets?next=/../x&q=%2e", ""},
+		{"/v1/%zz", "/v1/%zz", ambiguousPercentEncoding},
+		{"/v1/%4", "/v1/%4", ambiguousPercentEncoding},
+		{"/v1\\admin", "/v1\\admin", ambiguousBackslash},
+		{"/v1/a\tb", "/v1/a\tb", ambiguousControlChar},
+		{"*", "*", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			got, ambiguity := normalizeRequestPath(test.path)
+			if got != test.want {
+				t.Errorf("want %q, got %q", test.want, got)
+			}
+			if ambiguity != test.wantAmbiguity {
+				t.Errorf("want ambiguity %q, got %q", test.wantAmbiguity, ambiguity)
+			}
+		})
+	}
+}
+
+func TestNormalizeRequestHost(t *testing.T) {
+	tests := []struct {
+		host      string
+		want      string
+		wantValid bool
+	}{
+		{"", "", true},
+		{"API.Example.COM", "api.example.com", true},
+		{"api.example.com.:8080", "api.example.com:8080", true},
+		{"bücher.example", "xn--bcher-kva.example", true},
+		{"BÜCHER.example:443", "xn--bcher-kva.example:443", true},
+		{"my_service.default", "my_service.default", true},
+		{"10.0.0.1:80", "10.0.0.1:80", true},
+		{"[::1]:80", "[::1]:80", true},
+		{"[::1]", "[::1]", true},
+		{"xn--invalid-.example", "xn--invalid-.example", false},
+		{"exa mple.com", "exa mple.com", false},
+		{"-bad.example", "-bad.example", false},
+	}
+	for _, test := range tests {
+		t.Run(test.host, func(t *testing.T) {
+			got, valid := normalizeRequestHost(test.host)
+			if got != test.want {
+				t.Errorf("want %q, got %q", test.want, got)
+			}
+			if valid != test.wantValid {
+				t.Errorf("want valid %t, got %t", test.wantValid, valid)
+			}
+		})
+	}
+}
+
+func TestRequestNormalizer(t *testing.T) {
+	if newRequestNormalizer(config.RequestNormalizationOff) != nil {
+		t.Errorf("normalizer should be off")
+	}
+	var off *requestNormalizer
+	req := testutil.NewEnvoyRequest(http.MethodGet, "/a/../b", nil, nil)
+	if got := off.normalize(req); got != "" {
+		t.Errorf("want no ambiguity, got %q", got)
+	}
+	if got := req.Attributes.Request.Http.Path; got != "/a/../b" {
+		t.Errorf("want path unchanged, got %q", got)
+	}
+	if got := off.path("/a/../b"); got != "/a/../b" {
+		t.Errorf("want path unchanged, got %q", got)
+	}
+
+	normalizer := newRequestNormalizer(config.RequestNormalizationNormalize)
+	req = testutil.NewEnvoyRequest(http.MethodGet, "/a/../b%2f", nil, nil)
+	req.Attributes.Request.Http.Host = "Example.COM"
+	if got := normalizer.normalize(req); got != "" {
+		t.Errorf("want no ambiguity, got %q", got)
+	}
+	if got := req.Attributes.Request.Http.Path; got != "/b%2F" {
+		t.Errorf("want path %q, got %q", "/b%2F", got)
+	}
+	if got := req.Attributes.Request.Http.Host; got != "example.com" {
+		t.Errorf("want host %q, got %q", "example.com", got)
+	}
+
+	strict := newRequestNormalizer(config.RequestNormalizationStrict)
+	req = testutil.NewEnvoyRequest(http.MethodGet, "/a/../b%2f", nil, nil)
+	if got := strict.normalize(req); got != ambiguousEncodedSlash {
+		t.Errorf("want ambiguity %q, got %q", ambiguousEncodedSlash, got)
+	}
+	req = testutil.NewEnvoyRequest(http.MethodGet, "/b", nil, nil)
+	req.Attributes.Request.Http.Host = "xn--invalid-.example"
+	if got := strict.normalize(req); got != ambiguousHost {
+		t.Errorf("want ambiguity %q, got %q", ambiguousHost, got)
+	}
+}
+
+func TestCheckAmbiguousRequest(t *testing.T) {
+	req := testutil.NewEnvoyRequest(http.MethodGet, "/v1/pets%2f..%2fadmin", map[string]string{headerAPI: "api"}, nil)
+
+	server := AuthorizationServer{
+		handler: &Handler{
+			orgName:      "normalize-org",
+			envName:      "env",
+			apiHeader:    headerAPI,
+			analyticsMan: &testAnalyticsMan{},
+			ready:        util.NewAtomicBool(true),
+			normalizer:   newRequestNormalizer(config.RequestNormalizationStrict),
+		},
+	}
+
+	resp, err := server.Check(context.Background(), req)
+	if err != nil {
+		t.Fatalf("should not get error. got: %s", err)
+	}
+	if resp.Status.Code != int32(rpc.INVALID_ARGUMENT) {
+		t.Errorf("want: %d, got: %d", int32(rpc.INVALID_ARGUMENT), resp.Status.Code)
+	}
+	code := resp.GetDeniedResponse().GetStatus().GetCode()
+	if code != typev3.StatusCode_BadRequest {
+		t.Errorf("want: %v, got: %v", typev3.StatusCode_BadRequest, code)
+	}
+	if got := prometheustest.ToFloat64(prometheusAmbiguousRequestDenied.WithLabelValues("normalize-org", "env",
+		ambiguousEncodedSlash)); got != 1 {
+		t.Errorf("want 1 denied, got %v", got)
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	defaultTraceDuration = 5 * time.Minute
+	maxTraceDuration     = time.Hour
+	maxTraceSessions     = 10
+)
+
+// TraceSession logs the check decisions of the requests matching all of its
+// filters until it expires. Empty filters match all requests.
+type TraceSession struct {
+	ID       string    `json:"id"`
+	API      string    `json:"api,omitempty"`
+	Header   string    `json:"header,omitempty"` // name, lower case
+	Value    string    `json:"value,omitempty"`  // of Header, any if empty
+	ClientIP string    `json:"client_ip,omitempty"`
+	Duration string    `json:"duration,omitempty"` // requested, default 5m, at most 1h
+	Expiry   time.Time `json:"expiry"`
+	Traced   int       `json:"traced"` // number of requests logged
+}
+
+// requestTracer holds the TraceSessions created with the trace admin API
+type requestTracer struct {
+	now        func() time.Time
+	active     int32              // number of sessions, checked before locking
+	proxyChain *config.ProxyChain // resolves the client IPs matched
+
+	mu       sync.Mutex
+	sessions map[string]*TraceSession
+	nextID   int
+}
+
+func newRequestTracer(proxyChain *config.ProxyChain) *requestTracer {
+	return &requestTracer{
+		now:        time.Now,
+		proxyChain: proxyChain,
+		sessions:   make(map[string]*TraceSession),
+	}
+}
+
+// add starts the session, assigning its ID and expiry
+func (t *requestTracer) add(s TraceSession) (TraceSession, error) {
+	duration := defaultTraceDuration
+	if s.Duration != "" {
+		d, err := time.ParseDuration(s.Duration)
+		if err != nil || d <= 0 || d > maxTraceDuration {
+			return s, fmt.Errorf("duration must be positive and at most %s", maxTraceDuration)
+		}
+		duration = d
+	}
+	if s.Value != "" && s.Header == "" {
+		return s, fmt.Errorf("value requires header")
+	}
+	s.Header = strings.ToLower(s.Header)
+
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire(now)
+	if len(t.sessions) >= maxTraceSessions {
+		return s, fmt.Errorf("at most %d trace sessions may be active", maxTraceSessions)
+	}
+	t.nextID++
+	s.ID = strconv.Itoa(t.nextID)
+	s.Expiry = now.Add(duration)
+	s.Traced = 0
+	t.sessions[s.ID] = &s
+	atomic.StoreInt32(&t.active, int32(len(t.sessions)))
+	log.Infof("trace %s started until %s: %+v", s.ID, s.Expiry.Format(time.RFC3339), s)
+	return s, nil
+}
+
+// remove ends the session, returns false if it is not active
+func (t *requestTracer) remove(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.sessions[id]
+	delete(t.sessions, id)
+	atomic.StoreInt32(&t.active, int32(len(t.sessions)))
+	return ok
+}
+
+// list returns the active sessions ordered by ID
+func (t *requestTracer) list() []TraceSession {
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire(now)
+	sessions := make([]TraceSession, 0, len(t.sessions))
+	for _, s := range t.sessions {
+		sessions = append(sessions, *s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		a, _ := strconv.Atoi(sessions[i].ID)
+		b, _ := strconv.Atoi(sessions[j].ID)
+		return a < b
+	})
+	return sessions
+}
+
+// expire removes the expired sessions. Lock t.mu before calling.
+func (t *requestTracer) expire(now time.Time) {
+	for id, s := range t.sessions {
+		if now.After(s.Expiry) {
+			delete(t.sessions, id)
+			log.Infof("trace %s expired after %d requests", id, s.Traced)
+		}
+	}
+	atomic.StoreInt32(&t.active, int32(len(t.sessions)))
+}
+
+// match returns a trace of the request if its headers and client IP match a
+// session, nil otherwise. The API filter is applied when the trace finishes.
+func (t *requestTracer) match(req *authv3.CheckRequest) *requestTrace {
+	if t == nil || atomic.LoadInt32(&t.active) == 0 {
+		return nil
+	}
+	headers := req.GetAttributes().GetRequest().GetHttp().GetHeaders()
+	ip := t.proxyChain.ClientIP(req.GetAttributes().GetSource().GetAddress().GetSocketAddress().GetAddress(),
+		headers[config.ForwardedForHeader])
+
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire(now)
+	var sessions []*TraceSession
+	for _, s := range t.sessions {
+		if s.Header != "" {
+			if v, ok := headers[s.Header]; !ok || (s.Value != "" && v != s.Value) {
+				continue
+			}
+		}
+		if s.ClientIP != "" && s.ClientIP != ip {
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	if len(sessions) == 0 {
+		return nil
+	}
+	return &requestTrace{tracer: t, sessions: sessions, start: now}
+}
+
+// requestTrace collects the decisions of a request for the sessions it matches
+type requestTrace struct {
+	tracer   *requestTracer
+	sessions []*TraceSession
+	start    time.Time
+	lines    []string
+}
+
+// tracef records a decision, nil-safe
+func (r *requestTrace) tracef(format string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	elapsed := r.tracer.now().Sub(r.start)
+	r.lines = append(r.lines, fmt.Sprintf("[%s] ", elapsed)+fmt.Sprintf(format, args...))
+}
+
+// finish logs the decisions and response if a session matches the API
+func (r *requestTrace) finish(api string, resp *authv3.CheckResponse) {
+	if r == nil {
+		return
+	}
+	var ids []string
+	r.tracer.mu.Lock()
+	for _, s := range r.sessions {
+		if s.API == "" || s.API == api {
+			s.Traced++
+			ids = append(ids, s.ID)
+		}
+	}
+	r.tracer.mu.Unlock()
+	if len(ids) == 0 {
+		return
+	}
+
+	if code := codes.Code(resp.GetStatus().GetCode()); code == codes.OK {
+		ok := resp.GetOkResponse()
+		r.tracef("allowed: %d headers added, %d headers removed", len(ok.GetHeaders()), len(ok.GetHeadersToRemove()))
+	} else {
+		r.tracef("denied: %s, http status %d", code, resp.GetDeniedResponse().GetStatus().GetCode())
+	}
+	log.Infof("trace %s:\n  %s", strings.Join(ids, ","), strings.Join(r.lines, "\n  "))
+}
+
+// TraceHandlerFunc returns an http.HandlerFunc managing trace sessions:
+// GET lists the active sessions, POST starts the JSON TraceSession of the
+// body, and DELETE with an "id" query parameter ends a session.
+func (h *Handler) TraceHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respond := func(status int, body interface{}) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			if err := json.NewEncoder(w).Encode(body); err != nil {
+				log.Warnf("trace unable to respond: %s", err)
+			}
+		}
+		switch r.Method {
+		case http.MethodGet:
+			respond(http.StatusOK, map[string]interface{}{"sessions": h.tracer.list()})
+		case http.MethodPost:
+			var s TraceSession
+			if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+				respond(http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			s, err := h.tracer.add(s)
+			if err != nil {
+				respond(http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			respond(http.StatusCreated, s)
+		case http.MethodDelete:
+			if !h.tracer.remove(r.URL.Query().Get("id")) {
+				respond(http.StatusNotFound, map[string]string{"error": "no such trace session"})
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
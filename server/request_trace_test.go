@@ -0,0 +1,209 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/testutil"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+)
+
+func TestRequestTracer(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	tracer := newRequestTracer(nil)
+	tracer.now = func() time.Time { return now }
+
+	if r := tracer.match(testutil.NewEnvoyRequest(http.MethodGet, "/", nil, nil)); r != nil {
+		t.Errorf("want no trace without sessions")
+	}
+	var nilTracer *requestTracer
+	if r := nilTracer.match(testutil.NewEnvoyRequest(http.MethodGet, "/", nil, nil)); r != nil {
+		t.Errorf("want no trace of nil tracer")
+	}
+
+	for _, bad := range []TraceSession{
+		{Duration: "2h"},
+		{Duration: "soon"},
+		{Value: "no header"},
+	} {
+		if _, err := tracer.add(bad); err == nil {
+			t.Errorf("want error for %#v", bad)
+		}
+	}
+
+	byHeader, err := tracer.add(TraceSession{Header: "X-Debug", Value: "1", Duration: "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if byHeader.Header != "x-debug" || !byHeader.Expiry.Equal(now.Add(time.Minute)) {
+		t.Errorf("unexpected session: %#v", byHeader)
+	}
+	byIP, err := tracer.add(TraceSession{ClientIP: "192.0.2.1", API: "api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withIP := func(req *authv3.CheckRequest, ip string) *authv3.CheckRequest {
+		req.Attributes.Source = &authv3.AttributeContext_Peer{
+			Address: &corev3.Address{
+				Address: &corev3.Address_SocketAddress{
+					SocketAddress: &corev3.SocketAddress{Address: ip},
+				},
+			},
+		}
+		return req
+	}
+	tests := []struct {
+		desc    string
+		headers map[string]string
+		ip      string
+		want    int
+	}{
+		{"no match", map[string]string{"x-debug": "0"}, "192.0.2.2", 0},
+		{"header", map[string]string{"x-debug": "1"}, "192.0.2.2", 1},
+		{"client ip", nil, "192.0.2.1", 1},
+		{"both", map[string]string{"x-debug": "1"}, "192.0.2.1", 2},
+	}
+	for _, test := range tests {
+		r := tracer.match(withIP(testutil.NewEnvoyRequest(http.MethodGet, "/", test.headers, nil), test.ip))
+		if got := len(r.getSessions()); got != test.want {
+			t.Errorf("%s: want %d sessions, got %d", test.desc, test.want, got)
+		}
+	}
+
+	// the api filter applies when finished
+	r := tracer.match(withIP(testutil.NewEnvoyRequest(http.MethodGet, "/", map[string]string{"x-debug": "1"}, nil), "192.0.2.1"))
+	r.tracef("decision")
+	r.finish("other", &authv3.CheckResponse{})
+	sessions := tracer.list()
+	if len(sessions) != 2 || sessions[0].ID != byHeader.ID || sessions[0].Traced != 1 ||
+		sessions[1].ID != byIP.ID || sessions[1].Traced != 0 {
+		t.Errorf("unexpected sessions: %#v", sessions)
+	}
+
+	if !tracer.remove(byIP.ID) || tracer.remove(byIP.ID) {
+		t.Errorf("want session removed once")
+	}
+	now = now.Add(2 * time.Minute)
+	if sessions := tracer.list(); len(sessions) != 0 {
+		t.Errorf("want expired session removed, got: %#v", sessions)
+	}
+	if r := tracer.match(testutil.NewEnvoyRequest(http.MethodGet, "/", map[string]string{"x-debug": "1"}, nil)); r != nil {
+		t.Errorf("want no trace after expiry")
+	}
+}
+
+// getSessions returns the sessions of a trace, nil-safe
+func (r *requestTrace) getSessions() []*TraceSession {
+	if r == nil {
+		return nil
+	}
+	return r.sessions
+}
+
+func TestTraceHandlerFunc(t *testing.T) {
+	h := &Handler{tracer: newRequestTracer(nil)}
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.TraceHandlerFunc()(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/traces", `{"api": "api", "duration": "10m"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("want status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body)
+	}
+	var created TraceSession
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.ID == "" || created.API != "api" {
+		t.Errorf("unexpected session: %#v", created)
+	}
+
+	for _, body := range []string{`{"duration": "1d"}`, `not json`} {
+		if rec := do(http.MethodPost, "/traces", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: want status %d, got %d", body, http.StatusBadRequest, rec.Code)
+		}
+	}
+
+	rec = do(http.MethodGet, "/traces", "")
+	var list struct {
+		Sessions []TraceSession `json:"sessions"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Sessions) != 1 || list.Sessions[0].ID != created.ID {
+		t.Errorf("unexpected sessions: %#v", list.Sessions)
+	}
+
+	if rec := do(http.MethodDelete, "/traces?id="+created.ID, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("want status %d, got %d", http.StatusNoContent, rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/traces?id="+created.ID, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("want status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	if rec := do(http.MethodPut, "/traces", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("want status %d, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
+
+func TestCheckTrace(t *testing.T) {
+	testAuthMan := &testAuthMan{}
+	server := AuthorizationServer{
+		handler: &Handler{
+			apiHeader:    headerAPI,
+			apiKeyHeader: "x-api-key",
+			authMan:      testAuthMan,
+			productMan:   &testProductMan{},
+			quotaMan:     &testQuotaMan{},
+			analyticsMan: &testAnalyticsMan{},
+			ready:        util.NewAtomicBool(true),
+			tracer:       newRequestTracer(nil),
+		},
+	}
+	session, err := server.handler.tracer.add(TraceSession{Header: "x-debug", API: "api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testAuthMan.sendAuth(nil, auth.ErrNoAuth)
+	for _, headers := range []map[string]string{
+		{headerAPI: "api", "x-debug": "1"},
+		{headerAPI: "api"},
+		{headerAPI: "other", "x-debug": "1"},
+	} {
+		req := testutil.NewEnvoyRequest(http.MethodGet, "/path", headers, nil)
+		if _, err := server.Check(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sessions := server.handler.tracer.list()
+	if len(sessions) != 1 || sessions[0].ID != session.ID || sessions[0].Traced != 1 {
+		t.Errorf("want 1 request traced, got: %#v", sessions)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	// metadata only, present if the matched operation has response outcomes
+	metadataResponseOutcomes = "x-apigee-response-outcomes"
+
+	// the analytics attribute of the classified response outcome
+	responseOutcomeAttribute = "response.outcome"
+)
+
+// encodeResponseOutcomesMetadata flags the metadata of an operation with
+// response outcomes to be classified from the access log
+func encodeResponseOutcomesMetadata(metadata *structpb.Struct, op *config.APIOperation) {
+	if metadata == nil || len(op.ResponseOutcomes) == 0 {
+		return
+	}
+	metadata.Fields[metadataResponseOutcomes] = structpb.NewBoolValue(true)
+}
+
+// responseOutcomeAttributes returns the outcome attribute of the response if
+// the metadata is flagged and the matched operation is still in its spec
+func (h *Handler) responseOutcomeAttributes(fields map[string]*structpb.Value, api, operation string,
+	code int, responseHeaders map[string]string) []analytics.Attribute {
+	if !fields[metadataResponseOutcomes].GetBoolValue() {
+		return nil
+	}
+	spec, ok := h.environmentSpec(fields[metadataEnvironmentSpec].GetStringValue())
+	if !ok {
+		return nil
+	}
+	for i := range spec.APIs {
+		if spec.APIs[i].ID != api {
+			continue
+		}
+		for j := range spec.APIs[i].Operations {
+			if op := &spec.APIs[i].Operations[j]; op.Name == operation {
+				return []analytics.Attribute{{
+					Name:  responseOutcomeAttribute,
+					Value: op.ResponseOutcome(code, responseHeaders),
+				}}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestResponseOutcomeAttributes(t *testing.T) {
+	envSpec := config.EnvironmentSpec{
+		ID: "spec",
+		APIs: []config.APISpec{{
+			ID:       "api",
+			BasePath: "/v1",
+			Operations: []config.APIOperation{
+				{
+					Name:        "classified",
+					HTTPMatches: []config.HTTPMatch{{PathTemplate: "/a"}},
+					ResponseOutcomes: []config.ResponseOutcome{
+						{Codes: []string{"2xx"}, Header: "x-error", Outcome: config.ResponseOutcomeBackendError},
+					},
+				},
+				{Name: "plain", HTTPMatches: []config.HTTPMatch{{PathTemplate: "/b"}}},
+			},
+		}},
+	}
+	specExt, err := config.NewEnvironmentSpecExt(&envSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{envSpecsByID: map[string]*config.EnvironmentSpecExt{"spec": specExt}}
+
+	metadata := &structpb.Struct{Fields: map[string]*structpb.Value{}}
+	encodeResponseOutcomesMetadata(metadata, &envSpec.APIs[0].Operations[1])
+	if len(metadata.Fields) != 0 {
+		t.Errorf("want no flag without response outcomes, got %v", metadata.Fields)
+	}
+	if attrs := h.responseOutcomeAttributes(metadata.Fields, "api", "plain", 500, nil); attrs != nil {
+		t.Errorf("want no attributes unflagged, got %v", attrs)
+	}
+
+	encodeResponseOutcomesMetadata(metadata, &envSpec.APIs[0].Operations[0])
+	metadata.Fields[metadataEnvironmentSpec] = stringValueFrom("spec")
+	attrs := h.responseOutcomeAttributes(metadata.Fields, "api", "classified", 200, map[string]string{"x-error": "1"})
+	if len(attrs) != 1 || attrs[0].Name != responseOutcomeAttribute || attrs[0].Value != config.ResponseOutcomeBackendError {
+		t.Errorf("want backend_error outcome, got %v", attrs)
+	}
+	attrs = h.responseOutcomeAttributes(metadata.Fields, "api", "classified", 200, nil)
+	if len(attrs) != 1 || attrs[0].Value != config.ResponseOutcomeSuccess {
+		t.Errorf("want success outcome, got %v", attrs)
+	}
+	if attrs := h.responseOutcomeAttributes(metadata.Fields, "api", "removed", 200, nil); attrs != nil {
+		t.Errorf("want no attributes of a missing operation, got %v", attrs)
+	}
+}
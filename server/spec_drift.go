@@ -0,0 +1,338 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Kinds of SpecDrift.
+const (
+	// a spec operation path no product operation of the API covers
+	SpecDriftOperationNotInProducts = "operation_not_in_products"
+	// a spec operation path covered by product operations without its method
+	SpecDriftMethodNotInProducts = "method_not_in_products"
+	// a product operation resource no spec operation of the API matches
+	SpecDriftOperationNotInSpec = "operation_not_in_spec"
+)
+
+// SpecDrift is a difference between the operations of an environment spec
+// API and the operations configured for the API in the API products.
+type SpecDrift struct {
+	Spec      string `json:"spec"`
+	API       string `json:"api"`
+	Kind      string `json:"kind"`
+	Operation string `json:"operation,omitempty"` // of the spec
+	Product   string `json:"product,omitempty"`
+	Method    string `json:"method,omitempty"` // empty for any method
+	Path      string `json:"path"`
+}
+
+// specDriftMonitor periodically compares the operations of the environment
+// specs with those of the API products bound to the environment.
+type specDriftMonitor struct {
+	handler  *Handler
+	interval time.Duration
+	done     chan struct{}
+
+	mu      sync.Mutex
+	checked time.Time
+	drift   []SpecDrift
+}
+
+// newSpecDriftMonitor returns nil if interval is not positive
+func newSpecDriftMonitor(h *Handler, interval time.Duration) *specDriftMonitor {
+	if interval <= 0 {
+		return nil
+	}
+	return &specDriftMonitor{
+		handler:  h,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+}
+
+// start checks after each interval, the products aren't loaded at startup
+func (m *specDriftMonitor) start() {
+	go func() {
+		t := time.NewTicker(m.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				m.check()
+			case <-m.done:
+				return
+			}
+		}
+	}()
+}
+
+func (m *specDriftMonitor) stop() {
+	if m != nil {
+		close(m.done)
+	}
+}
+
+// check compares the current specs and products and records the drift
+func (m *specDriftMonitor) check() {
+	h := m.handler
+	h.envSpecsMu.RLock()
+	specs := make([]*config.EnvironmentSpec, 0, len(h.envSpecsByID))
+	for _, spec := range h.envSpecsByID {
+		specs = append(specs, spec.EnvironmentSpec)
+	}
+	h.envSpecsMu.RUnlock()
+	sort.Slice(specs, func(i, j int) bool { return specs[i].ID < specs[j].ID })
+
+	env := h.envName
+	if h.isMultitenant {
+		env = ""
+	}
+	drift := detectSpecDrift(specs, h.productMan.Products(), env)
+
+	type labels struct{ spec, api, kind string }
+	counts := make(map[labels]int)
+	for _, d := range drift {
+		counts[labels{d.Spec, d.API, d.Kind}]++
+	}
+	prometheusSpecDrift.Reset()
+	for l, n := range counts {
+		prometheusSpecDrift.WithLabelValues(h.orgName, l.spec, l.api, l.kind).Set(float64(n))
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(drift) != len(m.drift) {
+		log.Warnf("%d differences between environment spec and API product operations", len(drift))
+	}
+	m.checked = time.Now()
+	m.drift = drift
+}
+
+// report returns the time and drift of the last check
+func (m *specDriftMonitor) report() (time.Time, []SpecDrift) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.checked, m.drift
+}
+
+// SpecDriftHandlerFunc returns an http.HandlerFunc responding with the JSON
+// drift found by the last comparison of the environment specs with the API
+// products, no drift if the comparison isn't enabled or hasn't run.
+func (h *Handler) SpecDriftHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]interface{}{"drift": []SpecDrift{}}
+		if h.specDrift != nil {
+			checked, drift := h.specDrift.report()
+			if !checked.IsZero() {
+				body["checked"] = checked.UTC().Format(time.RFC3339)
+			}
+			if drift != nil {
+				body["drift"] = drift
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			log.Warnf("spec drift unable to respond: %s", err)
+		}
+	}
+}
+
+// productOperation is an operation of an API product for an API
+type productOperation struct {
+	product  string
+	resource string
+	segments []string
+	methods  []string // empty for any method
+}
+
+// detectSpecDrift returns the differences between the operations of the APIs
+// of specs and those of products available in env, any env if empty. APIs
+// no product operation configures are not compared.
+func detectSpecDrift(specs []*config.EnvironmentSpec, products product.ProductsNameMap, env string) []SpecDrift {
+	names := make([]string, 0, len(products))
+	for name := range products {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var drift []SpecDrift
+	for _, spec := range specs {
+		for _, api := range spec.APIs {
+			var productOps []productOperation
+			for _, name := range names {
+				p := products[name]
+				if p.OperationGroup == nil || (env != "" && !p.EnvironmentMap[env]) {
+					continue
+				}
+				for _, oc := range p.OperationGroup.OperationConfigs {
+					if oc.APISource != api.ID {
+						continue
+					}
+					for _, op := range oc.Operations {
+						productOps = append(productOps, productOperation{
+							product:  name,
+							resource: op.Resource,
+							segments: driftPathSegments(op.Resource),
+							methods:  op.Methods,
+						})
+					}
+				}
+			}
+			if len(productOps) == 0 {
+				continue
+			}
+
+			catchAll := false
+			var specPaths [][]string
+			for _, op := range api.Operations {
+				if len(op.HTTPMatches) == 0 {
+					catchAll = true
+					continue
+				}
+				for _, match := range op.HTTPMatches {
+					segments := driftPathSegments(match.PathTemplate)
+					specPaths = append(specPaths, segments)
+					if driftPathCovered(productOps, segments, match.Method) {
+						continue
+					}
+					kind := SpecDriftOperationNotInProducts
+					if driftPathCovered(productOps, segments, "*") {
+						kind = SpecDriftMethodNotInProducts
+					}
+					drift = append(drift, SpecDrift{
+						Spec:      spec.ID,
+						API:       api.ID,
+						Kind:      kind,
+						Operation: op.Name,
+						Method:    match.Method,
+						Path:      match.PathTemplate,
+					})
+				}
+			}
+			if catchAll {
+				continue
+			}
+
+			for _, pop := range productOps {
+				matched := false
+				for _, segments := range specPaths {
+					if driftPathCovers(segments, pop.segments) {
+						matched = true
+						break
+					}
+				}
+				if !matched {
+					drift = append(drift, SpecDrift{
+						Spec:    spec.ID,
+						API:     api.ID,
+						Kind:    SpecDriftOperationNotInSpec,
+						Product: pop.product,
+						Method:  strings.Join(pop.methods, ","),
+						Path:    pop.resource,
+					})
+				}
+			}
+		}
+	}
+	return drift
+}
+
+// allows returns true if the operation allows the method, "" for all methods
+// and "*" for some method
+func (o productOperation) allows(method string) bool {
+	if len(o.methods) == 0 || method == "*" {
+		return true
+	}
+	if method == "" {
+		return false
+	}
+	for _, m := range o.methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// driftPathCovered returns true if a product operation covers the path and
+// allows the method
+func driftPathCovered(productOps []productOperation, segments []string, method string) bool {
+	for _, pop := range productOps {
+		if driftPathCovers(pop.segments, segments) && pop.allows(method) {
+			return true
+		}
+	}
+	return false
+}
+
+// driftPathSegments splits a spec path template or product resource into
+// segments, path variables as the wildcards they bind
+func driftPathSegments(path string) []string {
+	if path == "/" { // a product resource of all paths
+		path = "/**"
+	}
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, s := range segments {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			segments[i] = "*"
+			if strings.HasSuffix(s, "=**}") {
+				segments[i] = "**"
+			}
+		}
+	}
+	return segments
+}
+
+// driftPathCovers returns true if every path matched by segments is matched
+// by pattern, a "*" segment matching any one segment and "**" the rest
+func driftPathCovers(pattern, segments []string) bool {
+	for i, p := range pattern {
+		if p == "**" {
+			return true
+		}
+		if i >= len(segments) {
+			return false
+		}
+		switch s := segments[i]; {
+		case s == "**":
+			return false
+		case p == "*" || p == s:
+		default:
+			return false
+		}
+	}
+	return len(pattern) == len(segments)
+}
+
+var (
+	prometheusSpecDrift = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "config",
+		Name:      "spec_drift_count",
+		Help:      "Number of differences between environment spec and API product operations by kind",
+	}, []string{"org", "spec", "api", "kind"})
+)
@@ -0,0 +1,188 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	prometheustest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDetectSpecDrift(t *testing.T) {
+	spec := &config.EnvironmentSpec{
+		ID: "spec",
+		APIs: []config.APISpec{
+			{
+				ID:       "pets",
+				BasePath: "/v1",
+				Operations: []config.APIOperation{
+					{Name: "list", HTTPMatches: []config.HTTPMatch{{PathTemplate: "/pets", Method: "GET"}}},
+					{Name: "get", HTTPMatches: []config.HTTPMatch{{PathTemplate: "/pets/{id}", Method: "GET"}}},
+					{Name: "delete", HTTPMatches: []config.HTTPMatch{{PathTemplate: "/pets/{id}", Method: "DELETE"}}},
+					{Name: "photos", HTTPMatches: []config.HTTPMatch{{PathTemplate: "/photos/{path=**}"}}},
+				},
+			},
+			{
+				ID:         "all",
+				BasePath:   "/all",
+				Operations: []config.APIOperation{{Name: "any"}},
+			},
+			{
+				ID:         "unbound",
+				BasePath:   "/unbound",
+				Operations: []config.APIOperation{{Name: "op", HTTPMatches: []config.HTTPMatch{{PathTemplate: "/op"}}}},
+			},
+		},
+	}
+	operations := func(apiSource string, ops ...product.Operation) *product.OperationGroup {
+		return &product.OperationGroup{OperationConfigs: []product.OperationConfig{{APISource: apiSource, Operations: ops}}}
+	}
+	products := product.ProductsNameMap{
+		"p1": {
+			Name:           "p1",
+			EnvironmentMap: map[string]bool{"env": true},
+			OperationGroup: operations("pets",
+				product.Operation{Resource: "/pets", Methods: []string{"GET", "POST"}},
+				product.Operation{Resource: "/pets/*", Methods: []string{"GET"}},
+				product.Operation{Resource: "/stores"},
+			),
+		},
+		"p2": {
+			Name:           "p2",
+			EnvironmentMap: map[string]bool{"env": true},
+			OperationGroup: operations("all", product.Operation{Resource: "/"}),
+		},
+		"other-env": {
+			Name:           "other-env",
+			EnvironmentMap: map[string]bool{"other": true},
+			OperationGroup: operations("unbound", product.Operation{Resource: "/"}),
+		},
+	}
+
+	got := detectSpecDrift([]*config.EnvironmentSpec{spec}, products, "env")
+	want := []SpecDrift{
+		{Spec: "spec", API: "pets", Kind: SpecDriftMethodNotInProducts, Operation: "delete", Method: "DELETE", Path: "/pets/{id}"},
+		{Spec: "spec", API: "pets", Kind: SpecDriftOperationNotInProducts, Operation: "photos", Path: "/photos/{path=**}"},
+		{Spec: "spec", API: "pets", Kind: SpecDriftOperationNotInSpec, Product: "p1", Path: "/stores"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %#v, got %#v", want, got)
+	}
+
+	got = detectSpecDrift([]*config.EnvironmentSpec{spec}, products, "")
+	want = append(want, SpecDrift{Spec: "spec", API: "unbound", Kind: SpecDriftOperationNotInSpec, Product: "other-env", Path: "/"})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("any env: want %#v, got %#v", want, got)
+	}
+}
+
+func TestDriftPathCovers(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/pets", "/pets", true},
+		{"/pets/*", "/pets/{id}", true},
+		{"/pets/*", "/pets/{id=**}", false},
+		{"/pets/**", "/pets/{id}/photos", true},
+		{"/", "/anything/at/all", true},
+		{"/pets/{id}", "/pets/*", true},
+		{"/pets/{id}", "/pets", false},
+		{"/pets", "/pets/*", false},
+		{"/stores", "/pets", false},
+	}
+	for _, test := range tests {
+		if got := driftPathCovers(driftPathSegments(test.pattern), driftPathSegments(test.path)); got != test.want {
+			t.Errorf("%s covers %s: want %t, got %t", test.pattern, test.path, test.want, got)
+		}
+	}
+}
+
+func TestSpecDriftMonitor(t *testing.T) {
+	if newSpecDriftMonitor(nil, 0) != nil {
+		t.Errorf("monitor should be disabled")
+	}
+	var nilMonitor *specDriftMonitor
+	nilMonitor.stop()
+
+	specExt, err := config.NewEnvironmentSpecExt(&config.EnvironmentSpec{
+		ID: "drift-spec",
+		APIs: []config.APISpec{{
+			ID:         "api",
+			BasePath:   "/v1",
+			Operations: []config.APIOperation{{Name: "op", HTTPMatches: []config.HTTPMatch{{PathTemplate: "/op"}}}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{
+		orgName:      "drift-org",
+		envName:      "env",
+		envSpecsByID: map[string]*config.EnvironmentSpecExt{"drift-spec": specExt},
+		productMan: &testProductMan{products: map[string]*product.APIProduct{
+			"p": {
+				Name:           "p",
+				EnvironmentMap: map[string]bool{"env": true},
+				OperationGroup: &product.OperationGroup{OperationConfigs: []product.OperationConfig{{
+					APISource:  "api",
+					Operations: []product.Operation{{Resource: "/other"}},
+				}}},
+			},
+		}},
+	}
+
+	resp := httptest.NewRecorder()
+	h.SpecDriftHandlerFunc()(resp, httptest.NewRequest("GET", "/specs/drift", nil))
+	if got := resp.Body.String(); got != "{\"drift\":[]}\n" {
+		t.Errorf("disabled: got %s", got)
+	}
+
+	h.specDrift = newSpecDriftMonitor(h, time.Minute)
+	defer h.specDrift.stop()
+	h.specDrift.start()
+	h.specDrift.check()
+
+	if got := prometheustest.ToFloat64(prometheusSpecDrift.WithLabelValues("drift-org", "drift-spec", "api",
+		SpecDriftOperationNotInProducts)); got != 1 {
+		t.Errorf("want 1 missing operation, got %v", got)
+	}
+	if got := prometheustest.ToFloat64(prometheusSpecDrift.WithLabelValues("drift-org", "drift-spec", "api",
+		SpecDriftOperationNotInSpec)); got != 1 {
+		t.Errorf("want 1 missing spec operation, got %v", got)
+	}
+
+	resp = httptest.NewRecorder()
+	h.SpecDriftHandlerFunc()(resp, httptest.NewRequest("GET", "/specs/drift", nil))
+	var body struct {
+		Checked string      `json:"checked"`
+		Drift   []SpecDrift `json:"drift"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Checked == "" {
+		t.Errorf("want checked time")
+	}
+	if len(body.Drift) != 2 {
+		t.Errorf("want 2 drift, got %v", body.Drift)
+	}
+}
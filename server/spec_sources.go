@@ -0,0 +1,274 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	specSourceResultApplied   = "applied"
+	specSourceResultUnchanged = "unchanged"
+	specSourceResultFailed    = "failed"
+	specSourceResultRejected  = "rejected"
+)
+
+// environmentSpecSetup configures EnvironmentSpecExts with the handler's
+// settings and verifiers. JWKS sources are registered with the verifiers at
+// startup, specs applied later may only use those registered.
+type environmentSpecSetup struct {
+	auth          config.Auth
+	kvms          *kvmManager
+	ipReputation  *ipReputationList
+	proxyChain    *config.ProxyChain
+	oidcDiscovery *oidcDiscoveryManager
+	remoteJWKS    *remoteJWKSManager
+	revocations   *revocationList
+	jwtLimiter    *jwtLimiter
+	jwksURLs      map[string]bool // RemoteJWKS verified by the auth.Manager
+	envVars       []string        // environment variables of {env.VAR} templates
+}
+
+// configure applies the settings and verifiers to envSpec
+func (s *environmentSpecSetup) configure(envSpec *config.EnvironmentSpecExt) {
+	envSpec.SetJWTParallelism(s.auth.JWTParallelism)
+	envSpec.SetVerificationTimeouts(s.auth.VerificationTimeout, s.auth.MaxVerificationTimeout)
+	envSpec.SetTokenSchemes(s.auth.TokenSchemes)
+	if s.kvms != nil {
+		envSpec.SetKVMLookup(s.kvms)
+	}
+	if s.ipReputation != nil {
+		envSpec.SetIPReputation(s.ipReputation)
+	}
+	if s.proxyChain != nil {
+		envSpec.SetProxyChain(s.proxyChain)
+	}
+	if s.oidcDiscovery != nil {
+		envSpec.SetOIDCVerifier(s.oidcDiscovery)
+	}
+	if s.remoteJWKS != nil {
+		envSpec.SetJWKSVerifier(s.remoteJWKS)
+	}
+	if s.revocations != nil {
+		envSpec.SetRevocationList(s.revocations)
+	}
+	if s.jwtLimiter != nil {
+		envSpec.SetJWTLimiter(s.jwtLimiter)
+	}
+}
+
+// checkJWKSSources fails if envSpec uses a JWKS source not registered at startup
+func (s *environmentSpecSetup) checkJWKSSources(envSpec *config.EnvironmentSpecExt) error {
+	for _, jwtAuth := range envSpec.JWTAuthentications() {
+		switch source := jwtAuth.JWKSSource.(type) {
+		case config.RemoteJWKS:
+			if source.TLS != nil {
+				if s.remoteJWKS.empty() || s.remoteJWKS.sources[source.URL] == nil {
+					return fmt.Errorf("remote_jwks %s with tls is not configured, restart to add it", source.URL)
+				}
+			} else if !s.jwksURLs[source.URL] {
+				return fmt.Errorf("remote_jwks %s is not configured, restart to add it", source.URL)
+			}
+		case config.OIDCDiscovery:
+			if s.oidcDiscovery.empty() || s.oidcDiscovery.providers[source.ConfigurationURL()] == nil {
+				return fmt.Errorf("oidc_discovery %s is not configured, restart to add it", source.URL)
+			}
+		}
+	}
+	return nil
+}
+
+// environmentSpec returns the EnvironmentSpecExt of id
+func (h *Handler) environmentSpec(id string) (*config.EnvironmentSpecExt, bool) {
+	h.envSpecsMu.RLock()
+	defer h.envSpecsMu.RUnlock()
+	spec, ok := h.envSpecsByID[id]
+	return spec, ok
+}
+
+// replaceEnvironmentSpecs swaps the specs of ids for specs, which must be
+// validated. Nothing is replaced on error.
+func (h *Handler) replaceEnvironmentSpecs(ids []string, specs []config.EnvironmentSpec) error {
+	added := make(map[string]*config.EnvironmentSpecExt, len(specs))
+	for i := range specs {
+		spec := specs[i]
+		envSpec, err := config.NewEnvironmentSpecExt(&spec, config.WithEnvironmentVariables(h.specSetup.envVars))
+		if err != nil {
+			return err
+		}
+		if err := h.specSetup.checkJWKSSources(envSpec); err != nil {
+			return fmt.Errorf("environment spec %q: %v", spec.ID, err)
+		}
+		h.specSetup.configure(envSpec)
+		added[spec.ID] = envSpec
+	}
+
+	h.envSpecsMu.Lock()
+	defer h.envSpecsMu.Unlock()
+	replaced := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		replaced[id] = true
+	}
+	specsByID := make(map[string]*config.EnvironmentSpecExt, len(h.envSpecsByID)+len(added))
+	for id, envSpec := range h.envSpecsByID {
+		if !replaced[id] {
+			specsByID[id] = envSpec
+		}
+	}
+	for id, envSpec := range added {
+		if _, ok := specsByID[id]; ok {
+			return fmt.Errorf("environment spec IDs must be unique, got multiple %s", id)
+		}
+		specsByID[id] = envSpec
+	}
+	h.envSpecsByID = specsByID
+	return nil
+}
+
+// specSourcePoller polls the environment_specs.remote sources, replacing
+// the specs of a source in the handler when its content changes. Content
+// that fails to fetch, verify or validate keeps the previous specs.
+type specSourcePoller struct {
+	handler *Handler
+	cfg     *config.Config
+	sources []*polledSpecSource
+	done    chan struct{}
+}
+
+// polledSpecSource is a source and the IDs of its applied specs
+type polledSpecSource struct {
+	fetcher *config.SpecSourceFetcher
+	specs   []config.EnvironmentSpec
+}
+
+// newSpecSourcePoller creates a specSourcePoller of the remote specs loaded
+// by cfg. Returns nil if there are none.
+func newSpecSourcePoller(h *Handler, cfg *config.Config) *specSourcePoller {
+	remote := cfg.EnvironmentSpecs.RemoteSpecs()
+	if len(remote) == 0 {
+		return nil
+	}
+	p := &specSourcePoller{
+		handler: h,
+		cfg:     cfg,
+		done:    make(chan struct{}),
+	}
+	for _, r := range remote {
+		p.sources = append(p.sources, &polledSpecSource{fetcher: r.Fetcher, specs: r.Specs})
+	}
+	return p
+}
+
+func (p *specSourcePoller) start() {
+	for _, s := range p.sources {
+		go func(s *polledSpecSource) {
+			source := s.fetcher.Source()
+			t := time.NewTicker(source.Interval())
+			defer t.Stop()
+			for {
+				select {
+				case <-t.C:
+					p.refresh(s)
+				case <-p.done:
+					return
+				}
+			}
+		}(s)
+	}
+}
+
+func (p *specSourcePoller) stop() {
+	if p != nil {
+		close(p.done)
+	}
+}
+
+// refresh fetches s and applies its changed specs
+func (p *specSourcePoller) refresh(s *polledSpecSource) {
+	source := s.fetcher.Source()
+	name := source.String()
+	data, changed, err := s.fetcher.Fetch()
+	var signatureErr *config.SpecSignatureError
+	if errors.As(err, &signatureErr) {
+		log.Errorf("refused environment specs from %s: %v", name, err)
+		recordSpecSignature(p.handler.orgName, signatureErr.Result)
+		config.EmitLoadEvent(config.NewLoadEvent(name, nil, nil, err), p.cfg.Global.ConfigEventWebhook)
+		prometheusSpecSourceRefreshes.WithLabelValues(p.handler.orgName, specSourceResultRejected).Inc()
+		return
+	}
+	if err != nil {
+		log.Warnf("unable to refresh environment specs from %s: %v", name, err)
+		prometheusSpecSourceRefreshes.WithLabelValues(p.handler.orgName, specSourceResultFailed).Inc()
+		return
+	}
+	if !changed {
+		prometheusSpecSourceRefreshes.WithLabelValues(p.handler.orgName, specSourceResultUnchanged).Inc()
+		return
+	}
+	recordSpecSignature(p.handler.orgName, config.SpecSignatureVerified)
+
+	specs, err := p.apply(s, name, data)
+	previous := &config.Config{EnvironmentSpecs: config.EnvironmentSpecs{Inline: s.specs}}
+	current := &config.Config{EnvironmentSpecs: config.EnvironmentSpecs{Inline: specs}}
+	config.EmitLoadEvent(config.NewLoadEvent(name, previous, current, err), p.cfg.Global.ConfigEventWebhook)
+	if err != nil {
+		prometheusSpecSourceRefreshes.WithLabelValues(p.handler.orgName, specSourceResultRejected).Inc()
+		return
+	}
+	s.specs = specs
+	prometheusSpecSourceRefreshes.WithLabelValues(p.handler.orgName, specSourceResultApplied).Inc()
+}
+
+// apply decodes and validates data, replacing the previous specs of s
+func (p *specSourcePoller) apply(s *polledSpecSource, name string, data []byte) ([]config.EnvironmentSpec, error) {
+	specs, err := p.cfg.DecodeEnvironmentSpecs(name, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.ValidateEnvironmentSpecs(specs); err != nil {
+		return specs, err
+	}
+	ids := make([]string, len(s.specs))
+	for i, spec := range s.specs {
+		ids[i] = spec.ID
+	}
+	return specs, p.handler.replaceEnvironmentSpecs(ids, specs)
+}
+
+// recordSpecSignature counts a signature verification result
+func recordSpecSignature(org, result string) {
+	prometheusSpecSignatures.WithLabelValues(org, result).Inc()
+}
+
+var (
+	prometheusSpecSignatures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "config",
+		Name:      "spec_signature_count",
+		Help:      "Total number of environment spec signature verifications by result",
+	}, []string{"org", "result"})
+
+	prometheusSpecSourceRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "config",
+		Name:      "spec_source_refresh_count",
+		Help:      "Total number of remote environment spec source refreshes by result",
+	}, []string{"org", "result"})
+)
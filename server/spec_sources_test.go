@@ -0,0 +1,161 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/google/go-cmp/cmp"
+	prometheustest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSpecSourcePollerRefresh(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var content, signature string
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := 0
+	serve := func(c string, signer *ecdsa.PrivateKey) {
+		version++
+		c = fmt.Sprintf("# version: %d\n%s", version, c)
+		digest := sha256.Sum256([]byte(c))
+		sig, _ := ecdsa.SignASN1(rand.Reader, signer, digest[:])
+		mu.Lock()
+		defer mu.Unlock()
+		content = c
+		signature = base64.StdEncoding.EncodeToString(sig)
+	}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/specs.yaml.sig" {
+			_, _ = w.Write([]byte(signature))
+			return
+		}
+		_, _ = w.Write([]byte(content))
+	}))
+	defer srv.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fetcher, err := config.NewSpecSourceFetcher(config.RemoteSpecSource{URL: srv.URL + "/specs.yaml", PublicKeyFile: keyFile, CAFile: caFile}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	localSpec, err := config.NewEnvironmentSpecExt(&config.EnvironmentSpec{ID: "local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{
+		orgName:      "org",
+		envSpecsByID: map[string]*config.EnvironmentSpecExt{"local": localSpec},
+		specSetup: &environmentSpecSetup{
+			jwksURLs: map[string]bool{"https://issuer/jwks": true},
+		},
+	}
+	s := &polledSpecSource{fetcher: fetcher}
+	p := &specSourcePoller{
+		handler: h,
+		cfg:     config.Default(),
+		sources: []*polledSpecSource{s},
+	}
+	specIDs := func() []string {
+		var ids []string
+		for id := range h.envSpecsByID {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	jwtSpec := func(id, jwks string) string {
+		return `
+id: ` + id + `
+apis:
+- id: api
+  base_path: /v1
+  authentication:
+    jwt:
+      name: jwt
+      issuer: issuer
+      in:
+      - header: authorization
+      remote_jwks:
+        url: ` + jwks + `
+`
+	}
+
+	tests := []struct {
+		desc    string
+		content string
+		signer  *ecdsa.PrivateKey
+		want    []string
+	}{
+		{"applied", "id: remote-1\n---\nid: remote-2\n", key, []string{"local", "remote-1", "remote-2"}},
+		{"invalid signature kept previous", "id: remote-6\n", otherKey, []string{"local", "remote-1", "remote-2"}},
+		{"replaced", jwtSpec("remote-3", "https://issuer/jwks"), key, []string{"local", "remote-3"}},
+		{"unknown jwks kept previous", jwtSpec("remote-4", "https://other/jwks"), key, []string{"local", "remote-3"}},
+		{"duplicate kept previous", "id: local\n", key, []string{"local", "remote-3"}},
+		{"invalid kept previous", "id: remote-5\napis:\n- id: ''\n", key, []string{"local", "remote-3"}},
+		{"removed", "", key, []string{"local"}},
+	}
+	invalid := prometheustest.ToFloat64(prometheusSpecSignatures.WithLabelValues("org", config.SpecSignatureInvalid))
+	for _, test := range tests {
+		serve(test.content, test.signer)
+		p.refresh(s)
+		if diff := cmp.Diff(test.want, specIDs()); diff != "" {
+			t.Errorf("%s: spec IDs diff (-want +got):\n%s", test.desc, diff)
+		}
+	}
+
+	if _, ok := h.environmentSpec("local"); !ok {
+		t.Errorf("want local spec")
+	}
+	if got := prometheustest.ToFloat64(prometheusSpecSignatures.WithLabelValues("org", config.SpecSignatureInvalid)) - invalid; got != 1 {
+		t.Errorf("want 1 invalid signature, got %v", got)
+	}
+}
@@ -0,0 +1,325 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth/jwt"
+	"github.com/apigee/apigee-remote-service-golib/v2/context"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// Reasons of denied SpecTestResults.
+const (
+	SpecTestNotFound        = "not_found"
+	SpecTestUnauthenticated = "unauthenticated"
+	SpecTestCORSPreflight   = "cors_preflight"
+)
+
+// SpecTests is a file of test cases of an environment spec.
+type SpecTests struct {
+	Tests []SpecTest `yaml:"tests"`
+}
+
+// SpecTest is a request and the expected result of an environment spec.
+type SpecTest struct {
+	Name    string          `yaml:"name"`
+	Request SpecTestRequest `yaml:"request"`
+	Expect  SpecTestExpect  `yaml:"expect"`
+}
+
+// SpecTestRequest is the request of a SpecTest. JWTs in its headers are
+// decoded without verifying their signatures.
+type SpecTestRequest struct {
+	Method  string            `yaml:"method"`
+	Path    string            `yaml:"path"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+}
+
+// SpecTestExpect is the expected result of a SpecTest, only set fields are
+// compared.
+type SpecTestExpect struct {
+	Allow     *bool  `yaml:"allow,omitempty"`
+	Reason    string `yaml:"reason,omitempty"` // of a denial
+	API       string `yaml:"api,omitempty"`
+	Operation string `yaml:"operation,omitempty"`
+	APIKey    string `yaml:"api_key,omitempty"`
+	// Path is the :path sent upstream.
+	Path string `yaml:"path,omitempty"`
+	// Headers are the request headers set upstream, an empty value expects
+	// the header not to be set.
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// RemovedHeaders are the request headers removed upstream.
+	RemovedHeaders []string `yaml:"removed_headers,omitempty"`
+}
+
+// SpecTestResult is the result of a SpecTest request.
+type SpecTestResult struct {
+	Allowed        bool
+	Reason         string
+	API            string
+	Operation      string
+	APIKey         string
+	Path           string
+	Headers        map[string]string
+	RemovedHeaders []string
+}
+
+// SpecTestFailure is a SpecTest whose result isn't as expected.
+type SpecTestFailure struct {
+	Test     string
+	Mismatch []string
+}
+
+func (f SpecTestFailure) String() string {
+	return fmt.Sprintf("%s: %s", f.Test, strings.Join(f.Mismatch, "; "))
+}
+
+// ReadSpecTests reads a SpecTests file, rejecting unknown fields.
+func ReadSpecTests(f string) (SpecTests, error) {
+	tests := SpecTests{}
+	data, err := os.ReadFile(f)
+	if err != nil {
+		return tests, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err = decoder.Decode(&tests)
+	return tests, err
+}
+
+// RunSpecTests runs the tests against spec with the matching, authentication
+// and transform code of checks, returning the failures. JWT signatures are
+// not verified and bot rules, DPoP, replay protection, and consumer
+// authorization are not evaluated as they depend on the remote service or
+// runtime state.
+func RunSpecTests(spec config.EnvironmentSpec, tests []SpecTest) ([]SpecTestFailure, error) {
+	if err := config.ValidateEnvironmentSpecs([]config.EnvironmentSpec{spec}); err != nil {
+		return nil, err
+	}
+	specExt, err := config.NewEnvironmentSpecExt(&spec)
+	if err != nil {
+		return nil, err
+	}
+	specExt.SetOIDCVerifier(unverifiedOIDCVerifier{})
+	specExt.SetJWKSVerifier(unverifiedJWKSVerifier{})
+
+	var failures []SpecTestFailure
+	for i, test := range tests {
+		name := test.Name
+		if name == "" {
+			name = fmt.Sprintf("test %d", i+1)
+		}
+		result := runSpecTest(specExt, test.Request)
+		if mismatch := test.Expect.compare(result); len(mismatch) > 0 {
+			failures = append(failures, SpecTestFailure{Test: name, Mismatch: mismatch})
+		}
+	}
+	return failures, nil
+}
+
+// runSpecTest checks the request as the spec_match, authentication and
+// transforms stages
+func runSpecTest(specExt *config.EnvironmentSpecExt, r SpecTestRequest) SpecTestResult {
+	headers := make(map[string]string, len(r.Headers))
+	for k, v := range r.Headers {
+		headers[strings.ToLower(k)] = v
+	}
+	method := r.Method
+	if method == "" {
+		method = "GET"
+	}
+	path, _ := normalizeRequestPath(r.Path) // as by the default request_normalization
+	req := &authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{
+			Request: &authv3.AttributeContext_Request{
+				Http: &authv3.AttributeContext_HttpRequest{
+					Method:  method,
+					Path:    path,
+					Headers: headers,
+				},
+			},
+		},
+	}
+	envRequest := config.NewEnvironmentSpecRequest(unverifiedAuthManager{}, specExt, req)
+
+	result := SpecTestResult{Reason: SpecTestNotFound}
+	apiSpec := envRequest.GetAPISpec()
+	if apiSpec == nil {
+		return result
+	}
+	result.API = apiSpec.ID
+	if envRequest.IsCORSPreflight() {
+		result.Reason = SpecTestCORSPreflight
+		return result
+	}
+	operation := envRequest.GetOperation()
+	if operation == nil {
+		return result
+	}
+	result.Operation = operation.Name
+	if !envRequest.IsAuthenticated() {
+		result.Reason = SpecTestUnauthenticated
+		return result
+	}
+	result.Allowed, result.Reason = true, ""
+	if envRequest.IsAuthorizationRequired() {
+		result.APIKey = envRequest.GetAPIKey()
+	}
+
+	okResponse := &authv3.OkHttpResponse{}
+	addRequestHeaderTransforms(envRequest, okResponse)
+	result.Headers = make(map[string]string)
+	for _, h := range okResponse.Headers {
+		key, value := strings.ToLower(h.Header.Key), h.Header.Value
+		if key == envoyPathHeader {
+			result.Path = value
+			continue
+		}
+		if prev, ok := result.Headers[key]; ok && h.Append.GetValue() {
+			value = prev + "," + value
+		}
+		result.Headers[key] = value
+	}
+	result.RemovedHeaders = okResponse.HeadersToRemove
+	sort.Strings(result.RemovedHeaders)
+	return result
+}
+
+// compare returns the differences of the result from the expectations
+func (e SpecTestExpect) compare(r SpecTestResult) (mismatch []string) {
+	differs := func(name, want, got string) {
+		if want != "" && want != got {
+			mismatch = append(mismatch, fmt.Sprintf("want %s %q, got %q", name, want, got))
+		}
+	}
+	if e.Allow != nil && *e.Allow != r.Allowed {
+		decision := "allowed"
+		if !r.Allowed {
+			decision = "denied " + r.Reason
+		}
+		mismatch = append(mismatch, fmt.Sprintf("want allow %t, got %s", *e.Allow, decision))
+	}
+	differs("reason", e.Reason, r.Reason)
+	differs("api", e.API, r.API)
+	differs("operation", e.Operation, r.Operation)
+	differs("api_key", e.APIKey, r.APIKey)
+	differs("path", e.Path, r.Path)
+
+	names := make([]string, 0, len(e.Headers))
+	for name := range e.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		want := e.Headers[name]
+		got, ok := r.Headers[strings.ToLower(name)]
+		switch {
+		case want == "" && ok:
+			mismatch = append(mismatch, fmt.Sprintf("want header %q not set, got %q", name, got))
+		case want != "" && want != got:
+			mismatch = append(mismatch, fmt.Sprintf("want header %q %q, got %q", name, want, got))
+		}
+	}
+	removed := make(map[string]bool, len(r.RemovedHeaders))
+	for _, name := range r.RemovedHeaders {
+		removed[name] = true
+	}
+	for _, name := range e.RemovedHeaders {
+		if !removed[strings.ToLower(name)] {
+			mismatch = append(mismatch, fmt.Sprintf("want header %q removed", name))
+		}
+	}
+	return mismatch
+}
+
+// unverifiedJWTParser decodes JWTs without verifying their signatures,
+// rejecting only expired tokens. For spec tests only.
+type unverifiedJWTParser struct{}
+
+func (unverifiedJWTParser) parse(jwtString string) (map[string]interface{}, error) {
+	parts := strings.Split(jwtString, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT payload: %v", err)
+	}
+	claims := make(map[string]interface{})
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("invalid JWT payload: %v", err)
+	}
+	if exp, ok := claims["exp"].(float64); ok && time.Unix(int64(exp), 0).Before(time.Now()) {
+		return nil, fmt.Errorf("JWT expired")
+	}
+	// as parsed by the JWT verifier
+	if aud, ok := claims["aud"].([]interface{}); ok {
+		auds := make([]string, 0, len(aud))
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				auds = append(auds, s)
+			}
+		}
+		claims["aud"] = auds
+	}
+	return claims, nil
+}
+
+// unverifiedOIDCVerifier is a config.OIDCVerifier of unverifiedJWTParser
+type unverifiedOIDCVerifier struct {
+	unverifiedJWTParser
+}
+
+func (v unverifiedOIDCVerifier) ParseJWT(jwtString string, source config.OIDCDiscovery) (map[string]interface{}, error) {
+	return v.parse(jwtString)
+}
+
+// unverifiedJWKSVerifier is a config.JWKSVerifier of unverifiedJWTParser
+type unverifiedJWKSVerifier struct {
+	unverifiedJWTParser
+}
+
+func (v unverifiedJWKSVerifier) ParseJWT(jwtString string, source config.RemoteJWKS) (map[string]interface{}, error) {
+	return v.parse(jwtString)
+}
+
+// unverifiedAuthManager is an auth.Manager parsing JWTs of RemoteJWKS
+// sources without verification. For spec tests only.
+type unverifiedAuthManager struct {
+	unverifiedJWTParser
+}
+
+func (unverifiedAuthManager) Close() {}
+
+func (unverifiedAuthManager) Authenticate(ctx context.Context, apiKey string,
+	claims map[string]interface{}, apiKeyClaimKey string) (*auth.Context, error) {
+	return nil, auth.ErrInternalError
+}
+
+func (m unverifiedAuthManager) ParseJWT(jwtString string, provider jwt.Provider) (map[string]interface{}, error) {
+	return m.parse(jwtString)
+}
@@ -0,0 +1,107 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRunSpecTests(t *testing.T) {
+	valid := testJWT(`{"iss":"issuer","aud":["aud1"]}`)
+	expired := testJWT(fmt.Sprintf(`{"iss":"issuer","aud":"aud1","exp":%d}`, time.Now().Add(-time.Hour).Unix()))
+	file := filepath.Join(t.TempDir(), "tests.yaml")
+	if err := os.WriteFile(file, []byte(fmt.Sprintf(`
+tests:
+- name: allowed
+  request:
+    path: /v1/petstore?x-api-key=key
+    headers:
+      jwt: %[1]s
+  expect:
+    allow: true
+    api: api
+    operation: op
+    api_key: key
+    path: /petstore?x-api-key=key
+    headers:
+      Target: add,append
+      x-missing: ""
+    removed_headers: [jwt]
+- name: unauthenticated
+  request:
+    method: POST
+    path: /v1/petstore
+  expect:
+    allow: false
+    reason: unauthenticated
+- name: expired
+  request:
+    path: /v1/petstore
+    headers:
+      jwt: %[2]s
+  expect:
+    reason: unauthenticated
+- request:
+    path: /v9/petstore
+  expect:
+    allow: false
+    reason: not_found
+- name: wrong
+  request:
+    path: /v1/airport?jwt=%[1]s
+  expect:
+    allow: false
+    operation: op
+    headers:
+      target: add
+`, valid, expired)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests, err := ReadSpecTests(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failures, err := RunSpecTests(createAuthEnvSpec(), tests.Tests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SpecTestFailure{{
+		Test: "wrong",
+		Mismatch: []string{
+			"want allow false, got allowed",
+			`want operation "op", got "op2"`,
+			`want header "target" "add", got "add,append"`,
+		},
+	}}
+	if !reflect.DeepEqual(failures, want) {
+		t.Errorf("want failures %v, got %v", want, failures)
+	}
+}
+
+func TestReadSpecTestsUnknownField(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tests.yaml")
+	if err := os.WriteFile(file, []byte("tests:\n- expect:\n    allowed: true\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadSpecTests(file); err == nil {
+		t.Errorf("want unknown field error")
+	}
+}
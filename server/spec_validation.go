@@ -0,0 +1,93 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"gopkg.in/yaml.v3"
+)
+
+// maxSpecValidationBody limits the candidate specs of a validation request
+const maxSpecValidationBody = 10 << 20
+
+// SpecValidationHandlerFunc returns an http.HandlerFunc validating the
+// candidate environment specs POSTed as YAML or JSON, either a single spec
+// or a list, without applying them. It responds with the JSON validation
+// result of each spec. The envVars are those {env.VAR} templates may read.
+func SpecValidationHandlerFunc(envVars []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respond := func(status int, body interface{}) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			if err := json.NewEncoder(w).Encode(body); err != nil {
+				log.Warnf("spec validation unable to respond: %s", err)
+			}
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSpecValidationBody))
+		if err != nil {
+			respond(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		specs, err := unmarshalCandidateSpecs(data)
+		if err != nil {
+			respond(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		results := config.ValidateCandidateEnvironmentSpecs(specs, config.WithEnvironmentVariables(envVars))
+		valid := true
+		for _, r := range results {
+			valid = valid && r.Valid
+		}
+		respond(http.StatusOK, map[string]interface{}{"valid": valid, "specs": results})
+	}
+}
+
+// unmarshalCandidateSpecs reads a list of specs or a single spec
+func unmarshalCandidateSpecs(data []byte) ([]config.EnvironmentSpec, error) {
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+	if len(node.Content) == 0 {
+		return nil, fmt.Errorf("no environment specs")
+	}
+	if node.Content[0].Kind == yaml.SequenceNode {
+		var specs []config.EnvironmentSpec
+		if err := node.Decode(&specs); err != nil {
+			return nil, err
+		}
+		if len(specs) == 0 {
+			return nil, fmt.Errorf("no environment specs")
+		}
+		return specs, nil
+	}
+	var spec config.EnvironmentSpec
+	if err := node.Decode(&spec); err != nil {
+		return nil, err
+	}
+	return []config.EnvironmentSpec{spec}, nil
+}
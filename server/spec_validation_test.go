@@ -0,0 +1,108 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSpecValidationHandlerFunc(t *testing.T) {
+	tests := []struct {
+		desc       string
+		method     string
+		body       string
+		wantStatus int
+		wantValid  bool
+		wantSpecs  []config.EnvironmentSpecValidation
+	}{
+		{
+			desc:       "single yaml spec",
+			method:     http.MethodPost,
+			body:       "id: spec\napis:\n- id: api\n  base_path: /v1\n",
+			wantStatus: http.StatusOK,
+			wantValid:  true,
+			wantSpecs:  []config.EnvironmentSpecValidation{{ID: "spec", Valid: true}},
+		},
+		{
+			desc:       "json list",
+			method:     http.MethodPost,
+			body:       `[{"id": "spec"}, {"id": "spec"}]`,
+			wantStatus: http.StatusOK,
+			wantValid:  false,
+			wantSpecs: []config.EnvironmentSpecValidation{
+				{ID: "spec", Valid: true},
+				{ID: "spec", Error: "environment spec IDs must be unique, got multiple spec"},
+			},
+		},
+		{
+			desc:       "invalid spec",
+			method:     http.MethodPost,
+			body:       "id: spec\napis:\n- base_path: /v1\n",
+			wantStatus: http.StatusOK,
+			wantValid:  false,
+			wantSpecs:  []config.EnvironmentSpecValidation{{ID: "spec", Error: "API spec IDs must be non-empty"}},
+		},
+		{
+			desc:       "empty",
+			method:     http.MethodPost,
+			body:       "",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			desc:       "unparseable",
+			method:     http.MethodPost,
+			body:       "id: [",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			desc:       "get",
+			method:     http.MethodGet,
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			SpecValidationHandlerFunc(nil)(rec, httptest.NewRequest(test.method, "/specs/validate", strings.NewReader(test.body)))
+			if rec.Code != test.wantStatus {
+				t.Fatalf("want status %d, got %d: %s", test.wantStatus, rec.Code, rec.Body)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+			var resp struct {
+				Valid bool                               `json:"valid"`
+				Specs []config.EnvironmentSpecValidation `json:"specs"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Valid != test.wantValid {
+				t.Errorf("want valid %t, got %t", test.wantValid, resp.Valid)
+			}
+			if diff := cmp.Diff(test.wantSpecs, resp.Specs); diff != "" {
+				t.Errorf("diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	v3 "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
+	grpcstatsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/grpc_stats/v3"
+)
+
+const (
+	// envoyGrpcStatsFilter counts the messages of gRPC streams and emits them
+	// as filter state of the same name
+	envoyGrpcStatsFilter = "envoy.filters.http.grpc_stats"
+
+	// streamMessagesNamespace is the dynamic metadata namespace of the message
+	// counts of other streams, such as WebSockets, set by a Lua or Wasm filter
+	streamMessagesNamespace = "envoy.filters.http.apigee.stream_messages"
+
+	// fields of the stream messages metadata
+	requestMessageCountField  = "request_message_count"
+	responseMessageCountField = "response_message_count"
+
+	// analytics attributes populated from the message counts of a stream
+	streamRequestMessagesAttribute  = "stream.request_messages"
+	streamResponseMessagesAttribute = "stream.response_messages"
+)
+
+// streamMessageAttributes returns the analytics attributes of the message
+// counts of a gRPC stream from the grpc_stats filter state, or of another
+// stream from the stream messages metadata. Nil if neither was logged.
+func streamMessageAttributes(cp *v3.AccessLogCommon) []analytics.Attribute {
+	if state := cp.GetFilterStateObjects()[envoyGrpcStatsFilter]; state != nil {
+		counts := &grpcstatsv3.FilterObject{}
+		if err := state.UnmarshalTo(counts); err != nil {
+			log.Debugf("invalid %s filter state: %v", envoyGrpcStatsFilter, err)
+		} else {
+			return []analytics.Attribute{
+				{Name: streamRequestMessagesAttribute, Value: int64(counts.GetRequestMessageCount())},
+				{Name: streamResponseMessagesAttribute, Value: int64(counts.GetResponseMessageCount())},
+			}
+		}
+	}
+
+	fields := cp.GetMetadata().GetFilterMetadata()[streamMessagesNamespace].GetFields()
+	var attributes []analytics.Attribute
+	if v, ok := fields[requestMessageCountField]; ok {
+		attributes = append(attributes, analytics.Attribute{
+			Name:  streamRequestMessagesAttribute,
+			Value: int64(v.GetNumberValue()),
+		})
+	}
+	if v, ok := fields[responseMessageCountField]; ok {
+		attributes = append(attributes, analytics.Attribute{
+			Name:  streamResponseMessagesAttribute,
+			Value: int64(v.GetNumberValue()),
+		})
+	}
+	return attributes
+}
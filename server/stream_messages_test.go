@@ -0,0 +1,89 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	v3 "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
+	grpcstatsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/grpc_stats/v3"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestStreamMessageAttributes(t *testing.T) {
+	grpcStats := mustMarshalAny(&grpcstatsv3.FilterObject{
+		RequestMessageCount:  3,
+		ResponseMessageCount: 7,
+	})
+	wsMetadata := &core.Metadata{FilterMetadata: map[string]*structpb.Struct{
+		streamMessagesNamespace: {Fields: map[string]*structpb.Value{
+			requestMessageCountField:  structpb.NewNumberValue(12),
+			responseMessageCountField: structpb.NewNumberValue(40),
+		}},
+	}}
+
+	tests := []struct {
+		desc string
+		cp   *v3.AccessLogCommon
+		want []analytics.Attribute
+	}{
+		{"nil", nil, nil},
+		{"not a stream", &v3.AccessLogCommon{}, nil},
+		{"grpc", &v3.AccessLogCommon{
+			FilterStateObjects: map[string]*anypb.Any{envoyGrpcStatsFilter: grpcStats},
+		}, []analytics.Attribute{
+			{Name: streamRequestMessagesAttribute, Value: int64(3)},
+			{Name: streamResponseMessagesAttribute, Value: int64(7)},
+		}},
+		{"websocket", &v3.AccessLogCommon{Metadata: wsMetadata}, []analytics.Attribute{
+			{Name: streamRequestMessagesAttribute, Value: int64(12)},
+			{Name: streamResponseMessagesAttribute, Value: int64(40)},
+		}},
+		{"grpc over metadata", &v3.AccessLogCommon{
+			FilterStateObjects: map[string]*anypb.Any{envoyGrpcStatsFilter: grpcStats},
+			Metadata:           wsMetadata,
+		}, []analytics.Attribute{
+			{Name: streamRequestMessagesAttribute, Value: int64(3)},
+			{Name: streamResponseMessagesAttribute, Value: int64(7)},
+		}},
+		{"invalid filter state", &v3.AccessLogCommon{
+			FilterStateObjects: map[string]*anypb.Any{envoyGrpcStatsFilter: mustMarshalAny(wrapperspb.String("x"))},
+			Metadata:           wsMetadata,
+		}, []analytics.Attribute{
+			{Name: streamRequestMessagesAttribute, Value: int64(12)},
+			{Name: streamResponseMessagesAttribute, Value: int64(40)},
+		}},
+		{"partial metadata", &v3.AccessLogCommon{Metadata: &core.Metadata{FilterMetadata: map[string]*structpb.Struct{
+			streamMessagesNamespace: {Fields: map[string]*structpb.Value{
+				responseMessageCountField: structpb.NewNumberValue(5),
+			}},
+		}}}, []analytics.Attribute{
+			{Name: streamResponseMessagesAttribute, Value: int64(5)},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			got := streamMessageAttributes(test.cp)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
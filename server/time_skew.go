@@ -0,0 +1,79 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// correctTimeSkew compares the end of a record, as timed by Envoy, to the
+// adapter's clock. If they differ by more than maxTimeSkew, the record's
+// timestamps are shifted to end at the adapter's time. A maxTimeSkew of
+// zero only measures skew.
+func correctTimeSkew(record *analytics.Record, now time.Time, maxTimeSkew time.Duration, org string) {
+	end := record.ClientSentEndTimestamp
+	if end == 0 {
+		end = record.ClientReceivedStartTimestamp
+	}
+	if end == 0 {
+		return
+	}
+	skew := timeToApigeeInt(now) - end
+	absSkew := time.Duration(skew) * time.Millisecond
+	if absSkew < 0 {
+		absSkew = -absSkew
+	}
+	prometheusAnalyticsTimeSkew.WithLabelValues(org).Observe(absSkew.Seconds())
+
+	if maxTimeSkew <= 0 || absSkew <= maxTimeSkew {
+		return
+	}
+	log.Debugf("correcting analytics record time skew of %dms", skew)
+	prometheusAnalyticsTimeSkewCorrected.WithLabelValues(org).Inc()
+	for _, ts := range []*int64{
+		&record.ClientReceivedStartTimestamp,
+		&record.ClientReceivedEndTimestamp,
+		&record.TargetSentStartTimestamp,
+		&record.TargetSentEndTimestamp,
+		&record.TargetReceivedStartTimestamp,
+		&record.TargetReceivedEndTimestamp,
+		&record.ClientSentStartTimestamp,
+		&record.ClientSentEndTimestamp,
+	} {
+		if *ts != 0 { // unset remains unset
+			*ts += skew
+		}
+	}
+}
+
+var (
+	prometheusAnalyticsTimeSkew = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Subsystem: "analytics",
+		Name:      "time_skew_seconds",
+		Help:      "Absolute difference between Envoy record end times and the adapter clock",
+		Buckets:   []float64{.1, .5, 1, 5, 10, 30, 60, 300, 900, 3600},
+	}, []string{"org"})
+
+	prometheusAnalyticsTimeSkewCorrected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "analytics",
+		Name:      "time_skew_corrected_count",
+		Help:      "Total number of analytics records with corrected timestamps",
+	}, []string{"org"})
+)
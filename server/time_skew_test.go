@@ -0,0 +1,69 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCorrectTimeSkew(t *testing.T) {
+	now := time.Unix(1000, 0)
+	nowMs := timeToApigeeInt(now)
+	record := func(end int64) analytics.Record {
+		return analytics.Record{
+			ClientReceivedStartTimestamp: end - 100,
+			ClientReceivedEndTimestamp:   end - 90,
+			TargetSentStartTimestamp:     end - 80,
+			TargetSentEndTimestamp:       end - 70,
+			TargetReceivedStartTimestamp: end - 60,
+			TargetReceivedEndTimestamp:   end - 50,
+			ClientSentStartTimestamp:     end - 40,
+			ClientSentEndTimestamp:       end,
+		}
+	}
+
+	tests := []struct {
+		desc        string
+		record      analytics.Record
+		maxTimeSkew time.Duration
+		want        analytics.Record
+	}{
+		{"disabled", record(nowMs + 60000), 0, record(nowMs + 60000)},
+		{"within skew", record(nowMs - 1000), time.Second, record(nowMs - 1000)},
+		{"future", record(nowMs + 60000), time.Second, record(nowMs)},
+		{"past", record(nowMs - 60000), time.Second, record(nowMs)},
+		{
+			"unset timestamps",
+			analytics.Record{ClientReceivedStartTimestamp: nowMs - 60000},
+			time.Second,
+			analytics.Record{ClientReceivedStartTimestamp: nowMs},
+		},
+		{"no timestamps", analytics.Record{}, time.Second, analytics.Record{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			got := test.record
+			correctTimeSkew(&got, now, test.maxTimeSkew, "org")
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,283 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/context"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	verificationKindAPIKey = "api_key"
+
+	verificationStoreResultHit   = "hit"
+	verificationStoreResultMiss  = "miss"
+	verificationStoreResultError = "error"
+)
+
+// errUnsignedVerification is returned for a stored value without a valid signature
+var errUnsignedVerification = errors.New("stored verification signature mismatch")
+
+// verificationStore is an external store of verification results shared by
+// the replicas of the service behind their local caches. Stored results are
+// signed with a secret of the replicas, values written by anyone else with
+// access to the store are rejected.
+type verificationStore interface {
+	// get returns the value stored at key, nil if there is none
+	get(key string) ([]byte, error)
+	// set stores the value at key for ttl
+	set(key string, value []byte, ttl time.Duration) error
+	// add stores the value at key for ttl unless a value is stored there
+	add(key string, value []byte, ttl time.Duration) error
+	close()
+}
+
+// redisVerificationStore is a verificationStore in Redis. Keys are scoped by
+// org and env, values are prefixed by the hex HMAC-SHA256 of key and value.
+type redisVerificationStore struct {
+	client     *redisClient
+	prefix     string // key prefix, org, and env
+	signingKey []byte
+}
+
+// newRedisVerificationStore returns nil if client is nil
+func newRedisVerificationStore(client *redisClient, prefix, org, env string, signingKey []byte) verificationStore {
+	if client == nil {
+		return nil
+	}
+	return &redisVerificationStore{
+		client:     client,
+		prefix:     prefix + org + ":" + env + ":",
+		signingKey: signingKey,
+	}
+}
+
+// signature returns the hex HMAC of the full key and value
+func (s *redisVerificationStore) signature(key string, value []byte) []byte {
+	mac := hmac.New(sha256.New, s.signingKey)
+	_, _ = mac.Write([]byte(key))
+	_, _ = mac.Write([]byte{0})
+	_, _ = mac.Write(value)
+	sum := mac.Sum(nil)
+	signature := make([]byte, hex.EncodedLen(len(sum)))
+	hex.Encode(signature, sum)
+	return signature
+}
+
+func (s *redisVerificationStore) get(key string) ([]byte, error) {
+	replies, err := s.client.do([]string{"GET", s.prefix + key})
+	if err != nil {
+		return nil, err
+	}
+	switch reply := replies[0].(type) {
+	case string:
+		size := hex.EncodedLen(sha256.Size)
+		if len(reply) < size {
+			return nil, errUnsignedVerification
+		}
+		value := []byte(reply[size:])
+		if !hmac.Equal([]byte(reply[:size]), s.signature(s.prefix+key, value)) {
+			return nil, errUnsignedVerification
+		}
+		return value, nil
+	case nil:
+		return nil, nil
+	case redisError:
+		return nil, reply
+	default:
+		return nil, fmt.Errorf("unexpected GET reply: %v", reply)
+	}
+}
+
+func (s *redisVerificationStore) set(key string, value []byte, ttl time.Duration) error {
+	return s.store(key, value, ttl, false)
+}
+
+func (s *redisVerificationStore) add(key string, value []byte, ttl time.Duration) error {
+	return s.store(key, value, ttl, true)
+}
+
+// store sets the signed value at key for ttl, only if none is stored if nx
+func (s *redisVerificationStore) store(key string, value []byte, ttl time.Duration, nx bool) error {
+	millis := int64(ttl / time.Millisecond)
+	if millis <= 0 {
+		return nil
+	}
+	signed := string(s.signature(s.prefix+key, value)) + string(value)
+	cmd := []string{"SET", s.prefix + key, signed, "PX", strconv.FormatInt(millis, 10)}
+	if nx {
+		cmd = []string{"SET", s.prefix + key, signed, "NX", "PX", strconv.FormatInt(millis, 10)}
+	}
+	replies, err := s.client.do(cmd)
+	if err != nil {
+		return err
+	}
+	if rerr, ok := replies[0].(redisError); ok {
+		return rerr
+	}
+	return nil
+}
+
+func (s *redisVerificationStore) close() {
+	s.client.close()
+}
+
+// verificationStoreKey keys a credential of kind by its digest so the
+// credential itself isn't stored
+func verificationStoreKey(kind, credential string) string {
+	sum := sha256.Sum256([]byte(credential))
+	return kind + ":" + hex.EncodeToString(sum[:])
+}
+
+// loadVerification returns the stored verification of the credential, nil if
+// there is none or it can't be loaded. Always nil if store is nil.
+func loadVerification(store verificationStore, org, kind, credential string) []byte {
+	if store == nil {
+		return nil
+	}
+	value, err := store.get(verificationStoreKey(kind, credential))
+	switch {
+	case err != nil:
+		log.Warnf("unable to load %s verification from store: %v", kind, err)
+		prometheusVerificationStore.WithLabelValues(org, kind, verificationStoreResultError).Inc()
+	case value == nil:
+		prometheusVerificationStore.WithLabelValues(org, kind, verificationStoreResultMiss).Inc()
+	default:
+		prometheusVerificationStore.WithLabelValues(org, kind, verificationStoreResultHit).Inc()
+	}
+	return value
+}
+
+// saveVerification stores the verification of the credential for ttl unless
+// one is stored, such as the invalidation of an API key. Does nothing if store
+// is nil.
+func saveVerification(store verificationStore, org, kind, credential string, value []byte, ttl time.Duration) {
+	if store == nil {
+		return
+	}
+	if err := store.add(verificationStoreKey(kind, credential), value, ttl); err != nil {
+		log.Warnf("unable to save %s verification to store: %v", kind, err)
+		prometheusVerificationStore.WithLabelValues(org, kind, verificationStoreResultError).Inc()
+	}
+}
+
+// storedAuthContext is the stored form of the auth.Context of a verified API
+// key or, if Invalidated is set, of the invalidation of the key
+type storedAuthContext struct {
+	Invalidated    time.Time `json:"invalidated,omitempty"`
+	ClientID       string    `json:"client_id"`
+	AccessToken    string    `json:"access_token,omitempty"`
+	Application    string    `json:"application_name"`
+	APIProducts    []string  `json:"api_product_list"`
+	Expires        time.Time `json:"expires,omitempty"`
+	DeveloperEmail string    `json:"developer_email,omitempty"`
+	Scopes         []string  `json:"scopes,omitempty"`
+}
+
+// authenticate authenticates with the wrapped auth.Manager, sharing the
+// contexts of verified API keys through the store. Invalidated keys are
+// verified with their own auth.Manager, including those invalidated by other
+// replicas whose invalidations are stored in place of the contexts.
+func (m *remoteServiceAuthManager) authenticate(ctx context.Context, apiKey string,
+	claims map[string]interface{}, apiKeyClaimKey string) (*auth.Context, error) {
+	// the key in the claims takes precedence, as in auth.Manager
+	key := apiKey
+	if claims[apiKeyClaimKey] != nil {
+		key, _ = claims[apiKeyClaimKey].(string)
+	}
+	if m.store == nil || key == "" {
+		return m.keyManager(key).Authenticate(ctx, apiKey, claims, apiKeyClaimKey)
+	}
+	apiKey = key
+
+	if value := loadVerification(m.store, m.org, verificationKindAPIKey, apiKey); value != nil {
+		stored := storedAuthContext{}
+		switch err := json.Unmarshal(value, &stored); {
+		case err == nil && !stored.Invalidated.IsZero():
+			if err := m.invalidated.add(apiKey, stored.Invalidated); err != nil {
+				log.Warnf("unable to invalidate API key: %v", err)
+			}
+			// not stored until the invalidation expires
+			return m.keyManager(apiKey).Authenticate(ctx, apiKey, claims, apiKeyClaimKey)
+		case err == nil && stored.ClientID != "":
+			return &auth.Context{
+				Context:        ctx,
+				ClientID:       stored.ClientID,
+				AccessToken:    stored.AccessToken,
+				Application:    stored.Application,
+				APIProducts:    stored.APIProducts,
+				Expires:        stored.Expires,
+				DeveloperEmail: stored.DeveloperEmail,
+				Scopes:         stored.Scopes,
+				APIKey:         apiKey,
+			}, nil
+		}
+		log.Warnf("ignoring invalid %s verification in store", verificationKindAPIKey)
+	}
+
+	manager := m.keyManager(apiKey)
+	authContext, err := manager.Authenticate(ctx, apiKey, claims, apiKeyClaimKey)
+	if err == nil && authContext.APIKey == apiKey { // verified by key, not claims
+		value, _ := json.Marshal(storedAuthContext{
+			ClientID:       authContext.ClientID,
+			AccessToken:    authContext.AccessToken,
+			Application:    authContext.Application,
+			APIProducts:    authContext.APIProducts,
+			Expires:        authContext.Expires,
+			DeveloperEmail: authContext.DeveloperEmail,
+			Scopes:         authContext.Scopes,
+		})
+		saveVerification(m.store, m.org, verificationKindAPIKey, apiKey, value, m.apiKeyStoreTTL)
+	}
+	return authContext, err
+}
+
+// keyManager returns the auth.Manager verifying the API key
+func (m *remoteServiceAuthManager) keyManager(apiKey string) auth.Manager {
+	if invalidated := m.invalidated.manager(apiKey); invalidated != nil {
+		return invalidated
+	}
+	return m.Manager
+}
+
+// Close implements auth.Manager
+func (m *remoteServiceAuthManager) Close() {
+	m.Manager.Close()
+	m.accessTokenVerifier.close()
+	m.invalidated.close()
+	if m.store != nil {
+		m.store.close()
+	}
+}
+
+var (
+	prometheusVerificationStore = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "verification_store_count",
+		Help:      "Number of shared verification store lookups by kind and result",
+	}, []string{"org", "kind", "result"})
+)
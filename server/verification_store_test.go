@@ -0,0 +1,195 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/context"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// countingAuthMan verifies API key "good" and counts verifications
+type countingAuthMan struct {
+	auth.Manager
+	calls int
+}
+
+func (m *countingAuthMan) Authenticate(ctx context.Context, apiKey string,
+	claims map[string]interface{}, apiKeyClaimKey string) (*auth.Context, error) {
+	m.calls++
+	if claimKey, ok := claims[apiKeyClaimKey].(string); ok {
+		apiKey = claimKey
+	}
+	if apiKey != "good" {
+		return nil, auth.ErrBadAuth
+	}
+	return &auth.Context{
+		Context:     ctx,
+		ClientID:    "client",
+		Application: "app",
+		APIProducts: []string{"product"},
+		Scopes:      []string{"scope"},
+		APIKey:      apiKey,
+	}, nil
+}
+
+func newTestVerificationStore(t *testing.T, srv *fakeRedis) verificationStore {
+	c, err := newRedisClient(testRedisConfig(srv.address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newRedisVerificationStore(c, "v:", "org", "env", []byte("signing key"))
+}
+
+func TestRedisVerificationStore(t *testing.T) {
+	if s := newRedisVerificationStore(nil, "", "org", "env", nil); s != nil {
+		t.Errorf("want nil store without client, got: %v", s)
+	}
+
+	srv := newFakeRedis(t, "")
+	defer srv.close()
+	s := newTestVerificationStore(t, srv)
+	defer s.close()
+
+	if value, err := s.get("key"); value != nil || err != nil {
+		t.Errorf("want miss, got: %q, %v", value, err)
+	}
+	if err := s.set("key", []byte("value"), 1500*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := s.get("key"); string(value) != "value" || err != nil {
+		t.Errorf("want value, got: %q, %v", value, err)
+	}
+	if err := s.set("expired", []byte("value"), 0); err != nil {
+		t.Fatal(err)
+	}
+	srv.mu.Lock()
+	if srv.ttls["v:org:env:key"] != 1500 {
+		t.Errorf("want ttl 1500 ms, got: %v", srv.ttls)
+	}
+	if _, ok := srv.values["v:org:env:expired"]; ok {
+		t.Errorf("want no value without ttl")
+	}
+	stored := srv.values["v:org:env:key"]
+	srv.mu.Unlock()
+
+	// values not signed by the replicas are rejected
+	other := &redisVerificationStore{client: s.(*redisVerificationStore).client, prefix: "v:org:env:", signingKey: []byte("other")}
+	if value, err := other.get("key"); value != nil || err != errUnsignedVerification {
+		t.Errorf("want %v, got: %q, %v", errUnsignedVerification, value, err)
+	}
+	for _, forged := range []string{"value", stored[:len(stored)-1] + "X"} {
+		srv.mu.Lock()
+		srv.values["v:org:env:forged"] = forged
+		srv.mu.Unlock()
+		if value, err := s.get("forged"); value != nil || err != errUnsignedVerification {
+			t.Errorf("want %v for %q, got: %q, %v", errUnsignedVerification, forged, value, err)
+		}
+	}
+	// nor are values moved to another key or env
+	srv.mu.Lock()
+	srv.values["v:org:env:moved"] = stored
+	srv.mu.Unlock()
+	if value, err := s.get("moved"); value != nil || err != errUnsignedVerification {
+		t.Errorf("want %v for moved value, got: %q, %v", errUnsignedVerification, value, err)
+	}
+	otherEnv := newRedisVerificationStore(s.(*redisVerificationStore).client, "v:", "org", "prod", []byte("signing key"))
+	if value, err := otherEnv.get("key"); value != nil || err != nil {
+		t.Errorf("want miss in other env, got: %q, %v", value, err)
+	}
+
+	if got := verificationStoreKey(verificationKindAPIKey, "key"); got != "api_key:"+sha256OfKey {
+		t.Errorf("want key digest, got: %s", got)
+	}
+
+	// unreachable store
+	srv.close()
+	s.close()
+	if value := loadVerification(s, "org", verificationKindAPIKey, "key"); value != nil {
+		t.Errorf("want nil value from unreachable store, got: %q", value)
+	}
+	saveVerification(s, "org", verificationKindAPIKey, "key", []byte("value"), time.Minute)
+}
+
+func TestAuthenticateShared(t *testing.T) {
+	srv := newFakeRedis(t, "")
+	defer srv.close()
+	store := newTestVerificationStore(t, srv)
+	defer store.close()
+
+	want := &auth.Context{
+		ClientID:    "client",
+		Application: "app",
+		APIProducts: []string{"product"},
+		Scopes:      []string{"scope"},
+		APIKey:      "good",
+	}
+	ignoreContext := cmpopts.IgnoreFields(auth.Context{}, "Context")
+	replica := func() (*remoteServiceAuthManager, *countingAuthMan) {
+		counter := &countingAuthMan{}
+		return &remoteServiceAuthManager{
+			Manager:        counter,
+			store:          store,
+			apiKeyStoreTTL: time.Minute,
+			org:            "org",
+		}, counter
+	}
+	m1, c1 := replica()
+	m2, c2 := replica()
+
+	// the replicas verify the key once
+	got, err := m1.Authenticate(nil, "good", nil, "api_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got, ignoreContext); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+	ctx := &Handler{orgName: "org"}
+	got, err = m2.Authenticate(ctx, "", map[string]interface{}{"api_key": "good"}, "api_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got, ignoreContext); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+	if got.Context != ctx {
+		t.Errorf("want request context, got: %v", got.Context)
+	}
+	if c1.calls != 1 || c2.calls != 0 {
+		t.Errorf("want 1 verification, got: %d, %d", c1.calls, c2.calls)
+	}
+
+	// bad keys and claims without keys are not stored
+	if _, err := m2.Authenticate(nil, "bad", nil, "api_key"); err != auth.ErrBadAuth {
+		t.Errorf("want: %v, got: %v", auth.ErrBadAuth, err)
+	}
+	if _, err := m2.Authenticate(nil, "bad", nil, "api_key"); err != auth.ErrBadAuth {
+		t.Errorf("want: %v, got: %v", auth.ErrBadAuth, err)
+	}
+	_, _ = m2.Authenticate(nil, "", map[string]interface{}{"sub": "me"}, "api_key")
+	if c2.calls != 3 {
+		t.Errorf("want 3 verifications, got: %d", c2.calls)
+	}
+	srv.mu.Lock()
+	if len(srv.values) != 1 {
+		t.Errorf("want only the good key stored, got: %v", srv.values)
+	}
+	srv.mu.Unlock()
+}
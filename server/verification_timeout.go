@@ -0,0 +1,66 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/context"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// authenticateWithTimeout authenticates the API key or claims, giving up with
+// auth.ErrNetworkError after timeout so a slow verification of one API can't
+// hold checks of all APIs to tenant.client_timeout. The abandoned verification
+// completes in the background. Zero timeout waits for the verification.
+// Timeouts are counted by the spec and api labels of metricScope.
+func (a *AuthorizationServer) authenticateWithTimeout(ctx context.Context, timeout time.Duration,
+	apiKey string, claims map[string]interface{}, spec, api string) (*auth.Context, error) {
+	authMan := a.handler.authMan
+	if timeout <= 0 {
+		return authMan.Authenticate(ctx, apiKey, claims, a.handler.apiKeyClaim)
+	}
+
+	type authenticated struct {
+		authContext *auth.Context
+		err         error
+	}
+	done := make(chan authenticated, 1)
+	go func() {
+		authContext, err := authMan.Authenticate(ctx, apiKey, claims, a.handler.apiKeyClaim)
+		done <- authenticated{authContext, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.authContext, r.err
+	case <-timer.C:
+		log.Debugf("API key verification for api %q timed out after %s", api, timeout)
+		prometheusVerificationTimeouts.WithLabelValues(ctx.Organization(), ctx.Environment(), spec, api).Inc()
+		return nil, auth.ErrNetworkError
+	}
+}
+
+var (
+	prometheusVerificationTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "verification_timeout_count",
+		Help:      "Total number of API key verifications abandoned after the API verification timeout",
+	}, []string{"org", "env", "spec", "api"})
+)
@@ -0,0 +1,66 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	apigeeContext "github.com/apigee/apigee-remote-service-golib/v2/context"
+)
+
+func TestAuthenticateWithTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	tests := []struct {
+		desc    string
+		timeout time.Duration
+		slow    bool
+		wantErr error
+	}{
+		{"no timeout", 0, false, nil},
+		{"within timeout", time.Minute, false, nil},
+		{"timed out", 10 * time.Millisecond, true, auth.ErrNetworkError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			authMan := &testAuthMan{}
+			authMan.makeContextFunc = func(ctx apigeeContext.Context) (*auth.Context, error) {
+				if test.slow {
+					<-release
+				}
+				return &auth.Context{Context: ctx, ClientID: "client"}, nil
+			}
+			server := AuthorizationServer{
+				handler: &Handler{
+					orgName: "org",
+					envName: "env",
+					authMan: authMan,
+				},
+			}
+
+			authContext, err := server.authenticateWithTimeout(server.handler, test.timeout, "key", nil, "", "api")
+			if err != test.wantErr {
+				t.Errorf("want: %v, got: %v", test.wantErr, err)
+			}
+			if test.wantErr == nil && authContext.ClientID != "client" {
+				t.Errorf("want: client, got: %s", authContext.ClientID)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/context"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+)
+
+// verifyAPIKeyHeadersFragment prefixes the URL fragment carrying the
+// forwarded headers from the context to the round tripper
+const verifyAPIKeyHeadersFragment = "verify-api-key-headers:"
+
+// verifyAPIKeyHeaders forwards allowed request headers to the verifyApiKey
+// call. The golib verifier builds its request from the context's
+// RemoteServiceAPI without the request context, so the headers ride in the
+// URL fragment, which is never sent, to the round tripper of the auth client.
+type verifyAPIKeyHeaders struct {
+	names map[string]bool // lowercase
+}
+
+// newVerifyAPIKeyHeaders returns nil if no headers are forwarded
+func newVerifyAPIKeyHeaders(names []string) *verifyAPIKeyHeaders {
+	if len(names) == 0 {
+		return nil
+	}
+	h := &verifyAPIKeyHeaders{names: make(map[string]bool, len(names))}
+	for _, name := range names {
+		h.names[strings.ToLower(name)] = true
+	}
+	return h
+}
+
+// context returns ctx forwarding the allowed headers, ctx itself if there
+// are none
+func (h *verifyAPIKeyHeaders) context(ctx context.Context, headers map[string]string) context.Context {
+	if h == nil {
+		return ctx
+	}
+	forwarded := make(url.Values)
+	for k, v := range headers {
+		if k = strings.ToLower(k); h.names[k] {
+			forwarded.Set(k, v)
+		}
+	}
+	if len(forwarded) == 0 {
+		return ctx
+	}
+	return &verifyAPIKeyContext{Context: ctx, fragment: verifyAPIKeyHeadersFragment + forwarded.Encode()}
+}
+
+// roundTripper returns rt adding the forwarded headers of request URLs
+func (h *verifyAPIKeyHeaders) roundTripper(rt http.RoundTripper) http.RoundTripper {
+	if h == nil {
+		return rt
+	}
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if !strings.HasPrefix(req.URL.Fragment, verifyAPIKeyHeadersFragment) {
+			return rt.RoundTrip(req)
+		}
+		forwarded, err := url.ParseQuery(strings.TrimPrefix(req.URL.Fragment, verifyAPIKeyHeadersFragment))
+		if err != nil {
+			log.Warnf("ignoring invalid verifyApiKey headers: %v", err)
+		}
+		req = req.Clone(req.Context())
+		req.URL.Fragment, req.URL.RawFragment = "", ""
+		for k, vv := range forwarded {
+			if h.names[k] && req.Header.Get(k) == "" {
+				req.Header.Set(k, vv[0])
+			}
+		}
+		return rt.RoundTrip(req)
+	})
+}
+
+// verifyAPIKeyContext is a context with forwarded headers in the fragment of
+// its RemoteServiceAPI
+type verifyAPIKeyContext struct {
+	context.Context
+	fragment string
+}
+
+func (c *verifyAPIKeyContext) RemoteServiceAPI() *url.URL {
+	u := *c.Context.RemoteServiceAPI()
+	u.Fragment, u.RawFragment = c.fragment, ""
+	return &u
+}
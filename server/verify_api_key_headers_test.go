@@ -0,0 +1,69 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/auth/key"
+	"github.com/apigee/apigee-remote-service-golib/v2/authtest"
+)
+
+func TestVerifyAPIKeyHeaders(t *testing.T) {
+	var got http.Header
+	var gotURL string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, gotURL = r.Header.Clone(), r.URL.String()
+		_, _ = w.Write([]byte(`{}`)) // no token, a bad key
+	}))
+	defer ts.Close()
+
+	h := newVerifyAPIKeyHeaders([]string{"X-Forwarded-For", "x-partner-id"})
+	client := &http.Client{Transport: h.roundTripper(http.DefaultTransport)}
+	verifier := key.NewVerifier(key.VerifierOpts{Client: client, Org: "org"})
+
+	rootContext := authtest.NewContext(ts.URL)
+	ctx := h.context(rootContext, map[string]string{
+		"x-forwarded-for": "10.0.0.1",
+		"x-partner-id":    "partner",
+		"authorization":   "Bearer secret",
+		"x-other":         "other",
+	})
+	if _, err := verifier.Verify(ctx, "key"); err != key.ErrBadKeyAuth {
+		t.Fatalf("want bad key, got %v", err)
+	}
+	if got.Get("x-forwarded-for") != "10.0.0.1" || got.Get("x-partner-id") != "partner" {
+		t.Errorf("want forwarded headers, got %v", got)
+	}
+	if got.Get("authorization") != "" || got.Get("x-other") != "" {
+		t.Errorf("want unlisted headers not forwarded, got %v", got)
+	}
+	if got.Get("Content-Type") != "application/json" {
+		t.Errorf("want verifyApiKey headers kept, got %v", got)
+	}
+	if gotURL != "/verifyApiKey" {
+		t.Errorf("want URL without fragment, got %q", gotURL)
+	}
+
+	if c := h.context(rootContext, map[string]string{"x-other": "other"}); c != rootContext {
+		t.Errorf("want root context without forwarded headers")
+	}
+	var nilHeaders *verifyAPIKeyHeaders
+	if c := nilHeaders.context(rootContext, map[string]string{"x-partner-id": "partner"}); c != rootContext {
+		t.Errorf("want root context without verify_api_key_headers")
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package specmatch matches HTTP requests to the APIs and operations of an
+// environment spec, resolves their authentication, and applies their request
+// transforms exactly as the remote service does, for use by other gateways
+// and test tools.
+package specmatch
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/util"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+)
+
+// PathHeader is the pseudo-header of the transformed request path.
+const PathHeader = ":path"
+
+// Engine matches requests to an environment spec. It is safe for concurrent
+// use.
+type Engine struct {
+	spec    *config.EnvironmentSpecExt
+	authMan auth.Manager
+}
+
+// New validates the spec and returns an Engine for it. The authMan verifies
+// the JWTs and API keys of requests, nil if the spec authenticates neither.
+func New(spec config.EnvironmentSpec, authMan auth.Manager) (*Engine, error) {
+	if err := config.ValidateEnvironmentSpecs([]config.EnvironmentSpec{spec}); err != nil {
+		return nil, err
+	}
+	ext, err := config.NewEnvironmentSpecExt(&spec)
+	if err != nil {
+		return nil, err
+	}
+	return &Engine{spec: ext, authMan: authMan}, nil
+}
+
+// Request is an HTTP request to match.
+type Request struct {
+	Method  string
+	Path    string            // including any query
+	Host    string            // optional
+	Headers map[string]string // by lowercase name
+}
+
+// Match returns the API and operation of the request, nil if no API matches.
+func (e *Engine) Match(r Request) *Match {
+	headers := make(map[string]string, len(r.Headers))
+	for k, v := range r.Headers {
+		headers[strings.ToLower(k)] = v
+	}
+	req := &authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{
+			Request: &authv3.AttributeContext_Request{
+				Http: &authv3.AttributeContext_HttpRequest{
+					Method:  r.Method,
+					Path:    r.Path,
+					Host:    r.Host,
+					Headers: headers,
+				},
+			},
+		},
+	}
+	envRequest := config.NewEnvironmentSpecRequest(e.authMan, e.spec, req)
+	api := envRequest.GetAPISpec()
+	if api == nil {
+		return nil
+	}
+	m := &Match{
+		API:           api.ID,
+		OperationPath: envRequest.GetOperationPath(),
+		envRequest:    envRequest,
+	}
+	if op := envRequest.GetOperation(); op != nil {
+		m.Operation = op.Name
+		m.PathParams = envRequest.GetPathParams()
+		m.QueryParams = envRequest.GetQueryParams()
+	}
+	return m
+}
+
+// Match is a request matched to an API of the spec.
+type Match struct {
+	API           string
+	Operation     string // empty if no operation matched
+	OperationPath string // the path without the API base path
+	PathParams    map[string]string
+	QueryParams   map[string]string
+
+	envRequest *config.EnvironmentSpecRequest
+}
+
+// Authenticated returns true if the request meets the authentication
+// requirement of its operation or, if none, of its API.
+func (m *Match) Authenticated() bool {
+	return m.envRequest.IsAuthenticated()
+}
+
+// APIKey returns the API key of the consumer authorization of the operation
+// or, if none, of the API.
+func (m *Match) APIKey() string {
+	return m.envRequest.GetAPIKey()
+}
+
+// Transforms returns the request transforms of the operation, none if no
+// operation matched.
+func (m *Match) Transforms() RequestTransforms {
+	return Transforms(m.envRequest)
+}
+
+// HeaderValue is a request header to set or, if Append, add.
+type HeaderValue struct {
+	Name   string
+	Value  string
+	Append bool
+}
+
+// RequestTransforms are the changes to a request to send to its target, in
+// the order they apply.
+type RequestTransforms struct {
+	// Headers of the JWT payloads to forward, then PathHeader, then the
+	// header transforms.
+	Headers []HeaderValue
+	// RemoveHeaders are the request headers matching the removals.
+	RemoveHeaders []string
+}
+
+// Transforms applies the request transforms of the operation of envRequest,
+// including the forwarded JWT payloads. Headers without a value are omitted.
+func Transforms(envRequest *config.EnvironmentSpecRequest) (t RequestTransforms) {
+	if envRequest == nil || (envRequest.GetOperation() == nil && !envRequest.IsAuthExcluded()) {
+		return t
+	}
+	add := func(name, value string, appnd bool) {
+		if value != "" {
+			t.Headers = append(t.Headers, HeaderValue{Name: name, Value: value, Append: appnd})
+		}
+	}
+
+	for _, ja := range envRequest.JWTAuthentications() {
+		claims, _ := envRequest.GetJWTResult(ja.Name)
+		if claims != nil && ja.ForwardPayloadHeader != "" {
+			b, err := json.Marshal(claims)
+			if err != nil {
+				log.Errorf("unable to marshal ForwardPayloadHeader for %s", ja.Name)
+				continue
+			}
+			add(ja.ForwardPayloadHeader, base64.URLEncoding.EncodeToString(b), true)
+		}
+	}
+
+	transforms := envRequest.GetHTTPRequestTransforms()
+
+	// http path transformation
+	targetPath := envRequest.GetOperationPath()
+	if transforms.PathTransform != "" {
+		targetPath = path.Clean(envRequest.Reify(transforms.PathTransform))
+	}
+
+	queryMap := envRequest.GetQueryParams()
+	for _, name := range transforms.QueryTransforms.Remove {
+		delete(queryMap, strings.ToLower(name))
+	}
+	queryAppends := make(map[string][]string) // excess adds
+	for k, v := range queryMap {
+		queryAppends[k] = []string{v}
+	}
+	for _, qt := range transforms.QueryTransforms.Add {
+		if !envRequest.MeetsCondition(qt.Condition) {
+			continue
+		}
+		_, present := queryAppends[qt.Name]
+		ok, appnd := qt.Apply(present)
+		if !ok {
+			continue
+		}
+		value := envRequest.Reify(qt.Value)
+		if appnd {
+			queryAppends[qt.Name] = append(queryAppends[qt.Name], value)
+		} else {
+			queryAppends[qt.Name] = []string{value}
+		}
+	}
+	if len(queryAppends) > 0 {
+		names := make([]string, 0, len(queryAppends))
+		for name := range queryAppends {
+			names = append(names, name)
+		}
+		if transforms.StableHeaders {
+			sort.Strings(names)
+		}
+		queryParams := []string{}
+		for _, name := range names {
+			vals := queryAppends[name]
+			for _, val := range vals {
+				queryParams = append(queryParams, fmt.Sprintf("%s=%s", url.QueryEscape(name), url.QueryEscape(val)))
+			}
+		}
+		targetPath = targetPath + "?" + strings.Join(queryParams, "&")
+	}
+	add(PathHeader, targetPath, false)
+
+	// header transforms
+	headers := envRequest.Request.GetAttributes().GetRequest().GetHttp().GetHeaders()
+	removed := make(map[string]bool)
+	for _, name := range transforms.HeaderTransforms.Remove {
+		name = strings.ToLower(name)
+		for hdr := range headers {
+			if util.SimpleGlobMatch(name, hdr) {
+				t.RemoveHeaders = append(t.RemoveHeaders, hdr)
+				removed[hdr] = true
+			}
+		}
+	}
+	for _, ht := range transforms.HeaderTransforms.Add {
+		if !envRequest.MeetsCondition(ht.Condition) {
+			continue
+		}
+		name := strings.ToLower(ht.Name)
+		_, present := headers[name]
+		ok, appnd := ht.Apply(present && !removed[name])
+		if ok {
+			add(ht.Name, envRequest.Reify(ht.Value), appnd)
+		}
+	}
+
+	if transforms.StableHeaders {
+		t.Headers = stableHeaders(t.Headers)
+		sort.Strings(t.RemoveHeaders)
+	}
+	return t
+}
+
+// stableHeaders groups the values of each header, case-insensitively, in
+// the order the header is first added and under its first name. A value
+// replacing the values of a header drops those before it.
+func stableHeaders(headers []HeaderValue) []HeaderValue {
+	var names []string
+	groups := make(map[string][]HeaderValue)
+	for _, h := range headers {
+		key := strings.ToLower(h.Name)
+		group, ok := groups[key]
+		if !ok {
+			names = append(names, key)
+		} else {
+			h.Name = group[0].Name
+		}
+		if !h.Append {
+			group = nil
+		}
+		groups[key] = append(group, h)
+	}
+	stable := make([]HeaderValue, 0, len(headers))
+	for _, name := range names {
+		stable = append(stable, groups[name]...)
+	}
+	return stable
+}
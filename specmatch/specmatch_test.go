@@ -0,0 +1,192 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package specmatch
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+)
+
+func testSpec() config.EnvironmentSpec {
+	return config.EnvironmentSpec{
+		ID: "spec",
+		APIs: []config.APISpec{{
+			ID:       "pets",
+			BasePath: "/v1",
+			ConsumerAuthorization: config.ConsumerAuthorization{
+				In: []config.APIOperationParameter{{Match: config.Header("x-api-key")}},
+			},
+			Operations: []config.APIOperation{
+				{
+					Name:        "get",
+					HTTPMatches: []config.HTTPMatch{{PathTemplate: "/pets/{id}", Method: "GET"}},
+					HTTPRequestTransforms: config.HTTPRequestTransforms{
+						PathTransform: "/animals/{path.id}",
+						HeaderTransforms: config.NameValueTransforms{
+							Add:    []config.AddNameValue{{Name: "x-pet", Value: "{path.id}"}},
+							Remove: []string{"x-remove*"},
+						},
+					},
+				},
+			},
+		}},
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(testSpec(), nil); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	if _, err := New(config.EnvironmentSpec{}, nil); err == nil {
+		t.Errorf("want error for invalid spec")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	engine, err := New(testSpec(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m := engine.Match(Request{Method: "GET", Path: "/v2/pets/1"}); m != nil {
+		t.Errorf("want no match, got %#v", m)
+	}
+
+	m := engine.Match(Request{Method: "POST", Path: "/v1/pets/1"})
+	if m == nil || m.API != "pets" || m.Operation != "" {
+		t.Fatalf("want API without operation, got %#v", m)
+	}
+	if got := m.Transforms(); !reflect.DeepEqual(got, RequestTransforms{}) {
+		t.Errorf("want no transforms, got %#v", got)
+	}
+
+	m = engine.Match(Request{
+		Method:  "GET",
+		Path:    "/v1/pets/1?q=x",
+		Headers: map[string]string{"X-API-Key": "key", "x-remove-me": "x"},
+	})
+	if m == nil {
+		t.Fatal("want match")
+	}
+	if m.API != "pets" || m.Operation != "get" || m.OperationPath != "/pets/1" {
+		t.Errorf("want pets get /pets/1, got %s %s %s", m.API, m.Operation, m.OperationPath)
+	}
+	if want := map[string]string{"id": "1"}; !reflect.DeepEqual(m.PathParams, want) {
+		t.Errorf("want path params %v, got %v", want, m.PathParams)
+	}
+	if want := map[string]string{"q": "x"}; !reflect.DeepEqual(m.QueryParams, want) {
+		t.Errorf("want query params %v, got %v", want, m.QueryParams)
+	}
+	if !m.Authenticated() {
+		t.Errorf("want authenticated without requirement")
+	}
+	if got := m.APIKey(); got != "key" {
+		t.Errorf("want API key %q, got %q", "key", got)
+	}
+
+	want := RequestTransforms{
+		Headers: []HeaderValue{
+			{Name: PathHeader, Value: "/animals/1?q=x"},
+			{Name: "x-pet", Value: "1"},
+		},
+		RemoveHeaders: []string{"x-remove-me"},
+	}
+	if got := m.Transforms(); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %#v, got %#v", want, got)
+	}
+}
+
+func TestTransformsStableHeaders(t *testing.T) {
+	spec := testSpec()
+	spec.APIs[0].Operations[0].HTTPRequestTransforms = config.HTTPRequestTransforms{
+		StableHeaders: true,
+		HeaderTransforms: config.NameValueTransforms{
+			Add: []config.AddNameValue{
+				{Name: "X-Trace", Value: "a", Append: true},
+				{Name: "x-pet", Value: "{path.id}"},
+				{Name: "x-trace", Value: "b", Append: true},
+				{Name: "X-PET", Value: "2", Action: config.AddActionAppend},
+				{Name: "X-Tenant", Value: "t", Action: config.AddActionAddIfAbsent},
+				{Name: "X-Existing", Value: "e", Action: config.AddActionAddIfAbsent},
+				{Name: "X-Replace", Value: "r", Action: config.AddActionOverwriteIfPresent},
+				{Name: "X-Removed", Value: "r", Action: config.AddActionOverwriteIfPresent},
+			},
+			Remove: []string{"x-removed", "x-b*", "x-a"},
+		},
+		QueryTransforms: config.NameValueTransforms{
+			Add: []config.AddNameValue{
+				{Name: "z", Value: "1"},
+				{Name: "a", Value: "2", Action: config.AddActionAddIfAbsent},
+				{Name: "q", Value: "3", Action: config.AddActionAddIfAbsent},
+			},
+		},
+	}
+	engine, err := New(spec, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := engine.Match(Request{
+		Method: "GET",
+		Path:   "/v1/pets/1?q=x&m=y",
+		Headers: map[string]string{
+			"x-api-key":  "key",
+			"x-existing": "x",
+			"x-replace":  "x",
+			"x-removed":  "x",
+			"x-b":        "x",
+			"x-a":        "x",
+		},
+	})
+	if m == nil {
+		t.Fatal("want match")
+	}
+
+	want := RequestTransforms{
+		Headers: []HeaderValue{
+			{Name: PathHeader, Value: "/pets/1?a=2&m=y&q=x&z=1"},
+			{Name: "X-Trace", Value: "a", Append: true},
+			{Name: "X-Trace", Value: "b", Append: true},
+			{Name: "x-pet", Value: "1"},
+			{Name: "x-pet", Value: "2", Append: true},
+			{Name: "X-Tenant", Value: "t"},
+			{Name: "X-Replace", Value: "r"},
+		},
+		RemoveHeaders: []string{"x-a", "x-b", "x-removed"},
+	}
+	if got := m.Transforms(); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %#v, got %#v", want, got)
+	}
+}
+
+func TestStableHeaders(t *testing.T) {
+	got := stableHeaders([]HeaderValue{
+		{Name: "X-A", Value: "1", Append: true},
+		{Name: "x-b", Value: "1"},
+		{Name: "x-a", Value: "2"},
+		{Name: "X-B", Value: "2", Append: true},
+		{Name: "x-a", Value: "3", Append: true},
+	})
+	want := []HeaderValue{
+		{Name: "X-A", Value: "2"},
+		{Name: "X-A", Value: "3", Append: true},
+		{Name: "x-b", Value: "1"},
+		{Name: "x-b", Value: "2", Append: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %#v, got %#v", want, got)
+	}
+}
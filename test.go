@@ -0,0 +1,82 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-envoy/v2/server"
+	"github.com/spf13/cobra"
+)
+
+// testCmd runs test files of requests and expected results against an
+// environment spec file.
+func testCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "test SPEC TESTS...",
+		Short: "Run test cases of requests and expected results against an environment spec file",
+		Long: `Run test cases of requests and expected results against an environment spec file.
+
+Requests are matched, authenticated and transformed as by checks. JWT
+signatures are not verified, and bot rules, DPoP, replay protection and
+consumer authorization are not evaluated. A test file lists the cases:
+
+  tests:
+  - name: list pets
+    request:
+      method: GET
+      path: /v1/petstore/pets
+      headers:
+        authorization: Bearer <JWT>
+    expect:
+      allow: true
+      operation: listPets
+      headers:
+        x-target: pets`,
+		Args: cobra.MinimumNArgs(2),
+		// errors are logged by main
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			spec, err := config.ReadEnvironmentSpec(args[0])
+			if err != nil {
+				return fmt.Errorf("unable to read %s: %v", args[0], err)
+			}
+			var total, failed int
+			for _, f := range args[1:] {
+				tests, err := server.ReadSpecTests(f)
+				if err != nil {
+					return fmt.Errorf("unable to read %s: %v", f, err)
+				}
+				failures, err := server.RunSpecTests(spec, tests.Tests)
+				if err != nil {
+					return fmt.Errorf("invalid %s: %v", args[0], err)
+				}
+				for _, failure := range failures {
+					fmt.Fprintf(cmd.OutOrStdout(), "! %s: %s\n", f, failure)
+				}
+				total += len(tests.Tests)
+				failed += len(failures)
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d of %d test(s) failed", failed, total)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%d test(s) passed\n", total)
+			return nil
+		},
+	}
+	return cmd
+}
@@ -0,0 +1,201 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/alecthomas/participle/v2"
+	"github.com/alecthomas/participle/v2/lexer/stateful"
+)
+
+// Condition is a parsed boolean expression over variables, for example:
+// headers.content-type =~ "^application/json" && !(query.debug == "true").
+// Supported operators are "==", "!=", "=~" (regular expression match), "!",
+// "&&", "||" and parentheses. A variable or literal on its own is true if
+// its value is non-empty.
+type Condition struct {
+	Or []*ConditionAnd `parser:" @@ ( '||' @@ )*"`
+}
+
+// ConditionAnd is a conjunction of terms.
+type ConditionAnd struct {
+	And []*ConditionTerm `parser:" @@ ( '&&' @@ )*"`
+}
+
+// ConditionTerm is a negation, a parenthesized Condition, or a comparison.
+type ConditionTerm struct {
+	Not        *ConditionTerm       `parser:"   '!' @@"`
+	Group      *Condition           `parser:" | '(' @@ ')'"`
+	Comparison *ConditionComparison `parser:" | @@"`
+}
+
+// ConditionComparison compares two operands, or tests one for non-empty.
+type ConditionComparison struct {
+	Left     *ConditionOperand `parser:" @@"`
+	Operator string            `parser:" ( @( '==' | '!=' | '=~' )"`
+	Right    *ConditionOperand `parser:"   @@ )?"`
+	regexp   *regexp.Regexp
+}
+
+// ConditionOperand is a variable name or a quoted string literal.
+type ConditionOperand struct {
+	Variable *string `parser:"   @Ident"`
+	Literal  *string `parser:" | @String"`
+}
+
+var conditionLexer = stateful.MustSimple([]stateful.Rule{
+	{Name: `String`, Pattern: `"(\\.|[^"\\])*"|'(\\.|[^'\\])*'`},
+	{Name: `Operator`, Pattern: `==|!=|=~|&&|\|\||[!()]`},
+	{Name: `Ident`, Pattern: `[a-zA-Z_][a-zA-Z0-9_.:-]*`},
+	{Name: `Whitespace`, Pattern: `\s+`},
+})
+
+var conditionParser = participle.MustBuild(&Condition{},
+	participle.Lexer(conditionLexer),
+	participle.Elide("Whitespace"),
+	participle.Unquote("String"),
+)
+
+// ParseCondition parses a Condition expression
+func ParseCondition(val string) (*Condition, error) {
+	var condition Condition
+	if err := conditionParser.ParseString("", val, &condition); err != nil {
+		return nil, err
+	}
+	if err := condition.compile(); err != nil {
+		return nil, err
+	}
+	return &condition, nil
+}
+
+// compile prepares the regular expressions of any "=~" comparisons
+func (c *Condition) compile() error {
+	for _, and := range c.Or {
+		for _, term := range and.And {
+			if err := term.compile(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *ConditionTerm) compile() error {
+	switch {
+	case t.Not != nil:
+		return t.Not.compile()
+	case t.Group != nil:
+		return t.Group.compile()
+	case t.Comparison != nil && t.Comparison.Operator == "=~":
+		if t.Comparison.Right.Literal == nil {
+			return fmt.Errorf("=~ requires a string literal regular expression")
+		}
+		re, err := regexp.Compile(*t.Comparison.Right.Literal)
+		if err != nil {
+			return err
+		}
+		t.Comparison.regexp = re
+	}
+	return nil
+}
+
+// Evaluate returns the result of the Condition using the passed variables.
+// A nil Condition is always true.
+func (c *Condition) Evaluate(dict VariableDictionary) bool {
+	if c == nil {
+		return true
+	}
+	for _, and := range c.Or {
+		if and.evaluate(dict) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ConditionAnd) evaluate(dict VariableDictionary) bool {
+	for _, term := range c.And {
+		if !term.evaluate(dict) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *ConditionTerm) evaluate(dict VariableDictionary) bool {
+	switch {
+	case t.Not != nil:
+		return !t.Not.evaluate(dict)
+	case t.Group != nil:
+		return t.Group.Evaluate(dict)
+	default:
+		return t.Comparison.evaluate(dict)
+	}
+}
+
+func (c *ConditionComparison) evaluate(dict VariableDictionary) bool {
+	left := c.Left.value(dict)
+	switch c.Operator {
+	case "==":
+		return left == c.Right.value(dict)
+	case "!=":
+		return left != c.Right.value(dict)
+	case "=~":
+		return c.regexp.MatchString(left)
+	default:
+		return left != ""
+	}
+}
+
+func (o *ConditionOperand) value(dict VariableDictionary) string {
+	if o.Literal != nil {
+		return *o.Literal
+	}
+	val, _ := dict.LookupValue(*o.Variable)
+	return val
+}
+
+// Variables returns the names of the variables of the Condition in the order
+// they appear, including duplicates.
+func (c *Condition) Variables() []string {
+	var names []string
+	if c == nil {
+		return names
+	}
+	for _, and := range c.Or {
+		for _, term := range and.And {
+			names = append(names, term.variables()...)
+		}
+	}
+	return names
+}
+
+func (t *ConditionTerm) variables() []string {
+	switch {
+	case t.Not != nil:
+		return t.Not.variables()
+	case t.Group != nil:
+		return t.Group.Variables()
+	}
+	var names []string
+	for _, o := range []*ConditionOperand{t.Comparison.Left, t.Comparison.Right} {
+		if o != nil && o.Variable != nil {
+			names = append(names, *o.Variable)
+		}
+	}
+	return names
+}
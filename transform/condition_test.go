@@ -0,0 +1,112 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"testing"
+)
+
+func TestParseConditionErrors(t *testing.T) {
+	for _, test := range []string{
+		"",
+		"a ==",
+		"(a == b",
+		"a == b)",
+		"a && || b",
+		`a =~ b`,
+		`a =~ "("`,
+		`a = "b"`,
+	} {
+		t.Run(test, func(t *testing.T) {
+			if _, err := ParseCondition(test); err == nil {
+				t.Errorf("%q should not parse", test)
+			}
+		})
+	}
+}
+
+func TestEvaluateCondition(t *testing.T) {
+	dict := mapDict{map[string]string{
+		"headers.content-type": "application/json",
+		"headers.x-debug":      "true",
+		"query.empty":          "",
+		"jwt.foo.sub":          "me",
+	}}
+
+	for _, test := range []struct {
+		condition string
+		want      bool
+	}{
+		{`headers.x-debug == "true"`, true},
+		{`headers.x-debug != "true"`, false},
+		{`headers.x-debug == 'true'`, true},
+		{`"true" == headers.x-debug`, true},
+		{`headers.x-debug`, true},
+		{`query.empty`, false},
+		{`headers.missing`, false},
+		{`!headers.missing`, true},
+		{`headers.content-type =~ "^application/"`, true},
+		{`headers.content-type =~ "xml$"`, false},
+		{`jwt.foo.sub == "me" && headers.x-debug == "false"`, false},
+		{`jwt.foo.sub == "me" || headers.x-debug == "false"`, true},
+		{`!(jwt.foo.sub == "me" && headers.x-debug == "true")`, false},
+		{`headers.missing || query.empty || jwt.foo.sub == "you"`, false},
+		{`(headers.missing || jwt.foo.sub) && !query.empty`, true},
+		{`headers.x-debug == headers.x-debug`, true},
+	} {
+		t.Run(test.condition, func(t *testing.T) {
+			c, err := ParseCondition(test.condition)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := c.Evaluate(dict); got != test.want {
+				t.Errorf("want: %t, got: %t", test.want, got)
+			}
+		})
+	}
+
+	var nilCondition *Condition
+	if !nilCondition.Evaluate(dict) {
+		t.Errorf("nil Condition should be true")
+	}
+}
+
+func TestConditionVariables(t *testing.T) {
+	for _, test := range []struct {
+		condition string
+		want      []string
+	}{
+		{`headers.x-debug`, []string{"headers.x-debug"}},
+		{`"true" == query.debug`, []string{"query.debug"}},
+		{`a == b || !(c =~ "^x") && d`, []string{"a", "b", "c", "d"}},
+		{`"a" == "b"`, nil},
+	} {
+		t.Run(test.condition, func(t *testing.T) {
+			c, err := ParseCondition(test.condition)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := c.Variables()
+			if len(got) != len(test.want) {
+				t.Fatalf("want %v, got %v", test.want, got)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Errorf("want %v, got %v", test.want, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-envoy/v2/config"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/spf13/cobra"
+)
+
+// validateCmd validates environment spec files and, if online, checks the
+// JWKS sources of their JWT authentication requirements.
+func validateCmd() *cobra.Command {
+	var online bool
+	var timeout time.Duration
+	cmd := &cobra.Command{
+		Use:   "validate SPEC...",
+		Short: "Validate environment spec files",
+		Args:  cobra.MinimumNArgs(1),
+		// errors are logged by main
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			specs := make([]config.EnvironmentSpec, 0, len(args))
+			for _, f := range args {
+				spec, err := config.ReadEnvironmentSpec(f)
+				if err != nil {
+					return fmt.Errorf("unable to read %s: %v", f, err)
+				}
+				specs = append(specs, spec)
+			}
+			if !online {
+				if err := config.ValidateEnvironmentSpecs(specs); err != nil {
+					return err
+				}
+				fmt.Fprintln(cmd.OutOrStdout(), "environment specs are valid")
+				return nil
+			}
+
+			checks, err := config.ValidateEnvironmentSpecsOnline(specs, &http.Client{Timeout: timeout})
+			printEndpointChecks(cmd.OutOrStdout(), checks)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), "environment specs are valid")
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&online, "online", false, "Check that the JWKS of each JWT authentication requirement is reachable and has keys")
+	cmd.Flags().DurationVar(&timeout, "timeout", 30*time.Second, "Timeout of each online check request")
+	return cmd
+}
+
+// printEndpointChecks writes one line per check, marking failures with "!".
+func printEndpointChecks(w io.Writer, checks []config.EndpointCheck) {
+	for _, c := range checks {
+		mark := " "
+		if !c.OK() {
+			mark = "!"
+		}
+		fmt.Fprintf(w, "%s %s\n", mark, c)
+	}
+}
+
+// checkSpecEndpoints checks the JWKS sources of the config's environment
+// specs at startup, logging the result of each.
+func checkSpecEndpoints(cfg *config.Config) error {
+	client := &http.Client{Timeout: cfg.Tenant.ClientTimeout}
+	checks, err := config.ValidateEnvironmentSpecsOnline(cfg.EnvironmentSpecs.Inline, client)
+	for _, c := range checks {
+		if c.OK() {
+			log.Infof("environment spec endpoint %s", c)
+		}
+	}
+	return err
+}